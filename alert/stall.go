@@ -0,0 +1,57 @@
+package alert
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+)
+
+// stallCheck tracks the height of a chain, last seen to change at since. A
+// stall is alerted once per height.
+type stallCheck struct {
+	height  uint64
+	since   time.Time
+	alerted bool
+}
+
+// check tells whether to alert at now of the chain at height.
+func (sc *stallCheck) check(height uint64, now time.Time, after time.Duration) bool {
+	if height != sc.height || sc.since.IsZero() {
+		*sc = stallCheck{height: height, since: now}
+		return false
+	}
+	if sc.alerted || now.Sub(sc.since) < after {
+		return false
+	}
+	sc.alerted = true
+	return true
+}
+
+// WatchStall alerts when height, e.g., of the block store, does not increase
+// for after, until ctx is done.
+func WatchStall(ctx context.Context, alerter consensus.Alerter, height func() uint64, after time.Duration) {
+	if after <= 0 {
+		return
+	}
+	ticker := time.NewTicker(after / 4)
+	defer ticker.Stop()
+
+	var sc stallCheck
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			h := height()
+			if sc.check(h, now, after) {
+				alerter.Alert(consensus.Alert{
+					Kind:    consensus.AlertConsensusStall,
+					Height:  h,
+					Message: fmt.Sprintf("no block committed for %v", now.Sub(sc.since).Round(time.Second)),
+				})
+			}
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// Package alert posts the critical events of a node (consensus.Alert) to the
+// webhooks of its operators, e.g., of a paging service, so that they are
+// reached without scraping the logs.
+//
+// Every alert is posted as a JSON Payload to each URL, retried with backoff
+// until it is accepted (a 2xx response) or webhookAttempts fail. Alerts are
+// delivered in order from a queue, and dropped, with a warning in the logs,
+// when the queue is full: reporting must never block the node.
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+var (
+	webhookAttempts = 5
+	webhookBackoff  = time.Second // doubled after every failed attempt
+	webhookTimeout  = 10 * time.Second
+	queueCapacity   = 64
+)
+
+// Payload is the body posted for an alert.
+type Payload struct {
+	consensus.Alert
+	Node    string    `json:"node"`
+	ChainID string    `json:"chain_id"`
+	Time    time.Time `json:"time"`
+}
+
+// Webhooks posts the alerts of a node to URLs. A nil Webhooks drops them.
+type Webhooks struct {
+	urls    []string
+	node    string
+	chainID string
+	client  *http.Client
+
+	mu     sync.Mutex
+	closed bool
+	queue  chan Payload
+	done   chan struct{}
+}
+
+var _ consensus.Alerter = (*Webhooks)(nil)
+
+// NewWebhooks starts delivering the alerts of the node to urls.
+func NewWebhooks(urls []string, node, chainID string) *Webhooks {
+	w := &Webhooks{
+		urls:    urls,
+		node:    node,
+		chainID: chainID,
+		client:  &http.Client{Timeout: webhookTimeout},
+		queue:   make(chan Payload, queueCapacity),
+		done:    make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Alert queues an alert for delivery.
+func (w *Webhooks) Alert(a consensus.Alert) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+
+	select {
+	case w.queue <- Payload{Alert: a, Node: w.node, ChainID: w.chainID, Time: time.Now()}:
+	default:
+		log.Warn("Dropping alert, webhook queue is full", "kind", a.Kind, "height", a.Height, "msg", a.Message)
+	}
+}
+
+// Close stops accepting alerts, and waits up to timeout for the queued ones
+// to be delivered, e.g., before the node exits on the error alerted.
+func (w *Webhooks) Close(timeout time.Duration) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+
+	select {
+	case <-w.done:
+	case <-time.After(timeout):
+		log.Warn("Alerts not delivered in time", "queued", len(w.queue))
+	}
+}
+
+func (w *Webhooks) run() {
+	defer close(w.done)
+	for p := range w.queue {
+		data, err := json.Marshal(&p)
+		if err != nil {
+			log.Error("Cannot encode alert", "kind", p.Kind, "err", err)
+			continue
+		}
+		for _, url := range w.urls {
+			w.deliver(url, data)
+		}
+	}
+}
+
+// deliver posts data to url until it is accepted or all the attempts failed.
+func (w *Webhooks) deliver(url string, data []byte) {
+	backoff := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		err := w.post(url, data)
+		if err == nil {
+			return
+		}
+		if attempt == webhookAttempts {
+			log.Error("Failed to deliver alert", "url", url, "attempts", attempt, "err", err)
+			return
+		}
+		log.Debug("Retrying alert delivery", "url", url, "attempt", attempt, "err", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (w *Webhooks) post(url string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package alert
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhooksRetry(t *testing.T) {
+	webhookBackoff = time.Millisecond
+
+	var calls int32
+	var got Payload
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first attempt fails
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+	}))
+	defer srv.Close()
+
+	w := NewWebhooks([]string{srv.URL}, "node0", "test")
+	w.Alert(consensus.Alert{Kind: consensus.AlertWALCorruption, Height: 7, Message: "checksum mismatch"})
+	w.Close(time.Second)
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	assert.Equal(t, consensus.AlertWALCorruption, got.Kind)
+	assert.Equal(t, uint64(7), got.Height)
+	assert.Equal(t, "node0", got.Node)
+	assert.Equal(t, "test", got.ChainID)
+
+	// dropped once closed, and by a nil Webhooks
+	w.Alert(consensus.Alert{Kind: consensus.AlertConsensusStall})
+	var nilHooks *Webhooks
+	nilHooks.Alert(consensus.Alert{Kind: consensus.AlertConsensusStall})
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestStallCheck(t *testing.T) {
+	now := time.Now()
+	var sc stallCheck
+	assert.False(t, sc.check(5, now, time.Minute))
+	assert.False(t, sc.check(5, now.Add(30*time.Second), time.Minute))
+	assert.True(t, sc.check(5, now.Add(time.Minute), time.Minute))
+	// once per height
+	assert.False(t, sc.check(5, now.Add(2*time.Minute), time.Minute))
+	assert.False(t, sc.check(6, now.Add(2*time.Minute), time.Minute))
+	assert.True(t, sc.check(6, now.Add(3*time.Minute), time.Minute))
+}
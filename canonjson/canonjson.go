@@ -0,0 +1,199 @@
+// Package canonjson encodes values as canonical JSON, the same bytes for the
+// same data whatever the implementation, so other tools can hash or sign a
+// configuration such as a genesis file and get the same result:
+//
+//   - no whitespace, object keys sorted by their bytes;
+//   - strings escape only '"', '\' and the control characters, with
+//     \b \t \n \f \r or else \u00xx, everything else is written as UTF-8;
+//   - integers are written exactly, without exponent nor sign for zero;
+//     other numbers in their shortest round-trip form, with an exponent
+//     below 1e-6 and from 1e21 on (e.g. 1.5e-7, 1e+21), as in ECMAScript;
+//   - strings holding an RFC 3339 timestamp, which is how encoding/json
+//     writes a time.Time, are rewritten in UTC as TimeFormat, so a time
+//     encodes the same in any time zone.
+//
+// Values are first marshalled with encoding/json, so struct tags and custom
+// marshalers apply.
+package canonjson
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// TimeFormat is the format of times: UTC, with nanoseconds.
+const TimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+var ErrInvalidValue = errors.New("value cannot be encoded as canonical JSON")
+
+// Marshal returns the canonical JSON encoding of v.
+func Marshal(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return Canonicalize(data)
+}
+
+// Canonicalize rewrites a JSON document in canonical form.
+func Canonicalize(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("%w: data after the value", ErrInvalidValue)
+	}
+
+	var buf bytes.Buffer
+	if err := encode(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encode(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case json.Number:
+		s, err := formatNumber(string(v))
+		if err != nil {
+			return err
+		}
+		buf.WriteString(s)
+	case string:
+		return encodeString(buf, canonicalTime(v))
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, e := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := encode(buf, e); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		buf.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := encodeString(buf, k); err != nil {
+				return err
+			}
+			buf.WriteByte(':')
+			if err := encode(buf, v[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return fmt.Errorf("%w: %T", ErrInvalidValue, v)
+	}
+	return nil
+}
+
+func isInteger(s string) bool {
+	return !strings.ContainsAny(s, ".eE")
+}
+
+func formatNumber(s string) (string, error) {
+	if isInteger(s) {
+		neg := strings.HasPrefix(s, "-")
+		digits := strings.TrimLeft(strings.TrimPrefix(s, "-"), "0")
+		if digits == "" {
+			return "0", nil
+		}
+		if neg {
+			return "-" + digits, nil
+		}
+		return digits, nil
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+		return "", fmt.Errorf("%w: number %s", ErrInvalidValue, s)
+	}
+	if f == 0 {
+		return "0", nil
+	}
+	if abs := math.Abs(f); abs < 1e-6 || abs >= 1e21 {
+		// shortest digits, exponent without leading zeros: 1e+21, 1.5e-7
+		s := strconv.FormatFloat(f, 'e', -1, 64)
+		mantissa, exp := s[:strings.IndexByte(s, 'e')], s[strings.IndexByte(s, 'e')+1:]
+		sign, exp := exp[:1], strings.TrimLeft(exp[1:], "0")
+		return mantissa + "e" + sign + exp, nil
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64), nil
+}
+
+// canonicalTime rewrites an RFC 3339 timestamp in UTC, other strings are
+// returned as they are.
+func canonicalTime(s string) string {
+	// cheap filter before parsing: 2006-01-02T15:04:05
+	if len(s) < 20 || s[4] != '-' || s[7] != '-' || s[10] != 'T' {
+		return s
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return s
+	}
+	return t.UTC().Format(TimeFormat)
+}
+
+const hex = "0123456789abcdef"
+
+func encodeString(buf *bytes.Buffer, s string) error {
+	if !utf8.ValidString(s) {
+		return fmt.Errorf("%w: invalid UTF-8 in %q", ErrInvalidValue, s)
+	}
+
+	buf.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case c == '\b':
+			buf.WriteString(`\b`)
+		case c == '\t':
+			buf.WriteString(`\t`)
+		case c == '\n':
+			buf.WriteString(`\n`)
+		case c == '\f':
+			buf.WriteString(`\f`)
+		case c == '\r':
+			buf.WriteString(`\r`)
+		case c < 0x20:
+			buf.WriteString(`\u00`)
+			buf.WriteByte(hex[c>>4])
+			buf.WriteByte(hex[c&0xf])
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	buf.WriteByte('"')
+	return nil
+}
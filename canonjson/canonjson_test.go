@@ -0,0 +1,50 @@
+package canonjson
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonicalize(t *testing.T) {
+	for in, out := range map[string]string{
+		`{ "b": 1, "a": [true, null, "x"] }`: `{"a":[true,null,"x"],"b":1}`,
+		`{"z": {"y": 2, "x": 1}}`:            `{"z":{"x":1,"y":2}}`,
+		`-0`:                                 `0`,
+		`18446744073709551615`:               `18446744073709551615`,
+		`1.50`:                               `1.5`,
+		`1E3`:                                `1000`,
+		`0.000001`:                           `0.000001`,
+		`0.00000015`:                         `1.5e-7`,
+		`1e21`:                               `1e+21`,
+		`"<a&b>é\u0001\n"`:                   "\"<a&b>é\\u0001\\n\"",
+		`"2021-06-01T08:00:00+08:00"`:        `"2021-06-01T00:00:00.000000000Z"`,
+		`"2021-06-01 not a time"`:            `"2021-06-01 not a time"`,
+	} {
+		got, err := Canonicalize([]byte(in))
+		assert.NoError(t, err, in)
+		assert.Equal(t, out, string(got), in)
+	}
+
+	_, err := Canonicalize([]byte(`{} {}`))
+	assert.Error(t, err)
+}
+
+func TestMarshal(t *testing.T) {
+	type config struct {
+		Name  string    `json:"name"`
+		Power int64     `json:"power"`
+		Time  time.Time `json:"time"`
+	}
+
+	loc := time.FixedZone("UTC+8", 8*3600)
+	at := time.Date(2021, 6, 1, 8, 0, 0, 0, loc)
+	a, err := Marshal(&config{Name: "val", Power: 10, Time: at})
+	assert.NoError(t, err)
+	b, err := Marshal(map[string]interface{}{"time": at.UTC(), "power": 10, "name": "val"})
+	assert.NoError(t, err)
+
+	assert.Equal(t, `{"name":"val","power":10,"time":"2021-06-01T00:00:00.000000000Z"}`, string(a))
+	assert.Equal(t, a, b)
+}
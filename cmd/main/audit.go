@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/QuarkChain/go-minimal-pbft/invariants"
+	"github.com/QuarkChain/go-minimal-pbft/node"
+	"github.com/spf13/cobra"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+var (
+	auditNodes   *[]string
+	auditDomains *[]string
+	auditJSON    *bool
+)
+
+// AuditCmd runs the invariants against the stores of (stopped) nodes, e.g.,
+// the datadirs of an e2e network, and exits with 1 if any is violated.
+var AuditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Check the stores of nodes against the consensus invariants",
+	RunE:  runAudit,
+}
+
+func init() {
+	auditNodes = AuditCmd.Flags().StringArray("node", nil, "Stores of a node as [name=]datadir[,stateDir], repeated for every node")
+	auditDomains = AuditCmd.Flags().StringArray("domain", nil, "Failure domain of a node as name=domain, e.g., its region")
+	auditJSON = AuditCmd.Flags().Bool("json", false, "Print the violations as JSON lines")
+}
+
+func runAudit(cmd *cobra.Command, args []string) error {
+	if len(*auditNodes) == 0 {
+		return fmt.Errorf("no --node to audit")
+	}
+	domains := make(map[string]string)
+	for _, d := range *auditDomains {
+		kv := strings.SplitN(d, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid --domain %q, expected name=domain", d)
+		}
+		domains[kv[0]] = kv[1]
+	}
+
+	var dbs []*leveldb.DB
+	defer func() {
+		for _, db := range dbs {
+			db.Close()
+		}
+	}()
+	open := func(path string) (*leveldb.DB, error) {
+		db, err := leveldb.OpenFile(path, &opt.Options{ReadOnly: true, ErrorIfMissing: true})
+		if err != nil {
+			return nil, fmt.Errorf("cannot open %s: %w", path, err)
+		}
+		dbs = append(dbs, db)
+		return db, nil
+	}
+
+	var nodes []invariants.Node
+	for _, spec := range *auditNodes {
+		name, dirs := "", spec
+		if kv := strings.SplitN(spec, "=", 2); len(kv) == 2 {
+			name, dirs = kv[0], kv[1]
+		}
+		datadir, stateDir := dirs, ""
+		if d := strings.SplitN(dirs, ",", 2); len(d) == 2 {
+			datadir, stateDir = d[0], d[1]
+		}
+		if name == "" {
+			name = filepath.Base(filepath.Clean(datadir))
+		}
+
+		db, err := open(datadir)
+		if err != nil {
+			return err
+		}
+		stateDB := db
+		if stateDir != "" {
+			if stateDB, err = open(stateDir); err != nil {
+				return err
+			}
+		}
+		nodes = append(nodes, invariants.Node{
+			Name:       name,
+			Domain:     domains[name],
+			Blocks:     node.NewDefaultBlockStore(db),
+			AppHashes:  consensus.NewAppHashStore(stateDB),
+			Validators: consensus.NewValidatorStore(stateDB),
+		})
+	}
+
+	violations := invariants.Run(nodes)
+	for _, v := range violations {
+		if *auditJSON {
+			data, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(data))
+		} else {
+			fmt.Println(v)
+		}
+	}
+	if len(violations) > 0 {
+		fmt.Fprintf(os.Stderr, "%d violations\n", len(violations))
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "%d nodes, no violation\n", len(nodes))
+	return nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/QuarkChain/go-minimal-pbft/examples/counter"
+	"github.com/QuarkChain/go-minimal-pbft/examples/kvstore"
+	"github.com/QuarkChain/go-minimal-pbft/node"
+	"github.com/QuarkChain/go-minimal-pbft/rpc"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/spf13/cobra"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+var (
+	devApp           *string
+	devChainID       *string
+	devRPCAddr       *string
+	devVerbosity     *int
+	devEmptyBlocks   *bool
+	devEmptyInterval *time.Duration
+)
+
+// devApps are the applications dev can run.
+var devApps = map[string]func() consensus.BlockFinalizer{
+	"kvstore": func() consensus.BlockFinalizer { return kvstore.New() },
+	"counter": func() consensus.BlockFinalizer { return counter.New(0) },
+}
+
+// DevCmd runs a chain of a single validator in-process, for developing an
+// application: blocks are made as soon as txs arrive, and nothing is kept.
+var DevCmd = &cobra.Command{
+	Use:   "dev",
+	Short: "Run a single-validator chain in memory, making a block as soon as txs arrive",
+	Long: `Run a single-validator chain in memory, making a block as soon as txs arrive.
+
+The validator key is generated and the blocks and state are kept in memory,
+so every run starts a new chain. Each line read on stdin is submitted as the
+data of a tx, e.g. a=1 with the kvstore, and txs in their binary encoding are
+accepted by abci_broadcastTx on --rpcAddr. Every committed block is logged
+with its txs and app hash.`,
+	RunE: runDev,
+}
+
+func init() {
+	devApp = DevCmd.Flags().String("app", "kvstore", "Application to run: "+strings.Join(devAppNames(), ", "))
+	devChainID = DevCmd.Flags().String("chainID", "dev", "Chain ID")
+	devRPCAddr = DevCmd.Flags().String("rpcAddr", "127.0.0.1:8545", "JSON-RPC listen address (empty to disable)")
+	devVerbosity = DevCmd.Flags().Int("verbosity", 3, "Logging verbosity: 0=silent, 1=error, 2=warn, 3=info, 4=debug, 5=detail")
+	devEmptyBlocks = DevCmd.Flags().Bool("createEmptyBlocks", false, "Make blocks without txs")
+	devEmptyInterval = DevCmd.Flags().Duration("createEmptyBlocksInterval", 0, "Make an empty block when no tx arrived for this long after the last block (0 disables)")
+}
+
+func devAppNames() []string {
+	var names []string
+	for name := range devApps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// devTxPool holds the submitted txs until the next block.
+type devTxPool struct {
+	mu        sync.Mutex
+	txs       []*types.Transaction
+	available chan struct{}
+}
+
+var (
+	_ consensus.TxNotifier = (*devTxPool)(nil)
+	_ rpc.TxSubmitter      = (*devTxPool)(nil)
+)
+
+func newDevTxPool() *devTxPool {
+	return &devTxPool{available: make(chan struct{}, 1)}
+}
+
+func (p *devTxPool) SubmitTx(tx *types.Transaction) error {
+	p.mu.Lock()
+	p.txs = append(p.txs, tx)
+	p.mu.Unlock()
+
+	select {
+	case p.available <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (p *devTxPool) HasTxs() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.txs) > 0
+}
+
+func (p *devTxPool) TxsAvailable() <-chan struct{} {
+	return p.available
+}
+
+// take removes the pending txs. With a single validator, the block they are
+// proposed in is always committed.
+func (p *devTxPool) take() []*types.Transaction {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	txs := p.txs
+	p.txs = nil
+	return txs
+}
+
+// devExecutor proposes the pending txs and logs the committed blocks.
+type devExecutor struct {
+	*consensus.DefaultBlockExecutor
+	txs *devTxPool
+}
+
+func (e *devExecutor) MakeBlock(chainState *consensus.ChainState, height uint64, commit *consensus.Commit, proposerAddress common.Address) *consensus.FullBlock {
+	block := e.DefaultBlockExecutor.MakeBlock(chainState, height, commit, proposerAddress)
+	block.Block = types.NewBlock(block.Header(), e.txs.take(), nil, nil, trie.NewStackTrie(nil))
+	return block
+}
+
+func (e *devExecutor) ApplyBlock(ctx context.Context, state consensus.ChainState, block *consensus.FullBlock) (consensus.ChainState, error) {
+	start := time.Now()
+	newState, err := e.DefaultBlockExecutor.ApplyBlock(ctx, state, block)
+	if err != nil {
+		log.Error("Failed to apply block", "height", block.NumberU64(), "err", err)
+		return newState, err
+	}
+
+	log.Info("Committed block", "height", block.NumberU64(), "hash", block.Hash(), "txs", len(block.Transactions()),
+		"app_hash", hexutil.Bytes(newState.AppHash), "elapsed", time.Since(start))
+	for i, tx := range block.Transactions() {
+		log.Info("  tx", "index", i, "hash", consensus.TxHash(e, tx), "data", fmt.Sprintf("%q", tx.Data()))
+	}
+	if newState.HaltReason != "" {
+		log.Warn("Application halted the chain", "height", block.NumberU64(), "reason", newState.HaltReason)
+	}
+	return newState, nil
+}
+
+func runDev(cmd *cobra.Command, args []string) error {
+	newApp, ok := devApps[*devApp]
+	if !ok {
+		return fmt.Errorf("unknown --app %q, expected one of %s", *devApp, strings.Join(devAppNames(), ", "))
+	}
+
+	glogger := log.NewGlogHandler(log.StreamHandler(os.Stderr, log.TerminalFormat(true)))
+	glogger.Verbosity(log.Lvl(*devVerbosity))
+	log.Root().SetHandler(glogger)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	privVal := consensus.GeneratePrivValidatorLocal()
+	pubVal, err := privVal.GetPubKey(ctx)
+	if err != nil {
+		return err
+	}
+	gcs := consensus.MakeGenesisChainState(*devChainID, uint64(time.Now().UnixMilli()),
+		[]common.Address{pubVal.Address()}, []int64{1}, 128, 1)
+
+	txs := newDevTxPool()
+	bs := node.NewDefaultBlockStore(db)
+	validatorStore := consensus.NewValidatorStore(db)
+	paramsStore := consensus.NewConsensusParamsStore(db)
+	executor := &devExecutor{
+		DefaultBlockExecutor: consensus.NewDefaultBlockExecutor(db,
+			consensus.WithFinalizer(newApp()),
+			consensus.WithValidatorStore(validatorStore),
+			consensus.WithConsensusParamsStore(paramsStore),
+		).(*consensus.DefaultBlockExecutor),
+		txs: txs,
+	}
+
+	// no WAL nor peers: the round of a single validator needs no timeout, and
+	// the next height starts as soon as the block is committed
+	p := params.NewDefaultConsesusConfig()
+	p.TimeoutCommit = 0
+	p.SkipTimeoutCommit = true
+	p.DoubleSignCheckHeight = 0
+
+	sendC := make(chan consensus.Message, 1000)
+	obsvC := make(chan consensus.MsgInfo, 1000)
+	go func() {
+		for {
+			select {
+			case <-sendC:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	consensusState := consensus.NewConsensusState(ctx, p, *gcs, executor, bs, obsvC, sendC,
+		consensus.TxSource(txs), consensus.EmptyBlocks(*devEmptyBlocks, *devEmptyInterval))
+	consensusState.SetPrivValidator(privVal)
+	if err := consensusState.Start(ctx); err != nil {
+		return fmt.Errorf("failed to start consensus: %w", err)
+	}
+
+	if *devRPCAddr != "" {
+		rpcServer, err := rpc.NewServer(*devRPCAddr, &rpc.Environment{
+			BlockStore:      bs,
+			Executor:        executor,
+			ConsensusState:  consensusState,
+			Validators:      validatorStore,
+			ConsensusParams: paramsStore,
+			Txs:             txs,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create RPC server: %w", err)
+		}
+		if err := rpcServer.Start(ctx); err != nil {
+			return fmt.Errorf("failed to start RPC server: %w", err)
+		}
+	}
+
+	log.Info("Running dev chain", "chain", *devChainID, "app", *devApp, "validator", pubVal.Address())
+
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				txs.SubmitTx(types.NewTx(&types.LegacyTx{Data: []byte(line)}))
+			}
+		}
+	}()
+
+	<-ctx.Done()
+	consensusState.Wait()
+	return nil
+}
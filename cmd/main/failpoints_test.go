@@ -0,0 +1,193 @@
+//go:build failpoints
+// +build failpoints
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/QuarkChain/go-minimal-pbft/internal/failpoint"
+	"github.com/QuarkChain/go-minimal-pbft/mempool"
+	"github.com/QuarkChain/go-minimal-pbft/node"
+	"github.com/QuarkChain/go-minimal-pbft/privval"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// The crash tests run the part of the node under test in a child process (the
+// test binary itself) which is killed at a failpoint, then check the on-disk
+// state from the parent as a restarted node would see it.
+//
+//	go test -tags failpoints ./cmd/main
+
+const (
+	crashTestEnv    = "MPBFT_CRASH_TEST"
+	crashTestDirEnv = "MPBFT_CRASH_TEST_DIR"
+)
+
+func TestMain(m *testing.M) {
+	if name := os.Getenv(crashTestEnv); name != "" {
+		crashChildren[name](os.Getenv(crashTestDirEnv))
+		// the failpoint was expected to kill us
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+var crashChildren = map[string]func(dir string){
+	"blockstore": func(dir string) {
+		db, err := leveldb.OpenFile(dir, nil)
+		if err != nil {
+			panic(err)
+		}
+		bs := node.NewDefaultBlockStore(db)
+		bs.SaveBlock(makeTestBlock(1), makeTestCommit(1))
+
+		failpoint.Enable(failpoint.BlockStoreMidPersist, failpoint.Exit)
+		bs.SaveBlock(makeTestBlock(2), makeTestCommit(2))
+	},
+	"mempool-wal": func(dir string) {
+		wal, err := mempool.OpenWAL(filepath.Join(dir, "mempool.wal"))
+		if err != nil {
+			panic(err)
+		}
+		if err := wal.Write([]byte("tx1")); err != nil {
+			panic(err)
+		}
+		if err := wal.Flush(); err != nil {
+			panic(err)
+		}
+
+		failpoint.Enable(failpoint.MempoolWALWrite, failpoint.Exit)
+		wal.Write([]byte("tx2"))
+	},
+	"sign-state": func(dir string) {
+		pv, err := privval.NewFilePV(consensus.GeneratePrivValidatorLocal(), filepath.Join(dir, "state.json"))
+		if err != nil {
+			panic(err)
+		}
+		if err := pv.SignVote(context.Background(), "test", testVote(consensus.PrevoteType, 1)); err != nil {
+			panic(err)
+		}
+
+		failpoint.Enable(failpoint.SignStateWrite, failpoint.Exit)
+		pv.SignVote(context.Background(), "test", testVote(consensus.PrecommitType, 1))
+	},
+}
+
+func testVote(t consensus.SignedMsgType, block byte) *consensus.Vote {
+	return &consensus.Vote{Type: t, Height: 5, Round: 0, BlockID: common.Hash{block}}
+}
+
+// runCrashChild runs the child and checks that it was killed by a failpoint.
+func runCrashChild(t *testing.T, name string, dir string) {
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), crashTestEnv+"="+name, crashTestDirEnv+"="+dir)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != failpoint.ExitCode {
+		t.Fatalf("child %s not killed by failpoint: %v\n%s", name, err, stderr.String())
+	}
+}
+
+func makeTestCommit(height uint64) *consensus.Commit {
+	c := consensus.CommitSig{
+		BlockIDFlag:      consensus.BlockIDFlagCommit,
+		ValidatorAddress: common.Address{},
+		TimestampMs:      1133423,
+		Signature:        []byte{},
+	}
+	return consensus.NewCommit(height, 0, common.BytesToHash([]byte{byte(height)}), []consensus.CommitSig{c})
+}
+
+func makeTestBlock(height uint64) *consensus.FullBlock {
+	return &consensus.FullBlock{Block: types.NewBlock(
+		&consensus.Header{
+			ParentHash:     common.BytesToHash([]byte{byte(height - 1)}),
+			Number:         new(big.Int).SetUint64(height),
+			TimeMs:         34534 + height,
+			Coinbase:       common.Address{},
+			LastCommitHash: common.Hash{},
+			Difficulty:     big.NewInt(1),
+			Extra:          []byte{},
+			BaseFee:        big.NewInt(0),
+			NextValidators: []common.Address{},
+		},
+		[]*types.Transaction{},
+		[]*types.Header{},
+		[]*types.Receipt{},
+		trie.NewStackTrie(nil)),
+		LastCommit: makeTestCommit(height - 1),
+	}
+}
+
+func TestCrashMidBlockPersist(t *testing.T) {
+	dir := t.TempDir()
+	runCrashChild(t, "blockstore", dir)
+
+	db, err := leveldb.OpenFile(dir, nil)
+	assert.NoError(t, err)
+	defer db.Close()
+	bs := node.NewDefaultBlockStore(db)
+
+	// the half persisted block must not be visible
+	assert.Equal(t, uint64(1), bs.Height())
+	assert.NotNil(t, bs.LoadBlock(1))
+	assert.NotNil(t, bs.LoadBlockCommit(1))
+	assert.Nil(t, bs.LoadBlockCommit(2))
+
+	// and the restarted node can persist it again
+	bs.SaveBlock(makeTestBlock(2), makeTestCommit(2))
+	assert.Equal(t, uint64(2), bs.Height())
+	assert.Equal(t, makeTestBlock(2).Hash(), bs.LoadBlock(2).Hash())
+	assert.NotNil(t, bs.LoadBlockCommit(2))
+}
+
+func TestCrashMempoolWALWrite(t *testing.T) {
+	dir := t.TempDir()
+	runCrashChild(t, "mempool-wal", dir)
+
+	wal, err := mempool.OpenWAL(filepath.Join(dir, "mempool.wal"))
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	// only the flushed tx survives, and the WAL is still readable
+	var txs []string
+	n, err := wal.Replay(func(tx []byte) error {
+		txs = append(txs, string(tx))
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []string{"tx1"}, txs)
+}
+
+func TestCrashAfterSignStateWrite(t *testing.T) {
+	dir := t.TempDir()
+	runCrashChild(t, "sign-state", dir)
+
+	// the precommit was recorded before it was signed
+	pv, err := privval.NewFilePV(consensus.GeneratePrivValidatorLocal(), filepath.Join(dir, "state.json"))
+	assert.NoError(t, err)
+	assert.Equal(t, privval.StepPrecommit, pv.LastSignState().Step)
+
+	ctx := context.Background()
+	assert.ErrorIs(t, pv.SignVote(ctx, "test", testVote(consensus.PrevoteType, 1)), privval.ErrDoubleSign)
+	assert.ErrorIs(t, pv.SignVote(ctx, "test", testVote(consensus.PrecommitType, 2)), privval.ErrDoubleSign)
+	// while the interrupted precommit can be signed again
+	assert.NoError(t, pv.SignVote(ctx, "test", testVote(consensus.PrecommitType, 1)))
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	gentxValKeyPath    *string
+	gentxValKeyType    *string
+	gentxChainID       *string
+	gentxGenesisTimeMs *uint64
+	gentxPower         *int64
+	gentxName          *string
+)
+
+// GentxCmd lets a prospective validator produce its signed genesis entry,
+// without sharing anything but the entry itself.
+var GentxCmd = &cobra.Command{
+	Use:   "gentx [OUTFILE]",
+	Short: "Create a signed genesis validator entry",
+	Run:   runGentx,
+	Args:  cobra.ExactArgs(1),
+}
+
+// CollectGentxsCmd verifies the entries of all validators and writes the
+// genesis to be used by all nodes (see --genesis of the node command).
+var CollectGentxsCmd = &cobra.Command{
+	Use:   "collect-gentxs [GENTX_DIR] [GENESIS_FILE]",
+	Short: "Verify the gentxs (*.json) in a directory and assemble the genesis",
+	Run:   runCollectGentxs,
+	Args:  cobra.ExactArgs(2),
+}
+
+func init() {
+	gentxValKeyPath = GentxCmd.Flags().String("valKey", "", "Path to validator key")
+	gentxValKeyType = GentxCmd.Flags().String("valKeyType", keyTypeSecp256k1, "Validator key type: secp256k1 or ed25519")
+	gentxChainID = GentxCmd.Flags().String("chainID", "test", "Chain id of the network")
+	gentxGenesisTimeMs = GentxCmd.Flags().Uint64("genesisTimeMs", 0, "Genesis block timestamp")
+	gentxPower = GentxCmd.Flags().Int64("power", 1, "Voting power of the validator")
+	gentxName = GentxCmd.Flags().String("name", "", "Human-readable validator name (optional)")
+}
+
+func runGentx(cmd *cobra.Command, args []string) {
+	if *gentxValKeyPath == "" || *gentxGenesisTimeMs == 0 {
+		log.Error("Please specify --valKey and --genesisTimeMs")
+		return
+	}
+
+	privVal, err := loadPrivValidator(*gentxValKeyPath, *gentxValKeyType)
+	if err != nil {
+		log.Error("Failed to load validator key", "err", err)
+		return
+	}
+	signer, ok := privVal.(consensus.BytesSigner)
+	if !ok {
+		log.Error("Validator key cannot sign a gentx", "type", *gentxValKeyType)
+		return
+	}
+	pubKey, err := privVal.GetPubKey(context.Background())
+	if err != nil {
+		log.Error("Failed to load validator pub key", "err", err)
+		return
+	}
+
+	gt := &consensus.GenTx{
+		ChainID:       *gentxChainID,
+		GenesisTimeMs: *gentxGenesisTimeMs,
+		Validator: consensus.GenesisValidator{
+			PubKey: fmt.Sprint(pubKey),
+			Power:  *gentxPower,
+			Name:   *gentxName,
+		},
+	}
+	if err := gt.Sign(signer); err != nil {
+		log.Error("Failed to sign gentx", "err", err)
+		return
+	}
+	if _, err := gt.Verify(); err != nil {
+		log.Error("Invalid gentx", "err", err)
+		return
+	}
+
+	if err := writeJSON(args[0], gt); err != nil {
+		log.Error("Failed to write gentx", "err", err)
+		return
+	}
+	log.Info("Gentx created", "address", pubKey.Address(), "file", args[0])
+}
+
+func runCollectGentxs(cmd *cobra.Command, args []string) {
+	files, err := filepath.Glob(filepath.Join(args[0], "*.json"))
+	if err != nil {
+		log.Error("Failed to list gentxs", "err", err)
+		return
+	}
+	sort.Strings(files)
+
+	genTxs := make([]*consensus.GenTx, 0, len(files))
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Error("Failed to read gentx", "file", file, "err", err)
+			return
+		}
+		gt := &consensus.GenTx{}
+		if err := json.Unmarshal(data, gt); err != nil {
+			log.Error("Invalid gentx", "file", file, "err", err)
+			return
+		}
+		genTxs = append(genTxs, gt)
+	}
+
+	g, err := consensus.CollectGenTxs(genTxs)
+	if err != nil {
+		log.Error("Failed to collect gentxs", "err", err)
+		return
+	}
+
+	if err := writeJSON(args[1], g); err != nil {
+		log.Error("Failed to write genesis", "err", err)
+		return
+	}
+
+	hash, err := g.Hash()
+	if err != nil {
+		log.Error("Failed to hash genesis", "err", err)
+		return
+	}
+	names := make([]string, len(g.Validators))
+	for i, val := range g.Validators {
+		names[i] = val.Name
+	}
+	log.Info("Genesis created", "file", args[1], "chain", g.ChainID, "hash", hash, "validators", len(g.Validators), "names", strings.Join(names, ","))
+}
+
+func writeJSON(filename string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, append(data, '\n'), 0644)
+}
@@ -16,11 +16,24 @@ import (
 
 var keyDescription *string
 var nolock *bool
+var keyType *string
 
 const (
 	ValidatorKeyArmoredBlock = "VALIDATOR PRIVATE KEY"
+
+	keyTypeSecp256k1 = "secp256k1"
+	keyTypeEd25519   = "ed25519"
 )
 
+// optionalKeyType is a validator key type that is only compiled in with a
+// build tag, e.g., dilithium.
+type optionalKeyType struct {
+	generate func(filename string) error
+	load     func(filename string) (consensus.PrivValidator, error)
+}
+
+var optionalKeyTypes = map[string]optionalKeyType{}
+
 var KeygenCmd = &cobra.Command{
 	Use:   "keygen [KEYFILE]",
 	Short: "Create validator key at the specified path",
@@ -31,6 +44,7 @@ var KeygenCmd = &cobra.Command{
 func init() {
 	keyDescription = KeygenCmd.Flags().String("desc", "", "Human-readable key description (optional)")
 	nolock = KeygenCmd.Flags().Bool("nolock", false, "Do not lock memory (less safer)")
+	keyType = KeygenCmd.Flags().String("type", keyTypeSecp256k1, "Key type: secp256k1 or ed25519")
 }
 
 func runKeygen(cmd *cobra.Command, args []string) {
@@ -41,7 +55,18 @@ func runKeygen(cmd *cobra.Command, args []string) {
 	}
 	setRestrictiveUmask()
 
-	log.Info("Creating new key", "location", args[0])
+	log.Info("Creating new key", "location", args[0], "type", *keyType)
+
+	if *keyType == keyTypeEd25519 {
+		runKeygenEd25519(args[0])
+		return
+	}
+	if kt, ok := optionalKeyTypes[*keyType]; ok {
+		if err := kt.generate(args[0]); err != nil {
+			log.Error("Failed to generate key", "err", err)
+		}
+		return
+	}
 
 	gk := consensus.GeneratePrivValidatorLocal().(*consensus.PrivValidatorLocal)
 	pk, err := gk.GetPubKey(context.Background())
@@ -59,6 +84,46 @@ func runKeygen(cmd *cobra.Command, args []string) {
 	}
 }
 
+func runKeygenEd25519(filename string) {
+	gk := consensus.GeneratePrivValidatorEd25519().(*consensus.PrivValidatorEd25519)
+	pk, err := gk.GetPubKey(context.Background())
+	if err != nil {
+		log.Error("Failed to get pub key", "err", err)
+		return
+	}
+
+	// the pub key (not only the address) goes into the validator set
+	log.Info("Key generated", "address", pk.Address(), "pubkey", pk)
+
+	if err := writeKeyBytes(gk.PrivKey.Seed(), filename); err != nil {
+		log.Error("Failed to write key", "err", err)
+		return
+	}
+}
+
+// loadPrivValidator loads a validator key of the given type from disk.
+func loadPrivValidator(filename string, keyType string) (consensus.PrivValidator, error) {
+	switch keyType {
+	case keyTypeSecp256k1:
+		key, err := loadValidatorKey(filename)
+		if err != nil {
+			return nil, err
+		}
+		return consensus.NewPrivValidatorLocal(key), nil
+	case keyTypeEd25519:
+		seed, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open file: %w", err)
+		}
+		return consensus.NewPrivValidatorEd25519(seed)
+	default:
+		if kt, ok := optionalKeyTypes[keyType]; ok {
+			return kt.load(filename)
+		}
+		return nil, fmt.Errorf("unknown key type %q", keyType)
+	}
+}
+
 // loadValidatorKey loads a serialized guardian key from disk.
 func loadValidatorKey(filename string) (*ecdsa.PrivateKey, error) {
 	b, err := ioutil.ReadFile(filename)
@@ -76,12 +141,14 @@ func loadValidatorKey(filename string) (*ecdsa.PrivateKey, error) {
 
 // writeValidatorKey serializes a guardian key and writes it to disk.
 func writeValidatorKey(key *ecdsa.PrivateKey, description string, filename string, unsafe bool) error {
+	return writeKeyBytes(crypto.FromECDSA(key), filename)
+}
+
+func writeKeyBytes(b []byte, filename string) error {
 	if _, err := os.Stat(filename); !os.IsNotExist(err) {
 		return errors.New("refusing to override existing key")
 	}
 
-	b := crypto.FromECDSA(key)
-
 	err := ioutil.WriteFile(filename, b, 0600)
 	if err != nil {
 		return fmt.Errorf("failed to write file: %w", err)
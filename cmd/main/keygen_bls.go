@@ -0,0 +1,42 @@
+//go:build bls
+// +build bls
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+const keyTypeBLS12381 = "bls12381"
+
+func init() {
+	optionalKeyTypes[keyTypeBLS12381] = optionalKeyType{
+		generate: generateBLS12381Key,
+		load:     loadBLS12381Key,
+	}
+}
+
+func generateBLS12381Key(filename string) error {
+	gk := consensus.GeneratePrivValidatorBLS12381().(*consensus.PrivValidatorBLS12381)
+	pk, err := gk.GetPubKey(context.Background())
+	if err != nil {
+		return err
+	}
+
+	log.Info("Key generated", "address", pk.Address(), "pubkey", pk)
+
+	return writeKeyBytes(gk.Seed[:], filename)
+}
+
+func loadBLS12381Key(filename string) (consensus.PrivValidator, error) {
+	seed, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	return consensus.NewPrivValidatorBLS12381(seed)
+}
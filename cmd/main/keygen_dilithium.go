@@ -0,0 +1,42 @@
+//go:build dilithium
+// +build dilithium
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+const keyTypeDilithium3 = "dilithium3"
+
+func init() {
+	optionalKeyTypes[keyTypeDilithium3] = optionalKeyType{
+		generate: generateDilithium3Key,
+		load:     loadDilithium3Key,
+	}
+}
+
+func generateDilithium3Key(filename string) error {
+	gk := consensus.GeneratePrivValidatorDilithium3().(*consensus.PrivValidatorDilithium3)
+	pk, err := gk.GetPubKey(context.Background())
+	if err != nil {
+		return err
+	}
+
+	log.Info("Key generated", "address", pk.Address(), "pubkey", pk)
+
+	return writeKeyBytes(gk.Seed[:], filename)
+}
+
+func loadDilithium3Key(filename string) (consensus.PrivValidator, error) {
+	seed, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	return consensus.NewPrivValidatorDilithium3(seed)
+}
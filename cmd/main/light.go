@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/QuarkChain/go-minimal-pbft/light"
+	"github.com/QuarkChain/go-minimal-pbft/rpc/client"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	lightPrimary      *string
+	lightWitnesses    *[]string
+	lightTrustHeight  *uint64
+	lightTrustHash    *string
+	lightTrustPeriod  *time.Duration
+	lightListenAddr   *string
+	lightSyncInterval *time.Duration
+	lightVerbosity    *int
+)
+
+// LightCmd runs a light client: it verifies the headers of the chain from a
+// trusted one, and serves a JSON-RPC proxy of the primary node whose results
+// are checked against them, for wallets not trusting any full node.
+var LightCmd = &cobra.Command{
+	Use:   "light <chain-id>",
+	Short: "Run a light client serving a verifying RPC proxy",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runLight,
+}
+
+func init() {
+	lightPrimary = LightCmd.Flags().String("primary", "", "RPC address of the node serving the light client, e.g. ws://127.0.0.1:8545/websocket")
+	lightWitnesses = LightCmd.Flags().StringSlice("witnesses", nil, "RPC addresses of the nodes the verified headers are checked against")
+	lightTrustHeight = LightCmd.Flags().Uint64("trustHeight", 0, "Height of the trusted header")
+	lightTrustHash = LightCmd.Flags().String("trustHash", "", "Hash of the trusted header")
+	lightTrustPeriod = LightCmd.Flags().Duration("trustPeriod", 14*24*time.Hour, "How long after its time a header verifies the later ones")
+	lightListenAddr = LightCmd.Flags().String("laddr", "127.0.0.1:8546", "Listen address of the proxy")
+	lightSyncInterval = LightCmd.Flags().Duration("syncInterval", time.Second, "How often the latest header is verified")
+	lightVerbosity = LightCmd.Flags().Int("verbosity", 3, "Logging verbosity: 0=silent, 1=error, 2=warn, 3=info, 4=debug, 5=detail")
+}
+
+func runLight(cmd *cobra.Command, args []string) error {
+	if *lightPrimary == "" {
+		return fmt.Errorf("no --primary")
+	}
+	if *lightTrustHeight == 0 || *lightTrustHash == "" {
+		return fmt.Errorf("--trustHeight and --trustHash are required")
+	}
+	trustHash := common.HexToHash(*lightTrustHash)
+	if len(common.FromHex(*lightTrustHash)) != common.HashLength {
+		return fmt.Errorf("invalid --trustHash %q", *lightTrustHash)
+	}
+
+	glogger := log.NewGlogHandler(log.StreamHandler(os.Stderr, log.TerminalFormat(true)))
+	glogger.Verbosity(log.Lvl(*lightVerbosity))
+	log.Root().SetHandler(glogger)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	primary, err := client.Dial(ctx, *lightPrimary)
+	if err != nil {
+		return fmt.Errorf("cannot dial primary: %w", err)
+	}
+	defer primary.Close()
+
+	witnesses := make([]light.Provider, len(*lightWitnesses))
+	for i, addr := range *lightWitnesses {
+		w, err := client.Dial(ctx, addr)
+		if err != nil {
+			return fmt.Errorf("cannot dial witness %s: %w", addr, err)
+		}
+		defer w.Close()
+		witnesses[i] = w
+	}
+	if len(witnesses) == 0 {
+		return errors.New("at least one witness is needed to confirm the headers")
+	}
+
+	lc, err := light.NewClient(ctx, args[0], light.TrustOptions{
+		Height: *lightTrustHeight,
+		Hash:   trustHash,
+		Period: *lightTrustPeriod,
+	}, primary, witnesses)
+	if err != nil {
+		return err
+	}
+	go lc.Sync(ctx, *lightSyncInterval)
+
+	proxy, err := light.NewProxy(*lightListenAddr, lc, light.VerifyStateTreeQuery)
+	if err != nil {
+		return err
+	}
+	if err := proxy.Start(ctx); err != nil {
+		return fmt.Errorf("failed to start proxy: %w", err)
+	}
+
+	<-ctx.Done()
+	return nil
+}
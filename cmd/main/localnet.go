@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/spf13/cobra"
+)
+
+var (
+	localnetNodes       *int
+	localnetDir         *string
+	localnetBasePort    *uint
+	localnetRPCBasePort *uint
+)
+
+// LocalnetCmd runs a network of validator nodes on localhost, each in its own
+// process, with a prompt to pause, restart and partition them.
+var LocalnetCmd = &cobra.Command{
+	Use:   "localnet [-- NODE_FLAGS...]",
+	Short: "Run a local network of validator nodes with a control prompt",
+	Long: `Run a local network of validator nodes with a control prompt.
+
+The keys, genesis time and data of the nodes are kept in --dir, so running
+it again restarts the same network. The flags after -- are passed to every
+node, e.g. -- --timeoutCommitMs=1000.
+
+Commands of the prompt, nodes are numbered from 1:
+  status                    list the nodes
+  pause N / resume N        stop and continue the process of node N
+  stop N / start N          shut down and start node N again
+  partition 1,2 3,4         disconnect the groups of nodes from each other
+  heal                      undo the partition
+  quit                      shut down all the nodes and exit`,
+	Run: runLocalnet,
+}
+
+func init() {
+	localnetNodes = LocalnetCmd.Flags().Int("nodes", 4, "Number of validator nodes")
+	localnetDir = LocalnetCmd.Flags().String("dir", "./localnet", "Path to the keys and data of the nodes")
+	localnetBasePort = LocalnetCmd.Flags().Uint("basePort", 9100, "P2P port of node 1, node N listens on basePort+N-1")
+	localnetRPCBasePort = LocalnetCmd.Flags().Uint("rpcBasePort", 0, "JSON-RPC port of node 1, like --basePort (0 to disable)")
+}
+
+// colors of the log prefixes of the nodes
+var localnetColors = []string{"31", "32", "33", "34", "35", "36", "91", "92", "93", "94", "95", "96"}
+
+type localNode struct {
+	index  int // from 1
+	home   string
+	peerID peer.ID
+	args   []string
+
+	cmd    *exec.Cmd
+	done   chan struct{}
+	paused bool
+}
+
+func (n *localNode) name() string {
+	return fmt.Sprintf("node%d", n.index)
+}
+
+func (n *localNode) denyFile() string {
+	return filepath.Join(n.home, "denied_peers")
+}
+
+func (n *localNode) running() bool {
+	if n.done == nil {
+		return false
+	}
+	select {
+	case <-n.done:
+		return false
+	default:
+		return true
+	}
+}
+
+type localnet struct {
+	mu    sync.Mutex
+	out   sync.Mutex // serializes the log lines of the nodes
+	nodes []*localNode
+}
+
+func runLocalnet(cmd *cobra.Command, args []string) {
+	if *localnetNodes <= 0 || *localnetNodes > len(localnetColors) {
+		log.Error("Invalid number of nodes", "nodes", *localnetNodes, "max", len(localnetColors))
+		return
+	}
+
+	ln, err := setupLocalnet(*localnetDir, *localnetNodes, args)
+	if err != nil {
+		log.Error("Failed to set up localnet", "err", err)
+		return
+	}
+
+	for _, n := range ln.nodes {
+		if err := ln.start(n); err != nil {
+			log.Error("Failed to start node", "node", n.name(), "err", err)
+			ln.stopAll()
+			return
+		}
+		// the first node is the one the others bootstrap from
+		if n.index == 1 {
+			time.Sleep(time.Second)
+		}
+	}
+
+	sigC := make(chan os.Signal, 1)
+	signal.Notify(sigC, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigC
+		ln.stopAll()
+		os.Exit(0)
+	}()
+
+	ln.prompt(os.Stdin)
+	ln.stopAll()
+}
+
+// setupLocalnet creates the keys of the nodes and the genesis time, unless
+// they are already in dir.
+func setupLocalnet(dir string, numNodes int, extraArgs []string) (*localnet, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	genesisTimeMs, err := localnetGenesisTime(filepath.Join(dir, "genesis_time_ms"))
+	if err != nil {
+		return nil, err
+	}
+
+	ln := &localnet{}
+	var bootstrap []string
+	var valArgs []string
+	for i := 1; i <= numNodes; i++ {
+		home, err := filepath.Abs(filepath.Join(dir, fmt.Sprintf("node%d", i)))
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(home, 0700); err != nil {
+			return nil, err
+		}
+
+		nodeKey, err := getOrCreateNodeKey(filepath.Join(home, "node.key"))
+		if err != nil {
+			return nil, err
+		}
+		peerID, err := peer.IDFromPrivateKey(nodeKey)
+		if err != nil {
+			return nil, err
+		}
+
+		valKey := filepath.Join(home, "val.key")
+		if _, err := os.Stat(valKey); os.IsNotExist(err) {
+			pv := consensus.GeneratePrivValidatorLocal().(*consensus.PrivValidatorLocal)
+			if err := writeValidatorKey(pv.PrivKey, "", valKey, false); err != nil {
+				return nil, err
+			}
+		}
+		privVal, err := loadPrivValidator(valKey, keyTypeSecp256k1)
+		if err != nil {
+			return nil, err
+		}
+		pubKey, err := privVal.GetPubKey(context.Background())
+		if err != nil {
+			return nil, err
+		}
+
+		port := *localnetBasePort + uint(i-1)
+		bootstrap = append(bootstrap, fmt.Sprintf("/ip4/127.0.0.1/udp/%d/quic/p2p/%s", port, peerID))
+		valArgs = append(valArgs, "--validatorSet="+pubKey.Address().Hex())
+
+		n := &localNode{index: i, home: home, peerID: peerID}
+		n.args = []string{
+			"node",
+			"--nodeName=" + n.name(),
+			"--nodeKey=" + filepath.Join(home, "node.key"),
+			"--valKey=" + valKey,
+			"--datadir=" + filepath.Join(home, "data"),
+			"--port=" + strconv.FormatUint(uint64(port), 10),
+			"--genesisTimeMs=" + strconv.FormatUint(genesisTimeMs, 10),
+			"--p2pDenyPeersFile=" + n.denyFile(),
+		}
+		if *localnetRPCBasePort != 0 {
+			n.args = append(n.args, fmt.Sprintf("--rpcAddr=127.0.0.1:%d", *localnetRPCBasePort+uint(i-1)))
+		}
+		ln.nodes = append(ln.nodes, n)
+	}
+
+	for _, n := range ln.nodes {
+		n.args = append(n.args, "--bootstrap="+strings.Join(bootstrap, ","))
+		n.args = append(n.args, valArgs...)
+		n.args = append(n.args, extraArgs...)
+		// a partition does not survive the localnet
+		if err := os.Remove(n.denyFile()); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+func localnetGenesisTime(path string) (uint64, error) {
+	b, err := ioutil.ReadFile(path)
+	if err == nil {
+		return strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	t := uint64(time.Now().UnixMilli())
+	return t, ioutil.WriteFile(path, []byte(strconv.FormatUint(t, 10)), 0600)
+}
+
+func (ln *localnet) start(n *localNode) error {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+
+	if n.running() {
+		return fmt.Errorf("%s is already running", n.name())
+	}
+
+	cmd := exec.Command(os.Args[0], n.args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	prefix := fmt.Sprintf("\x1b[%sm%-6s|\x1b[0m ", localnetColors[n.index-1], n.name())
+	go ln.copyLines(prefix, stdout, &wg)
+	go ln.copyLines(prefix, stderr, &wg)
+
+	n.cmd, n.paused = cmd, false
+	n.done = make(chan struct{})
+	go func(done chan struct{}) {
+		wg.Wait()
+		err := cmd.Wait()
+		ln.printf("%s exited: %v\n", n.name(), err)
+		close(done)
+	}(n.done)
+	return nil
+}
+
+func (ln *localnet) copyLines(prefix string, r io.Reader, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		ln.out.Lock()
+		fmt.Fprintln(os.Stdout, prefix+scanner.Text())
+		ln.out.Unlock()
+	}
+}
+
+func (ln *localnet) printf(format string, a ...interface{}) {
+	ln.out.Lock()
+	defer ln.out.Unlock()
+	fmt.Fprintf(os.Stdout, format, a...)
+}
+
+func (ln *localnet) stop(n *localNode) error {
+	ln.mu.Lock()
+	if !n.running() {
+		ln.mu.Unlock()
+		return fmt.Errorf("%s is not running", n.name())
+	}
+	if n.paused {
+		n.cmd.Process.Signal(syscall.SIGCONT)
+		n.paused = false
+	}
+	n.cmd.Process.Signal(os.Interrupt)
+	done := n.done
+	ln.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		n.cmd.Process.Kill()
+		<-done
+	}
+	return nil
+}
+
+func (ln *localnet) stopAll() {
+	for _, n := range ln.nodes {
+		if n.running() {
+			ln.stop(n)
+		}
+	}
+}
+
+func (ln *localnet) signal(n *localNode, sig syscall.Signal, paused bool) error {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+
+	if !n.running() {
+		return fmt.Errorf("%s is not running", n.name())
+	}
+	if err := n.cmd.Process.Signal(sig); err != nil {
+		return err
+	}
+	n.paused = paused
+	return nil
+}
+
+// partition makes the nodes of each group deny the nodes of the others.
+// Nodes in no group are alone in theirs.
+func (ln *localnet) partition(groups [][]*localNode) error {
+	group := make(map[*localNode]int)
+	for i, g := range groups {
+		for _, n := range g {
+			if _, ok := group[n]; ok {
+				return fmt.Errorf("%s is in several groups", n.name())
+			}
+			group[n] = i
+		}
+	}
+	for _, n := range ln.nodes {
+		if _, ok := group[n]; !ok {
+			group[n] = len(groups) + n.index
+		}
+	}
+
+	for _, n := range ln.nodes {
+		var denied []string
+		for _, other := range ln.nodes {
+			if group[other] != group[n] {
+				denied = append(denied, other.peerID.String())
+			}
+		}
+		if err := ioutil.WriteFile(n.denyFile(), []byte(strings.Join(denied, "\n")+"\n"), 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ln *localnet) heal() error {
+	for _, n := range ln.nodes {
+		if err := ioutil.WriteFile(n.denyFile(), nil, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ln *localnet) node(arg string) (*localNode, error) {
+	i, err := strconv.Atoi(strings.TrimPrefix(arg, "node"))
+	if err != nil || i < 1 || i > len(ln.nodes) {
+		return nil, fmt.Errorf("no node %q, nodes are 1 to %d", arg, len(ln.nodes))
+	}
+	return ln.nodes[i-1], nil
+}
+
+func (ln *localnet) status() {
+	for _, n := range ln.nodes {
+		state := "stopped"
+		if n.running() {
+			state = fmt.Sprintf("running (pid %d)", n.cmd.Process.Pid)
+			if n.paused {
+				state = fmt.Sprintf("paused (pid %d)", n.cmd.Process.Pid)
+			}
+		}
+		ln.printf("%s %s %s\n", n.name(), n.peerID, state)
+	}
+}
+
+var errQuit = errors.New("quit")
+
+func (ln *localnet) exec(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+
+	switch cmd, args := fields[0], fields[1:]; cmd {
+	case "quit", "exit":
+		return errQuit
+	case "status":
+		ln.status()
+		return nil
+	case "heal":
+		return ln.heal()
+	case "partition":
+		var groups [][]*localNode
+		for _, arg := range args {
+			var g []*localNode
+			for _, s := range strings.Split(arg, ",") {
+				n, err := ln.node(s)
+				if err != nil {
+					return err
+				}
+				g = append(g, n)
+			}
+			groups = append(groups, g)
+		}
+		if len(groups) < 2 {
+			return errors.New("usage: partition 1,2 3,4")
+		}
+		return ln.partition(groups)
+	case "pause", "resume", "stop", "start":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: %s N", cmd)
+		}
+		n, err := ln.node(args[0])
+		if err != nil {
+			return err
+		}
+		switch cmd {
+		case "pause":
+			return ln.signal(n, syscall.SIGSTOP, true)
+		case "resume":
+			return ln.signal(n, syscall.SIGCONT, false)
+		case "stop":
+			return ln.stop(n)
+		default:
+			return ln.start(n)
+		}
+	default:
+		return fmt.Errorf("unknown command %q, see localnet --help", cmd)
+	}
+}
+
+func (ln *localnet) prompt(in io.Reader) {
+	scanner := bufio.NewScanner(in)
+	ln.printf("> ")
+	for scanner.Scan() {
+		if err := ln.exec(scanner.Text()); err == errQuit {
+			return
+		} else if err != nil {
+			ln.printf("error: %v\n", err)
+		}
+		ln.printf("> ")
+	}
+}
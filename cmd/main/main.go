@@ -26,6 +26,15 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.guardiand.yaml)")
 	rootCmd.AddCommand(NodeCmd)
 	rootCmd.AddCommand(KeygenCmd)
+	rootCmd.AddCommand(VerifyReplayCmd)
+	rootCmd.AddCommand(ReplayFromCmd)
+	rootCmd.AddCommand(GentxCmd)
+	rootCmd.AddCommand(CollectGentxsCmd)
+	rootCmd.AddCommand(LocalnetCmd)
+	rootCmd.AddCommand(DBCmd)
+	rootCmd.AddCommand(AuditCmd)
+	rootCmd.AddCommand(DevCmd)
+	rootCmd.AddCommand(LightCmd)
 }
 
 // initConfig reads in config file and ENV variables if set.
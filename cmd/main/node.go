@@ -2,46 +2,126 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/QuarkChain/go-minimal-pbft/alert"
 	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/QuarkChain/go-minimal-pbft/mempool"
+	"github.com/QuarkChain/go-minimal-pbft/metrics"
+	"github.com/QuarkChain/go-minimal-pbft/node"
 	"github.com/QuarkChain/go-minimal-pbft/p2p"
+	"github.com/QuarkChain/go-minimal-pbft/privval"
+	"github.com/QuarkChain/go-minimal-pbft/rpc"
+	"github.com/QuarkChain/go-minimal-pbft/rpc/grpcapi"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/params"
 	"github.com/libp2p/go-libp2p-core/peer"
 	"github.com/mattn/go-colorable"
 	"github.com/mattn/go-isatty"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/cobra"
 	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/opt"
 
 	p2pcrypto "github.com/libp2p/go-libp2p-core/crypto"
 )
 
+// how long the alerts queued when the node exits may take to be delivered
+const alertFlushTimeout = 10 * time.Second
+
 var (
-	p2pNetworkID  *string
-	p2pPort       *uint
-	p2pBootstrap  *string
-	nodeKeyPath   *string
-	valKeyPath    *string
-	nodeName      *string
-	verbosity     *int
-	datadir       *string
-	validatorSet  *[]string
-	genesisTimeMs *uint64
-	skipBlockSync *bool
-	powerStr      *string
+	p2pNetworkID   *string
+	p2pPort        *uint
+	p2pWSPort      *uint
+	p2pBootstrap   *string
+	p2pCompress    *bool
+	p2pBlockParts  *bool
+	p2pSignCtrl    *bool
+	p2pRelay       *bool
+	alertWebhooks  *[]string
+	alertStall     *time.Duration
+	p2pVoteRelays  *int
+	p2pDenyFile    *string
+	p2pMode        *string
+	p2pTLSCert     *string
+	p2pTLSKey      *string
+	p2pTLSCA       *string
+	p2pTrusted     *string
+	p2pMinOutbound *float64
+	p2pRotateEvery *time.Duration
+	p2pRotateShare *float64
+	nodeKeyPath    *string
+	valKeyPath     *string
+	valKeyType     *string
+	valStatePath   *string
+	vaultAddr      *string
+	vaultKey       *string
+	vaultMount     *string
+	vaultRoleID    *string
+	vaultSecretID  *string
+	vaultNamespace *string
+	vaultCACert    *string
+	vaultProbe     *time.Duration
+	nodeName       *string
+	verbosity      *int
+	datadir        *string
+	blockStoreDir  *string
+	stateDir       *string
+	walDir         *string
+	dbCompactEvery *time.Duration
+	validatorSet   *[]string
+	genesisPath    *string
+	genesisTimeMs  *uint64
+	skipBlockSync  *bool
+	doubleSignChk  *bool
+	storeCheck     *bool
+	unsafeNoWAL    *bool
+	walMaxSize     *int64
+	walMaxFiles    *int
+	walFsync       *string
+	walFsyncEvery  *time.Duration
+	powerStr       *string
 
 	timeoutCommitMs    *uint64
+	timeoutPropose     *time.Duration
+	timeoutProposeD    *time.Duration
+	targetBlockTime    *time.Duration
+	proposeMaxWait     *time.Duration
+	createEmptyBlocks  *bool
+	fastPathCommit     *bool
+	pipelineProposals  *bool
+	emptyBlockInterval *time.Duration
+	mempoolSize        *int
+	mempoolRecheck     *bool
+	timeoutPrevote     *time.Duration
+	timeoutPrevoteD    *time.Duration
+	timeoutPrecommit   *time.Duration
+	timeoutPrecommitD  *time.Duration
 	consensusSyncMs    *uint64
+	heightTimings      *uint64
 	proposerRepetition *uint64
+	haltHeight         *uint64
+	haltTime           *uint64
+	misbehave          *string
+	safetyChecks       *string
+
+	rpcAddr          *string
+	rpcAdmin         *bool
+	rpcIPC           *string
+	grpcAddr         *string
+	metricsNamespace *string
+	nodeApp          *string
 )
 
 var NodeCmd = &cobra.Command{
@@ -53,7 +133,24 @@ var NodeCmd = &cobra.Command{
 func init() {
 	p2pNetworkID = NodeCmd.Flags().String("network", "/mpbft/dev", "P2P network identifier")
 	p2pPort = NodeCmd.Flags().Uint("port", 8999, "P2P UDP listener port")
+	p2pWSPort = NodeCmd.Flags().Uint("p2pWebsocketPort", 0, "Also listen with websockets on this TCP port, e.g. 443 for peers behind firewalls letting only web traffic out (0 disables)")
 	p2pBootstrap = NodeCmd.Flags().String("bootstrap", "", "P2P bootstrap peers (comma-separated)")
+	p2pCompress = NodeCmd.Flags().Bool("p2pCompressProposals", false, "Compress the tx payloads of proposed blocks (all peers must run a version decoding them)")
+	p2pBlockParts = NodeCmd.Flags().Bool("p2pBlockParts", false, "Announce large proposals by the Merkle root of their parts, fetched from several peers at once (all peers must run a version fetching them)")
+	p2pSignCtrl = NodeCmd.Flags().Bool("p2pSignControlMessages", false, "Sign consensus sync requests (round step and has-vote hints) with the node key")
+	p2pRelay = NodeCmd.Flags().Bool("p2pRelay", false, "Relay the votes of the validators sending them to us (see --p2pVoteRelays)")
+	alertWebhooks = NodeCmd.Flags().StringArray("alertWebhook", nil, "URL to POST the critical events to as JSON, e.g. double signs prevented or a stalled chain (repeated for several)")
+	alertStall = NodeCmd.Flags().Duration("alertStallAfter", 5*time.Minute, "Alert the webhooks when no block is committed for this long (0 disables)")
+	p2pVoteRelays = NodeCmd.Flags().Int("p2pVoteRelays", 0, "Send our votes to this many --p2pRelay peers instead of gossiping them, e.g. on a constrained uplink (0 to gossip)")
+	p2pDenyFile = NodeCmd.Flags().String("p2pDenyPeersFile", "", "File of peer IDs (one per line) not to connect to, re-read when it changes; used by localnet partitions")
+	p2pMode = NodeCmd.Flags().String("p2pMode", "full", "P2P connection mode: full, dialOnly (never accept connections, e.g. a validator behind a firewall) or listenOnly (never dial, e.g. a sentry in a DMZ)")
+	p2pTLSCert = NodeCmd.Flags().String("p2pTLSCert", "", "PEM certificate chain issued by the operator CA for the node peer ID (URI SAN libp2p:<peer ID>), proven to every peer after connecting (the transport TLS keeps its libp2p certificates); requires all peers to have one")
+	p2pTLSKey = NodeCmd.Flags().String("p2pTLSKey", "", "PEM key of the p2pTLSCert certificate")
+	p2pTLSCA = NodeCmd.Flags().String("p2pTLSCA", "", "PEM certificates of the operator CA the peer certificates must be issued by")
+	p2pTrusted = NodeCmd.Flags().String("p2pTrustedPeers", "", "P2P peers (comma-separated multiaddrs) to stay connected to, never refused nor rotated out")
+	p2pMinOutbound = NodeCmd.Flags().Float64("p2pMinOutboundRatio", p2p.DefaultEclipseConfig.MinOutboundRatio, "Minimum share of peers dialed by the node, above which inbound connections are refused (0 disables)")
+	p2pRotateEvery = NodeCmd.Flags().Duration("p2pInboundRotateInterval", p2p.DefaultEclipseConfig.InboundRotateInterval, "Interval of the disconnection of a share of the inbound peers (0 disables)")
+	p2pRotateShare = NodeCmd.Flags().Float64("p2pInboundRotateFraction", p2p.DefaultEclipseConfig.InboundRotateFraction, "Share of the inbound peers disconnected every --p2pInboundRotateInterval")
 
 	nodeName = NodeCmd.Flags().String("nodeName", "", "Node name to announce in gossip heartbeats")
 	nodeKeyPath = NodeCmd.Flags().String("nodeKey", "", "Path to node key (will be generated if it doesn't exist)")
@@ -61,20 +158,83 @@ func init() {
 	verbosity = NodeCmd.Flags().Int("verbosity", 3, "Logging verbosity: 0=silent, 1=error, 2=warn, 3=info, 4=debug, 5=detail")
 
 	valKeyPath = NodeCmd.Flags().String("valKey", "", "Path to validator key (empty if not a validator)")
+	valKeyType = NodeCmd.Flags().String("valKeyType", keyTypeSecp256k1, "Validator key type: secp256k1 or ed25519")
+	valStatePath = NodeCmd.Flags().String("valState", "", "Path to the last signed height/round/step of the validator, refusing to sign below it (defaults to <datadir>/priv_validator_state.json)")
+	vaultAddr = NodeCmd.Flags().String("vaultAddr", "", "Address of the HashiCorp Vault signing with an ed25519 key of its transit engine instead of --valKey, authenticated by $VAULT_TOKEN or --vaultRoleID")
+	vaultKey = NodeCmd.Flags().String("vaultKey", "", "Name of the Vault transit key of the validator")
+	vaultMount = NodeCmd.Flags().String("vaultMount", "transit", "Path of the Vault transit engine")
+	vaultRoleID = NodeCmd.Flags().String("vaultRoleID", "", "Vault AppRole role ID to log in with instead of $VAULT_TOKEN")
+	vaultSecretID = NodeCmd.Flags().String("vaultSecretIDFile", "", "Path to the secret ID of --vaultRoleID")
+	vaultNamespace = NodeCmd.Flags().String("vaultNamespace", "", "Vault Enterprise namespace of the transit engine")
+	vaultCACert = NodeCmd.Flags().String("vaultCACert", "", "PEM certificates of the CA of the Vault server (defaults to the system roots)")
+	vaultProbe = NodeCmd.Flags().Duration("vaultHealthInterval", 30*time.Second, "Interval of the Vault health probes (0 disables)")
 
 	datadir = NodeCmd.Flags().String("datadir", "./datadir", "Path to database")
+	blockStoreDir = NodeCmd.Flags().String("blockStoreDir", "", "Path to the block store (defaults to --datadir)")
+	stateDir = NodeCmd.Flags().String("stateDir", "", "Path to the state store (defaults to the block store)")
+	walDir = NodeCmd.Flags().String("walDir", "", "Path to the WALs, best on low-latency storage (defaults to <datadir>/wal)")
+	dbCompactEvery = NodeCmd.Flags().Duration("dbCompactInterval", 0, "Interval of the full compactions of the stores, reclaiming the space of deleted data (0 disables)")
 
-	validatorSet = NodeCmd.Flags().StringArray("validatorSet", []string{}, "List of validators")
+	validatorSet = NodeCmd.Flags().StringArray("validatorSet", []string{}, "List of validators (hex address, or ed25519:<hex pubkey>)")
 	genesisTimeMs = NodeCmd.Flags().Uint64("genesisTimeMs", 0, "Genesis block timestamp")
+	genesisPath = NodeCmd.Flags().String("genesis", "", "Path to genesis from collect-gentxs (overrides --validatorSet, --valPowers, and --genesisTimeMs)")
 	skipBlockSync = NodeCmd.Flags().Bool("skipBlockSync", false, "Skip block sync")
+	doubleSignChk = NodeCmd.Flags().Bool("doubleSignCheck", true, "Refuse to start if peers hold votes signed by the validator key above the local state (disable to override, e.g., after checking the key is not signing elsewhere)")
+	storeCheck = NodeCmd.Flags().Bool("storeIntegrityCheck", true, "Refuse to start if the block store, state store and WAL were not left at the same height, e.g., restored from different backups (disable to override)")
+	unsafeNoWAL = NodeCmd.Flags().Bool("unsafeDisableWAL", false, "UNSAFE: write no WAL nor sign state and skip the double-sign checks, for throwaway load-test networks only; a restarted validator may double sign")
+	walMaxSize = NodeCmd.Flags().Int64("walMaxFileSize", consensus.DefaultWALConfig.MaxFileSize, "Size in bytes above which the consensus WAL is rotated")
+	walMaxFiles = NodeCmd.Flags().Int("walMaxFiles", consensus.DefaultWALConfig.MaxFiles, "Rotated consensus WAL files kept")
+	walFsync = NodeCmd.Flags().String("walFsync", "always", "When to fsync the consensus WAL: always (before acting on our own messages), interval (at most every --walFsyncInterval, a crash may lose our latest votes) or never")
+	walFsyncEvery = NodeCmd.Flags().Duration("walFsyncInterval", consensus.DefaultWALConfig.FsyncInterval, "Minimum interval between consensus WAL fsyncs with --walFsync=interval")
 	powerStr = NodeCmd.Flags().String("valPowers", "", "comma seperated voting powers")
 
 	timeoutCommitMs = NodeCmd.Flags().Uint64("timeoutCommitMs", 5000, "Timeout commit in ms")
+	// round r waits timeout + r * delta, so a network slower than the
+	// timeouts still decides once the rounds get long enough
+	timeouts := params.NewDefaultConsesusConfig()
+	timeoutPropose = NodeCmd.Flags().Duration("timeoutPropose", timeouts.TimeoutPropose, "How long to wait for the proposal of round 0")
+	timeoutProposeD = NodeCmd.Flags().Duration("timeoutProposeDelta", timeouts.TimeoutProposeDelta, "Increase of the propose timeout per round")
+	targetBlockTime = NodeCmd.Flags().Duration("targetBlockTime", 0, "Block interval the proposer waits for before proposing when consensus is faster (0 disables)")
+	proposeMaxWait = NodeCmd.Flags().Duration("targetBlockTimeMaxWait", 0, "Maximum wait of the proposer for --targetBlockTime (defaults to it), at most half --timeoutPropose")
+	fastPathCommit = NodeCmd.Flags().Bool("fastPathCommit", true, "Start the next height as soon as all the validators precommitted, without waiting for --timeoutCommitMs")
+	pipelineProposals = NodeCmd.Flags().Bool("pipelineProposals", false, "Reap the txs of our proposal of the next height while the committed block is applied; the txs arriving meanwhile wait for a later block")
+	createEmptyBlocks = NodeCmd.Flags().Bool("createEmptyBlocks", true, "Propose blocks without txs; without, round 0 waits for txs in the mempool")
+	emptyBlockInterval = NodeCmd.Flags().Duration("createEmptyBlocksInterval", 0, "Propose an empty block only this long after the last block, when no tx is pending (0 disables)")
+	mempoolSize = NodeCmd.Flags().Int("mempoolSize", mempool.DefaultConfig.Size, "Number of pending txs above which the mempool refuses txs")
+	mempoolRecheck = NodeCmd.Flags().Bool("mempoolRecheck", mempool.DefaultConfig.Recheck, "Check the pending txs again after every block")
+	timeoutPrevote = NodeCmd.Flags().Duration("timeoutPrevote", timeouts.TimeoutPrevote, "How long to wait for more prevotes after +2/3 of any in round 0")
+	timeoutPrevoteD = NodeCmd.Flags().Duration("timeoutPrevoteDelta", timeouts.TimeoutPrevoteDelta, "Increase of the prevote timeout per round")
+	timeoutPrecommit = NodeCmd.Flags().Duration("timeoutPrecommit", timeouts.TimeoutPrecommit, "How long to wait for more precommits after +2/3 of any in round 0")
+	timeoutPrecommitD = NodeCmd.Flags().Duration("timeoutPrecommitDelta", timeouts.TimeoutPrecommitDelta, "Increase of the precommit timeout per round")
 	consensusSyncMs = NodeCmd.Flags().Uint64("consensusSyncMs", 500, "Consensus sync in ms")
+	heightTimings = NodeCmd.Flags().Uint64("heightTimings", consensus.DefaultHeightTimings, "Number of recent heights to keep the stage timings of, served by consensus_heightTimings (0 disables)")
 	proposerRepetition = NodeCmd.Flags().Uint64("proposerRepetition", 8, "proposer repetition")
+	haltHeight = NodeCmd.Flags().Uint64("haltHeight", 0, "Commit up to this height, then shut down, e.g., to upgrade the binary with the rest of the network (0 disables)")
+	haltTime = NodeCmd.Flags().Uint64("haltTime", 0, "Commit up to the first block at or after this unix time in seconds, then shut down (0 disables)")
+	misbehave = NodeCmd.Flags().String("misbehave", "", "Byzantine misbehaviors for integration tests, e.g. equivocate@5-8,withhold-proposal (needs the byzantine build tag)")
+	safetyChecks = NodeCmd.Flags().String("safetyChecks", "", "Check the safety invariants of the state machine on every transition, reporting violations with \"log\" or crashing with \"panic\" (empty disables)")
+
+	rpcAddr = NodeCmd.Flags().String("rpcAddr", "", "JSON-RPC listen address, e.g. 127.0.0.1:8545 (empty to disable)")
+	grpcAddr = NodeCmd.Flags().String("grpcAddr", "", "gRPC listen address of the block stream for exporting the chain, e.g. 127.0.0.1:9090 (empty to disable)")
+	rpcIPC = NodeCmd.Flags().String("rpcIPC", "", "Path of the JSON-RPC unix socket, also serving votes_submit to co-located signers (empty to disable)")
+	rpcAdmin = NodeCmd.Flags().Bool("rpcAdmin", false, "Serve the admin_ methods (e.g. admin_halt) over JSON-RPC; only enable on an address the operator alone can reach")
+	metricsNamespace = NodeCmd.Flags().String("metricsNamespace", "", "Prefix of the metric names, e.g. mpbft")
+	nodeApp = NodeCmd.Flags().String("app", "", "Application executing the blocks: "+strings.Join(devAppNames(), ", ")+" (empty for none, the app hashes are then empty)")
 
 }
 
+// newNodeApp returns a new instance of the application of --app, nil if none.
+func newNodeApp() (consensus.BlockFinalizer, error) {
+	if *nodeApp == "" {
+		return nil, nil
+	}
+	newApp, ok := devApps[*nodeApp]
+	if !ok {
+		return nil, fmt.Errorf("unknown --app %q, expected one of %s", *nodeApp, strings.Join(devAppNames(), ", "))
+	}
+	return newApp(), nil
+}
+
 func runNode(cmd *cobra.Command, args []string) {
 	glogger := log.NewGlogHandler(log.StreamHandler(os.Stderr, log.TerminalFormat(false)))
 	glogger.Verbosity(log.Lvl(*verbosity))
@@ -116,7 +276,7 @@ func runNode(cmd *cobra.Command, args []string) {
 	}
 
 	// Check genesis timestamp
-	if *genesisTimeMs == 0 {
+	if *genesisTimeMs == 0 && *genesisPath == "" {
 		log.Error("Please specify --genesisTimeMs")
 		return
 	}
@@ -125,13 +285,26 @@ func runNode(cmd *cobra.Command, args []string) {
 	var privVal consensus.PrivValidator
 	var pubVal consensus.PubKey
 
-	if *valKeyPath != "" {
-		valKey, err := loadValidatorKey(*valKeyPath)
+	if *valKeyPath != "" && *vaultAddr != "" {
+		log.Error("Please specify either --valKey or --vaultAddr")
+		return
+	}
+	if *valKeyPath != "" || *vaultAddr != "" {
+		if *vaultAddr != "" {
+			privVal, err = loadVaultPV(rootCtx)
+		} else {
+			privVal, err = loadPrivValidator(*valKeyPath, *valKeyType)
+		}
 		if err != nil {
 			log.Error("Failed to load validator key", "err", err)
 			return
 		}
-		privVal = consensus.NewPrivValidatorLocal(valKey)
+		if !*unsafeNoWAL {
+			if privVal, err = loadSignState(privVal); err != nil {
+				log.Error("Failed to load validator sign state", "err", err)
+				return
+			}
+		}
 		pubVal, err = privVal.GetPubKey(rootCtx)
 		if err != nil {
 			log.Error("Failed to load valiator pub key", "err", err)
@@ -141,71 +314,195 @@ func runNode(cmd *cobra.Command, args []string) {
 	}
 
 	// Update validators
-	vals := make([]common.Address, len(*validatorSet))
-	found := false
-	for i, addrStr := range *validatorSet {
-		addr := common.HexToAddress(addrStr)
-		if pubVal != nil && addr == pubVal.Address() {
-			found = true
-		}
-		vals[i] = addr
+	gcs, vals, err := makeGenesisChainState()
+	if err != nil {
+		log.Error("Invalid genesis", "err", err)
+		return
 	}
 
-	powers := make([]int64, len(vals))
-	if *powerStr == "" {
-		log.Info("Set all validator power = 1")
-		for i := 0; i < len(powers); i++ {
-			powers[i] = 1
+	if pubVal != nil && !gcs.Validators.HasAddress(pubVal.Address()) {
+		log.Error("Current validator is not in validator set")
+		return
+	}
+
+	// a nil alerts drops the alerts
+	var alerts *alert.Webhooks
+	if len(*alertWebhooks) > 0 {
+		alerts = alert.NewWebhooks(*alertWebhooks, *nodeName, gcs.ChainID)
+		// deliver the alert of an error we exit on
+		defer alerts.Close(alertFlushTimeout)
+		if pv, ok := privVal.(*privval.FilePV); ok {
+			pv.SetAlerter(alerts)
 		}
-	} else {
-		ss := strings.Split(*powerStr, ",")
-		if len(ss) != len(powers) {
-			log.Error("Invalid power string", "str", *powerStr)
+	}
+
+	metricsOpts := metrics.Options{
+		Namespace:   *metricsNamespace,
+		ConstLabels: prometheus.Labels{"chain_id": gcs.ChainID},
+	}
+	if *nodeName != "" {
+		metricsOpts.ConstLabels["moniker"] = *nodeName
+	}
+	if err := registerMetrics(metricsOpts.Wrap()); err != nil {
+		log.Error("Failed to register metrics", "err", err)
+		return
+	}
+	csMetrics := consensus.NewMetrics()
+	if err := csMetrics.Register(metricsOpts.Wrap()); err != nil {
+		log.Error("Failed to register metrics", "err", err)
+		return
+	}
+
+	if *unsafeNoWAL {
+		warnWALDisabled()
+	}
+	dirs := resolveDataDirs()
+	db, stateDB, err := openNodeStores(dirs)
+	if err != nil {
+		log.Error("Failed to open stores", "err", err)
+		return
+	}
+	log.Info("Opened stores", "block_store", dirs.blockStore, "state", dirs.state, "wal", dirs.wal)
+
+	storeList := []consensus.Store{{Name: "block_store", Path: dirs.blockStore, DB: db}}
+	if stateDB != db {
+		storeList = append(storeList, consensus.Store{Name: "state", Path: dirs.state, DB: stateDB})
+	}
+	stores := consensus.NewStores(storeList...)
+	go stores.Run(rootCtx, *dbCompactEvery)
+
+	mempoolConfig := mempool.DefaultConfig
+	mempoolConfig.Size = *mempoolSize
+	mempoolConfig.Recheck = *mempoolRecheck
+	mp := mempool.New(mempoolConfig, nil)
+	if dirs.wal != "" {
+		mempoolWAL, err := mempool.OpenWAL(filepath.Join(dirs.wal, "mempool.wal"))
+		if err != nil {
+			log.Error("Failed to open mempool WAL", "err", err)
 			return
 		}
-		for i, s := range ss {
-			p, err := strconv.Atoi(s)
-			powers[i] = int64(p)
-			if err != nil {
-				log.Error("Invalid power string", "err", err)
-				return
-			}
+		defer mempoolWAL.Close()
+		n, err := mp.SetWAL(mempoolWAL)
+		if err != nil {
+			log.Error("Failed to replay mempool WAL", "err", err)
+			return
 		}
+		log.Info("Replayed mempool WAL", "txs", n)
 	}
 
-	if pubVal != nil && !found {
-		log.Error("Current validator is not in validator set")
+	bs := node.NewDefaultBlockStore(db)
+	validatorStore := consensus.NewValidatorStore(stateDB)
+	paramsStore := consensus.NewConsensusParamsStore(stateDB)
+	appHashStore := consensus.NewAppHashStore(stateDB)
+	executorOpts := []consensus.ExecutorOption{
+		consensus.WithMempool(mp),
+		consensus.WithValidatorStore(validatorStore),
+		consensus.WithConsensusParamsStore(paramsStore),
+		consensus.WithAppHashStore(appHashStore),
+		consensus.WithAlerter(alerts),
+	}
+	app, err := newNodeApp()
+	if err != nil {
+		log.Error("Invalid application", "err", err)
+		return
+	}
+	if app != nil {
+		executorOpts = append(executorOpts, consensus.WithFinalizer(app))
+	}
+	executor := consensus.NewDefaultBlockExecutor(stateDB, executorOpts...)
+	evpool, err := consensus.NewEvidencePool(stateDB)
+	if err != nil {
+		log.Error("Failed to load evidence pool", "err", err)
 		return
-	} else {
-		log.Info("Validators", "vals", vals, "powers", powers)
 	}
 
-	gcs := consensus.MakeGenesisChainState("test", *genesisTimeMs, vals, powers, 128, int64(*proposerRepetition))
+	// before anything is signed from stores that do not match
+	storeDigests := consensus.NewStoreDigests(db, stateDB, dirs.wal)
+	if *storeCheck {
+		digest, err := storeDigests.Check(bs, appHashStore)
+		if err != nil {
+			log.Error("Store integrity check failed, not starting", "err", err)
+			alerts.Alert(consensus.Alert{Kind: consensus.AlertStoresInconsistent, Message: err.Error()})
+			return
+		}
+		if digest != nil {
+			log.Info("Checked store integrity", "height", digest.Height, "block", digest.BlockHash)
+		}
+	}
+	if *gcs, err = restoreChainState(rootCtx, executor, bs, *gcs); err != nil {
+		log.Error("Failed to restore the chain state", "err", err)
+		return
+	}
 
-	db, err := leveldb.OpenFile(*datadir, &opt.Options{ErrorIfExist: true})
+	p2p.CompressProposals = *p2pCompress
+	p2p.BlockParts = *p2pBlockParts
+	p2p.WebsocketPort = *p2pWSPort
+	p2p.SignControlMessages = *p2pSignCtrl
+	p2p.VoteRelays = *p2pVoteRelays
+	mode, err := p2p.ParseMode(*p2pMode)
 	if err != nil {
-		log.Error("Failed to create db", "err", err)
+		log.Error("Invalid p2p mode", "err", err)
 		return
 	}
 
-	bs := NewDefaultBlockStore(db)
-	executor := consensus.NewDefaultBlockExecutor(db)
+	var certAuth *p2p.CertAuth
+	if *p2pTLSCert != "" || *p2pTLSKey != "" || *p2pTLSCA != "" {
+		certAuth, err = p2p.LoadCertAuth(*p2pTLSCert, *p2pTLSKey, *p2pTLSCA)
+		if err != nil {
+			log.Error("Failed to load peer certificates", "err", err)
+			return
+		}
+	}
 
-	p2pserver, err := p2p.NewP2PServer(rootCtx, bs, obsvC, sendC, p2pPriv, *p2pPort, *p2pNetworkID, *p2pBootstrap, *nodeName, rootCtxCancel)
+	nodeInfo := p2p.NodeInfo{ChainID: gcs.ChainID, GenesisHash: consensus.GenesisHash(gcs), NodeName: *nodeName, Relay: *p2pRelay}
+	trustedPeers, err := p2p.ParseTrustedPeers(*p2pTrusted)
+	if err != nil {
+		log.Error("Invalid --p2pTrustedPeers", "err", err)
+		return
+	}
+	p2pserver, err := p2p.NewP2PServer(rootCtx, bs, obsvC, sendC, p2pPriv, *p2pPort, *p2pNetworkID, *p2pBootstrap, *nodeName, nodeInfo, mode, certAuth, rootCtxCancel)
+	if err != nil {
+		log.Error("Failed to start p2p", "err", err)
+		return
+	}
+	// tell the peers we leave, once the node stops for whatever reason
+	defer p2pserver.Stop()
+	p2pserver.SetEclipseConfig(p2p.EclipseConfig{
+		MinOutboundRatio:      *p2pMinOutbound,
+		InboundRotateInterval: *p2pRotateEvery,
+		InboundRotateFraction: *p2pRotateShare,
+		TrustedPeers:          trustedPeers,
+	})
+	p2pserver.SetMempool(mp)
 
 	go func() {
 		p2pserver.Run(rootCtx)
 	}()
 
+	if *p2pDenyFile != "" {
+		go watchDeniedPeers(rootCtx, *p2pDenyFile, p2pserver)
+	}
+
 	// TODO: make sure we have sufficient peer node to sync
 	time.Sleep(time.Second)
 
+	// before block sync, which would take us past the heights we signed
+	if pubVal != nil && *doubleSignChk && !*unsafeNoWAL && !(len(vals) == 1 && vals[0] == pubVal.Address()) {
+		if err := checkDoubleSignAtPeers(rootCtx, p2pserver, *gcs, pubVal); err != nil {
+			log.Error("Double-sign check failed, not starting", "err", err)
+			alerts.Alert(consensus.Alert{Kind: consensus.AlertDoubleSignPrevented, Message: err.Error()})
+			return
+		}
+	}
+
 	if len(vals) == 1 && pubVal != nil && vals[0] == pubVal.Address() {
 		log.Info("Running in self validator mode, skipping block sync")
 	} else if *skipBlockSync {
 		log.Info("Skipping block sync by config")
 	} else {
 		bs := p2p.NewBlockSync(p2pserver.Host, *gcs, bs, executor, obsvC)
+		bs.SetEvidencePool(evpool)
+		bs.SetMaxHeight(*haltHeight)
 		bs.Start(rootCtx)
 		err := bs.WaitDone()
 		if err != nil {
@@ -215,12 +512,70 @@ func runNode(cmd *cobra.Command, args []string) {
 
 		*gcs = bs.LastChainState()
 	}
+	if gcs.LastBlockHeight > 0 {
+		if err := storeDigests.Record(consensus.NewStoreDigest(*gcs)); err != nil {
+			log.Error("Failed to record the store digest", "err", err)
+			return
+		}
+	}
 
 	p := params.NewDefaultConsesusConfig()
 	p.TimeoutCommit = time.Duration(*timeoutCommitMs) * time.Millisecond
+	p.TimeoutPropose, p.TimeoutProposeDelta = *timeoutPropose, *timeoutProposeD
+	p.TimeoutPrevote, p.TimeoutPrevoteDelta = *timeoutPrevote, *timeoutPrevoteD
+	p.TimeoutPrecommit, p.TimeoutPrecommitDelta = *timeoutPrecommit, *timeoutPrecommitD
 	p.ConsensusSyncRequestDuration = time.Duration(*consensusSyncMs) * time.Millisecond
+	if *unsafeNoWAL {
+		p.DoubleSignCheckHeight = 0
+	}
+	if err := consensus.ValidateConsensusConfig(p); err != nil {
+		log.Error("Invalid consensus config", "err", err)
+		return
+	}
 
 	// Block sync is done, now entering consensus stage
+	stateOptions := []consensus.StateOption{consensus.StateMetrics(csMetrics), consensus.TxSource(mp), consensus.RecordStoreDigests(storeDigests)}
+	if *haltHeight > 0 {
+		stateOptions = append(stateOptions, consensus.HaltHeight(*haltHeight))
+	}
+	if *haltTime > 0 {
+		stateOptions = append(stateOptions, consensus.HaltTime(time.Unix(int64(*haltTime), 0)))
+	}
+	if !*fastPathCommit {
+		stateOptions = append(stateOptions, consensus.FastPathCommit(false))
+	}
+	if *pipelineProposals {
+		stateOptions = append(stateOptions, consensus.PipelineProposals(true))
+	}
+	if *targetBlockTime > 0 {
+		stateOptions = append(stateOptions, consensus.TargetBlockTime(*targetBlockTime, *proposeMaxWait))
+	}
+	if !*createEmptyBlocks || *emptyBlockInterval > 0 {
+		stateOptions = append(stateOptions, consensus.EmptyBlocks(*createEmptyBlocks, *emptyBlockInterval))
+	}
+	switch *safetyChecks {
+	case "":
+	case "log":
+		stateOptions = append(stateOptions, consensus.SafetyChecks(func(consensus.SafetyViolation) {}))
+	case "panic":
+		stateOptions = append(stateOptions, consensus.SafetyChecks(nil))
+	default:
+		log.Error("Invalid --safetyChecks, expected log or panic", "safetyChecks", *safetyChecks)
+		return
+	}
+	if *misbehave != "" {
+		if !consensus.MisbehaviorsEnabled {
+			log.Error("Misbehaviors need a binary built with the byzantine tag")
+			return
+		}
+		ms, err := consensus.ParseMisbehaviors(*misbehave)
+		if err != nil {
+			log.Error("Invalid misbehaviors", "err", err)
+			return
+		}
+		log.Warn("Misbehaving, for testing only", "misbehaviors", *misbehave)
+		stateOptions = append(stateOptions, consensus.Misbehave(ms))
+	}
 	consensusState := consensus.NewConsensusState(
 		rootCtx,
 		p,
@@ -229,18 +584,427 @@ func runNode(cmd *cobra.Command, args []string) {
 		bs,
 		obsvC,
 		sendC,
+		stateOptions...,
 	)
 
 	consensusState.SetPrivValidator(privVal)
+	consensusState.SetEvidencePool(evpool)
+
+	if dirs.wal != "" {
+		fsync, err := consensus.ParseWALFsyncPolicy(*walFsync)
+		if err != nil {
+			log.Error("Invalid --walFsync", "err", err)
+			return
+		}
+		wal, err := consensus.OpenWAL(consensus.WALConfig{
+			Dir:           dirs.wal,
+			MaxFileSize:   *walMaxSize,
+			MaxFiles:      *walMaxFiles,
+			Fsync:         fsync,
+			FsyncInterval: *walFsyncEvery,
+		})
+		if err != nil {
+			log.Error("Failed to open consensus WAL", "err", err)
+			return
+		}
+		consensusState.SetWAL(wal)
+	}
+
+	var timingStore *consensus.HeightTimingStore
+	if *heightTimings > 0 {
+		timingStore = consensus.NewHeightTimingStore(db, *heightTimings)
+		consensusState.SetHeightTimingStore(timingStore)
+	}
 
 	p2pserver.SetConsensusState(consensusState)
 
-	consensusState.Start(rootCtx)
+	if err := consensusState.Start(rootCtx); err != nil {
+		log.Error("Failed to start consensus", "err", err)
+		if errors.Is(err, consensus.ErrWALCorrupted) {
+			alerts.Alert(consensus.Alert{Kind: consensus.AlertWALCorruption, Height: bs.Height() + 1, Message: err.Error()})
+		}
+		return
+	}
+	if alerts != nil {
+		go alert.WatchStall(rootCtx, alerts, bs.Height, *alertStall)
+	}
+
+	rpcEnv := &rpc.Environment{
+		BlockStore:      bs,
+		Executor:        executor,
+		ConsensusState:  consensusState,
+		HeightTimings:   timingStore,
+		Stores:          stores,
+		Validators:      validatorStore,
+		ConsensusParams: paramsStore,
+		AppHashes:       appHashStore,
+		Net:             netInfoSource{p2pserver},
+		Messages:        messageSuspender{p2pserver},
+		Admin:           *rpcAdmin,
+		Txs:             mp,
+	}
+	if *rpcAddr != "" {
+		rpcServer, err := rpc.NewServer(*rpcAddr, rpcEnv)
+		if err != nil {
+			log.Error("Failed to create RPC server", "err", err)
+			return
+		}
+		if err := rpcServer.Start(rootCtx); err != nil {
+			log.Error("Failed to start RPC server", "err", err)
+			return
+		}
+	}
+	if *grpcAddr != "" {
+		if err := grpcapi.NewServer(*grpcAddr, bs).Start(rootCtx); err != nil {
+			log.Error("Failed to start gRPC server", "err", err)
+			return
+		}
+	}
+	if *rpcIPC != "" {
+		ipcServer, err := rpc.NewIPCServer(*rpcIPC, rpcEnv)
+		if err != nil {
+			log.Error("Failed to create IPC server", "err", err)
+			return
+		}
+		if err := ipcServer.Start(rootCtx); err != nil {
+			log.Error("Failed to start IPC server", "err", err)
+			return
+		}
+	}
 
 	// Running the node
 	log.Info("Running the node")
 
-	<-rootCtx.Done()
+	select {
+	case <-rootCtx.Done():
+	case <-consensusState.UpgradeHalt():
+		log.Warn("Halt height or time reached; shutting down", "height", bs.Height())
+		rootCtxCancel()
+		// let the receive routine close the WAL
+		consensusState.Wait()
+	}
+}
+
+func registerMetrics(reg prometheus.Registerer) error {
+	if err := consensus.RegisterMetrics(reg); err != nil {
+		return err
+	}
+	if err := mempool.RegisterMetrics(reg); err != nil {
+		return err
+	}
+	return p2p.RegisterMetrics(reg)
+}
+
+// checkDoubleSignAtPeers fails if a peer holds a vote of ours above the next
+// height we would sign, e.g., when the node was restored from an old backup.
+// Votes of the next height itself may come from before a crash.
+func checkDoubleSignAtPeers(ctx context.Context, server *p2p.Server, state consensus.ChainState, pubVal consensus.PubKey) error {
+	fromHeight := state.LastBlockHeight + 2
+	votes, err := server.FindSignedVotes(ctx, state.ChainID, pubVal, fromHeight)
+	if err != nil {
+		// nothing to check against, e.g., the first node of the network
+		log.Warn("Skipping double-sign check", "err", err)
+		return nil
+	}
+	if len(votes) != 0 {
+		log.Error("Found votes signed by the validator key", "local_height", state.LastBlockHeight,
+			"vote_height", votes[0].Height, "vote_round", votes[0].Round, "votes", len(votes))
+		return consensus.ErrSignatureFoundAtPeers
+	}
+	log.Info("Double-sign check passed", "from_height", fromHeight)
+	return nil
+}
+
+// netInfoSource serves the p2p connectivity as "net_info".
+type netInfoSource struct {
+	server *p2p.Server
+}
+
+func (s netInfoSource) NetInfo() rpc.ResultNetInfo {
+	return rpc.ResultNetInfo(s.server.NetInfo())
+}
+
+// messageSuspender serves the p2p message suspensions as
+// "admin_suspendMessages" and "admin_resumeMessages".
+type messageSuspender struct {
+	server *p2p.Server
+}
+
+func (s messageSuspender) SuspendMessages(kinds []string, d time.Duration) ([]rpc.ResultMessageSuspension, error) {
+	suspensions, err := s.server.SuspendMessages(kinds, d)
+	return resultMessageSuspensions(suspensions), err
+}
+
+func (s messageSuspender) ResumeMessages(kinds []string) []rpc.ResultMessageSuspension {
+	return resultMessageSuspensions(s.server.ResumeMessages(kinds))
+}
+
+func resultMessageSuspensions(suspensions []p2p.MessageSuspension) []rpc.ResultMessageSuspension {
+	if suspensions == nil {
+		return nil
+	}
+	result := make([]rpc.ResultMessageSuspension, len(suspensions))
+	for i, s := range suspensions {
+		result[i] = rpc.ResultMessageSuspension(s)
+	}
+	return result
+}
+
+// watchDeniedPeers applies the peers of the deny file whenever it changes. A
+// missing file denies no peer.
+func watchDeniedPeers(ctx context.Context, path string, server *p2p.Server) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var lastMod time.Time
+	for {
+		var modTime time.Time
+		if fi, err := os.Stat(path); err == nil {
+			modTime = fi.ModTime()
+		}
+		if !modTime.Equal(lastMod) {
+			lastMod = modTime
+			peers, err := readDeniedPeers(path)
+			if err != nil {
+				log.Error("Invalid deny peers file", "path", path, "err", err)
+			} else {
+				log.Info("Denied peers changed", "peers", peers)
+				server.SetDeniedPeers(peers)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func readDeniedPeers(path string) ([]peer.ID, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var peers []peer.ID
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		id, err := peer.Decode(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer ID %q: %w", line, err)
+		}
+		peers = append(peers, id)
+	}
+	return peers, nil
+}
+
+// loadSignState guards the validator key with its sign state file.
+func loadSignState(signer consensus.PrivValidator) (*privval.FilePV, error) {
+	path := *valStatePath
+	if path == "" {
+		path = filepath.Join(*datadir, "priv_validator_state.json")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	pv, err := privval.NewFilePV(signer, path)
+	if err != nil {
+		return nil, err
+	}
+	state := pv.LastSignState()
+	log.Info("Loaded validator sign state", "path", path, "height", state.Height, "round", state.Round, "step", state.Step)
+	return pv, nil
+}
+
+// loadVaultPV connects to the Vault of --vaultAddr, probing it in the
+// background until rootCtx is done.
+func loadVaultPV(rootCtx context.Context) (*privval.VaultPV, error) {
+	cfg := privval.VaultConfig{
+		Address:   *vaultAddr,
+		Mount:     *vaultMount,
+		Key:       *vaultKey,
+		Namespace: *vaultNamespace,
+		// not a flag, to keep it out of the process list
+		Token:  os.Getenv("VAULT_TOKEN"),
+		RoleID: *vaultRoleID,
+	}
+	if cfg.Key == "" {
+		return nil, fmt.Errorf("no --vaultKey")
+	}
+	if *vaultSecretID != "" {
+		secretID, err := ioutil.ReadFile(*vaultSecretID)
+		if err != nil {
+			return nil, err
+		}
+		cfg.SecretID = strings.TrimSpace(string(secretID))
+	}
+	if *vaultCACert != "" {
+		caPEM, err := ioutil.ReadFile(*vaultCACert)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificate in %s", *vaultCACert)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+		cfg.HTTPClient = &http.Client{Transport: transport}
+	}
+
+	pv, err := privval.NewVaultPV(rootCtx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if *vaultProbe > 0 {
+		go pv.ProbeRoutine(rootCtx, *vaultProbe)
+	}
+	return pv, nil
+}
+
+// dataDirs are the paths of the stores, which may be on different disks.
+type dataDirs struct {
+	blockStore string
+	state      string
+	wal        string // empty with --unsafeDisableWAL
+}
+
+func resolveDataDirs() dataDirs {
+	dirs := dataDirs{blockStore: *blockStoreDir, state: *stateDir, wal: *walDir}
+	if dirs.blockStore == "" {
+		dirs.blockStore = *datadir
+	}
+	if dirs.state == "" {
+		dirs.state = dirs.blockStore
+	}
+	if *unsafeNoWAL {
+		dirs.wal = ""
+	} else if dirs.wal == "" {
+		dirs.wal = filepath.Join(*datadir, "wal")
+	}
+	return dirs
+}
+
+// openNodeStores opens the block store and state databases of dirs, and
+// creates the WAL directory, on the first start as on restarts.
+func openNodeStores(dirs dataDirs) (db, stateDB *leveldb.DB, err error) {
+	db, err = leveldb.OpenFile(dirs.blockStore, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot open block store: %w", err)
+	}
+	stateDB = db
+	if dirs.state != dirs.blockStore {
+		stateDB, err = leveldb.OpenFile(dirs.state, nil)
+		if err != nil {
+			db.Close()
+			return nil, nil, fmt.Errorf("cannot open state db: %w", err)
+		}
+	}
+	if dirs.wal != "" {
+		if err := os.MkdirAll(dirs.wal, 0700); err != nil {
+			return nil, nil, fmt.Errorf("cannot create wal dir: %w", err)
+		}
+	}
+	return db, stateDB, nil
+}
+
+// restoreChainState returns the state after the stored blocks, which are
+// applied again from the genesis state: the chain state is not stored.
+func restoreChainState(ctx context.Context, executor consensus.BlockExecutor, bs consensus.BlockStore, genesis consensus.ChainState) (consensus.ChainState, error) {
+	if bs.Height() < genesis.InitialHeight {
+		return genesis, nil
+	}
+	log.Info("Restoring the chain state from the stored blocks", "height", bs.Height())
+	state, err := consensus.ReplayBlocks(ctx, executor, bs, genesis, consensus.ReplayOptions{})
+	if err != nil {
+		return state, err
+	}
+	log.Info("Restored the chain state", "height", state.LastBlockHeight, "block", state.LastBlockID)
+	return state, nil
+}
+
+// warnWALDisabled makes --unsafeDisableWAL hard to miss in the logs.
+func warnWALDisabled() {
+	log.Warn("**************************************************************")
+	log.Warn("WAL AND DOUBLE-SIGN CHECKS DISABLED by --unsafeDisableWAL")
+	log.Warn("A validator restarted by this node may DOUBLE SIGN and be slashed")
+	log.Warn("Only use it for throwaway test networks")
+	log.Warn("**************************************************************")
+}
+
+// makeGenesisChainState builds the genesis state from the --genesis file, or
+// from the --validatorSet, --valPowers, and --genesisTimeMs flags.
+func makeGenesisChainState() (*consensus.ChainState, []common.Address, error) {
+	if *genesisPath != "" {
+		g, err := consensus.LoadGenesis(*genesisPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		gcs, err := g.ChainState(128, int64(*proposerRepetition))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		vals := make([]common.Address, len(g.Validators))
+		for i, val := range g.Validators {
+			pubKey, _ := consensus.ParsePubKey(val.PubKey)
+			vals[i] = pubKey.Address()
+		}
+		hash, err := g.Hash()
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Info("Loaded genesis", "chain", g.ChainID, "hash", hash, "vals", vals)
+		return gcs, vals, nil
+	}
+
+	vals := make([]common.Address, len(*validatorSet))
+	valPubKeys := make([]consensus.PubKey, len(*validatorSet))
+	for i, valStr := range *validatorSet {
+		pubKey, err := consensus.ParsePubKey(valStr)
+		if err != nil {
+			return nil, nil, err
+		}
+		vals[i] = pubKey.Address()
+		valPubKeys[i] = pubKey
+	}
+
+	powers := make([]int64, len(vals))
+	if *powerStr == "" {
+		log.Info("Set all validator power = 1")
+		for i := 0; i < len(powers); i++ {
+			powers[i] = 1
+		}
+	} else {
+		ss := strings.Split(*powerStr, ",")
+		if len(ss) != len(powers) {
+			return nil, nil, fmt.Errorf("invalid power string %q", *powerStr)
+		}
+		for i, s := range ss {
+			p, err := strconv.Atoi(s)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid power string: %w", err)
+			}
+			powers[i] = int64(p)
+		}
+	}
+
+	log.Info("Validators", "vals", vals, "powers", powers)
+
+	if err := consensus.ValidateValidatorUpdate(vals, powers); err != nil {
+		return nil, nil, err
+	}
+
+	gcs := consensus.MakeGenesisChainState("test", *genesisTimeMs, vals, powers, 128, int64(*proposerRepetition))
+	consensus.SetValidatorPubKeys(gcs.Validators, valPubKeys)
+	consensus.SetValidatorPubKeys(gcs.NextValidators, valPubKeys)
+	return gcs, vals, consensus.ValidateChainState(gcs)
 }
 
 func getOrCreateNodeKey(path string) (p2pcrypto.PrivKey, error) {
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/QuarkChain/go-minimal-pbft/node"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/spf13/cobra"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+var (
+	replayFromData    *string
+	replayFromWAL     *string
+	replayFromHeight  *uint64
+	replayFromEntries *int
+	replayFromOut     *string
+)
+
+// ReplayFromCmd reconstructs the consensus state another node was in at a
+// height from a copy of its data dir, e.g., sent along with a report of a
+// divergence: the stored blocks are executed again up to the height, checking
+// the app hashes the node recorded, then the messages and timeouts of the
+// height are replayed from its WAL. Nothing is written to the copy.
+var ReplayFromCmd = &cobra.Command{
+	Use:   "replay-from",
+	Short: "Reconstruct the consensus state at a height from a copied data dir",
+	RunE:  runReplayFrom,
+}
+
+func init() {
+	replayFromData = ReplayFromCmd.Flags().String("data", "", "Path to the copied data dir (opened read-only)")
+	replayFromWAL = ReplayFromCmd.Flags().String("walDir", "", "Path to the copied WALs (defaults to <data>/wal)")
+	replayFromHeight = ReplayFromCmd.Flags().Uint64("height", 0, "Height to reconstruct the consensus state at")
+	replayFromEntries = ReplayFromCmd.Flags().Int("entries", 0, "Stop after replaying this many WAL entries of the height (0 for all)")
+	replayFromOut = ReplayFromCmd.Flags().String("out", "", "Write the round state to the file instead of stdout")
+
+	// the genesis must match the one of the node that produced the data dir
+	for _, name := range []string{"genesis", "validatorSet", "valPowers", "genesisTimeMs", "proposerRepetition", "stateDir"} {
+		ReplayFromCmd.Flags().AddFlag(NodeCmd.Flags().Lookup(name))
+	}
+}
+
+func runReplayFrom(cmd *cobra.Command, args []string) error {
+	if *replayFromData == "" {
+		return fmt.Errorf("no --data")
+	}
+	height := *replayFromHeight
+	walDir := *replayFromWAL
+	if walDir == "" {
+		walDir = filepath.Join(*replayFromData, "wal")
+	}
+
+	gcs, _, err := makeGenesisChainState()
+	if err != nil {
+		return fmt.Errorf("invalid genesis: %w", err)
+	}
+	if height < gcs.InitialHeight {
+		return fmt.Errorf("--height must be at least the initial height %d", gcs.InitialHeight)
+	}
+
+	db, err := leveldb.OpenFile(*replayFromData, &opt.Options{ReadOnly: true, ErrorIfMissing: true})
+	if err != nil {
+		return fmt.Errorf("cannot open %s: %w", *replayFromData, err)
+	}
+	defer db.Close()
+
+	stateDB := db
+	if *stateDir != "" {
+		stateDB, err = leveldb.OpenFile(*stateDir, &opt.Options{ReadOnly: true, ErrorIfMissing: true})
+		if err != nil {
+			return fmt.Errorf("cannot open %s: %w", *stateDir, err)
+		}
+		defer stateDB.Close()
+	}
+
+	bs := node.NewDefaultBlockStore(db)
+	if height > bs.Height()+1 {
+		return fmt.Errorf("--height %d is above the height in progress %d", height, bs.Height()+1)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the state of the previous height, from the blocks executed again
+	executor := consensus.NewDefaultBlockExecutor(stateDB)
+	state := *gcs
+	if height > gcs.InitialHeight {
+		state, err = consensus.ReplayBlocks(ctx, executor, bs, state, consensus.ReplayOptions{
+			To:        height - 1,
+			AppHashes: consensus.NewAppHashStore(stateDB),
+		})
+		if err != nil {
+			return fmt.Errorf("replay of the blocks before height %d failed at height %d: %w", height, state.LastBlockHeight+1, err)
+		}
+	}
+
+	// the messages the state machine sends are dropped
+	sendC := make(chan consensus.Message, 64)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sendC:
+			}
+		}
+	}()
+	cs := consensus.NewConsensusState(ctx, params.NewDefaultConsesusConfig(), state, executor, bs, make(chan consensus.MsgInfo), sendC)
+
+	last := cs.GetRoundStateSnapshot()
+	n, err := cs.ReplayWAL(ctx, walDir, func(e consensus.ReplayedWALEntry) bool {
+		snap := cs.GetRoundStateSnapshot()
+		if snap.Height != height {
+			log.Info("Height committed", "entry", e.Index, "height", height, "round", last.Round)
+			return false
+		}
+		last = snap
+
+		at := fmt.Sprintf("%d/%d/%v", snap.Height, snap.Round, snap.Step)
+		if e.Msg == nil {
+			log.Info("Replayed timeout", "entry", e.Index, "round", e.Round, "step", e.Step, "duration", e.Timeout, "state", at, "locked_round", snap.LockedRound)
+		} else {
+			log.Info("Replayed message", "entry", e.Index, "msg", e.Msg, "peer", e.PeerID, "state", at, "locked_round", snap.LockedRound)
+		}
+		return *replayFromEntries == 0 || e.Index+1 < *replayFromEntries
+	})
+	if err != nil {
+		return fmt.Errorf("replay of the WAL failed: %w", err)
+	}
+	if n == 0 {
+		log.Warn("No WAL entry of the height, the state is the one it started with", "height", height, "wal", walDir)
+	}
+
+	out := io.Writer(os.Stdout)
+	if *replayFromOut != "" {
+		f, err := os.Create(*replayFromOut)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(last)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/QuarkChain/go-minimal-pbft/node"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestNodeRestart runs a single validator on a datadir, stops it, and starts
+// it again on the same datadir, as the node does: the chain goes on from the
+// stored blocks.
+func TestNodeRestart(t *testing.T) {
+	dir := t.TempDir()
+	dirs := dataDirs{blockStore: filepath.Join(dir, "data"), state: filepath.Join(dir, "state"), wal: filepath.Join(dir, "wal")}
+	privVal := consensus.GeneratePrivValidatorLocal()
+	pubVal, err := privVal.GetPubKey(context.Background())
+	require.NoError(t, err)
+	genesis := *consensus.MakeGenesisChainState("restart", uint64(time.Now().UnixMilli()), []common.Address{pubVal.Address()}, []int64{1}, 128, 1)
+
+	// run starts the node, waits for the block at height, and stops it. It
+	// returns the state the node restored, the block after it and the last
+	// block stored.
+	run := func(height uint64) (consensus.ChainState, *consensus.FullBlock, *consensus.FullBlock) {
+		db, stateDB, err := openNodeStores(dirs)
+		require.NoError(t, err)
+		defer db.Close()
+		defer stateDB.Close()
+
+		bs := node.NewDefaultBlockStore(db)
+		executor := consensus.NewDefaultBlockExecutor(stateDB, consensus.WithAppHashStore(consensus.NewAppHashStore(stateDB)))
+		state, err := restoreChainState(context.Background(), executor, bs, genesis)
+		require.NoError(t, err)
+		restored := state
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		sendC := make(chan consensus.Message, 64)
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-sendC:
+				}
+			}
+		}()
+
+		p := params.NewDefaultConsesusConfig()
+		p.TimeoutCommit = 0
+		p.SkipTimeoutCommit = true
+		p.DoubleSignCheckHeight = 0
+		cs := consensus.NewConsensusState(ctx, p, state, executor, bs, make(chan consensus.MsgInfo), sendC)
+		cs.SetPrivValidator(privVal)
+		wal, err := consensus.OpenWAL(consensus.WALConfig{Dir: dirs.wal})
+		require.NoError(t, err)
+		cs.SetWAL(wal)
+		require.NoError(t, cs.Start(ctx))
+
+		require.Eventually(t, func() bool { return bs.Height() >= height }, 10*time.Second, 10*time.Millisecond)
+		cancel()
+		cs.Wait()
+		return restored, bs.LoadBlock(restored.LastBlockHeight + 1), bs.LoadBlock(bs.Height())
+	}
+
+	state, _, last := run(3)
+	assert.Equal(t, uint64(0), state.LastBlockHeight)
+
+	// the stores exist: the state is the one after the stored blocks
+	state, next, _ := run(last.NumberU64() + 2)
+	assert.Equal(t, last.NumberU64(), state.LastBlockHeight)
+	assert.Equal(t, last.Hash(), state.LastBlockID)
+	assert.Equal(t, last.Hash(), next.Header().ParentHash)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/spf13/cobra"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+var dbStatsJSON *bool
+
+// DBCmd inspects and maintains the stores of a stopped node.
+var DBCmd = &cobra.Command{
+	Use:   "db",
+	Short: "Inspect and maintain the stores of a stopped node",
+}
+
+var dbStatsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Print the disk usage of the stores",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		stores, closeStores, err := openStores(true)
+		if err != nil {
+			return err
+		}
+		defer closeStores()
+
+		stats := stores.Stats()
+		if *dbStatsJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(stats)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "STORE\tLEVEL\tTABLES\tBYTES")
+		for _, st := range stats {
+			fmt.Fprintf(w, "%s\t\t\t%d\t(%s, on disk)\n", st.Name, st.DiskBytes, st.Path)
+			for _, level := range st.Levels {
+				fmt.Fprintf(w, "\t%d\t%d\t%d\n", level.Level, level.Tables, level.SizeBytes)
+			}
+		}
+		return w.Flush()
+	},
+}
+
+var dbCompactCmd = &cobra.Command{
+	Use:   "compact",
+	Short: "Compact the stores to reclaim the space of deleted data",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		stores, closeStores, err := openStores(false)
+		if err != nil {
+			return err
+		}
+		defer closeStores()
+
+		return stores.Compact()
+	},
+}
+
+func init() {
+	DBCmd.PersistentFlags().AddFlag(NodeCmd.Flags().Lookup("datadir"))
+	DBCmd.PersistentFlags().AddFlag(NodeCmd.Flags().Lookup("blockStoreDir"))
+	DBCmd.PersistentFlags().AddFlag(NodeCmd.Flags().Lookup("stateDir"))
+	dbStatsJSON = dbStatsCmd.Flags().Bool("json", false, "Print the stats as JSON")
+
+	DBCmd.AddCommand(dbStatsCmd)
+	DBCmd.AddCommand(dbCompactCmd)
+}
+
+// openStores opens the existing stores of the data dirs.
+func openStores(readOnly bool) (*consensus.Stores, func(), error) {
+	dirs := resolveDataDirs()
+	paths := []struct{ name, path string }{{"block_store", dirs.blockStore}}
+	if dirs.state != dirs.blockStore {
+		paths = append(paths, struct{ name, path string }{"state", dirs.state})
+	}
+
+	var stores []consensus.Store
+	closeStores := func() {
+		for _, store := range stores {
+			store.DB.Close()
+		}
+	}
+	for _, p := range paths {
+		db, err := leveldb.OpenFile(p.path, &opt.Options{ReadOnly: readOnly, ErrorIfMissing: true})
+		if err != nil {
+			closeStores()
+			return nil, nil, fmt.Errorf("cannot open %s: %w", p.path, err)
+		}
+		stores = append(stores, consensus.Store{Name: p.name, Path: p.path, DB: db})
+	}
+	return consensus.NewStores(stores...), closeStores, nil
+}
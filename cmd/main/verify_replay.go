@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/QuarkChain/go-minimal-pbft/node"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/spf13/cobra"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+var (
+	replayDatadir *string
+	replayFrom    *uint64
+	replayTo      *uint64
+	replayOut     *string
+	replayAgainst *string
+	replayCheck   *bool
+)
+
+// VerifyReplayCmd re-executes the blocks of a (stopped) node's datadir and
+// reports the app hash after each height. Running it with two binaries and
+// comparing the reports (--against) shows whether an upgrade executes the
+// chain the same way before it is rolled out. With --checkAppHashes, the app
+// hashes are checked against the ones the node recorded, and the replay stops
+// at the first divergence. The blocks are executed by the --app of the node,
+// without which there would be no app hash to report.
+var VerifyReplayCmd = &cobra.Command{
+	Use:   "verify-replay",
+	Short: "Replay stored blocks and report (or diff) the app hash per height",
+	Run:   runVerifyReplay,
+}
+
+func init() {
+	replayDatadir = VerifyReplayCmd.Flags().String("datadir", "./datadir", "Path to the database to replay (opened read-only)")
+	replayFrom = VerifyReplayCmd.Flags().Uint64("from", 1, "First height to report")
+	replayTo = VerifyReplayCmd.Flags().Uint64("to", 0, "Last height to replay (0 for the last stored block)")
+	replayOut = VerifyReplayCmd.Flags().String("out", "", "Write the report to the file instead of stdout")
+	replayAgainst = VerifyReplayCmd.Flags().String("against", "", "Report of another binary to compare with")
+	replayCheck = VerifyReplayCmd.Flags().Bool("checkAppHashes", false, "Stop at the first app hash differing from the one recorded by the node")
+
+	// the genesis must match the one of the node that produced the datadir
+	for _, name := range []string{"genesis", "validatorSet", "valPowers", "genesisTimeMs", "proposerRepetition", "stateDir", "app"} {
+		VerifyReplayCmd.Flags().AddFlag(NodeCmd.Flags().Lookup(name))
+	}
+}
+
+// replayRecord is one line of the report.
+type replayRecord struct {
+	Height    uint64        `json:"height"`
+	BlockHash common.Hash   `json:"block_hash"`
+	AppHash   hexutil.Bytes `json:"app_hash"`
+}
+
+func runVerifyReplay(cmd *cobra.Command, args []string) {
+	app, err := newNodeApp()
+	if err != nil {
+		log.Error("Invalid application", "err", err)
+		return
+	}
+	if app == nil {
+		log.Error("Please specify the --app of the node, the app hashes are empty without one")
+		return
+	}
+
+	gcs, _, err := makeGenesisChainState()
+	if err != nil {
+		log.Error("Invalid genesis", "err", err)
+		return
+	}
+
+	db, err := leveldb.OpenFile(*replayDatadir, &opt.Options{ReadOnly: true})
+	if err != nil {
+		log.Error("Failed to open db", "err", err)
+		return
+	}
+	defer db.Close()
+
+	stateDB := db
+	if *stateDir != "" {
+		stateDB, err = leveldb.OpenFile(*stateDir, &opt.Options{ReadOnly: true})
+		if err != nil {
+			log.Error("Failed to open state db", "err", err)
+			return
+		}
+		defer stateDB.Close()
+	}
+
+	var against map[uint64]replayRecord
+	if *replayAgainst != "" {
+		against, err = readReplayReport(*replayAgainst)
+		if err != nil {
+			log.Error("Failed to read report", "err", err)
+			return
+		}
+	}
+
+	out := io.Writer(os.Stdout)
+	if *replayOut != "" {
+		f, err := os.Create(*replayOut)
+		if err != nil {
+			log.Error("Failed to create report", "err", err)
+			return
+		}
+		defer f.Close()
+		out = f
+	}
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+
+	bs := node.NewDefaultBlockStore(db)
+	// records nothing, the hashes of the node are the ones checked
+	executor := consensus.NewDefaultBlockExecutor(stateDB, consensus.WithFinalizer(app))
+	opts := consensus.ReplayOptions{To: *replayTo}
+	if *replayCheck {
+		opts.AppHashes = consensus.NewAppHashStore(stateDB)
+	}
+
+	diverged := 0
+	opts.OnBlock = func(block *consensus.FullBlock, state consensus.ChainState) error {
+		height := block.NumberU64()
+		if height < *replayFrom {
+			return nil
+		}
+
+		record := replayRecord{Height: height, BlockHash: block.Hash(), AppHash: state.AppHash}
+		data, err := json.Marshal(&record)
+		if err != nil {
+			return fmt.Errorf("failed to encode record: %w", err)
+		}
+		fmt.Fprintln(w, string(data))
+
+		if against == nil {
+			return nil
+		}
+		other, ok := against[height]
+		if !ok {
+			return nil
+		}
+		if other.BlockHash != record.BlockHash || string(other.AppHash) != string(record.AppHash) {
+			diverged++
+			log.Error("Replay diverged", "height", height,
+				"hash", record.BlockHash, "app_hash", record.AppHash,
+				"other_hash", other.BlockHash, "other_app_hash", other.AppHash)
+		}
+		return nil
+	}
+
+	// the state at a height is only known after executing all the blocks before it
+	state, err := consensus.ReplayBlocks(context.Background(), executor, bs, *gcs, opts)
+	if err != nil {
+		w.Flush()
+		log.Error("Replay failed", "last_height", state.LastBlockHeight, "err", err)
+		if errors.Is(err, consensus.ErrAppHashMismatch) {
+			os.Exit(1)
+		}
+		return
+	}
+	to := state.LastBlockHeight
+
+	if against == nil {
+		log.Info("Replay done", "from", *replayFrom, "to", to)
+		return
+	}
+	if diverged != 0 {
+		w.Flush()
+		log.Error("Replay differs from report", "against", *replayAgainst, "heights", diverged)
+		os.Exit(1)
+	}
+	log.Info("Replay matches report", "against", *replayAgainst, "from", *replayFrom, "to", to)
+}
+
+func readReplayReport(filename string) (map[uint64]replayRecord, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records := make(map[uint64]replayRecord)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record replayRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("invalid record %q: %w", scanner.Text(), err)
+		}
+		records[record.Height] = record
+	}
+	return records, scanner.Err()
+}
@@ -0,0 +1,137 @@
+//go:build bls
+// +build bls
+
+package consensus
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// AggregateCommit is a commit of BLS12-381 validators in which the
+// precommits for the block share a single signature, e.g., for light clients
+// and bridges that pay to store or transmit each signature. It is not part of
+// the chain: the blocks, their headers and the commits the nodes store and
+// validate keep one signature per validator, the aggregate is made from such
+// a Commit by whoever serves it, and is verified by whoever receives it with
+// VerifyAggregateCommit.
+//
+// The precommits for nil do not count towards the quorum and are dropped.
+type AggregateCommit struct {
+	Height  uint64      `json:"height"`
+	Round   int32       `json:"round"`
+	BlockID common.Hash `json:"block_id"`
+	// bitmap of the signers in the validator set order
+	Signers []byte `json:"signers"`
+	// timestamps of the signers, which are part of what they signed
+	TimestampsMs []uint64 `json:"timestamps_ms"`
+	Signature    []byte   `json:"signature"`
+}
+
+var ErrNotBLS12381 = errors.New("validator key is not bls12381")
+
+func (agg *AggregateCommit) signed(idx int) bool {
+	return idx/8 < len(agg.Signers) && agg.Signers[idx/8]&(1<<(idx%8)) != 0
+}
+
+// NewAggregateCommit aggregates the signatures for the block of a commit made
+// by vals. All the validators that signed the block must have BLS12-381 keys.
+func NewAggregateCommit(vals *ValidatorSet, commit *Commit) (*AggregateCommit, error) {
+	if vals.Size() != len(commit.Signatures) {
+		return nil, fmt.Errorf("invalid commit -- wrong set size: %d vs %d", vals.Size(), len(commit.Signatures))
+	}
+
+	agg := &AggregateCommit{
+		Height:  commit.Height,
+		Round:   commit.Round,
+		BlockID: commit.BlockID,
+		Signers: make([]byte, (len(commit.Signatures)+7)/8),
+	}
+	var sigs [][]byte
+	for idx, commitSig := range commit.Signatures {
+		if !commitSig.ForBlock() {
+			continue
+		}
+		_, val := vals.GetByIndex(int32(idx))
+		if _, ok := val.PubKey.(*BLS12381PubKey); !ok {
+			return nil, fmt.Errorf("%w: %v", ErrNotBLS12381, val.Address)
+		}
+
+		agg.Signers[idx/8] |= 1 << (idx % 8)
+		agg.TimestampsMs = append(agg.TimestampsMs, commitSig.TimestampMs)
+		sigs = append(sigs, commitSig.Signature)
+	}
+
+	sig, err := AggregateBLS12381Signatures(sigs)
+	if err != nil {
+		return nil, err
+	}
+	agg.Signature = sig
+	return agg, nil
+}
+
+// VerifyAggregateCommit verifies that +2/3 of the voting power of vals, the
+// validator set of height, signed blockID, like VerifyCommitLight does for a
+// Commit. The signers sign their own timestamps, i.e., distinct messages, so
+// it still takes a pairing per signer; only the final exponentiation is
+// shared.
+func VerifyAggregateCommit(chainID string, vals *ValidatorSet, blockID common.Hash, height uint64, agg *AggregateCommit) error {
+	if agg == nil {
+		return errors.New("nil commit")
+	}
+	if agg.Height != height {
+		return fmt.Errorf("invalid commit height: expected %d, got %d", height, agg.Height)
+	}
+	if agg.BlockID != blockID {
+		return fmt.Errorf("invalid commit -- wrong block ID: want %v, got %v", blockID, agg.BlockID)
+	}
+	if len(agg.Signers) != (vals.Size()+7)/8 {
+		return fmt.Errorf("invalid commit -- wrong signer bitmap size %d", len(agg.Signers))
+	}
+
+	// rebuild the precommits of the signers to get what they signed
+	commitSigs := make([]CommitSig, vals.Size())
+	var pubKeys []*BLS12381PubKey
+	talliedVotingPower := int64(0)
+	for idx, val := range vals.Validators {
+		commitSigs[idx] = NewCommitSigAbsent()
+		if !agg.signed(idx) {
+			continue
+		}
+		if len(pubKeys) == len(agg.TimestampsMs) {
+			return errors.New("invalid commit -- fewer timestamps than signers")
+		}
+		pubKey, ok := val.PubKey.(*BLS12381PubKey)
+		if !ok {
+			return fmt.Errorf("%w: %v", ErrNotBLS12381, val.Address)
+		}
+
+		commitSigs[idx] = CommitSig{
+			BlockIDFlag:      BlockIDFlagCommit,
+			ValidatorAddress: val.Address,
+			TimestampMs:      agg.TimestampsMs[len(pubKeys)],
+		}
+		pubKeys = append(pubKeys, pubKey)
+		talliedVotingPower += val.VotingPower
+	}
+	if len(pubKeys) != len(agg.TimestampsMs) {
+		return errors.New("invalid commit -- more timestamps than signers")
+	}
+	if needed := vals.TotalVotingPower() * 2 / 3; talliedVotingPower <= needed {
+		return fmt.Errorf("%w: got %d, needed more than %d", ErrNotEnoughVotingPowerSigned, talliedVotingPower, needed)
+	}
+
+	commit := NewCommit(agg.Height, agg.Round, agg.BlockID, commitSigs)
+	msgs := make([][]byte, 0, len(pubKeys))
+	for idx := range commitSigs {
+		if agg.signed(idx) {
+			msgs = append(msgs, commit.GetVote(int32(idx)).VoteSignBytes(chainID))
+		}
+	}
+	if !VerifyBLS12381Aggregate(pubKeys, msgs, agg.Signature) {
+		return errors.New("invalid commit -- wrong aggregate signature")
+	}
+	return nil
+}
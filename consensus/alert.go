@@ -0,0 +1,34 @@
+package consensus
+
+// Some events need an operator at once rather than a line in the logs: the
+// node refusing to sign or to start, or the chain no longer progressing. They
+// are reported as Alerts to an Alerter, e.g., the webhooks of package alert.
+
+// The kinds of Alert.
+const (
+	AlertDoubleSignPrevented = "double_sign_prevented"
+	AlertAppHashMismatch     = "app_hash_mismatch"
+	AlertConsensusStall      = "consensus_stall"
+	AlertWALCorruption       = "wal_corruption"
+	AlertStoresInconsistent  = "stores_inconsistent"
+)
+
+// Alert is a critical event of a node.
+type Alert struct {
+	Kind    string `json:"kind"`
+	Height  uint64 `json:"height,omitempty"`
+	Message string `json:"message"`
+}
+
+// Alerter receives the alerts. Alert must not block.
+type Alerter interface {
+	Alert(Alert)
+}
+
+// WithAlerter reports to alerter the app hashes of the blocks applied again,
+// e.g., on restart, differing from the recorded ones, see WithAppHashStore.
+func WithAlerter(alerter Alerter) ExecutorOption {
+	return func(be *DefaultBlockExecutor) {
+		be.alerter = alerter
+	}
+}
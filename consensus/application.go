@@ -0,0 +1,124 @@
+package consensus
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// The executor delivers every committed block to a BlockFinalizer at once.
+// An Application is the same state machine driven step by step, as with
+// ABCI: a block begins, its txs are delivered in order, it ends with the
+// decisions of the application, and the state after it is committed.
+// WithApplication runs an Application as the finalizer.
+
+// ProposalValidator is implemented by the finalizers checking the contents of
+// a proposal, e.g., its txs, before we prevote it. A proposal it rejects is
+// prevoted nil. It must be deterministic, and must not change the app state.
+type ProposalValidator interface {
+	ValidateProposal(ctx context.Context, req FinalizeBlockRequest) error
+}
+
+// ProposalProcessor is implemented by the block executors asking the
+// application about a proposal, see ProposalValidator.
+type ProposalProcessor interface {
+	ProcessProposal(ctx context.Context, state ChainState, block *FullBlock) error
+}
+
+// BeginBlockRequest is a committed block as begun by the application, its
+// txs being delivered next.
+type BeginBlockRequest struct {
+	Height         uint64
+	Hash           common.Hash
+	TimeMs         uint64
+	Proposer       common.Address
+	LastCommitInfo CommitInfo
+}
+
+// Application is a state machine executing the committed blocks one step at
+// a time.
+type Application interface {
+	ProposalValidator
+	BeginBlock(ctx context.Context, req BeginBlockRequest) error
+	// DeliverTx executes a tx of the block. An error fails the tx, not the
+	// block: the txs of a committed block are all delivered.
+	DeliverTx(ctx context.Context, tx *types.Transaction) error
+	// EndBlock returns the decisions of the application, but the AppHash,
+	// which is the one returned by Commit.
+	EndBlock(ctx context.Context) (FinalizeBlockResponse, error)
+	Commit(ctx context.Context) (appHash []byte, err error)
+}
+
+// applicationFinalizer finalizes the blocks with an Application.
+type applicationFinalizer struct {
+	app Application
+}
+
+var (
+	_ BlockFinalizer    = applicationFinalizer{}
+	_ ProposalValidator = applicationFinalizer{}
+)
+
+// WithApplication delivers every applied block to app, see Application.
+func WithApplication(app Application) ExecutorOption {
+	return WithFinalizer(applicationFinalizer{app: app})
+}
+
+func (f applicationFinalizer) ValidateProposal(ctx context.Context, req FinalizeBlockRequest) error {
+	return f.app.ValidateProposal(ctx, req)
+}
+
+func (f applicationFinalizer) FinalizeBlock(ctx context.Context, req FinalizeBlockRequest) (FinalizeBlockResponse, error) {
+	if err := f.app.BeginBlock(ctx, BeginBlockRequest{
+		Height:         req.Height,
+		Hash:           req.Hash,
+		TimeMs:         req.TimeMs,
+		Proposer:       req.Proposer,
+		LastCommitInfo: req.LastCommitInfo,
+	}); err != nil {
+		return FinalizeBlockResponse{}, fmt.Errorf("begin block: %w", err)
+	}
+	for i, tx := range req.Txs {
+		if err := f.app.DeliverTx(ctx, tx); err != nil {
+			log.Debug("tx failed", "height", req.Height, "index", i, "hash", tx.Hash(), "err", err)
+		}
+	}
+	resp, err := f.app.EndBlock(ctx)
+	if err != nil {
+		return FinalizeBlockResponse{}, fmt.Errorf("end block: %w", err)
+	}
+	if resp.AppHash, err = f.app.Commit(ctx); err != nil {
+		return FinalizeBlockResponse{}, fmt.Errorf("commit: %w", err)
+	}
+	return resp, nil
+}
+
+// ProcessProposal asks the finalizer about block if it is a
+// ProposalValidator.
+func (be *DefaultBlockExecutor) ProcessProposal(ctx context.Context, state ChainState, block *FullBlock) error {
+	validator, ok := be.finalizer.(ProposalValidator)
+	if !ok {
+		return nil
+	}
+	req, err := finalizeRequest(state, block)
+	if err != nil {
+		return err
+	}
+	if err := validator.ValidateProposal(ctx, req); err != nil {
+		return fmt.Errorf("proposal rejected by application: %w", err)
+	}
+	return nil
+}
+
+// processProposal asks the application about the proposal block, if the
+// executor is a ProposalProcessor.
+func (cs *ConsensusState) processProposal(ctx context.Context, block *FullBlock) error {
+	processor, ok := cs.blockExec.(ProposalProcessor)
+	if !ok {
+		return nil
+	}
+	return processor.ProcessProposal(ctx, cs.chainState, block)
+}
@@ -0,0 +1,64 @@
+package consensus
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+var errRejected = errors.New("rejected")
+
+type stepApp struct {
+	calls  []string
+	reject bool
+}
+
+func (app *stepApp) ValidateProposal(ctx context.Context, req FinalizeBlockRequest) error {
+	if app.reject {
+		return errRejected
+	}
+	return nil
+}
+
+func (app *stepApp) BeginBlock(ctx context.Context, req BeginBlockRequest) error {
+	app.calls = append(app.calls, "begin")
+	return nil
+}
+
+func (app *stepApp) DeliverTx(ctx context.Context, tx *types.Transaction) error {
+	app.calls = append(app.calls, "deliver")
+	return nil
+}
+
+func (app *stepApp) EndBlock(ctx context.Context) (FinalizeBlockResponse, error) {
+	app.calls = append(app.calls, "end")
+	return FinalizeBlockResponse{AppHash: []byte{1}}, nil
+}
+
+func (app *stepApp) Commit(ctx context.Context) ([]byte, error) {
+	app.calls = append(app.calls, "commit")
+	return []byte{2}, nil
+}
+
+func TestApplication(t *testing.T) {
+	ctx := context.Background()
+	app := &stepApp{}
+	exec := NewDefaultBlockExecutor(nil, WithApplication(app))
+
+	state := *MakeGenesisChainState("test", 1000, []common.Address{{1}}, []int64{1}, 100, 1)
+	block := state.MakeBlock(1, NewCommit(0, 0, common.Hash{}, nil), common.Address{1})
+
+	processor := exec.(ProposalProcessor)
+	assert.NoError(t, processor.ProcessProposal(ctx, state, block))
+	app.reject = true
+	assert.ErrorIs(t, processor.ProcessProposal(ctx, state, block), errRejected)
+
+	newState, err := exec.ApplyBlock(ctx, state, block)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"begin", "end", "commit"}, app.calls)
+	assert.Equal(t, []byte{2}, newState.AppHash)
+}
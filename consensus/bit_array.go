@@ -0,0 +1,46 @@
+package consensus
+
+import "math/bits"
+
+// BitArray is defined by the go-ethereum fork, whose mutex is not reachable
+// from here: the helpers below are built on its locked methods, and a
+// compound one, e.g., SetIndexIfClear, is atomic only if its callers are
+// serialized, as the vote sets are under cs.mtx.
+
+// SetIndexIfClear sets bit i if it is clear, and tells whether it did, so
+// that whatever the bit stands for is requested once.
+func SetIndexIfClear(ba *BitArray, i int) bool {
+	if ba == nil || i < 0 || i >= ba.Size() || ba.GetIndex(i) {
+		return false
+	}
+	return ba.SetIndex(i, true)
+}
+
+// SetRange sets the bits from from, inclusive, to to, exclusive, clamped to
+// the size of the array.
+func SetRange(ba *BitArray, from, to int) {
+	if ba == nil {
+		return
+	}
+	if from < 0 {
+		from = 0
+	}
+	if size := ba.Size(); to > size {
+		to = size
+	}
+	for i := from; i < to; i++ {
+		ba.SetIndex(i, true)
+	}
+}
+
+// CountBits returns the number of bits set. It counts a consistent copy.
+func CountBits(ba *BitArray) int {
+	if ba == nil {
+		return 0
+	}
+	n := 0
+	for _, e := range ba.Copy().Elems {
+		n += bits.OnesCount64(e)
+	}
+	return n
+}
@@ -0,0 +1,27 @@
+package consensus
+
+import "github.com/ethereum/go-ethereum/common"
+
+// BlockMeta describes a stored block without its body, for range scans over
+// the block store.
+type BlockMeta struct {
+	Height     uint64         `json:"height"`
+	Hash       common.Hash    `json:"hash"`
+	ParentHash common.Hash    `json:"parent_hash"`
+	TimeMs     uint64         `json:"time_ms"`
+	Proposer   common.Address `json:"proposer"`
+	NumTxs     uint64         `json:"num_txs"`
+	BlockSize  uint64         `json:"block_size"` // of the encoded block
+}
+
+func NewBlockMeta(block *FullBlock, blockSize int) *BlockMeta {
+	return &BlockMeta{
+		Height:     block.NumberU64(),
+		Hash:       block.Hash(),
+		ParentHash: block.ParentHash(),
+		TimeMs:     block.TimeMs(),
+		Proposer:   block.Coinbase(),
+		NumTxs:     uint64(len(block.Transactions())),
+		BlockSize:  uint64(blockSize),
+	}
+}
@@ -0,0 +1,67 @@
+package consensus
+
+import (
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// When consensus is faster than the cadence applications expect, e.g., with
+// SkipTimeoutCommit or the fast path on full precommits, the proposer of
+// round 0 waits until TargetBlockTime after the last block before proposing,
+// so that block intervals approach it. The wait is bounded by maxWait, and by
+// half the propose timeout, which the other validators started meanwhile.
+
+type blockTimeTarget struct {
+	target  time.Duration
+	maxWait time.Duration
+}
+
+// TargetBlockTime makes the proposer wait up to maxWait (target if 0) before
+// proposing, until target after the last block time.
+func TargetBlockTime(target, maxWait time.Duration) StateOption {
+	return func(cs *ConsensusState) {
+		if maxWait <= 0 {
+			maxWait = target
+		}
+		cs.blockTime = blockTimeTarget{target: target, maxWait: maxWait}
+	}
+}
+
+// proposerWait is how long to wait at now before proposing after a block of
+// time lastBlockMs.
+func proposerWait(lastBlockMs uint64, now time.Time, target, maxWait time.Duration) time.Duration {
+	if target <= 0 || lastBlockMs == 0 {
+		return 0
+	}
+	wait := time.UnixMilli(int64(lastBlockMs)).Add(target).Sub(now)
+	if wait > maxWait {
+		wait = maxWait
+	}
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// waitToPropose schedules the propose step of round 0 if we are to propose
+// it ahead of the target block time, and tells whether it did.
+func (cs *ConsensusState) waitToPropose(height uint64, round int32) bool {
+	if round != 0 || cs.blockTime.target <= 0 || cs.replayMode || cs.privValidatorPubKey == nil ||
+		cs.chainState.LastBlockHeight == 0 || !cs.isProposer(cs.privValidatorPubKey.Address()) {
+		return false
+	}
+
+	maxWait := cs.blockTime.maxWait
+	if bound := cs.config.Propose(round) / 2; maxWait > bound {
+		maxWait = bound
+	}
+	wait := proposerWait(cs.chainState.LastBlockTime, CanonicalNow(), cs.blockTime.target, maxWait)
+	if wait <= 0 {
+		return false
+	}
+
+	log.Debug("waiting for the target block time to propose", "height", height, "wait", wait)
+	cs.scheduleTimeout(wait, height, round, RoundStepNewRound)
+	return true
+}
@@ -0,0 +1,27 @@
+package consensus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProposerWait(t *testing.T) {
+	last := time.UnixMilli(1_000_000)
+	lastMs := uint64(last.UnixMilli())
+
+	assert.Equal(t, 600*time.Millisecond, proposerWait(lastMs, last.Add(400*time.Millisecond), time.Second, time.Second))
+	// bounded
+	assert.Equal(t, 200*time.Millisecond, proposerWait(lastMs, last.Add(400*time.Millisecond), time.Second, 200*time.Millisecond))
+	// consensus slower than the target
+	assert.Zero(t, proposerWait(lastMs, last.Add(2*time.Second), time.Second, time.Second))
+	assert.Zero(t, proposerWait(lastMs, last, 0, time.Second))
+	assert.Zero(t, proposerWait(0, last, time.Second, time.Second))
+}
+
+func TestEmptyBlocksWait(t *testing.T) {
+	assert.False(t, emptyBlocks{}.wait())
+	assert.True(t, emptyBlocks{skip: true}.wait())
+	assert.True(t, emptyBlocks{interval: time.Second}.wait())
+}
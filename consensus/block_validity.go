@@ -0,0 +1,63 @@
+package consensus
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Besides the checks of the block executor, an embedder may register its own
+// checks of the proposed blocks, e.g., of header fields, tx limits or
+// preconditions of the application, with BlockValidators. They run before we
+// prevote, after the built-in checks and before the application is asked
+// with ProcessProposal; a block one rejects is prevoted nil. They do not run
+// on the blocks committed by +2/3 precommits, e.g., synced ones: a check
+// that is not deterministic across the validators only delays blocks.
+
+// BlockValidator checks a proposed block against the chain state of its
+// height.
+type BlockValidator interface {
+	ValidateBlock(state ChainState, block *FullBlock) error
+}
+
+// BlockValidatorFunc is a func as a BlockValidator.
+type BlockValidatorFunc func(state ChainState, block *FullBlock) error
+
+func (f BlockValidatorFunc) ValidateBlock(state ChainState, block *FullBlock) error {
+	return f(state, block)
+}
+
+var consensusBlockValidatorRejections = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "consensus_block_validator_rejections_total",
+		Help: "Total number of proposed blocks prevoted nil as rejected by a registered block validator",
+	})
+
+// BlockValidators adds validators to the checks of the proposed blocks, run
+// in order.
+func BlockValidators(validators ...BlockValidator) StateOption {
+	return func(cs *ConsensusState) {
+		cs.blockValidators = append(cs.blockValidators, validators...)
+	}
+}
+
+// MaxBlockTxs is a BlockValidator rejecting the blocks of more than max txs.
+func MaxBlockTxs(max int) BlockValidator {
+	return BlockValidatorFunc(func(state ChainState, block *FullBlock) error {
+		if n := len(block.Transactions()); n > max {
+			return fmt.Errorf("%d txs, at most %d", n, max)
+		}
+		return nil
+	})
+}
+
+// validateBlockChecks checks block with the registered validators.
+func (cs *ConsensusState) validateBlockChecks(block *FullBlock) error {
+	for i, validator := range cs.blockValidators {
+		if err := validator.ValidateBlock(cs.chainState, block); err != nil {
+			consensusBlockValidatorRejections.Inc()
+			return fmt.Errorf("rejected by block validator %d: %w", i, err)
+		}
+	}
+	return nil
+}
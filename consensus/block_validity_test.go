@@ -0,0 +1,50 @@
+package consensus
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlockValidators(t *testing.T) {
+	state := *MakeGenesisChainState("test", 1000, []common.Address{{1}}, []int64{1}, 100, 1)
+	block := state.MakeBlock(1, NewCommit(0, 0, common.Hash{}, nil), common.Address{1})
+	txs := types.Transactions{types.NewTx(&types.LegacyTx{Nonce: 1}), types.NewTx(&types.LegacyTx{Nonce: 2})}
+	block.Block = types.NewBlock(block.Header(), txs, nil, nil, trie.NewStackTrie(nil))
+
+	// none registered
+	cs := &ConsensusState{chainState: state}
+	assert.NoError(t, cs.validateBlockChecks(block))
+
+	errBadHeader := errors.New("bad header")
+	var called []int
+	BlockValidators(
+		BlockValidatorFunc(func(s ChainState, b *FullBlock) error {
+			called = append(called, 0)
+			assert.Equal(t, state.ChainID, s.ChainID)
+			return nil
+		}),
+		MaxBlockTxs(2),
+	)(cs)
+	assert.NoError(t, cs.validateBlockChecks(block))
+
+	BlockValidators(MaxBlockTxs(1))(cs)
+	err := cs.validateBlockChecks(block)
+	assert.EqualError(t, err, "rejected by block validator 2: 2 txs, at most 1")
+
+	// in order, the first rejection wins
+	cs.blockValidators = nil
+	BlockValidators(
+		BlockValidatorFunc(func(ChainState, *FullBlock) error { return errBadHeader }),
+		BlockValidatorFunc(func(ChainState, *FullBlock) error {
+			called = append(called, 1)
+			return nil
+		}),
+	)(cs)
+	assert.ErrorIs(t, cs.validateBlockChecks(block), errBadHeader)
+	assert.Equal(t, []int{0, 0}, called)
+}
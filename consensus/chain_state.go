@@ -36,11 +36,23 @@ type ChainState struct {
 	LastValidators              *ValidatorSet
 	LastHeightValidatorsChanged int64
 
+	// Validators skipped when their turn to propose comes, sorted. Set by the
+	// application, see JailUpdate.
+	Jailed []common.Address
+
+	// Set when the application halted the chain after LastBlockHeight, see
+	// FinalizeBlockResponse.Halt.
+	HaltReason string
+
 	// Consensus parameters used for validating blocks.
-	// Changes returned by EndBlock and updated after Commit.
-	// ConsensusParams                  types.ConsensusParams
-	// LastHeightConsensusParamsChanged int64
+	// Changes returned by FinalizeBlock and updated after Commit.
+	ConsensusParams                  ConsensusParams
+	LastHeightConsensusParamsChanged uint64
+
 	Epoch uint64
+	// VoteExtensionMaxBytes caps the vote extensions, 0 for
+	// MaxVoteExtensionBytes.
+	VoteExtensionMaxBytes uint64
 
 	// Merkle root of the results from executing prev block
 	// LastResultsHash []byte
@@ -67,11 +79,14 @@ func (state ChainState) Copy() ChainState {
 		Validators:                  state.Validators.Copy(),
 		LastValidators:              state.LastValidators.Copy(),
 		LastHeightValidatorsChanged: state.LastHeightValidatorsChanged,
+		Jailed:                      append([]common.Address(nil), state.Jailed...),
+		HaltReason:                  state.HaltReason,
 
-		Epoch: state.Epoch,
+		Epoch:                 state.Epoch,
+		VoteExtensionMaxBytes: state.VoteExtensionMaxBytes,
 
-		// ConsensusParams:                  state.ConsensusParams,
-		// LastHeightConsensusParamsChanged: state.LastHeightConsensusParamsChanged,
+		ConsensusParams:                  state.ConsensusParams,
+		LastHeightConsensusParamsChanged: state.LastHeightConsensusParamsChanged,
 
 		AppHash: state.AppHash,
 
@@ -79,6 +94,14 @@ func (state ChainState) Copy() ChainState {
 	}
 }
 
+// VoteExtensionLimit is the largest vote extension accepted.
+func (state ChainState) VoteExtensionLimit() int {
+	if state.VoteExtensionMaxBytes == 0 || state.VoteExtensionMaxBytes > uint64(MaxVoteExtensionBytes) {
+		return MaxVoteExtensionBytes
+	}
+	return int(state.VoteExtensionMaxBytes)
+}
+
 func MakeGenesisChainState(chainID string, genesisTimeMs uint64, validatorAddrs []common.Address, votingPowers []int64, epoch uint64, proposerReptition int64) *ChainState {
 	vs := NewValidatorSet(validatorAddrs, votingPowers, proposerReptition)
 	nextVs := vs.Copy()
@@ -153,6 +176,8 @@ func (state ChainState) MakeBlock(
 	var timestamp uint64
 	if height == state.InitialHeight {
 		timestamp = state.LastBlockTime // genesis time
+	} else if state.ConsensusParams.PBTSEnabled(height) {
+		timestamp = proposerBlockTime(state.LastBlockTime, CanonicalNowMs())
 	} else {
 		timestamp = MedianTime(commit, state.LastValidators)
 	}
@@ -168,7 +193,7 @@ func (state ChainState) MakeBlock(
 				Coinbase:       proposerAddress,
 				LastCommitHash: commit.Hash(),
 				Difficulty:     big.NewInt(int64(height)),
-				Extra:          []byte{},
+				Extra:          NewHeaderExtra(state).Bytes(),
 				BaseFee:        big.NewInt(0), // TODO: update base fee
 			},
 			nil, nil, nil, trie.NewStackTrie(nil),
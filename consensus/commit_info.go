@@ -0,0 +1,95 @@
+package consensus
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// VoteInfo tells whether a validator signed the last commit, for fee
+// distribution and downtime penalties.
+type VoteInfo struct {
+	Address         common.Address `json:"address"`
+	Power           int64          `json:"power"`
+	SignedLastBlock bool           `json:"signed_last_block"`
+	// TimestampMs of the precommit, 0 if the validator did not sign
+	TimestampMs uint64 `json:"timestamp_ms"`
+}
+
+// CommitInfo is the signing info of every validator of the last commit, in
+// validator set order.
+type CommitInfo struct {
+	Round int32      `json:"round"`
+	Votes []VoteInfo `json:"votes"`
+}
+
+// MakeCommitInfo matches the signatures of a commit with the validator set
+// that made it. A precommit for nil counts as signed: the validator was
+// online, even if it did not see the block in time.
+func MakeCommitInfo(commit *Commit, vals *ValidatorSet) (CommitInfo, error) {
+	if commit == nil || len(commit.Signatures) == 0 {
+		return CommitInfo{}, nil
+	}
+	if len(commit.Signatures) != vals.Size() {
+		return CommitInfo{}, fmt.Errorf("commit has %d signatures for %d validators",
+			len(commit.Signatures), vals.Size())
+	}
+
+	info := CommitInfo{Round: commit.Round, Votes: make([]VoteInfo, len(commit.Signatures))}
+	for i, commitSig := range commit.Signatures {
+		_, val := vals.GetByIndex(int32(i))
+		if !commitSig.Absent() && commitSig.ValidatorAddress != val.Address {
+			return CommitInfo{}, fmt.Errorf("signature #%d from %v, expected %v", i, commitSig.ValidatorAddress, val.Address)
+		}
+
+		info.Votes[i] = VoteInfo{Address: val.Address, Power: val.VotingPower}
+		if !commitSig.Absent() {
+			info.Votes[i].SignedLastBlock = true
+			info.Votes[i].TimestampMs = commitSig.TimestampMs
+		}
+	}
+	return info, nil
+}
+
+// FinalizeBlockRequest is a committed block as delivered to the application.
+type FinalizeBlockRequest struct {
+	Height         uint64
+	Hash           common.Hash
+	TimeMs         uint64
+	Proposer       common.Address
+	Txs            types.Transactions
+	LastCommitInfo CommitInfo
+}
+
+// FinalizeBlockResponse carries the decisions of the application taking
+// effect from the next height.
+type FinalizeBlockResponse struct {
+	JailUpdates []JailUpdate
+	// ValidatorUpdates change the validator set from height H+2, see
+	// ValidatorUpdate
+	ValidatorUpdates []ValidatorUpdate
+	// AppHash is the hash of the application state after the block, set as
+	// the AppHash of the chain state
+	AppHash []byte
+	// Halt stops the chain after the block, e.g., as a circuit breaker when
+	// the application detects a critical bug: consensus no longer proposes
+	// and precommits nil, see ConsensusState.HaltStatus.
+	Halt       bool
+	HaltReason string
+	// ConsensusParams, if set, replace the consensus params from height
+	// H+1, see ValidateConsensusParamsUpdate
+	ConsensusParams *ConsensusParams
+	// MinTxPriority is the CheckTx priority below which the mempool does
+	// not propose txs after the block, e.g., the base fee of a fee market
+	// the app would reject them under; 0 proposes them all. It is a hint to
+	// the proposers only, the blocks of others are not checked against it.
+	MinTxPriority int64
+}
+
+// BlockFinalizer is implemented by applications executing the committed
+// blocks.
+type BlockFinalizer interface {
+	FinalizeBlock(ctx context.Context, req FinalizeBlockRequest) (FinalizeBlockResponse, error)
+}
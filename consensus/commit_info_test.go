@@ -0,0 +1,34 @@
+package consensus
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMakeCommitInfo(t *testing.T) {
+	n := 3
+	blockHash := common.BytesToHash([]byte{1, 2, 3})
+	// the last validator (in set order) misses the commit
+	vals, commit := makeTestCommit(t, GeneratePrivValidatorLocal, n, 0, 1, blockHash)
+
+	info, err := MakeCommitInfo(commit, vals)
+	assert.NoError(t, err)
+	assert.Len(t, info.Votes, n)
+	for i, vote := range info.Votes {
+		_, val := vals.GetByIndex(int32(i))
+		assert.Equal(t, val.Address, vote.Address)
+		assert.Equal(t, i != n-1, vote.SignedLastBlock)
+		if vote.SignedLastBlock {
+			assert.Equal(t, 1000+uint64(i), vote.TimestampMs)
+		} else {
+			assert.Zero(t, vote.TimestampMs)
+		}
+	}
+
+	// a commit of another validator set is rejected
+	addrs := []common.Address{vals.Validators[0].Address, vals.Validators[1].Address}
+	_, err = MakeCommitInfo(commit, NewValidatorSet(addrs, []int64{1, 1}, 4))
+	assert.Error(t, err)
+}
@@ -0,0 +1,226 @@
+package consensus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// The consensus params are the limits blocks are validated against. They
+// start from the genesis ones, and the application changes them when it
+// finalizes a block (FinalizeBlockResponse.ConsensusParams); like validator
+// updates, the change applies from the next height, so the block proposed
+// meanwhile is still validated against the params it was built for.
+
+var (
+	ErrBlockParams        = errors.New("block exceeds consensus params")
+	ErrParamsNotFound     = errors.New("consensus params not found")
+	consensusParamsPrefix = []byte("consensus_params")
+	consensusParamsLatest = []byte("latest_consensus_params")
+)
+
+// MaxBlockSizeBytes bounds MaxBlockBytes: larger blocks cannot be gossiped,
+// see the full block channel of p2p.
+const MaxBlockSizeBytes = 32 * 1024 * 1024
+
+// MaxSynchronyBoundMs bounds the PBTS precision and message delay: beyond, a
+// proposer could time its blocks as it likes.
+const MaxSynchronyBoundMs = 60 * 1000
+
+// proposalOverheadBytes bounds the encoding of a proposal but its block, the
+// part set of a proposal carrying a block of MaxBlockBytes must hold both.
+const proposalOverheadBytes = 1024
+
+// UnbondingHeights is how many heights a validator leaving the set is assumed
+// to stay bonded, so that the application can still slash it. Evidence older
+// than that could name validators that left with their stake, and cannot be
+// kept longer.
+var UnbondingHeights uint64 = 2 * EvidenceMaxAgeHeights
+
+// ConsensusParams are the block limits of a height. A zero field means the
+// default: no limit, EvidenceMaxAgeHeights, vote extensions from the initial
+// height, no proposer-based timestamps, or the default synchrony bounds (see
+// pbts.go).
+type ConsensusParams struct {
+	MaxBlockBytes              uint64 `json:"max_block_bytes,omitempty"`
+	MaxGas                     uint64 `json:"max_gas,omitempty"`
+	EvidenceMaxAgeHeights      uint64 `json:"evidence_max_age_heights,omitempty"`
+	VoteExtensionsEnableHeight uint64 `json:"vote_extensions_enable_height,omitempty"`
+	PBTSEnableHeight           uint64 `json:"pbts_enable_height,omitempty" rlp:"optional"`
+	SynchronyPrecisionMs       uint64 `json:"synchrony_precision_ms,omitempty" rlp:"optional"`
+	SynchronyMessageDelayMs    uint64 `json:"synchrony_message_delay_ms,omitempty" rlp:"optional"`
+}
+
+// EvidenceMaxAge is how many heights evidence is kept and accepted.
+func (p ConsensusParams) EvidenceMaxAge() uint64 {
+	if p.EvidenceMaxAgeHeights == 0 {
+		return EvidenceMaxAgeHeights
+	}
+	return p.EvidenceMaxAgeHeights
+}
+
+// VoteExtensionsEnabled tells whether precommits of height are extended.
+func (p ConsensusParams) VoteExtensionsEnabled(height uint64) bool {
+	return height >= p.VoteExtensionsEnableHeight
+}
+
+// ValidateConsensusParams checks params on their own, at genesis.
+func ValidateConsensusParams(p ConsensusParams) error {
+	var pe paramErrors
+	if p.MaxBlockBytes > MaxBlockSizeBytes {
+		pe.addf("max block bytes is %d, must be at most %d", p.MaxBlockBytes, MaxBlockSizeBytes)
+	}
+	if p.MaxBlockBytes != 0 && p.MaxBlockBytes < MaxHeaderBytes {
+		pe.addf("max block bytes is %d, must be at least %d for the header", p.MaxBlockBytes, MaxHeaderBytes)
+	}
+	if maxParts := uint64(MaxParts) * uint64(BlockPartSize); p.MaxBlockBytes+proposalOverheadBytes > maxParts {
+		pe.addf("max block bytes is %d, must be at most %d to fit the proposal in %d parts of %d bytes",
+			p.MaxBlockBytes, maxParts-proposalOverheadBytes, MaxParts, BlockPartSize)
+	}
+	if age := p.EvidenceMaxAge(); age > UnbondingHeights {
+		pe.addf("evidence max age is %d heights, must be at most the %d heights validators stay bonded or the misbehaving ones may be gone", age, UnbondingHeights)
+	}
+	if p.SynchronyPrecisionMs > MaxSynchronyBoundMs {
+		pe.addf("synchrony precision is %dms, must be at most %dms", p.SynchronyPrecisionMs, MaxSynchronyBoundMs)
+	}
+	if p.SynchronyMessageDelayMs > MaxSynchronyBoundMs {
+		pe.addf("synchrony message delay is %dms, must be at most %dms", p.SynchronyMessageDelayMs, MaxSynchronyBoundMs)
+	}
+	return pe.err()
+}
+
+// ValidateConsensusParamsUpdate checks the params set by the application
+// when finalizing the block of height: vote extensions and proposer-based
+// timestamps cannot be enabled retroactively, nor disabled once enabled.
+func ValidateConsensusParamsUpdate(height uint64, old, next ConsensusParams) error {
+	if err := ValidateConsensusParams(next); err != nil {
+		return err
+	}
+	var pe paramErrors
+	if next.VoteExtensionsEnableHeight != old.VoteExtensionsEnableHeight {
+		if old.VoteExtensionsEnabled(height + 1) {
+			pe.addf("vote extensions are enabled since height %d, cannot be changed", old.VoteExtensionsEnableHeight)
+		} else if next.VoteExtensionsEnableHeight <= height+1 {
+			pe.addf("vote extensions enable height is %d, must be above %d", next.VoteExtensionsEnableHeight, height+1)
+		}
+	}
+	if next.PBTSEnableHeight != old.PBTSEnableHeight {
+		if old.PBTSEnabled(height + 1) {
+			pe.addf("proposer-based timestamps are enabled since height %d, cannot be changed", old.PBTSEnableHeight)
+		} else if next.PBTSEnableHeight != 0 && next.PBTSEnableHeight <= height+1 {
+			pe.addf("proposer-based timestamps enable height is %d, must be above %d", next.PBTSEnableHeight, height+1)
+		}
+	}
+	return pe.err()
+}
+
+// validateBlockParams checks a block against the params of its height.
+func validateBlockParams(p ConsensusParams, block *FullBlock) error {
+	if p.MaxBlockBytes != 0 {
+		if size := uint64(block.Size()); size > p.MaxBlockBytes {
+			return fmt.Errorf("%w: %d bytes, at most %d", ErrBlockParams, size, p.MaxBlockBytes)
+		}
+	}
+	if p.MaxGas != 0 {
+		gas := uint64(0)
+		for _, tx := range block.Transactions() {
+			if gas += tx.Gas(); gas > p.MaxGas || gas < tx.Gas() {
+				return fmt.Errorf("%w: txs wanting more than %d gas", ErrBlockParams, p.MaxGas)
+			}
+		}
+	}
+	return nil
+}
+
+// ConsensusParamsStore keeps the consensus params of every height, written
+// only at the heights they change, like the ValidatorStore. The executor
+// records the params of the next height of each applied block, see
+// WithConsensusParamsStore.
+type ConsensusParamsStore struct {
+	db *leveldb.DB
+}
+
+func NewConsensusParamsStore(db *leveldb.DB) *ConsensusParamsStore {
+	return &ConsensusParamsStore{db: db}
+}
+
+func (s *ConsensusParamsStore) key(height uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], height)
+	return append(append([]byte{}, consensusParamsPrefix...), b[:]...)
+}
+
+// Latest is the highest height the params are known of, 0 if none.
+func (s *ConsensusParamsStore) Latest() uint64 {
+	data, err := s.db.Get(consensusParamsLatest, nil)
+	if err != nil || len(data) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(data)
+}
+
+// Save records the params of a height. Heights must be saved in order;
+// params equal to the ones of the previous entry are not written again.
+func (s *ConsensusParamsStore) Save(height uint64, params ConsensusParams) error {
+	latest := s.Latest()
+	if height <= latest {
+		return nil
+	}
+
+	batch := new(leveldb.Batch)
+	if prev, err := s.Load(latest); err != nil || prev != params {
+		data, err := rlp.EncodeToBytes(&params)
+		if err != nil {
+			return err
+		}
+		batch.Put(s.key(height), data)
+	}
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], height)
+	batch.Put(consensusParamsLatest, b[:])
+	return s.db.Write(batch, nil)
+}
+
+// saveApplied records the params made known by applying the block of
+// newState.LastBlockHeight: its own and the ones of the next height.
+func (s *ConsensusParamsStore) saveApplied(state, newState ChainState) {
+	height := newState.LastBlockHeight
+	for i, params := range []ConsensusParams{state.ConsensusParams, newState.ConsensusParams} {
+		if err := s.Save(height+uint64(i), params); err != nil {
+			log.Error("cannot save consensus params", "height", height+uint64(i), "err", err)
+			return
+		}
+	}
+}
+
+// Load returns the params of a height.
+func (s *ConsensusParamsStore) Load(height uint64) (ConsensusParams, error) {
+	if height == 0 || height > s.Latest() {
+		return ConsensusParams{}, fmt.Errorf("%w at height %d", ErrParamsNotFound, height)
+	}
+
+	it := s.db.NewIterator(util.BytesPrefix(consensusParamsPrefix), nil)
+	defer it.Release()
+	key := s.key(height)
+	ok := it.Seek(key)
+	if !ok {
+		ok = it.Last()
+	} else if !bytes.Equal(it.Key(), key) {
+		ok = it.Prev()
+	}
+	if !ok {
+		return ConsensusParams{}, fmt.Errorf("%w at height %d", ErrParamsNotFound, height)
+	}
+
+	var params ConsensusParams
+	if err := rlp.DecodeBytes(it.Value(), &params); err != nil {
+		return ConsensusParams{}, err
+	}
+	return params, nil
+}
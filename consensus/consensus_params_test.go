@@ -0,0 +1,94 @@
+package consensus
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestValidateConsensusParams(t *testing.T) {
+	defer func(size int) { BlockPartSize = size }(BlockPartSize)
+	BlockPartSize = 1024
+
+	maxBlockBytes := uint64(MaxParts*BlockPartSize) - proposalOverheadBytes
+	for _, tc := range []struct {
+		name   string
+		params ConsensusParams
+		errMsg string
+	}{
+		{name: "defaults", params: ConsensusParams{}},
+		{name: "largest block of the parts", params: ConsensusParams{MaxBlockBytes: maxBlockBytes}},
+		{name: "block over the parts", params: ConsensusParams{MaxBlockBytes: maxBlockBytes + 1}, errMsg: "to fit the proposal in 1024 parts of 1024 bytes"},
+		{name: "block under the header", params: ConsensusParams{MaxBlockBytes: MaxHeaderBytes - 1}, errMsg: "for the header"},
+		{name: "evidence kept while bonded", params: ConsensusParams{EvidenceMaxAgeHeights: UnbondingHeights}},
+		{name: "evidence kept after unbonding", params: ConsensusParams{EvidenceMaxAgeHeights: UnbondingHeights + 1}, errMsg: "validators stay bonded"},
+		{name: "synchrony precision", params: ConsensusParams{SynchronyPrecisionMs: MaxSynchronyBoundMs + 1}, errMsg: "synchrony precision"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateConsensusParams(tc.params)
+			if tc.errMsg == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, ErrInvalidConsensusParams)
+			assert.Contains(t, err.Error(), tc.errMsg)
+		})
+	}
+}
+
+func TestValidateConsensusParamsUnbonding(t *testing.T) {
+	defer func(heights uint64) { UnbondingHeights = heights }(UnbondingHeights)
+
+	// the default evidence age is checked too
+	UnbondingHeights = EvidenceMaxAgeHeights - 1
+	assert.ErrorIs(t, ValidateConsensusParams(ConsensusParams{}), ErrInvalidConsensusParams)
+	assert.NoError(t, ValidateConsensusParams(ConsensusParams{EvidenceMaxAgeHeights: UnbondingHeights}))
+
+	// and at every update
+	assert.ErrorIs(t, ValidateConsensusParamsUpdate(10, ConsensusParams{EvidenceMaxAgeHeights: 10}, ConsensusParams{}), ErrInvalidConsensusParams)
+}
+
+func TestValidateConsensusParamsUpdate(t *testing.T) {
+	assert.NoError(t, ValidateConsensusParamsUpdate(10, ConsensusParams{}, ConsensusParams{MaxGas: 1000}))
+	assert.ErrorIs(t, ValidateConsensusParamsUpdate(10, ConsensusParams{}, ConsensusParams{MaxBlockBytes: MaxBlockSizeBytes + 1}), ErrInvalidConsensusParams)
+
+	// extensions are enabled from the initial height by default
+	assert.ErrorIs(t, ValidateConsensusParamsUpdate(10, ConsensusParams{}, ConsensusParams{VoteExtensionsEnableHeight: 20}), ErrInvalidConsensusParams)
+
+	disabled := ConsensusParams{VoteExtensionsEnableHeight: 100}
+	assert.NoError(t, ValidateConsensusParamsUpdate(10, disabled, ConsensusParams{VoteExtensionsEnableHeight: 20}))
+	assert.ErrorIs(t, ValidateConsensusParamsUpdate(10, disabled, ConsensusParams{VoteExtensionsEnableHeight: 11}), ErrInvalidConsensusParams)
+	assert.ErrorIs(t, ValidateConsensusParamsUpdate(99, disabled, ConsensusParams{VoteExtensionsEnableHeight: 200}), ErrInvalidConsensusParams)
+}
+
+func TestEvidenceMaxAge(t *testing.T) {
+	assert.Equal(t, EvidenceMaxAgeHeights, ConsensusParams{}.EvidenceMaxAge())
+	assert.Equal(t, uint64(10), ConsensusParams{EvidenceMaxAgeHeights: 10}.EvidenceMaxAge())
+}
+
+func TestConsensusParamsStore(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(t, err)
+	store := NewConsensusParamsStore(db)
+
+	_, err = store.Load(1)
+	assert.ErrorIs(t, err, ErrParamsNotFound)
+
+	p1 := ConsensusParams{MaxBlockBytes: 1 << 20}
+	p2 := ConsensusParams{MaxBlockBytes: 1 << 20, MaxGas: 1000}
+	assert.NoError(t, store.Save(1, p1))
+	assert.NoError(t, store.Save(2, p1))
+	assert.NoError(t, store.Save(3, p2))
+	// heights saved again are ignored
+	assert.NoError(t, store.Save(2, p2))
+
+	for height, want := range map[uint64]ConsensusParams{1: p1, 2: p1, 3: p2} {
+		got, err := store.Load(height)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got, "height %d", height)
+	}
+	_, err = store.Load(4)
+	assert.ErrorIs(t, err, ErrParamsNotFound)
+}
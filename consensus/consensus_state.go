@@ -6,8 +6,10 @@ import (
 	"fmt"
 	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/QuarkChain/go-minimal-pbft/internal/failpoint"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/log"
@@ -57,6 +59,10 @@ type BlockStore interface {
 	LoadBlockCommit(height uint64) *Commit
 	LoadSeenCommit() *Commit
 
+	// Iterate calls fn with the meta of every block in [from, to], from the
+	// highest if reverse, until fn returns false. The bodies are not loaded.
+	Iterate(from, to uint64, reverse bool, fn func(*BlockMeta) bool) error
+
 	SaveBlock(*FullBlock, *Commit)
 }
 
@@ -78,6 +84,19 @@ var (
 
 var msgQueueSize = 1000
 
+// Number of consensus sync requests from peers that lack the proposal of the
+// current round, after a prevote quorum, to re-broadcast the proposal.
+var proposalRebroadcastLackingPeers = 2
+
+// proposalSpread tracks how well the proposal of a round spreads, as observed
+// from the HasProposal flag of consensus sync requests.
+type proposalSpread struct {
+	height      uint64
+	round       int32
+	lacking     map[string]bool // peers
+	rebroadcast bool
+}
+
 // State handles execution of the consensus algorithm.
 // It processes votes and proposals, and upon reaching agreement,
 // commits blocks to the chain and executes them against the application.
@@ -97,8 +116,11 @@ type ConsensusState struct {
 	blockExec BlockExecutor
 
 	// add evidence to the pool
-	// when it's detected
-	// evpool evidencePool
+	// when it's detected, nil if evidence is ignored
+	evpool *EvidencePool
+
+	// picks the proposer of every round
+	proposerSelector ProposerSelector
 
 	// internal state
 	mtx sync.RWMutex
@@ -111,13 +133,15 @@ type ConsensusState struct {
 	// state changes may be triggered by: msgs from peers,
 	// msgs from ourself, or by timeouts
 	peerInMsgQueue   chan MsgInfo
+	verifiedMsgQueue chan MsgInfo // peer messages past verifyRoutine
+	verifiedSigs     *sigCache    // of the votes past verifyRoutine, see verifiedKeys
 	internalMsgQueue chan MsgInfo
 	timeoutTicker    TimeoutTicker
 	peerOutMsgQueue  chan Message
 
 	// a Write-Ahead Log ensures we can recover from any kind of crash
 	// and helps us avoid signing conflicting votes
-	// wal          WAL
+	wal          *WAL // nil without a WAL, see SetWAL
 	replayMode   bool // so we don't log signing errors during replay
 	doWALCatchup bool // determines if we even try to do the catchup
 
@@ -142,6 +166,56 @@ type ConsensusState struct {
 
 	consensusSyncRequestAsyncChan chan *consensusSyncRequestAsync
 	committedBlockChan            chan *FullBlock
+
+	proposalSpread proposalSpread
+
+	// when the current prevote or precommit step started waiting for
+	// quorum, zero if not waiting
+	quorumWaitSince time.Time
+
+	// the height and round for HeightRound
+	heightRound atomic.Value
+
+	heightTimings *HeightTimingStore // nil if not recorded
+	heightTiming  HeightTiming       // of the current height
+
+	operatorHalt *HaltStatus
+	upgradeHalt  upgradeHalt
+	blockTime    blockTimeTarget
+	txs          TxNotifier
+	emptyBlocks  emptyBlocks
+	noFastPath   bool
+
+	// of the Validators of the round state
+	validatorIndex *ValidatorIndex
+
+	voteExtensions     *voteExtensionSet // of the current height
+	lastVoteExtensions *voteExtensionSet
+
+	metrics *Metrics
+
+	newBatchVerifier func() BatchVerifier
+
+	futureMsgs *futureMsgs
+
+	roundEvents *roundEventBus
+
+	// lock transitions of the current height, see GetLockState
+	lockTransitions []LockTransition
+
+	// see BlockValidators
+	blockValidators []BlockValidator
+
+	storeDigests *StoreDigests // nil if not recorded
+
+	// see PipelineProposals
+	pipelineProposals bool
+
+	// misbehaviors of a byzantine validator, see Misbehave
+	misbehaviors Misbehaviors
+
+	// nil unless SafetyChecks
+	onSafetyViolation func(SafetyViolation)
 }
 
 // NewState returns a new State.
@@ -155,13 +229,17 @@ func NewConsensusState(
 	peerOutMsgQueue chan Message,
 	// txNotifier txNotifier,
 	// evpool evidencePool,
-	// options ...StateOption,
+	options ...StateOption,
 ) *ConsensusState {
 	cs := &ConsensusState{
 		config:                        cfg,
 		blockExec:                     blockExec,
 		blockStore:                    blockStore,
 		peerInMsgQueue:                peerInMsgQueue,
+		verifiedMsgQueue:              make(chan MsgInfo, msgQueueSize),
+		newBatchVerifier:              newParallelVerifier,
+		verifiedSigs:                  newSigCache(verifiedSigsSize),
+		futureMsgs:                    newFutureMsgs(),
 		peerOutMsgQueue:               peerOutMsgQueue,
 		internalMsgQueue:              make(chan MsgInfo, msgQueueSize),
 		timeoutTicker:                 NewTimeoutTicker(),
@@ -169,9 +247,12 @@ func NewConsensusState(
 		committedBlockChan:            make(chan *FullBlock, msgQueueSize),
 		done:                          make(chan struct{}),
 		doWALCatchup:                  true,
-		// wal:              nilWAL{},
 		// evpool:   evpool,
-		onStopCh: make(chan *RoundState),
+		onStopCh:         make(chan *RoundState),
+		proposerSelector: WeightedProposerSelector{},
+		metrics:          NewMetrics(),
+		upgradeHalt:      upgradeHalt{ch: make(chan struct{})},
+		roundEvents:      newRoundEventBus(),
 	}
 
 	// set function defaults (may be overwritten before calling Start)
@@ -180,6 +261,10 @@ func NewConsensusState(
 	cs.setProposal = cs.defaultSetProposal
 	cs.createProposalBlockFunc = cs.defaultCreateBlock
 
+	for _, option := range options {
+		option(cs)
+	}
+
 	// We have no votes, so reconstruct LastCommit from SeenCommit.
 	if state.LastBlockHeight > 0 {
 		cs.reconstructLastCommit(state)
@@ -195,6 +280,17 @@ func NewConsensusState(
 }
 
 func (cs *ConsensusState) defaultCreateBlock(height uint64, commit *Commit, proposerAddr common.Address) *FullBlock {
+	if handler, ok := cs.blockExec.(EvidenceHandler); ok {
+		var exts []*VoteExtension
+		if _, ok := cs.blockExec.(VoteExtender); ok {
+			exts = cs.lastVoteExtensions.forBlock(cs.chainState.LastBlockID)
+		}
+		return handler.MakeBlockWithEvidence(&cs.chainState, height, commit, proposerAddr, exts, cs.pendingEvidence())
+	}
+	if extender, ok := cs.blockExec.(VoteExtender); ok {
+		exts := cs.lastVoteExtensions.forBlock(cs.chainState.LastBlockID)
+		return extender.MakeBlockWithExtensions(&cs.chainState, height, commit, proposerAddr, exts)
+	}
 	return cs.blockExec.MakeBlock(&cs.chainState, height, commit, proposerAddr)
 }
 
@@ -293,66 +389,7 @@ func (cs *ConsensusState) LoadCommit(height uint64) *Commit {
 // OnStart loads the latest state via the WAL, and starts the timeout and
 // receive routines.
 func (cs *ConsensusState) OnStart(ctx context.Context) error {
-	// // We may set the WAL in testing before calling Start, so only OpenWAL if its
-	// // still the nilWAL.
-	// if _, ok := cs.wal.(nilWAL); ok {
-	// 	if err := cs.loadWalFile(ctx); err != nil {
-	// 		return err
-	// 	}
-	// }
-
-	// // We may have lost some votes if the process crashed reload from consensus
-	// // log to catchup.
-	// if cs.doWALCatchup {
-	// 	repairAttempted := false
-
-	// LOOP:
-	// 	for {
-	// 		err := cs.catchupReplay(ctx, cs.Height)
-	// 		switch {
-	// 		case err == nil:
-	// 			break LOOP
-
-	// 		case !IsDataCorruptionError(err):
-	// 			log.Error("error on catchup replay; proceeding to start state anyway", "err", err)
-	// 			break LOOP
-
-	// 		case repairAttempted:
-	// 			return err
-	// 		}
-
-	// 		log.Error("the WAL file is corrupted; attempting repair", "err", err)
-
-	// 		// 1) prep work
-	// 		if err := cs.wal.Stop(); err != nil {
-
-	// 			return err
-	// 		}
-
-	// 		repairAttempted = true
-
-	// 		// 2) backup original WAL file
-	// 		corruptedFile := fmt.Sprintf("%s.CORRUPTED", cs.config.WalFile())
-	// 		if err := tmos.CopyFile(cs.config.WalFile(), corruptedFile); err != nil {
-	// 			return err
-	// 		}
-
-	// 		log.Debug("backed up WAL file", "src", cs.config.WalFile(), "dst", corruptedFile)
-
-	// 		// 3) try to repair (WAL file will be overwritten!)
-	// 		if err := repairWalFile(corruptedFile, cs.config.WalFile()); err != nil {
-	// 			log.Error("the WAL repair failed", "err", err)
-	// 			return err
-	// 		}
-
-	// 		log.Info("successful WAL repair")
-
-	// 		// reload WAL file
-	// 		if err := cs.loadWalFile(ctx); err != nil {
-	// 			return err
-	// 		}
-	// 	}
-	// }
+	quorumMetricsState.Store(cs)
 
 	// we need the timeoutRoutine for replay so
 	// we don't block on the tick chan.
@@ -363,12 +400,24 @@ func (cs *ConsensusState) OnStart(ctx context.Context) error {
 		return err
 	}
 
+	// We may have lost some votes if the process crashed, reload them from
+	// the consensus log to catch up.
+	if cs.wal != nil && cs.doWALCatchup {
+		if err := cs.catchupReplay(ctx, cs.Height); err != nil {
+			if errors.Is(err, ErrWALCorrupted) {
+				return err
+			}
+			log.Error("error on catchup replay; proceeding to start state anyway", "err", err)
+		}
+	}
+
 	// Double Signing Risk Reduction
 	if err := cs.checkDoubleSigningRisk(cs.Height); err != nil {
 		return err
 	}
 
 	// now start the receiveRoutine
+	go cs.verifyRoutine(ctx)
 	go cs.receiveRoutine(ctx, 0)
 
 	// schedule the first round!
@@ -389,6 +438,7 @@ func (cs *ConsensusState) startRoutines(ctx context.Context, maxSteps int) {
 		return
 	}
 
+	go cs.verifyRoutine(ctx)
 	go cs.receiveRoutine(ctx, maxSteps)
 }
 
@@ -456,11 +506,16 @@ func (cs *ConsensusState) Wait() {
 
 func (cs *ConsensusState) updateHeight(height uint64) {
 	cs.Height = height
+	cs.publishHeightRound()
 }
 
 func (cs *ConsensusState) updateRoundStep(round int32, step RoundStepType) {
 	cs.Round = round
 	cs.Step = step
+	cs.trackQuorumWait()
+	cs.publishHeightRound()
+	cs.publishRoundEvent(EventNewStep, common.Hash{})
+	cs.checkLockState()
 }
 
 // enterNewRound(height, 0) at cs.StartTime.
@@ -533,8 +588,8 @@ func (cs *ConsensusState) processCommitedBlock(ctx context.Context, block *FullB
 		return
 	}
 
-	if err := cs.chainState.Validators.VerifyCommit(
-		cs.chainState.ChainID, block.Hash(), block.NumberU64(), block.Header().Commit); err != nil {
+	if err := VerifyCommitByKeyType(
+		cs.chainState.ChainID, cs.chainState.Validators, block.Hash(), block.NumberU64(), block.Header().Commit); err != nil {
 		log.Info("verify error")
 		return
 	}
@@ -577,6 +632,10 @@ func (cs *ConsensusState) processCommitedBlock(ctx context.Context, block *FullB
 		log.Error("failed to apply block", "height", height, "err", err)
 		return
 	}
+	if cs.evpool != nil {
+		cs.evpool.SetMaxAge(stateCopy.ConsensusParams.EvidenceMaxAge())
+		cs.evpool.MarkCommittedBlock(cs.blockExec, block)
+	}
 
 	// NewHeightStep!
 	cs.updateToState(ctx, stateCopy)
@@ -586,12 +645,9 @@ func (cs *ConsensusState) processCommitedBlock(ctx context.Context, block *FullB
 		log.Error("failed to get private validator pubkey", "height", height, "err", err)
 	}
 
-	// if we can skip timeoutCommit and have all the votes now,
-	if cs.config.SkipTimeoutCommit && cs.LastCommit.HasAll() {
-		// go straight to new round (skip timeout commit)
-		// cs.scheduleTimeout(time.Duration(0), cs.Height, 0, RoundStepNewHeight)
-		cs.enterNewRound(ctx, cs.Height, 0)
-	} else {
+	// if we have all the votes now, go straight to new round (skip timeout
+	// commit)
+	if !cs.enterNewHeightFast(ctx, cs.LastCommit) {
 		// cs.StartTime is already set.
 		// Schedule Round0 to start soon.
 		cs.scheduleRound0(&cs.RoundState)
@@ -599,16 +655,20 @@ func (cs *ConsensusState) processCommitedBlock(ctx context.Context, block *FullB
 
 	// By here,
 	// * cs.Height has been increment to height+1
-	// * cs.Step is now RoundStepNewHeight
+	// * cs.Step is now RoundStepNewHeight, unless all precommitted and round 0
+	//   started right away
 	// * cs.StartTime is set to when we will start round0.
 }
 
-func (cs *ConsensusState) ProcessSyncRequest(csq *ConsensusSyncRequest) ([]interface{}, error) {
-	log.Debug("Processing sync req", "req", csq)
+// ProcessSyncRequest returns the messages the peer lacks, according to its
+// consensus sync request.
+func (cs *ConsensusState) ProcessSyncRequest(csq *ConsensusSyncRequest, peerID string) ([]interface{}, error) {
+	log.Debug("Processing sync req", "req", csq, "peer", peerID)
 	respChan := make(chan []interface{})
 
 	reqAsync := &consensusSyncRequestAsync{
 		req:      csq,
+		peerID:   peerID,
 		respChan: respChan,
 	}
 
@@ -645,7 +705,7 @@ func appendDiffVotes(vs *VoteSet, bm []uint64, msgs []interface{}) []interface{}
 	return msgs
 }
 
-func (cs *ConsensusState) processSyncRequest(csq *ConsensusSyncRequest) []interface{} {
+func (cs *ConsensusState) processSyncRequest(ctx context.Context, csq *ConsensusSyncRequest, peerID string) []interface{} {
 	var msgs []interface{}
 	if csq.Height < cs.chainState.InitialHeight {
 		// nothing to have
@@ -674,6 +734,10 @@ func (cs *ConsensusState) processSyncRequest(csq *ConsensusSyncRequest) []interf
 	// now csq.height == cs.height and csq.round <= cs.round
 	if csq.HasProposal == 0 && cs.Proposal != nil {
 		msgs = append(msgs, &types.ProposalMessage{Proposal: cs.Proposal})
+
+		if csq.Round == uint32(cs.Round) {
+			cs.maybeRebroadcastProposal(ctx, peerID)
+		}
 	}
 	msgs = appendDiffVotes(cs.Votes.Prevotes(int32(csq.Round)), csq.PrevotesBitmap, msgs)
 	msgs = appendDiffVotes(cs.Votes.Precommits(int32(csq.Round)), csq.PrecommitsBitmap, msgs)
@@ -681,6 +745,32 @@ func (cs *ConsensusState) processSyncRequest(csq *ConsensusSyncRequest) []interf
 	return msgs
 }
 
+// maybeRebroadcastProposal is called for each request of a peer asking for
+// the current round without having the proposal. Once the prevotes show that the round is
+// progressing (+2/3 any) but several peers still lack the proposal (e.g. the
+// proposer is poorly connected), re-broadcast the proposal we have so that
+// it does not only spread through consensus sync. Done at most once per round.
+func (cs *ConsensusState) maybeRebroadcastProposal(ctx context.Context, peerID string) {
+	ps := &cs.proposalSpread
+	if ps.height != cs.Height || ps.round != cs.Round || ps.lacking == nil {
+		*ps = proposalSpread{height: cs.Height, round: cs.Round, lacking: make(map[string]bool)}
+	}
+
+	// a peer asks again until it gets the proposal, it counts once
+	ps.lacking[peerID] = true
+	if ps.rebroadcast || len(ps.lacking) < proposalRebroadcastLackingPeers {
+		return
+	}
+	if !cs.isProposalComplete() || !cs.Votes.Prevotes(cs.Round).HasTwoThirdsAny() {
+		return
+	}
+
+	log.Debug("re-broadcasting proposal", "height", cs.Height, "round", cs.Round, "lacking", len(ps.lacking))
+
+	ps.rebroadcast = true
+	cs.broadcastMessageToPeers(ctx, &ProposalMessage{Proposal: cs.Proposal})
+}
+
 func (cs *ConsensusState) broadcastMessageToPeers(ctx context.Context, msg Message) {
 	select {
 	case <-ctx.Done():
@@ -795,6 +885,8 @@ func (cs *ConsensusState) updateToState(ctx context.Context, state ChainState) {
 	}
 
 	// RoundState fields
+	// the locks go first, not to be checked against round 0 of the height
+	cs.resetLocks()
 	cs.updateHeight(height)
 	cs.updateRoundStep(0, RoundStepNewHeight)
 
@@ -810,19 +902,27 @@ func (cs *ConsensusState) updateToState(ctx context.Context, state ChainState) {
 	}
 
 	cs.Validators = validators
+	cs.validatorIndex = NewValidatorIndex(validators)
+	cs.updateVoteExtensions(state, height)
 	cs.Proposal = nil
 	cs.ProposalBlock = nil
-	cs.LockedRound = -1
-	cs.LockedBlock = nil
-	cs.ValidRound = -1
-	cs.ValidBlock = nil
-	cs.Votes = NewHeightVoteSet(state.ChainID, height, validators)
+	cs.ProposalReceiveTime = time.Time{}
+	cs.Votes = NewHeightVoteSet(state.ChainID, height, cs.verifiedKeys(validators))
 	cs.CommitRound = -1
 	cs.LastValidators = state.LastValidators
 	cs.TriggeredTimeoutPrecommit = false
 
 	cs.chainState = state
 
+	cs.heightTiming = HeightTiming{}
+	recordHeightTiming(&cs.heightTiming.NewHeightMs)
+
+	cs.updateHaltMetric()
+	if status := cs.haltStatus(); status.Halted {
+		log.Warn("Consensus halted", "height", height, "source", status.Source, "reason", status.Reason)
+	}
+	cs.checkUpgradeHalt()
+
 	// Finally, broadcast RoundState
 	cs.newStep(ctx)
 }
@@ -834,6 +934,7 @@ func (cs *ConsensusState) newStep(ctx context.Context) {
 	// }
 
 	cs.nSteps++
+	cs.recordStepMetrics()
 }
 
 //-----------------------------------------
@@ -851,13 +952,11 @@ func (cs *ConsensusState) receiveRoutine(ctx context.Context, maxSteps int) {
 		// priv_val tracks LastSig
 
 		// close wal now that we're done writing to it
-		// if err := cs.wal.Stop(); err != nil {
-		// 	// if !errors.Is(err, service.ErrAlreadyStopped) {
-		// 	log.Error("failed trying to stop WAL", "error", err)
-		// 	// }
-		// }
-
-		// cs.wal.Wait()
+		if cs.wal != nil {
+			if err := cs.wal.Close(); err != nil {
+				log.Error("failed trying to stop WAL", "error", err)
+			}
+		}
 		close(cs.done)
 	}
 
@@ -893,23 +992,15 @@ func (cs *ConsensusState) receiveRoutine(ctx context.Context, maxSteps int) {
 
 		select {
 
-		case mi = <-cs.peerInMsgQueue:
-			// if err := cs.wal.Write(mi); err != nil {
-			// 	log.Error("failed writing to WAL", "err", err)
-			// }
+		case mi = <-cs.verifiedMsgQueue:
+			cs.walWriteMsg(mi)
 
 			// handles proposals, block parts, votes
 			// may generate internal events (votes, complete proposals, 2/3 majorities)
 			cs.handleMsg(ctx, mi)
 
 		case mi = <-cs.internalMsgQueue:
-			// err := cs.wal.WriteSync(mi) // NOTE: fsync
-			// if err != nil {
-			// 	panic(fmt.Sprintf(
-			// 		"failed to write %v msg to consensus WAL due to %v; check your file system and restart the node",
-			// 		mi, err,
-			// 	))
-			// }
+			cs.walWriteMsg(mi) // NOTE: fsync
 
 			// if _, ok := mi.Msg.(*VoteMessage); ok {
 			// we actually want to simulate failing during
@@ -923,9 +1014,7 @@ func (cs *ConsensusState) receiveRoutine(ctx context.Context, maxSteps int) {
 			cs.handleMsg(ctx, mi)
 
 		case ti := <-cs.timeoutTicker.Chan(): // tockChan:
-			// if err := cs.wal.Write(ti); err != nil {
-			// 	log.Error("failed writing to WAL", "err", err)
-			// }
+			cs.walWriteTimeout(ti)
 
 			// if the timeout is relevant to the rs
 			// go to the next step
@@ -934,19 +1023,26 @@ func (cs *ConsensusState) receiveRoutine(ctx context.Context, maxSteps int) {
 		case <-consensusSyncRequestTimer.C:
 			msg := cs.createSyncRequest()
 			cs.broadcastMessageToPeers(ctx, msg)
+			if cs.needCommit() {
+				cs.broadcastMessageToPeers(ctx, &WantCommit{Height: cs.Height})
+			}
 
 			consensusSyncRequestTimer.Reset(cs.config.ConsensusSyncRequestDuration)
 		case syncReqAsync := <-cs.consensusSyncRequestAsyncChan:
 			// respChan is supposed to be non-blocking
-			syncReqAsync.respChan <- cs.processSyncRequest(syncReqAsync.req)
+			syncReqAsync.respChan <- cs.processSyncRequest(ctx, syncReqAsync.req, syncReqAsync.peerID)
 		case commitedBlock := <-cs.committedBlockChan:
 			cs.processCommitedBlock(ctx, commitedBlock)
+		case <-cs.txsAvailable():
+			cs.handleTxsAvailable(ctx)
 		case <-ctx.Done():
 			onExit(cs)
 			return
 
 		}
 		// TODO should we handle context cancels here?
+
+		cs.replayFutureMsgs(ctx)
 	}
 }
 
@@ -960,6 +1056,10 @@ func (cs *ConsensusState) handleMsg(ctx context.Context, mi MsgInfo) {
 		err   error
 	)
 
+	if cs.futureMsgs.add(mi, cs.Height, cs.Round) {
+		return
+	}
+
 	msg, peerID := mi.Msg, mi.PeerID
 
 	switch msg := msg.(type) {
@@ -982,6 +1082,21 @@ func (cs *ConsensusState) handleMsg(ctx context.Context, mi MsgInfo) {
 			cs.broadcastMessageToPeers(ctx, msg)
 		}
 
+	case *VoteExtension:
+		added, err = cs.addVoteExtension(ctx, msg, peerID)
+		if added {
+			cs.broadcastMessageToPeers(ctx, msg)
+		}
+
+	case *verifiedVoteExtension:
+		added, err = cs.addVerifiedVoteExtension(ctx, msg)
+
+	case *DuplicateVoteEvidence:
+		added, err = cs.addEvidence(msg)
+		if added {
+			cs.broadcastMessageToPeers(ctx, msg)
+		}
+
 	// if err == ErrAddingVote {
 	// TODO: punish peer
 	// We probably don't want to stop the peer here. The vote does not
@@ -1041,6 +1156,7 @@ func (cs *ConsensusState) handleTimeout(
 		cs.enterPropose(ctx, ti.Height, 0)
 
 	case RoundStepPropose:
+		cs.metrics.ProposalTimeouts.Inc()
 		cs.enterPrevote(ctx, ti.Height, ti.Round)
 
 	case RoundStepPrevoteWait:
@@ -1061,7 +1177,7 @@ func (cs *ConsensusState) handleTimeout(
 // Used internally by handleTimeout and handleMsg to make state transitions
 
 // Enter: `timeoutNewHeight` by startTime (commitTime+timeoutCommit),
-//	or, if SkipTimeoutCommit==true, after receiving all precommits from (height,round-1)
+//	or after receiving all precommits from (height,round-1)
 // Enter: `timeoutPrecommits` after any +2/3 precommits from (height,round-1)
 // Enter: +2/3 precommits for nil at (height,round-1)
 // Enter: +2/3 prevotes any or +2/3 precommits for block or any from (height, round)
@@ -1076,19 +1192,26 @@ func (cs *ConsensusState) enterNewRound(ctx context.Context, height uint64, roun
 		return
 	}
 
+	// past the halt for upgrade, the node neither proposes nor votes
+	if cs.upgradeHalt.reached(cs.chainState) {
+		log.Debug("entering new round; halted for upgrade", "height", height, "round", round)
+		return
+	}
+
 	if now := CanonicalNow(); cs.StartTime.After(now) {
 		log.Debug("need to set a buffer and log message here for sanity", "start_time", "height", height, "round", round, cs.StartTime, "now", now)
 	}
 
 	log.Debug("entering new round", "height", height, "round", round, "current", fmt.Sprintf("%v/%v/%v", cs.Height, cs.Round, cs.Step))
+	if round == 0 {
+		recordHeightTiming(&cs.heightTiming.RoundZeroMs)
+	}
 
 	// increment validators if necessary
-	validators := cs.Validators
-	if cs.Round < round {
-		validators = validators.Copy()
-		for i := uint64(0); i < uint64(validators.ProposerReptition); i++ {
-			validators.IncrementProposerPriority(SafeSubInt32(round, cs.Round))
-		}
+	validators := roundValidators(cs.Validators, cs.Round, round)
+
+	if round > 0 {
+		cs.cancelSpeculation()
 	}
 
 	// Setup new round
@@ -1096,6 +1219,7 @@ func (cs *ConsensusState) enterNewRound(ctx context.Context, height uint64, roun
 	// but we fire an event, so update the round step first
 	cs.updateRoundStep(round, RoundStepNewRound)
 	cs.Validators = validators
+	cs.validatorIndex = NewValidatorIndex(validators)
 	if round == 0 {
 		// We've already reset these upon new height,
 		// and meanwhile we might have received a proposal
@@ -1104,11 +1228,18 @@ func (cs *ConsensusState) enterNewRound(ctx context.Context, height uint64, roun
 		log.Debug("resetting proposal info", "height", height, "round", round)
 		cs.Proposal = nil
 		cs.ProposalBlock = nil
+		cs.ProposalReceiveTime = time.Time{}
 	}
 
 	cs.Votes.SetRound(SafeAddInt32(round, 1)) // also track next round (round+1) to allow round-skipping
 	cs.TriggeredTimeoutPrecommit = false
+	// act on a polka received while we were in an earlier round
+	cs.unlockOnHigherPolka()
+	cs.publishRoundEvent(EventNewRound, common.Hash{})
 
+	if cs.waitForTxs(height, round) || cs.waitToPropose(height, round) {
+		return
+	}
 	cs.enterPropose(ctx, height, round)
 }
 
@@ -1162,12 +1293,20 @@ func (cs *ConsensusState) enterPropose(ctx context.Context, height uint64, round
 	address := cs.privValidatorPubKey.Address()
 
 	// if not a validator, we're done
-	if !cs.Validators.HasAddress(address) {
+	if !cs.validatorIndex.HasAddress(address) {
 		log.Debug("node is not a validator", "height", height, "round", round, "addr", address, "vals", cs.Validators)
 		return
 	}
 
-	if cs.isProposer(address) {
+	if cs.isHalted() {
+		log.Debug("propose step; consensus halted, not proposing", "height", height, "round", round)
+		return
+	}
+
+	if cs.isProposer(address) && cs.replayMode {
+		// the proposal we signed, if any, is replayed from the WAL
+		log.Debug("propose step; replaying, not proposing", "height", height, "round", round)
+	} else if cs.isProposer(address) {
 		log.Debug(
 			"propose step; our turn to propose",
 			"height", height, "round", round,
@@ -1179,16 +1318,26 @@ func (cs *ConsensusState) enterPropose(ctx context.Context, height uint64, round
 		log.Debug(
 			"propose step; not our turn to propose",
 			"height", height, "round", round,
-			"proposer", cs.Validators.GetProposer().Address,
+			"proposer", cs.proposer().Address,
 		)
 	}
 }
 
 func (cs *ConsensusState) isProposer(address common.Address) bool {
-	return cs.Validators.GetProposer().Address == address
+	return cs.proposer().Address == address
+}
+
+// proposer of the current round, jailed validators are skipped.
+func (cs *ConsensusState) proposer() *Validator {
+	return cs.proposerSelector.Proposer(cs.Validators, cs.Height, cs.Round, cs.chainState.Jailed)
 }
 
 func (cs *ConsensusState) defaultDecideProposal(height uint64, round int32) {
+	if cs.misbehaves(MisbehaviorWithholdProposal) {
+		log.Warn("misbehaving: withholding proposal", "height", height, "round", round)
+		return
+	}
+
 	var block *FullBlock
 
 	// Decide on block
@@ -1201,13 +1350,14 @@ func (cs *ConsensusState) defaultDecideProposal(height uint64, round int32) {
 		if block == nil {
 			return
 		}
+		if cs.misbehaves(MisbehaviorInvalidProposal) {
+			block = cs.invalidProposalBlock(block)
+		}
 	}
 
 	// Flush the WAL. Otherwise, we may not recompute the same proposal to sign,
 	// and the privValidator will refuse to sign anything.
-	// if err := cs.wal.FlushAndSync(); err != nil {
-	// 	log.Error("failed flushing WAL to disk")
-	// }
+	cs.walFlush()
 
 	// Make proposal
 	proposal := NewProposal(height, round, cs.ValidRound, block)
@@ -1215,11 +1365,17 @@ func (cs *ConsensusState) defaultDecideProposal(height uint64, round int32) {
 	// wait the max amount we would wait for a proposal
 	ctx, cancel := context.WithTimeout(context.TODO(), cs.config.TimeoutPropose)
 	defer cancel()
-	if err := cs.privValidator.SignProposal(ctx, cs.chainState.ChainID, proposal); err == nil {
+	failpoint.Inject(failpoint.BeforeSign)
+	err := cs.privValidator.SignProposal(ctx, cs.chainState.ChainID, proposal)
+	failpoint.Inject(failpoint.AfterSign)
+	if err == nil {
 		// send proposal and block parts on internal msg queue
 		cs.sendInternalMessage(ctx, MsgInfo{&ProposalMessage{proposal}, ""})
 
 		log.Debug("signed proposal", "height", height, "round", round, "proposal", proposal)
+		if cs.misbehaves(MisbehaviorConflictingProposal) {
+			cs.signConflictingProposal(ctx, proposal)
+		}
 	} else if !cs.replayMode {
 		log.Error("propose step; failed signing proposal", "height", height, "round", round, "err", err)
 	}
@@ -1326,6 +1482,22 @@ func (cs *ConsensusState) defaultDoPrevote(ctx context.Context, height uint64, r
 
 	// Validate proposal block
 	err := cs.blockExec.ValidateBlock(cs.chainState, cs.ProposalBlock)
+	if err == nil {
+		err = cs.verifyBlockEvidence(cs.ProposalBlock)
+	}
+	if err == nil {
+		err = cs.validateBlockChecks(cs.ProposalBlock)
+	}
+	if err == nil {
+		err = cs.checkProposalTimely()
+	}
+	if err == nil {
+		err = cs.processProposal(ctx, cs.ProposalBlock)
+	}
+	if err != nil && cs.misbehaves(MisbehaviorVoteInvalid) {
+		log.Warn("misbehaving: prevoting an invalid block", "height", height, "round", round, "err", err)
+		err = nil
+	}
 	if err != nil {
 		// ProposalBlock is invalid, prevote nil.
 		log.Error("prevote step: ProposalBlock is invalid", "height", height, "round", round, "err", err)
@@ -1338,6 +1510,7 @@ func (cs *ConsensusState) defaultDoPrevote(ctx context.Context, height uint64, r
 	// and the proposal block parts are validated as they are received (against the merkle hash in the proposal)
 	log.Debug("prevote step: ProposalBlock is valid", "height", height, "round", round)
 	cs.signAddVote(ctx, PrevoteType, cs.ProposalBlock.Hash())
+	cs.speculate(cs.ProposalBlock)
 }
 
 // Enter: any +2/3 prevotes at next round.
@@ -1394,6 +1567,12 @@ func (cs *ConsensusState) enterPrecommit(ctx context.Context, height uint64, rou
 		cs.newStep(ctx)
 	}()
 
+	if cs.isHalted() {
+		log.Debug("precommit step; consensus halted; precommitting nil", "height", height, "round", round)
+		cs.signAddVote(ctx, PrecommitType, common.Hash{})
+		return
+	}
+
 	// check for a polka
 	blockID, ok := cs.Votes.Prevotes(round).TwoThirdsMajority()
 
@@ -1421,8 +1600,7 @@ func (cs *ConsensusState) enterPrecommit(ctx context.Context, height uint64, rou
 			log.Debug("precommit step; +2/3 prevoted for nil", "height", height, "round", round)
 		} else {
 			log.Debug("precommit step; +2/3 prevoted for nil; unlocking", "height", height, "round", round)
-			cs.LockedRound = -1
-			cs.LockedBlock = nil
+			cs.unlock(round)
 		}
 
 		cs.signAddVote(ctx, PrecommitType, common.Hash{})
@@ -1434,7 +1612,7 @@ func (cs *ConsensusState) enterPrecommit(ctx context.Context, height uint64, rou
 	// If we're already locked on that block, precommit it, and update the LockedRound
 	if cs.LockedBlock.HashTo(blockID) {
 		log.Debug("precommit step; +2/3 prevoted locked block; relocking", "height", height, "round", round)
-		cs.LockedRound = round
+		cs.lock(round, cs.LockedBlock)
 
 		cs.signAddVote(ctx, PrecommitType, blockID)
 		return
@@ -1445,12 +1623,11 @@ func (cs *ConsensusState) enterPrecommit(ctx context.Context, height uint64, rou
 		log.Debug("precommit step; +2/3 prevoted proposal block; locking", "height", height, "round", round, "hash", blockID)
 
 		// Validate the block.
-		if err := cs.blockExec.ValidateBlock(cs.chainState, cs.ProposalBlock); err != nil {
+		if err := cs.blockExec.ValidateBlock(cs.chainState, cs.ProposalBlock); err != nil && !cs.misbehaves(MisbehaviorVoteInvalid) {
 			panic(fmt.Sprintf("precommit step; +2/3 prevoted for an invalid block: %v", err))
 		}
 
-		cs.LockedRound = round
-		cs.LockedBlock = cs.ProposalBlock
+		cs.lock(round, cs.ProposalBlock)
 
 		cs.signAddVote(ctx, PrecommitType, blockID)
 		return
@@ -1461,8 +1638,7 @@ func (cs *ConsensusState) enterPrecommit(ctx context.Context, height uint64, rou
 	// The +2/3 prevotes for this round is the POL for our unlock.
 	log.Debug("precommit step; +2/3 prevotes for a block we do not have; voting nil", "height", height, "round", round, "block_id", blockID)
 
-	cs.LockedRound = -1
-	cs.LockedBlock = nil
+	cs.unlock(round)
 
 	cs.signAddVote(ctx, PrecommitType, common.Hash{})
 }
@@ -1626,6 +1802,7 @@ func (cs *ConsensusState) finalizeCommit(ctx context.Context, height uint64) {
 		// Happens during replay if we already saved the block but didn't commit
 		log.Debug("calling finalizeCommit on already stored block", "height", block.Number)
 	}
+	recordHeightTiming(&cs.heightTiming.BlockPersistedMs)
 
 	// fail.Fail() // XXX
 
@@ -1642,16 +1819,12 @@ func (cs *ConsensusState) finalizeCommit(ctx context.Context, height uint64) {
 	// Either way, the State should not be resumed until we
 	// successfully call ApplyBlock (ie. later here, or in Handshake after
 	// restart).
-	// endMsg := EndHeightMessage{height}
-	// if err := cs.wal.WriteSync(endMsg); err != nil { // NOTE: fsync
-	// 	panic(fmt.Sprintf(
-	// 		"failed to write %v msg to consensus WAL due to %v; check your file system and restart the node",
-	// 		endMsg, err,
-	// 	))
-	// }
+	cs.walEndHeight(height)
 
 	// fail.Fail() // XXX
 
+	cs.prepareNextProposal(block)
+
 	// Create a copy of the state for staging and an event cache for txs.
 	stateCopy := cs.chainState.Copy()
 
@@ -1662,6 +1835,15 @@ func (cs *ConsensusState) finalizeCommit(ctx context.Context, height uint64) {
 		log.Error("failed to apply block", "height", height, "err", err)
 		return
 	}
+	recordHeightTiming(&cs.heightTiming.AppCommittedMs)
+	cs.recordStoreDigest(stateCopy)
+	cs.saveHeightTiming()
+	cs.publishRoundEvent(EventCommit, blockID)
+	cs.recordBlockMetrics(block)
+	if cs.evpool != nil {
+		cs.evpool.SetMaxAge(stateCopy.ConsensusParams.EvidenceMaxAge())
+		cs.evpool.MarkCommittedBlock(cs.blockExec, block)
+	}
 
 	// fail.Fail() // XXX
 
@@ -1675,13 +1857,16 @@ func (cs *ConsensusState) finalizeCommit(ctx context.Context, height uint64) {
 		log.Error("failed to get private validator pubkey", "height", height, "err", err)
 	}
 
-	// cs.StartTime is already set.
-	// Schedule Round0 to start soon.
-	cs.scheduleRound0(&cs.RoundState)
+	if !cs.enterNewHeightFast(ctx, cs.LastCommit) {
+		// cs.StartTime is already set.
+		// Schedule Round0 to start soon.
+		cs.scheduleRound0(&cs.RoundState)
+	}
 
 	// By here,
 	// * cs.Height has been increment to height+1
-	// * cs.Step is now RoundStepNewHeight
+	// * cs.Step is now RoundStepNewHeight, unless all precommitted and round 0
+	//   started right away
 	// * cs.StartTime is set to when we will start round0.
 }
 
@@ -1706,13 +1891,20 @@ func (cs *ConsensusState) defaultSetProposal(ctx context.Context, proposal *Prop
 	}
 
 	// Verify signature
-	if !cs.Validators.GetProposer().PubKey.VerifySignature(proposal.ProposalSignBytes(cs.chainState.ChainID), proposal.Signature) {
+	if !cs.proposer().PubKey.VerifySignature(proposal.ProposalSignBytes(cs.chainState.ChainID), proposal.Signature) {
 		return false, ErrInvalidProposalSignature
 	}
 
 	cs.Proposal = proposal
 	cs.ProposalBlock = proposal.Block
-	log.Info("Received proposal", "height", cs.Height, "round", cs.Round, "from", cs.Validators.GetProposer().Address)
+	cs.ProposalReceiveTime = CanonicalNow()
+	recordHeightTiming(&cs.heightTiming.ProposalMs)
+	if held, kind := cs.heldBlock(proposal.Block.Hash()); held != nil {
+		consensusProposalKnownBlocks.WithLabelValues(kind).Inc()
+		cs.ProposalBlock = held
+	}
+	log.Info("Received proposal", "height", cs.Height, "round", cs.Round, "from", cs.proposer().Address)
+	cs.publishRoundEvent(EventCompleteProposal, cs.ProposalBlock.Hash())
 
 	// Update Valid* if we can.
 	prevotes := cs.Votes.Prevotes(cs.Round)
@@ -1725,8 +1917,7 @@ func (cs *ConsensusState) defaultSetProposal(ctx context.Context, proposal *Prop
 				"valid_block_hash", cs.ProposalBlock.Hash(),
 			)
 
-			cs.ValidRound = cs.Round
-			cs.ValidBlock = cs.ProposalBlock
+			cs.setValid(cs.Round, cs.ProposalBlock)
 		}
 		// TODO: In case there is +2/3 majority in Prevotes set for some
 		// block and cs.ProposalBlock contains different block, either
@@ -1773,13 +1964,8 @@ func (cs *ConsensusState) tryAddVote(ctx context.Context, vote *Vote, peerID str
 				return added, err
 			}
 
-			// TODO: report conflicting votes to the evidence pool
-			// cs.evpool.ReportConflictingVotes(voteErr.VoteA, voteErr.VoteB)
-			log.Debug(
-				"found and sent conflicting votes to the evidence pool",
-				"vote_a", voteErr.VoteA,
-				"vote_b", voteErr.VoteB,
-			)
+			cs.metrics.ByzantineVotes.Inc()
+			cs.reportConflictingVotes(ctx, voteErr.VoteA, voteErr.VoteB)
 
 			return added, err
 		} else if errors.Is(err, ErrVoteNonDeterministicSignature) {
@@ -1825,12 +2011,9 @@ func (cs *ConsensusState) addVote(
 			return
 		}
 
-		// if we can skip timeoutCommit and have all the votes now,
-		if cs.config.SkipTimeoutCommit && cs.LastCommit.HasAll() {
-			// go straight to new round (skip timeout commit)
-			// cs.scheduleTimeout(time.Duration(0), cs.Height, 0, RoundStepNewHeight)
-			cs.enterNewRound(ctx, cs.Height, 0)
-		}
+		// if we have all the votes now, go straight to new round (skip
+		// timeout commit)
+		cs.enterNewHeightFast(ctx, cs.LastCommit)
 
 		return
 	}
@@ -1853,24 +2036,20 @@ func (cs *ConsensusState) addVote(
 	case PrevoteType:
 		prevotes := cs.Votes.Prevotes(vote.Round)
 		log.Debug("added vote to prevote", "vote", vote, "prevotes", prevotes.StringShort())
+		recordHeightTiming(&cs.heightTiming.FirstPrevoteMs)
 
 		// If +2/3 prevotes for a block or nil for *any* round:
 		if blockID, ok := prevotes.TwoThirdsMajority(); ok {
+			recordHeightTiming(&cs.heightTiming.PrevoteQuorumMs)
+			cs.roundEvents.publish(RoundEvent{Type: EventPolka, Height: height, Round: vote.Round, Step: cs.Step, BlockID: blockID})
 			// There was a polka!
 			// If we're locked but this is a recent polka, unlock.
 			// If it matches our ProposalBlock, update the ValidBlock
 
 			// Unlock if `cs.LockedRound < vote.Round <= cs.Round`
 			// NOTE: If vote.Round > cs.Round, we'll deal with it when we get to vote.Round
-			if (cs.LockedBlock != nil) &&
-				(cs.LockedRound < vote.Round) &&
-				(vote.Round <= cs.Round) &&
-				!cs.LockedBlock.HashTo(blockID) {
-
-				log.Debug("unlocking because of POL", "locked_round", cs.LockedRound, "pol_round", vote.Round)
-
-				cs.LockedRound = -1
-				cs.LockedBlock = nil
+			if vote.Round <= cs.Round {
+				cs.unlockOnHigherPolka()
 			}
 
 			// Update Valid* if we can.
@@ -1878,8 +2057,7 @@ func (cs *ConsensusState) addVote(
 			if (blockID != common.Hash{}) && (cs.ValidRound < vote.Round) && (vote.Round == cs.Round) {
 				if cs.ProposalBlock.HashTo(blockID) {
 					log.Debug("updating valid block because of POL", "valid_round", cs.ValidRound, "pol_round", vote.Round)
-					cs.ValidRound = vote.Round
-					cs.ValidBlock = cs.ProposalBlock
+					cs.setValid(vote.Round, cs.ProposalBlock)
 				} else {
 					log.Debug(
 						"valid block we do not know about; set ProposalBlock=nil",
@@ -1898,6 +2076,13 @@ func (cs *ConsensusState) addVote(
 		case cs.Round < vote.Round && prevotes.HasTwoThirdsAny():
 			// Round-skip if there is any 2/3+ of votes ahead of us
 			cs.enterNewRound(ctx, height, vote.Round)
+			if HasTwoThirdsNil(prevotes) {
+				cs.skipNilRound(ctx, height, vote.Round)
+			}
+
+		case cs.Round == vote.Round && HasTwoThirdsNil(prevotes):
+			// no need to wait for the timeouts of a round nothing can commit in
+			cs.skipNilRound(ctx, height, vote.Round)
 
 		case cs.Round == vote.Round && RoundStepPrevote <= cs.Step: // current round
 			blockID, ok := prevotes.TwoThirdsMajority()
@@ -1930,10 +2115,8 @@ func (cs *ConsensusState) addVote(
 			cs.enterPrecommit(ctx, height, vote.Round)
 
 			if (blockID != common.Hash{}) {
+				recordHeightTiming(&cs.heightTiming.PrecommitQuorumMs)
 				cs.enterCommit(ctx, height, vote.Round)
-				if cs.config.SkipTimeoutCommit && precommits.HasAll() {
-					cs.enterNewRound(ctx, cs.Height, 0)
-				}
 			} else {
 				cs.enterPrecommitWait(ctx, height, vote.Round)
 			}
@@ -1956,16 +2139,18 @@ func (cs *ConsensusState) signVote(
 ) (*Vote, error) {
 	// Flush the WAL. Otherwise, we may not recompute the same vote to sign,
 	// and the privValidator will refuse to sign anything.
-	// if err := cs.wal.FlushAndSync(); err != nil {
-	// 	return nil, err
-	// }
+	if cs.wal != nil && !cs.replayMode {
+		if err := cs.wal.FlushAndSync(); err != nil {
+			return nil, err
+		}
+	}
 
 	if cs.privValidatorPubKey == nil {
 		return nil, errPubKeyIsNotSet
 	}
 
 	addr := cs.privValidatorPubKey.Address()
-	valIdx, _ := cs.Validators.GetByAddress(addr)
+	valIdx, _ := cs.validatorIndex.GetByAddress(addr)
 
 	vote := &Vote{
 		ValidatorAddress: addr,
@@ -1993,7 +2178,9 @@ func (cs *ConsensusState) signVote(
 	ctx, cancel := context.WithTimeout(context.TODO(), timeout)
 	defer cancel()
 
+	failpoint.Inject(failpoint.BeforeSign)
 	err := cs.privValidator.SignVote(ctx, cs.chainState.ChainID, vote)
+	failpoint.Inject(failpoint.AfterSign)
 
 	return vote, err
 }
@@ -2028,6 +2215,16 @@ func (cs *ConsensusState) signAddVote(ctx context.Context, msgType SignedMsgType
 		return nil
 	}
 
+	// Our votes of the replayed height are replayed from the WAL, a vote
+	// signed again could conflict with them.
+	if cs.replayMode {
+		return nil
+	}
+
+	if cs.upgradeHalt.reached(cs.chainState) {
+		return nil
+	}
+
 	if cs.privValidatorPubKey == nil {
 		// Vote won't be signed, but it's not critical.
 		log.Error(fmt.Sprintf("signAddVote: %v", errPubKeyIsNotSet))
@@ -2035,7 +2232,7 @@ func (cs *ConsensusState) signAddVote(ctx context.Context, msgType SignedMsgType
 	}
 
 	// If the node not in the validator set, do nothing.
-	if !cs.Validators.HasAddress(cs.privValidatorPubKey.Address()) {
+	if !cs.validatorIndex.HasAddress(cs.privValidatorPubKey.Address()) {
 		return nil
 	}
 
@@ -2044,6 +2241,11 @@ func (cs *ConsensusState) signAddVote(ctx context.Context, msgType SignedMsgType
 	if err == nil {
 		cs.sendInternalMessage(ctx, MsgInfo{&VoteMessage{Vote: vote}, ""})
 		log.Debug("signed and pushed vote", "height", cs.Height, "round", cs.Round, "vote", vote)
+		cs.signAddVoteExtension(ctx, vote)
+		cs.checkVote(vote)
+		if cs.misbehaves(MisbehaviorEquivocate) {
+			cs.signConflictingVote(ctx, vote)
+		}
 		return vote
 	}
 
@@ -0,0 +1,326 @@
+package consensus
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// stateTestTicker records the timeouts instead of firing them, the test
+// fires them with stateTest.timeout.
+type stateTestTicker struct {
+	TimeoutTicker
+	scheduled []timeoutInfo
+}
+
+func (t *stateTestTicker) ScheduleTimeout(ti timeoutInfo) { t.scheduled = append(t.scheduled, ti) }
+
+// stateTestBlockStore keeps the blocks in memory.
+type stateTestBlockStore struct {
+	BlockStore
+	blocks  []*FullBlock
+	commits []*Commit
+}
+
+func (bs *stateTestBlockStore) Base() uint64 { return 1 }
+
+func (bs *stateTestBlockStore) Height() uint64 { return uint64(len(bs.blocks)) }
+
+func (bs *stateTestBlockStore) Size() uint64 { return uint64(len(bs.blocks)) }
+
+func (bs *stateTestBlockStore) LoadBlock(height uint64) *FullBlock {
+	if height == 0 || height > bs.Height() {
+		return nil
+	}
+	return bs.blocks[height-1]
+}
+
+func (bs *stateTestBlockStore) LoadBlockCommit(height uint64) *Commit {
+	if height == 0 || height > bs.Height() {
+		return nil
+	}
+	return bs.commits[height-1]
+}
+
+func (bs *stateTestBlockStore) LoadSeenCommit() *Commit { return bs.LoadBlockCommit(bs.Height()) }
+
+func (bs *stateTestBlockStore) Iterate(from, to uint64, reverse bool, fn func(*BlockMeta) bool) error {
+	return nil
+}
+
+func (bs *stateTestBlockStore) SaveBlock(block *FullBlock, commit *Commit) {
+	bs.blocks = append(bs.blocks, block)
+	bs.commits = append(bs.commits, commit)
+}
+
+// stateTest drives the ConsensusState of one of n validators of equal power
+// without starting it: the messages and timeouts are handled by the test, in
+// its goroutine.
+type stateTest struct {
+	t      *testing.T
+	ctx    context.Context
+	cs     *ConsensusState
+	ticker *stateTestTicker
+	blocks *stateTestBlockStore
+	// the keys of the validators, in the validator set order
+	pvs []PrivValidator
+	// index of the validator of cs, not the proposer of round 0 of height 1
+	self int
+}
+
+func newStateTest(t *testing.T, n int, configure func(*ConsensusConfig), options ...StateOption) *stateTest {
+	addrs := make([]common.Address, n)
+	powers := make([]int64, n)
+	byAddr := make(map[common.Address]PrivValidator, n)
+	for i := range addrs {
+		pv := GeneratePrivValidatorLocal()
+		pubKey, err := pv.GetPubKey(context.Background())
+		require.NoError(t, err)
+		addrs[i], powers[i] = pubKey.Address(), 1
+		byAddr[addrs[i]] = pv
+	}
+	genesis := *MakeGenesisChainState("test", uint64(CanonicalNowMs())-1000, addrs, powers, 100, 1)
+
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	cfg := params.NewDefaultConsesusConfig()
+	cfg.DoubleSignCheckHeight = 0
+	if configure != nil {
+		configure(cfg)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	st := &stateTest{
+		t:      t,
+		ctx:    ctx,
+		ticker: &stateTestTicker{},
+		blocks: &stateTestBlockStore{},
+		pvs:    make([]PrivValidator, n),
+	}
+	st.cs = NewConsensusState(ctx, cfg, genesis, NewDefaultBlockExecutor(db), st.blocks, make(chan MsgInfo), make(chan Message, 1000), options...)
+	st.cs.SetTimeoutTicker(st.ticker)
+
+	for i, val := range st.cs.Validators.Validators {
+		st.pvs[i] = byAddr[val.Address]
+	}
+	st.self = (st.proposerIndex(0) + 1) % n
+	st.cs.SetPrivValidator(st.pvs[st.self])
+	return st
+}
+
+// proposerIndex returns the index of the proposer of round of the current
+// height, from the current round on.
+func (st *stateTest) proposerIndex(round int32) int {
+	proposer := st.cs.proposerAt(st.cs.Height, round)
+	require.NotNil(st.t, proposer)
+	idx, _ := st.cs.Validators.GetByAddress(proposer.Address)
+	return int(idx)
+}
+
+// nextOtherRound returns the first round from the current one on that cs
+// does not propose in.
+func (st *stateTest) nextOtherRound() int32 {
+	round := st.cs.Round
+	for st.proposerIndex(round) == st.self {
+		round++
+	}
+	return round
+}
+
+// others returns the indexes of the validators other than cs.
+func (st *stateTest) others() []int {
+	var idxs []int
+	for i := range st.pvs {
+		if i != st.self {
+			idxs = append(idxs, i)
+		}
+	}
+	return idxs
+}
+
+// flush handles the messages cs sent itself, e.g., its proposal and votes.
+func (st *stateTest) flush() {
+	for {
+		select {
+		case mi := <-st.cs.internalMsgQueue:
+			st.cs.handleMsg(st.ctx, mi)
+		default:
+			return
+		}
+	}
+}
+
+// startRound enters round 0 of the current height, as its timeout would.
+func (st *stateTest) startRound() {
+	st.cs.enterNewRound(st.ctx, st.cs.Height, 0)
+	st.flush()
+}
+
+// timeout fires the timeout of step in the current round.
+func (st *stateTest) timeout(step RoundStepType) {
+	st.cs.handleTimeout(st.ctx, timeoutInfo{Height: st.cs.Height, Round: st.cs.Round, Step: step}, st.cs.RoundState)
+	st.flush()
+}
+
+// makeBlock returns a block of the current height proposed by the validator
+// at idx.
+func (st *stateTest) makeBlock(idx int) *FullBlock {
+	commit := NewCommit(0, 0, common.Hash{}, nil)
+	if st.cs.Height != st.cs.chainState.InitialHeight {
+		commit = st.cs.LastCommit.MakeCommit()
+	}
+	_, val := st.cs.Validators.GetByIndex(int32(idx))
+	return st.cs.blockExec.MakeBlock(&st.cs.chainState, st.cs.Height, commit, val.Address)
+}
+
+// propose handles the proposal of block in round, signed by the proposer of
+// the round at timestampMs (now if 0).
+func (st *stateTest) propose(round int32, polRound int32, block *FullBlock, timestampMs int64) *Proposal {
+	proposal := NewProposal(st.cs.Height, round, polRound, block)
+	if timestampMs != 0 {
+		proposal.TimestampMs = timestampMs
+	}
+	require.NoError(st.t, st.pvs[st.proposerIndex(round)].SignProposal(st.ctx, st.cs.chainState.ChainID, proposal))
+	st.cs.handleMsg(st.ctx, MsgInfo{Msg: &ProposalMessage{Proposal: proposal}, PeerID: "peer"})
+	st.flush()
+	return proposal
+}
+
+// vote handles a vote of the current height by each validator at idxs.
+func (st *stateTest) vote(typ SignedMsgType, round int32, blockID common.Hash, idxs ...int) {
+	for _, idx := range idxs {
+		st.handleVote(st.cs.Height, round, typ, blockID, st.cs.Validators, idx)
+	}
+}
+
+// precommitLate handles a precommit of the last block, committed in round 0,
+// by each validator at idxs.
+func (st *stateTest) precommitLate(block *FullBlock, idxs ...int) {
+	for _, idx := range idxs {
+		st.handleVote(block.NumberU64(), 0, PrecommitType, block.Hash(), st.cs.LastValidators, idx)
+	}
+}
+
+func (st *stateTest) handleVote(height uint64, round int32, typ SignedMsgType, blockID common.Hash, vals *ValidatorSet, idx int) {
+	_, val := vals.GetByIndex(int32(idx))
+	vote := &Vote{
+		ValidatorAddress: val.Address,
+		ValidatorIndex:   int32(idx),
+		Height:           height,
+		Round:            round,
+		TimestampMs:      st.cs.voteTime(),
+		Type:             typ,
+		BlockID:          blockID,
+	}
+	require.NoError(st.t, st.pvs[idx].SignVote(st.ctx, st.cs.chainState.ChainID, vote))
+	st.cs.handleMsg(st.ctx, MsgInfo{Msg: &VoteMessage{Vote: vote}, PeerID: "peer"})
+	st.flush()
+}
+
+// ownVote returns the vote of cs of the current height, nil if none.
+func (st *stateTest) ownVote(typ SignedMsgType, round int32) *Vote {
+	votes := st.cs.Votes.Prevotes(round)
+	if typ == PrecommitType {
+		votes = st.cs.Votes.Precommits(round)
+	}
+	return votes.GetByIndex(int32(st.self))
+}
+
+// commit makes the validators commit a new block of the current height in
+// round 0, all of them but the ones at late precommitting it.
+func (st *stateTest) commit(late ...int) *FullBlock {
+	st.startRound()
+	// our own proposal, if cs is the proposer
+	block := st.cs.ProposalBlock
+	if block == nil {
+		block = st.makeBlock(st.proposerIndex(0))
+		st.propose(0, -1, block, 0)
+	}
+
+	isLate := make(map[int]bool)
+	for _, idx := range late {
+		isLate[idx] = true
+	}
+	var precommits []int
+	for _, idx := range st.others() {
+		if !isLate[idx] {
+			precommits = append(precommits, idx)
+		}
+	}
+	st.vote(PrevoteType, 0, block.Hash(), st.others()...)
+	st.vote(PrecommitType, 0, block.Hash(), precommits...)
+	require.Equal(st.t, block.NumberU64(), st.blocks.Height())
+	return block
+}
+
+func TestStateTestCommit(t *testing.T) {
+	st := newStateTest(t, 4, func(cfg *ConsensusConfig) { cfg.TimeoutCommit = time.Hour })
+	block := st.commit()
+	require.Equal(t, uint64(2), st.cs.Height)
+	require.Equal(t, block.Hash(), st.cs.chainState.LastBlockID)
+}
+
+func TestFastPathCommit(t *testing.T) {
+	for _, skip := range []bool{false, true} {
+		st := newStateTest(t, 4, func(cfg *ConsensusConfig) {
+			cfg.TimeoutCommit = time.Hour
+			cfg.SkipTimeoutCommit = skip
+		})
+		late := st.others()[0]
+		block := st.commit(late)
+
+		// +2/3 precommitted: the next height waits for the late precommit
+		assert.Equal(t, RoundStepNewHeight, st.cs.Step)
+		assert.Equal(t, 0.0, testutil.ToFloat64(st.cs.metrics.FastPathCommits))
+
+		// and starts once all precommitted, whatever SkipTimeoutCommit
+		st.precommitLate(block, late)
+		assert.Equal(t, uint64(2), st.cs.Height)
+		assert.Less(t, RoundStepNewHeight, st.cs.Step)
+		assert.Equal(t, 1.0, testutil.ToFloat64(st.cs.metrics.FastPathCommits))
+	}
+}
+
+func TestFastPathCommitOff(t *testing.T) {
+	st := newStateTest(t, 4, func(cfg *ConsensusConfig) { cfg.TimeoutCommit = time.Hour }, FastPathCommit(false))
+	late := st.others()[0]
+	block := st.commit(late)
+
+	// the next height keeps waiting for TimeoutCommit
+	st.precommitLate(block, late)
+	assert.Equal(t, RoundStepNewHeight, st.cs.Step)
+	assert.Equal(t, 0.0, testutil.ToFloat64(st.cs.metrics.FastPathCommits))
+	last := st.ticker.scheduled[len(st.ticker.scheduled)-1]
+	assert.Equal(t, timeoutInfo{Duration: last.Duration, Height: 2, Round: 0, Step: RoundStepNewHeight}, last)
+	assert.Greater(t, last.Duration, 59*time.Minute)
+}
+
+func TestRebroadcastProposalLackingPeers(t *testing.T) {
+	st := newStateTest(t, 4, nil)
+	st.startRound()
+	block := st.makeBlock(st.proposerIndex(0))
+	st.propose(0, -1, block, 0)
+	st.vote(PrevoteType, 0, block.Hash(), st.others()[:2]...)
+	require.True(t, st.cs.Votes.Prevotes(0).HasTwoThirdsAny())
+
+	req := &ConsensusSyncRequest{Height: st.cs.Height, Round: uint32(st.cs.Round)}
+	// the requests of a single peer
+	for i := 0; i < proposalRebroadcastLackingPeers+1; i++ {
+		st.cs.processSyncRequest(st.ctx, req, "a")
+	}
+	assert.False(t, st.cs.proposalSpread.rebroadcast)
+
+	st.cs.processSyncRequest(st.ctx, req, "b")
+	assert.True(t, st.cs.proposalSpread.rebroadcast)
+}
@@ -5,17 +5,67 @@ import (
 	"errors"
 	"fmt"
 	"sort"
+	"sync"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
 	"github.com/syndtr/goleveldb/leveldb"
 )
 
 type DefaultBlockExecutor struct {
-	db *leveldb.DB
+	db         *leveldb.DB
+	finalizer  BlockFinalizer
+	validators *ValidatorStore
+	appHashes  *AppHashStore
+	params     *ConsensusParamsStore
+	alerter    Alerter
+	mempool    Mempool
+
+	specMu sync.Mutex
+	spec   *speculation
+
+	prepMu   sync.Mutex
+	prepared *preparedTxs
 }
 
-func NewDefaultBlockExecutor(db *leveldb.DB) BlockExecutor {
-	return &DefaultBlockExecutor{}
+type ExecutorOption func(*DefaultBlockExecutor)
+
+// WithFinalizer delivers every applied block to the application.
+func WithFinalizer(finalizer BlockFinalizer) ExecutorOption {
+	return func(be *DefaultBlockExecutor) {
+		be.finalizer = finalizer
+	}
+}
+
+// WithValidatorStore records the validator set of every height in store.
+func WithValidatorStore(store *ValidatorStore) ExecutorOption {
+	return func(be *DefaultBlockExecutor) {
+		be.validators = store
+	}
+}
+
+// WithAppHashStore records the app hash of every applied block in store, for
+// ReplayBlocks to check.
+func WithAppHashStore(store *AppHashStore) ExecutorOption {
+	return func(be *DefaultBlockExecutor) {
+		be.appHashes = store
+	}
+}
+
+// WithConsensusParamsStore records the consensus params of every height in
+// store.
+func WithConsensusParamsStore(store *ConsensusParamsStore) ExecutorOption {
+	return func(be *DefaultBlockExecutor) {
+		be.params = store
+	}
+}
+
+func NewDefaultBlockExecutor(db *leveldb.DB, opts ...ExecutorOption) BlockExecutor {
+	be := &DefaultBlockExecutor{}
+	for _, opt := range opts {
+		opt(be)
+	}
+	return be
 }
 
 func (be *DefaultBlockExecutor) ValidateBlock(state ChainState, b *FullBlock) error {
@@ -23,24 +73,24 @@ func (be *DefaultBlockExecutor) ValidateBlock(state ChainState, b *FullBlock) er
 }
 
 func validateBlock(state ChainState, block *FullBlock) error {
-
-	// Validate basic info.
-
-	if state.LastBlockHeight == 0 && block.NumberU64() != state.InitialHeight {
-		return fmt.Errorf("wrong Block.Header.Height. Expected %v for initial block, got %v",
-			block.NumberU64(), state.InitialHeight)
+	header := block.Header()
+	if err := ValidateHeaderBasic(header); err != nil {
+		return err
 	}
-	if state.LastBlockHeight > 0 && block.NumberU64() != state.LastBlockHeight+1 {
-		return fmt.Errorf("wrong Block.Header.Height. Expected %v, got %v",
-			state.LastBlockHeight+1,
-			block.NumberU64(),
-		)
+	if err := ValidateHeaderAgainstState(state, header); err != nil {
+		return err
 	}
-	// Validate prev block info.
-	if block.ParentHash() != state.LastBlockID {
-		return fmt.Errorf("wrong Block.Header.LastBlockID.  Expected %v, got %v",
-			state.LastBlockID,
-			block.ParentHash(),
+	if err := validateBlockParams(state.ConsensusParams, block); err != nil {
+		return err
+	}
+
+	if block.LastCommit == nil {
+		return errors.New("nil LastCommit")
+	}
+	if header.LastCommitHash != block.LastCommit.Hash() {
+		return fmt.Errorf("wrong Block.Header.LastCommitHash. Expected %v, got %v",
+			block.LastCommit.Hash(),
+			header.LastCommitHash,
 		)
 	}
 
@@ -49,64 +99,26 @@ func validateBlock(state ChainState, block *FullBlock) error {
 		if len(block.LastCommit.Signatures) != 0 {
 			return errors.New("initial block can't have LastCommit signatures")
 		}
-	} else {
-		// LastCommit.Signatures length is checked in VerifyCommit.
-		if err := state.LastValidators.VerifyCommit(
-			state.ChainID, state.LastBlockID, block.NumberU64()-1, block.LastCommit); err != nil {
-			return err
-		}
+		return nil
 	}
 
-	// Don't allow validator change within the epoch
-	if block.NumberU64()%state.Epoch != 0 && len(block.NextValidators()) != 0 {
-		return errors.New("cannot change validators within epoch")
+	// the signatures are checked to be the ones of LastValidators, in order
+	if err := VerifyCommitByKeyType(
+		state.ChainID, state.LastValidators, state.LastBlockID, block.NumberU64()-1, block.LastCommit); err != nil {
+		return err
 	}
 
-	// NOTE: We can't actually verify it's the right proposer because we don't
-	// know what round the block was first proposed. So just check that it's
-	// a legit address and a known validator.
-	// The length is checked in ValidateBasic above.
-	if !state.Validators.HasAddress(block.Coinbase()) {
-		return fmt.Errorf("block.Header.ProposerAddress %X is not a validator",
-			block.Coinbase(),
-		)
-	}
-
-	if block.TimeMs()/1000 != block.Time() {
-		return fmt.Errorf("inccorect timestamp")
+	// with PBTS, the validators check the time of the proposals they prevote
+	if state.ConsensusParams.PBTSEnabled(block.NumberU64()) {
+		return nil
 	}
-
-	// Validate block Time
-	switch {
-	case block.NumberU64() > state.InitialHeight:
-		if block.TimeMs() <= state.LastBlockTime {
-			return fmt.Errorf("block time %v not greater than last block time %v",
-				block.TimeMs(),
-				state.LastBlockTime,
-			)
-		}
-		medianTime := MedianTime(block.LastCommit, state.LastValidators)
-		if block.TimeMs() != medianTime {
-			return fmt.Errorf("invalid block time. Expected %v, got %v",
-				medianTime,
-				block.TimeMs(),
-			)
-		}
-
-	case block.NumberU64() == state.InitialHeight:
-		genesisTime := state.LastBlockTime
-		if block.TimeMs() != genesisTime {
-			return fmt.Errorf("block time %v is not equal to genesis time %v",
-				block.TimeMs(),
-				genesisTime,
-			)
-		}
-
-	default:
-		return fmt.Errorf("block height %v lower than initial height %v",
-			block.NumberU64(), state.InitialHeight)
+	medianTime := MedianTime(block.LastCommit, state.LastValidators)
+	if block.TimeMs() != medianTime {
+		return fmt.Errorf("invalid block time. Expected %v, got %v",
+			medianTime,
+			block.TimeMs(),
+		)
 	}
-
 	return nil
 }
 
@@ -166,63 +178,129 @@ func weightedMedian(weightedTimes []*weightedTime, totalVotingPower int64) (res
 }
 
 func (be *DefaultBlockExecutor) ApplyBlock(ctx context.Context, state ChainState, block *FullBlock) (ChainState, error) {
-	// TOOD: execute the block & new validator change
+	var resp FinalizeBlockResponse
+	if be.finalizer != nil {
+		var err error
+		if resp, err = be.finalize(ctx, state, block); err != nil {
+			return state, fmt.Errorf("finalize block failed for application: %w", err)
+		}
+	}
+
 	// Update the state with the block and responses.
-	state, err := updateState(state, block.Hash(), block, []common.Address{}, []int64{})
+	newState, err := updateState(state, block.Hash(), block, resp.ValidatorUpdates, resp.ConsensusParams)
 	if err != nil {
-		return state, fmt.Errorf("commit failed for application: %v", err)
+		return state, fmt.Errorf("commit failed for application: %w", err)
 	}
 
-	return state, nil
+	newState.Jailed, err = applyJailUpdates(newState.Validators, state.Jailed, resp.JailUpdates)
+	if err != nil {
+		return state, fmt.Errorf("invalid jail updates from application: %w", err)
+	}
+	newState.AppHash = resp.AppHash
+	if resp.Halt {
+		newState.HaltReason = resp.HaltReason
+		if newState.HaltReason == "" {
+			newState.HaltReason = "halted by the application"
+		}
+	}
+	if be.validators != nil {
+		be.validators.saveApplied(state, newState)
+	}
+	if be.params != nil {
+		be.params.saveApplied(state, newState)
+	}
+	if be.appHashes != nil {
+		be.checkAppHash(block, newState)
+		if err := be.appHashes.Save(newState.LastBlockHeight, newState.AppHash); err != nil {
+			log.Error("cannot save app hash", "height", newState.LastBlockHeight, "err", err)
+		}
+	}
+	if be.mempool != nil {
+		be.mempool.Update(ctx, block.NumberU64(), block.Transactions(), resp.MinTxPriority)
+	}
+
+	return newState, nil
+}
+
+// Query passes the query to the finalizer, if it can be queried.
+func (be *DefaultBlockExecutor) Query(ctx context.Context, req QueryRequest) (QueryResponse, error) {
+	querier, ok := be.finalizer.(Querier)
+	if !ok {
+		return QueryResponse{}, ErrQueryNotSupported
+	}
+	return querier.Query(ctx, req)
+}
+
+func (be *DefaultBlockExecutor) finalize(ctx context.Context, state ChainState, block *FullBlock) (FinalizeBlockResponse, error) {
+	if resp, ok, err := be.speculated(block); ok {
+		return resp, err
+	}
+	req, err := finalizeRequest(state, block)
+	if err != nil {
+		return FinalizeBlockResponse{}, err
+	}
+	return be.finalizer.FinalizeBlock(ctx, req)
+}
+
+func finalizeRequest(state ChainState, block *FullBlock) (FinalizeBlockRequest, error) {
+	// the last commit is signed by the validators of the previous height
+	var info CommitInfo
+	if block.NumberU64() > state.InitialHeight {
+		var err error
+		if info, err = MakeCommitInfo(block.LastCommit, state.LastValidators); err != nil {
+			return FinalizeBlockRequest{}, err
+		}
+	}
+
+	return FinalizeBlockRequest{
+		Height:         block.NumberU64(),
+		Hash:           block.Hash(),
+		TimeMs:         block.TimeMs(),
+		Proposer:       block.Coinbase(),
+		Txs:            block.Transactions(),
+		LastCommitInfo: info,
+	}, nil
 }
 
 func updateState(
 	state ChainState,
 	blockID common.Hash,
 	block *FullBlock,
-	nextValidators []common.Address,
-	nextVotingPowers []int64,
+	validatorUpdates []ValidatorUpdate,
+	paramsUpdate *ConsensusParams,
 ) (ChainState, error) {
 
 	// Copy the valset so we can apply changes from EndBlock
 	// and update s.LastValidators and s.Validators.
 	nValSet := state.NextValidators.Copy()
 
-	if len(nextValidators) != 0 {
-		// TODO: sanity check
-		nValSet = NewValidatorSet(nextValidators, nextVotingPowers, nValSet.ProposerReptition)
+	// Change results from this height but only applies to the next next height.
+	lastHeightValsChanged := state.LastHeightValidatorsChanged
+	if len(validatorUpdates) != 0 {
+		nextValidators, nextVotingPowers, pubKeys, err := applyValidatorUpdates(nValSet, validatorUpdates)
+		if err != nil {
+			return state, err
+		}
+		nValSet = updateValidatorSet(nValSet, nextValidators, nextVotingPowers)
+		inheritPubKeys(nValSet, state.NextValidators, nextValidators)
+		SetValidatorPubKeys(nValSet, pubKeys)
+		lastHeightValsChanged = int64(block.NumberU64()) + 1 + 1
 	}
 
 	// Update validator proposer priority and set state variables.
 	nValSet.IncrementProposerPriority(1)
 
-	// // Update the validator set with the latest abciResponses.
-	// lastHeightValsChanged := state.LastHeightValidatorsChanged
-	// if len(validatorUpdates) > 0 {
-	// 	err := nValSet.UpdateWithChangeSet(validatorUpdates)
-	// 	if err != nil {
-	// 		return state, fmt.Errorf("error changing validator set: %v", err)
-	// 	}
-	// 	// Change results from this height but only applies to the next next height.
-	// 	lastHeightValsChanged = header.Height + 1 + 1
-	// }
-
-	// Update the params with the latest abciResponses.
-	// nextParams := state.ConsensusParams
-	// lastHeightParamsChanged := state.LastHeightConsensusParamsChanged
-	// if abciResponses.EndBlock.ConsensusParamUpdates != nil {
-	// 	// NOTE: must not mutate s.ConsensusParams
-	// 	nextParams = state.ConsensusParams.UpdateConsensusParams(abciResponses.EndBlock.ConsensusParamUpdates)
-	// 	err := nextParams.ValidateConsensusParams()
-	// 	if err != nil {
-	// 		return state, fmt.Errorf("error updating consensus params: %v", err)
-	// 	}
-
-	// 	state.Version.App = nextParams.Version.AppVersion
-
-	// 	// Change results from this height but only applies to the next height.
-	// 	lastHeightParamsChanged = header.Height + 1
-	// }
+	// Update the params with the application response.
+	nextParams := state.ConsensusParams
+	lastHeightParamsChanged := state.LastHeightConsensusParamsChanged
+	if paramsUpdate != nil && *paramsUpdate != state.ConsensusParams {
+		if err := ValidateConsensusParamsUpdate(block.NumberU64(), state.ConsensusParams, *paramsUpdate); err != nil {
+			return state, err
+		}
+		// Change results from this height but only applies to the next height.
+		nextParams = *paramsUpdate
+		lastHeightParamsChanged = block.NumberU64() + 1
+	}
 
 	// NOTE: the AppHash has not been populated.
 	// It will be filled on state.Save.
@@ -237,6 +315,13 @@ func updateState(
 		LastValidators:  state.Validators.Copy(),
 		AppHash:         nil,
 		Epoch:           state.Epoch,
+
+		LastHeightValidatorsChanged: lastHeightValsChanged,
+
+		VoteExtensionMaxBytes: state.VoteExtensionMaxBytes,
+
+		ConsensusParams:                  nextParams,
+		LastHeightConsensusParamsChanged: lastHeightParamsChanged,
 	}, nil
 }
 
@@ -247,5 +332,9 @@ func (be *DefaultBlockExecutor) MakeBlock(
 	// evidence []types.Evidence,
 	proposerAddress common.Address) *FullBlock {
 
-	return chainState.MakeBlock(height, commit, proposerAddress)
+	block := chainState.MakeBlock(height, commit, proposerAddress)
+	if be.mempool != nil {
+		block = be.reapTxs(chainState, block)
+	}
+	return block
 }
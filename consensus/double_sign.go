@@ -0,0 +1,61 @@
+package consensus
+
+import (
+	"errors"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var ErrSignatureFoundAtPeers = errors.New("peers hold signatures from the same key above the local state")
+
+// how many committed heights SignedVotes looks back, from the latest one
+const signedVotesLookback = 100
+
+// SignedVotes returns the votes of the validator this node holds at heights
+// from fromHeight on, the most recent first and at most max of them. It
+// serves the peers checking on startup that they have not signed beyond
+// their local state, i.e., that they were not restored from an old backup.
+func (cs *ConsensusState) SignedVotes(addr common.Address, fromHeight uint64, max int) []*Vote {
+	votes, height := cs.signedVotesOfHeight(addr, fromHeight, max)
+
+	for i := uint64(1); i <= signedVotesLookback && i < height && len(votes) < max; i++ {
+		if height-i < fromHeight {
+			break
+		}
+		commit := cs.LoadCommit(height - i)
+		if commit == nil {
+			continue
+		}
+		for idx, sig := range commit.Signatures {
+			if sig.BlockIDFlag == BlockIDFlagCommit && sig.ValidatorAddress == addr {
+				votes = append(votes, commit.GetVote(int32(idx)))
+				break
+			}
+		}
+	}
+	return votes
+}
+
+// signedVotesOfHeight returns the votes of the validator in the rounds of the
+// current height, and the height.
+func (cs *ConsensusState) signedVotesOfHeight(addr common.Address, fromHeight uint64, max int) ([]*Vote, uint64) {
+	cs.mtx.RLock()
+	defer cs.mtx.RUnlock()
+
+	if cs.Votes == nil || cs.Height < fromHeight {
+		return nil, cs.Height
+	}
+
+	var votes []*Vote
+	for round := cs.Votes.Round(); round >= 0; round-- {
+		for _, vs := range []*VoteSet{cs.Votes.Precommits(round), cs.Votes.Prevotes(round)} {
+			if vs == nil {
+				continue
+			}
+			if vote := vs.GetByAddress(addr); vote != nil && len(votes) < max {
+				votes = append(votes, vote)
+			}
+		}
+	}
+	return votes, cs.Height
+}
@@ -0,0 +1,203 @@
+package consensus
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// A validator signing two different votes of the same height, round and type
+// is equivocating: the two votes are the evidence of it, which any node can
+// verify with the key of the validator. The evidence found by the vote sets
+// is kept in the EvidencePool, gossiped to the peers, and proposed to the
+// application by the EvidenceHandler of the block executor, to slash the
+// validator.
+//
+// Validator sets of past heights are not stored, so evidence is verified
+// against the validator set of the current height: evidence of a validator
+// that left the set is rejected.
+
+var ErrInvalidEvidence = errors.New("invalid evidence")
+
+// EvidenceMaxAgeHeights is how many heights evidence is kept and accepted in
+// blocks after the height of its votes, unless the consensus params set
+// another age.
+var EvidenceMaxAgeHeights uint64 = 100000
+
+// MaxBlockEvidence bounds the evidence proposed in a block.
+var MaxBlockEvidence = 32
+
+// EvidenceHandler is implemented by the block executors of applications
+// slashing the equivocating validators.
+type EvidenceHandler interface {
+	// MakeBlockWithEvidence replaces MakeBlock, and MakeBlockWithExtensions
+	// (extensions are nil if the executor is not a VoteExtender). evidence
+	// is the pending evidence, not yet in a block.
+	MakeBlockWithEvidence(chainState *ChainState, height uint64, commit *Commit, proposerAddress common.Address, extensions []*VoteExtension, evidence []*DuplicateVoteEvidence) *FullBlock
+	// BlockEvidence returns the evidence put in a block, for consensus to
+	// verify before voting for it.
+	BlockEvidence(block *FullBlock) ([]*DuplicateVoteEvidence, error)
+}
+
+// DuplicateVoteEvidence is two conflicting votes of a validator, VoteA for
+// the lowest block ID.
+type DuplicateVoteEvidence struct {
+	VoteA *Vote
+	VoteB *Vote
+}
+
+// NewDuplicateVoteEvidence orders two conflicting votes, so that the
+// evidence of the same votes received in any order has the same hash.
+func NewDuplicateVoteEvidence(vote1, vote2 *Vote) *DuplicateVoteEvidence {
+	if bytes.Compare(vote1.BlockID[:], vote2.BlockID[:]) > 0 {
+		vote1, vote2 = vote2, vote1
+	}
+	return &DuplicateVoteEvidence{VoteA: vote1, VoteB: vote2}
+}
+
+func (ev *DuplicateVoteEvidence) Height() uint64 {
+	return ev.VoteA.Height
+}
+
+func (ev *DuplicateVoteEvidence) Address() common.Address {
+	return ev.VoteA.ValidatorAddress
+}
+
+func (ev *DuplicateVoteEvidence) Hash() common.Hash {
+	b, err := rlp.EncodeToBytes(ev)
+	if err != nil {
+		panic(err)
+	}
+	return crypto.Keccak256Hash(b)
+}
+
+func (ev *DuplicateVoteEvidence) String() string {
+	return fmt.Sprintf("DuplicateVoteEvidence{%v %d/%d/%v %x %x}",
+		ev.Address(), ev.Height(), ev.VoteA.Round, ev.VoteA.Type, ev.VoteA.BlockID[:6], ev.VoteB.BlockID[:6])
+}
+
+func (ev *DuplicateVoteEvidence) ValidateBasic() error {
+	a, b := ev.VoteA, ev.VoteB
+	if a == nil || b == nil {
+		return fmt.Errorf("%w: missing vote", ErrInvalidEvidence)
+	}
+	if err := a.ValidateBasic(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidEvidence, err)
+	}
+	if err := b.ValidateBasic(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidEvidence, err)
+	}
+	if a.Height != b.Height || a.Round != b.Round || a.Type != b.Type {
+		return fmt.Errorf("%w: votes of %d/%d/%v and %d/%d/%v", ErrInvalidEvidence, a.Height, a.Round, a.Type, b.Height, b.Round, b.Type)
+	}
+	if a.ValidatorAddress != b.ValidatorAddress || a.ValidatorIndex != b.ValidatorIndex {
+		return fmt.Errorf("%w: votes of %v and %v", ErrInvalidEvidence, a.ValidatorAddress, b.ValidatorAddress)
+	}
+	if bytes.Compare(a.BlockID[:], b.BlockID[:]) >= 0 {
+		return fmt.Errorf("%w: votes not for different blocks in order", ErrInvalidEvidence)
+	}
+	return nil
+}
+
+// VerifyDuplicateVoteEvidence checks that ev is made of two votes signed
+// by a validator of vals.
+func VerifyDuplicateVoteEvidence(chainID string, vals *ValidatorIndex, ev *DuplicateVoteEvidence) error {
+	if err := ev.ValidateBasic(); err != nil {
+		return err
+	}
+	idx, val := vals.GetByAddress(ev.Address())
+	if val == nil {
+		return fmt.Errorf("%w: %v is not a validator", ErrInvalidEvidence, ev.Address())
+	}
+	if ev.VoteA.ValidatorIndex != idx {
+		return fmt.Errorf("%w: validator %v at index %d, not %d", ErrInvalidEvidence, ev.Address(), idx, ev.VoteA.ValidatorIndex)
+	}
+	for _, vote := range []*Vote{ev.VoteA, ev.VoteB} {
+		if !val.PubKey.VerifySignature(vote.VoteSignBytes(chainID), vote.Signature) {
+			return fmt.Errorf("%w: wrong signature from %v", ErrInvalidEvidence, ev.Address())
+		}
+	}
+	return nil
+}
+
+// SetEvidencePool keeps the evidence found by consensus, or received from
+// the peers, in pool. It must be called before the consensus state starts.
+func (cs *ConsensusState) SetEvidencePool(pool *EvidencePool) {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	cs.evpool = pool
+}
+
+// reportConflictingVotes adds the evidence of two conflicting votes of
+// another validator to the pool, and gossips it.
+func (cs *ConsensusState) reportConflictingVotes(ctx context.Context, vote1, vote2 *Vote) {
+	ev := NewDuplicateVoteEvidence(vote1, vote2)
+	added, err := cs.addEvidence(ev)
+	if err != nil {
+		log.Error("invalid evidence from conflicting votes", "evidence", ev, "err", err)
+		return
+	}
+	if added {
+		log.Warn("found conflicting votes", "evidence", ev)
+		cs.broadcastMessageToPeers(ctx, ev)
+	}
+}
+
+// addEvidence verifies and adds evidence that is not expired. Evidence of the
+// heights to come cannot be verified yet, and is ignored.
+func (cs *ConsensusState) addEvidence(ev *DuplicateVoteEvidence) (bool, error) {
+	if cs.evpool == nil || ev.Height() > cs.Height || ev.Height()+cs.chainState.ConsensusParams.EvidenceMaxAge() < cs.Height {
+		return false, nil
+	}
+	if err := VerifyDuplicateVoteEvidence(cs.chainState.ChainID, cs.validatorIndex, ev); err != nil {
+		return false, err
+	}
+	return cs.evpool.Add(ev)
+}
+
+// pendingEvidence is the evidence to propose.
+func (cs *ConsensusState) pendingEvidence() []*DuplicateVoteEvidence {
+	if cs.evpool == nil {
+		return nil
+	}
+	return cs.evpool.Pending(MaxBlockEvidence)
+}
+
+// verifyBlockEvidence checks the evidence in a proposed block: at most
+// MaxBlockEvidence pieces, each valid, not expired and not committed yet.
+func (cs *ConsensusState) verifyBlockEvidence(block *FullBlock) error {
+	handler, ok := cs.blockExec.(EvidenceHandler)
+	if !ok {
+		return nil
+	}
+	evs, err := handler.BlockEvidence(block)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidEvidence, err)
+	}
+	if len(evs) > MaxBlockEvidence {
+		return fmt.Errorf("%w: %d pieces in block, at most %d", ErrInvalidEvidence, len(evs), MaxBlockEvidence)
+	}
+
+	height := block.NumberU64()
+	seen := make(map[common.Hash]bool, len(evs))
+	for _, ev := range evs {
+		if err := VerifyDuplicateVoteEvidence(cs.chainState.ChainID, cs.validatorIndex, ev); err != nil {
+			return err
+		}
+		if ev.Height() > height || ev.Height()+cs.chainState.ConsensusParams.EvidenceMaxAge() < height {
+			return fmt.Errorf("%w: %v expired or from the future at height %d", ErrInvalidEvidence, ev, height)
+		}
+		hash := ev.Hash()
+		if seen[hash] || (cs.evpool != nil && cs.evpool.IsCommitted(ev)) {
+			return fmt.Errorf("%w: %v already in a block", ErrInvalidEvidence, ev)
+		}
+		seen[hash] = true
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package consensus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var (
+	evidencePendingPrefix   = []byte("evidence_pending")
+	evidenceCommittedPrefix = []byte("evidence_committed")
+
+	consensusEvidencePending = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "consensus_evidence_pending",
+			Help: "Number of pieces of evidence waiting to be put in a block",
+		})
+	consensusEvidenceCommitted = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "consensus_evidence_committed_total",
+			Help: "Total number of pieces of evidence committed in blocks",
+		})
+)
+
+// EvidencePool keeps the verified evidence not yet in a block, and the hashes
+// of the evidence committed, so it is not proposed twice. Both are persisted
+// in the database, and dropped after the evidence max age.
+type EvidencePool struct {
+	mu      sync.Mutex
+	db      *leveldb.DB
+	pending map[common.Hash]*DuplicateVoteEvidence
+	maxAge  uint64 // 0 for EvidenceMaxAgeHeights
+}
+
+// NewEvidencePool loads the pending evidence of the database.
+func NewEvidencePool(db *leveldb.DB) (*EvidencePool, error) {
+	pool := &EvidencePool{db: db, pending: make(map[common.Hash]*DuplicateVoteEvidence)}
+
+	it := db.NewIterator(util.BytesPrefix(evidencePendingPrefix), nil)
+	defer it.Release()
+	for it.Next() {
+		ev := &DuplicateVoteEvidence{}
+		if err := rlp.DecodeBytes(it.Value(), ev); err != nil {
+			log.Error("cannot decode pending evidence", "key", it.Key(), "err", err)
+			continue
+		}
+		pool.pending[ev.Hash()] = ev
+	}
+	consensusEvidencePending.Set(float64(len(pool.pending)))
+	return pool, it.Error()
+}
+
+// keys sort by evidence height, so the expired evidence comes first
+func evidenceKey(prefix []byte, height uint64, hash common.Hash) []byte {
+	var h [8]byte
+	binary.BigEndian.PutUint64(h[:], height)
+	return append(append(append([]byte{}, prefix...), h[:]...), hash[:]...)
+}
+
+// Add adds verified evidence, returning whether it is new.
+func (pool *EvidencePool) Add(ev *DuplicateVoteEvidence) (bool, error) {
+	hash := ev.Hash()
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if _, ok := pool.pending[hash]; ok || pool.isCommitted(ev.Height(), hash) {
+		return false, nil
+	}
+	data, err := rlp.EncodeToBytes(ev)
+	if err != nil {
+		return false, err
+	}
+	if err := pool.db.Put(evidenceKey(evidencePendingPrefix, ev.Height(), hash), data, nil); err != nil {
+		return false, err
+	}
+	pool.pending[hash] = ev
+	consensusEvidencePending.Set(float64(len(pool.pending)))
+	return true, nil
+}
+
+func (pool *EvidencePool) isCommitted(height uint64, hash common.Hash) bool {
+	ok, err := pool.db.Has(evidenceKey(evidenceCommittedPrefix, height, hash), nil)
+	return err == nil && ok
+}
+
+// IsCommitted tells whether the evidence is in a committed block.
+func (pool *EvidencePool) IsCommitted(ev *DuplicateVoteEvidence) bool {
+	return pool.isCommitted(ev.Height(), ev.Hash())
+}
+
+// Pending returns at most max pieces of pending evidence, the oldest first.
+func (pool *EvidencePool) Pending(max int) []*DuplicateVoteEvidence {
+	pool.mu.Lock()
+	evs := make([]*DuplicateVoteEvidence, 0, len(pool.pending))
+	for _, ev := range pool.pending {
+		evs = append(evs, ev)
+	}
+	pool.mu.Unlock()
+
+	sort.Slice(evs, func(i, j int) bool {
+		if evs[i].Height() != evs[j].Height() {
+			return evs[i].Height() < evs[j].Height()
+		}
+		hi, hj := evs[i].Hash(), evs[j].Hash()
+		return bytes.Compare(hi[:], hj[:]) < 0
+	})
+	if len(evs) > max {
+		evs = evs[:max]
+	}
+	return evs
+}
+
+// SetMaxAge sets how many heights evidence is kept, from the consensus
+// params.
+func (pool *EvidencePool) SetMaxAge(heights uint64) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	pool.maxAge = heights
+}
+
+// Update marks the evidence of the block at height as committed, and drops
+// the expired evidence.
+func (pool *EvidencePool) Update(height uint64, committed []*DuplicateVoteEvidence) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	batch := new(leveldb.Batch)
+	for _, ev := range committed {
+		hash := ev.Hash()
+		delete(pool.pending, hash)
+		batch.Delete(evidenceKey(evidencePendingPrefix, ev.Height(), hash))
+		batch.Put(evidenceKey(evidenceCommittedPrefix, ev.Height(), hash), nil)
+	}
+	consensusEvidenceCommitted.Add(float64(len(committed)))
+
+	maxAge := pool.maxAge
+	if maxAge == 0 {
+		maxAge = EvidenceMaxAgeHeights
+	}
+	if height > maxAge {
+		expiry := height - maxAge
+		for hash, ev := range pool.pending {
+			if ev.Height() < expiry {
+				delete(pool.pending, hash)
+				batch.Delete(evidenceKey(evidencePendingPrefix, ev.Height(), hash))
+			}
+		}
+		it := pool.db.NewIterator(&util.Range{
+			Start: evidenceCommittedPrefix,
+			Limit: evidenceKey(evidenceCommittedPrefix, expiry, common.Hash{}),
+		}, nil)
+		for it.Next() {
+			batch.Delete(append([]byte{}, it.Key()...))
+		}
+		it.Release()
+	}
+
+	if err := pool.db.Write(batch, nil); err != nil {
+		log.Error("cannot update evidence pool", "height", height, "err", err)
+	}
+	consensusEvidencePending.Set(float64(len(pool.pending)))
+}
+
+// Size is the number of pieces of pending evidence.
+func (pool *EvidencePool) Size() int {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	return len(pool.pending)
+}
+
+// MarkCommittedBlock updates the pool with the evidence of a block applied
+// by exec, e.g., when syncing blocks.
+func (pool *EvidencePool) MarkCommittedBlock(exec BlockExecutor, block *FullBlock) {
+	var evs []*DuplicateVoteEvidence
+	if handler, ok := exec.(EvidenceHandler); ok {
+		var err error
+		if evs, err = handler.BlockEvidence(block); err != nil {
+			log.Error("cannot get the evidence of a committed block", "height", block.NumberU64(), "err", err)
+		}
+	}
+	pool.Update(block.NumberU64(), evs)
+}
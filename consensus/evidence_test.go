@@ -0,0 +1,90 @@
+package consensus
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func makeDuplicateVoteEvidence(t *testing.T, pv PrivValidator, addr common.Address, height uint64) *DuplicateVoteEvidence {
+	votes := make([]*Vote, 2)
+	for i := range votes {
+		votes[i] = &Vote{
+			Type:             PrecommitType,
+			Height:           height,
+			BlockID:          common.BytesToHash([]byte{byte(i + 1)}),
+			ValidatorAddress: addr,
+		}
+		assert.NoError(t, pv.SignVote(context.Background(), "test", votes[i]))
+	}
+	return NewDuplicateVoteEvidence(votes[1], votes[0])
+}
+
+func TestVerifyDuplicateVoteEvidence(t *testing.T) {
+	pv := GeneratePrivValidatorLocal()
+	pubKey, err := pv.GetPubKey(context.Background())
+	assert.NoError(t, err)
+	vals := NewValidatorIndex(NewValidatorSet([]common.Address{pubKey.Address()}, []int64{1}, 4))
+
+	ev := makeDuplicateVoteEvidence(t, pv, pubKey.Address(), 3)
+	assert.Equal(t, common.BytesToHash([]byte{1}), ev.VoteA.BlockID)
+	assert.NoError(t, VerifyDuplicateVoteEvidence("test", vals, ev))
+	assert.Equal(t, ev.Hash(), NewDuplicateVoteEvidence(ev.VoteB, ev.VoteA).Hash())
+
+	assert.True(t, errors.Is(VerifyDuplicateVoteEvidence("other", vals, ev), ErrInvalidEvidence))
+
+	same := &DuplicateVoteEvidence{VoteA: ev.VoteA, VoteB: ev.VoteA}
+	assert.True(t, errors.Is(same.ValidateBasic(), ErrInvalidEvidence))
+
+	otherRound := *ev.VoteB
+	otherRound.Round = 1
+	assert.True(t, errors.Is((&DuplicateVoteEvidence{VoteA: ev.VoteA, VoteB: &otherRound}).ValidateBasic(), ErrInvalidEvidence))
+}
+
+func TestEvidencePool(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(t, err)
+	pool, err := NewEvidencePool(db)
+	assert.NoError(t, err)
+
+	pv := GeneratePrivValidatorLocal()
+	pubKey, err := pv.GetPubKey(context.Background())
+	assert.NoError(t, err)
+	ev1 := makeDuplicateVoteEvidence(t, pv, pubKey.Address(), 5)
+	ev2 := makeDuplicateVoteEvidence(t, pv, pubKey.Address(), 3)
+
+	for _, ev := range []*DuplicateVoteEvidence{ev1, ev2} {
+		added, err := pool.Add(ev)
+		assert.NoError(t, err)
+		assert.True(t, added)
+	}
+	added, err := pool.Add(ev1)
+	assert.NoError(t, err)
+	assert.False(t, added)
+
+	pending := pool.Pending(10)
+	assert.Equal(t, 2, len(pending))
+	assert.Equal(t, ev2.Hash(), pending[0].Hash())
+
+	// pending evidence survives a restart
+	pool, err = NewEvidencePool(db)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, pool.Size())
+
+	pool.Update(6, []*DuplicateVoteEvidence{ev2})
+	assert.Equal(t, 1, pool.Size())
+	assert.True(t, pool.IsCommitted(ev2))
+	added, err = pool.Add(ev2)
+	assert.NoError(t, err)
+	assert.False(t, added)
+
+	// expired
+	pool.Update(5+EvidenceMaxAgeHeights+1, nil)
+	assert.Equal(t, 0, pool.Size())
+	assert.False(t, pool.IsCommitted(ev2))
+}
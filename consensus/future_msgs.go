@@ -0,0 +1,164 @@
+package consensus
+
+import (
+	"context"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A peer a little ahead sends the proposal of a round we have not entered
+// yet, or the proposal and votes of the next height while we are still
+// committing, which the state machine would drop: they are buffered instead,
+// and handled once we get there.
+//
+// The buffer is bounded: at most futureRounds rounds or futureHeights
+// heights ahead, futureMsgsPerPeer messages by peer, and futureMsgsSize in
+// total, the messages the farthest ahead evicted first when it is full.
+// Votes of the current height are not buffered, the vote set keeps the ones
+// of the next rounds.
+
+var consensusFutureMessages = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "consensus_future_messages_total",
+		Help: "Total number of proposals and votes received ahead of the state machine, by what became of them",
+	}, []string{"result"})
+
+var (
+	futureRounds      = int32(3)
+	futureHeights     = uint64(1)
+	futureMsgsPerPeer = 64
+	futureMsgsSize    = 1024
+)
+
+type futureMsg struct {
+	height uint64
+	round  int32
+	mi     MsgInfo
+}
+
+// after tells whether the message is farther ahead than o.
+func (m futureMsg) after(o futureMsg) bool {
+	return m.height > o.height || (m.height == o.height && m.round > o.round)
+}
+
+type futureMsgs struct {
+	msgs   []futureMsg // in arrival order
+	byPeer map[string]int
+}
+
+func newFutureMsgs() *futureMsgs {
+	return &futureMsgs{byPeer: make(map[string]int)}
+}
+
+// futureMsgOf returns the message to buffer from mi, false if mi is not ahead
+// of height and round or too far ahead.
+func futureMsgOf(mi MsgInfo, height uint64, round int32) (futureMsg, bool) {
+	m := futureMsg{mi: mi}
+	switch msg := mi.Msg.(type) {
+	case *ProposalMessage:
+		if msg.Proposal == nil {
+			return m, false
+		}
+		m.height, m.round = msg.Proposal.Height, msg.Proposal.Round
+		if m.height == height && m.round > round && m.round <= round+futureRounds {
+			return m, true
+		}
+	case *VoteMessage:
+		if msg.Vote == nil {
+			return m, false
+		}
+		m.height, m.round = msg.Vote.Height, msg.Vote.Round
+	default:
+		return m, false
+	}
+	return m, m.height > height && m.height <= height+futureHeights && m.round < futureRounds
+}
+
+// add buffers mi if it is ahead of height and round, and tells whether it
+// did.
+func (fm *futureMsgs) add(mi MsgInfo, height uint64, round int32) bool {
+	// our own messages are never ahead
+	if mi.PeerID == "" {
+		return false
+	}
+	m, ok := futureMsgOf(mi, height, round)
+	if !ok {
+		return false
+	}
+
+	if fm.byPeer[string(mi.PeerID)] >= futureMsgsPerPeer {
+		consensusFutureMessages.WithLabelValues("dropped").Inc()
+		return true
+	}
+	if len(fm.msgs) >= futureMsgsSize {
+		farthest := 0
+		for i, o := range fm.msgs {
+			if o.after(fm.msgs[farthest]) {
+				farthest = i
+			}
+		}
+		if !fm.msgs[farthest].after(m) {
+			consensusFutureMessages.WithLabelValues("dropped").Inc()
+			return true
+		}
+		fm.remove(farthest)
+		consensusFutureMessages.WithLabelValues("evicted").Inc()
+	}
+
+	fm.msgs = append(fm.msgs, m)
+	fm.byPeer[string(mi.PeerID)]++
+	consensusFutureMessages.WithLabelValues("buffered").Inc()
+	return true
+}
+
+func (fm *futureMsgs) remove(i int) {
+	peer := string(fm.msgs[i].mi.PeerID)
+	if fm.byPeer[peer]--; fm.byPeer[peer] == 0 {
+		delete(fm.byPeer, peer)
+	}
+	fm.msgs = append(fm.msgs[:i], fm.msgs[i+1:]...)
+}
+
+// take removes the messages no longer ahead of height and round, and
+// returns the ones of them to handle now: the votes of height and the
+// proposals of the round. The others are behind, and dropped.
+func (fm *futureMsgs) take(height uint64, round int32) []MsgInfo {
+	var due []MsgInfo
+	for i := 0; i < len(fm.msgs); {
+		m := fm.msgs[i]
+		_, ahead := futureMsgOf(m.mi, height, round)
+		if ahead {
+			i++
+			continue
+		}
+		fm.remove(i)
+
+		_, isProposal := m.mi.Msg.(*ProposalMessage)
+		if m.height == height && (!isProposal || m.round == round) {
+			due = append(due, m.mi)
+			consensusFutureMessages.WithLabelValues("replayed").Inc()
+		} else {
+			consensusFutureMessages.WithLabelValues("expired").Inc()
+		}
+	}
+	return due
+}
+
+// replayFutureMsgs handles the buffered messages we got to, until handling
+// them does not move the state machine any further.
+func (cs *ConsensusState) replayFutureMsgs(ctx context.Context) {
+	for {
+		if len(cs.futureMsgs.msgs) == 0 {
+			return
+		}
+		due := cs.futureMsgs.take(cs.Height, cs.Round)
+		if len(due) == 0 {
+			return
+		}
+		log.Debug("handling buffered messages", "height", cs.Height, "round", cs.Round, "msgs", len(due))
+		for _, mi := range due {
+			cs.handleMsg(ctx, mi)
+		}
+	}
+}
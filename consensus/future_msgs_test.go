@@ -0,0 +1,65 @@
+package consensus
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func futureProposal(height uint64, round int32, peer string) MsgInfo {
+	return MsgInfo{Msg: &ProposalMessage{Proposal: &Proposal{Height: height, Round: round}}, PeerID: peer}
+}
+
+func futureVote(height uint64, round int32, peer string) MsgInfo {
+	return MsgInfo{Msg: &VoteMessage{Vote: &Vote{Height: height, Round: round, Type: PrevoteType}}, PeerID: peer}
+}
+
+func TestFutureMsgs(t *testing.T) {
+	fm := newFutureMsgs()
+
+	// current, own, or too far ahead
+	assert.False(t, fm.add(futureProposal(5, 1, "a"), 5, 1))
+	assert.False(t, fm.add(futureVote(5, 3, "a"), 5, 1))
+	assert.False(t, fm.add(futureProposal(6, 0, ""), 5, 1))
+	assert.False(t, fm.add(futureProposal(7, 0, "a"), 5, 1))
+	assert.False(t, fm.add(futureProposal(5, 1+futureRounds+1, "a"), 5, 1))
+
+	assert.True(t, fm.add(futureProposal(5, 2, "a"), 5, 1))
+	assert.True(t, fm.add(futureProposal(6, 0, "a"), 5, 1))
+	assert.True(t, fm.add(futureVote(6, 0, "b"), 5, 1))
+	assert.True(t, fm.add(futureProposal(6, 1, "b"), 5, 1))
+
+	assert.Len(t, fm.take(5, 2), 1)
+	// the proposal of round 1 waits for it
+	assert.Len(t, fm.take(6, 0), 2)
+	assert.Len(t, fm.take(6, 0), 0)
+	assert.Len(t, fm.msgs, 1)
+
+	// behind
+	assert.Len(t, fm.take(6, 2), 0)
+	assert.Empty(t, fm.msgs)
+	assert.Empty(t, fm.byPeer)
+}
+
+func TestFutureMsgsLimits(t *testing.T) {
+	defer func(perPeer, size int) { futureMsgsPerPeer, futureMsgsSize = perPeer, size }(futureMsgsPerPeer, futureMsgsSize)
+	futureMsgsPerPeer, futureMsgsSize = 2, 3
+
+	fm := newFutureMsgs()
+	fm.add(futureVote(6, 2, "a"), 5, 0)
+	fm.add(futureVote(6, 1, "a"), 5, 0)
+	// over the quota of a
+	fm.add(futureVote(6, 0, "a"), 5, 0)
+	assert.Len(t, fm.msgs, 2)
+
+	fm.add(futureVote(6, 1, "b"), 5, 0)
+	// full: evicts the farthest ahead
+	fm.add(futureVote(6, 0, "c"), 5, 0)
+	assert.Len(t, fm.msgs, 3)
+	for _, m := range fm.msgs {
+		assert.NotEqual(t, int32(2), m.round)
+	}
+	// nothing farther ahead to evict
+	fm.add(futureVote(6, 1, "d"), 5, 0)
+	assert.Zero(t, fm.byPeer["d"])
+}
@@ -0,0 +1,233 @@
+package consensus
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/QuarkChain/go-minimal-pbft/canonjson"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// prefix of the gentx sign bytes, so a gentx signature can never be valid for
+// a vote or a proposal
+var genTxSignPrefix = []byte("mpbft/gentx")
+
+// BytesSigner is implemented by priv validators holding their key locally,
+// which can sign arbitrary (domain separated) messages such as gentxs.
+type BytesSigner interface {
+	SignBytes(msg []byte) ([]byte, error)
+}
+
+// GenesisValidator is a validator of the genesis validator set. PubKey is in
+// the ParsePubKey format.
+type GenesisValidator struct {
+	PubKey string `json:"pub_key"`
+	Power  int64  `json:"power"`
+	Name   string `json:"name,omitempty"`
+}
+
+// GenTx is the genesis entry of a prospective validator, signed with its
+// validator key to prove that the key is controlled by the validator.
+type GenTx struct {
+	ChainID       string           `json:"chain_id"`
+	GenesisTimeMs uint64           `json:"genesis_time_ms"`
+	Validator     GenesisValidator `json:"validator"`
+	Signature     hexutil.Bytes    `json:"signature"`
+}
+
+func (gt *GenTx) SignBytes() []byte {
+	b, err := rlp.EncodeToBytes([]interface{}{
+		gt.ChainID, gt.GenesisTimeMs, gt.Validator.PubKey, uint64(gt.Validator.Power), gt.Validator.Name,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return append(append([]byte{}, genTxSignPrefix...), b...)
+}
+
+func (gt *GenTx) Sign(signer BytesSigner) error {
+	sig, err := signer.SignBytes(gt.SignBytes())
+	if err != nil {
+		return err
+	}
+	gt.Signature = sig
+	return nil
+}
+
+// Verify checks the entry is well-formed and signed by its validator key.
+func (gt *GenTx) Verify() (PubKey, error) {
+	if gt.ChainID == "" {
+		return nil, errors.New("empty chain id")
+	}
+	if gt.Validator.Power <= 0 {
+		return nil, fmt.Errorf("invalid voting power %d", gt.Validator.Power)
+	}
+
+	pubKey, err := ParsePubKey(gt.Validator.PubKey)
+	if err != nil {
+		return nil, err
+	}
+	if !pubKey.VerifySignature(gt.SignBytes(), gt.Signature) {
+		return nil, fmt.Errorf("invalid gentx signature of %v", pubKey.Address())
+	}
+	return pubKey, nil
+}
+
+// Genesis is the genesis of a network, as assembled from the gentxs.
+type Genesis struct {
+	ChainID       string             `json:"chain_id"`
+	GenesisTimeMs uint64             `json:"genesis_time_ms"`
+	Validators    []GenesisValidator `json:"validators"`
+	// 0 for MaxVoteExtensionBytes
+	VoteExtensionMaxBytes uint64 `json:"vote_extension_max_bytes,omitempty"`
+	// the initial consensus params, none set if nil
+	ConsensusParams *ConsensusParams `json:"consensus_params,omitempty"`
+}
+
+// CollectGenTxs verifies the gentxs and assembles the genesis. All gentxs must
+// agree on the chain id and genesis time, and each validator may appear once.
+// Validators are sorted by address so that the result does not depend on
+// the order the gentxs were collected in.
+func CollectGenTxs(genTxs []*GenTx) (*Genesis, error) {
+	if len(genTxs) == 0 {
+		return nil, errors.New("no gentx")
+	}
+
+	g := &Genesis{ChainID: genTxs[0].ChainID, GenesisTimeMs: genTxs[0].GenesisTimeMs}
+	addrs := make(map[common.Address]GenesisValidator)
+	for _, gt := range genTxs {
+		if gt.ChainID != g.ChainID || gt.GenesisTimeMs != g.GenesisTimeMs {
+			return nil, fmt.Errorf("gentx of %s is for chain %s at %d, expected chain %s at %d",
+				gt.Validator.PubKey, gt.ChainID, gt.GenesisTimeMs, g.ChainID, g.GenesisTimeMs)
+		}
+
+		pubKey, err := gt.Verify()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := addrs[pubKey.Address()]; ok {
+			return nil, fmt.Errorf("duplicate gentx for %v", pubKey.Address())
+		}
+		addrs[pubKey.Address()] = gt.Validator
+	}
+
+	sorted := make([]common.Address, 0, len(addrs))
+	for addr := range addrs {
+		sorted = append(sorted, addr)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i][:], sorted[j][:]) < 0
+	})
+	for _, addr := range sorted {
+		g.Validators = append(g.Validators, addrs[addr])
+	}
+	return g, nil
+}
+
+// Hash is the sha256 of the canonical JSON of the genesis, see canonjson, so
+// any tool gets the same hash for the same genesis however its file is
+// formatted. It identifies the file; the network is identified by
+// GenesisHash.
+func (g *Genesis) Hash() (common.Hash, error) {
+	data, err := canonjson.Marshal(g)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return sha256.Sum256(data), nil
+}
+
+// LoadGenesis reads a genesis written by collect-gentxs.
+func LoadGenesis(filename string) (*Genesis, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &Genesis{}
+	if err := json.Unmarshal(data, g); err != nil {
+		return nil, fmt.Errorf("invalid genesis: %w", err)
+	}
+	return g, nil
+}
+
+// ChainState returns the genesis chain state, with the validator keys set.
+func (g *Genesis) ChainState(epoch uint64, proposerReptition int64) (*ChainState, error) {
+	vals := make([]common.Address, len(g.Validators))
+	powers := make([]int64, len(g.Validators))
+	pubKeys := make([]PubKey, len(g.Validators))
+	for i, val := range g.Validators {
+		pubKey, err := ParsePubKey(val.PubKey)
+		if err != nil {
+			return nil, err
+		}
+		vals[i] = pubKey.Address()
+		powers[i] = val.Power
+		pubKeys[i] = pubKey
+	}
+	if err := ValidateValidatorUpdate(vals, powers); err != nil {
+		return nil, err
+	}
+
+	gcs := MakeGenesisChainState(g.ChainID, g.GenesisTimeMs, vals, powers, epoch, proposerReptition)
+	gcs.VoteExtensionMaxBytes = g.VoteExtensionMaxBytes
+	if g.ConsensusParams != nil {
+		if err := ValidateConsensusParams(*g.ConsensusParams); err != nil {
+			return nil, err
+		}
+		gcs.ConsensusParams = *g.ConsensusParams
+	}
+	SetValidatorPubKeys(gcs.Validators, pubKeys)
+	SetValidatorPubKeys(gcs.NextValidators, pubKeys)
+	return gcs, ValidateChainState(gcs)
+}
+
+// GenesisHash identifies the network of a genesis state: its chain ID,
+// initial height, genesis time, epoch and validators. Networks forked from
+// the same genesis file with another chain ID, or reusing a chain ID with
+// other validators or genesis time, have different hashes; see the node info
+// handshake of p2p.
+func GenesisHash(state *ChainState) common.Hash {
+	h := sha256.New()
+	writeUint := func(n uint64) {
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], n)
+		h.Write(b[:])
+	}
+
+	writeUint(uint64(len(state.ChainID)))
+	h.Write([]byte(state.ChainID))
+	writeUint(state.InitialHeight)
+	writeUint(state.LastBlockTime)
+	writeUint(state.Epoch)
+	writeUint(uint64(state.Validators.ProposerReptition))
+	writeUint(uint64(len(state.Validators.Validators)))
+	for _, val := range state.Validators.Validators {
+		h.Write(val.Address[:])
+		writeUint(uint64(val.VotingPower))
+	}
+	// only hashed when set, so the hash of the existing networks is kept
+	if state.VoteExtensionMaxBytes != 0 {
+		writeUint(state.VoteExtensionMaxBytes)
+	}
+	if p := state.ConsensusParams; p != (ConsensusParams{}) {
+		h.Write([]byte("consensus_params"))
+		writeUint(p.MaxBlockBytes)
+		writeUint(p.MaxGas)
+		writeUint(p.EvidenceMaxAgeHeights)
+		writeUint(p.VoteExtensionsEnableHeight)
+		if p.PBTSEnableHeight != 0 || p.SynchronyPrecisionMs != 0 || p.SynchronyMessageDelayMs != 0 {
+			writeUint(p.PBTSEnableHeight)
+			writeUint(p.SynchronyPrecisionMs)
+			writeUint(p.SynchronyMessageDelayMs)
+		}
+	}
+	return common.BytesToHash(h.Sum(nil))
+}
@@ -0,0 +1,74 @@
+package consensus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeGenTx(t *testing.T, pv *PrivValidatorEd25519, power int64) *GenTx {
+	pk, err := pv.GetPubKey(context.Background())
+	assert.NoError(t, err)
+
+	gt := &GenTx{
+		ChainID:       "test",
+		GenesisTimeMs: 1000,
+		Validator:     GenesisValidator{PubKey: fmt.Sprint(pk), Power: power},
+	}
+	assert.NoError(t, gt.Sign(pv))
+	return gt
+}
+
+func TestCollectGenTxs(t *testing.T) {
+	pv0 := GeneratePrivValidatorEd25519().(*PrivValidatorEd25519)
+	pv1 := GeneratePrivValidatorEd25519().(*PrivValidatorEd25519)
+
+	g0, err := CollectGenTxs([]*GenTx{makeGenTx(t, pv0, 1), makeGenTx(t, pv1, 2)})
+	assert.NoError(t, err)
+	g1, err := CollectGenTxs([]*GenTx{makeGenTx(t, pv1, 2), makeGenTx(t, pv0, 1)})
+	assert.NoError(t, err)
+	assert.Equal(t, g0, g1)
+	assert.Len(t, g0.Validators, 2)
+
+	// duplicate
+	_, err = CollectGenTxs([]*GenTx{makeGenTx(t, pv0, 1), makeGenTx(t, pv0, 1)})
+	assert.Error(t, err)
+
+	// tampered power
+	gt := makeGenTx(t, pv0, 1)
+	gt.Validator.Power = 100
+	_, err = CollectGenTxs([]*GenTx{gt})
+	assert.Error(t, err)
+
+	// other chain
+	gt = makeGenTx(t, pv1, 1)
+	gt.ChainID = "other"
+	assert.NoError(t, gt.Sign(pv1))
+	_, err = CollectGenTxs([]*GenTx{makeGenTx(t, pv0, 1), gt})
+	assert.Error(t, err)
+}
+
+func TestGenesisHash(t *testing.T) {
+	g := &Genesis{ChainID: "test", GenesisTimeMs: 1000, Validators: []GenesisValidator{{PubKey: "0x01", Power: 1}}}
+	h0, err := g.Hash()
+	assert.NoError(t, err)
+
+	// the same genesis formatted otherwise
+	var g1 Genesis
+	assert.NoError(t, json.Unmarshal([]byte(`{
+		"validators": [{"power": 1, "pub_key": "0x01"}],
+		"genesis_time_ms": 1000,
+		"chain_id": "test"
+	}`), &g1))
+	h1, err := g1.Hash()
+	assert.NoError(t, err)
+	assert.Equal(t, h0, h1)
+
+	g.Validators[0].Power = 2
+	h2, err := g.Hash()
+	assert.NoError(t, err)
+	assert.NotEqual(t, h0, h2)
+}
@@ -0,0 +1,251 @@
+package consensus
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/stretchr/testify/assert"
+)
+
+// Golden files pin the canonical encodings, sign bytes and hashes of the
+// consensus types. Any change of them is consensus-breaking: if it is
+// intended, regenerate the files with
+//
+//	go generate ./consensus
+//
+// and review the diff.
+//
+//go:generate go test -run TestGoldenEncodings -update
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files")
+
+const goldenChainID = "golden"
+
+// goldenPrivValidators returns validators with fixed keys, so that the
+// (deterministic) signatures are the same on every run.
+func goldenPrivValidators(t *testing.T, n int) []*PrivValidatorLocal {
+	pvs := make([]*PrivValidatorLocal, n)
+	for i := range pvs {
+		pk, err := crypto.ToECDSA(common.LeftPadBytes([]byte{byte(i + 1)}, 32))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pvs[i] = NewPrivValidatorLocal(pk)
+	}
+	return pvs
+}
+
+type goldenFixture struct {
+	name    string
+	encode  func() ([]byte, error)
+	hash    func() common.Hash
+	signFor func() []byte
+}
+
+func goldenFixtures(t *testing.T) []goldenFixture {
+	pvs := goldenPrivValidators(t, 4)
+	addrs := make([]common.Address, len(pvs))
+	powers := make([]int64, len(pvs))
+	for i, pv := range pvs {
+		addrs[i] = pv.Address()
+		powers[i] = int64(i + 1)
+	}
+
+	blockHash := common.BytesToHash([]byte{1, 2, 3})
+	vote := &Vote{
+		Type:             PrecommitType,
+		Height:           7,
+		Round:            1,
+		BlockID:          blockHash,
+		TimestampMs:      1650000000000,
+		ValidatorAddress: addrs[0],
+		ValidatorIndex:   0,
+	}
+	if err := pvs[0].SignVote(context.Background(), goldenChainID, vote); err != nil {
+		t.Fatal(err)
+	}
+
+	nilVote := &Vote{
+		Type:             PrevoteType,
+		Height:           7,
+		Round:            0,
+		TimestampMs:      1650000000000,
+		ValidatorAddress: addrs[1],
+		ValidatorIndex:   1,
+	}
+	if err := pvs[1].SignVote(context.Background(), goldenChainID, nilVote); err != nil {
+		t.Fatal(err)
+	}
+
+	vals := NewValidatorSet(addrs, powers, 2)
+	vs := NewVoteSet(goldenChainID, 6, 0, PrecommitType, vals)
+	for i, pv := range pvs {
+		var blockID common.Hash
+		if i != len(pvs)-1 {
+			blockID = blockHash
+		}
+		v := &Vote{
+			Type:             PrecommitType,
+			Height:           6,
+			Round:            0,
+			BlockID:          blockID,
+			TimestampMs:      1650000000000 + uint64(i),
+			ValidatorAddress: addrs[i],
+			ValidatorIndex:   int32(i),
+		}
+		if err := pv.SignVote(context.Background(), goldenChainID, v); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := vs.AddVote(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit := vs.MakeCommit()
+
+	block := &FullBlock{Block: types.NewBlock(
+		&Header{
+			ParentHash:     blockHash,
+			Number:         big.NewInt(7),
+			TimeMs:         1650000001000,
+			Coinbase:       addrs[2],
+			LastCommitHash: commit.Hash(),
+			Difficulty:     big.NewInt(1),
+			Extra:          []byte{},
+			BaseFee:        big.NewInt(0),
+			NextValidators: addrs,
+		},
+		[]*types.Transaction{},
+		[]*types.Header{},
+		[]*types.Receipt{},
+		trie.NewStackTrie(nil)),
+		LastCommit: commit,
+	}
+
+	proposal := &Proposal{
+		Height:      7,
+		Round:       1,
+		POLRound:    -1,
+		TimestampMs: 1650000001000,
+		Block:       block,
+	}
+	if err := pvs[2].SignProposal(context.Background(), goldenChainID, proposal); err != nil {
+		t.Fatal(err)
+	}
+
+	return []goldenFixture{
+		{
+			name:    "vote",
+			encode:  func() ([]byte, error) { return rlp.EncodeToBytes(vote) },
+			signFor: func() []byte { return vote.VoteSignBytes(goldenChainID) },
+		},
+		{
+			name:    "vote_nil",
+			encode:  func() ([]byte, error) { return rlp.EncodeToBytes(nilVote) },
+			signFor: func() []byte { return nilVote.VoteSignBytes(goldenChainID) },
+		},
+		{
+			name:   "commit",
+			encode: func() ([]byte, error) { return rlp.EncodeToBytes(commit) },
+			hash:   commit.Hash,
+		},
+		{
+			name:   "block",
+			encode: func() ([]byte, error) { return rlp.EncodeToBytes(block) },
+			hash:   block.Hash,
+		},
+		{
+			name:    "proposal",
+			encode:  func() ([]byte, error) { return rlp.EncodeToBytes(proposal) },
+			signFor: func() []byte { return proposal.ProposalSignBytes(goldenChainID) },
+		},
+		{
+			name:   "validator_set",
+			encode: func() ([]byte, error) { return encodeValidatorSet(vals, addrs) },
+		},
+	}
+}
+
+// encodeValidatorSet encodes what of a validator set must be agreed on: the
+// order, the voting powers and the proposer.
+func encodeValidatorSet(vals *ValidatorSet, addrs []common.Address) ([]byte, error) {
+	type entry struct {
+		Index       uint64
+		Address     common.Address
+		VotingPower uint64
+	}
+
+	entries := make([]entry, len(addrs))
+	for i, addr := range addrs {
+		idx, val := vals.GetByAddress(addr)
+		if val == nil {
+			return nil, fmt.Errorf("missing validator %v", addr)
+		}
+		entries[i] = entry{uint64(idx), val.Address, uint64(val.VotingPower)}
+	}
+	return rlp.EncodeToBytes([]interface{}{entries, vals.GetProposer().Address})
+}
+
+func (f *goldenFixture) render() ([]byte, error) {
+	data, err := f.encode()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "rlp: %s\n", hex.EncodeToString(data))
+	if f.hash != nil {
+		fmt.Fprintf(&buf, "hash: %s\n", f.hash().Hex())
+	}
+	if f.signFor != nil {
+		fmt.Fprintf(&buf, "sign_bytes: %s\n", hex.EncodeToString(f.signFor()))
+	}
+	return buf.Bytes(), nil
+}
+
+func TestGoldenEncodings(t *testing.T) {
+	for _, f := range goldenFixtures(t) {
+		f := f
+		t.Run(f.name, func(t *testing.T) {
+			got, err := f.render()
+			assert.NoError(t, err)
+
+			filename := filepath.Join("testdata", "golden", f.name+".golden")
+			if *updateGolden {
+				assert.NoError(t, os.MkdirAll(filepath.Dir(filename), 0755))
+				assert.NoError(t, ioutil.WriteFile(filename, got, 0644))
+				return
+			}
+
+			want, err := ioutil.ReadFile(filename)
+			if os.IsNotExist(err) {
+				t.Skipf("%s not generated yet, run go generate ./consensus", filename)
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, string(want), string(got), "encoding of %s changed, this breaks consensus", f.name)
+		})
+	}
+}
+
+func TestGoldenEncodingsDeterministic(t *testing.T) {
+	first, second := goldenFixtures(t), goldenFixtures(t)
+	for i := range first {
+		a, err := first[i].render()
+		assert.NoError(t, err)
+		b, err := second[i].render()
+		assert.NoError(t, err)
+		assert.Equal(t, a, b, first[i].name)
+	}
+}
@@ -0,0 +1,146 @@
+package consensus
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A halted node no longer proposes and precommits nil, so once +1/3 of the
+// voting power is halted no block can be committed. It still prevotes as
+// usual: precommitting nil is enough to stop the chain, and is safe whatever
+// the node is locked on.
+//
+// The chain halts when the application says so for a block, and a node when
+// its operator calls Halt. Both take effect from the next height, so the
+// current height still commits.
+//
+// For a coordinated upgrade, the operators of the network all set the same
+// HaltHeight or HaltTime: their nodes commit up to it, then neither sign nor
+// propose anything above, and UpgradeHalt tells the node to shut down, so the
+// new binary starts from the same height everywhere.
+
+var consensusHalted = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Name: "consensus_halted",
+		Help: "Whether consensus is halted by the application or the operator",
+	})
+
+const (
+	HaltSourceApp      = "app"
+	HaltSourceOperator = "operator"
+	HaltSourceUpgrade  = "upgrade"
+)
+
+type HaltStatus struct {
+	Halted bool   `json:"halted"`
+	Source string `json:"source,omitempty"`
+	Reason string `json:"reason,omitempty"`
+	// the first height not committed
+	Height uint64 `json:"height,omitempty"`
+}
+
+// Halt halts the node after the current height, until Resume.
+func (cs *ConsensusState) Halt(reason string) {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+
+	if reason == "" {
+		reason = "halted by the operator"
+	}
+	cs.operatorHalt = &HaltStatus{Halted: true, Source: HaltSourceOperator, Reason: reason, Height: cs.Height + 1}
+	log.Warn("Consensus halt requested", "from_height", cs.Height+1, "reason", reason)
+	cs.updateHaltMetric()
+}
+
+// Resume cancels Halt. A halt of the application cannot be canceled.
+func (cs *ConsensusState) Resume() {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+
+	if cs.operatorHalt != nil {
+		log.Warn("Consensus resumed", "height", cs.Height)
+	}
+	cs.operatorHalt = nil
+	cs.updateHaltMetric()
+}
+
+type upgradeHalt struct {
+	height uint64
+	// in ms, like the block times
+	timeMs uint64
+	once   sync.Once
+	ch     chan struct{}
+}
+
+// HaltHeight makes the node stop after committing the block at height.
+func HaltHeight(height uint64) StateOption {
+	return func(cs *ConsensusState) {
+		cs.upgradeHalt.height = height
+	}
+}
+
+// HaltTime makes the node stop after committing the first block whose time
+// is t or later.
+func HaltTime(t time.Time) StateOption {
+	return func(cs *ConsensusState) {
+		cs.upgradeHalt.timeMs = uint64(t.UnixMilli())
+	}
+}
+
+// reached tells whether the last block of state is the halt one, or above.
+func (uh *upgradeHalt) reached(state ChainState) bool {
+	if uh.height > 0 && state.LastBlockHeight >= uh.height {
+		return true
+	}
+	return uh.timeMs > 0 && state.LastBlockHeight > 0 && state.LastBlockTime >= uh.timeMs
+}
+
+// UpgradeHalt is closed once the block of HaltHeight or HaltTime is
+// committed, when the node should shut down.
+func (cs *ConsensusState) UpgradeHalt() <-chan struct{} {
+	return cs.upgradeHalt.ch
+}
+
+func (cs *ConsensusState) checkUpgradeHalt() {
+	if !cs.upgradeHalt.reached(cs.chainState) {
+		return
+	}
+	cs.upgradeHalt.once.Do(func() {
+		log.Warn("Halt for upgrade reached", "height", cs.chainState.LastBlockHeight, "halt_height", cs.upgradeHalt.height, "halt_time_ms", cs.upgradeHalt.timeMs)
+		close(cs.upgradeHalt.ch)
+	})
+}
+
+func (cs *ConsensusState) HaltStatus() HaltStatus {
+	cs.mtx.RLock()
+	defer cs.mtx.RUnlock()
+	return cs.haltStatus()
+}
+
+func (cs *ConsensusState) haltStatus() HaltStatus {
+	if cs.chainState.HaltReason != "" {
+		return HaltStatus{Halted: true, Source: HaltSourceApp, Reason: cs.chainState.HaltReason, Height: cs.chainState.LastBlockHeight + 1}
+	}
+	if cs.upgradeHalt.reached(cs.chainState) {
+		return HaltStatus{Halted: true, Source: HaltSourceUpgrade, Reason: "halt height or time reached", Height: cs.chainState.LastBlockHeight + 1}
+	}
+	if cs.operatorHalt != nil && cs.Height >= cs.operatorHalt.Height {
+		return *cs.operatorHalt
+	}
+	return HaltStatus{}
+}
+
+func (cs *ConsensusState) isHalted() bool {
+	return cs.haltStatus().Halted
+}
+
+func (cs *ConsensusState) updateHaltMetric() {
+	if cs.isHalted() {
+		consensusHalted.Set(1)
+	} else {
+		consensusHalted.Set(0)
+	}
+}
@@ -0,0 +1,33 @@
+package consensus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpgradeHaltReached(t *testing.T) {
+	cs := &ConsensusState{upgradeHalt: upgradeHalt{ch: make(chan struct{})}}
+	HaltHeight(10)(cs)
+	assert.False(t, cs.upgradeHalt.reached(ChainState{LastBlockHeight: 9}))
+	assert.True(t, cs.upgradeHalt.reached(ChainState{LastBlockHeight: 10}))
+
+	start := time.UnixMilli(1000000)
+	cs = &ConsensusState{upgradeHalt: upgradeHalt{ch: make(chan struct{})}}
+	HaltTime(start)(cs)
+	assert.False(t, cs.upgradeHalt.reached(ChainState{LastBlockHeight: 3, LastBlockTime: 999999}))
+	assert.True(t, cs.upgradeHalt.reached(ChainState{LastBlockHeight: 4, LastBlockTime: 1000000}))
+	// the genesis time is not the time of a committed block
+	assert.False(t, cs.upgradeHalt.reached(ChainState{LastBlockTime: 2000000}))
+
+	cs.chainState = ChainState{LastBlockHeight: 4, LastBlockTime: 1000000}
+	cs.checkUpgradeHalt()
+	cs.checkUpgradeHalt()
+	select {
+	case <-cs.UpgradeHalt():
+	default:
+		t.Fatal("upgrade halt not signaled")
+	}
+	assert.Equal(t, HaltSourceUpgrade, cs.haltStatus().Source)
+}
@@ -0,0 +1,64 @@
+package consensus
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// The headers of the chain types have no field committing to the validators
+// of their height or to the app hash, their Extra carries a HeaderExtra
+// instead. MakeBlock fills it from the state and ValidateHeaderAgainstState
+// checks it, so that a light client verifying a header also verifies the
+// validators a node serves for its height, and the query proofs against the
+// app hash after the previous block.
+
+// HeaderExtra is the rlp encoded content of the Extra of the headers.
+type HeaderExtra struct {
+	// ValidatorsHash is the ValidatorsHash of the validators of the height.
+	ValidatorsHash common.Hash
+	// LastAppHash is the app hash after the previous block, the one of the
+	// genesis at the initial height.
+	LastAppHash []byte
+}
+
+// ValidatorsHash returns the hash of the addresses and voting powers of vals,
+// in set order. The address of a validator is the one of its key, so the
+// keys are committed too.
+func ValidatorsHash(vals *ValidatorSet) common.Hash {
+	var records []validatorRecord
+	if vals != nil {
+		records = make([]validatorRecord, len(vals.Validators))
+	}
+	for i := range records {
+		val := vals.Validators[i]
+		records[i] = validatorRecord{Address: val.Address, Power: uint64(val.VotingPower)}
+	}
+	b, err := rlp.EncodeToBytes(records)
+	if err != nil {
+		panic(err)
+	}
+	return crypto.Keccak256Hash(b)
+}
+
+// NewHeaderExtra returns the HeaderExtra of the next block of state.
+func NewHeaderExtra(state ChainState) *HeaderExtra {
+	return &HeaderExtra{ValidatorsHash: ValidatorsHash(state.Validators), LastAppHash: state.AppHash}
+}
+
+func (e *HeaderExtra) Bytes() []byte {
+	b, err := rlp.EncodeToBytes(e)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// DecodeHeaderExtra returns the HeaderExtra of h.
+func DecodeHeaderExtra(h *Header) (*HeaderExtra, error) {
+	e := &HeaderExtra{}
+	if err := rlp.DecodeBytes(h.Extra, e); err != nil {
+		return nil, headerErrorf("extra data: %v", err)
+	}
+	return e, nil
+}
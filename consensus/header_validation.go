@@ -0,0 +1,154 @@
+package consensus
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Headers are validated in two steps: ValidateHeaderBasic checks what a
+// header says on its own, ValidateHeaderAgainstState checks that it extends
+// the chain of a state. Consensus, block sync and replay all go through
+// validateBlock, which adds the checks of the last commit; external verifiers
+// run ValidateHeaderBasic before verifying a commit of the header, e.g., with
+// VerifyCommitLight.
+//
+// Headers have no chain ID: the commits of a header are signed for it, so a
+// header of another chain fails commit verification.
+
+var ErrInvalidHeader = errors.New("invalid header")
+
+const (
+	MaxHeaderExtraBytes     = 1024
+	MaxHeaderNextValidators = 1024
+	maxHeaderBigIntBits     = 256
+
+	// MaxHeaderBytes bounds the encoded size of a valid header, its commit
+	// apart: the fixed-size fields take less than 1KB.
+	MaxHeaderBytes = 1024 + MaxHeaderExtraBytes + MaxHeaderNextValidators*(common.AddressLength+1)
+)
+
+func headerErrorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidHeader, fmt.Sprintf(format, args...))
+}
+
+// ValidateHeaderBasic checks the fields of a header without any state.
+func ValidateHeaderBasic(h *Header) error {
+	if h == nil {
+		return headerErrorf("nil header")
+	}
+
+	if h.Number == nil || h.Number.Sign() <= 0 || !h.Number.IsUint64() {
+		return headerErrorf("height %v out of range", h.Number)
+	}
+	if h.Difficulty != nil && (h.Difficulty.Sign() < 0 || h.Difficulty.BitLen() > maxHeaderBigIntBits) {
+		return headerErrorf("difficulty %v out of range", h.Difficulty)
+	}
+	if h.BaseFee != nil && (h.BaseFee.Sign() < 0 || h.BaseFee.BitLen() > maxHeaderBigIntBits) {
+		return headerErrorf("base fee %v out of range", h.BaseFee)
+	}
+	if h.GasUsed > h.GasLimit {
+		return headerErrorf("gas used %d above gas limit %d", h.GasUsed, h.GasLimit)
+	}
+
+	if h.TimeMs/1000 != h.Time {
+		return headerErrorf("time %d does not match time ms %d", h.Time, h.TimeMs)
+	}
+	if h.Coinbase == (common.Address{}) {
+		return headerErrorf("empty proposer address")
+	}
+
+	if len(h.Extra) > MaxHeaderExtraBytes {
+		return headerErrorf("extra data of %d bytes, max %d", len(h.Extra), MaxHeaderExtraBytes)
+	}
+	if len(h.NextValidators) > MaxHeaderNextValidators {
+		return headerErrorf("%d next validators, max %d", len(h.NextValidators), MaxHeaderNextValidators)
+	}
+	seen := make(map[common.Address]bool, len(h.NextValidators))
+	for _, addr := range h.NextValidators {
+		if addr == (common.Address{}) {
+			return headerErrorf("empty next validator address")
+		}
+		if seen[addr] {
+			return headerErrorf("duplicate next validator %v", addr)
+		}
+		seen[addr] = true
+	}
+	return nil
+}
+
+// ValidateHeaderAgainstState checks that a header is the next one of the
+// chain of a state: height, parent, proposer, time, validator changes and
+// extra data, see HeaderExtra.
+func ValidateHeaderAgainstState(state ChainState, h *Header) error {
+	height := h.Number.Uint64()
+
+	if state.LastBlockHeight == 0 && height != state.InitialHeight {
+		return headerErrorf("wrong height. Expected %v for initial block, got %v",
+			state.InitialHeight, height)
+	}
+	if state.LastBlockHeight > 0 && height != state.LastBlockHeight+1 {
+		return headerErrorf("wrong height. Expected %v, got %v",
+			state.LastBlockHeight+1,
+			height,
+		)
+	}
+	if h.ParentHash != state.LastBlockID {
+		return headerErrorf("wrong parent hash. Expected %v, got %v",
+			state.LastBlockID,
+			h.ParentHash,
+		)
+	}
+
+	// Don't allow validator change within the epoch
+	if height%state.Epoch != 0 && len(h.NextValidators) != 0 {
+		return headerErrorf("cannot change validators within epoch")
+	}
+
+	extra, err := DecodeHeaderExtra(h)
+	if err != nil {
+		return err
+	}
+	if expected := NewHeaderExtra(state); extra.ValidatorsHash != expected.ValidatorsHash {
+		return headerErrorf("wrong validators hash. Expected %v, got %v",
+			expected.ValidatorsHash,
+			extra.ValidatorsHash,
+		)
+	}
+	if !bytes.Equal(extra.LastAppHash, expected.LastAppHash) {
+		return headerErrorf("wrong last app hash. Expected %x, got %x",
+			expected.LastAppHash,
+			extra.LastAppHash,
+		)
+	}
+
+	// NOTE: We can't actually verify it's the right proposer because we don't
+	// know what round the block was first proposed. So just check that it's
+	// a known validator.
+	if !state.Validators.HasAddress(h.Coinbase) {
+		return headerErrorf("proposer %X is not a validator", h.Coinbase)
+	}
+
+	switch {
+	case height > state.InitialHeight:
+		if h.TimeMs <= state.LastBlockTime {
+			return headerErrorf("time %v not greater than last block time %v",
+				h.TimeMs,
+				state.LastBlockTime,
+			)
+		}
+	case height == state.InitialHeight:
+		if h.TimeMs != state.LastBlockTime {
+			return headerErrorf("time %v is not equal to genesis time %v",
+				h.TimeMs,
+				state.LastBlockTime,
+			)
+		}
+	default:
+		return headerErrorf("height %v lower than initial height %v",
+			height, state.InitialHeight)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package consensus
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateHeaderBasic(t *testing.T) {
+	valid := func() *Header {
+		return &Header{
+			Number:     big.NewInt(3),
+			TimeMs:     12345,
+			Time:       12,
+			Coinbase:   common.Address{1},
+			Difficulty: big.NewInt(3),
+			BaseFee:    big.NewInt(0),
+			Extra:      []byte{},
+		}
+	}
+	assert.NoError(t, ValidateHeaderBasic(valid()))
+
+	for name, mutate := range map[string]func(h *Header){
+		"no height":      func(h *Header) { h.Number = nil },
+		"zero height":    func(h *Header) { h.Number = big.NewInt(0) },
+		"huge height":    func(h *Header) { h.Number = new(big.Int).Lsh(big.NewInt(1), 64) },
+		"huge base fee":  func(h *Header) { h.BaseFee = new(big.Int).Lsh(big.NewInt(1), 300) },
+		"gas used":       func(h *Header) { h.GasUsed = 1 },
+		"time":           func(h *Header) { h.Time = 13 },
+		"no proposer":    func(h *Header) { h.Coinbase = common.Address{} },
+		"extra":          func(h *Header) { h.Extra = make([]byte, MaxHeaderExtraBytes+1) },
+		"duplicate next": func(h *Header) { h.NextValidators = []common.Address{{2}, {2}} },
+		"empty next":     func(h *Header) { h.NextValidators = []common.Address{{}} },
+	} {
+		h := valid()
+		mutate(h)
+		err := ValidateHeaderBasic(h)
+		assert.True(t, errors.Is(err, ErrInvalidHeader), name)
+	}
+}
+
+func TestValidateHeaderExtra(t *testing.T) {
+	state := *MakeGenesisChainState("test", 1000, []common.Address{{1}, {2}}, []int64{1, 1}, 100, 1)
+	header := state.MakeBlock(1, NewCommit(0, 0, common.Hash{}, nil), common.Address{1}).Header()
+	assert.NoError(t, ValidateHeaderAgainstState(state, header))
+
+	// the validators of the state are not the ones of the header
+	other := *MakeGenesisChainState("test", 1000, []common.Address{{1}, {2}}, []int64{1, 2}, 100, 1)
+	err := ValidateHeaderAgainstState(other, header)
+	assert.True(t, errors.Is(err, ErrInvalidHeader))
+
+	// nor the app hash
+	other = state
+	other.AppHash = []byte{1}
+	err = ValidateHeaderAgainstState(other, header)
+	assert.True(t, errors.Is(err, ErrInvalidHeader))
+
+	header.Extra = []byte{}
+	err = ValidateHeaderAgainstState(state, header)
+	assert.True(t, errors.Is(err, ErrInvalidHeader))
+}
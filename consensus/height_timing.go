@@ -0,0 +1,112 @@
+package consensus
+
+import (
+	"encoding/binary"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// HeightTiming is when a height committed by consensus went through each
+// stage, in Unix ms, 0 for the stages it skipped (e.g. the proposal of a
+// block committed without it). The time between two stages is where the
+// block time goes: e.g. between BlockPersistedMs and AppCommittedMs it is
+// spent by the application.
+type HeightTiming struct {
+	Height uint64 `json:"height"`
+	// the round the block was committed in
+	CommitRound int32 `json:"commit_round"`
+
+	NewHeightMs       uint64 `json:"new_height_ms"`
+	RoundZeroMs       uint64 `json:"round_zero_ms"` // after the commit timeout
+	ProposalMs        uint64 `json:"proposal_ms"`
+	FirstPrevoteMs    uint64 `json:"first_prevote_ms"`
+	PrevoteQuorumMs   uint64 `json:"prevote_quorum_ms"`
+	PrecommitQuorumMs uint64 `json:"precommit_quorum_ms"`
+	BlockPersistedMs  uint64 `json:"block_persisted_ms"`
+	AppCommittedMs    uint64 `json:"app_committed_ms"`
+}
+
+// recordHeightTiming sets the time of a stage of the current height if it is
+// not set yet.
+func recordHeightTiming(field *uint64) {
+	if *field == 0 {
+		*field = uint64(CanonicalNowMs())
+	}
+}
+
+// DefaultHeightTimings is the number of heights a HeightTimingStore keeps.
+const DefaultHeightTimings = 1000
+
+var heightTimingPrefix = []byte("height_timing")
+
+// HeightTimingStore keeps the timings of the last heights in a ring of
+// slots of a database, the timing of a height overwriting the one of size
+// heights before.
+type HeightTimingStore struct {
+	db   *leveldb.DB
+	size uint64
+}
+
+func NewHeightTimingStore(db *leveldb.DB, size uint64) *HeightTimingStore {
+	if size == 0 {
+		size = DefaultHeightTimings
+	}
+	return &HeightTimingStore{db: db, size: size}
+}
+
+// Size is the number of heights the store keeps.
+func (s *HeightTimingStore) Size() uint64 {
+	return s.size
+}
+
+func (s *HeightTimingStore) key(height uint64) []byte {
+	var slot [8]byte
+	binary.BigEndian.PutUint64(slot[:], height%s.size)
+	return append(append([]byte{}, heightTimingPrefix...), slot[:]...)
+}
+
+func (s *HeightTimingStore) Save(t *HeightTiming) {
+	data, err := rlp.EncodeToBytes(t)
+	if err != nil {
+		log.Error("cannot encode height timing", "height", t.Height, "err", err)
+		return
+	}
+	if err := s.db.Put(s.key(t.Height), data, nil); err != nil {
+		log.Error("cannot save height timing", "height", t.Height, "err", err)
+	}
+}
+
+// Load returns the timing of a height, nil if it was not recorded or was
+// overwritten since.
+func (s *HeightTimingStore) Load(height uint64) *HeightTiming {
+	data, err := s.db.Get(s.key(height), nil)
+	if err != nil {
+		return nil
+	}
+	t := &HeightTiming{}
+	if err := rlp.DecodeBytes(data, t); err != nil || t.Height != height {
+		return nil
+	}
+	return t
+}
+
+// SetHeightTimingStore records the timing of every height committed by
+// consensus in store. It must be called before the consensus state starts.
+func (cs *ConsensusState) SetHeightTimingStore(store *HeightTimingStore) {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	cs.heightTimings = store
+}
+
+// saveHeightTiming saves the timing of the height just committed.
+func (cs *ConsensusState) saveHeightTiming() {
+	if cs.heightTimings == nil {
+		return
+	}
+	cs.heightTiming.Height = cs.Height
+	cs.heightTiming.CommitRound = cs.CommitRound
+	t := cs.heightTiming
+	cs.heightTimings.Save(&t)
+}
@@ -0,0 +1,88 @@
+package consensus
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Jailed validators keep their voting power: their votes still count and the
+// quorum is still +2/3 of the whole set, since commits are verified against
+// it. They are only skipped when their turn to propose comes, without
+// touching the proposer priorities, so jailing and unjailing a validator does
+// not change who proposes after it.
+
+// JailUpdate jails or unjails a validator, as decided by the application.
+type JailUpdate struct {
+	Address common.Address
+	Jailed  bool
+}
+
+func isJailed(jailed []common.Address, addr common.Address) bool {
+	i := sort.Search(len(jailed), func(i int) bool {
+		return bytes.Compare(jailed[i][:], addr[:]) >= 0
+	})
+	return i < len(jailed) && jailed[i] == addr
+}
+
+// ProposerSkippingJailed returns the proposer of the set, or if it is jailed,
+// the first validator not jailed to come after it in the rotation.
+func ProposerSkippingJailed(vals *ValidatorSet, jailed []common.Address) *Validator {
+	proposer := vals.GetProposer()
+	if len(jailed) == 0 || !isJailed(jailed, proposer.Address) {
+		return proposer
+	}
+
+	// rotate a copy, the priorities of the set are left as they are
+	rotation := vals.Copy()
+	for slot := 1; slot < rotation.Size(); slot++ {
+		for i := int64(0); i < rotation.ProposerReptition; i++ {
+			rotation.IncrementProposerPriority(1)
+		}
+		if p := rotation.GetProposer(); !isJailed(jailed, p.Address) {
+			_, val := vals.GetByAddress(p.Address)
+			return val
+		}
+	}
+	// cannot happen, applyJailUpdates keeps one validator out of jail
+	return proposer
+}
+
+// applyJailUpdates returns the sorted jailed validators of vals after the
+// updates. Validators no longer in the set are dropped.
+func applyJailUpdates(vals *ValidatorSet, jailed []common.Address, updates []JailUpdate) ([]common.Address, error) {
+	set := make(map[common.Address]bool, len(jailed)+len(updates))
+	for _, addr := range jailed {
+		set[addr] = true
+	}
+	for _, u := range updates {
+		if !vals.HasAddress(u.Address) {
+			return nil, fmt.Errorf("cannot jail %v: not a validator", u.Address)
+		}
+		if u.Jailed {
+			set[u.Address] = true
+		} else {
+			delete(set, u.Address)
+		}
+	}
+
+	result := make([]common.Address, 0, len(set))
+	for addr := range set {
+		if vals.HasAddress(addr) {
+			result = append(result, addr)
+		}
+	}
+	if len(result) != 0 && len(result) >= vals.Size() {
+		return nil, fmt.Errorf("cannot jail all the %d validators", vals.Size())
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return bytes.Compare(result[i][:], result[j][:]) < 0
+	})
+	if len(result) == 0 {
+		return nil, nil
+	}
+	return result, nil
+}
@@ -0,0 +1,63 @@
+package consensus
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyJailUpdates(t *testing.T) {
+	vals, addrs := makeTestValidators(4)
+
+	jailed, err := applyJailUpdates(vals, nil, []JailUpdate{{addrs[2], true}, {addrs[0], true}})
+	assert.NoError(t, err)
+	assert.Equal(t, []common.Address{addrs[0], addrs[2]}, jailed)
+	assert.True(t, isJailed(jailed, addrs[2]))
+	assert.False(t, isJailed(jailed, addrs[1]))
+
+	jailed, err = applyJailUpdates(vals, jailed, []JailUpdate{{addrs[0], false}})
+	assert.NoError(t, err)
+	assert.Equal(t, []common.Address{addrs[2]}, jailed)
+
+	jailed, err = applyJailUpdates(vals, jailed, []JailUpdate{{addrs[2], false}})
+	assert.NoError(t, err)
+	assert.Nil(t, jailed)
+
+	_, err = applyJailUpdates(vals, nil, []JailUpdate{{common.BytesToAddress([]byte{0xff}), true}})
+	assert.Error(t, err)
+
+	all := make([]JailUpdate, len(addrs))
+	for i, addr := range addrs {
+		all[i] = JailUpdate{addr, true}
+	}
+	_, err = applyJailUpdates(vals, nil, all)
+	assert.Error(t, err)
+}
+
+func TestProposerSkippingJailed(t *testing.T) {
+	vals, _ := makeTestValidators(4)
+
+	// the sequence of proposers without jailing
+	var expected []common.Address
+	rotation := vals.Copy()
+	for i := 0; i < 12; i++ {
+		expected = append(expected, rotation.GetProposer().Address)
+		rotation.IncrementProposerPriority(1)
+	}
+
+	// jail every proposer in turn
+	rotation = vals.Copy()
+	for i := 0; i < 12; i++ {
+		jailed := []common.Address{expected[i]}
+		proposer := ProposerSkippingJailed(rotation, jailed)
+		assert.NotEqual(t, expected[i], proposer.Address)
+
+		// no jailing, no change
+		assert.Equal(t, expected[i], ProposerSkippingJailed(rotation, nil).Address)
+		// and the rotation itself is untouched, so unjailing restores it
+		assert.Equal(t, expected[i], rotation.GetProposer().Address)
+
+		rotation.IncrementProposerPriority(1)
+	}
+}
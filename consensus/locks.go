@@ -0,0 +1,163 @@
+package consensus
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// The lock (LockedRound/LockedBlock) and the valid block (ValidRound/
+// ValidBlock) of the round state only change through the functions below,
+// which check the transition with SafetyChecks and record it, so that the
+// lock history of the current height can be read with GetLockState.
+
+// The kinds of LockTransition.
+const (
+	LockTransitionLock   = "lock"
+	LockTransitionRelock = "relock"
+	LockTransitionUnlock = "unlock"
+	LockTransitionValid  = "valid"
+)
+
+// maxLockTransitions caps the transitions kept for a height, the latest ones
+// being kept; a height only gets more than a few in rounds after rounds.
+const maxLockTransitions = 64
+
+// LockTransition is a change of the lock or of the valid block.
+type LockTransition struct {
+	Kind string `json:"kind"`
+	// round of the state machine when it changed
+	Round int32 `json:"round"`
+	// round of the polka justifying it
+	PolRound int32 `json:"pol_round"`
+	// block locked or valid, zero for unlocks
+	BlockID common.Hash `json:"block_id"`
+	TimeMs  uint64      `json:"time_ms"`
+}
+
+// RoundPolka is a round with +2/3 prevotes for a block, or nil, BlockID
+// being zero then.
+type RoundPolka struct {
+	Round   int32       `json:"round"`
+	BlockID common.Hash `json:"block_id"`
+}
+
+// LockState is the lock and the valid block of the current height, with the
+// polkas and the transitions justifying them.
+type LockState struct {
+	Height          uint64           `json:"height"`
+	Round           int32            `json:"round"`
+	Step            string           `json:"step"`
+	LockedRound     int32            `json:"locked_round"`
+	LockedBlockHash common.Hash      `json:"locked_block_hash"`
+	ValidRound      int32            `json:"valid_round"`
+	ValidBlockHash  common.Hash      `json:"valid_block_hash"`
+	Polkas          []RoundPolka     `json:"polkas"`
+	Transitions     []LockTransition `json:"transitions"`
+}
+
+// GetLockState returns the lock state of the current height.
+func (cs *ConsensusState) GetLockState() LockState {
+	cs.mtx.RLock()
+	defer cs.mtx.RUnlock()
+
+	ls := LockState{
+		Height:          cs.Height,
+		Round:           cs.Round,
+		Step:            cs.Step.String(),
+		LockedRound:     cs.LockedRound,
+		LockedBlockHash: blockHash(cs.LockedBlock),
+		ValidRound:      cs.ValidRound,
+		ValidBlockHash:  blockHash(cs.ValidBlock),
+		Transitions:     append([]LockTransition(nil), cs.lockTransitions...),
+	}
+	if cs.Votes != nil {
+		for round := int32(0); round <= cs.Votes.Round(); round++ {
+			prevotes := cs.Votes.Prevotes(round)
+			if prevotes == nil {
+				continue
+			}
+			if polka, ok := prevotes.TwoThirdsMajority(); ok {
+				ls.Polkas = append(ls.Polkas, RoundPolka{Round: round, BlockID: polka})
+			}
+		}
+	}
+	return ls
+}
+
+func (cs *ConsensusState) recordLockTransition(kind string, polRound int32, blockID common.Hash) {
+	if len(cs.lockTransitions) == maxLockTransitions {
+		copy(cs.lockTransitions, cs.lockTransitions[1:])
+		cs.lockTransitions = cs.lockTransitions[:maxLockTransitions-1]
+	}
+	cs.lockTransitions = append(cs.lockTransitions, LockTransition{
+		Kind:     kind,
+		Round:    cs.Round,
+		PolRound: polRound,
+		BlockID:  blockID,
+		TimeMs:   uint64(CanonicalNowMs()),
+	})
+}
+
+// resetLocks clears the lock and the valid block for a new height.
+func (cs *ConsensusState) resetLocks() {
+	cs.LockedRound = -1
+	cs.LockedBlock = nil
+	cs.ValidRound = -1
+	cs.ValidBlock = nil
+	cs.lockTransitions = nil
+}
+
+// lock locks on block at round.
+func (cs *ConsensusState) lock(round int32, block *FullBlock) {
+	cs.checkLock(round, block)
+	kind := LockTransitionLock
+	if cs.LockedBlock != nil && cs.LockedBlock.Hash() == block.Hash() {
+		kind = LockTransitionRelock
+	}
+	cs.LockedRound = round
+	cs.LockedBlock = block
+	cs.recordLockTransition(kind, round, block.Hash())
+	cs.publishRoundEvent(EventLock, block.Hash())
+}
+
+// unlock releases the lock, if any, after the polka of polRound.
+func (cs *ConsensusState) unlock(polRound int32) {
+	cs.checkUnlock()
+	locked := cs.LockedBlock != nil
+	cs.LockedRound = -1
+	cs.LockedBlock = nil
+	if locked {
+		cs.recordLockTransition(LockTransitionUnlock, polRound, common.Hash{})
+		cs.publishRoundEvent(EventUnlock, common.Hash{})
+	}
+}
+
+// unlockOnHigherPolka releases the lock if a round after the locked one, up
+// to the current one, has a polka for another block or nil. The polka of a
+// round after the current one is only acted on once we get to the round, so
+// enterNewRound checks again: without, we would prevote the locked block in
+// a round +2/3 already prevoted something else in.
+func (cs *ConsensusState) unlockOnHigherPolka() {
+	if cs.LockedBlock == nil || cs.Votes == nil {
+		return
+	}
+	for round := cs.Round; round > cs.LockedRound; round-- {
+		prevotes := cs.Votes.Prevotes(round)
+		if prevotes == nil {
+			continue
+		}
+		if polka, ok := prevotes.TwoThirdsMajority(); ok && !cs.LockedBlock.HashTo(polka) {
+			log.Debug("unlocking because of POL", "locked_round", cs.LockedRound, "pol_round", round)
+			cs.unlock(round)
+			return
+		}
+	}
+}
+
+// setValid makes block, with a polka at round, the valid block.
+func (cs *ConsensusState) setValid(round int32, block *FullBlock) {
+	cs.checkValid(round, block)
+	cs.ValidRound = round
+	cs.ValidBlock = block
+	cs.recordLockTransition(LockTransitionValid, round, block.Hash())
+}
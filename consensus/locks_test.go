@@ -0,0 +1,176 @@
+package consensus
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type lockTest struct {
+	cs         *ConsensusState
+	blocks     []*FullBlock
+	violations []string
+	prevote    func(round int32, blockID common.Hash)
+}
+
+// newLockTest returns the state at height 1 of 4 validators, two blocks they
+// can prevote, and a prevote of 3 of them.
+func newLockTest(t *testing.T) *lockTest {
+	pvs := make([]PrivValidator, 4)
+	addrs := make([]common.Address, 4)
+	for i := range pvs {
+		pvs[i] = GeneratePrivValidatorLocal()
+		pubKey, err := pvs[i].GetPubKey(context.Background())
+		require.NoError(t, err)
+		addrs[i] = pubKey.Address()
+	}
+	vals := NewValidatorSet(addrs, []int64{1, 1, 1, 1}, 1)
+	byAddr := make(map[common.Address]PrivValidator)
+	for i, addr := range addrs {
+		byAddr[addr] = pvs[i]
+	}
+
+	lt := &lockTest{cs: &ConsensusState{}}
+	SafetyChecks(func(v SafetyViolation) { lt.violations = append(lt.violations, v.Invariant) })(lt.cs)
+	lt.cs.Height = 1
+	lt.cs.resetLocks()
+	lt.cs.Votes = NewHeightVoteSet("test", 1, vals)
+	lt.cs.Votes.SetRound(5)
+
+	state := *MakeGenesisChainState("test", 1000, addrs, []int64{1, 1, 1, 1}, 100, 1)
+	for _, proposer := range addrs[:2] {
+		lt.blocks = append(lt.blocks, state.MakeBlock(1, NewCommit(0, 0, common.Hash{}, nil), proposer))
+	}
+	require.NotEqual(t, lt.blocks[0].Hash(), lt.blocks[1].Hash())
+
+	lt.prevote = func(round int32, blockID common.Hash) {
+		for idx, val := range vals.Validators[:3] {
+			vote := &Vote{ValidatorAddress: val.Address, ValidatorIndex: int32(idx), Height: 1, Round: round, Type: PrevoteType, BlockID: blockID}
+			require.NoError(t, byAddr[val.Address].SignVote(context.Background(), "test", vote))
+			_, err := lt.cs.Votes.AddVote(vote, "")
+			require.NoError(t, err)
+		}
+	}
+	return lt
+}
+
+func TestLockTransitions(t *testing.T) {
+	lt := newLockTest(t)
+	cs, block := lt.cs, lt.blocks[0]
+
+	lt.prevote(0, block.Hash())
+	cs.lock(0, block)
+	cs.setValid(0, block)
+	lt.prevote(1, block.Hash())
+	cs.Round = 1
+	cs.lock(1, block)
+	lt.prevote(2, common.Hash{})
+	cs.Round = 2
+	cs.unlockOnHigherPolka()
+	// nothing to release
+	cs.unlock(2)
+	assert.Empty(t, lt.violations)
+
+	ls := cs.GetLockState()
+	assert.Equal(t, int32(-1), ls.LockedRound)
+	assert.Equal(t, common.Hash{}, ls.LockedBlockHash)
+	assert.Equal(t, int32(0), ls.ValidRound)
+	assert.Equal(t, block.Hash(), ls.ValidBlockHash)
+	assert.Equal(t, []RoundPolka{{0, block.Hash()}, {1, block.Hash()}, {2, common.Hash{}}}, ls.Polkas)
+	kinds := make([]string, len(ls.Transitions))
+	for i, tr := range ls.Transitions {
+		kinds[i] = tr.Kind
+	}
+	assert.Equal(t, []string{LockTransitionLock, LockTransitionValid, LockTransitionRelock, LockTransitionUnlock}, kinds)
+	assert.Equal(t, LockTransition{Kind: LockTransitionUnlock, Round: 2, PolRound: 2, TimeMs: ls.Transitions[3].TimeMs}, ls.Transitions[3])
+
+	cs.resetLocks()
+	ls = cs.GetLockState()
+	assert.Equal(t, int32(-1), ls.ValidRound)
+	assert.Empty(t, ls.Transitions)
+}
+
+func TestUnlockOnHigherPolka(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		polRound int32
+		polBlock int // index of the block, -1 for nil
+		round    int32
+		unlocked bool
+	}{
+		{"earlier round", 0, 1, 2, false},
+		{"locked block", 2, 0, 2, false},
+		{"nil", 2, -1, 2, true},
+		{"other block", 2, 1, 3, true},
+		// acted on once we get to the round
+		{"future round", 3, -1, 2, false},
+		{"skipped round", 3, 1, 4, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lt := newLockTest(t)
+			cs := lt.cs
+
+			lt.prevote(1, lt.blocks[0].Hash())
+			cs.Round = 1
+			cs.lock(1, lt.blocks[0])
+
+			polka := common.Hash{}
+			if tc.polBlock >= 0 {
+				polka = lt.blocks[tc.polBlock].Hash()
+			}
+			lt.prevote(tc.polRound, polka)
+			cs.Round = tc.round
+			cs.unlockOnHigherPolka()
+
+			assert.Equal(t, tc.unlocked, cs.LockedBlock == nil)
+			if tc.unlocked {
+				assert.Equal(t, int32(-1), cs.LockedRound)
+				assert.Equal(t, tc.polRound, cs.lockTransitions[len(cs.lockTransitions)-1].PolRound)
+			} else {
+				assert.Equal(t, int32(1), cs.LockedRound)
+			}
+			cs.checkLockState()
+			assert.Empty(t, lt.violations)
+		})
+	}
+}
+
+func TestLockTransitionChecks(t *testing.T) {
+	lt := newLockTest(t)
+	cs, block := lt.cs, lt.blocks[0]
+
+	// no polka
+	cs.setValid(0, block)
+	assert.Equal(t, []string{InvariantValidPolka}, lt.violations)
+
+	lt.violations = nil
+	lt.prevote(1, block.Hash())
+	cs.Round = 1
+	cs.setValid(1, block)
+	cs.setValid(0, block)
+	assert.Equal(t, []string{InvariantValidPolka, InvariantValidPolka}, lt.violations)
+
+	lt.violations = nil
+	cs.ValidBlock = nil
+	cs.checkLockState()
+	assert.Equal(t, []string{InvariantLockState}, lt.violations)
+}
+
+func TestLockTransitionsCapped(t *testing.T) {
+	lt := newLockTest(t)
+	cs, block := lt.cs, lt.blocks[0]
+
+	lt.prevote(0, block.Hash())
+	for i := 0; i < maxLockTransitions; i++ {
+		cs.lock(0, block)
+	}
+	cs.setValid(0, block)
+
+	ls := cs.GetLockState()
+	require.Len(t, ls.Transitions, maxLockTransitions)
+	assert.Equal(t, LockTransitionRelock, ls.Transitions[0].Kind)
+	assert.Equal(t, LockTransitionValid, ls.Transitions[maxLockTransitions-1].Kind)
+}
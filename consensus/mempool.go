@@ -0,0 +1,86 @@
+package consensus
+
+import (
+	"context"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// The rlp headers of the tx list and of the block grow with the txs, by up to
+// 8 bytes each.
+const txListOverhead = 16
+
+// Mempool holds the txs waiting to be proposed, see the mempool package.
+type Mempool interface {
+	TxNotifier
+	// Reap returns the txs to propose, in order, up to maxBytes of encoding
+	// and maxGas, 0 for no limit. They stay pending until committed.
+	Reap(maxBytes, maxGas uint64) types.Transactions
+	// ReapExcluding is Reap leaving out the txs of exclude, e.g., the ones of
+	// a block being committed, which stay pending until Update.
+	ReapExcluding(maxBytes, maxGas uint64, exclude types.Transactions) types.Transactions
+	// Pending tells whether the txs are all pending and may still be reaped,
+	// i.e., not below the minimum priority.
+	Pending(txs types.Transactions) bool
+	// Update removes the txs of the committed block at height, and rechecks
+	// the pending ones against the new app state. The txs of priority below
+	// minPriority are no longer reaped, see
+	// FinalizeBlockResponse.MinTxPriority.
+	Update(ctx context.Context, height uint64, txs types.Transactions, minPriority int64)
+}
+
+// CheckTxResponse admits a tx to the mempool.
+type CheckTxResponse struct {
+	// Priority orders the txs to propose, highest first, the txs of the same
+	// priority in the order they arrived.
+	Priority int64
+}
+
+// TxChecker is implemented by the applications checking the txs before they
+// are admitted to the mempool, e.g., their signatures and fees, and again
+// after every block, against the state it left. A tx it rejects is dropped.
+type TxChecker interface {
+	CheckTx(ctx context.Context, tx *types.Transaction) (CheckTxResponse, error)
+}
+
+// WithMempool proposes the txs of mempool, and removes the committed ones
+// from it.
+func WithMempool(mempool Mempool) ExecutorOption {
+	return func(be *DefaultBlockExecutor) {
+		be.mempool = mempool
+	}
+}
+
+// txLimits returns the bytes and the gas left for the txs of block, 0 for no
+// limit, as the consensus params allow; ok is false if there is no room.
+func txLimits(chainState *ChainState, block *FullBlock) (maxBytes, maxGas uint64, ok bool) {
+	params := chainState.ConsensusParams
+	if params.MaxBlockBytes != 0 {
+		overhead := uint64(block.Size()) + txListOverhead
+		if overhead >= params.MaxBlockBytes {
+			return 0, 0, false
+		}
+		maxBytes = params.MaxBlockBytes - overhead
+	}
+	return maxBytes, params.MaxGas, true
+}
+
+// reapTxs adds the txs of the mempool to block, as many as the consensus
+// params allow, the ones reaped ahead by PrepareProposal if they still fit.
+func (be *DefaultBlockExecutor) reapTxs(chainState *ChainState, block *FullBlock) *FullBlock {
+	maxBytes, maxGas, ok := txLimits(chainState, block)
+	if !ok {
+		return block
+	}
+
+	txs, ok := be.preparedTxs(block.NumberU64(), maxBytes, maxGas)
+	if !ok {
+		txs = be.mempool.Reap(maxBytes, maxGas)
+	}
+	if len(txs) == 0 {
+		return block
+	}
+	block.Block = types.NewBlock(block.Header(), txs, nil, nil, trie.NewStackTrie(nil))
+	return block
+}
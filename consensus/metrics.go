@@ -0,0 +1,152 @@
+package consensus
+
+import (
+	"github.com/QuarkChain/go-minimal-pbft/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RegisterMetrics registers the consensus metrics with reg, see
+// metrics.Options.
+func RegisterMetrics(reg prometheus.Registerer) error {
+	return metrics.Register(reg,
+		consensusBlockValidatorRejections,
+		consensusEvidenceCommitted,
+		consensusEvidencePending,
+		consensusFutureMessages,
+		consensusHalted,
+		consensusPipelinedProposals,
+		consensusProposalKnownBlocks,
+		consensusRoundEventsDropped,
+		consensusSafetyViolations,
+		consensusSpeculations,
+		consensusSubmittedVotes,
+		consensusUntimelyProposals,
+		consensusVoteExtensions,
+		consensusVoteSignatures,
+		quorumCollector{},
+		storeCollector{},
+		storeCompactions,
+	)
+}
+
+// Metrics are the metrics of the state machine of a consensus state, see
+// StateMetrics. They are collectors of their own, unlike the process-wide
+// ones of RegisterMetrics, so that a process running several consensus
+// states can register each in its own namespace.
+type Metrics struct {
+	// Height, round and step of the state machine.
+	Height prometheus.Gauge
+	Round  prometheus.Gauge
+	Step   prometheus.Gauge
+
+	// BlockIntervalSeconds is the time between the committed block and the
+	// previous one.
+	BlockIntervalSeconds prometheus.Histogram
+	// MissingValidators and MissingValidatorsPower count the validators
+	// whose precommit is absent from the last commit of the committed block.
+	MissingValidators      prometheus.Gauge
+	MissingValidatorsPower prometheus.Gauge
+
+	// ProposalTimeouts counts the rounds the proposal was not received in
+	// time, i.e., the proposals missed.
+	ProposalTimeouts prometheus.Counter
+	// ByzantineVotes counts the conflicting votes seen from peers.
+	ByzantineVotes prometheus.Counter
+	// FastPathCommits counts the heights started without waiting for the
+	// commit timeout, all the validators having precommitted.
+	FastPathCommits prometheus.Counter
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		Height: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "consensus_height",
+			Help: "Height of the consensus state machine",
+		}),
+		Round: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "consensus_round",
+			Help: "Round of the consensus state machine",
+		}),
+		Step: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "consensus_step",
+			Help: "Step of the consensus state machine, as RoundStepType",
+		}),
+		BlockIntervalSeconds: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "consensus_block_interval_seconds",
+			Help:    "Time between the committed block and the previous one",
+			Buckets: prometheus.ExponentialBuckets(0.25, 2, 10),
+		}),
+		MissingValidators: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "consensus_missing_validators",
+			Help: "Validators whose precommit is absent from the last commit of the latest block",
+		}),
+		MissingValidatorsPower: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "consensus_missing_validators_power",
+			Help: "Voting power of the validators absent from the last commit of the latest block",
+		}),
+		ProposalTimeouts: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "consensus_proposal_timeouts_total",
+			Help: "Rounds whose proposal was not received before the propose timeout",
+		}),
+		ByzantineVotes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "consensus_byzantine_votes_total",
+			Help: "Conflicting votes seen from other validators",
+		}),
+		FastPathCommits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "consensus_fast_path_commits_total",
+			Help: "Heights started right after the commit, all the validators having precommitted",
+		}),
+	}
+}
+
+// Register registers the metrics with reg, see metrics.Options.
+func (m *Metrics) Register(reg prometheus.Registerer) error {
+	return metrics.Register(reg,
+		m.Height,
+		m.Round,
+		m.Step,
+		m.BlockIntervalSeconds,
+		m.MissingValidators,
+		m.MissingValidatorsPower,
+		m.ProposalTimeouts,
+		m.ByzantineVotes,
+		m.FastPathCommits,
+	)
+}
+
+// StateOption sets an optional parameter of NewConsensusState.
+type StateOption func(*ConsensusState)
+
+// StateMetrics sets the metrics of the consensus state. Without it, the
+// metrics are kept but not registered anywhere.
+func StateMetrics(m *Metrics) StateOption {
+	return func(cs *ConsensusState) {
+		cs.metrics = m
+	}
+}
+
+func (cs *ConsensusState) recordStepMetrics() {
+	cs.metrics.Height.Set(float64(cs.Height))
+	cs.metrics.Round.Set(float64(cs.Round))
+	cs.metrics.Step.Set(float64(cs.Step))
+}
+
+// recordBlockMetrics records the metrics of a committed block, before the
+// state moves to the next height.
+func (cs *ConsensusState) recordBlockMetrics(block *FullBlock) {
+	if block.NumberU64() > cs.chainState.InitialHeight && block.TimeMs() >= cs.chainState.LastBlockTime {
+		cs.metrics.BlockIntervalSeconds.Observe(float64(block.TimeMs()-cs.chainState.LastBlockTime) / 1000)
+	}
+
+	missing, missingPower := 0, int64(0)
+	if info, err := MakeCommitInfo(block.LastCommit, cs.chainState.LastValidators); err == nil {
+		for _, vote := range info.Votes {
+			if !vote.SignedLastBlock {
+				missing++
+				missingPower += vote.Power
+			}
+		}
+	}
+	cs.metrics.MissingValidators.Set(float64(missing))
+	cs.metrics.MissingValidatorsPower.Set(float64(missingPower))
+}
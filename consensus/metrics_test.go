@@ -0,0 +1,18 @@
+package consensus
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsRegister(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	assert.NoError(t, RegisterMetrics(reg))
+	// no name clash with the process-wide metrics
+	assert.NoError(t, NewMetrics().Register(reg))
+
+	// one set per consensus state, in its own namespace
+	assert.NoError(t, NewMetrics().Register(prometheus.WrapRegistererWithPrefix("b_", reg)))
+}
@@ -0,0 +1,222 @@
+package consensus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// Misbehaviors make a validator byzantine, so that integration tests exercise
+// the code of the honest nodes facing one: evidence, locking, invalid
+// proposals. They are only compiled in with the byzantine build tag, e.g.
+//
+//	go build -tags byzantine ./cmd/main
+//	main node --misbehave "equivocate@5-8,withhold-proposal"
+//
+// The conflicting votes and proposals are signed with BytesSigner, bypassing
+// the double-sign protection of the priv validator, and are sent to the peers
+// only: our own state machine stays honest, but for what it votes and
+// proposes.
+
+var ErrInvalidMisbehavior = errors.New("invalid misbehavior")
+
+type Misbehavior string
+
+const (
+	// MisbehaviorEquivocate signs a second vote for each of our votes, for
+	// nil if ours is for a block, and for a block otherwise.
+	MisbehaviorEquivocate Misbehavior = "equivocate"
+	// MisbehaviorWithholdProposal never proposes.
+	MisbehaviorWithholdProposal Misbehavior = "withhold-proposal"
+	// MisbehaviorConflictingProposal signs a second proposal for another
+	// block. Proposals sent by parts (see p2p.BlockParts) come with parts
+	// conflicting with the ones of our proposal.
+	MisbehaviorConflictingProposal Misbehavior = "conflicting-proposal"
+	// MisbehaviorInvalidProposal proposes blocks with a time failing the
+	// header validation.
+	MisbehaviorInvalidProposal Misbehavior = "invalid-proposal"
+	// MisbehaviorVoteInvalid prevotes and precommits the proposal block
+	// without validating it.
+	MisbehaviorVoteInvalid Misbehavior = "vote-invalid"
+)
+
+var allMisbehaviors = []Misbehavior{
+	MisbehaviorEquivocate,
+	MisbehaviorWithholdProposal,
+	MisbehaviorConflictingProposal,
+	MisbehaviorInvalidProposal,
+	MisbehaviorVoteInvalid,
+}
+
+// heightRange is [from, to], to 0 for no end.
+type heightRange struct {
+	from, to uint64
+}
+
+func (r heightRange) contains(height uint64) bool {
+	return r.from <= height && (r.to == 0 || height <= r.to)
+}
+
+// Misbehaviors are the misbehaviors of a validator, each at a range of
+// heights.
+type Misbehaviors map[Misbehavior]heightRange
+
+// ParseMisbehaviors parses a comma separated list of misbehaviors, each at
+// every height, or at the heights after @: a height, a range from-to, or
+// from- for no end.
+func ParseMisbehaviors(spec string) (Misbehaviors, error) {
+	ms := make(Misbehaviors)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, heights, ranged := entry, "", false
+		if i := strings.IndexByte(entry, '@'); i >= 0 {
+			name, heights, ranged = entry[:i], entry[i+1:], true
+		}
+		m := Misbehavior(name)
+		known := false
+		for _, k := range allMisbehaviors {
+			known = known || k == m
+		}
+		if !known {
+			return nil, fmt.Errorf("%w: unknown %q", ErrInvalidMisbehavior, name)
+		}
+
+		var r heightRange
+		if ranged {
+			var err error
+			if r, err = parseHeightRange(heights); err != nil {
+				return nil, fmt.Errorf("%w: %q: %v", ErrInvalidMisbehavior, entry, err)
+			}
+		}
+		ms[m] = r
+	}
+	return ms, nil
+}
+
+func parseHeightRange(s string) (heightRange, error) {
+	from, to := s, s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		from, to = s[:i], s[i+1:]
+	}
+
+	var (
+		r   heightRange
+		err error
+	)
+	if r.from, err = strconv.ParseUint(from, 10, 64); err != nil {
+		return r, err
+	}
+	if to != "" {
+		if r.to, err = strconv.ParseUint(to, 10, 64); err != nil {
+			return r, err
+		}
+		if r.to < r.from {
+			return r, fmt.Errorf("empty range %d-%d", r.from, r.to)
+		}
+	}
+	return r, nil
+}
+
+// Misbehave makes the validator misbehave. Without the byzantine build tag
+// it is ignored, see MisbehaviorsEnabled.
+func Misbehave(ms Misbehaviors) StateOption {
+	return func(cs *ConsensusState) {
+		if !MisbehaviorsEnabled {
+			log.Error("misbehaviors are not compiled in, ignoring them", "misbehaviors", len(ms))
+			return
+		}
+		cs.misbehaviors = ms
+	}
+}
+
+func (ms Misbehaviors) at(m Misbehavior, height uint64) bool {
+	r, ok := ms[m]
+	return ok && r.contains(height)
+}
+
+// misbehavingSigner returns the signer of the conflicting messages.
+func (cs *ConsensusState) misbehavingSigner() BytesSigner {
+	signer, ok := cs.privValidator.(BytesSigner)
+	if !ok {
+		log.Error("cannot misbehave with a remote signer", "height", cs.Height)
+	}
+	return signer
+}
+
+// signConflictingVote sends the peers a vote conflicting with ours.
+func (cs *ConsensusState) signConflictingVote(ctx context.Context, vote *Vote) {
+	signer := cs.misbehavingSigner()
+	if signer == nil {
+		return
+	}
+
+	conflicting := *vote
+	switch {
+	case vote.BlockID != (common.Hash{}):
+		conflicting.BlockID = common.Hash{}
+	case cs.ProposalBlock != nil:
+		conflicting.BlockID = cs.ProposalBlock.Hash()
+	default:
+		conflicting.BlockID = crypto.Keccak256Hash([]byte("mpbft/misbehavior"), vote.VoteSignBytes(cs.chainState.ChainID))
+	}
+	sig, err := signer.SignBytes(conflicting.VoteSignBytes(cs.chainState.ChainID))
+	if err != nil {
+		log.Error("failed signing conflicting vote", "height", vote.Height, "round", vote.Round, "err", err)
+		return
+	}
+	conflicting.Signature = sig
+
+	log.Warn("misbehaving: equivocating", "height", vote.Height, "round", vote.Round, "type", vote.Type,
+		"block_id", vote.BlockID, "conflicting_block_id", conflicting.BlockID)
+	cs.broadcastMessageToPeers(ctx, &VoteMessage{Vote: &conflicting})
+}
+
+// signConflictingProposal sends the peers a proposal for another block than
+// the one of ours.
+func (cs *ConsensusState) signConflictingProposal(ctx context.Context, proposal *Proposal) {
+	signer := cs.misbehavingSigner()
+	if signer == nil {
+		return
+	}
+
+	conflicting := NewProposal(proposal.Height, proposal.Round, proposal.POLRound, retimeBlock(proposal.Block, 1))
+	sig, err := signer.SignBytes(conflicting.ProposalSignBytes(cs.chainState.ChainID))
+	if err != nil {
+		log.Error("failed signing conflicting proposal", "height", proposal.Height, "round", proposal.Round, "err", err)
+		return
+	}
+	conflicting.Signature = sig
+
+	log.Warn("misbehaving: proposing a conflicting block", "height", proposal.Height, "round", proposal.Round,
+		"block", proposal.Block.Hash(), "conflicting_block", conflicting.Block.Hash())
+	cs.broadcastMessageToPeers(ctx, &ProposalMessage{Proposal: conflicting})
+}
+
+// invalidProposalBlock returns block with a time before the last block.
+func (cs *ConsensusState) invalidProposalBlock(block *FullBlock) *FullBlock {
+	log.Warn("misbehaving: proposing an invalid block", "height", block.NumberU64())
+	return retimeBlock(block, -int64(block.TimeMs()-cs.chainState.LastBlockTime))
+}
+
+// retimeBlock returns a copy of block with its time shifted by deltaMs.
+func retimeBlock(block *FullBlock, deltaMs int64) *FullBlock {
+	header := block.Header()
+	header.TimeMs = uint64(int64(header.TimeMs) + deltaMs)
+	header.Time = header.TimeMs / 1000
+	return &FullBlock{
+		Block:      types.NewBlock(header, block.Transactions(), nil, nil, trie.NewStackTrie(nil)),
+		LastCommit: block.LastCommit,
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !byzantine
+// +build !byzantine
+
+package consensus
+
+const MisbehaviorsEnabled = false
+
+// misbehaves is always false without the byzantine build tag.
+func (cs *ConsensusState) misbehaves(m Misbehavior) bool {
+	return false
+}
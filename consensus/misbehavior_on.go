@@ -0,0 +1,12 @@
+//go:build byzantine
+// +build byzantine
+
+package consensus
+
+const MisbehaviorsEnabled = true
+
+// misbehaves returns whether the validator has misbehavior m at the current
+// height.
+func (cs *ConsensusState) misbehaves(m Misbehavior) bool {
+	return cs.misbehaviors.at(m, cs.Height)
+}
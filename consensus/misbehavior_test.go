@@ -0,0 +1,34 @@
+package consensus
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMisbehaviors(t *testing.T) {
+	ms, err := ParseMisbehaviors("equivocate@5-7, withhold-proposal,invalid-proposal@3,vote-invalid@10-")
+	require.NoError(t, err)
+	require.Len(t, ms, 4)
+
+	for height, expected := range map[uint64]bool{4: false, 5: true, 7: true, 8: false} {
+		assert.Equal(t, expected, ms.at(MisbehaviorEquivocate, height), height)
+	}
+	assert.True(t, ms.at(MisbehaviorWithholdProposal, 1))
+	assert.True(t, ms.at(MisbehaviorInvalidProposal, 3))
+	assert.False(t, ms.at(MisbehaviorInvalidProposal, 4))
+	assert.False(t, ms.at(MisbehaviorVoteInvalid, 9))
+	assert.True(t, ms.at(MisbehaviorVoteInvalid, 1000))
+	assert.False(t, ms.at(MisbehaviorConflictingProposal, 5))
+
+	ms, err = ParseMisbehaviors("")
+	require.NoError(t, err)
+	assert.Empty(t, ms)
+
+	for _, spec := range []string{"lie", "equivocate@", "equivocate@x", "equivocate@7-5"} {
+		_, err := ParseMisbehaviors(spec)
+		assert.True(t, errors.Is(err, ErrInvalidMisbehavior), spec)
+	}
+}
@@ -0,0 +1,141 @@
+package consensus
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var ErrInvalidConsensusParams = errors.New("invalid consensus params")
+
+// Safe ranges of the consensus timeouts. Below the minimum, rounds time out
+// before messages can reach the other validators and the network never
+// decides; above the maximum, a single faulty proposer stalls the chain for
+// longer than any operator would wait.
+var (
+	MinConsensusTimeout = 10 * time.Millisecond
+	MaxConsensusTimeout = time.Hour
+)
+
+// MaxTotalVotingPower bounds the total voting power so that priorities and
+// +2/3 computations cannot overflow int64.
+const MaxTotalVotingPower = int64(math.MaxInt64) / 8
+
+// paramErrors collects all the problems, so an operator can fix a
+// configuration in one go.
+type paramErrors []string
+
+func (pe *paramErrors) addf(format string, args ...interface{}) {
+	*pe = append(*pe, fmt.Sprintf(format, args...))
+}
+
+func (pe paramErrors) err() error {
+	if len(pe) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrInvalidConsensusParams, strings.Join(pe, "; "))
+}
+
+func checkTimeout(pe *paramErrors, name string, d time.Duration) {
+	if d < MinConsensusTimeout {
+		pe.addf("%s is %v, must be at least %v or rounds end before votes can arrive", name, d, MinConsensusTimeout)
+	} else if d > MaxConsensusTimeout {
+		pe.addf("%s is %v, must be at most %v or a faulty proposer stalls the chain", name, d, MaxConsensusTimeout)
+	}
+}
+
+// checkTimeoutDelta checks the increase of a timeout per round, which 0
+// disables.
+func checkTimeoutDelta(pe *paramErrors, name string, d time.Duration) {
+	if d < 0 {
+		pe.addf("%s is %v, must not be negative", name, d)
+	} else if d > MaxConsensusTimeout {
+		pe.addf("%s is %v, must be at most %v", name, d, MaxConsensusTimeout)
+	}
+}
+
+// ValidateConsensusConfig rejects timeouts known to break liveness.
+func ValidateConsensusConfig(cfg *ConsensusConfig) error {
+	var pe paramErrors
+
+	checkTimeout(&pe, "timeout propose", cfg.TimeoutPropose)
+	checkTimeout(&pe, "timeout prevote", cfg.TimeoutPrevote)
+	checkTimeout(&pe, "timeout precommit", cfg.TimeoutPrecommit)
+	checkTimeoutDelta(&pe, "timeout propose delta", cfg.TimeoutProposeDelta)
+	checkTimeoutDelta(&pe, "timeout prevote delta", cfg.TimeoutPrevoteDelta)
+	checkTimeoutDelta(&pe, "timeout precommit delta", cfg.TimeoutPrecommitDelta)
+	checkTimeout(&pe, "consensus sync request duration", cfg.ConsensusSyncRequestDuration)
+
+	// 0 is fine, the next height starts as soon as the block is committed
+	if cfg.TimeoutCommit < 0 {
+		pe.addf("timeout commit is %v, must not be negative", cfg.TimeoutCommit)
+	} else if cfg.TimeoutCommit > MaxConsensusTimeout {
+		pe.addf("timeout commit is %v, must be at most %v", cfg.TimeoutCommit, MaxConsensusTimeout)
+	}
+
+	return pe.err()
+}
+
+// ValidateValidatorUpdate checks a validator set given as addresses and
+// voting powers, at genesis or when it is changed at an epoch boundary.
+func ValidateValidatorUpdate(vals []common.Address, powers []int64) error {
+	var pe paramErrors
+
+	if len(vals) == 0 {
+		pe.addf("empty validator set, no block can ever be committed")
+	}
+	if len(vals) != len(powers) {
+		pe.addf("%d validators but %d voting powers", len(vals), len(powers))
+		return pe.err()
+	}
+
+	seen := make(map[common.Address]bool, len(vals))
+	total := int64(0)
+	for i, val := range vals {
+		if seen[val] {
+			pe.addf("duplicate validator %v", val)
+		}
+		seen[val] = true
+
+		if powers[i] <= 0 {
+			pe.addf("validator %v has voting power %d, must be positive", val, powers[i])
+			continue
+		}
+		if powers[i] > MaxTotalVotingPower-total {
+			pe.addf("total voting power exceeds %d", MaxTotalVotingPower)
+			break
+		}
+		total += powers[i]
+	}
+
+	return pe.err()
+}
+
+// ValidateChainState checks the chain-level params of a (genesis) state.
+func ValidateChainState(state *ChainState) error {
+	var pe paramErrors
+
+	if state.ChainID == "" {
+		pe.addf("empty chain id")
+	}
+	if state.InitialHeight == 0 {
+		pe.addf("initial height must be at least 1")
+	}
+	if state.Epoch == 0 {
+		pe.addf("epoch must be positive")
+	}
+	if state.VoteExtensionMaxBytes > uint64(MaxVoteExtensionBytes) {
+		pe.addf("vote extension max bytes is %d, must be at most %d", state.VoteExtensionMaxBytes, MaxVoteExtensionBytes)
+	}
+	if state.Validators == nil || state.Validators.Size() == 0 {
+		pe.addf("empty validator set, no block can ever be committed")
+	} else if state.Validators.ProposerReptition <= 0 {
+		pe.addf("proposer repetition is %d, must be positive", state.Validators.ProposerReptition)
+	}
+
+	return pe.err()
+}
@@ -0,0 +1,290 @@
+package consensus
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// A part set splits data, e.g. an encoded proposal, into parts of a fixed
+// size, and commits to them with the root of the Merkle tree of their hashes.
+// Each part comes with the proof of its inclusion under the root, so a part
+// is checked on its own, whichever peer it is received from, and a set is
+// assembled from several peers at the same time. The tree is the RFC 6962
+// one, as in statetree.
+
+var (
+	ErrInvalidPart     = errors.New("invalid part")
+	ErrInvalidPartSize = errors.New("invalid part set size")
+)
+
+// MaxParts bounds the parts of a set, so that a header cannot make a peer
+// allocate more than MaxParts*BlockPartSize bytes.
+const MaxParts = 1024
+
+// BlockPartSize is the size of the parts proposals are split into, but the
+// last one.
+var BlockPartSize = 64 * 1024
+
+var (
+	partLeafPrefix  = []byte{0}
+	partInnerPrefix = []byte{1}
+)
+
+// PartSetHeader identifies a part set.
+type PartSetHeader struct {
+	Total uint32
+	Root  common.Hash
+}
+
+func (h PartSetHeader) ValidateBasic() error {
+	if h.Total == 0 || h.Total > MaxParts {
+		return fmt.Errorf("%w: %d parts, at most %d", ErrInvalidPartSize, h.Total, MaxParts)
+	}
+	return nil
+}
+
+// Part is the part at Index of a set, with the hashes of the siblings on the
+// path from it to the root, from the bottom.
+type Part struct {
+	Index uint32
+	Bytes []byte
+	Proof [][]byte
+}
+
+func (p *Part) ValidateBasic() error {
+	if len(p.Bytes) == 0 || len(p.Bytes) > BlockPartSize {
+		return fmt.Errorf("%w: %d bytes", ErrInvalidPart, len(p.Bytes))
+	}
+	if len(p.Proof) > 32 {
+		return fmt.Errorf("%w: proof of %d hashes", ErrInvalidPart, len(p.Proof))
+	}
+	return nil
+}
+
+// Verify checks that the part is included under the root of the set.
+func (p *Part) Verify(h PartSetHeader) error {
+	if p.Index >= h.Total {
+		return fmt.Errorf("%w: index %d of %d", ErrInvalidPart, p.Index, h.Total)
+	}
+	root, rest := partProofRoot(partLeafHash(p.Bytes), int(p.Index), int(h.Total), p.Proof)
+	if root == nil || len(rest) != 0 || !bytes.Equal(root, h.Root[:]) {
+		return fmt.Errorf("%w: wrong proof of part %d", ErrInvalidPart, p.Index)
+	}
+	return nil
+}
+
+// PartSet is a set of parts being assembled, or split from data. It is safe
+// for concurrent use.
+type PartSet struct {
+	mtx    sync.Mutex
+	header PartSetHeader
+	parts  []*Part
+	bits   *BitArray
+	count  uint32
+	size   int
+}
+
+// NewPartSetFromData splits data into parts of partSize bytes.
+func NewPartSetFromData(data []byte, partSize int) (*PartSet, error) {
+	total := (len(data) + partSize - 1) / partSize
+	if total == 0 || total > MaxParts {
+		return nil, fmt.Errorf("%w: %d bytes in parts of %d", ErrInvalidPartSize, len(data), partSize)
+	}
+
+	ps := newPartSet(uint32(total))
+	leaves := make([][]byte, total)
+	for i := range ps.parts {
+		end := (i + 1) * partSize
+		if end > len(data) {
+			end = len(data)
+		}
+		ps.parts[i] = &Part{Index: uint32(i), Bytes: append([]byte{}, data[i*partSize:end]...)}
+		leaves[i] = partLeafHash(ps.parts[i].Bytes)
+		ps.bits.SetIndex(i, true)
+	}
+	for i, part := range ps.parts {
+		part.Proof = partAunts(leaves, i)
+	}
+	copy(ps.header.Root[:], partsRoot(leaves))
+	ps.count = uint32(total)
+	ps.size = len(data)
+	return ps, nil
+}
+
+// NewPartSetFromHeader returns an empty set to assemble the parts of h into.
+func NewPartSetFromHeader(h PartSetHeader) (*PartSet, error) {
+	if err := h.ValidateBasic(); err != nil {
+		return nil, err
+	}
+	ps := newPartSet(h.Total)
+	ps.header = h
+	return ps, nil
+}
+
+func newPartSet(total uint32) *PartSet {
+	bits, err := types.NewBitArrayFromUint64(int(total), make([]uint64, (total+63)/64))
+	if err != nil {
+		panic(err)
+	}
+	return &PartSet{
+		header: PartSetHeader{Total: total},
+		parts:  make([]*Part, total),
+		bits:   bits,
+	}
+}
+
+func (ps *PartSet) Header() PartSetHeader {
+	return ps.header
+}
+
+// AddPart adds a part once verified, and tells whether it was missing.
+func (ps *PartSet) AddPart(part *Part) (bool, error) {
+	if err := part.ValidateBasic(); err != nil {
+		return false, err
+	}
+	if err := part.Verify(ps.header); err != nil {
+		return false, err
+	}
+
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+
+	if ps.parts[part.Index] != nil {
+		return false, nil
+	}
+	ps.parts[part.Index] = part
+	ps.bits.SetIndex(int(part.Index), true)
+	ps.count++
+	ps.size += len(part.Bytes)
+	return true, nil
+}
+
+// GetPart returns the part at index, nil if it is missing.
+func (ps *PartSet) GetPart(index uint32) *Part {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+
+	if index >= ps.header.Total {
+		return nil
+	}
+	return ps.parts[index]
+}
+
+// BitArray returns a copy of the bits of the parts held.
+func (ps *PartSet) BitArray() *BitArray {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+
+	return ps.bits.Copy()
+}
+
+// Missing returns the indexes of the missing parts.
+func (ps *PartSet) Missing() []uint32 {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+
+	var missing []uint32
+	for i, part := range ps.parts {
+		if part == nil {
+			missing = append(missing, uint32(i))
+		}
+	}
+	return missing
+}
+
+func (ps *PartSet) IsComplete() bool {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+
+	return ps.count == ps.header.Total
+}
+
+// Data returns the assembled data, nil until the set is complete.
+func (ps *PartSet) Data() []byte {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+
+	if ps.count != ps.header.Total {
+		return nil
+	}
+	data := make([]byte, 0, ps.size)
+	for _, part := range ps.parts {
+		data = append(data, part.Bytes...)
+	}
+	return data
+}
+
+func partHash(data ...[]byte) []byte {
+	h := sha256.New()
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+func partLeafHash(data []byte) []byte {
+	return partHash(partLeafPrefix, data)
+}
+
+// partSplit returns the largest power of 2 smaller than n, the size of the
+// left subtree of n leaves.
+func partSplit(n int) int {
+	k := 1
+	for k*2 < n {
+		k *= 2
+	}
+	return k
+}
+
+func partsRoot(leaves [][]byte) []byte {
+	if len(leaves) == 1 {
+		return leaves[0]
+	}
+	k := partSplit(len(leaves))
+	return partHash(partInnerPrefix, partsRoot(leaves[:k]), partsRoot(leaves[k:]))
+}
+
+// partAunts returns the hashes of the siblings on the path from the leaf at
+// index to the root, from the bottom.
+func partAunts(leaves [][]byte, index int) [][]byte {
+	if len(leaves) <= 1 {
+		return nil
+	}
+	k := partSplit(len(leaves))
+	if index < k {
+		return append(partAunts(leaves[:k], index), partsRoot(leaves[k:]))
+	}
+	return append(partAunts(leaves[k:], index-k), partsRoot(leaves[:k]))
+}
+
+// partProofRoot hashes the leaf up to the root of a subtree of total leaves.
+// It consumes the aunts from the top, and returns nil if there are too few.
+func partProofRoot(leaf []byte, index, total int, aunts [][]byte) ([]byte, [][]byte) {
+	if total == 1 {
+		return leaf, aunts
+	}
+	if len(aunts) == 0 {
+		return nil, nil
+	}
+
+	k := partSplit(total)
+	top, rest := aunts[len(aunts)-1], aunts[:len(aunts)-1]
+	if index < k {
+		left, rest := partProofRoot(leaf, index, k, rest)
+		if left == nil {
+			return nil, nil
+		}
+		return partHash(partInnerPrefix, left, top), rest
+	}
+	right, rest := partProofRoot(leaf, index-k, total-k, rest)
+	if right == nil {
+		return nil, nil
+	}
+	return partHash(partInnerPrefix, top, right), rest
+}
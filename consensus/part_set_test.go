@@ -0,0 +1,71 @@
+package consensus
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testPartData(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	return data
+}
+
+func TestPartSetAssemble(t *testing.T) {
+	data := testPartData(1000)
+
+	for _, partSize := range []int{100, 333, 1000} {
+		src, err := NewPartSetFromData(data, partSize)
+		require.NoError(t, err)
+		require.True(t, src.IsComplete())
+
+		dst, err := NewPartSetFromHeader(src.Header())
+		require.NoError(t, err)
+		assert.Nil(t, dst.Data())
+
+		// out of order, as when fetched from several peers
+		total := src.Header().Total
+		for i := int(total) - 1; i >= 0; i-- {
+			added, err := dst.AddPart(src.GetPart(uint32(i)))
+			require.NoError(t, err)
+			assert.True(t, added)
+			assert.Equal(t, int(total)-i, CountBits(dst.BitArray()))
+		}
+		added, err := dst.AddPart(src.GetPart(0))
+		require.NoError(t, err)
+		assert.False(t, added)
+
+		assert.Empty(t, dst.Missing())
+		assert.Equal(t, data, dst.Data())
+	}
+}
+
+func TestPartSetRejectsInvalidParts(t *testing.T) {
+	src, err := NewPartSetFromData(testPartData(500), 100)
+	require.NoError(t, err)
+	dst, err := NewPartSetFromHeader(src.Header())
+	require.NoError(t, err)
+
+	part := src.GetPart(2)
+	tampered := &Part{Index: part.Index, Bytes: append([]byte{1}, part.Bytes[1:]...), Proof: part.Proof}
+	_, err = dst.AddPart(tampered)
+	assert.True(t, errors.Is(err, ErrInvalidPart))
+
+	moved := &Part{Index: 3, Bytes: part.Bytes, Proof: part.Proof}
+	_, err = dst.AddPart(moved)
+	assert.True(t, errors.Is(err, ErrInvalidPart))
+
+	short := &Part{Index: part.Index, Bytes: part.Bytes, Proof: part.Proof[1:]}
+	_, err = dst.AddPart(short)
+	assert.True(t, errors.Is(err, ErrInvalidPart))
+
+	assert.Equal(t, []uint32{0, 1, 2, 3, 4}, dst.Missing())
+
+	_, err = NewPartSetFromHeader(PartSetHeader{Total: MaxParts + 1})
+	assert.True(t, errors.Is(err, ErrInvalidPartSize))
+}
@@ -0,0 +1,103 @@
+package consensus
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// With proposer-based timestamps (PBTS), enabled from
+// ConsensusParams.PBTSEnableHeight, the time of a block is the clock of its
+// proposer instead of the median of the precommit times of the last commit,
+// which the proposer picks among. Validators only prevote a block proposed
+// for the first time (POLRound -1) if they received it timely: no earlier
+// than its time minus the clock precision, and no later than its time plus
+// the message delay and the precision. A proposer with a skewed clock, or
+// one manipulating the time of its blocks, gets nil prevotes; a re-proposed
+// block already got the prevotes of +2/3, which checked its time.
+
+const (
+	// DefaultSynchronyPrecision bounds the clock differences between the
+	// validators.
+	DefaultSynchronyPrecision = 505 * time.Millisecond
+	// DefaultSynchronyMessageDelay bounds the time a proposal takes to
+	// reach the validators in round 0.
+	DefaultSynchronyMessageDelay = 15 * time.Second
+)
+
+var ErrUntimelyProposal = errors.New("proposal not timely")
+
+var consensusUntimelyProposals = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "consensus_untimely_proposals_total",
+		Help: "Total number of proposals prevoted nil as received too early or too late for their block time",
+	})
+
+// PBTSEnabled tells whether the blocks of height use proposer-based
+// timestamps.
+func (p ConsensusParams) PBTSEnabled(height uint64) bool {
+	return p.PBTSEnableHeight != 0 && height >= p.PBTSEnableHeight
+}
+
+// SynchronyPrecision is the PBTS clock precision.
+func (p ConsensusParams) SynchronyPrecision() time.Duration {
+	if p.SynchronyPrecisionMs == 0 {
+		return DefaultSynchronyPrecision
+	}
+	return time.Duration(p.SynchronyPrecisionMs) * time.Millisecond
+}
+
+// SynchronyMessageDelay is the PBTS message delay of round. It grows by 10%
+// every round, so that a network slower than the params expect still
+// decides in a later round.
+func (p ConsensusParams) SynchronyMessageDelay(round int32) time.Duration {
+	delay := DefaultSynchronyMessageDelay
+	if p.SynchronyMessageDelayMs != 0 {
+		delay = time.Duration(p.SynchronyMessageDelayMs) * time.Millisecond
+	}
+	if round <= 0 {
+		return delay
+	}
+	grown := float64(delay) * math.Pow(1.1, float64(round))
+	if grown >= math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(grown)
+}
+
+// proposerBlockTime is the time of a block proposed at nowMs with PBTS: the
+// proposer clock, but after the last block.
+func proposerBlockTime(lastBlockTimeMs uint64, nowMs int64) uint64 {
+	if nowMs <= 0 || uint64(nowMs) <= lastBlockTimeMs {
+		return lastBlockTimeMs + 1
+	}
+	return uint64(nowMs)
+}
+
+// isTimely tells whether a block of time blockTimeMs received at receiveTime
+// is timely for precision and msgDelay.
+func isTimely(blockTimeMs uint64, receiveTime time.Time, precision, msgDelay time.Duration) bool {
+	blockTime := time.UnixMilli(int64(blockTimeMs))
+	return !receiveTime.Before(blockTime.Add(-precision)) &&
+		!receiveTime.After(blockTime.Add(msgDelay).Add(precision))
+}
+
+// checkProposalTimely checks that the proposal of the round state can be
+// prevoted as far as its time is concerned.
+func (cs *ConsensusState) checkProposalTimely() error {
+	params := cs.chainState.ConsensusParams
+	if !params.PBTSEnabled(cs.Height) || cs.Proposal == nil || cs.Proposal.POLRound != -1 {
+		return nil
+	}
+	precision, msgDelay := params.SynchronyPrecision(), params.SynchronyMessageDelay(cs.Proposal.Round)
+	blockTimeMs := cs.ProposalBlock.TimeMs()
+	if isTimely(blockTimeMs, cs.ProposalReceiveTime, precision, msgDelay) {
+		return nil
+	}
+	consensusUntimelyProposals.Inc()
+	return fmt.Errorf("%w: block time %v received at %v, precision %v, message delay %v", ErrUntimelyProposal,
+		time.UnixMilli(int64(blockTimeMs)).UTC(), cs.ProposalReceiveTime, precision, msgDelay)
+}
@@ -0,0 +1,160 @@
+package consensus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/QuarkChain/go-minimal-pbft/internal/testhook"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProposalTimely(t *testing.T) {
+	blockTime := time.UnixMilli(1_000_000)
+	precision, delay := 500*time.Millisecond, 2*time.Second
+
+	assert.True(t, isTimely(1_000_000, blockTime, precision, delay))
+	assert.True(t, isTimely(1_000_000, blockTime.Add(-precision), precision, delay))
+	assert.True(t, isTimely(1_000_000, blockTime.Add(delay+precision), precision, delay))
+	// proposer clock ahead
+	assert.False(t, isTimely(1_000_000, blockTime.Add(-precision-time.Millisecond), precision, delay))
+	// too late, or back dated
+	assert.False(t, isTimely(1_000_000, blockTime.Add(delay+precision+time.Millisecond), precision, delay))
+}
+
+func TestPBTSParams(t *testing.T) {
+	assert.False(t, ConsensusParams{}.PBTSEnabled(100))
+	p := ConsensusParams{PBTSEnableHeight: 10, SynchronyMessageDelayMs: 1000}
+	assert.False(t, p.PBTSEnabled(9))
+	assert.True(t, p.PBTSEnabled(10))
+
+	assert.Equal(t, DefaultSynchronyPrecision, p.SynchronyPrecision())
+	assert.Equal(t, time.Second, p.SynchronyMessageDelay(0))
+	assert.Equal(t, 1100*time.Millisecond, p.SynchronyMessageDelay(1))
+	assert.Equal(t, time.Duration(1<<63-1), p.SynchronyMessageDelay(1<<30))
+
+	assert.Equal(t, uint64(1001), proposerBlockTime(1000, 1001))
+	// clock behind the last block
+	assert.Equal(t, uint64(1001), proposerBlockTime(1000, 900))
+
+	assert.ErrorIs(t, ValidateConsensusParams(ConsensusParams{SynchronyPrecisionMs: MaxSynchronyBoundMs + 1}), ErrInvalidConsensusParams)
+	assert.NoError(t, ValidateConsensusParamsUpdate(10, ConsensusParams{}, ConsensusParams{PBTSEnableHeight: 20}))
+	assert.ErrorIs(t, ValidateConsensusParamsUpdate(10, ConsensusParams{}, ConsensusParams{PBTSEnableHeight: 11}), ErrInvalidConsensusParams)
+	assert.ErrorIs(t, ValidateConsensusParamsUpdate(20, p, ConsensusParams{}), ErrInvalidConsensusParams)
+	// not enabled yet
+	assert.NoError(t, ValidateConsensusParamsUpdate(5, p, ConsensusParams{}))
+}
+
+// newPBTSTest returns a stateTest at height 2, in a round it does not
+// propose, with proposer-based timestamps from height 2 if enabled. Its
+// clock is the fake clock.
+func newPBTSTest(t *testing.T, clock *testhook.FakeClock, enabled bool) *stateTest {
+	st := newStateTest(t, 4, nil)
+	st.cs.chainState.ConsensusParams = ConsensusParams{SynchronyPrecisionMs: 100, SynchronyMessageDelayMs: 500}
+	if enabled {
+		st.cs.chainState.ConsensusParams.PBTSEnableHeight = 2
+	}
+	st.commit()
+	require.Equal(t, uint64(2), st.cs.Height)
+	require.Equal(t, enabled, st.cs.chainState.ConsensusParams.PBTSEnabled(2))
+
+	st.startRound()
+	if round := st.nextOtherRound(); round != st.cs.Round {
+		st.cs.enterNewRound(st.ctx, st.cs.Height, round)
+		st.flush()
+	}
+	return st
+}
+
+// makeBlockAt makes the block of the proposer of round with the clock
+// offset, as if the clock of the proposer was off or the block was old.
+func makeBlockAt(st *stateTest, clock *testhook.FakeClock, round int32, offset time.Duration) *FullBlock {
+	params := st.cs.chainState.ConsensusParams
+	defer func() { st.cs.chainState.ConsensusParams = params }()
+	// the time of the block is the clock of the proposer, see MakeBlock
+	st.cs.chainState.ConsensusParams.PBTSEnableHeight = st.cs.Height
+
+	clock.Advance(offset)
+	defer clock.Advance(-offset)
+	return st.makeBlock(st.proposerIndex(round))
+}
+
+func TestPrevoteProposalTimely(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		offset   time.Duration
+		prevoted bool
+	}{
+		{name: "timely", offset: 50 * time.Millisecond, prevoted: true},
+		{name: "early", offset: time.Second},
+		{name: "late", offset: -800 * time.Millisecond},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := testhook.NewFakeClock(time.Now())
+			testhook.SetClock(clock)
+			defer testhook.Reset()
+
+			st := newPBTSTest(t, clock, true)
+			round := st.cs.Round
+			block := makeBlockAt(st, clock, round, tc.offset)
+			// the block time is not the median time of the last commit,
+			// which only PBTS lets validateBlock accept
+			require.NotEqual(t, MedianTime(block.LastCommit, st.cs.chainState.LastValidators), block.TimeMs())
+
+			st.propose(round, -1, block, 0)
+			prevote := st.ownVote(PrevoteType, round)
+			require.NotNil(t, prevote)
+			if tc.prevoted {
+				assert.Equal(t, block.Hash(), prevote.BlockID)
+			} else {
+				assert.Equal(t, common.Hash{}, prevote.BlockID)
+			}
+		})
+	}
+}
+
+func TestPrevoteProposalTimeWithoutPBTS(t *testing.T) {
+	clock := testhook.NewFakeClock(time.Now())
+	testhook.SetClock(clock)
+	defer testhook.Reset()
+
+	// a timely block, but the time of its proposer instead of the median
+	st := newPBTSTest(t, clock, false)
+	round := st.cs.Round
+	block := makeBlockAt(st, clock, round, 50*time.Millisecond)
+	require.NotEqual(t, MedianTime(block.LastCommit, st.cs.chainState.LastValidators), block.TimeMs())
+
+	st.propose(round, -1, block, 0)
+	prevote := st.ownVote(PrevoteType, round)
+	require.NotNil(t, prevote)
+	assert.Equal(t, common.Hash{}, prevote.BlockID)
+}
+
+func TestPrevoteReproposalUntimely(t *testing.T) {
+	clock := testhook.NewFakeClock(time.Now())
+	testhook.SetClock(clock)
+	defer testhook.Reset()
+
+	st := newPBTSTest(t, clock, true)
+	polRound := st.cs.Round
+	block := makeBlockAt(st, clock, polRound, time.Second)
+
+	// the others prevoted the block in polRound, cs did not get it in time
+	st.vote(PrevoteType, polRound, block.Hash(), st.others()...)
+	require.Nil(t, st.cs.LockedBlock)
+
+	st.cs.enterNewRound(st.ctx, st.cs.Height, polRound+1)
+	st.flush()
+	round := st.nextOtherRound()
+	if round != st.cs.Round {
+		st.cs.enterNewRound(st.ctx, st.cs.Height, round)
+		st.flush()
+	}
+
+	// re-proposed, the +2/3 prevotes checked its time already
+	st.propose(round, polRound, block, 0)
+	prevote := st.ownVote(PrevoteType, round)
+	require.NotNil(t, prevote)
+	assert.Equal(t, block.Hash(), prevote.BlockID)
+}
@@ -0,0 +1,50 @@
+package consensus
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+)
+
+// PrivValidatorEd25519 is a local validator signing with an ed25519 key.
+type PrivValidatorEd25519 struct {
+	PrivKey ed25519.PrivateKey
+}
+
+// generate a local ed25519 priv validator with random key.
+func GeneratePrivValidatorEd25519() PrivValidator {
+	_, pk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic("failed to generate key")
+	}
+
+	return &PrivValidatorEd25519{PrivKey: pk}
+}
+
+// NewPrivValidatorEd25519 creates the validator from a 32-byte seed.
+func NewPrivValidatorEd25519(seed []byte) (*PrivValidatorEd25519, error) {
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.New("invalid ed25519 seed size")
+	}
+	return &PrivValidatorEd25519{PrivKey: ed25519.NewKeyFromSeed(seed)}, nil
+}
+
+func (pv *PrivValidatorEd25519) GetPubKey(context.Context) (PubKey, error) {
+	return NewEd25519PubKey(pv.PrivKey.Public().(ed25519.PublicKey)), nil
+}
+
+func (pv *PrivValidatorEd25519) SignVote(ctx context.Context, chainId string, vote *Vote) error {
+	vote.TimestampMs = uint64(CanonicalNowMs())
+	vote.Signature = ed25519.Sign(pv.PrivKey, vote.VoteSignBytes(chainId))
+	return nil
+}
+
+func (pv *PrivValidatorEd25519) SignProposal(ctx context.Context, chainID string, proposal *Proposal) error {
+	proposal.Signature = ed25519.Sign(pv.PrivKey, proposal.ProposalSignBytes(chainID))
+	return nil
+}
+
+func (pv *PrivValidatorEd25519) SignBytes(msg []byte) ([]byte, error) {
+	return ed25519.Sign(pv.PrivKey, msg), nil
+}
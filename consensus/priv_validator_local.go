@@ -76,6 +76,11 @@ func (pv *PrivValidatorLocal) SignVote(ctx context.Context, chainId string, vote
 	return err
 }
 
+func (pv *PrivValidatorLocal) SignBytes(msg []byte) ([]byte, error) {
+	h := crypto.Keccak256Hash(msg)
+	return crypto.Sign(h[:], pv.PrivKey)
+}
+
 func (pv *PrivValidatorLocal) SignProposal(ctx context.Context, chainID string, proposal *Proposal) error {
 	// TODO: sanity check
 	b := proposal.ProposalSignBytes(chainID)
@@ -0,0 +1,91 @@
+package consensus
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// A proposal announced by the part set of its encoding, see the p2p package,
+// is only seen once its parts are fetched. The Proposal of the chain types
+// cannot carry the header of the part set, so the proposer signs the header
+// along with the height, round and block of the proposal, and peers only
+// track and fetch the part sets signed by the proposer of their round, at the
+// current height or the next one.
+
+var ErrInvalidProposalParts = errors.New("invalid proposal parts")
+
+// prefix of the proposal parts sign bytes, so a signature of them can never
+// be valid for a vote or a proposal
+var proposalPartsSignPrefix = []byte("mpbft/proposal_parts")
+
+// ProposalPartsSignBytes returns the bytes the proposer of round at height
+// signs to announce its proposal of blockID by the part set parts.
+func ProposalPartsSignBytes(chainID string, height uint64, round int32, blockID common.Hash, parts PartSetHeader) []byte {
+	b, err := rlp.EncodeToBytes([]interface{}{
+		chainID, height, uint32(round), blockID, parts.Total, parts.Root,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return append(append([]byte{}, proposalPartsSignPrefix...), b...)
+}
+
+// ProposerAt returns the proposer of round at the current height, from the
+// current round on, or at the next height, nil otherwise. The proposers of the
+// next height are known before it is committed, but for the validators the
+// commit jails or releases.
+func (cs *ConsensusState) ProposerAt(height uint64, round int32) *Validator {
+	cs.mtx.RLock()
+	defer cs.mtx.RUnlock()
+	return cs.proposerAt(height, round)
+}
+
+func (cs *ConsensusState) proposerAt(height uint64, round int32) *Validator {
+	switch {
+	case height == cs.Height && round >= cs.Round && cs.Validators != nil:
+		vals := roundValidators(cs.Validators, cs.Round, round)
+		return cs.proposerSelector.Proposer(vals, height, round, cs.chainState.Jailed)
+	case height == cs.Height+1 && round >= 0 && cs.chainState.NextValidators != nil:
+		vals := roundValidators(cs.chainState.NextValidators, 0, round)
+		return cs.proposerSelector.Proposer(vals, height, round, cs.chainState.Jailed)
+	}
+	return nil
+}
+
+// SignProposalParts signs the part set of our proposal of blockID at height
+// and round. It fails if we are not the proposer of the round, or the priv
+// validator cannot sign arbitrary messages, see BytesSigner, in which case
+// the proposal is to be sent whole.
+func (cs *ConsensusState) SignProposalParts(height uint64, round int32, blockID common.Hash, parts PartSetHeader) ([]byte, error) {
+	cs.mtx.RLock()
+	defer cs.mtx.RUnlock()
+
+	signer, ok := cs.privValidator.(BytesSigner)
+	if !ok || cs.privValidatorPubKey == nil {
+		return nil, errors.New("priv validator cannot sign proposal parts")
+	}
+	proposer := cs.proposerAt(height, round)
+	if proposer == nil || proposer.Address != cs.privValidatorPubKey.Address() {
+		return nil, fmt.Errorf("not the proposer of height %d round %d", height, round)
+	}
+	return signer.SignBytes(ProposalPartsSignBytes(cs.chainState.ChainID, height, round, blockID, parts))
+}
+
+// VerifyProposalParts checks that the part set of a proposal of blockID at
+// height and round was signed by the proposer of the round, see ProposerAt.
+func (cs *ConsensusState) VerifyProposalParts(height uint64, round int32, blockID common.Hash, parts PartSetHeader, sig []byte) error {
+	cs.mtx.RLock()
+	defer cs.mtx.RUnlock()
+
+	proposer := cs.proposerAt(height, round)
+	if proposer == nil {
+		return fmt.Errorf("%w: height %d round %d, at %d/%d", ErrInvalidProposalParts, height, round, cs.Height, cs.Round)
+	}
+	if !proposer.PubKey.VerifySignature(ProposalPartsSignBytes(cs.chainState.ChainID, height, round, blockID, parts), sig) {
+		return fmt.Errorf("%w: not signed by proposer %v", ErrInvalidProposalParts, proposer.Address)
+	}
+	return nil
+}
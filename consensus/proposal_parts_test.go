@@ -0,0 +1,67 @@
+package consensus
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProposalParts(t *testing.T) {
+	pvs := make(map[common.Address]PrivValidator)
+	addrs := make([]common.Address, 4)
+	for i := range addrs {
+		pv := GeneratePrivValidatorLocal()
+		pubKey, err := pv.GetPubKey(context.Background())
+		require.NoError(t, err)
+		addrs[i] = pubKey.Address()
+		pvs[addrs[i]] = pv
+	}
+	state := *MakeGenesisChainState("test", 1000, addrs, []int64{1, 2, 3, 4}, 100, 1)
+	cs := &ConsensusState{chainState: state, proposerSelector: WeightedProposerSelector{}}
+	cs.Height, cs.Round, cs.Validators = 1, 1, state.Validators
+	parts := PartSetHeader{Total: 2, Root: common.Hash{1}}
+
+	useProposerOf := func(height uint64, round int32) {
+		proposer := cs.ProposerAt(height, round)
+		require.NotNil(t, proposer)
+		cs.privValidator = pvs[proposer.Address]
+		cs.privValidatorPubKey, _ = cs.privValidator.GetPubKey(context.Background())
+	}
+
+	for _, hr := range []struct {
+		height uint64
+		round  int32
+	}{{1, 1}, {1, 3}, {2, 0}, {2, 2}} {
+		useProposerOf(hr.height, hr.round)
+		sig, err := cs.SignProposalParts(hr.height, hr.round, common.Hash{2}, parts)
+		require.NoError(t, err)
+		assert.NoError(t, cs.VerifyProposalParts(hr.height, hr.round, common.Hash{2}, parts, sig))
+		// bound to the block and the parts
+		err = cs.VerifyProposalParts(hr.height, hr.round, common.Hash{3}, parts, sig)
+		assert.True(t, errors.Is(err, ErrInvalidProposalParts))
+		err = cs.VerifyProposalParts(hr.height, hr.round, common.Hash{2}, PartSetHeader{Total: 2, Root: common.Hash{9}}, sig)
+		assert.True(t, errors.Is(err, ErrInvalidProposalParts))
+	}
+
+	// past rounds and far heights have no proposer
+	assert.Nil(t, cs.ProposerAt(1, 0))
+	assert.Nil(t, cs.ProposerAt(3, 0))
+	assert.Nil(t, cs.ProposerAt(0, 0))
+
+	// only the proposer signs
+	useProposerOf(1, 1)
+	for _, addr := range addrs {
+		if addr == cs.privValidatorPubKey.Address() {
+			continue
+		}
+		cs.privValidator = pvs[addr]
+		cs.privValidatorPubKey, _ = cs.privValidator.GetPubKey(context.Background())
+		break
+	}
+	_, err := cs.SignProposalParts(1, 1, common.Hash{2}, parts)
+	assert.Error(t, err)
+}
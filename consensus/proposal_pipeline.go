@@ -0,0 +1,122 @@
+package consensus
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The proposer of a height reaps its txs once the previous block is applied,
+// as the mempool drops the committed txs and rechecks the others then. With
+// PipelineProposals, the proposer of round 0 of the next height, known from
+// the NextValidators before the block is applied, starts reaping them when it
+// finalizes the commit, leaving out the txs of the block, while the block is
+// applied. The proposal takes them if they are all still pending and fit the
+// block, and reaps again otherwise. The txs arriving in the meantime wait for
+// the next block.
+
+var consensusPipelinedProposals = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "consensus_pipelined_proposals_total",
+		Help: "Total number of proposals whose txs were reaped while the previous block was applied, by result: reused, stale, or discarded",
+	}, []string{"result"})
+
+// ProposalPipeliner is implemented by the block executors able to prepare a
+// proposal while the previous block is applied, see DefaultBlockExecutor.
+type ProposalPipeliner interface {
+	// PrepareProposal starts reaping the txs of a proposal of the height
+	// after block, by proposer with commit as last commit, while block is
+	// applied on top of state. The txs of block are left out.
+	PrepareProposal(state ChainState, block *FullBlock, commit *Commit, proposer common.Address)
+}
+
+type preparedTxs struct {
+	height uint64
+	done   chan struct{}
+	txs    types.Transactions
+}
+
+// PipelineProposals sets whether to reap the txs of our proposal of the next
+// height while the block is applied, off by default.
+func PipelineProposals(enabled bool) StateOption {
+	return func(cs *ConsensusState) {
+		cs.pipelineProposals = enabled
+	}
+}
+
+// PrepareProposal reaps the txs from the mempool, if any, in the background,
+// instead of the ones prepared so far.
+func (be *DefaultBlockExecutor) PrepareProposal(state ChainState, block *FullBlock, commit *Commit, proposer common.Address) {
+	if be.mempool == nil {
+		return
+	}
+	height := block.NumberU64() + 1
+	// the header of the proposal depends on the state after block, but has
+	// the same size
+	maxBytes, maxGas, ok := txLimits(&state, state.MakeBlock(height, commit, proposer))
+	if !ok {
+		return
+	}
+
+	prep := &preparedTxs{height: height, done: make(chan struct{})}
+	be.prepMu.Lock()
+	if be.prepared != nil {
+		consensusPipelinedProposals.WithLabelValues("discarded").Inc()
+	}
+	be.prepared = prep
+	be.prepMu.Unlock()
+
+	log.Debug("reaping txs of the next proposal", "height", height)
+	committed := block.Transactions()
+	go func() {
+		defer close(prep.done)
+		prep.txs = be.mempool.ReapExcluding(maxBytes, maxGas, committed)
+	}()
+}
+
+// preparedTxs returns the txs prepared for a proposal at height, if they are
+// all still pending and within maxBytes and maxGas, 0 for no limit.
+func (be *DefaultBlockExecutor) preparedTxs(height uint64, maxBytes, maxGas uint64) (types.Transactions, bool) {
+	be.prepMu.Lock()
+	prep := be.prepared
+	be.prepared = nil
+	be.prepMu.Unlock()
+	if prep == nil {
+		return nil, false
+	}
+	if prep.height != height {
+		consensusPipelinedProposals.WithLabelValues("discarded").Inc()
+		return nil, false
+	}
+
+	<-prep.done
+	bytes, gas := uint64(0), uint64(0)
+	for _, tx := range prep.txs {
+		bytes += uint64(tx.Size())
+		gas += tx.Gas()
+	}
+	if (maxBytes != 0 && bytes > maxBytes) || (maxGas != 0 && gas > maxGas) || !be.mempool.Pending(prep.txs) {
+		log.Debug("txs reaped ahead are stale, reaping again", "height", height)
+		consensusPipelinedProposals.WithLabelValues("stale").Inc()
+		return nil, false
+	}
+	consensusPipelinedProposals.WithLabelValues("reused").Inc()
+	return prep.txs, true
+}
+
+// prepareNextProposal starts reaping the txs of our proposal of the next
+// height, if we are the proposer of its round 0, while block is applied.
+func (cs *ConsensusState) prepareNextProposal(block *FullBlock) {
+	pipeliner, ok := cs.blockExec.(ProposalPipeliner)
+	if !ok || !cs.pipelineProposals || cs.replayMode || cs.privValidatorPubKey == nil {
+		return
+	}
+	// the validators of the next height do not depend on block, the jailed
+	// ones may: we then reap for nothing, or miss the chance to
+	addr := cs.privValidatorPubKey.Address()
+	if cs.proposerSelector.Proposer(cs.chainState.NextValidators, cs.Height+1, 0, cs.chainState.Jailed).Address != addr {
+		return
+	}
+	pipeliner.PrepareProposal(cs.chainState, block, cs.Votes.Precommits(cs.CommitRound).MakeCommit(), addr)
+}
@@ -0,0 +1,96 @@
+package consensus
+
+import (
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// pipelineMempool reaps its pending txs in order.
+type pipelineMempool struct {
+	Mempool
+	mu      sync.Mutex
+	pending types.Transactions
+	reaps   int
+}
+
+func (mp *pipelineMempool) Reap(maxBytes, maxGas uint64) types.Transactions {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.reaps++
+	return append(types.Transactions(nil), mp.pending...)
+}
+
+func (mp *pipelineMempool) ReapExcluding(maxBytes, maxGas uint64, exclude types.Transactions) types.Transactions {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return types.TxDifference(mp.pending, exclude)
+}
+
+func (mp *pipelineMempool) Pending(txs types.Transactions) bool {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	return len(types.TxDifference(txs, mp.pending)) == 0
+}
+
+func (mp *pipelineMempool) remove(txs ...*types.Transaction) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	mp.pending = types.TxDifference(mp.pending, txs)
+}
+
+func TestPipelinedProposal(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	require.NoError(t, err)
+	committed, next, later := types.NewTx(&types.LegacyTx{Nonce: 1, Gas: 1}), types.NewTx(&types.LegacyTx{Nonce: 2, Gas: 1}), types.NewTx(&types.LegacyTx{Nonce: 3, Gas: 1})
+	mp := &pipelineMempool{pending: types.Transactions{committed, next, later}}
+	be := NewDefaultBlockExecutor(db, WithMempool(mp)).(*DefaultBlockExecutor)
+
+	state := *MakeGenesisChainState("test", 1000, []common.Address{{1}}, []int64{1}, 100, 1)
+	commit := NewCommit(0, 0, common.Hash{}, nil)
+	block := func(height uint64) *FullBlock {
+		return &FullBlock{Block: types.NewBlock(
+			&Header{Number: big.NewInt(int64(height)), Coinbase: common.Address{1}, Difficulty: big.NewInt(1), BaseFee: big.NewInt(0)},
+			types.Transactions{committed}, nil, nil, trie.NewStackTrie(nil))}
+	}
+	// prepares the proposal after the block of height, and applies the block
+	prepare := func(height uint64) {
+		be.PrepareProposal(state, block(height), commit, common.Address{1})
+		<-be.prepared.done
+		mp.remove(committed)
+	}
+
+	prepare(0)
+	assert.Equal(t, types.Transactions{next, later}, be.MakeBlock(&state, 1, commit, common.Address{1}).Transactions())
+	assert.Equal(t, 0, mp.reaps)
+	assert.Nil(t, be.prepared)
+
+	// dropped after the block
+	mp.pending = types.Transactions{committed, next, later}
+	be.PrepareProposal(state, block(0), commit, common.Address{1})
+	<-be.prepared.done
+	mp.remove(committed, next)
+	assert.Equal(t, types.Transactions{later}, be.MakeBlock(&state, 1, commit, common.Address{1}).Transactions())
+	assert.Equal(t, 1, mp.reaps)
+
+	// no longer fitting the block
+	mp.pending = types.Transactions{committed, next, later}
+	prepare(0)
+	state.ConsensusParams.MaxGas = 1
+	be.MakeBlock(&state, 1, commit, common.Address{1})
+	assert.Equal(t, 2, mp.reaps)
+	state.ConsensusParams.MaxGas = 0
+
+	// of another height
+	prepare(1)
+	be.MakeBlock(&state, 1, commit, common.Address{1})
+	assert.Equal(t, 3, mp.reaps)
+}
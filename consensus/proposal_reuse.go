@@ -0,0 +1,28 @@
+package consensus
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A round re-proposing the valid block sends a block we may already hold:
+// the parts received in the earlier rounds are resumed by the p2p package,
+// see p2p.MsgProposalParts, and a proposal of a block held as the valid or
+// locked one keeps using the held block; count them.
+var consensusProposalKnownBlocks = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "consensus_proposal_known_block_total",
+		Help: "Total number of proposals carrying a block already held as the valid or locked block",
+	}, []string{"held"})
+
+// heldBlock returns the valid or locked block with the hash, if any. The
+// caller must hold cs.mtx.
+func (cs *ConsensusState) heldBlock(hash common.Hash) (*FullBlock, string) {
+	if cs.ValidBlock != nil && cs.ValidBlock.Hash() == hash {
+		return cs.ValidBlock, "valid"
+	}
+	if cs.LockedBlock != nil && cs.LockedBlock.Hash() == hash {
+		return cs.LockedBlock, "locked"
+	}
+	return nil, ""
+}
@@ -0,0 +1,68 @@
+package consensus
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ProposerSelector picks the proposer of a round. It must be deterministic:
+// every validator of the network must use the same selector, or they will
+// not agree on who may propose.
+//
+// vals is the validator set of the round, with the proposer priorities
+// accumulated up to it: IncrementProposerPriority is applied once per height
+// (see updateState) and ProposerReptition times per round (see
+// enterNewRound). Jailed validators must be skipped.
+type ProposerSelector interface {
+	Proposer(vals *ValidatorSet, height uint64, round int32, jailed []common.Address) *Validator
+}
+
+// WeightedProposerSelector is the default selector, the Tendermint proposer
+// election: on every increment, the priority of each validator grows by its
+// voting power, and the validator with the highest priority proposes, its
+// priority then being decreased by the total voting power. Validators thus
+// propose in proportion to their voting power, in a deterministic order that
+// does not depend on the round robin of the validator indexes.
+type WeightedProposerSelector struct{}
+
+func (WeightedProposerSelector) Proposer(vals *ValidatorSet, height uint64, round int32, jailed []common.Address) *Validator {
+	return ProposerSkippingJailed(vals, jailed)
+}
+
+// RoundRobinProposerSelector ignores the voting powers: the validators
+// propose in turn, in validator set order, one height or round each.
+type RoundRobinProposerSelector struct{}
+
+func (RoundRobinProposerSelector) Proposer(vals *ValidatorSet, height uint64, round int32, jailed []common.Address) *Validator {
+	n := uint64(vals.Size())
+	start := (height + uint64(round)) % n
+	for i := uint64(0); i < n; i++ {
+		_, val := vals.GetByIndex(int32((start + i) % n))
+		if !isJailed(jailed, val.Address) {
+			return val
+		}
+	}
+	// cannot happen, applyJailUpdates keeps one validator out of jail
+	_, val := vals.GetByIndex(int32(start))
+	return val
+}
+
+// roundValidators returns vals, the validators of round from, with the
+// proposer priorities of round to, vals itself if to is not after from.
+func roundValidators(vals *ValidatorSet, from, to int32) *ValidatorSet {
+	if to <= from {
+		return vals
+	}
+	vals = vals.Copy()
+	for i := uint64(0); i < uint64(vals.ProposerReptition); i++ {
+		vals.IncrementProposerPriority(SafeSubInt32(to, from))
+	}
+	return vals
+}
+
+// SetProposerSelector replaces the WeightedProposerSelector. It must be called
+// before the consensus state starts.
+func (cs *ConsensusState) SetProposerSelector(selector ProposerSelector) {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	cs.proposerSelector = selector
+}
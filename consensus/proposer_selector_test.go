@@ -0,0 +1,37 @@
+package consensus
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoundRobinProposerSelector(t *testing.T) {
+	vals, addrs := makeTestValidators(4)
+	selector := RoundRobinProposerSelector{}
+
+	assert.Equal(t, addrs[1], selector.Proposer(vals, 1, 0, nil).Address)
+	assert.Equal(t, addrs[3], selector.Proposer(vals, 1, 2, nil).Address)
+	assert.Equal(t, addrs[0], selector.Proposer(vals, 3, 1, nil).Address)
+
+	// the next validator not jailed proposes instead
+	jailed := []common.Address{addrs[1], addrs[2]}
+	assert.Equal(t, addrs[3], selector.Proposer(vals, 1, 0, jailed).Address)
+}
+
+func TestWeightedProposerSelector(t *testing.T) {
+	vals, addrs := makeTestValidators(4)
+	selector := WeightedProposerSelector{}
+
+	// validators propose in proportion to their voting power
+	counts := make(map[common.Address]int)
+	rotation := vals.Copy()
+	for i := 0; i < 100; i++ {
+		counts[selector.Proposer(rotation, uint64(i), 0, nil).Address]++
+		rotation.IncrementProposerPriority(1)
+	}
+	for i, addr := range addrs {
+		assert.Equal(t, 10*(i+1), counts[addr])
+	}
+}
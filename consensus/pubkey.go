@@ -1,6 +1,11 @@
 package consensus
 
 import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
 )
@@ -13,6 +18,23 @@ type PubKey interface {
 	Type() string
 }
 
+// PossessionProver is implemented by the keys whose signatures aggregate.
+// Aggregates are only safe with keys proven to be held by their validator, or
+// one could add a key derived from the keys of others and forge aggregates,
+// so a validator added with such a key must prove it holds the key, see
+// ValidatorUpdate.
+type PossessionProver interface {
+	VerifyPossession(proof []byte) bool
+}
+
+const (
+	EcdsaPubKeyType   = "ECDSA_PUBKEY"
+	Ed25519PubKeyType = "ED25519_PUBKEY"
+
+	// prefix of an ed25519 validator in the validator set flags, e.g., ed25519:<hex>
+	ed25519KeyPrefix = "ed25519:"
+)
+
 type EcdsaPubKey struct {
 	address common.Address
 }
@@ -22,7 +44,7 @@ func NewEcdsaPubKey(addr common.Address) PubKey {
 }
 
 func (pubkey *EcdsaPubKey) Type() string {
-	return "ECDSA_PUBKEY"
+	return EcdsaPubKeyType
 }
 
 func (pubkey *EcdsaPubKey) Address() common.Address {
@@ -44,3 +66,80 @@ func (pubkey *EcdsaPubKey) VerifySignature(msg []byte, sig []byte) bool {
 	addr := pubKeyToAddress(pub)
 	return addr == pubkey.address
 }
+
+// String returns the hex address, which is how ECDSA validators are given to
+// ParsePubKey.
+func (pubkey *EcdsaPubKey) String() string {
+	return pubkey.address.Hex()
+}
+
+// Ed25519PubKey is a validator key signing the raw sign bytes with ed25519.
+// Unlike ECDSA, the key cannot be recovered from a signature, so the full key
+// must be known to verifiers (see SetValidatorPubKeys).
+type Ed25519PubKey struct {
+	key ed25519.PublicKey
+}
+
+func NewEd25519PubKey(key ed25519.PublicKey) PubKey {
+	return &Ed25519PubKey{key: key}
+}
+
+func (pubkey *Ed25519PubKey) Type() string {
+	return Ed25519PubKeyType
+}
+
+// Address returns the last 20 bytes of the keccak256 of the key, the same
+// derivation as ECDSA addresses.
+func (pubkey *Ed25519PubKey) Address() common.Address {
+	return common.BytesToAddress(crypto.Keccak256(pubkey.key)[12:])
+}
+
+func (pubkey *Ed25519PubKey) Bytes() []byte {
+	return pubkey.key
+}
+
+func (pubkey *Ed25519PubKey) VerifySignature(msg []byte, sig []byte) bool {
+	if len(sig) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(pubkey.key, msg, sig)
+}
+
+func (pubkey *Ed25519PubKey) String() string {
+	return ed25519KeyPrefix + hex.EncodeToString(pubkey.key)
+}
+
+// pubKeyDecoders decode the raw keys given as "<prefix><hex public key>".
+// Optional key types (e.g. behind build tags) add themselves in init.
+var pubKeyDecoders = map[string]func(key []byte) (PubKey, error){
+	ed25519KeyPrefix: decodeEd25519PubKey,
+}
+
+func decodeEd25519PubKey(key []byte) (PubKey, error) {
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid ed25519 key size %d", len(key))
+	}
+	return NewEd25519PubKey(key), nil
+}
+
+// ParsePubKey parses a validator key as given on the command line: either
+// a hex address of a ECDSA validator, or "<prefix><hex public key>", e.g.,
+// "ed25519:<hex public key>".
+func ParsePubKey(s string) (PubKey, error) {
+	for prefix, decode := range pubKeyDecoders {
+		if !strings.HasPrefix(s, prefix) {
+			continue
+		}
+
+		key, err := hex.DecodeString(strings.TrimPrefix(s, prefix))
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", s, err)
+		}
+		return decode(key)
+	}
+
+	if !common.IsHexAddress(s) {
+		return nil, fmt.Errorf("invalid validator address %q", s)
+	}
+	return NewEcdsaPubKey(common.HexToAddress(s)), nil
+}
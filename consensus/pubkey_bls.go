@@ -0,0 +1,239 @@
+//go:build bls
+// +build bls
+
+package consensus
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/cloudflare/circl/ecc/bls12381"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// BLS12-381 keys sign in the minimal-signature-size setting: signatures are
+// 48-byte points of G1 and keys 96-byte points of G2. Signatures aggregate,
+// so a commit of BLS validators needs a single signature, see
+// AggregateCommit.
+//
+// Aggregating is only safe with keys proven to be held by their validator,
+// or one could forge aggregates with a key derived from the keys of others:
+// the keys of the genesis validators are proven by their signed gentx, the
+// ones added later by the proof of possession of their ValidatorUpdate, a
+// signature of the key by itself with a DST of its own, see
+// ProvePossession.
+
+const (
+	BLS12381PubKeyType = "BLS12381_PUBKEY"
+
+	bls12381KeyPrefix = "bls12381:"
+	bls12381SeedSize  = 32
+)
+
+var (
+	bls12381SignatureDST  = []byte("BLS_SIG_BLS12381G1_XMD:SHA-256_SSWU_RO_POP_")
+	bls12381PossessionDST = []byte("BLS_POP_BLS12381G1_XMD:SHA-256_SSWU_RO_POP_")
+)
+
+func init() {
+	pubKeyDecoders[bls12381KeyPrefix] = decodeBLS12381PubKey
+}
+
+type BLS12381PubKey struct {
+	key *bls12381.G2
+}
+
+func NewBLS12381PubKey(key *bls12381.G2) PubKey {
+	return &BLS12381PubKey{key: key}
+}
+
+func decodeBLS12381PubKey(key []byte) (PubKey, error) {
+	if len(key) != bls12381.G2SizeCompressed {
+		return nil, fmt.Errorf("invalid bls12381 key size %d", len(key))
+	}
+
+	pk := new(bls12381.G2)
+	if err := pk.SetBytes(key); err != nil {
+		return nil, err
+	}
+	if !pk.IsOnG2() || pk.IsIdentity() {
+		return nil, errors.New("invalid bls12381 key")
+	}
+	return NewBLS12381PubKey(pk), nil
+}
+
+func (pubkey *BLS12381PubKey) Type() string {
+	return BLS12381PubKeyType
+}
+
+// Address returns the last 20 bytes of the keccak256 of the compressed key.
+func (pubkey *BLS12381PubKey) Address() common.Address {
+	return common.BytesToAddress(crypto.Keccak256(pubkey.Bytes())[12:])
+}
+
+func (pubkey *BLS12381PubKey) Bytes() []byte {
+	return pubkey.key.BytesCompressed()
+}
+
+func (pubkey *BLS12381PubKey) VerifySignature(msg []byte, sig []byte) bool {
+	return VerifyBLS12381Aggregate([]*BLS12381PubKey{pubkey}, [][]byte{msg}, sig)
+}
+
+// VerifyPossession verifies that proof is the signature of the key by itself,
+// see ProvePossession.
+func (pubkey *BLS12381PubKey) VerifyPossession(proof []byte) bool {
+	sig, err := decodeBLS12381Signature(proof)
+	if err != nil {
+		return false
+	}
+	h := new(bls12381.G1)
+	h.Hash(pubkey.Bytes(), bls12381PossessionDST)
+	// e(sig, g2) * e(H(pk), pk)^-1 == 1
+	return bls12381.ProdPairFrac(
+		[]*bls12381.G1{sig, h},
+		[]*bls12381.G2{bls12381.G2Generator(), pubkey.key},
+		[]int{1, -1},
+	).IsIdentity()
+}
+
+func (pubkey *BLS12381PubKey) String() string {
+	return bls12381KeyPrefix + hex.EncodeToString(pubkey.Bytes())
+}
+
+func decodeBLS12381Signature(sig []byte) (*bls12381.G1, error) {
+	if len(sig) != bls12381.G1SizeCompressed {
+		return nil, fmt.Errorf("invalid bls12381 signature size %d", len(sig))
+	}
+	p := new(bls12381.G1)
+	if err := p.SetBytes(sig); err != nil {
+		return nil, err
+	}
+	if !p.IsOnG1() {
+		return nil, errors.New("invalid bls12381 signature")
+	}
+	return p, nil
+}
+
+// AggregateBLS12381Signatures adds up signatures, of the same message or not.
+func AggregateBLS12381Signatures(sigs [][]byte) ([]byte, error) {
+	if len(sigs) == 0 {
+		return nil, errors.New("no signature to aggregate")
+	}
+	agg := new(bls12381.G1)
+	agg.SetIdentity()
+	for i, sig := range sigs {
+		p, err := decodeBLS12381Signature(sig)
+		if err != nil {
+			return nil, fmt.Errorf("signature #%d: %w", i, err)
+		}
+		agg.Add(agg, p)
+	}
+	return agg.BytesCompressed(), nil
+}
+
+// VerifyBLS12381Aggregate verifies that sig aggregates the signatures of
+// msgs[i] by pubKeys[i]. It takes a single product of pairings, whose final
+// exponentiation dominates the cost.
+func VerifyBLS12381Aggregate(pubKeys []*BLS12381PubKey, msgs [][]byte, sig []byte) bool {
+	if len(pubKeys) == 0 || len(pubKeys) != len(msgs) {
+		return false
+	}
+	agg, err := decodeBLS12381Signature(sig)
+	if err != nil {
+		return false
+	}
+
+	// e(sig, g2) * prod e(H(msg_i), pk_i)^-1 == 1
+	ps := make([]*bls12381.G1, 0, len(msgs)+1)
+	qs := make([]*bls12381.G2, 0, len(msgs)+1)
+	signs := make([]int, 0, len(msgs)+1)
+	ps, qs, signs = append(ps, agg), append(qs, bls12381.G2Generator()), append(signs, 1)
+	for i, msg := range msgs {
+		h := new(bls12381.G1)
+		h.Hash(msg, bls12381SignatureDST)
+		ps, qs, signs = append(ps, h), append(qs, pubKeys[i].key), append(signs, -1)
+	}
+	return bls12381.ProdPairFrac(ps, qs, signs).IsIdentity()
+}
+
+// PrivValidatorBLS12381 is a local validator signing with a BLS12-381 key.
+type PrivValidatorBLS12381 struct {
+	Seed [bls12381SeedSize]byte
+
+	sk *bls12381.Scalar
+	pk *bls12381.G2
+}
+
+// generate a local bls12381 priv validator with random key.
+func GeneratePrivValidatorBLS12381() PrivValidator {
+	var seed [bls12381SeedSize]byte
+	if _, err := rand.Read(seed[:]); err != nil {
+		panic("failed to generate key")
+	}
+
+	pv, err := NewPrivValidatorBLS12381(seed[:])
+	if err != nil {
+		panic(err)
+	}
+	return pv
+}
+
+// NewPrivValidatorBLS12381 creates the validator from a 32-byte seed.
+func NewPrivValidatorBLS12381(seed []byte) (*PrivValidatorBLS12381, error) {
+	if len(seed) != bls12381SeedSize {
+		return nil, errors.New("invalid bls12381 seed size")
+	}
+
+	pv := &PrivValidatorBLS12381{sk: new(bls12381.Scalar), pk: new(bls12381.G2)}
+	copy(pv.Seed[:], seed)
+	// 64 bytes reduced modulo the group order, with a negligible bias
+	h := sha512.Sum512(append([]byte("mpbft/bls12381_keygen"), seed...))
+	pv.sk.SetBytes(h[:])
+	if pv.sk.IsZero() == 1 {
+		return nil, errors.New("invalid bls12381 seed")
+	}
+	pv.pk.ScalarMult(pv.sk, bls12381.G2Generator())
+	return pv, nil
+}
+
+func (pv *PrivValidatorBLS12381) GetPubKey(context.Context) (PubKey, error) {
+	return NewBLS12381PubKey(pv.pk), nil
+}
+
+func (pv *PrivValidatorBLS12381) SignVote(ctx context.Context, chainId string, vote *Vote) error {
+	vote.TimestampMs = uint64(CanonicalNowMs())
+	vote.Signature = pv.sign(vote.VoteSignBytes(chainId))
+	return nil
+}
+
+func (pv *PrivValidatorBLS12381) SignProposal(ctx context.Context, chainID string, proposal *Proposal) error {
+	proposal.Signature = pv.sign(proposal.ProposalSignBytes(chainID))
+	return nil
+}
+
+func (pv *PrivValidatorBLS12381) SignBytes(msg []byte) ([]byte, error) {
+	return pv.sign(msg), nil
+}
+
+// ProvePossession returns the proof of possession of the key, for the
+// ValidatorUpdate adding the validator.
+func (pv *PrivValidatorBLS12381) ProvePossession() []byte {
+	return pv.signWithDST(pv.pk.BytesCompressed(), bls12381PossessionDST)
+}
+
+func (pv *PrivValidatorBLS12381) sign(msg []byte) []byte {
+	return pv.signWithDST(msg, bls12381SignatureDST)
+}
+
+func (pv *PrivValidatorBLS12381) signWithDST(msg, dst []byte) []byte {
+	h := new(bls12381.G1)
+	h.Hash(msg, dst)
+	sig := new(bls12381.G1)
+	sig.ScalarMult(pv.sk, h)
+	return sig.BytesCompressed()
+}
@@ -0,0 +1,110 @@
+//go:build bls
+// +build bls
+
+package consensus
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBLS12381Aggregate(t *testing.T) {
+	var pubKeys []*BLS12381PubKey
+	var msgs, sigs [][]byte
+	for i := 0; i < 4; i++ {
+		pv := GeneratePrivValidatorBLS12381().(*PrivValidatorBLS12381)
+		key, err := pv.GetPubKey(context.Background())
+		assert.NoError(t, err)
+		pk := key.(*BLS12381PubKey)
+
+		msg := []byte{byte(i)}
+		sig, err := pv.SignBytes(msg)
+		assert.NoError(t, err)
+		assert.True(t, pk.VerifySignature(msg, sig))
+		assert.False(t, pk.VerifySignature([]byte{0xff}, sig))
+
+		decoded, err := ParsePubKey(pk.String())
+		assert.NoError(t, err)
+		assert.Equal(t, pk.Bytes(), decoded.(*BLS12381PubKey).Bytes())
+
+		pubKeys = append(pubKeys, pk)
+		msgs = append(msgs, msg)
+		sigs = append(sigs, sig)
+	}
+
+	agg, err := AggregateBLS12381Signatures(sigs)
+	assert.NoError(t, err)
+	assert.True(t, VerifyBLS12381Aggregate(pubKeys, msgs, agg))
+	assert.False(t, VerifyBLS12381Aggregate(pubKeys[1:], msgs[1:], agg))
+	msgs[0], msgs[1] = msgs[1], msgs[0]
+	assert.False(t, VerifyBLS12381Aggregate(pubKeys, msgs, agg))
+}
+
+func TestBLS12381ValidatorUpdatePossession(t *testing.T) {
+	vals, _ := makeTestValidators(3)
+	pv := GeneratePrivValidatorBLS12381().(*PrivValidatorBLS12381)
+	key, err := pv.GetPubKey(context.Background())
+	assert.NoError(t, err)
+	pubKey := key.(*BLS12381PubKey)
+	other := GeneratePrivValidatorBLS12381().(*PrivValidatorBLS12381)
+
+	// the signature of the key with the vote DST is no proof
+	for _, proof := range [][]byte{nil, other.ProvePossession(), pv.sign(pubKey.Bytes())} {
+		_, _, _, err := applyValidatorUpdates(vals, []ValidatorUpdate{{PubKey: pubKey.String(), Power: 1, ProofOfPossession: proof}})
+		assert.ErrorIs(t, err, ErrInvalidValidatorUpdate)
+	}
+
+	addrs, _, _, err := applyValidatorUpdates(vals, []ValidatorUpdate{{PubKey: pubKey.String(), Power: 1, ProofOfPossession: pv.ProvePossession()}})
+	assert.NoError(t, err)
+	assert.Contains(t, addrs, pubKey.Address())
+}
+
+func TestVerifyAggregateCommit(t *testing.T) {
+	blockHash := common.BytesToHash([]byte{1, 2, 3})
+	vals, commit := makeTestCommit(t, GeneratePrivValidatorBLS12381, 4, 1, 0, blockHash)
+	agg, err := NewAggregateCommit(vals, commit)
+	assert.NoError(t, err)
+	assert.Len(t, agg.TimestampsMs, 3)
+
+	assert.NoError(t, VerifyAggregateCommit("test", vals, blockHash, 1, agg))
+	assert.Error(t, VerifyAggregateCommit("other", vals, blockHash, 1, agg))
+	assert.Error(t, VerifyAggregateCommit("test", vals, common.Hash{}, 1, agg))
+	assert.Error(t, VerifyAggregateCommit("test", vals, blockHash, 2, agg))
+
+	// the timestamps are part of what the signers signed
+	tampered := *agg
+	tampered.TimestampsMs = append([]uint64(nil), agg.TimestampsMs...)
+	tampered.TimestampsMs[0]++
+	assert.Error(t, VerifyAggregateCommit("test", vals, blockHash, 1, &tampered))
+	tampered.TimestampsMs = agg.TimestampsMs[1:]
+	assert.Error(t, VerifyAggregateCommit("test", vals, blockHash, 1, &tampered))
+
+	// claiming a signer that did not sign
+	tampered = *agg
+	tampered.Signers = []byte{agg.Signers[0] | 1}
+	tampered.TimestampsMs = append([]uint64{1000}, agg.TimestampsMs...)
+	assert.Error(t, VerifyAggregateCommit("test", vals, blockHash, 1, &tampered))
+
+	// 2 of 4 is not +2/3
+	vals, commit = makeTestCommit(t, GeneratePrivValidatorBLS12381, 4, 2, 0, blockHash)
+	agg, err = NewAggregateCommit(vals, commit)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, VerifyAggregateCommit("test", vals, blockHash, 1, agg), ErrNotEnoughVotingPowerSigned)
+}
+
+func TestAggregateCommitNotBLS12381(t *testing.T) {
+	blockHash := common.BytesToHash([]byte{1, 2, 3})
+	vals, commit := makeTestCommit(t, GeneratePrivValidatorBLS12381, 4, 0, 0, blockHash)
+	agg, err := NewAggregateCommit(vals, commit)
+	assert.NoError(t, err)
+
+	// a signer with the default key
+	_, val := vals.GetByIndex(0)
+	val.PubKey = nil
+	_, err = NewAggregateCommit(vals, commit)
+	assert.ErrorIs(t, err, ErrNotBLS12381)
+	assert.ErrorIs(t, VerifyAggregateCommit("test", vals, blockHash, 1, agg), ErrNotBLS12381)
+}
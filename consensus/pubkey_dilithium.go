@@ -0,0 +1,136 @@
+//go:build dilithium
+// +build dilithium
+
+package consensus
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/cloudflare/circl/sign/dilithium/mode3"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// Dilithium (mode3) keys are an experiment to measure the overhead of
+// post-quantum signatures on consensus. Signatures are 3293 bytes vs 65 of
+// ECDSA, so commits and vote messages grow accordingly.
+
+const (
+	Dilithium3PubKeyType = "DILITHIUM3_PUBKEY"
+
+	dilithium3KeyPrefix = "dilithium3:"
+)
+
+func init() {
+	pubKeyDecoders[dilithium3KeyPrefix] = decodeDilithium3PubKey
+
+	if MaxSignatureSize < mode3.SignatureSize {
+		MaxSignatureSize = mode3.SignatureSize
+	}
+}
+
+type Dilithium3PubKey struct {
+	key *mode3.PublicKey
+}
+
+func NewDilithium3PubKey(key *mode3.PublicKey) PubKey {
+	return &Dilithium3PubKey{key: key}
+}
+
+func decodeDilithium3PubKey(key []byte) (PubKey, error) {
+	if len(key) != mode3.PublicKeySize {
+		return nil, fmt.Errorf("invalid dilithium3 key size %d", len(key))
+	}
+
+	pk := new(mode3.PublicKey)
+	if err := pk.UnmarshalBinary(key); err != nil {
+		return nil, err
+	}
+	return NewDilithium3PubKey(pk), nil
+}
+
+func (pubkey *Dilithium3PubKey) Type() string {
+	return Dilithium3PubKeyType
+}
+
+// Address returns the last 20 bytes of the keccak256 of the packed key.
+func (pubkey *Dilithium3PubKey) Address() common.Address {
+	return common.BytesToAddress(crypto.Keccak256(pubkey.key.Bytes())[12:])
+}
+
+func (pubkey *Dilithium3PubKey) Bytes() []byte {
+	return pubkey.key.Bytes()
+}
+
+func (pubkey *Dilithium3PubKey) VerifySignature(msg []byte, sig []byte) bool {
+	if len(sig) != mode3.SignatureSize {
+		return false
+	}
+	return mode3.Verify(pubkey.key, msg, sig)
+}
+
+func (pubkey *Dilithium3PubKey) String() string {
+	return dilithium3KeyPrefix + hex.EncodeToString(pubkey.key.Bytes())
+}
+
+// PrivValidatorDilithium3 is a local validator signing with a dilithium3 key.
+type PrivValidatorDilithium3 struct {
+	Seed    [mode3.SeedSize]byte
+	PubKey  *mode3.PublicKey
+	PrivKey *mode3.PrivateKey
+}
+
+// generate a local dilithium3 priv validator with random key.
+func GeneratePrivValidatorDilithium3() PrivValidator {
+	var seed [mode3.SeedSize]byte
+	if _, err := rand.Read(seed[:]); err != nil {
+		panic("failed to generate key")
+	}
+
+	pv, err := NewPrivValidatorDilithium3(seed[:])
+	if err != nil {
+		panic(err)
+	}
+	return pv
+}
+
+// NewPrivValidatorDilithium3 creates the validator from a 32-byte seed.
+func NewPrivValidatorDilithium3(seed []byte) (*PrivValidatorDilithium3, error) {
+	if len(seed) != mode3.SeedSize {
+		return nil, errors.New("invalid dilithium3 seed size")
+	}
+
+	pv := &PrivValidatorDilithium3{}
+	copy(pv.Seed[:], seed)
+	pv.PubKey, pv.PrivKey = mode3.NewKeyFromSeed(&pv.Seed)
+	return pv, nil
+}
+
+func (pv *PrivValidatorDilithium3) GetPubKey(context.Context) (PubKey, error) {
+	return NewDilithium3PubKey(pv.PubKey), nil
+}
+
+func (pv *PrivValidatorDilithium3) SignVote(ctx context.Context, chainId string, vote *Vote) error {
+	vote.TimestampMs = uint64(CanonicalNowMs())
+	vote.Signature = pv.sign(vote.VoteSignBytes(chainId))
+	return nil
+}
+
+func (pv *PrivValidatorDilithium3) SignProposal(ctx context.Context, chainID string, proposal *Proposal) error {
+	proposal.Signature = pv.sign(proposal.ProposalSignBytes(chainID))
+	return nil
+}
+
+func (pv *PrivValidatorDilithium3) SignBytes(msg []byte) ([]byte, error) {
+	return pv.sign(msg), nil
+}
+
+func (pv *PrivValidatorDilithium3) sign(msg []byte) []byte {
+	sig := make([]byte, mode3.SignatureSize)
+	mode3.SignTo(pv.PrivKey, msg, sig)
+	return sig
+}
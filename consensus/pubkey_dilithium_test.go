@@ -0,0 +1,79 @@
+//go:build dilithium
+// +build dilithium
+
+package consensus
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cloudflare/circl/sign/dilithium/mode3"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDilithium3SignVerify(t *testing.T) {
+	assert.Equal(t, mode3.SignatureSize, MaxSignatureSize)
+
+	pv := GeneratePrivValidatorDilithium3()
+	key, err := pv.GetPubKey(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, Dilithium3PubKeyType, key.Type())
+
+	msg := []byte{1, 2, 3}
+	sig, err := pv.SignBytes(msg)
+	require.NoError(t, err)
+	assert.Len(t, sig, mode3.SignatureSize)
+	assert.True(t, key.VerifySignature(msg, sig))
+	assert.False(t, key.VerifySignature([]byte{0xff}, sig))
+	assert.False(t, key.VerifySignature(msg, sig[:len(sig)-1]))
+
+	other := GeneratePrivValidatorDilithium3()
+	otherKey, err := other.GetPubKey(context.Background())
+	require.NoError(t, err)
+	assert.False(t, otherKey.VerifySignature(msg, sig))
+}
+
+func TestDilithium3RoundTrip(t *testing.T) {
+	seed := make([]byte, mode3.SeedSize)
+	seed[0] = 1
+	pv, err := NewPrivValidatorDilithium3(seed)
+	require.NoError(t, err)
+	key, err := pv.GetPubKey(context.Background())
+	require.NoError(t, err)
+
+	// the same seed gives the same key
+	again, err := NewPrivValidatorDilithium3(seed)
+	require.NoError(t, err)
+	againKey, err := again.GetPubKey(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, key.Bytes(), againKey.Bytes())
+
+	decoded, err := ParsePubKey(key.String())
+	require.NoError(t, err)
+	assert.Equal(t, key.Bytes(), decoded.Bytes())
+	assert.Equal(t, key.Address(), decoded.Address())
+
+	_, err = NewPrivValidatorDilithium3(seed[1:])
+	assert.Error(t, err)
+	_, err = ParsePubKey(dilithium3KeyPrefix + "00")
+	assert.Error(t, err)
+
+	// a signed vote keeps its signature through rlp and still verifies
+	vote := &Vote{
+		Type:             PrevoteType,
+		Height:           4,
+		Round:            1,
+		BlockID:          common.BytesToHash([]byte{1, 2}),
+		ValidatorAddress: key.Address(),
+	}
+	require.NoError(t, pv.SignVote(context.Background(), "dilithium", vote))
+	data, err := rlp.EncodeToBytes(vote)
+	require.NoError(t, err)
+	decodedVote := &Vote{}
+	require.NoError(t, rlp.DecodeBytes(data, decodedVote))
+	assert.NoError(t, ValidateSignatureSize(decodedVote.Signature))
+	assert.True(t, decoded.VerifySignature(decodedVote.VoteSignBytes("dilithium"), decodedVote.Signature))
+}
@@ -0,0 +1,45 @@
+package consensus
+
+import (
+	"context"
+	"errors"
+)
+
+var ErrQueryNotSupported = errors.New("application does not support queries")
+
+// QueryRequest is a read-only request against the application state.
+// Height 0 means the latest committed state.
+type QueryRequest struct {
+	Path   string `json:"path"`
+	Data   []byte `json:"data"`
+	Height uint64 `json:"height"`
+	Prove  bool   `json:"prove"`
+}
+
+// ProofOp is a single step of a Merkle proof, e.g., a leaf-to-subtree
+// inclusion proof followed by a subtree-to-root proof.
+type ProofOp struct {
+	Type string `json:"type"`
+	Key  []byte `json:"key"`
+	Data []byte `json:"data"`
+}
+
+// QueryResponse is the application's answer to a QueryRequest.
+// Code 0 means success. Height is the height of the state the value (and
+// proof, if requested) was read from, the proof being against the app hash
+// after the block of that height, which the header of the next height
+// commits to.
+type QueryResponse struct {
+	Code     uint32    `json:"code"`
+	Log      string    `json:"log"`
+	Key      []byte    `json:"key"`
+	Value    []byte    `json:"value"`
+	ProofOps []ProofOp `json:"proof_ops"`
+	Height   uint64    `json:"height"`
+}
+
+// Querier is implemented by block executors whose application state can be
+// queried, optionally with Merkle proofs, at historical heights.
+type Querier interface {
+	Query(ctx context.Context, req QueryRequest) (QueryResponse, error)
+}
@@ -0,0 +1,174 @@
+package consensus
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/QuarkChain/go-minimal-pbft/internal/testhook"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// QuorumStatus tells whether consensus is stalled waiting for +2/3 of the
+// voting power, and whose votes are missing, to coordinate the recovery of a
+// halted network.
+type QuorumStatus struct {
+	Height uint64 `json:"height"`
+	Round  int32  `json:"round"`
+	Step   string `json:"step"`
+
+	// We voted and wait for votes without which no timeout can fire, i.e.,
+	// the network has no quorum (if it lasts longer than a few timeouts).
+	WaitingForQuorum bool          `json:"waiting_for_quorum"`
+	WaitingSince     time.Time     `json:"waiting_since"`
+	WaitingFor       time.Duration `json:"waiting_for"`
+
+	TotalVotingPower  int64            `json:"total_voting_power"`
+	PrevotePower      int64            `json:"prevote_power"`
+	PrecommitPower    int64            `json:"precommit_power"`
+	MissingPrevotes   []common.Address `json:"missing_prevotes"`
+	MissingPrecommits []common.Address `json:"missing_precommits"`
+}
+
+var (
+	quorumMissingVoteDesc = prometheus.NewDesc(
+		"consensus_quorum_missing_vote",
+		"1 for each validator whose vote of the current round is missing while waiting for quorum",
+		[]string{"validator", "type"}, nil)
+	quorumWaitingDesc = prometheus.NewDesc(
+		"consensus_waiting_for_quorum",
+		"Whether consensus waits for +2/3 of the voting power",
+		nil, nil)
+	quorumWaitSecondsDesc = prometheus.NewDesc(
+		"consensus_quorum_wait_seconds",
+		"How long consensus has been waiting for quorum",
+		nil, nil)
+	quorumMissingPowerDesc = prometheus.NewDesc(
+		"consensus_quorum_missing_power",
+		"Voting power whose votes of the current step are missing while waiting for quorum",
+		nil, nil)
+)
+
+// the consensus state reported by the quorum metrics, the last one started
+var quorumMetricsState atomic.Value
+
+type quorumCollector struct{}
+
+func (quorumCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- quorumMissingVoteDesc
+	ch <- quorumWaitingDesc
+	ch <- quorumWaitSecondsDesc
+	ch <- quorumMissingPowerDesc
+}
+
+func (quorumCollector) Collect(ch chan<- prometheus.Metric) {
+	cs, ok := quorumMetricsState.Load().(*ConsensusState)
+	if !ok {
+		return
+	}
+	status := cs.QuorumStatus()
+
+	if !status.WaitingForQuorum {
+		ch <- prometheus.MustNewConstMetric(quorumWaitingDesc, prometheus.GaugeValue, 0)
+		ch <- prometheus.MustNewConstMetric(quorumWaitSecondsDesc, prometheus.GaugeValue, 0)
+		ch <- prometheus.MustNewConstMetric(quorumMissingPowerDesc, prometheus.GaugeValue, 0)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(quorumWaitingDesc, prometheus.GaugeValue, 1)
+	ch <- prometheus.MustNewConstMetric(quorumWaitSecondsDesc, prometheus.GaugeValue, status.WaitingFor.Seconds())
+
+	missingPower := status.TotalVotingPower - status.PrevotePower
+	if status.Step == RoundStepPrecommit.String() {
+		missingPower = status.TotalVotingPower - status.PrecommitPower
+	}
+	ch <- prometheus.MustNewConstMetric(quorumMissingPowerDesc, prometheus.GaugeValue, float64(missingPower))
+
+	for _, addr := range status.MissingPrevotes {
+		ch <- prometheus.MustNewConstMetric(quorumMissingVoteDesc, prometheus.GaugeValue, 1, addr.Hex(), "prevote")
+	}
+	for _, addr := range status.MissingPrecommits {
+		ch <- prometheus.MustNewConstMetric(quorumMissingVoteDesc, prometheus.GaugeValue, 1, addr.Hex(), "precommit")
+	}
+}
+
+// isWaitingForQuorum tells whether the current step only ends with +2/3 of
+// the votes: in the prevote and precommit steps the timeouts start once +2/3
+// of any votes are received, so without a quorum the round never ends.
+//
+// The caller must hold cs.mtx.
+func (cs *ConsensusState) isWaitingForQuorum() bool {
+	if cs.Votes == nil {
+		return false
+	}
+	switch cs.Step {
+	case RoundStepPrevote:
+		return !cs.Votes.Prevotes(cs.Round).HasTwoThirdsAny()
+	case RoundStepPrecommit:
+		return !cs.Votes.Precommits(cs.Round).HasTwoThirdsAny()
+	}
+	return false
+}
+
+// trackQuorumWait records when consensus starts waiting for quorum. It is
+// called on every step change; the caller must hold cs.mtx.
+func (cs *ConsensusState) trackQuorumWait() {
+	if !cs.isWaitingForQuorum() {
+		cs.quorumWaitSince = time.Time{}
+		return
+	}
+	// without quorum the step never changes again, the wait only ends
+	// when enough validators are back
+	if cs.quorumWaitSince.IsZero() {
+		cs.quorumWaitSince = testhook.Now()
+	}
+}
+
+// QuorumStatus reports the votes of the current round, and for how long
+// consensus has been waiting for quorum.
+func (cs *ConsensusState) QuorumStatus() QuorumStatus {
+	cs.mtx.RLock()
+	defer cs.mtx.RUnlock()
+
+	status := QuorumStatus{
+		Height: cs.Height,
+		Round:  cs.Round,
+		Step:   cs.Step.String(),
+	}
+	if cs.Votes == nil || cs.Validators == nil {
+		return status
+	}
+
+	status.TotalVotingPower = cs.Validators.TotalVotingPower()
+	status.PrevotePower, status.MissingPrevotes = cs.missingVotes(cs.Votes.Prevotes(cs.Round))
+	status.PrecommitPower, status.MissingPrecommits = cs.missingVotes(cs.Votes.Precommits(cs.Round))
+
+	// the step may not have changed since the votes arrived
+	if cs.isWaitingForQuorum() && !cs.quorumWaitSince.IsZero() {
+		status.WaitingForQuorum = true
+		status.WaitingSince = cs.quorumWaitSince
+		status.WaitingFor = testhook.Now().Sub(cs.quorumWaitSince)
+	}
+	return status
+}
+
+// missingVotes returns the voting power of the votes of the set and the
+// validators whose vote is missing. The caller must hold cs.mtx.
+func (cs *ConsensusState) missingVotes(votes *VoteSet) (int64, []common.Address) {
+	if votes == nil {
+		return 0, nil
+	}
+
+	bits := votes.BitArray()
+	power := int64(0)
+	var missing []common.Address
+	for i := 0; i < cs.Validators.Size(); i++ {
+		_, val := cs.Validators.GetByIndex(int32(i))
+		if bits.GetIndex(i) {
+			power += val.VotingPower
+		} else {
+			missing = append(missing, val.Address)
+		}
+	}
+	return power, missing
+}
@@ -0,0 +1,45 @@
+package consensus
+
+// Every node, validator or not, relays the proposals and votes it adds, so
+// validators that are not directly connected still get them. The relays
+// check with HasVote and HasProposal not to forward again what they already
+// hold.
+
+// HasVote tells whether the vote is already in the votes of the current or
+// last height. A conflicting vote of the same validator is not considered
+// held, so the evidence still spreads.
+func (cs *ConsensusState) HasVote(vote *Vote) bool {
+	cs.mtx.RLock()
+	defer cs.mtx.RUnlock()
+
+	var votes *VoteSet
+	switch {
+	case cs.Votes != nil && vote.Height == cs.Height:
+		switch vote.Type {
+		case PrevoteType:
+			votes = cs.Votes.Prevotes(vote.Round)
+		case PrecommitType:
+			votes = cs.Votes.Precommits(vote.Round)
+		}
+	case vote.Height+1 == cs.Height && vote.Type == PrecommitType:
+		votes = cs.LastCommit
+	}
+	if votes == nil || vote.Round != votes.GetRound() {
+		return false
+	}
+
+	held := votes.GetByIndex(vote.ValidatorIndex)
+	return held != nil && held.BlockID == vote.BlockID
+}
+
+// HasProposal tells whether the proposal of the current round is already
+// set, with the same block.
+func (cs *ConsensusState) HasProposal(proposal *Proposal) bool {
+	cs.mtx.RLock()
+	defer cs.mtx.RUnlock()
+
+	return cs.Proposal != nil &&
+		cs.Proposal.Height == proposal.Height &&
+		cs.Proposal.Round == proposal.Round &&
+		cs.Proposal.Block.Hash() == proposal.Block.Hash()
+}
@@ -0,0 +1,131 @@
+package consensus
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// Headers do not carry the app hash, so the executor records the app hash of
+// every applied block (see WithAppHashStore). After the application state is
+// lost, ReplayBlocks rebuilds it from the block store, and checks that the
+// application ends every height with the recorded hash.
+
+var (
+	ErrAppHashMismatch = errors.New("app hash mismatch")
+	ErrBlockNotStored  = errors.New("block not stored")
+)
+
+var appHashPrefix = []byte("app_hash")
+
+// AppHashStore keeps the app hash of every height.
+type AppHashStore struct {
+	db *leveldb.DB
+}
+
+func NewAppHashStore(db *leveldb.DB) *AppHashStore {
+	return &AppHashStore{db: db}
+}
+
+func (s *AppHashStore) key(height uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], height)
+	return append(append([]byte{}, appHashPrefix...), b[:]...)
+}
+
+func (s *AppHashStore) Save(height uint64, appHash []byte) error {
+	return s.db.Put(s.key(height), appHash, nil)
+}
+
+// Load returns the app hash of a height, false if it was not recorded.
+func (s *AppHashStore) Load(height uint64) ([]byte, bool) {
+	data, err := s.db.Get(s.key(height), nil)
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// checkAppHash reports a block applied again, e.g., on restart, to a
+// different app hash than the recorded one: the application is not
+// deterministic, or its state was lost.
+func (be *DefaultBlockExecutor) checkAppHash(block *FullBlock, state ChainState) {
+	height := state.LastBlockHeight
+	expected, ok := be.appHashes.Load(height)
+	if !ok || bytes.Equal(expected, state.AppHash) {
+		return
+	}
+	msg := fmt.Sprintf("block %v applied again to app hash %x, recorded %x", block.Hash(), state.AppHash, expected)
+	log.Error("App hash mismatch", "height", height, "block", block.Hash(), "recorded", fmt.Sprintf("%x", expected), "app_hash", fmt.Sprintf("%x", state.AppHash))
+	if be.alerter != nil {
+		be.alerter.Alert(Alert{Kind: AlertAppHashMismatch, Height: height, Message: msg})
+	}
+}
+
+// ReplayOptions configures ReplayBlocks.
+type ReplayOptions struct {
+	// To is the last height to replay, 0 for the last stored block.
+	To uint64
+	// AppHashes are the app hashes to check, nil to check none. The heights
+	// with no recorded hash are not checked.
+	AppHashes *AppHashStore
+	// OnBlock, if set, is called after each block is applied.
+	OnBlock func(block *FullBlock, state ChainState) error
+}
+
+// ReplayBlocks applies the stored blocks following state, i.e., from the
+// genesis state, with executor, which must not record the app hashes being
+// checked. It stops at the first app hash differing from the recorded one,
+// with an ErrAppHashMismatch error, and returns the state of the last height
+// applied.
+func ReplayBlocks(ctx context.Context, executor BlockExecutor, blocks BlockStore, state ChainState, opts ReplayOptions) (ChainState, error) {
+	to := opts.To
+	if to == 0 || to > blocks.Height() {
+		to = blocks.Height()
+	}
+
+	from := state.LastBlockHeight + 1
+	if from < state.InitialHeight {
+		from = state.InitialHeight
+	}
+	for height := from; height <= to; height++ {
+		if err := ctx.Err(); err != nil {
+			return state, err
+		}
+
+		block := blocks.LoadBlock(height)
+		if block == nil {
+			return state, fmt.Errorf("%w at height %d", ErrBlockNotStored, height)
+		}
+		if err := executor.ValidateBlock(state, block); err != nil {
+			return state, fmt.Errorf("stored block %d fails validation: %w", height, err)
+		}
+		newState, err := executor.ApplyBlock(ctx, state, block)
+		if err != nil {
+			return state, fmt.Errorf("failed to apply block %d: %w", height, err)
+		}
+
+		if opts.AppHashes != nil {
+			if expected, ok := opts.AppHashes.Load(height); ok && !bytes.Equal(expected, newState.AppHash) {
+				return state, fmt.Errorf("%w at height %d (block %v): recorded %x, replayed %x",
+					ErrAppHashMismatch, height, block.Hash(), expected, newState.AppHash)
+			}
+		}
+		state = newState
+
+		if opts.OnBlock != nil {
+			if err := opts.OnBlock(block, state); err != nil {
+				return state, err
+			}
+		}
+		if height%1000 == 0 {
+			log.Info("Replaying blocks", "height", height, "to", to)
+		}
+	}
+	return state, nil
+}
@@ -0,0 +1,83 @@
+package consensus
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+type replayBlockStore struct {
+	BlockStore
+	blocks map[uint64]*FullBlock
+}
+
+func (bs *replayBlockStore) Height() uint64 { return uint64(len(bs.blocks)) }
+
+func (bs *replayBlockStore) LoadBlock(height uint64) *FullBlock { return bs.blocks[height] }
+
+// replayExecutor is an application whose app hash is the height, apart from
+// the heights in wrong.
+type replayExecutor struct {
+	BlockExecutor
+	wrong map[uint64]bool
+}
+
+func (be *replayExecutor) ValidateBlock(ChainState, *FullBlock) error { return nil }
+
+func (be *replayExecutor) ApplyBlock(ctx context.Context, state ChainState, block *FullBlock) (ChainState, error) {
+	state.LastBlockHeight++
+	state.AppHash = []byte{byte(state.LastBlockHeight)}
+	if be.wrong[state.LastBlockHeight] {
+		state.AppHash = []byte{0xff}
+	}
+	return state, nil
+}
+
+func TestReplayBlocks(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(t, err)
+	appHashes := NewAppHashStore(db)
+
+	bs := &replayBlockStore{blocks: make(map[uint64]*FullBlock)}
+	for height := uint64(1); height <= 5; height++ {
+		bs.blocks[height] = &FullBlock{Block: types.NewBlock(
+			&Header{Number: big.NewInt(int64(height)), Coinbase: common.Address{1}, Difficulty: big.NewInt(1), BaseFee: big.NewInt(0)},
+			nil, nil, nil, trie.NewStackTrie(nil))}
+		assert.NoError(t, appHashes.Save(height, []byte{byte(height)}))
+	}
+	genesis := ChainState{InitialHeight: 1}
+
+	var replayed []uint64
+	state, err := ReplayBlocks(context.Background(), &replayExecutor{}, bs, genesis, ReplayOptions{
+		AppHashes: appHashes,
+		OnBlock: func(block *FullBlock, state ChainState) error {
+			replayed = append(replayed, state.LastBlockHeight)
+			return nil
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(5), state.LastBlockHeight)
+	assert.Equal(t, []uint64{1, 2, 3, 4, 5}, replayed)
+
+	// stops at the first divergence, with the state before it
+	state, err = ReplayBlocks(context.Background(), &replayExecutor{wrong: map[uint64]bool{3: true, 4: true}}, bs, genesis, ReplayOptions{AppHashes: appHashes})
+	assert.ErrorIs(t, err, ErrAppHashMismatch)
+	assert.Equal(t, uint64(2), state.LastBlockHeight)
+
+	// nothing checked without hashes
+	state, err = ReplayBlocks(context.Background(), &replayExecutor{wrong: map[uint64]bool{3: true}}, bs, genesis, ReplayOptions{To: 4})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), state.LastBlockHeight)
+
+	delete(bs.blocks, 5)
+	bs.blocks[6] = bs.blocks[4]
+	_, err = ReplayBlocks(context.Background(), &replayExecutor{}, bs, genesis, ReplayOptions{})
+	assert.ErrorIs(t, err, ErrBlockNotStored)
+}
@@ -0,0 +1,180 @@
+package consensus
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/event"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RoundEventType is a transition of the state machine.
+type RoundEventType uint8
+
+const (
+	// EventNewRound is published when a round starts, round 0 of a height
+	// included.
+	EventNewRound RoundEventType = iota
+	// EventNewStep is published on every step, EventNewRound coming with
+	// the one of RoundStepNewRound.
+	EventNewStep
+	// EventCompleteProposal is published once the proposal of the round,
+	// with its block, is set.
+	EventCompleteProposal
+	// EventPolka is published the first time +2/3 of the prevotes of a
+	// round are for the same block, or nil, BlockID being zero then.
+	EventPolka
+	// EventLock is published when we lock on a block, or relock on it in a
+	// later round.
+	EventLock
+	// EventUnlock is published when a polka releases our lock. Starting a
+	// new height clears it without one.
+	EventUnlock
+	// EventCommit is published once a block is committed and applied,
+	// before the next height starts.
+	EventCommit
+)
+
+func (t RoundEventType) String() string {
+	switch t {
+	case EventNewRound:
+		return "NewRound"
+	case EventNewStep:
+		return "NewStep"
+	case EventCompleteProposal:
+		return "CompleteProposal"
+	case EventPolka:
+		return "Polka"
+	case EventLock:
+		return "Lock"
+	case EventUnlock:
+		return "Unlock"
+	case EventCommit:
+		return "Commit"
+	default:
+		return fmt.Sprintf("RoundEventType(%d)", uint8(t))
+	}
+}
+
+func (t RoundEventType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+func (t *RoundEventType) UnmarshalText(text []byte) error {
+	for u := EventNewRound; u <= EventCommit; u++ {
+		if u.String() == string(text) {
+			*t = u
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown round event type %q", text)
+}
+
+// RoundEvent is a transition of the state machine, with the round state right
+// after it.
+type RoundEvent struct {
+	Type   RoundEventType
+	Height uint64
+	Round  int32
+	Step   RoundStepType
+	// block proposed, polka'ed, locked or committed, zero for the other
+	// events and the polkas for nil
+	BlockID common.Hash
+}
+
+func (ev RoundEvent) String() string {
+	return fmt.Sprintf("%v{%v/%v/%v %x}", ev.Type, ev.Height, ev.Round, ev.Step, ev.BlockID[:4])
+}
+
+var consensusRoundEventsDropped = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "consensus_round_events_dropped_total",
+		Help: "Total number of round events not delivered to a subscriber whose channel was full",
+	})
+
+// roundEventBus delivers the round events to the subscribers without ever
+// blocking the state machine: a subscriber not keeping up misses events,
+// which are counted.
+type roundEventBus struct {
+	mtx  sync.Mutex
+	subs map[*roundEventSub]struct{}
+
+	// rounds of polkaHeight a polka was published for
+	polkaHeight uint64
+	polkas      map[int32]bool
+}
+
+type roundEventSub struct {
+	ch    chan<- RoundEvent
+	types map[RoundEventType]bool // nil for all
+}
+
+func newRoundEventBus() *roundEventBus {
+	return &roundEventBus{subs: make(map[*roundEventSub]struct{})}
+}
+
+func (b *roundEventBus) subscribe(ch chan<- RoundEvent, types []RoundEventType) event.Subscription {
+	sub := &roundEventSub{ch: ch}
+	if len(types) != 0 {
+		sub.types = make(map[RoundEventType]bool)
+		for _, t := range types {
+			sub.types[t] = true
+		}
+	}
+
+	b.mtx.Lock()
+	b.subs[sub] = struct{}{}
+	b.mtx.Unlock()
+
+	return event.NewSubscription(func(quit <-chan struct{}) error {
+		<-quit
+		b.mtx.Lock()
+		delete(b.subs, sub)
+		b.mtx.Unlock()
+		return nil
+	})
+}
+
+func (b *roundEventBus) publish(ev RoundEvent) {
+	if b == nil {
+		return
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if ev.Type == EventPolka {
+		if b.polkaHeight != ev.Height || b.polkas == nil {
+			b.polkaHeight, b.polkas = ev.Height, make(map[int32]bool)
+		}
+		if b.polkas[ev.Round] {
+			return
+		}
+		b.polkas[ev.Round] = true
+	}
+
+	for sub := range b.subs {
+		if sub.types != nil && !sub.types[ev.Type] {
+			continue
+		}
+		select {
+		case sub.ch <- ev:
+		default:
+			consensusRoundEventsDropped.Inc()
+		}
+	}
+}
+
+// SubscribeRoundEvents sends the round events of the given types, all of
+// them if none, to ch until the subscription is unsubscribed. Events are
+// dropped when ch is full, so it should be buffered.
+func (cs *ConsensusState) SubscribeRoundEvents(ch chan<- RoundEvent, types ...RoundEventType) event.Subscription {
+	return cs.roundEvents.subscribe(ch, types)
+}
+
+// publishRoundEvent publishes an event of the current height, round and
+// step. The caller must hold cs.mtx.
+func (cs *ConsensusState) publishRoundEvent(t RoundEventType, blockID common.Hash) {
+	cs.roundEvents.publish(RoundEvent{Type: t, Height: cs.Height, Round: cs.Round, Step: cs.Step, BlockID: blockID})
+}
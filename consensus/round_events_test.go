@@ -0,0 +1,67 @@
+package consensus
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoundEventBus(t *testing.T) {
+	cs := &ConsensusState{roundEvents: newRoundEventBus()}
+	cs.Height, cs.Round = 3, 1
+
+	all := make(chan RoundEvent, 8)
+	polkas := make(chan RoundEvent, 8)
+	full := make(chan RoundEvent)
+	subAll := cs.SubscribeRoundEvents(all)
+	defer subAll.Unsubscribe()
+	subPolkas := cs.SubscribeRoundEvents(polkas, EventPolka)
+	cs.SubscribeRoundEvents(full).Unsubscribe()
+
+	cs.publishRoundEvent(EventNewRound, common.Hash{})
+	polka := RoundEvent{Type: EventPolka, Height: 3, Round: 1, BlockID: common.Hash{1}}
+	cs.roundEvents.publish(polka)
+	// published once per round
+	cs.roundEvents.publish(polka)
+
+	require.Len(t, all, 2)
+	assert.Equal(t, RoundEvent{Type: EventNewRound, Height: 3, Round: 1}, <-all)
+	assert.Equal(t, polka, <-all)
+	require.Len(t, polkas, 1)
+	assert.Equal(t, polka, <-polkas)
+
+	subPolkas.Unsubscribe()
+	polka.Height = 4
+	cs.roundEvents.publish(polka)
+	assert.Len(t, all, 1)
+	assert.Len(t, polkas, 0)
+}
+
+func TestRoundEventsLock(t *testing.T) {
+	cs := &ConsensusState{roundEvents: newRoundEventBus()}
+	cs.LockedRound = -1
+	events := make(chan RoundEvent, 8)
+	cs.SubscribeRoundEvents(events, EventLock, EventUnlock)
+
+	// nothing to release
+	cs.unlock(0)
+	assert.Len(t, events, 0)
+
+	state := *MakeGenesisChainState("test", 1000, []common.Address{{1}}, []int64{1}, 100, 1)
+	block := state.MakeBlock(1, NewCommit(0, 0, common.Hash{}, nil), common.Address{1})
+	cs.lock(2, block)
+	assert.Equal(t, int32(2), cs.LockedRound)
+	assert.Equal(t, RoundEvent{Type: EventLock, BlockID: block.Hash()}, <-events)
+
+	cs.unlock(3)
+	assert.Equal(t, int32(-1), cs.LockedRound)
+	assert.Nil(t, cs.LockedBlock)
+	assert.Equal(t, EventUnlock, (<-events).Type)
+
+	// without a bus, as in tests building the state by hand
+	cs = &ConsensusState{}
+	cs.lock(0, block)
+	cs.unlock(1)
+}
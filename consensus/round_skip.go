@@ -0,0 +1,56 @@
+package consensus
+
+import (
+	"context"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// HasTwoThirdsNil tells whether +2/3 of the voting power voted nil.
+func HasTwoThirdsNil(votes *VoteSet) bool {
+	if votes == nil {
+		return false
+	}
+	blockID, ok := votes.TwoThirdsMajority()
+	return ok && blockID == common.Hash{}
+}
+
+// skipNilRound moves on to the next round once +2/3 prevoted nil in round:
+// no block can get +2/3 precommits in it, so instead of waiting for the
+// propose, prevote and precommit timeouts, we precommit nil and start the
+// next round right away.
+func (cs *ConsensusState) skipNilRound(ctx context.Context, height uint64, round int32) {
+	if cs.Height != height || cs.Round != round || cs.Step < RoundStepPropose || RoundStepCommit <= cs.Step {
+		return
+	}
+
+	log.Debug("+2/3 prevoted nil; skipping to the next round", "height", height, "round", round, "step", cs.Step)
+	cs.enterPrecommit(ctx, height, round)
+	cs.enterNewRound(ctx, height, round+1)
+}
+
+// FastPathCommit sets whether to start the next height without waiting for
+// TimeoutCommit once all the validators precommitted, on by default. Off,
+// the heights keep the TimeoutCommit cadence, e.g., to leave the
+// application a fixed time between blocks.
+func FastPathCommit(enabled bool) StateOption {
+	return func(cs *ConsensusState) {
+		cs.noFastPath = !enabled
+	}
+}
+
+// enterNewHeightFast starts round 0 of the new height right away when all
+// the validators precommitted the block just committed, whatever
+// SkipTimeoutCommit: no precommit is left to wait for. With a small fixed
+// validator set, this is most heights, shorter by TimeoutCommit. See
+// FastPathCommit to turn it off.
+func (cs *ConsensusState) enterNewHeightFast(ctx context.Context, precommits *VoteSet) bool {
+	if cs.noFastPath || cs.Step != RoundStepNewHeight || precommits == nil || !precommits.HasAll() {
+		return false
+	}
+
+	cs.metrics.FastPathCommits.Inc()
+	cs.enterNewRound(ctx, cs.Height, 0)
+	return true
+}
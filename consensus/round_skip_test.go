@@ -0,0 +1,73 @@
+package consensus
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSkipNilRound(t *testing.T) {
+	st := newStateTest(t, 4, nil)
+	st.startRound()
+	require.Equal(t, RoundStepPropose, st.cs.Step)
+
+	others := st.others()
+	st.vote(PrevoteType, 0, common.Hash{}, others[:2]...)
+	assert.Equal(t, int32(0), st.cs.Round)
+	assert.Nil(t, st.ownVote(PrecommitType, 0))
+
+	// +2/3 prevoted nil: no waiting for the propose timeout
+	st.vote(PrevoteType, 0, common.Hash{}, others[2])
+	precommit := st.ownVote(PrecommitType, 0)
+	require.NotNil(t, precommit)
+	assert.Equal(t, common.Hash{}, precommit.BlockID)
+	assert.Equal(t, int32(1), st.cs.Round)
+
+	// a stale round, or one not entered, is not skipped
+	st.cs.skipNilRound(st.ctx, st.cs.Height, 0)
+	st.cs.skipNilRound(st.ctx, st.cs.Height, 2)
+	assert.Equal(t, int32(1), st.cs.Round)
+}
+
+func TestSkipNilRoundNotNil(t *testing.T) {
+	st := newStateTest(t, 4, nil)
+	st.startRound()
+
+	// +2/3 prevoted, but not all nil
+	others := st.others()
+	st.vote(PrevoteType, 0, common.Hash{}, others[:2]...)
+	st.vote(PrevoteType, 0, common.BytesToHash([]byte{1}), others[2])
+	assert.Equal(t, int32(0), st.cs.Round)
+	assert.Nil(t, st.ownVote(PrecommitType, 0))
+}
+
+func TestSkipNilRoundAfterRoundSkip(t *testing.T) {
+	st := newStateTest(t, 4, nil)
+	st.startRound()
+
+	// +2/3 prevoted nil in a round ahead: skip to it, then past it
+	others := st.others()
+	st.vote(PrevoteType, 2, common.Hash{}, others[:2]...)
+	assert.Equal(t, int32(0), st.cs.Round)
+	st.vote(PrevoteType, 2, common.Hash{}, others[2])
+
+	precommit := st.ownVote(PrecommitType, 2)
+	require.NotNil(t, precommit)
+	assert.Equal(t, common.Hash{}, precommit.BlockID)
+	assert.Nil(t, st.ownVote(PrecommitType, 0))
+	assert.Equal(t, int32(3), st.cs.Round)
+}
+
+func TestSkipNilRoundAfterRoundSkipNotNil(t *testing.T) {
+	st := newStateTest(t, 4, nil)
+	st.startRound()
+
+	// a round ahead with +2/3 prevotes, not all nil, is entered only
+	others := st.others()
+	st.vote(PrevoteType, 2, common.Hash{}, others[:2]...)
+	st.vote(PrevoteType, 2, common.BytesToHash([]byte{1}), others[2])
+	assert.Equal(t, int32(2), st.cs.Round)
+	assert.Nil(t, st.ownVote(PrecommitType, 2))
+}
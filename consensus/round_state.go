@@ -18,8 +18,10 @@ type RoundState struct {
 	Validators    *ValidatorSet `json:"validators"`
 	Proposal      *Proposal     `json:"proposal"`
 	ProposalBlock *FullBlock    `json:"proposal_block"`
-	LockedRound   int32         `json:"locked_round"`
-	LockedBlock   *FullBlock    `json:"locked_block"`
+	// Local time the proposal was received, checked with PBTS
+	ProposalReceiveTime time.Time  `json:"proposal_receive_time"`
+	LockedRound         int32      `json:"locked_round"`
+	LockedBlock         *FullBlock `json:"locked_block"`
 
 	// Last known round with POL for non-nil valid block.
 	ValidRound int32      `json:"valid_round"`
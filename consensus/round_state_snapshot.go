@@ -0,0 +1,149 @@
+package consensus
+
+import (
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// RoundStateSnapshot is a copy of the round state that a reader can keep
+// while the state machine goes on. The validator sets and vote bit arrays
+// are copied; the proposal and blocks are shared, as they are never modified
+// once received.
+type RoundStateSnapshot struct {
+	Height     uint64        `json:"height"`
+	Round      int32         `json:"round"`
+	Step       RoundStepType `json:"step"`
+	StartTime  time.Time     `json:"start_time"`
+	CommitTime time.Time     `json:"commit_time"`
+
+	Validators     *ValidatorSet `json:"validators"`
+	LastValidators *ValidatorSet `json:"last_validators"`
+
+	Proposal      *Proposal  `json:"proposal"`
+	ProposalBlock *FullBlock `json:"proposal_block"`
+	LockedRound   int32      `json:"locked_round"`
+	LockedBlock   *FullBlock `json:"locked_block"`
+	ValidRound    int32      `json:"valid_round"`
+	ValidBlock    *FullBlock `json:"valid_block"`
+	CommitRound   int32      `json:"commit_round"`
+
+	// the votes of every round up to the current one
+	Votes      []RoundVotes `json:"votes"`
+	LastCommit *BitArray    `json:"last_commit"`
+
+	TriggeredTimeoutPrecommit bool `json:"triggered_timeout_precommit"`
+}
+
+// RoundVotes are the validators whose votes of a round were received, and
+// the blocks with +2/3 of them, if any.
+type RoundVotes struct {
+	Round              int32       `json:"round"`
+	Prevotes           *BitArray   `json:"prevotes"`
+	PrevotesMaj23      common.Hash `json:"prevotes_maj23"`
+	HasPrevotesMaj23   bool        `json:"has_prevotes_maj23"`
+	Precommits         *BitArray   `json:"precommits"`
+	PrecommitsMaj23    common.Hash `json:"precommits_maj23"`
+	HasPrecommitsMaj23 bool        `json:"has_precommits_maj23"`
+}
+
+// RoundStateSummary is the cheap part of the round state, for logs and
+// polling.
+type RoundStateSummary struct {
+	Height            uint64         `json:"height"`
+	Round             int32          `json:"round"`
+	Step              string         `json:"step"`
+	StartTime         time.Time      `json:"start_time"`
+	Proposer          common.Address `json:"proposer"`
+	ProposalBlockHash common.Hash    `json:"proposal_block_hash"`
+	LockedRound       int32          `json:"locked_round"`
+	LockedBlockHash   common.Hash    `json:"locked_block_hash"`
+	ValidRound        int32          `json:"valid_round"`
+	ValidBlockHash    common.Hash    `json:"valid_block_hash"`
+}
+
+func blockHash(b *FullBlock) common.Hash {
+	if b == nil {
+		return common.Hash{}
+	}
+	return b.Hash()
+}
+
+func copyBitArray(ba *BitArray) *BitArray {
+	if ba == nil {
+		return nil
+	}
+	return ba.Copy()
+}
+
+// GetRoundStateSnapshot returns a copy of the round state, safe to read from
+// any goroutine, unlike the one of GetRoundState.
+func (cs *ConsensusState) GetRoundStateSnapshot() *RoundStateSnapshot {
+	cs.mtx.RLock()
+	defer cs.mtx.RUnlock()
+
+	rs := &cs.RoundState
+	snap := &RoundStateSnapshot{
+		Height:                    rs.Height,
+		Round:                     rs.Round,
+		Step:                      rs.Step,
+		StartTime:                 rs.StartTime,
+		CommitTime:                rs.CommitTime,
+		Proposal:                  rs.Proposal,
+		ProposalBlock:             rs.ProposalBlock,
+		LockedRound:               rs.LockedRound,
+		LockedBlock:               rs.LockedBlock,
+		ValidRound:                rs.ValidRound,
+		ValidBlock:                rs.ValidBlock,
+		CommitRound:               rs.CommitRound,
+		TriggeredTimeoutPrecommit: rs.TriggeredTimeoutPrecommit,
+	}
+	if rs.Validators != nil {
+		snap.Validators = rs.Validators.Copy()
+	}
+	if rs.LastValidators != nil {
+		snap.LastValidators = rs.LastValidators.Copy()
+	}
+	if rs.LastCommit != nil {
+		snap.LastCommit = copyBitArray(rs.LastCommit.BitArray())
+	}
+
+	if rs.Votes != nil {
+		for round := int32(0); round <= rs.Votes.Round(); round++ {
+			rv := RoundVotes{Round: round}
+			if prevotes := rs.Votes.Prevotes(round); prevotes != nil {
+				rv.Prevotes = copyBitArray(prevotes.BitArray())
+				rv.PrevotesMaj23, rv.HasPrevotesMaj23 = prevotes.TwoThirdsMajority()
+			}
+			if precommits := rs.Votes.Precommits(round); precommits != nil {
+				rv.Precommits = copyBitArray(precommits.BitArray())
+				rv.PrecommitsMaj23, rv.HasPrecommitsMaj23 = precommits.TwoThirdsMajority()
+			}
+			snap.Votes = append(snap.Votes, rv)
+		}
+	}
+	return snap
+}
+
+// GetRoundStateSummary returns the summary of the round state, without
+// copying the votes and validators.
+func (cs *ConsensusState) GetRoundStateSummary() RoundStateSummary {
+	cs.mtx.RLock()
+	defer cs.mtx.RUnlock()
+
+	summary := RoundStateSummary{
+		Height:            cs.Height,
+		Round:             cs.Round,
+		Step:              cs.Step.String(),
+		StartTime:         cs.StartTime,
+		ProposalBlockHash: blockHash(cs.ProposalBlock),
+		LockedRound:       cs.LockedRound,
+		LockedBlockHash:   blockHash(cs.LockedBlock),
+		ValidRound:        cs.ValidRound,
+		ValidBlockHash:    blockHash(cs.ValidBlock),
+	}
+	if cs.Validators != nil {
+		summary.Proposer = cs.proposer().Address
+	}
+	return summary
+}
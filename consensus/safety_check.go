@@ -0,0 +1,161 @@
+package consensus
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The safety invariants of the state machine, checked on every transition
+// with SafetyChecks. Unlike the invariants package, which checks what nodes
+// stored, they catch a regression of the locking rules at the transition
+// breaking them, before it ever leads to a fork.
+const (
+	// InvariantPrecommitPolka: we precommit a block only with a polka for
+	// it in the round of the precommit.
+	InvariantPrecommitPolka = "precommit_polka"
+	// InvariantLockPolka: we lock on a block only with a polka for it in
+	// the round of the lock.
+	InvariantLockPolka = "lock_polka"
+	// InvariantUnlockPolka: we unlock only with a polka for another block,
+	// or nil, in a round after the locked one and up to the current one.
+	InvariantUnlockPolka = "unlock_polka"
+	// InvariantLockedRoundMonotonic: the locked round of a height only
+	// increases while locked.
+	InvariantLockedRoundMonotonic = "locked_round_monotonic"
+	// InvariantLockState: the locked round is -1 exactly when no block is
+	// locked, and not after the current round; likewise for the valid round
+	// and block.
+	InvariantLockState = "lock_state"
+	// InvariantValidPolka: a block becomes the valid one only with a polka
+	// for it in the valid round, not before the previous valid round.
+	InvariantValidPolka = "valid_polka"
+)
+
+// SafetyViolation is a safety invariant broken by a transition.
+type SafetyViolation struct {
+	Invariant string        `json:"invariant"`
+	Height    uint64        `json:"height"`
+	Round     int32         `json:"round"`
+	Step      RoundStepType `json:"step"`
+	Detail    string        `json:"detail"`
+}
+
+func (v SafetyViolation) Error() string {
+	return fmt.Sprintf("safety invariant %s violated at %d/%d/%v: %s", v.Invariant, v.Height, v.Round, v.Step, v.Detail)
+}
+
+var consensusSafetyViolations = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "consensus_safety_violations_total",
+		Help: "Total number of safety invariants of the state machine violated, by invariant",
+	}, []string{"invariant"})
+
+// SafetyChecks checks the safety invariants on every transition, and calls
+// onViolation with the ones broken, or panics if it is nil. The checks only
+// read the vote sets, at the cost of a few map lookups per transition.
+func SafetyChecks(onViolation func(SafetyViolation)) StateOption {
+	return func(cs *ConsensusState) {
+		if onViolation == nil {
+			onViolation = func(v SafetyViolation) { panic(v) }
+		}
+		cs.onSafetyViolation = onViolation
+	}
+}
+
+func (cs *ConsensusState) safetyViolation(invariant string, format string, args ...interface{}) {
+	v := SafetyViolation{
+		Invariant: invariant,
+		Height:    cs.Height,
+		Round:     cs.Round,
+		Step:      cs.Step,
+		Detail:    fmt.Sprintf(format, args...),
+	}
+	consensusSafetyViolations.WithLabelValues(invariant).Inc()
+	log.Error("safety invariant violated", "invariant", invariant, "height", v.Height, "round", v.Round, "step", v.Step, "detail", v.Detail)
+	cs.onSafetyViolation(v)
+}
+
+// hasPolka returns whether +2/3 prevoted blockID at round.
+func (cs *ConsensusState) hasPolka(round int32, blockID common.Hash) bool {
+	prevotes := cs.Votes.Prevotes(round)
+	if prevotes == nil {
+		return false
+	}
+	polka, ok := prevotes.TwoThirdsMajority()
+	return ok && polka == blockID
+}
+
+// checkVote checks a vote we signed.
+func (cs *ConsensusState) checkVote(vote *Vote) {
+	if cs.onSafetyViolation == nil || vote.Type != PrecommitType || vote.BlockID == (common.Hash{}) {
+		return
+	}
+	if !cs.hasPolka(vote.Round, vote.BlockID) {
+		cs.safetyViolation(InvariantPrecommitPolka, "precommitted %v at round %d without a polka", vote.BlockID, vote.Round)
+	}
+}
+
+// checkLock checks locking on block at round.
+func (cs *ConsensusState) checkLock(round int32, block *FullBlock) {
+	if cs.onSafetyViolation == nil {
+		return
+	}
+	if !cs.hasPolka(round, block.Hash()) {
+		cs.safetyViolation(InvariantLockPolka, "locked on %v at round %d without a polka", block.Hash(), round)
+	}
+	if cs.LockedBlock != nil && round < cs.LockedRound {
+		cs.safetyViolation(InvariantLockedRoundMonotonic, "locked at round %d after round %d", round, cs.LockedRound)
+	}
+}
+
+// checkUnlock checks releasing the current lock.
+func (cs *ConsensusState) checkUnlock() {
+	if cs.onSafetyViolation == nil || cs.LockedBlock == nil {
+		return
+	}
+	for round := cs.LockedRound + 1; round <= cs.Round; round++ {
+		prevotes := cs.Votes.Prevotes(round)
+		if prevotes == nil {
+			continue
+		}
+		if polka, ok := prevotes.TwoThirdsMajority(); ok && !cs.LockedBlock.HashTo(polka) {
+			return
+		}
+	}
+	cs.safetyViolation(InvariantUnlockPolka, "unlocked %v locked at round %d without a later polka", cs.LockedBlock.Hash(), cs.LockedRound)
+}
+
+// checkValid checks making block, with a polka at round, the valid block.
+func (cs *ConsensusState) checkValid(round int32, block *FullBlock) {
+	if cs.onSafetyViolation == nil {
+		return
+	}
+	if !cs.hasPolka(round, block.Hash()) {
+		cs.safetyViolation(InvariantValidPolka, "valid block %v at round %d without a polka", block.Hash(), round)
+	}
+	if round < cs.ValidRound {
+		cs.safetyViolation(InvariantValidPolka, "valid block at round %d after round %d", round, cs.ValidRound)
+	}
+}
+
+// checkLockState checks the lock after a step.
+func (cs *ConsensusState) checkLockState() {
+	if cs.onSafetyViolation == nil {
+		return
+	}
+	if (cs.LockedBlock == nil) != (cs.LockedRound == -1) {
+		cs.safetyViolation(InvariantLockState, "locked round %d with locked block %v", cs.LockedRound, cs.LockedBlock != nil)
+	}
+	if cs.LockedRound > cs.Round {
+		cs.safetyViolation(InvariantLockState, "locked round %d after the current round", cs.LockedRound)
+	}
+	if (cs.ValidBlock == nil) != (cs.ValidRound == -1) {
+		cs.safetyViolation(InvariantLockState, "valid round %d with valid block %v", cs.ValidRound, cs.ValidBlock != nil)
+	}
+	if cs.ValidRound > cs.Round {
+		cs.safetyViolation(InvariantLockState, "valid round %d after the current round", cs.ValidRound)
+	}
+}
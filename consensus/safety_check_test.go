@@ -0,0 +1,87 @@
+package consensus
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSafetyChecks(t *testing.T) {
+	pvs := make([]PrivValidator, 4)
+	addrs := make([]common.Address, 4)
+	for i := range pvs {
+		pvs[i] = GeneratePrivValidatorLocal()
+		pubKey, err := pvs[i].GetPubKey(context.Background())
+		require.NoError(t, err)
+		addrs[i] = pubKey.Address()
+	}
+	vals := NewValidatorSet(addrs, []int64{1, 1, 1, 1}, 1)
+	byAddr := make(map[common.Address]PrivValidator)
+	for i, addr := range addrs {
+		byAddr[addr] = pvs[i]
+	}
+
+	var violations []string
+	cs := &ConsensusState{}
+	SafetyChecks(func(v SafetyViolation) { violations = append(violations, v.Invariant) })(cs)
+	cs.Height, cs.LockedRound, cs.ValidRound = 1, -1, -1
+	cs.Votes = NewHeightVoteSet("test", 1, vals)
+	cs.Votes.SetRound(2)
+
+	prevote := func(round int32, blockID common.Hash) {
+		for idx, val := range vals.Validators[:3] {
+			vote := &Vote{ValidatorAddress: val.Address, ValidatorIndex: int32(idx), Height: 1, Round: round, Type: PrevoteType, BlockID: blockID}
+			require.NoError(t, byAddr[val.Address].SignVote(context.Background(), "test", vote))
+			_, err := cs.Votes.AddVote(vote, "")
+			require.NoError(t, err)
+		}
+	}
+
+	state := *MakeGenesisChainState("test", 1000, addrs, []int64{1, 1, 1, 1}, 100, 1)
+	block := state.MakeBlock(1, NewCommit(0, 0, common.Hash{}, nil), addrs[0])
+
+	// no polka yet
+	cs.checkVote(&Vote{Height: 1, Round: 0, Type: PrecommitType, BlockID: block.Hash()})
+	cs.lock(0, block)
+	assert.Equal(t, []string{InvariantPrecommitPolka, InvariantLockPolka}, violations)
+
+	violations = nil
+	prevote(0, block.Hash())
+	cs.checkVote(&Vote{Height: 1, Round: 0, Type: PrecommitType, BlockID: block.Hash()})
+	cs.checkVote(&Vote{Height: 1, Round: 0, Type: PrecommitType})
+	cs.lock(0, block)
+	cs.checkLockState()
+	assert.Empty(t, violations)
+
+	// the polka of round 0 is not a later one
+	cs.Round = 1
+	cs.unlock(1)
+	assert.Equal(t, []string{InvariantUnlockPolka}, violations)
+
+	violations = nil
+	cs.lock(0, block)
+	prevote(1, common.Hash{})
+	cs.unlock(1)
+	assert.Empty(t, violations)
+
+	// relocking at an earlier round
+	prevote(2, block.Hash())
+	cs.Round = 2
+	cs.lock(2, block)
+	cs.lock(0, block)
+	assert.Equal(t, []string{InvariantLockedRoundMonotonic}, violations)
+
+	violations = nil
+	cs.LockedBlock = nil
+	cs.checkLockState()
+	assert.Equal(t, []string{InvariantLockState}, violations)
+
+	// panics without a callback
+	cs = &ConsensusState{}
+	SafetyChecks(nil)(cs)
+	cs.LockedRound = 3
+	assert.Panics(t, cs.checkLockState)
+}
@@ -0,0 +1,155 @@
+package consensus
+
+import (
+	"context"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Executing a block takes part of the time between its commit and the next
+// proposal. With a SpeculativeFinalizer, the executor starts executing the
+// proposal as soon as we prevote it, while the votes are collected, and the
+// commit of the same block reuses the result; a round moving on to another
+// block cancels the execution.
+
+var consensusSpeculations = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "consensus_speculative_executions_total",
+		Help: "Total number of blocks executed ahead of their commit, by result: reused, failed, or discarded",
+	}, []string{"result"})
+
+// SpeculativeFinalizer is implemented by the applications able to execute a
+// block before it is decided. FinalizeBlockSpeculative returns the response
+// FinalizeBlock would return for req without changing the app state, and a
+// commit func making the state after the block the app state. It must return
+// when ctx is canceled, and may run concurrently with queries, and with the
+// end of a canceled execution.
+type SpeculativeFinalizer interface {
+	BlockFinalizer
+	FinalizeBlockSpeculative(ctx context.Context, req FinalizeBlockRequest) (resp FinalizeBlockResponse, commit func() error, err error)
+}
+
+// Speculator is implemented by the block executors able to execute a block
+// ahead of its commit, see DefaultBlockExecutor.
+type Speculator interface {
+	// Speculate starts executing block on top of state, instead of the block
+	// executed so far, if any.
+	Speculate(state ChainState, block *FullBlock)
+	// CancelSpeculation stops executing any block but the ones of keep.
+	CancelSpeculation(keep ...common.Hash)
+}
+
+type speculation struct {
+	hash   common.Hash
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	resp   FinalizeBlockResponse
+	commit func() error
+	err    error
+}
+
+// Speculate executes block if the finalizer is a SpeculativeFinalizer.
+func (be *DefaultBlockExecutor) Speculate(state ChainState, block *FullBlock) {
+	finalizer, ok := be.finalizer.(SpeculativeFinalizer)
+	if !ok {
+		return
+	}
+
+	be.specMu.Lock()
+	defer be.specMu.Unlock()
+	if be.spec != nil {
+		if be.spec.hash == block.Hash() {
+			return
+		}
+		be.discard(be.spec)
+	}
+
+	req, err := finalizeRequest(state, block)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	spec := &speculation{hash: block.Hash(), cancel: cancel, done: make(chan struct{})}
+	be.spec = spec
+	log.Debug("executing block speculatively", "height", block.NumberU64(), "hash", spec.hash)
+	go func() {
+		defer close(spec.done)
+		spec.resp, spec.commit, spec.err = finalizer.FinalizeBlockSpeculative(ctx, req)
+	}()
+}
+
+func (be *DefaultBlockExecutor) CancelSpeculation(keep ...common.Hash) {
+	be.specMu.Lock()
+	defer be.specMu.Unlock()
+	if be.spec == nil {
+		return
+	}
+	for _, hash := range keep {
+		if be.spec.hash == hash {
+			return
+		}
+	}
+	be.discard(be.spec)
+	be.spec = nil
+}
+
+func (be *DefaultBlockExecutor) discard(spec *speculation) {
+	log.Debug("discarding speculative execution", "hash", spec.hash)
+	spec.cancel()
+	consensusSpeculations.WithLabelValues("discarded").Inc()
+}
+
+// speculated returns the response of the speculative execution of block, if
+// any, with its app state committed. Another block being executed is
+// canceled, and waited for, so that the app does not execute two blocks at
+// once.
+func (be *DefaultBlockExecutor) speculated(block *FullBlock) (FinalizeBlockResponse, bool, error) {
+	be.specMu.Lock()
+	spec := be.spec
+	be.spec = nil
+	be.specMu.Unlock()
+	if spec == nil {
+		return FinalizeBlockResponse{}, false, nil
+	}
+
+	if spec.hash != block.Hash() {
+		be.discard(spec)
+		<-spec.done
+		return FinalizeBlockResponse{}, false, nil
+	}
+	<-spec.done
+	spec.cancel()
+	if spec.err != nil {
+		log.Warn("speculative execution failed, executing the block again", "height", block.NumberU64(), "err", spec.err)
+		consensusSpeculations.WithLabelValues("failed").Inc()
+		return FinalizeBlockResponse{}, false, nil
+	}
+	consensusSpeculations.WithLabelValues("reused").Inc()
+	return spec.resp, true, spec.commit()
+}
+
+// speculate starts executing the proposal block we prevoted.
+func (cs *ConsensusState) speculate(block *FullBlock) {
+	if speculator, ok := cs.blockExec.(Speculator); ok && !cs.replayMode {
+		speculator.Speculate(cs.chainState, block)
+	}
+}
+
+// cancelSpeculation stops executing the proposal block of a past round,
+// unless it is our locked or valid block, which may still be committed.
+func (cs *ConsensusState) cancelSpeculation() {
+	speculator, ok := cs.blockExec.(Speculator)
+	if !ok {
+		return
+	}
+	var keep []common.Hash
+	for _, block := range []*FullBlock{cs.LockedBlock, cs.ValidBlock} {
+		if block != nil {
+			keep = append(keep, block.Hash())
+		}
+	}
+	speculator.CancelSpeculation(keep...)
+}
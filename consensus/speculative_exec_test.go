@@ -0,0 +1,64 @@
+package consensus
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+type speculativeApp struct {
+	finalized, speculated, committed int
+}
+
+func (app *speculativeApp) FinalizeBlock(ctx context.Context, req FinalizeBlockRequest) (FinalizeBlockResponse, error) {
+	app.finalized++
+	return FinalizeBlockResponse{AppHash: []byte{1}}, nil
+}
+
+func (app *speculativeApp) FinalizeBlockSpeculative(ctx context.Context, req FinalizeBlockRequest) (FinalizeBlockResponse, func() error, error) {
+	app.speculated++
+	return FinalizeBlockResponse{AppHash: []byte{2}}, func() error {
+		app.committed++
+		return nil
+	}, nil
+}
+
+func TestSpeculativeExecution(t *testing.T) {
+	ctx := context.Background()
+	app := &speculativeApp{}
+	exec := NewDefaultBlockExecutor(nil, WithFinalizer(app))
+	speculator := exec.(Speculator)
+
+	state := *MakeGenesisChainState("test", 1000, []common.Address{{1}}, []int64{1}, 100, 1)
+	block := state.MakeBlock(1, NewCommit(0, 0, common.Hash{}, nil), common.Address{1})
+	header := *block.Header()
+	header.TimeMs++
+	other := &FullBlock{Block: types.NewBlockWithHeader(&header), LastCommit: block.LastCommit}
+
+	// the block decided is the one executed
+	speculator.Speculate(state, block)
+	newState, err := exec.ApplyBlock(ctx, state, block)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{2}, newState.AppHash)
+	assert.Equal(t, 0, app.finalized)
+	assert.Equal(t, 1, app.committed)
+
+	// another block is decided
+	speculator.Speculate(state, other)
+	newState, err = exec.ApplyBlock(ctx, state, block)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{1}, newState.AppHash)
+	assert.Equal(t, 1, app.finalized)
+	assert.Equal(t, 1, app.committed)
+
+	// canceled on a round change
+	speculator.Speculate(state, other)
+	speculator.CancelSpeculation(block.Hash())
+	newState, err = exec.ApplyBlock(ctx, state, other)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{1}, newState.AppHash)
+	assert.Equal(t, 2, app.finalized)
+}
@@ -0,0 +1,59 @@
+package consensus
+
+// Outbound proposals and votes wait in the send queue of the p2p layer, which
+// can be long after round skips. Once consensus has moved past them, sending
+// them only takes bandwidth from the current round.
+const (
+	staleRounds  = 2
+	staleHeights = 1
+)
+
+type heightRound struct {
+	height uint64
+	round  int32
+}
+
+// publishHeightRound makes the height and round available to HeightRound.
+// The caller must hold cs.mtx.
+func (cs *ConsensusState) publishHeightRound() {
+	cs.heightRound.Store(heightRound{height: cs.Height, round: cs.Round})
+}
+
+// HeightRound returns the current height and round without taking the
+// consensus lock, which is held while messages are queued for broadcast.
+func (cs *ConsensusState) HeightRound() (uint64, int32) {
+	hr, _ := cs.heightRound.Load().(heightRound)
+	return hr.height, hr.round
+}
+
+// IsStaleMessage tells whether a proposal or vote is no use to the peers at
+// height and round: it is at least staleRounds rounds behind, or staleHeights
+// heights. The precommits of the last height are kept one more height, as
+// the peers still committing the height may need them.
+func IsStaleMessage(msg Message, height uint64, round int32) bool {
+	var (
+		msgHeight uint64
+		msgRound  int32
+		heights   = uint64(staleHeights)
+	)
+	switch m := msg.(type) {
+	case *ProposalMessage:
+		msgHeight, msgRound = m.Proposal.Height, m.Proposal.Round
+	case *VoteMessage:
+		msgHeight, msgRound = m.Vote.Height, m.Vote.Round
+		if m.Vote.Type == PrecommitType {
+			heights++
+		}
+	case *VoteExtension:
+		// like the precommit it extends
+		msgHeight, msgRound = m.Height, m.Round
+		heights++
+	default:
+		return false
+	}
+
+	if msgHeight+heights <= height {
+		return true
+	}
+	return msgHeight == height && msgRound+staleRounds <= round
+}
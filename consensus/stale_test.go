@@ -0,0 +1,28 @@
+package consensus
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsStaleMessage(t *testing.T) {
+	vote := func(height uint64, round int32, typ SignedMsgType) Message {
+		return &VoteMessage{Vote: &Vote{Height: height, Round: round, Type: typ}}
+	}
+
+	assert.False(t, IsStaleMessage(vote(5, 1, PrevoteType), 5, 2))
+	assert.True(t, IsStaleMessage(vote(5, 1, PrevoteType), 5, 3))
+	assert.True(t, IsStaleMessage(vote(4, 3, PrevoteType), 5, 0))
+
+	// precommits of the last height are still sent
+	assert.False(t, IsStaleMessage(vote(4, 3, PrecommitType), 5, 0))
+	assert.True(t, IsStaleMessage(vote(3, 0, PrecommitType), 5, 0))
+
+	proposal := &ProposalMessage{Proposal: &Proposal{Height: 5, Round: 0}}
+	assert.False(t, IsStaleMessage(proposal, 5, 1))
+	assert.True(t, IsStaleMessage(proposal, 5, 2))
+	assert.True(t, IsStaleMessage(proposal, 6, 0))
+
+	assert.False(t, IsStaleMessage(&ConsensusSyncRequest{}, 6, 0))
+}
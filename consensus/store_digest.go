@@ -0,0 +1,241 @@
+package consensus
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// The block store, the state store and the WAL may be on different disks, and
+// backed up separately. Restoring them from backups of different times makes
+// a node whose WAL and state do not match its blocks, which may sign votes
+// conflicting with the ones it already sent. After every commit, a digest of
+// the committed height is written to each of them; at startup, the digests
+// must agree with each other and with what the stores hold, see
+// StoreDigests.Check.
+
+var ErrStoresInconsistent = errors.New("stores inconsistent")
+
+var storeDigestKey = []byte("store_digest")
+
+const storeDigestFile = "store_digest.json"
+
+// StoreDigest is the state of the stores after a committed height.
+type StoreDigest struct {
+	Height         uint64        `json:"height"`
+	BlockHash      common.Hash   `json:"block_hash"`
+	AppHash        hexutil.Bytes `json:"app_hash"`
+	ValidatorsHash common.Hash   `json:"validators_hash"`
+}
+
+// NewStoreDigest returns the digest of the stores holding state.
+func NewStoreDigest(state ChainState) StoreDigest {
+	return StoreDigest{
+		Height:         state.LastBlockHeight,
+		BlockHash:      state.LastBlockID,
+		AppHash:        state.AppHash,
+		ValidatorsHash: validatorsHash(state.Validators),
+	}
+}
+
+func (d StoreDigest) equal(o StoreDigest) bool {
+	return d.Height == o.Height && d.BlockHash == o.BlockHash && bytes.Equal(d.AppHash, o.AppHash) && d.ValidatorsHash == o.ValidatorsHash
+}
+
+func validatorsHash(vals *ValidatorSet) common.Hash {
+	if vals == nil {
+		return common.Hash{}
+	}
+	h := sha256.New()
+	var b [8]byte
+	for _, val := range vals.Validators {
+		h.Write(val.Address[:])
+		binary.BigEndian.PutUint64(b[:], uint64(val.VotingPower))
+		h.Write(b[:])
+	}
+	return common.BytesToHash(h.Sum(nil))
+}
+
+// StoreDigests writes the digests to the stores and checks them.
+type StoreDigests struct {
+	blockDB *leveldb.DB
+	stateDB *leveldb.DB // nil if the state is in the block store
+	walDir  string      // empty without WAL
+}
+
+// NewStoreDigests returns the digests of the block store, the state store,
+// which may be the same, and the WAL dir, which is empty without WAL.
+func NewStoreDigests(blockDB, stateDB *leveldb.DB, walDir string) *StoreDigests {
+	sd := &StoreDigests{blockDB: blockDB, walDir: walDir}
+	if stateDB != blockDB {
+		sd.stateDB = stateDB
+	}
+	return sd
+}
+
+// RecordStoreDigests records the digest of the stores after every commit.
+func RecordStoreDigests(sd *StoreDigests) StateOption {
+	return func(cs *ConsensusState) {
+		cs.storeDigests = sd
+	}
+}
+
+// Record writes d to every store.
+func (sd *StoreDigests) Record(d StoreDigest) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	if err := sd.blockDB.Put(storeDigestKey, data, nil); err != nil {
+		return fmt.Errorf("block store: %w", err)
+	}
+	if sd.stateDB != nil {
+		if err := sd.stateDB.Put(storeDigestKey, data, nil); err != nil {
+			return fmt.Errorf("state store: %w", err)
+		}
+	}
+	if sd.walDir != "" {
+		if err := writeDigestFile(filepath.Join(sd.walDir, storeDigestFile), data); err != nil {
+			return fmt.Errorf("wal: %w", err)
+		}
+	}
+	return nil
+}
+
+// writeDigestFile replaces the file at path with data, so that a crash leaves
+// either the old digest or the new one.
+func writeDigestFile(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), storeDigestFile+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// load returns the digests of the stores having one, by store name.
+func (sd *StoreDigests) load() (map[string]StoreDigest, error) {
+	digests := make(map[string]StoreDigest)
+	add := func(name string, data []byte) error {
+		var d StoreDigest
+		if err := json.Unmarshal(data, &d); err != nil {
+			return fmt.Errorf("%w: invalid digest of the %s: %v", ErrStoresInconsistent, name, err)
+		}
+		digests[name] = d
+		return nil
+	}
+	fromDB := func(name string, db *leveldb.DB) error {
+		data, err := db.Get(storeDigestKey, nil)
+		if errors.Is(err, leveldb.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return add(name, data)
+	}
+
+	if err := fromDB("block store", sd.blockDB); err != nil {
+		return nil, err
+	}
+	if sd.stateDB != nil {
+		if err := fromDB("state store", sd.stateDB); err != nil {
+			return nil, err
+		}
+	}
+	if sd.walDir != "" {
+		data, err := ioutil.ReadFile(filepath.Join(sd.walDir, storeDigestFile))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			if err := add("wal", data); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return digests, nil
+}
+
+// Check checks that the digests of the stores agree, and that the block store
+// and the app hashes, if recorded, hold the latest one. A crash while they
+// are written may leave some stores a height behind the others, which is
+// tolerated. A store without digest, e.g., new, is not checked. Check returns
+// the latest digest, nil if there is none.
+func (sd *StoreDigests) Check(bs BlockStore, appHashes *AppHashStore) (*StoreDigest, error) {
+	digests, err := sd.load()
+	if err != nil || len(digests) == 0 {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(digests))
+	for name := range digests {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	latest := digests[names[0]]
+	for _, name := range names {
+		if digests[name].Height > latest.Height {
+			latest = digests[name]
+		}
+	}
+	for _, name := range names {
+		d := digests[name]
+		if d.equal(latest) || d.Height+1 == latest.Height {
+			continue
+		}
+		return nil, fmt.Errorf("%w: the %s is at height %d, while the stores are at height %d (block %v), e.g., restored from another backup",
+			ErrStoresInconsistent, name, d.Height, latest.Height, latest.BlockHash)
+	}
+
+	if _, ok := digests["block store"]; ok {
+		block := bs.LoadBlock(latest.Height)
+		if block == nil {
+			return nil, fmt.Errorf("%w: block store at height %d, below the committed height %d", ErrStoresInconsistent, bs.Height(), latest.Height)
+		}
+		if block.Hash() != latest.BlockHash {
+			return nil, fmt.Errorf("%w: block %v stored at height %d, committed %v", ErrStoresInconsistent, block.Hash(), latest.Height, latest.BlockHash)
+		}
+	}
+	if appHashes != nil {
+		if appHash, ok := appHashes.Load(latest.Height); ok && !bytes.Equal(appHash, latest.AppHash) {
+			return nil, fmt.Errorf("%w: app hash %x recorded at height %d, committed %x", ErrStoresInconsistent, appHash, latest.Height, []byte(latest.AppHash))
+		}
+	}
+	return &latest, nil
+}
+
+// recordStoreDigest records the digest of the stores after state was
+// committed.
+func (cs *ConsensusState) recordStoreDigest(state ChainState) {
+	if cs.storeDigests == nil {
+		return
+	}
+	if err := cs.storeDigests.Record(NewStoreDigest(state)); err != nil {
+		log.Error("failed to record the store digest", "height", state.LastBlockHeight, "err", err)
+	}
+}
@@ -0,0 +1,92 @@
+package consensus
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestStoreDigests(t *testing.T) {
+	blockDB, err := leveldb.Open(storage.NewMemStorage(), nil)
+	require.NoError(t, err)
+	stateDB, err := leveldb.Open(storage.NewMemStorage(), nil)
+	require.NoError(t, err)
+	walDir := t.TempDir()
+	appHashes := NewAppHashStore(stateDB)
+
+	state := *MakeGenesisChainState("test", 1000, []common.Address{{1}}, []int64{1}, 100, 1)
+	bs := &replayBlockStore{blocks: make(map[uint64]*FullBlock)}
+	var digests []StoreDigest
+	for height := uint64(1); height <= 3; height++ {
+		block := state.MakeBlock(height, NewCommit(0, 0, common.Hash{}, nil), common.Address{1})
+		bs.blocks[height] = block
+		state.LastBlockHeight = height
+		state.LastBlockID = block.Hash()
+		state.AppHash = []byte{byte(height)}
+		require.NoError(t, appHashes.Save(height, state.AppHash))
+		digests = append(digests, NewStoreDigest(state))
+	}
+
+	// new stores
+	sd := NewStoreDigests(blockDB, stateDB, walDir)
+	d, err := sd.Check(bs, appHashes)
+	assert.NoError(t, err)
+	assert.Nil(t, d)
+
+	require.NoError(t, sd.Record(digests[2]))
+	d, err = sd.Check(bs, appHashes)
+	require.NoError(t, err)
+	assert.Equal(t, digests[2], *d)
+
+	// a crash while recording
+	require.NoError(t, NewStoreDigests(blockDB, nil, "").Record(digests[1]))
+	_, err = sd.Check(bs, appHashes)
+	assert.NoError(t, err)
+
+	// the WAL of an older backup
+	walOnly := NewStoreDigests(blockDB, blockDB, walDir)
+	require.NoError(t, walOnly.Record(digests[0]))
+	_, err = sd.Check(bs, appHashes)
+	assert.ErrorIs(t, err, ErrStoresInconsistent)
+
+	// the block store of another chain
+	require.NoError(t, sd.Record(digests[2]))
+	other := digests[2]
+	other.BlockHash = common.Hash{1}
+	require.NoError(t, NewStoreDigests(blockDB, nil, "").Record(other))
+	_, err = sd.Check(bs, appHashes)
+	assert.ErrorIs(t, err, ErrStoresInconsistent)
+
+	// the blocks do not match the digests
+	require.NoError(t, sd.Record(digests[2]))
+	block := bs.blocks[3]
+	bs.blocks[3] = bs.blocks[2]
+	_, err = sd.Check(bs, appHashes)
+	assert.ErrorIs(t, err, ErrStoresInconsistent)
+	delete(bs.blocks, 3)
+	_, err = sd.Check(bs, appHashes)
+	assert.ErrorIs(t, err, ErrStoresInconsistent)
+
+	// the app hashes do not match the digests
+	bs.blocks[3] = block
+	require.NoError(t, appHashes.Save(3, []byte{0xff}))
+	_, err = sd.Check(bs, appHashes)
+	assert.ErrorIs(t, err, ErrStoresInconsistent)
+	require.NoError(t, appHashes.Save(3, []byte{3}))
+	_, err = sd.Check(bs, appHashes)
+	assert.NoError(t, err)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(walDir, storeDigestFile), []byte("{"), 0600))
+	_, err = sd.Check(bs, appHashes)
+	assert.ErrorIs(t, err, ErrStoresInconsistent)
+	require.NoError(t, os.Remove(filepath.Join(walDir, storeDigestFile)))
+	_, err = sd.Check(bs, appHashes)
+	assert.NoError(t, err)
+}
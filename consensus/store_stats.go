@@ -0,0 +1,194 @@
+package consensus
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/QuarkChain/go-minimal-pbft/internal/testhook"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// LevelDB only reclaims the space of deleted and overwritten keys when it
+// compacts the tables they are in, which it does as tables are written. Once
+// a store is pruned, the space of its old blocks may never be reclaimed: the
+// stores are compacted on request after pruning, and periodically.
+
+// Store is a database of the node, e.g. the block store.
+type Store struct {
+	Name string
+	Path string
+	DB   *leveldb.DB
+}
+
+type StoreLevelStats struct {
+	Level     int   `json:"level"`
+	Tables    int   `json:"tables"`
+	SizeBytes int64 `json:"size_bytes"`
+}
+
+type StoreStats struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	// of all the files of the store, logs included
+	DiskBytes         uint64            `json:"disk_bytes"`
+	Levels            []StoreLevelStats `json:"levels"`
+	LastCompactionMs  uint64            `json:"last_compaction_ms,omitempty"`
+	CompactionSeconds float64           `json:"compaction_seconds,omitempty"`
+}
+
+var (
+	storeDiskBytesDesc = prometheus.NewDesc(
+		"store_disk_bytes",
+		"Disk usage of the files of a store",
+		[]string{"store"}, nil)
+	storeLevelBytesDesc = prometheus.NewDesc(
+		"store_level_bytes",
+		"Size of the tables of a level of a store",
+		[]string{"store", "level"}, nil)
+
+	storeCompactions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "store_compactions_total",
+			Help: "Total number of full compactions of a store",
+		}, []string{"store"})
+)
+
+// the stores reported by the store metrics, the last ones run
+var storeMetricsStores atomic.Value
+
+// Stores reports the disk usage of the stores and compacts them.
+type Stores struct {
+	stores    []Store
+	compactC  chan struct{}
+	compactMu sync.Mutex // one compaction at a time
+
+	mu          sync.Mutex
+	compactions map[string]StoreStats // the last compaction of the stores
+}
+
+func NewStores(stores ...Store) *Stores {
+	return &Stores{
+		stores:      stores,
+		compactC:    make(chan struct{}, 1),
+		compactions: make(map[string]StoreStats),
+	}
+}
+
+// Stats returns the disk usage of every store.
+func (s *Stores) Stats() []StoreStats {
+	stats := make([]StoreStats, 0, len(s.stores))
+	for _, store := range s.stores {
+		s.mu.Lock()
+		st := s.compactions[store.Name]
+		s.mu.Unlock()
+		st.Name, st.Path = store.Name, store.Path
+		st.DiskBytes = diskUsage(store.Path)
+
+		var dbStats leveldb.DBStats
+		if err := store.DB.Stats(&dbStats); err != nil {
+			log.Warn("cannot get store stats", "store", store.Name, "err", err)
+		} else {
+			for level, size := range dbStats.LevelSizes {
+				st.Levels = append(st.Levels, StoreLevelStats{Level: level, Tables: dbStats.LevelTablesCounts[level], SizeBytes: size})
+			}
+		}
+		stats = append(stats, st)
+	}
+	return stats
+}
+
+func diskUsage(path string) uint64 {
+	var size uint64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += uint64(info.Size())
+		}
+		return nil
+	})
+	return size
+}
+
+// Compact compacts every store in full, which blocks writes while it runs.
+func (s *Stores) Compact() error {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	for _, store := range s.stores {
+		start := time.Now()
+		before := diskUsage(store.Path)
+		if err := store.DB.CompactRange(util.Range{}); err != nil {
+			return err
+		}
+		storeCompactions.WithLabelValues(store.Name).Inc()
+
+		s.mu.Lock()
+		s.compactions[store.Name] = StoreStats{
+			LastCompactionMs:  uint64(testhook.Now().UnixMilli()),
+			CompactionSeconds: time.Since(start).Seconds(),
+		}
+		s.mu.Unlock()
+		log.Info("Compacted store", "store", store.Name, "before", before, "after", diskUsage(store.Path), "elapsed", time.Since(start))
+	}
+	return nil
+}
+
+// RequestCompaction makes Run compact the stores, e.g., after pruning them.
+func (s *Stores) RequestCompaction() {
+	select {
+	case s.compactC <- struct{}{}:
+	default:
+	}
+}
+
+// Run reports the stores in the metrics, and compacts them on request and
+// every interval (0 for never) until the context is canceled.
+func (s *Stores) Run(ctx context.Context, interval time.Duration) {
+	storeMetricsStores.Store(s)
+
+	var tickC <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tickC = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tickC:
+		case <-s.compactC:
+		}
+		if err := s.Compact(); err != nil {
+			log.Error("Failed to compact stores", "err", err)
+		}
+	}
+}
+
+type storeCollector struct{}
+
+func (storeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- storeDiskBytesDesc
+	ch <- storeLevelBytesDesc
+}
+
+func (storeCollector) Collect(ch chan<- prometheus.Metric) {
+	s, ok := storeMetricsStores.Load().(*Stores)
+	if !ok {
+		return
+	}
+	for _, st := range s.Stats() {
+		ch <- prometheus.MustNewConstMetric(storeDiskBytesDesc, prometheus.GaugeValue, float64(st.DiskBytes), st.Name)
+		for _, level := range st.Levels {
+			ch <- prometheus.MustNewConstMetric(storeLevelBytesDesc, prometheus.GaugeValue, float64(level.SizeBytes), st.Name, strconv.Itoa(level.Level))
+		}
+	}
+}
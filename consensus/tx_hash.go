@@ -0,0 +1,43 @@
+package consensus
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// TxHasher is implemented by the applications whose txs are identified by
+// another hash than the one of their encoding, e.g., one excluding the
+// signatures, so that a tx re-signed by its sender keeps its identity. The
+// hash is the identity of the txs everywhere in the node: in the RPC results,
+// and in the mempool and indexer keyed by it.
+type TxHasher interface {
+	TxHash(tx *types.Transaction) common.Hash
+}
+
+// TxHash passes the tx to the finalizer, the hash of its encoding if the
+// finalizer does not hash txs.
+func (be *DefaultBlockExecutor) TxHash(tx *types.Transaction) common.Hash {
+	if hasher, ok := be.finalizer.(TxHasher); ok {
+		return hasher.TxHash(tx)
+	}
+	return tx.Hash()
+}
+
+// TxHash is the hash of tx by the executor, if it implements TxHasher, else
+// the hash of its encoding.
+func TxHash(executor BlockExecutor, tx *types.Transaction) common.Hash {
+	if hasher, ok := executor.(TxHasher); ok {
+		return hasher.TxHash(tx)
+	}
+	return tx.Hash()
+}
+
+// TxHashes hashes the txs of a block with TxHash.
+func TxHashes(executor BlockExecutor, block *FullBlock) []common.Hash {
+	txs := block.Transactions()
+	hashes := make([]common.Hash, len(txs))
+	for i, tx := range txs {
+		hashes[i] = TxHash(executor, tx)
+	}
+	return hashes
+}
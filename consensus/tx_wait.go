@@ -0,0 +1,83 @@
+package consensus
+
+import (
+	"context"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// Without txs, a chain may not need blocks. With EmptyBlocks, round 0 waits
+// in the new round step until txs are pending in the TxSource, and is then
+// proposed right away. A proposal received meanwhile is prevoted as usual,
+// so the validators without the txs yet follow the proposer. With an
+// interval, an empty block is still made interval after the last block.
+
+// TxNotifier is the source of the txs of the proposed blocks.
+type TxNotifier interface {
+	// HasTxs tells whether txs are pending.
+	HasTxs() bool
+	// TxsAvailable receives after txs became pending.
+	TxsAvailable() <-chan struct{}
+}
+
+type emptyBlocks struct {
+	skip     bool
+	interval time.Duration
+}
+
+// wait tells whether round 0 waits for txs.
+func (eb emptyBlocks) wait() bool {
+	return eb.skip || eb.interval > 0
+}
+
+// TxSource sets where the txs to wait for come from, see EmptyBlocks.
+func TxSource(txs TxNotifier) StateOption {
+	return func(cs *ConsensusState) {
+		cs.txs = txs
+	}
+}
+
+// EmptyBlocks sets when blocks are made without txs: with create, always if
+// interval is 0, else interval after the last block; without create, only
+// after interval if not 0.
+func EmptyBlocks(create bool, interval time.Duration) StateOption {
+	return func(cs *ConsensusState) {
+		cs.emptyBlocks = emptyBlocks{skip: !create, interval: interval}
+	}
+}
+
+// waitForTxs tells whether round 0 is to wait for txs, scheduling the empty
+// block of the interval, if any.
+func (cs *ConsensusState) waitForTxs(height uint64, round int32) bool {
+	if round != 0 || cs.replayMode || !cs.emptyBlocks.wait() || (cs.txs != nil && cs.txs.HasTxs()) {
+		return false
+	}
+
+	if cs.emptyBlocks.interval > 0 {
+		interval := cs.emptyBlocks.interval
+		wait := proposerWait(cs.chainState.LastBlockTime, CanonicalNow(), interval, interval)
+		if wait <= 0 {
+			return false
+		}
+		cs.scheduleTimeout(wait, height, round, RoundStepNewRound)
+	}
+	log.Debug("waiting for txs to propose", "height", height)
+	return true
+}
+
+// txsAvailable is nil, never receiving, without a TxSource.
+func (cs *ConsensusState) txsAvailable() <-chan struct{} {
+	if cs.txs == nil {
+		return nil
+	}
+	return cs.txs.TxsAvailable()
+}
+
+func (cs *ConsensusState) handleTxsAvailable(ctx context.Context) {
+	// a notification may be left from txs proposed since
+	if cs.Round != 0 || cs.Step != RoundStepNewRound || !cs.txs.HasTxs() {
+		return
+	}
+	cs.enterPropose(ctx, cs.Height, 0)
+}
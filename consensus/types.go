@@ -1,8 +1,11 @@
 package consensus
 
 import (
+	"errors"
+	"fmt"
 	"time"
 
+	"github.com/QuarkChain/go-minimal-pbft/internal/testhook"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/params"
 )
@@ -23,7 +26,8 @@ type (
 	ProposalMessage = types.ProposalMessage
 	ConsensusConfig = params.ConsensusConfig
 
-	Header = types.Header
+	Header   = types.Header
+	BitArray = types.BitArray
 
 	ErrVoteConflictingVotes = types.ErrVoteConflictingVotes
 )
@@ -52,15 +56,42 @@ var (
 // 	return &Block{Header: header, Body: body, LastCommit: lastCommit}
 // }
 
+// MaxSignatureSize is the largest vote signature of the enabled key types.
+// Key types with larger signatures (e.g. dilithium) raise it in init.
 var MaxSignatureSize = 65
 
+var ErrSignatureSize = errors.New("signature exceeds max signature size")
+
+// ValidateSignatureSize checks a decoded signature against MaxSignatureSize,
+// before it is verified or kept.
+func ValidateSignatureSize(sig []byte) error {
+	if len(sig) > MaxSignatureSize {
+		return fmt.Errorf("%w: %d bytes, at most %d", ErrSignatureSize, len(sig), MaxSignatureSize)
+	}
+	return nil
+}
+
+// ValidateCommitSignatureSizes checks the signatures of a decoded commit
+// against MaxSignatureSize. A nil commit has none.
+func ValidateCommitSignatureSizes(commit *Commit) error {
+	if commit == nil {
+		return nil
+	}
+	for i := range commit.Signatures {
+		if err := ValidateSignatureSize(commit.Signatures[i].Signature); err != nil {
+			return fmt.Errorf("commit signature %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
 // Now returns the current time in UTC with no monotonic component.
 func CanonicalNow() time.Time {
-	return Canonical(time.Now())
+	return Canonical(testhook.Now())
 }
 
 func CanonicalNowMs() int64 {
-	return time.Now().UnixMilli()
+	return testhook.Now().UnixMilli()
 }
 
 // Canonical returns UTC time with no monotonic component.
@@ -83,6 +114,7 @@ type ConsensusSyncRequest struct {
 // Internal struct to request async
 type consensusSyncRequestAsync struct {
 	req      *ConsensusSyncRequest
+	peerID   string
 	respChan chan []interface{}
 }
 
@@ -15,6 +15,65 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
+// makeTestValidators returns a set of n validators, of addresses and voting
+// powers 1 to n, and the addresses.
+func makeTestValidators(n int) (*ValidatorSet, []common.Address) {
+	addrs := make([]common.Address, n)
+	powers := make([]int64, n)
+	for i := range addrs {
+		addrs[i] = common.BigToAddress(big.NewInt(int64(i + 1)))
+		powers[i] = int64(i + 1)
+	}
+	return NewValidatorSet(addrs, powers, 1), addrs
+}
+
+// makeTestCommit returns a set of n validators of equal power, their keys
+// generated by genKey, and their commit of blockHash at height 1 of chain
+// "test": the first nilVotes validators (in set order) vote nil, the last
+// absent ones do not vote. The validator at index i votes at 1000+i.
+func makeTestCommit(t *testing.T, genKey func() PrivValidator, n, nilVotes, absent int, blockHash common.Hash) (*ValidatorSet, *Commit) {
+	pvs := make(map[common.Address]PrivValidator, n)
+	addrs := make([]common.Address, n)
+	powers := make([]int64, n)
+	var pubKeys []PubKey
+	for i := range addrs {
+		pv := genKey()
+		pubKey, err := pv.GetPubKey(context.Background())
+		assert.NoError(t, err)
+		addrs[i] = pubKey.Address()
+		pvs[addrs[i]] = pv
+		powers[i] = 1
+		// the default keys are recovered from the signatures
+		if pubKey.Type() != EcdsaPubKeyType {
+			pubKeys = append(pubKeys, pubKey)
+		}
+	}
+
+	vals := NewValidatorSet(addrs, powers, 4)
+	SetValidatorPubKeys(vals, pubKeys)
+	vs := NewVoteSet("test", 1, 0, PrecommitType, vals)
+	for i := 0; i < n-absent; i++ {
+		// the set sorts the validators
+		_, val := vals.GetByIndex(int32(i))
+		vote := &Vote{
+			ValidatorAddress: val.Address,
+			ValidatorIndex:   int32(i),
+			Height:           1,
+			Round:            0,
+			TimestampMs:      1000 + uint64(i),
+			Type:             PrecommitType,
+			BlockID:          blockHash,
+		}
+		if i < nilVotes {
+			vote.BlockID = common.Hash{}
+		}
+		assert.NoError(t, pvs[val.Address].SignVote(context.Background(), "test", vote))
+		_, err := vs.AddVote(vote)
+		assert.NoError(t, err)
+	}
+	return vals, vs.MakeCommit()
+}
+
 func TestSerdeCommitSig(t *testing.T) {
 	c := CommitSig{
 		BlockIDFlag:      BlockIDFlagCommit,
@@ -0,0 +1,54 @@
+package consensus
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ValidatorIndex looks up the validators of a set by address in O(1), where
+// ValidatorSet.GetByAddress scans the set. Build one per set for the code
+// looking up many validators, e.g., per signature of a commit.
+//
+// The index is of the addresses of the set when it is built: a set copied
+// and updated by IncrementProposerPriority keeps its validators, but one
+// changed otherwise needs a new index.
+type ValidatorIndex struct {
+	vals      *ValidatorSet
+	byAddress map[common.Address]int32
+}
+
+func NewValidatorIndex(vals *ValidatorSet) *ValidatorIndex {
+	idx := &ValidatorIndex{vals: vals, byAddress: make(map[common.Address]int32, len(vals.Validators))}
+	for i, val := range vals.Validators {
+		idx.byAddress[val.Address] = int32(i)
+	}
+	return idx
+}
+
+// GetByAddress returns the index and the validator of an address, -1 and nil
+// if it is not in the set.
+func (idx *ValidatorIndex) GetByAddress(addr common.Address) (int32, *Validator) {
+	i, ok := idx.byAddress[addr]
+	if !ok {
+		return -1, nil
+	}
+	return i, idx.vals.Validators[i]
+}
+
+// GetByIndex returns the address and the validator at an index, nil if it is
+// out of the set.
+func (idx *ValidatorIndex) GetByIndex(i int32) (common.Address, *Validator) {
+	if i < 0 || int(i) >= len(idx.vals.Validators) {
+		return common.Address{}, nil
+	}
+	val := idx.vals.Validators[i]
+	return val.Address, val
+}
+
+func (idx *ValidatorIndex) Size() int {
+	return len(idx.vals.Validators)
+}
+
+func (idx *ValidatorIndex) HasAddress(addr common.Address) bool {
+	_, ok := idx.byAddress[addr]
+	return ok
+}
@@ -0,0 +1,54 @@
+package consensus
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidatorIndex(t *testing.T) {
+	vals, addrs := makeTestValidators(16)
+	idx := NewValidatorIndex(vals)
+
+	for _, addr := range addrs {
+		i, val := idx.GetByAddress(addr)
+		wantI, wantVal := vals.GetByAddress(addr)
+		assert.Equal(t, wantI, i)
+		assert.Equal(t, wantVal, val)
+		assert.True(t, idx.HasAddress(addr))
+
+		gotAddr, gotVal := idx.GetByIndex(i)
+		assert.Equal(t, addr, gotAddr)
+		assert.Equal(t, val, gotVal)
+	}
+
+	unknown := common.BigToAddress(big.NewInt(1000))
+	i, val := idx.GetByAddress(unknown)
+	assert.Equal(t, int32(-1), i)
+	assert.Nil(t, val)
+	assert.False(t, idx.HasAddress(unknown))
+
+	_, val = idx.GetByIndex(int32(len(addrs)))
+	assert.Nil(t, val)
+	_, val = idx.GetByIndex(-1)
+	assert.Nil(t, val)
+}
+
+func BenchmarkValidatorSetGetByAddress(b *testing.B) {
+	vals, addrs := makeTestValidators(1024)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		vals.GetByAddress(addrs[i%len(addrs)])
+	}
+}
+
+func BenchmarkValidatorIndexGetByAddress(b *testing.B) {
+	vals, addrs := makeTestValidators(1024)
+	idx := NewValidatorIndex(vals)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		idx.GetByAddress(addrs[i%len(addrs)])
+	}
+}
@@ -0,0 +1,257 @@
+package consensus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var ErrValidatorsNotFound = errors.New("validators not found")
+
+var (
+	validatorsPrefix    = []byte("validators")
+	validatorsLatestKey = []byte("latest_validators")
+)
+
+// ValidatorInfo is a validator of the set of a height. PubKey is in the
+// ParsePubKey format.
+type ValidatorInfo struct {
+	Address common.Address `json:"address"`
+	PubKey  string         `json:"pub_key"`
+	Power   int64          `json:"power"`
+}
+
+type validatorRecord struct {
+	Address common.Address
+	PubKey  string
+	Power   uint64
+}
+
+// ValidatorPowerChange is a validator in both sets of a ValidatorSetDiff,
+// with another voting power.
+type ValidatorPowerChange struct {
+	Address  common.Address `json:"address"`
+	PubKey   string         `json:"pub_key"`
+	OldPower int64          `json:"old_power"`
+	NewPower int64          `json:"new_power"`
+}
+
+// ValidatorSetDiff is how the validator set of height To differs from the one
+// of height From.
+type ValidatorSetDiff struct {
+	From         uint64                 `json:"from"`
+	To           uint64                 `json:"to"`
+	Joined       []ValidatorInfo        `json:"joined"`
+	Left         []ValidatorInfo        `json:"left"`
+	PowerChanges []ValidatorPowerChange `json:"power_changes"`
+}
+
+// ValidatorStore keeps the validator set of every height, written only at the
+// heights they change: the set of a height is the one of the highest entry up
+// to it. The executor records the sets of the heights each applied block
+// makes known, see WithValidatorStore.
+type ValidatorStore struct {
+	db *leveldb.DB
+}
+
+func NewValidatorStore(db *leveldb.DB) *ValidatorStore {
+	return &ValidatorStore{db: db}
+}
+
+func (s *ValidatorStore) key(height uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], height)
+	return append(append([]byte{}, validatorsPrefix...), b[:]...)
+}
+
+// Latest is the highest height the validators are known of, 0 if none.
+func (s *ValidatorStore) Latest() uint64 {
+	data, err := s.db.Get(validatorsLatestKey, nil)
+	if err != nil || len(data) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(data)
+}
+
+func pubKeyString(val *Validator) string {
+	if str, ok := val.PubKey.(fmt.Stringer); ok {
+		return str.String()
+	}
+	return val.Address.Hex()
+}
+
+// ValidatorInfos returns the validators of a set, in validator set order.
+func ValidatorInfos(vals *ValidatorSet) []ValidatorInfo {
+	infos := make([]ValidatorInfo, len(vals.Validators))
+	for i, val := range vals.Validators {
+		infos[i] = ValidatorInfo{Address: val.Address, PubKey: pubKeyString(val), Power: val.VotingPower}
+	}
+	return infos
+}
+
+// SameValidators returns whether two sets have the same validators, keys
+// and powers, in the same order.
+func SameValidators(a, b []ValidatorInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// NewValidatorSetFromInfos returns the validator set of infos, with the keys
+// set, e.g., to verify the commits of a height with the set of Load.
+func NewValidatorSetFromInfos(infos []ValidatorInfo, proposerRepetition int64) (*ValidatorSet, error) {
+	addrs := make([]common.Address, len(infos))
+	powers := make([]int64, len(infos))
+	pubKeys := make([]PubKey, len(infos))
+	for i, info := range infos {
+		pubKey, err := ParsePubKey(info.PubKey)
+		if err != nil {
+			return nil, err
+		}
+		if pubKey.Address() != info.Address {
+			return nil, fmt.Errorf("key %s is not the one of validator %v", info.PubKey, info.Address)
+		}
+		addrs[i], powers[i], pubKeys[i] = info.Address, info.Power, pubKey
+	}
+	if err := ValidateValidatorUpdate(addrs, powers); err != nil {
+		return nil, err
+	}
+
+	vals := NewValidatorSet(addrs, powers, proposerRepetition)
+	SetValidatorPubKeys(vals, pubKeys)
+	return vals, nil
+}
+
+// Save records the validator set of a height. Heights must be saved in
+// order; a set equal to the one of the previous entry is not written again.
+func (s *ValidatorStore) Save(height uint64, vals *ValidatorSet) error {
+	latest := s.Latest()
+	if height <= latest {
+		return nil
+	}
+
+	infos := ValidatorInfos(vals)
+	batch := new(leveldb.Batch)
+	if prev, err := s.Load(latest); err != nil || !SameValidators(prev, infos) {
+		records := make([]validatorRecord, len(infos))
+		for i, info := range infos {
+			records[i] = validatorRecord{Address: info.Address, PubKey: info.PubKey, Power: uint64(info.Power)}
+		}
+		data, err := rlp.EncodeToBytes(records)
+		if err != nil {
+			return err
+		}
+		batch.Put(s.key(height), data)
+	}
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], height)
+	batch.Put(validatorsLatestKey, b[:])
+	return s.db.Write(batch, nil)
+}
+
+// saveApplied records the sets made known by applying the block of
+// state.LastBlockHeight+1, which gave newState: the validators of the block
+// and of the next two heights.
+func (s *ValidatorStore) saveApplied(state, newState ChainState) {
+	height := newState.LastBlockHeight
+	for i, vals := range []*ValidatorSet{state.Validators, newState.Validators, newState.NextValidators} {
+		if err := s.Save(height+uint64(i), vals); err != nil {
+			log.Error("cannot save validators", "height", height+uint64(i), "err", err)
+			return
+		}
+	}
+}
+
+// Load returns the validator set of a height, in validator set order.
+func (s *ValidatorStore) Load(height uint64) ([]ValidatorInfo, error) {
+	if height == 0 || height > s.Latest() {
+		return nil, fmt.Errorf("%w at height %d", ErrValidatorsNotFound, height)
+	}
+
+	it := s.db.NewIterator(util.BytesPrefix(validatorsPrefix), nil)
+	defer it.Release()
+	key := s.key(height)
+	ok := it.Seek(key)
+	if !ok {
+		ok = it.Last()
+	} else if !bytes.Equal(it.Key(), key) {
+		ok = it.Prev()
+	}
+	if !ok {
+		return nil, fmt.Errorf("%w at height %d", ErrValidatorsNotFound, height)
+	}
+
+	var records []validatorRecord
+	if err := rlp.DecodeBytes(it.Value(), &records); err != nil {
+		return nil, err
+	}
+	infos := make([]ValidatorInfo, len(records))
+	for i, r := range records {
+		infos[i] = ValidatorInfo{Address: r.Address, PubKey: r.PubKey, Power: int64(r.Power)}
+	}
+	return infos, nil
+}
+
+// ValidatorSetDiff returns the validators joining, leaving and changing
+// voting power between the sets of heights from and to.
+func (s *ValidatorStore) ValidatorSetDiff(from, to uint64) (*ValidatorSetDiff, error) {
+	fromVals, err := s.Load(from)
+	if err != nil {
+		return nil, err
+	}
+	toVals, err := s.Load(to)
+	if err != nil {
+		return nil, err
+	}
+	return DiffValidators(from, to, fromVals, toVals), nil
+}
+
+// DiffValidators compares two validator sets, the results are in the order
+// of the sets.
+func DiffValidators(from, to uint64, fromVals, toVals []ValidatorInfo) *ValidatorSetDiff {
+	diff := &ValidatorSetDiff{
+		From:         from,
+		To:           to,
+		Joined:       []ValidatorInfo{},
+		Left:         []ValidatorInfo{},
+		PowerChanges: []ValidatorPowerChange{},
+	}
+
+	old := make(map[common.Address]ValidatorInfo, len(fromVals))
+	for _, val := range fromVals {
+		old[val.Address] = val
+	}
+	kept := make(map[common.Address]bool, len(toVals))
+	for _, val := range toVals {
+		prev, ok := old[val.Address]
+		if !ok {
+			diff.Joined = append(diff.Joined, val)
+			continue
+		}
+		kept[val.Address] = true
+		if prev.Power != val.Power {
+			diff.PowerChanges = append(diff.PowerChanges, ValidatorPowerChange{
+				Address: val.Address, PubKey: val.PubKey, OldPower: prev.Power, NewPower: val.Power,
+			})
+		}
+	}
+	for _, val := range fromVals {
+		if !kept[val.Address] {
+			diff.Left = append(diff.Left, val)
+		}
+	}
+	return diff
+}
@@ -0,0 +1,50 @@
+package consensus
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestValidatorStoreDiff(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	assert.NoError(t, err)
+	store := NewValidatorStore(db)
+
+	a, b, c := common.BytesToAddress([]byte{1}), common.BytesToAddress([]byte{2}), common.BytesToAddress([]byte{3})
+	set := func(addrs []common.Address, powers ...int64) *ValidatorSet {
+		vals := &ValidatorSet{}
+		for i, addr := range addrs {
+			vals.Validators = append(vals.Validators, &Validator{Address: addr, VotingPower: powers[i]})
+		}
+		return vals
+	}
+
+	assert.NoError(t, store.Save(1, set([]common.Address{a, b}, 1, 2)))
+	assert.NoError(t, store.Save(2, set([]common.Address{a, b}, 1, 2)))
+	assert.NoError(t, store.Save(3, set([]common.Address{b, c}, 5, 3)))
+	// already saved
+	assert.NoError(t, store.Save(2, set([]common.Address{c}, 1)))
+	assert.Equal(t, uint64(3), store.Latest())
+
+	vals, err := store.Load(2)
+	assert.NoError(t, err)
+	assert.Equal(t, []ValidatorInfo{{a, a.Hex(), 1}, {b, b.Hex(), 2}}, vals)
+	_, err = store.Load(4)
+	assert.ErrorIs(t, err, ErrValidatorsNotFound)
+
+	diff, err := store.ValidatorSetDiff(1, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, []ValidatorInfo{{c, c.Hex(), 3}}, diff.Joined)
+	assert.Equal(t, []ValidatorInfo{{a, a.Hex(), 1}}, diff.Left)
+	assert.Equal(t, []ValidatorPowerChange{{b, b.Hex(), 2, 5}}, diff.PowerChanges)
+
+	diff, err = store.ValidatorSetDiff(1, 2)
+	assert.NoError(t, err)
+	assert.Empty(t, diff.Joined)
+	assert.Empty(t, diff.Left)
+	assert.Empty(t, diff.PowerChanges)
+}
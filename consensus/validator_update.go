@@ -0,0 +1,105 @@
+package consensus
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var ErrInvalidValidatorUpdate = errors.New("invalid validator update")
+
+// ValidatorUpdate changes the voting power of a validator, returned by the
+// application in FinalizeBlockResponse. PubKey is in the ParsePubKey format;
+// power 0 removes the validator, and an unknown key with a positive power adds
+// it.
+//
+// The updates of block H change NextValidators, so they take effect at height
+// H+2: the validators of H+1 are already known when H is committed, and the
+// proposer and voters of H+1 must not depend on its execution.
+//
+// A validator added with a key whose signatures aggregate, e.g., BLS12-381,
+// must prove it holds the key with ProofOfPossession, see PossessionProver.
+type ValidatorUpdate struct {
+	PubKey            string `json:"pub_key"`
+	Power             int64  `json:"power"`
+	ProofOfPossession []byte `json:"proof_of_possession,omitempty"`
+}
+
+// applyValidatorUpdates returns the addresses, voting powers and keys of vals
+// after the updates. Remaining validators keep their order, new ones are
+// appended in the order of the updates.
+func applyValidatorUpdates(vals *ValidatorSet, updates []ValidatorUpdate) ([]common.Address, []int64, []PubKey, error) {
+	idx := NewValidatorIndex(vals)
+	powers := make(map[common.Address]int64, len(updates))
+	var added []common.Address
+	var pubKeys []PubKey
+	for _, u := range updates {
+		pubKey, err := ParsePubKey(u.PubKey)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("%w: %v", ErrInvalidValidatorUpdate, err)
+		}
+		addr := pubKey.Address()
+		if _, ok := powers[addr]; ok {
+			return nil, nil, nil, fmt.Errorf("%w: duplicate update of %v", ErrInvalidValidatorUpdate, addr)
+		}
+		if u.Power < 0 {
+			return nil, nil, nil, fmt.Errorf("%w: negative voting power %d of %v", ErrInvalidValidatorUpdate, u.Power, addr)
+		}
+
+		_, val := idx.GetByAddress(addr)
+		if val == nil {
+			if u.Power == 0 {
+				return nil, nil, nil, fmt.Errorf("%w: cannot remove unknown validator %v", ErrInvalidValidatorUpdate, addr)
+			}
+			if prover, ok := pubKey.(PossessionProver); ok && !prover.VerifyPossession(u.ProofOfPossession) {
+				return nil, nil, nil, fmt.Errorf("%w: invalid proof of possession of the key of %v", ErrInvalidValidatorUpdate, addr)
+			}
+			added = append(added, addr)
+		}
+		powers[addr] = u.Power
+		pubKeys = append(pubKeys, pubKey)
+	}
+
+	addrs := make([]common.Address, 0, len(vals.Validators)+len(added))
+	newPowers := make([]int64, 0, len(vals.Validators)+len(added))
+	for _, val := range vals.Validators {
+		power, ok := powers[val.Address]
+		if !ok {
+			power = val.VotingPower
+		}
+		if power == 0 {
+			continue
+		}
+		addrs = append(addrs, val.Address)
+		newPowers = append(newPowers, power)
+	}
+	for _, addr := range added {
+		addrs = append(addrs, addr)
+		newPowers = append(newPowers, powers[addr])
+	}
+
+	if err := ValidateValidatorUpdate(addrs, newPowers); err != nil {
+		return nil, nil, nil, fmt.Errorf("%w: %v", ErrInvalidValidatorUpdate, err)
+	}
+	return addrs, newPowers, pubKeys, nil
+}
+
+// updateValidatorSet returns the set of addrs and powers following vals: the
+// remaining validators keep their proposer priorities, so that the weighted
+// proposer order goes on, and the new ones start behind, at -1.125 times the
+// total voting power as in Tendermint, not to propose right away.
+// IncrementProposerPriority then recenters the priorities.
+func updateValidatorSet(vals *ValidatorSet, addrs []common.Address, powers []int64) *ValidatorSet {
+	next := NewValidatorSet(addrs, powers, vals.ProposerReptition)
+	total := next.TotalVotingPower()
+	idx := NewValidatorIndex(vals)
+	for _, val := range next.Validators {
+		if _, prev := idx.GetByAddress(val.Address); prev != nil {
+			val.ProposerPriority = prev.ProposerPriority
+		} else {
+			val.ProposerPriority = -(total + total>>3)
+		}
+	}
+	return next
+}
@@ -0,0 +1,52 @@
+package consensus
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyValidatorUpdates(t *testing.T) {
+	vals, addrs := makeTestValidators(3)
+	newAddr := common.BytesToAddress([]byte{0x10})
+
+	nextAddrs, powers, pubKeys, err := applyValidatorUpdates(vals, []ValidatorUpdate{
+		{PubKey: newAddr.Hex(), Power: 5},
+		{PubKey: addrs[1].Hex(), Power: 0},
+		{PubKey: addrs[2].Hex(), Power: 7},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []common.Address{addrs[0], addrs[2], newAddr}, nextAddrs)
+	assert.Equal(t, []int64{1, 7, 5}, powers)
+	assert.Len(t, pubKeys, 3)
+
+	for _, updates := range [][]ValidatorUpdate{
+		{{PubKey: newAddr.Hex(), Power: 0}},
+		{{PubKey: addrs[0].Hex(), Power: -1}},
+		{{PubKey: addrs[0].Hex(), Power: 2}, {PubKey: addrs[0].Hex(), Power: 3}},
+		{{PubKey: addrs[0].Hex()}, {PubKey: addrs[1].Hex()}, {PubKey: addrs[2].Hex()}},
+		{{PubKey: "not a key", Power: 1}},
+	} {
+		_, _, _, err := applyValidatorUpdates(vals, updates)
+		assert.ErrorIs(t, err, ErrInvalidValidatorUpdate)
+	}
+}
+
+func TestUpdateValidatorSetKeepsPriorities(t *testing.T) {
+	vals, addrs := makeTestValidators(3)
+	for i := 0; i < 5; i++ {
+		vals.IncrementProposerPriority(1)
+	}
+	newAddr := common.BytesToAddress([]byte{0x10})
+
+	next := updateValidatorSet(vals, []common.Address{addrs[0], addrs[2], newAddr}, []int64{1, 7, 5})
+	idx, nextIdx := NewValidatorIndex(vals), NewValidatorIndex(next)
+	for _, addr := range []common.Address{addrs[0], addrs[2]} {
+		_, prev := idx.GetByAddress(addr)
+		_, val := nextIdx.GetByAddress(addr)
+		assert.Equal(t, prev.ProposerPriority, val.ProposerPriority)
+	}
+	_, val := nextIdx.GetByAddress(newAddr)
+	assert.Equal(t, int64(-(13 + 13>>3)), val.ProposerPriority)
+}
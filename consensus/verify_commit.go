@@ -0,0 +1,208 @@
+package consensus
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var ErrNotEnoughVotingPowerSigned = errors.New("not enough voting power signed")
+
+// SetValidatorPubKeys installs the given keys on the matching validators of
+// the set, so that their signatures are verified with their own key type.
+// Validators without a given key keep the default (ECDSA) key.
+func SetValidatorPubKeys(vals *ValidatorSet, pubKeys []PubKey) {
+	idx := NewValidatorIndex(vals)
+	for _, pubKey := range pubKeys {
+		if _, val := idx.GetByAddress(pubKey.Address()); val != nil {
+			val.PubKey = pubKey
+		}
+	}
+}
+
+// inheritPubKeys copies non-default keys of validators from src to the same
+// validators in dst, e.g., when a new validator set is created from addresses.
+func inheritPubKeys(dst, src *ValidatorSet, addrs []common.Address) {
+	srcIdx, dstIdx := NewValidatorIndex(src), NewValidatorIndex(dst)
+	for _, addr := range addrs {
+		_, oldVal := srcIdx.GetByAddress(addr)
+		_, newVal := dstIdx.GetByAddress(addr)
+		if oldVal == nil || newVal == nil || oldVal.PubKey == nil {
+			continue
+		}
+		if oldVal.PubKey.Type() != EcdsaPubKeyType {
+			newVal.PubKey = oldVal.PubKey
+		}
+	}
+}
+
+// VerifyCommitByKeyType verifies that +2/3 of the voting power of vals signed
+// blockID at height.
+//
+// Every signature is verified with the key of the validator that made it, so
+// a validator set may mix key types (e.g. ECDSA and ed25519) while keys are
+// being migrated.
+//
+// The commit must be made by vals: it has a signature, or an absent one, per
+// validator, in the validator set order, as MakeCommitInfo expects.
+func VerifyCommitByKeyType(chainID string, vals *ValidatorSet, blockID common.Hash, height uint64, commit *Commit) error {
+	if commit == nil {
+		return errors.New("nil commit")
+	}
+	if commit.Height != height {
+		return fmt.Errorf("invalid commit height: expected %d, got %d", height, commit.Height)
+	}
+
+	if vals.Size() != len(commit.Signatures) {
+		return fmt.Errorf("invalid commit -- wrong set size: %d vs %d", vals.Size(), len(commit.Signatures))
+	}
+
+	talliedVotingPower := int64(0)
+	for idx, commitSig := range commit.Signatures {
+		if commitSig.Absent() {
+			continue
+		}
+
+		_, val := vals.GetByIndex(int32(idx))
+		if commitSig.ValidatorAddress != val.Address {
+			return fmt.Errorf("signature #%d from %v, expected %v", idx, commitSig.ValidatorAddress, val.Address)
+		}
+
+		vote := commit.GetVote(int32(idx))
+		if commitSig.ForBlock() && vote.BlockID != blockID {
+			return fmt.Errorf("invalid commit -- wrong block ID: want %v, got %v", blockID, vote.BlockID)
+		}
+
+		if !val.PubKey.VerifySignature(vote.VoteSignBytes(chainID), commitSig.Signature) {
+			return fmt.Errorf("wrong signature (#%d) from %v (%s)", idx, commitSig.ValidatorAddress, val.PubKey.Type())
+		}
+
+		// only votes for the block count towards the quorum
+		if commitSig.ForBlock() {
+			talliedVotingPower += val.VotingPower
+		}
+	}
+
+	if needed := vals.TotalVotingPower() * 2 / 3; talliedVotingPower <= needed {
+		return fmt.Errorf("%w: got %d, needed more than %d", ErrNotEnoughVotingPowerSigned, talliedVotingPower, needed)
+	}
+	return nil
+}
+
+// Fraction is a trust level of VerifyCommitLightTrusting, e.g. 1/3.
+type Fraction struct {
+	Numerator   uint64 `json:"numerator"`
+	Denominator uint64 `json:"denominator"`
+}
+
+// DefaultTrustLevel is the trust level of light clients: among +1/3 of the
+// trusted voting power at least one honest validator signed.
+var DefaultTrustLevel = Fraction{Numerator: 1, Denominator: 3}
+
+var ErrInvalidTrustLevel = errors.New("trust level must be within [1/3, 1]")
+
+// ValidateTrustLevel checks that a trust level keeps the light client safe.
+func ValidateTrustLevel(lvl Fraction) error {
+	if lvl.Denominator == 0 || lvl.Numerator*3 < lvl.Denominator || lvl.Numerator > lvl.Denominator {
+		return fmt.Errorf("%w: %d/%d", ErrInvalidTrustLevel, lvl.Numerator, lvl.Denominator)
+	}
+	return nil
+}
+
+// VerifyCommitLight verifies that +2/3 of the voting power of vals, the
+// validator set of height, signed blockID. Unlike VerifyCommitByKeyType it
+// stops once the quorum is reached and ignores the signatures for nil, which
+// is all a light client, or a bridge verifying headers, needs.
+//
+// The commit must be made by vals: the signatures are in the validator set
+// order.
+func VerifyCommitLight(chainID string, vals *ValidatorSet, blockID common.Hash, height uint64, commit *Commit) error {
+	if commit == nil {
+		return errors.New("nil commit")
+	}
+	if commit.Height != height {
+		return fmt.Errorf("invalid commit height: expected %d, got %d", height, commit.Height)
+	}
+	if commit.BlockID != blockID {
+		return fmt.Errorf("invalid commit -- wrong block ID: want %v, got %v", blockID, commit.BlockID)
+	}
+	if vals.Size() != len(commit.Signatures) {
+		return fmt.Errorf("invalid commit -- wrong set size: %d vs %d", vals.Size(), len(commit.Signatures))
+	}
+
+	needed := vals.TotalVotingPower() * 2 / 3
+	talliedVotingPower := int64(0)
+	for idx, commitSig := range commit.Signatures {
+		if !commitSig.ForBlock() {
+			continue
+		}
+
+		_, val := vals.GetByIndex(int32(idx))
+		if commitSig.ValidatorAddress != val.Address {
+			return fmt.Errorf("signature #%d from %v, expected %v", idx, commitSig.ValidatorAddress, val.Address)
+		}
+		if !val.PubKey.VerifySignature(commit.GetVote(int32(idx)).VoteSignBytes(chainID), commitSig.Signature) {
+			return fmt.Errorf("wrong signature (#%d) from %v (%s)", idx, commitSig.ValidatorAddress, val.PubKey.Type())
+		}
+
+		talliedVotingPower += val.VotingPower
+		if talliedVotingPower > needed {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: got %d, needed more than %d", ErrNotEnoughVotingPowerSigned, talliedVotingPower, needed)
+}
+
+// VerifyCommitLightTrusting verifies that more than trustLevel of the voting
+// power of trusted signed the commit. trusted is a validator set the verifier
+// already trusts, not necessarily the one that made the commit, e.g., the set
+// of the last verified header when skipping to a later one. Validators of the
+// commit not in trusted are ignored.
+//
+// It does not verify that the commit is for a given block: that is for
+// VerifyCommitLight, against the validator set of the commit, once it is
+// trusted.
+func VerifyCommitLightTrusting(chainID string, trusted *ValidatorSet, commit *Commit, trustLevel Fraction) error {
+	if commit == nil {
+		return errors.New("nil commit")
+	}
+	if err := ValidateTrustLevel(trustLevel); err != nil {
+		return err
+	}
+
+	// power > total * numerator / denominator, without overflow
+	total := new(big.Int).SetInt64(trusted.TotalVotingPower())
+	needed := total.Mul(total, new(big.Int).SetUint64(trustLevel.Numerator))
+	denominator := new(big.Int).SetUint64(trustLevel.Denominator)
+	tallied := new(big.Int)
+
+	seen := make(map[common.Address]bool, len(commit.Signatures))
+	trustedIdx := NewValidatorIndex(trusted)
+	for idx, commitSig := range commit.Signatures {
+		if !commitSig.ForBlock() {
+			continue
+		}
+
+		_, val := trustedIdx.GetByAddress(commitSig.ValidatorAddress)
+		if val == nil {
+			continue
+		}
+		if seen[commitSig.ValidatorAddress] {
+			return fmt.Errorf("double vote from %v (#%d)", commitSig.ValidatorAddress, idx)
+		}
+		seen[commitSig.ValidatorAddress] = true
+
+		if !val.PubKey.VerifySignature(commit.GetVote(int32(idx)).VoteSignBytes(chainID), commitSig.Signature) {
+			return fmt.Errorf("wrong signature (#%d) from %v (%s)", idx, commitSig.ValidatorAddress, val.PubKey.Type())
+		}
+
+		tallied.Add(tallied, big.NewInt(val.VotingPower))
+		if new(big.Int).Mul(tallied, denominator).Cmp(needed) > 0 {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: got %v of %d, needed more than %d/%d", ErrNotEnoughVotingPowerSigned,
+		tallied, trusted.TotalVotingPower(), trustLevel.Numerator, trustLevel.Denominator)
+}
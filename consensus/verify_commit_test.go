@@ -0,0 +1,64 @@
+package consensus
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyCommitLight(t *testing.T) {
+	blockHash := common.BytesToHash([]byte{1, 2, 3})
+	vals, commit := makeTestCommit(t, GeneratePrivValidatorLocal, 4, 1, 0, blockHash)
+
+	assert.NoError(t, VerifyCommitLight("test", vals, blockHash, 1, commit))
+	assert.Error(t, VerifyCommitLight("other", vals, blockHash, 1, commit))
+	assert.Error(t, VerifyCommitLight("test", vals, common.Hash{}, 1, commit))
+	assert.Error(t, VerifyCommitLight("test", vals, blockHash, 2, commit))
+
+	// 2 of 4 is not +2/3
+	vals, commit = makeTestCommit(t, GeneratePrivValidatorLocal, 4, 2, 0, blockHash)
+	err := VerifyCommitLight("test", vals, blockHash, 1, commit)
+	assert.True(t, errors.Is(err, ErrNotEnoughVotingPowerSigned))
+}
+
+func TestVerifyCommitByKeyType(t *testing.T) {
+	blockHash := common.BytesToHash([]byte{1, 2, 3})
+	vals, commit := makeTestCommit(t, GeneratePrivValidatorLocal, 4, 1, 0, blockHash)
+	assert.NoError(t, VerifyCommitByKeyType("test", vals, blockHash, 1, commit))
+
+	// a signature missing, or out of the validator set order
+	truncated := NewCommit(commit.Height, commit.Round, commit.BlockID, commit.Signatures[:3])
+	assert.Error(t, VerifyCommitByKeyType("test", vals, blockHash, 1, truncated))
+	sigs := append([]CommitSig(nil), commit.Signatures...)
+	sigs[2], sigs[3] = sigs[3], sigs[2]
+	permuted := NewCommit(commit.Height, commit.Round, commit.BlockID, sigs)
+	assert.Error(t, VerifyCommitByKeyType("test", vals, blockHash, 1, permuted))
+}
+
+func TestVerifyCommitLightTrusting(t *testing.T) {
+	blockHash := common.BytesToHash([]byte{1, 2, 3})
+	vals, commit := makeTestCommit(t, GeneratePrivValidatorLocal, 4, 2, 0, blockHash)
+
+	// 2 of 4 is +1/3, not +2/3
+	assert.NoError(t, VerifyCommitLightTrusting("test", vals, commit, DefaultTrustLevel))
+	err := VerifyCommitLightTrusting("test", vals, commit, Fraction{2, 3})
+	assert.True(t, errors.Is(err, ErrNotEnoughVotingPowerSigned))
+
+	// none of the trusted validators signed
+	other, _ := makeTestCommit(t, GeneratePrivValidatorLocal, 4, 0, 0, blockHash)
+	err = VerifyCommitLightTrusting("test", other, commit, DefaultTrustLevel)
+	assert.True(t, errors.Is(err, ErrNotEnoughVotingPowerSigned))
+
+	err = VerifyCommitLightTrusting("test", vals, commit, Fraction{1, 4})
+	assert.True(t, errors.Is(err, ErrInvalidTrustLevel))
+}
+
+func TestValidateTrustLevel(t *testing.T) {
+	assert.NoError(t, ValidateTrustLevel(DefaultTrustLevel))
+	assert.NoError(t, ValidateTrustLevel(Fraction{1, 1}))
+	assert.Error(t, ValidateTrustLevel(Fraction{1, 0}))
+	assert.Error(t, ValidateTrustLevel(Fraction{1, 4}))
+	assert.Error(t, ValidateTrustLevel(Fraction{4, 3}))
+}
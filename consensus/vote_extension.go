@@ -0,0 +1,334 @@
+package consensus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Vote extensions are data of the application, e.g. oracle prices, that the
+// validators attach to their precommits for a block, and the proposer of the
+// next height gets to build its block from.
+//
+// Votes and commits are types of the go-ethereum fork, so an extension is not
+// part of the precommit: it is a message of its own, signed with the
+// validator key and gossiped right after the precommit. It is not in the
+// commit either: an application needing the extensions on chain puts them in
+// its block, and verifies them with VerifyVoteExtension in ValidateBlock.
+
+var ErrInvalidVoteExtension = errors.New("invalid vote extension")
+
+// MaxVoteExtensionBytes bounds the extension of a validator on any chain.
+// Chains may set a lower cap, see ChainState.VoteExtensionMaxBytes.
+var MaxVoteExtensionBytes = 16 * 1024
+
+// voteExtensionVerifiers bounds the extensions being verified by the
+// application at the same time.
+var voteExtensionVerifiers = make(chan struct{}, 8)
+
+var consensusVoteExtensions = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "consensus_vote_extensions_total",
+		Help: "Total number of vote extensions of other validators received, by result",
+	}, []string{"result"})
+
+var voteExtensionSignPrefix = []byte("mpbft/vote_extension")
+
+// VoteExtender is implemented by the block executors of applications
+// extending the precommits. It is only used with priv validators signing
+// locally, see BytesSigner.
+type VoteExtender interface {
+	// ExtendVote returns the extension of our precommit for a block.
+	ExtendVote(ctx context.Context, height uint64, blockID common.Hash) ([]byte, error)
+	// VerifyVoteExtension checks the extension of another validator.
+	VerifyVoteExtension(height uint64, validator common.Address, extension []byte) error
+	// MakeBlockWithExtensions replaces MakeBlock. extensions are the ones of
+	// the precommits for the last block, in the order of the last validators,
+	// nil for the validators whose extension was not received.
+	MakeBlockWithExtensions(chainState *ChainState, height uint64, commit *Commit, proposerAddress common.Address, extensions []*VoteExtension) *FullBlock
+}
+
+// VoteExtension is the extension of the precommit of a validator for a
+// block.
+type VoteExtension struct {
+	Height           uint64
+	Round            int32
+	BlockID          common.Hash
+	ValidatorAddress common.Address
+	Extension        []byte
+	Signature        []byte
+}
+
+func (ext *VoteExtension) ValidateBasic() error {
+	if ext.BlockID == (common.Hash{}) {
+		return fmt.Errorf("%w: no block", ErrInvalidVoteExtension)
+	}
+	if ext.Round < 0 {
+		return fmt.Errorf("%w: negative round", ErrInvalidVoteExtension)
+	}
+	if len(ext.Extension) > MaxVoteExtensionBytes {
+		return fmt.Errorf("%w: %d bytes, at most %d", ErrInvalidVoteExtension, len(ext.Extension), MaxVoteExtensionBytes)
+	}
+	if len(ext.Signature) == 0 || len(ext.Signature) > MaxSignatureSize {
+		return fmt.Errorf("%w: signature of %d bytes", ErrInvalidVoteExtension, len(ext.Signature))
+	}
+	return nil
+}
+
+func (ext *VoteExtension) SignBytes(chainID string) []byte {
+	b, err := rlp.EncodeToBytes([]interface{}{
+		chainID, ext.Height, uint64(ext.Round), ext.BlockID, ext.ValidatorAddress, ext.Extension,
+	})
+	if err != nil {
+		panic(err)
+	}
+	return append(append([]byte{}, voteExtensionSignPrefix...), b...)
+}
+
+// VerifyVoteExtension checks that ext is signed by a validator of vals.
+func VerifyVoteExtension(chainID string, vals *ValidatorIndex, ext *VoteExtension) error {
+	if err := ext.ValidateBasic(); err != nil {
+		return err
+	}
+	_, val := vals.GetByAddress(ext.ValidatorAddress)
+	if val == nil {
+		return fmt.Errorf("%w: %v is not a validator", ErrInvalidVoteExtension, ext.ValidatorAddress)
+	}
+	if !val.PubKey.VerifySignature(ext.SignBytes(chainID), ext.Signature) {
+		return fmt.Errorf("%w: wrong signature from %v", ErrInvalidVoteExtension, ext.ValidatorAddress)
+	}
+	return nil
+}
+
+// voteExtensionSet keeps the first extension of each validator of a height
+// for each block.
+type voteExtensionSet struct {
+	height uint64
+	vals   *ValidatorIndex
+	exts   map[common.Hash][]*VoteExtension
+	// extensions being verified by the application
+	verifying map[voteExtensionKey]bool
+}
+
+type voteExtensionKey struct {
+	blockID   common.Hash
+	validator common.Address
+}
+
+func newVoteExtensionSet(height uint64, vals *ValidatorSet) *voteExtensionSet {
+	return &voteExtensionSet{
+		height:    height,
+		vals:      NewValidatorIndex(vals),
+		exts:      make(map[common.Hash][]*VoteExtension),
+		verifying: make(map[voteExtensionKey]bool),
+	}
+}
+
+// startVerifying tells whether an extension is to be verified: the
+// validator has no extension for the block yet, nor one being verified.
+func (s *voteExtensionSet) startVerifying(ext *VoteExtension) bool {
+	key := voteExtensionKey{ext.BlockID, ext.ValidatorAddress}
+	idx, _ := s.vals.GetByAddress(ext.ValidatorAddress)
+	if exts := s.exts[ext.BlockID]; s.verifying[key] || (exts != nil && exts[idx] != nil) {
+		return false
+	}
+	s.verifying[key] = true
+	return true
+}
+
+func (s *voteExtensionSet) doneVerifying(ext *VoteExtension) {
+	delete(s.verifying, voteExtensionKey{ext.BlockID, ext.ValidatorAddress})
+}
+
+func (s *voteExtensionSet) add(ext *VoteExtension) bool {
+	idx, _ := s.vals.GetByAddress(ext.ValidatorAddress)
+	exts := s.exts[ext.BlockID]
+	if exts == nil {
+		exts = make([]*VoteExtension, s.vals.Size())
+		s.exts[ext.BlockID] = exts
+	}
+	if exts[idx] != nil {
+		return false
+	}
+	exts[idx] = ext
+	return true
+}
+
+// forBlock returns the extensions for a block, in the validator order.
+func (s *voteExtensionSet) forBlock(blockID common.Hash) []*VoteExtension {
+	if s == nil {
+		return nil
+	}
+	exts := s.exts[blockID]
+	if exts == nil {
+		return make([]*VoteExtension, s.vals.Size())
+	}
+	return append([]*VoteExtension(nil), exts...)
+}
+
+// updateVoteExtensions moves on to the extensions of the new height of
+// state, keeping the ones of the last height for the proposer.
+func (cs *ConsensusState) updateVoteExtensions(state ChainState, height uint64) {
+	switch {
+	case cs.voteExtensions != nil && cs.voteExtensions.height == state.LastBlockHeight:
+		cs.lastVoteExtensions = cs.voteExtensions
+	case state.LastBlockHeight > 0 && state.LastValidators != nil:
+		cs.lastVoteExtensions = newVoteExtensionSet(state.LastBlockHeight, state.LastValidators)
+	default:
+		cs.lastVoteExtensions = nil
+	}
+	cs.voteExtensions = newVoteExtensionSet(height, state.Validators)
+}
+
+// signAddVoteExtension extends our precommit for a block, if the application
+// extends votes.
+func (cs *ConsensusState) signAddVoteExtension(ctx context.Context, vote *Vote) {
+	extender, ok := cs.blockExec.(VoteExtender)
+	if !ok || vote.Type != PrecommitType || vote.BlockID == (common.Hash{}) ||
+		!cs.chainState.ConsensusParams.VoteExtensionsEnabled(vote.Height) {
+		return
+	}
+	signer, ok := cs.privValidator.(BytesSigner)
+	if !ok {
+		log.Warn("cannot extend votes with a remote signer", "height", vote.Height)
+		return
+	}
+
+	data, err := extender.ExtendVote(ctx, vote.Height, vote.BlockID)
+	if err != nil {
+		log.Error("failed extending vote", "height", vote.Height, "round", vote.Round, "err", err)
+		return
+	}
+	if max := cs.chainState.VoteExtensionLimit(); len(data) > max {
+		log.Error("vote extension too large, not sent", "height", vote.Height, "round", vote.Round, "size", len(data), "max", max)
+		return
+	}
+	ext := &VoteExtension{
+		Height:           vote.Height,
+		Round:            vote.Round,
+		BlockID:          vote.BlockID,
+		ValidatorAddress: vote.ValidatorAddress,
+		Extension:        data,
+	}
+	ext.Signature, err = signer.SignBytes(ext.SignBytes(cs.chainState.ChainID))
+	if err != nil {
+		log.Error("failed signing vote extension", "height", vote.Height, "round", vote.Round, "err", err)
+		return
+	}
+	cs.sendInternalMessage(ctx, MsgInfo{ext, ""})
+}
+
+// voteExtensionSetOf returns the set an extension belongs to: the one of the
+// current height, or of the last one for the block committed, as extensions
+// may arrive after the commit. Extensions below the enable height of the
+// consensus params belong to none.
+func (cs *ConsensusState) voteExtensionSetOf(ext *VoteExtension) *voteExtensionSet {
+	switch {
+	case !cs.chainState.ConsensusParams.VoteExtensionsEnabled(ext.Height):
+		return nil
+	case ext.Height == cs.Height:
+		return cs.voteExtensions
+	case cs.lastVoteExtensions != nil && ext.Height == cs.lastVoteExtensions.height && ext.BlockID == cs.chainState.LastBlockID:
+		return cs.lastVoteExtensions
+	default:
+		return nil
+	}
+}
+
+// verifiedVoteExtension is an extension of a peer once the application
+// verified it, back on the internal queue.
+type verifiedVoteExtension struct {
+	ext    *VoteExtension
+	peerID string
+	err    error
+}
+
+func (v *verifiedVoteExtension) ValidateBasic() error {
+	return nil
+}
+
+// PeerMisbehavior is sent to the peers queue to penalize a peer that sent an
+// invalid message.
+type PeerMisbehavior struct {
+	PeerID string
+	Err    error
+}
+
+func (m *PeerMisbehavior) ValidateBasic() error {
+	return nil
+}
+
+// addVoteExtension adds an extension of ours, or verifies the signature and
+// size of the extension of a peer and has the application verify it in the
+// background, see addVerifiedVoteExtension. Extensions are only added once
+// verified, so the proposer never gets a broken one, and only relayed then.
+func (cs *ConsensusState) addVoteExtension(ctx context.Context, ext *VoteExtension, peerID string) (bool, error) {
+	set := cs.voteExtensionSetOf(ext)
+	if set == nil {
+		return false, nil
+	}
+
+	if err := VerifyVoteExtension(cs.chainState.ChainID, set.vals, ext); err != nil {
+		cs.penalizeVoteExtension(ctx, peerID, "invalid", err)
+		return false, err
+	}
+	if max := cs.chainState.VoteExtensionLimit(); len(ext.Extension) > max {
+		err := fmt.Errorf("%w: %d bytes, at most %d", ErrInvalidVoteExtension, len(ext.Extension), max)
+		cs.penalizeVoteExtension(ctx, peerID, "oversized", err)
+		return false, err
+	}
+
+	extender, ok := cs.blockExec.(VoteExtender)
+	if !ok || peerID == "" {
+		return set.add(ext), nil
+	}
+	if !set.startVerifying(ext) {
+		return false, nil
+	}
+	go func() {
+		select {
+		case voteExtensionVerifiers <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		err := extender.VerifyVoteExtension(ext.Height, ext.ValidatorAddress, ext.Extension)
+		<-voteExtensionVerifiers
+		cs.sendInternalMessage(ctx, MsgInfo{&verifiedVoteExtension{ext: ext, peerID: peerID, err: err}, ""})
+	}()
+	return false, nil
+}
+
+// addVerifiedVoteExtension adds an extension of a peer verified by the
+// application, and relays it.
+func (cs *ConsensusState) addVerifiedVoteExtension(ctx context.Context, v *verifiedVoteExtension) (bool, error) {
+	set := cs.voteExtensionSetOf(v.ext)
+	if set == nil {
+		return false, nil
+	}
+	set.doneVerifying(v.ext)
+
+	if v.err != nil {
+		err := fmt.Errorf("%w: %v", ErrInvalidVoteExtension, v.err)
+		cs.penalizeVoteExtension(ctx, v.peerID, "rejected", err)
+		return false, err
+	}
+	consensusVoteExtensions.WithLabelValues("accepted").Inc()
+	added := set.add(v.ext)
+	if added {
+		cs.broadcastMessageToPeers(ctx, v.ext)
+	}
+	return added, nil
+}
+
+func (cs *ConsensusState) penalizeVoteExtension(ctx context.Context, peerID, result string, err error) {
+	if peerID == "" {
+		return
+	}
+	consensusVoteExtensions.WithLabelValues(result).Inc()
+	cs.broadcastMessageToPeers(ctx, &PeerMisbehavior{PeerID: peerID, Err: err})
+}
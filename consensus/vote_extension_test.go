@@ -0,0 +1,68 @@
+package consensus
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyVoteExtension(t *testing.T) {
+	pv := GeneratePrivValidatorLocal()
+	pubKey, err := pv.GetPubKey(context.Background())
+	assert.NoError(t, err)
+	vals := NewValidatorIndex(NewValidatorSet([]common.Address{pubKey.Address()}, []int64{1}, 4))
+
+	ext := &VoteExtension{
+		Height:           3,
+		Round:            1,
+		BlockID:          common.HexToHash("0x01"),
+		ValidatorAddress: pubKey.Address(),
+		Extension:        []byte("price=42"),
+	}
+	ext.Signature, err = pv.(BytesSigner).SignBytes(ext.SignBytes("test"))
+	assert.NoError(t, err)
+	assert.NoError(t, VerifyVoteExtension("test", vals, ext))
+
+	// signed for another chain
+	assert.True(t, errors.Is(VerifyVoteExtension("other", vals, ext), ErrInvalidVoteExtension))
+
+	tampered := *ext
+	tampered.Extension = []byte("price=43")
+	assert.True(t, errors.Is(VerifyVoteExtension("test", vals, &tampered), ErrInvalidVoteExtension))
+
+	unknown := *ext
+	unknown.ValidatorAddress = common.HexToAddress("0x02")
+	assert.True(t, errors.Is(VerifyVoteExtension("test", vals, &unknown), ErrInvalidVoteExtension))
+
+	tooLarge := *ext
+	tooLarge.Extension = make([]byte, MaxVoteExtensionBytes+1)
+	assert.True(t, errors.Is(tooLarge.ValidateBasic(), ErrInvalidVoteExtension))
+}
+
+func TestVoteExtensionLimit(t *testing.T) {
+	assert.Equal(t, MaxVoteExtensionBytes, ChainState{}.VoteExtensionLimit())
+	assert.Equal(t, 100, ChainState{VoteExtensionMaxBytes: 100}.VoteExtensionLimit())
+
+	state := MakeGenesisChainState("test", 0, []common.Address{common.HexToAddress("0x01")}, []int64{1}, 100, 4)
+	state.VoteExtensionMaxBytes = uint64(MaxVoteExtensionBytes) + 1
+	assert.True(t, errors.Is(ValidateChainState(state), ErrInvalidConsensusParams))
+}
+
+func TestVoteExtensionSetVerifying(t *testing.T) {
+	addr := common.HexToAddress("0x01")
+	set := newVoteExtensionSet(3, NewValidatorSet([]common.Address{addr}, []int64{1}, 4))
+	ext := &VoteExtension{Height: 3, BlockID: common.HexToHash("0x02"), ValidatorAddress: addr}
+
+	assert.True(t, set.startVerifying(ext))
+	// a second extension of the validator waits for the first one
+	assert.False(t, set.startVerifying(ext))
+	assert.Nil(t, set.forBlock(ext.BlockID)[0])
+
+	set.doneVerifying(ext)
+	assert.True(t, set.add(ext))
+	assert.False(t, set.startVerifying(ext))
+	assert.Equal(t, ext, set.forBlock(ext.BlockID)[0])
+}
@@ -0,0 +1,69 @@
+package consensus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var ErrInvalidSubmittedVote = errors.New("invalid submitted vote")
+
+var consensusSubmittedVotes = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "consensus_submitted_votes_total",
+		Help: "Total number of votes submitted by co-located signers",
+	}, []string{"result"})
+
+// SubmitVotes adds votes signed next to the node, e.g., by the signer agent
+// of validators running on the same host, as if they were our own: they skip
+// the p2p queue and are gossiped once added. It returns, for each vote, why
+// it was rejected, nil if it was queued, blocking while the queue is full
+// until the context is done. The signatures are still verified when the votes
+// are added.
+func (cs *ConsensusState) SubmitVotes(ctx context.Context, votes []*Vote) []error {
+	errs := make([]error, len(votes))
+
+	cs.mtx.RLock()
+	height := cs.Height
+	vals := cs.validatorIndex
+	cs.mtx.RUnlock()
+
+	for i, vote := range votes {
+		errs[i] = checkSubmittedVote(vote, height, vals)
+		if errs[i] != nil {
+			consensusSubmittedVotes.WithLabelValues("rejected").Inc()
+			continue
+		}
+		select {
+		case cs.internalMsgQueue <- MsgInfo{&VoteMessage{Vote: vote}, ""}:
+			consensusSubmittedVotes.WithLabelValues("queued").Inc()
+		case <-ctx.Done():
+			errs[i] = ctx.Err()
+			consensusSubmittedVotes.WithLabelValues("rejected").Inc()
+		}
+	}
+	return errs
+}
+
+func checkSubmittedVote(vote *Vote, height uint64, vals *ValidatorIndex) error {
+	if vote == nil {
+		return fmt.Errorf("%w: nil vote", ErrInvalidSubmittedVote)
+	}
+	if err := vote.ValidateBasic(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSubmittedVote, err)
+	}
+	// the last height is only for the commit, which does not take votes
+	if vote.Height != height {
+		return fmt.Errorf("%w: height %d, consensus is at %d", ErrInvalidSubmittedVote, vote.Height, height)
+	}
+	idx, val := vals.GetByAddress(vote.ValidatorAddress)
+	if val == nil {
+		return fmt.Errorf("%w: %v is not a validator", ErrInvalidSubmittedVote, vote.ValidatorAddress)
+	}
+	if idx != vote.ValidatorIndex {
+		return fmt.Errorf("%w: index %d of %v, expected %d", ErrInvalidSubmittedVote, vote.ValidatorIndex, vote.ValidatorAddress, idx)
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+package consensus
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"runtime"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The signatures of the votes from peers are verified in batches, on a pool
+// of workers, before the votes reach the receive routine: verifying them one
+// at a time there bounds how many votes a node processes, which with many
+// validators is what makes it lag. The vote set still verifies the
+// signatures when the votes are added, but the ones verified by the pipeline
+// of the ConsensusState are found by the keys of its vote sets instead of
+// being verified again, see verifiedKeys.
+
+var consensusVoteSignatures = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "consensus_vote_signatures_total",
+		Help: "Signatures of votes from peers verified ahead of the receive routine, by result",
+	}, []string{"result"})
+
+// Most messages taken from the peer queue at once, the votes among them
+// verified as one batch.
+var voteBatchSize = 64
+
+// BatchVerifier verifies signatures together, e.g., with ed25519 batch
+// verification, much faster than one by one.
+type BatchVerifier interface {
+	Add(key PubKey, msg, sig []byte)
+	// Verify tells whether all the signatures are valid, and if not, which
+	// ones are. A verifier only able to tell for the batch as a whole
+	// returns a nil slice: the signatures are then verified one by one.
+	Verify() (bool, []bool)
+}
+
+// StateBatchVerifier verifies the votes from peers with the batch verifiers
+// of newVerifier, instead of on a pool of workers one signature at a time.
+func StateBatchVerifier(newVerifier func() BatchVerifier) StateOption {
+	return func(cs *ConsensusState) {
+		cs.newBatchVerifier = newVerifier
+	}
+}
+
+type sigEntry struct {
+	key PubKey
+	msg []byte
+	sig []byte
+}
+
+// parallelVerifier is the default BatchVerifier: the standard library cannot
+// verify ed25519 signatures in batches, so they are split between workers.
+type parallelVerifier struct {
+	entries []sigEntry
+}
+
+func newParallelVerifier() BatchVerifier {
+	return &parallelVerifier{}
+}
+
+func (pv *parallelVerifier) Add(key PubKey, msg, sig []byte) {
+	pv.entries = append(pv.entries, sigEntry{key, msg, sig})
+}
+
+func (pv *parallelVerifier) Verify() (bool, []bool) {
+	valid := make([]bool, len(pv.entries))
+	workers := runtime.NumCPU()
+	if workers > len(pv.entries) {
+		workers = len(pv.entries)
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < len(pv.entries); i += workers {
+				e := pv.entries[i]
+				valid[i] = e.key.VerifySignature(e.msg, e.sig)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for _, ok := range valid {
+		if !ok {
+			return false, valid
+		}
+	}
+	return true, valid
+}
+
+// sigCache records signatures known to be valid, each found once.
+type sigCache struct {
+	mu    sync.Mutex
+	sigs  map[[32]byte]struct{}
+	order [][32]byte // oldest first, to evict
+	size  int
+}
+
+func newSigCache(size int) *sigCache {
+	return &sigCache{sigs: make(map[[32]byte]struct{}, size), size: size}
+}
+
+// sigCacheID identifies a key in the cache, without hashing it when it is
+// not already an address.
+func sigCacheID(key PubKey) []byte {
+	switch key := key.(type) {
+	case *EcdsaPubKey:
+		return key.address.Bytes()
+	case *Ed25519PubKey:
+		return key.key
+	default:
+		return key.Address().Bytes()
+	}
+}
+
+func sigCacheKey(id, msg, sig []byte) [32]byte {
+	h := sha256.New()
+	// length-prefixed, so that no two entries hash the same bytes
+	var lens [2 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lens[:], uint64(len(id)))
+	n += binary.PutUvarint(lens[n:], uint64(len(sig)))
+	h.Write(lens[:n])
+	h.Write(id)
+	h.Write(sig)
+	h.Write(msg)
+	var key [32]byte
+	h.Sum(key[:0])
+	return key
+}
+
+func (c *sigCache) add(id, msg, sig []byte) {
+	key := sigCacheKey(id, msg, sig)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.sigs[key]; ok {
+		return
+	}
+	for len(c.order) >= c.size {
+		delete(c.sigs, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.sigs[key] = struct{}{}
+	c.order = append(c.order, key)
+}
+
+// take tells whether the signature is known valid, and forgets it.
+func (c *sigCache) take(id, msg, sig []byte) bool {
+	key := sigCacheKey(id, msg, sig)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.sigs[key]; !ok {
+		return false
+	}
+	delete(c.sigs, key)
+	return true
+}
+
+// Most signatures verified by the pipeline of a ConsensusState and not yet
+// found by its vote sets.
+const verifiedSigsSize = 16 * 1024
+
+// verifiedKey is the key of a validator in the vote sets of a ConsensusState,
+// accepting the signatures its pipeline verified.
+type verifiedKey struct {
+	PubKey
+	sigs *sigCache
+}
+
+func (k *verifiedKey) VerifySignature(msg []byte, sig []byte) bool {
+	return k.sigs.take(sigCacheID(k.PubKey), msg, sig) || k.PubKey.VerifySignature(msg, sig)
+}
+
+// verifiedKeys returns a copy of vals for the vote sets of cs, whose keys
+// find the signatures verified by the pipeline of cs. The keys of vals, used
+// elsewhere, still verify every signature.
+func (cs *ConsensusState) verifiedKeys(vals *ValidatorSet) *ValidatorSet {
+	vals = vals.Copy()
+	for _, val := range vals.Validators {
+		if val.PubKey != nil {
+			val.PubKey = &verifiedKey{PubKey: val.PubKey, sigs: cs.verifiedSigs}
+		}
+	}
+	return vals
+}
+
+// voteKey returns the key of the validator of a vote, nil if the vote is
+// neither of the current height nor a precommit of the last one: the vote
+// set rejects them, or verifies them itself.
+func (cs *ConsensusState) voteKey(vote *Vote) (PubKey, string) {
+	cs.mtx.RLock()
+	defer cs.mtx.RUnlock()
+
+	var vals *ValidatorSet
+	switch {
+	case vote.Height == cs.Height:
+		vals = cs.Validators
+	case vote.Height+1 == cs.Height && vote.Type == PrecommitType:
+		vals = cs.LastValidators
+	}
+	if vals == nil {
+		return nil, ""
+	}
+	addr, val := vals.GetByIndex(vote.ValidatorIndex)
+	if val == nil || addr != vote.ValidatorAddress {
+		return nil, ""
+	}
+	return val.PubKey, cs.chainState.ChainID
+}
+
+// verifyRoutine passes the messages of the peer queue to the receive
+// routine, in order, apart from the votes with invalid signatures.
+func (cs *ConsensusState) verifyRoutine(ctx context.Context) {
+	batch := make([]MsgInfo, 0, voteBatchSize)
+	for {
+		batch = batch[:0]
+		select {
+		case mi := <-cs.peerInMsgQueue:
+			batch = append(batch, mi)
+		case <-ctx.Done():
+			return
+		}
+	drain:
+		for len(batch) < voteBatchSize {
+			select {
+			case mi := <-cs.peerInMsgQueue:
+				batch = append(batch, mi)
+			default:
+				break drain
+			}
+		}
+
+		for _, mi := range cs.verifyBatch(batch) {
+			select {
+			case cs.verifiedMsgQueue <- mi:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// verifyBatch drops the votes of batch whose signature is invalid.
+func (cs *ConsensusState) verifyBatch(batch []MsgInfo) []MsgInfo {
+	type pending struct {
+		idx int
+		key PubKey
+		msg []byte
+		sig []byte
+	}
+	var (
+		verifier BatchVerifier
+		votes    []pending
+	)
+	for i, mi := range batch {
+		vm, ok := mi.Msg.(*VoteMessage)
+		if !ok || vm.Vote == nil {
+			continue
+		}
+		key, chainID := cs.voteKey(vm.Vote)
+		if key == nil {
+			consensusVoteSignatures.WithLabelValues("skipped").Inc()
+			continue
+		}
+		if verifier == nil {
+			verifier = cs.newBatchVerifier()
+		}
+		msg := vm.Vote.VoteSignBytes(chainID)
+		verifier.Add(key, msg, vm.Vote.Signature)
+		votes = append(votes, pending{i, key, msg, vm.Vote.Signature})
+	}
+	if verifier == nil {
+		return batch
+	}
+
+	ok, valid := verifier.Verify()
+	if !ok && valid == nil {
+		fallback := newParallelVerifier()
+		for _, v := range votes {
+			fallback.Add(v.key, v.msg, v.sig)
+		}
+		_, valid = fallback.Verify()
+	}
+	drop := make(map[int]bool)
+	for i, v := range votes {
+		if ok || valid[i] {
+			cs.verifiedSigs.add(sigCacheID(v.key), v.msg, v.sig)
+			consensusVoteSignatures.WithLabelValues("valid").Inc()
+			continue
+		}
+		drop[v.idx] = true
+		consensusVoteSignatures.WithLabelValues("invalid").Inc()
+		log.Debug("Dropping vote with invalid signature", "vote", batch[v.idx].Msg.(*VoteMessage).Vote, "peer", batch[v.idx].PeerID)
+	}
+	if len(drop) == 0 {
+		return batch
+	}
+
+	kept := batch[:0]
+	for i, mi := range batch {
+		if !drop[i] {
+			kept = append(kept, mi)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,85 @@
+package consensus
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParallelVerifier(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	key := NewEd25519PubKey(pub)
+
+	verifier := newParallelVerifier()
+	for i := 0; i < 10; i++ {
+		msg := []byte{byte(i)}
+		sig := ed25519.Sign(priv, msg)
+		if i == 7 {
+			sig[0] ^= 1
+		}
+		verifier.Add(key, msg, sig)
+	}
+	ok, valid := verifier.Verify()
+	assert.False(t, ok)
+	for i, v := range valid {
+		assert.Equal(t, i != 7, v, i)
+	}
+}
+
+func TestSigCache(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	key := NewEd25519PubKey(pub)
+	msg := []byte("vote")
+	sig := ed25519.Sign(priv, msg)
+
+	id := sigCacheID(key)
+	cache := newSigCache(2)
+	cache.add(id, msg, sig)
+	assert.False(t, cache.take(id, []byte("other"), sig))
+	assert.True(t, cache.take(id, msg, sig))
+	// found once
+	assert.False(t, cache.take(id, msg, sig))
+
+	// the oldest are evicted
+	cache.add(id, []byte{1}, sig)
+	cache.add(id, []byte{2}, sig)
+	cache.add(id, []byte{3}, sig)
+	assert.False(t, cache.take(id, []byte{1}, sig))
+	assert.True(t, cache.take(id, []byte{3}, sig))
+}
+
+func TestSigCacheKeyLengths(t *testing.T) {
+	id, msg := []byte{1}, []byte("vote")
+	// e.g. dilithium signatures are longer than 255 bytes
+	sig := bytes.Repeat([]byte{2}, 256)
+	assert.NotEqual(t, sigCacheKey(id, msg, sig), sigCacheKey(id, append(sig, msg...), nil))
+}
+
+func TestVerifiedKeys(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	key := NewEd25519PubKey(pub)
+	vals, _ := makeTestValidators(2)
+	SetValidatorPubKeys(vals, []PubKey{key})
+	_, val := vals.GetByAddress(key.Address())
+	msg, sig := []byte("vote"), make([]byte, ed25519.SignatureSize)
+
+	// as if the pipeline of cs verified the (invalid) signature
+	cs := &ConsensusState{verifiedSigs: newSigCache(4)}
+	cs.verifiedSigs.add(sigCacheID(key), msg, sig)
+	other := &ConsensusState{verifiedSigs: newSigCache(4)}
+
+	_, otherVal := other.verifiedKeys(vals).GetByAddress(key.Address())
+	assert.False(t, otherVal.PubKey.VerifySignature(msg, sig))
+	assert.False(t, val.PubKey.VerifySignature(msg, sig))
+	_, csVal := cs.verifiedKeys(vals).GetByAddress(key.Address())
+	assert.True(t, csVal.PubKey.VerifySignature(msg, sig))
+	// found once
+	assert.False(t, csVal.PubKey.VerifySignature(msg, sig))
+	assert.Equal(t, key, val.PubKey)
+}
@@ -0,0 +1,668 @@
+package consensus
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// The consensus WAL records every message and timeout before the consensus
+// state acts on it, so that a restarted node can replay the height it crashed
+// in and get back to the round and step it was at, with the votes it already
+// signed: as they are replayed instead of signed again, it cannot sign
+// conflicting ones. Our own messages are fsynced before they are handled and
+// so before they are sent; an EndHeight entry is written once the block of a
+// height is stored.
+//
+// The entries are framed like the mempool WAL. The head file is rotated once
+// larger than MaxFileSize, and only the MaxFiles latest rotated files are
+// kept.
+
+var (
+	ErrWALCorrupted = errors.New("consensus wal corrupted")
+
+	// Largest entry accepted when reading the WAL, anything bigger is
+	// treated as corruption.
+	MaxWALEntrySize = uint32(64 << 20)
+)
+
+const walHeadName = "consensus.wal"
+
+// WALFsyncPolicy tells when the WAL is fsynced.
+type WALFsyncPolicy int
+
+const (
+	// fsync our own messages before handling them
+	WALFsyncAlways WALFsyncPolicy = iota
+	// fsync at most every FsyncInterval, a crash may lose our last
+	// messages, which may then be signed again differently
+	WALFsyncInterval
+	// leave it to the OS, for benchmarks only
+	WALFsyncNever
+)
+
+func ParseWALFsyncPolicy(s string) (WALFsyncPolicy, error) {
+	switch s {
+	case "always":
+		return WALFsyncAlways, nil
+	case "interval":
+		return WALFsyncInterval, nil
+	case "never":
+		return WALFsyncNever, nil
+	}
+	return 0, fmt.Errorf("unknown wal fsync policy %q, expected always, interval or never", s)
+}
+
+type WALConfig struct {
+	Dir           string
+	MaxFileSize   int64 // 0 for DefaultWALConfig.MaxFileSize
+	MaxFiles      int   // rotated files kept, 0 for DefaultWALConfig.MaxFiles
+	Fsync         WALFsyncPolicy
+	FsyncInterval time.Duration
+}
+
+var DefaultWALConfig = WALConfig{
+	MaxFileSize:   64 << 20,
+	MaxFiles:      4,
+	Fsync:         WALFsyncAlways,
+	FsyncInterval: 100 * time.Millisecond,
+}
+
+const (
+	walEntryMsg uint8 = iota + 1
+	walEntryTimeout
+	walEntryEndHeight
+)
+
+const (
+	walMsgProposal uint8 = iota + 1
+	walMsgVote
+)
+
+// walEntry is the RLP of a WAL entry. Data is the message type and its RLP.
+type walEntry struct {
+	Type     uint8
+	Height   uint64
+	Round    uint32
+	Step     uint8
+	Duration uint64
+	PeerID   string
+	Data     []byte
+}
+
+// WAL is the consensus write-ahead log, see OpenWAL.
+type WAL struct {
+	mtx      sync.Mutex
+	cfg      WALConfig
+	file     *os.File
+	w        *bufio.Writer
+	size     int64
+	lastSync time.Time
+}
+
+// OpenWAL opens (or creates) the WAL in cfg.Dir. A truncated last entry, as
+// left by a crash in the middle of a write, is cut off.
+func OpenWAL(cfg WALConfig) (*WAL, error) {
+	if cfg.MaxFileSize <= 0 {
+		cfg.MaxFileSize = DefaultWALConfig.MaxFileSize
+	}
+	if cfg.MaxFiles <= 0 {
+		cfg.MaxFiles = DefaultWALConfig.MaxFiles
+	}
+	if cfg.FsyncInterval <= 0 {
+		cfg.FsyncInterval = DefaultWALConfig.FsyncInterval
+	}
+
+	wal := &WAL{cfg: cfg}
+	if err := wal.repairHead(); err != nil {
+		return nil, err
+	}
+	if err := wal.openHead(); err != nil {
+		return nil, err
+	}
+	return wal, nil
+}
+
+func (wal *WAL) headPath() string {
+	return filepath.Join(wal.cfg.Dir, walHeadName)
+}
+
+func (wal *WAL) openHead() error {
+	file, err := os.OpenFile(wal.headPath(), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open consensus wal: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	wal.file, wal.w, wal.size = file, bufio.NewWriter(file), info.Size()
+	return nil
+}
+
+func (wal *WAL) repairHead() error {
+	file, err := os.OpenFile(wal.headPath(), os.O_RDWR, 0600)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open consensus wal: %w", err)
+	}
+	defer file.Close()
+
+	r := &countingReader{r: bufio.NewReader(file)}
+	valid := int64(0)
+	for {
+		_, err := readWALEntry(r)
+		if err == io.EOF {
+			return nil
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			log.Warn("Cutting off truncated consensus wal entry", "path", wal.headPath(), "size", valid)
+			return file.Truncate(valid)
+		}
+		if err != nil {
+			return err
+		}
+		valid = r.n
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// files returns the paths of the WAL files, the oldest first.
+func (wal *WAL) files() ([]string, error) {
+	return walFiles(wal.cfg.Dir)
+}
+
+// walFiles returns the paths of the WAL files in dir, the oldest first.
+func walFiles(dir string) ([]string, error) {
+	head := filepath.Join(dir, walHeadName)
+	rotated, err := filepath.Glob(head + ".*")
+	if err != nil {
+		return nil, err
+	}
+	indexes := make([]int, 0, len(rotated))
+	for _, path := range rotated {
+		if index, err := strconv.Atoi(strings.TrimPrefix(filepath.Ext(path), ".")); err == nil {
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Ints(indexes)
+
+	paths := make([]string, 0, len(indexes)+1)
+	for _, index := range indexes {
+		paths = append(paths, walRotatedPath(head, index))
+	}
+	return append(paths, head), nil
+}
+
+func (wal *WAL) rotatedPath(index int) string {
+	return walRotatedPath(wal.headPath(), index)
+}
+
+func walRotatedPath(head string, index int) string {
+	return fmt.Sprintf("%s.%06d", head, index)
+}
+
+// rotate renames the head to the next rotated file and deletes the oldest
+// ones.
+func (wal *WAL) rotate() error {
+	if err := wal.flushAndSync(); err != nil {
+		return err
+	}
+	if err := wal.file.Close(); err != nil {
+		return err
+	}
+
+	paths, err := wal.files()
+	if err != nil {
+		return err
+	}
+	next := 1
+	if len(paths) > 1 {
+		last, _ := strconv.Atoi(strings.TrimPrefix(filepath.Ext(paths[len(paths)-2]), "."))
+		next = last + 1
+	}
+	if err := os.Rename(wal.headPath(), wal.rotatedPath(next)); err != nil {
+		return err
+	}
+	rotated := append(paths[:len(paths)-1], wal.rotatedPath(next))
+	for len(rotated) > wal.cfg.MaxFiles {
+		if err := os.Remove(rotated[0]); err != nil {
+			log.Warn("Failed to remove old consensus wal file", "path", rotated[0], "err", err)
+		}
+		rotated = rotated[1:]
+	}
+	return wal.openHead()
+}
+
+func (wal *WAL) write(e *walEntry) error {
+	data, err := rlp.EncodeToBytes(e)
+	if err != nil {
+		return err
+	}
+	if err := writeWALEntry(wal.w, data); err != nil {
+		return err
+	}
+	wal.size += int64(8 + len(data))
+	if wal.size > wal.cfg.MaxFileSize {
+		return wal.rotate()
+	}
+	return nil
+}
+
+// Write appends an entry, buffered until the next sync.
+func (wal *WAL) Write(e *walEntry) error {
+	wal.mtx.Lock()
+	defer wal.mtx.Unlock()
+	return wal.write(e)
+}
+
+// WriteSync appends an entry and syncs the WAL as the fsync policy says.
+func (wal *WAL) WriteSync(e *walEntry) error {
+	wal.mtx.Lock()
+	defer wal.mtx.Unlock()
+	if err := wal.write(e); err != nil {
+		return err
+	}
+	return wal.sync()
+}
+
+// FlushAndSync writes the buffered entries and syncs as the fsync policy says.
+func (wal *WAL) FlushAndSync() error {
+	wal.mtx.Lock()
+	defer wal.mtx.Unlock()
+	return wal.sync()
+}
+
+func (wal *WAL) sync() error {
+	switch wal.cfg.Fsync {
+	case WALFsyncNever:
+		return wal.w.Flush()
+	case WALFsyncInterval:
+		if time.Since(wal.lastSync) < wal.cfg.FsyncInterval {
+			return wal.w.Flush()
+		}
+	}
+	return wal.flushAndSync()
+}
+
+func (wal *WAL) flushAndSync() error {
+	if err := wal.w.Flush(); err != nil {
+		return err
+	}
+	wal.lastSync = time.Now()
+	return wal.file.Sync()
+}
+
+// Close flushes, fsyncs and closes the WAL.
+func (wal *WAL) Close() error {
+	wal.mtx.Lock()
+	defer wal.mtx.Unlock()
+	if err := wal.flushAndSync(); err != nil {
+		return err
+	}
+	return wal.file.Close()
+}
+
+// readHeight returns the entries of a height, in order, and whether the
+// height ended.
+func (wal *WAL) readHeight(height uint64) ([]*walEntry, bool, error) {
+	wal.mtx.Lock()
+	defer wal.mtx.Unlock()
+	if err := wal.w.Flush(); err != nil {
+		return nil, false, err
+	}
+
+	paths, err := wal.files()
+	if err != nil {
+		return nil, false, err
+	}
+	return readWALHeight(paths, height)
+}
+
+// readWALHeight reads the entries of a height from the WAL files at paths. A
+// truncated last entry of the head, which a WAL not opened since a crash
+// keeps, ends the WAL.
+func readWALHeight(paths []string, height uint64) ([]*walEntry, bool, error) {
+	var entries []*walEntry
+	ended := false
+	for i, path := range paths {
+		file, err := os.Open(path)
+		if os.IsNotExist(err) && i == len(paths)-1 {
+			break
+		}
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to open consensus wal: %w", err)
+		}
+		r := bufio.NewReader(file)
+		for {
+			data, err := readWALEntry(r)
+			if err == io.EOF {
+				break
+			}
+			if errors.Is(err, io.ErrUnexpectedEOF) && i == len(paths)-1 {
+				log.Warn("Ignoring truncated consensus wal entry", "path", path)
+				break
+			}
+			if err != nil {
+				file.Close()
+				return nil, false, fmt.Errorf("%s: %w", path, err)
+			}
+			e := &walEntry{}
+			if err := rlp.DecodeBytes(data, e); err != nil {
+				file.Close()
+				return nil, false, fmt.Errorf("%w: %s: %v", ErrWALCorrupted, path, err)
+			}
+			if e.Height != height {
+				continue
+			}
+			if e.Type == walEntryEndHeight {
+				ended = true
+				continue
+			}
+			entries = append(entries, e)
+		}
+		file.Close()
+	}
+	return entries, ended, nil
+}
+
+func writeWALEntry(w io.Writer, data []byte) error {
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(hdr[4:], crc32.ChecksumIEEE(data))
+
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func readWALEntry(r io.Reader) ([]byte, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(hdr[:4])
+	if size > MaxWALEntrySize {
+		return nil, fmt.Errorf("%w: entry size %d", ErrWALCorrupted, size)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(hdr[4:]) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrWALCorrupted)
+	}
+	return data, nil
+}
+
+// walMsgEntry returns the entry of a message, nil for the messages not
+// replayed (e.g. vote extensions and evidence, which peers send again).
+func walMsgEntry(mi MsgInfo) (*walEntry, error) {
+	var buf bytes.Buffer
+	e := &walEntry{Type: walEntryMsg, PeerID: mi.PeerID}
+	switch m := mi.Msg.(type) {
+	case *ProposalMessage:
+		e.Height = m.Proposal.Height
+		buf.WriteByte(walMsgProposal)
+		if err := m.Proposal.EncodeRLP(&buf); err != nil {
+			return nil, err
+		}
+	case *VoteMessage:
+		e.Height = m.Vote.Height
+		buf.WriteByte(walMsgVote)
+		if err := m.Vote.EncodeRLP(&buf); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, nil
+	}
+	e.Data = buf.Bytes()
+	return e, nil
+}
+
+func walTimeoutEntry(ti timeoutInfo) *walEntry {
+	return &walEntry{
+		Type:     walEntryTimeout,
+		Height:   ti.Height,
+		Round:    uint32(ti.Round),
+		Step:     uint8(ti.Step),
+		Duration: uint64(ti.Duration),
+	}
+}
+
+func (e *walEntry) msgInfo() (MsgInfo, error) {
+	if len(e.Data) == 0 {
+		return MsgInfo{}, fmt.Errorf("%w: empty message", ErrWALCorrupted)
+	}
+	s := rlp.NewStream(bytes.NewReader(e.Data[1:]), 0)
+	switch e.Data[0] {
+	case walMsgProposal:
+		p := &Proposal{}
+		if err := p.DecodeRLP(s); err != nil {
+			return MsgInfo{}, fmt.Errorf("%w: %v", ErrWALCorrupted, err)
+		}
+		return MsgInfo{Msg: &ProposalMessage{Proposal: p}, PeerID: e.PeerID}, nil
+	case walMsgVote:
+		v := &Vote{}
+		if err := v.DecodeRLP(s); err != nil {
+			return MsgInfo{}, fmt.Errorf("%w: %v", ErrWALCorrupted, err)
+		}
+		return MsgInfo{Msg: &VoteMessage{Vote: v}, PeerID: e.PeerID}, nil
+	}
+	return MsgInfo{}, fmt.Errorf("%w: unknown message type %d", ErrWALCorrupted, e.Data[0])
+}
+
+func (e *walEntry) timeoutInfo() timeoutInfo {
+	return timeoutInfo{
+		Duration: time.Duration(e.Duration),
+		Height:   e.Height,
+		Round:    int32(e.Round),
+		Step:     RoundStepType(e.Step),
+	}
+}
+
+// SetWAL records the messages and timeouts in wal, and replays the current
+// height from it at start. It must be called before the consensus state
+// starts.
+func (cs *ConsensusState) SetWAL(wal *WAL) {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	cs.wal = wal
+}
+
+// walWriteMsg records a message before it is handled. Our own messages are
+// synced, so we never act on (e.g. send) a vote the WAL could lose.
+func (cs *ConsensusState) walWriteMsg(mi MsgInfo) {
+	if cs.wal == nil || cs.replayMode {
+		return
+	}
+	e, err := walMsgEntry(mi)
+	if err != nil || e == nil {
+		if err != nil {
+			log.Error("failed encoding message for WAL", "err", err)
+		}
+		return
+	}
+	if mi.PeerID != "" {
+		if err := cs.wal.Write(e); err != nil {
+			log.Error("failed writing to WAL", "err", err)
+		}
+		return
+	}
+	if err := cs.wal.WriteSync(e); err != nil {
+		panic(fmt.Sprintf(
+			"failed to write %v msg to consensus WAL due to %v; check your file system and restart the node",
+			mi, err,
+		))
+	}
+}
+
+func (cs *ConsensusState) walWriteTimeout(ti timeoutInfo) {
+	if cs.wal == nil || cs.replayMode {
+		return
+	}
+	if err := cs.wal.Write(walTimeoutEntry(ti)); err != nil {
+		log.Error("failed writing to WAL", "err", err)
+	}
+}
+
+// walEndHeight records that the block of height is stored.
+func (cs *ConsensusState) walEndHeight(height uint64) {
+	if cs.wal == nil || cs.replayMode {
+		return
+	}
+	if err := cs.wal.WriteSync(&walEntry{Type: walEntryEndHeight, Height: height}); err != nil {
+		panic(fmt.Sprintf(
+			"failed to write end of height %d to consensus WAL due to %v; check your file system and restart the node",
+			height, err,
+		))
+	}
+}
+
+// walFlush syncs the WAL before signing, so that what we sign is derived
+// from messages the WAL keeps.
+func (cs *ConsensusState) walFlush() {
+	if cs.wal == nil || cs.replayMode {
+		return
+	}
+	if err := cs.wal.FlushAndSync(); err != nil {
+		log.Error("failed flushing WAL to disk", "err", err)
+	}
+}
+
+// catchupReplay replays the messages and timeouts of height recorded before
+// a restart. Nothing is signed while replaying: the votes and proposal we
+// signed are replayed like the others.
+func (cs *ConsensusState) catchupReplay(ctx context.Context, height uint64) error {
+	entries, ended, err := cs.wal.readHeight(height)
+	if err != nil {
+		return err
+	}
+	if ended {
+		// should not happen: consensus starts after the stored blocks
+		log.Warn("consensus WAL has ended the height to start at, not replaying", "height", height)
+		return nil
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	if _, err := cs.replayWALEntries(ctx, entries, nil); err != nil {
+		return err
+	}
+	log.Info("Replayed consensus WAL", "height", height, "entries", len(entries), "round", cs.Round, "step", cs.Step)
+	return nil
+}
+
+// ReplayedWALEntry is a WAL entry replayed by ReplayWAL.
+type ReplayedWALEntry struct {
+	Index  int
+	Msg    Message // the proposal or vote, nil for a timeout
+	PeerID string  // empty for the messages of the node
+	// the timeout, for a timeout
+	Timeout time.Duration
+	Round   int32
+	Step    RoundStepType
+}
+
+// ReplayWAL replays the WAL in dir from the height of cs, to reconstruct the
+// round state of the node that wrote it, e.g., from a copy of its data dir.
+// The WAL files are only read, a truncated last entry ends them. cs must not
+// be started, nor have a private validator: the votes the node signed are
+// replayed like the others. onEntry, if set, is called after each entry, and
+// stops the replay when it returns false. It returns the number of entries
+// replayed; a height committed by the replay moves cs to the next one.
+func (cs *ConsensusState) ReplayWAL(ctx context.Context, dir string, onEntry func(ReplayedWALEntry) bool) (int, error) {
+	paths, err := walFiles(dir)
+	if err != nil {
+		return 0, err
+	}
+	entries, _, err := readWALHeight(paths, cs.Height)
+	if err != nil {
+		return 0, err
+	}
+
+	// timeouts scheduled by the replay are not acted on, only the replayed
+	// ones are, but they must not block the state machine
+	if !cs.timeoutTicker.IsRunning() {
+		if err := cs.timeoutTicker.Start(ctx); err != nil {
+			return 0, err
+		}
+	}
+
+	var cb func(int, *walEntry, MsgInfo) bool
+	if onEntry != nil {
+		cb = func(i int, e *walEntry, mi MsgInfo) bool {
+			return onEntry(ReplayedWALEntry{
+				Index:   i,
+				Msg:     mi.Msg,
+				PeerID:  mi.PeerID,
+				Timeout: time.Duration(e.Duration),
+				Round:   int32(e.Round),
+				Step:    RoundStepType(e.Step),
+			})
+		}
+	}
+	return cs.replayWALEntries(ctx, entries, cb)
+}
+
+// replayWALEntries handles entries, calling onEntry, if set, after each one
+// until it returns false.
+func (cs *ConsensusState) replayWALEntries(ctx context.Context, entries []*walEntry, onEntry func(int, *walEntry, MsgInfo) bool) (int, error) {
+	cs.replayMode = true
+	defer func() { cs.replayMode = false }()
+
+	for i, e := range entries {
+		var mi MsgInfo
+		switch e.Type {
+		case walEntryMsg:
+			var err error
+			if mi, err = e.msgInfo(); err != nil {
+				return i, err
+			}
+			cs.handleMsg(ctx, mi)
+		case walEntryTimeout:
+			cs.handleTimeout(ctx, e.timeoutInfo(), cs.RoundState)
+		}
+		if onEntry != nil && !onEntry(i, e, mi) {
+			return i + 1, nil
+		}
+	}
+	return len(entries), nil
+}
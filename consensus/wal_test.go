@@ -0,0 +1,135 @@
+package consensus
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTimeouts(t *testing.T, wal *WAL, height uint64, n int) {
+	for i := 0; i < n; i++ {
+		ti := timeoutInfo{Duration: time.Second, Height: height, Round: int32(i), Step: RoundStepPropose}
+		assert.NoError(t, wal.Write(walTimeoutEntry(ti)))
+	}
+}
+
+func TestWALReadHeight(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := OpenWAL(WALConfig{Dir: dir})
+	assert.NoError(t, err)
+
+	writeTimeouts(t, wal, 1, 2)
+	assert.NoError(t, wal.WriteSync(&walEntry{Type: walEntryEndHeight, Height: 1}))
+	writeTimeouts(t, wal, 2, 3)
+	assert.NoError(t, wal.Close())
+
+	wal, err = OpenWAL(WALConfig{Dir: dir})
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	entries, ended, err := wal.readHeight(1)
+	assert.NoError(t, err)
+	assert.True(t, ended)
+	assert.Len(t, entries, 2)
+
+	entries, ended, err = wal.readHeight(2)
+	assert.NoError(t, err)
+	assert.False(t, ended)
+	assert.Len(t, entries, 3)
+	assert.Equal(t, int32(2), entries[2].timeoutInfo().Round)
+	assert.Equal(t, time.Second, entries[2].timeoutInfo().Duration)
+}
+
+func TestWALTruncatedTail(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := OpenWAL(WALConfig{Dir: dir})
+	assert.NoError(t, err)
+	writeTimeouts(t, wal, 1, 3)
+	assert.NoError(t, wal.Close())
+
+	// crash in the middle of the last write
+	path := filepath.Join(dir, walHeadName)
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(path, info.Size()-2))
+
+	wal, err = OpenWAL(WALConfig{Dir: dir})
+	assert.NoError(t, err)
+	writeTimeouts(t, wal, 1, 1)
+	entries, _, err := wal.readHeight(1)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+	assert.NoError(t, wal.Close())
+
+	// a corrupted entry is not repaired
+	data, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	data[10] ^= 0xff
+	assert.NoError(t, os.WriteFile(path, data, 0600))
+	_, err = OpenWAL(WALConfig{Dir: dir})
+	assert.ErrorIs(t, err, ErrWALCorrupted)
+}
+
+func TestWALRotation(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := OpenWAL(WALConfig{Dir: dir, MaxFileSize: 64, MaxFiles: 2})
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	writeTimeouts(t, wal, 1, 20)
+	paths, err := wal.files()
+	assert.NoError(t, err)
+	assert.Len(t, paths, 3)
+
+	// the oldest entries were deleted with their files
+	entries, _, err := wal.readHeight(1)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, entries)
+	assert.Less(t, len(entries), 20)
+	assert.Equal(t, int32(19), entries[len(entries)-1].timeoutInfo().Round)
+}
+
+func TestParseWALFsyncPolicy(t *testing.T) {
+	policy, err := ParseWALFsyncPolicy("interval")
+	assert.NoError(t, err)
+	assert.Equal(t, WALFsyncInterval, policy)
+
+	_, err = ParseWALFsyncPolicy("sometimes")
+	assert.Error(t, err)
+}
+
+func TestReadWALCopy(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := OpenWAL(WALConfig{Dir: dir})
+	assert.NoError(t, err)
+	writeTimeouts(t, wal, 1, 5)
+	assert.NoError(t, wal.Close())
+
+	// copied from a node that crashed in the middle of a write
+	path := filepath.Join(dir, walHeadName)
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(path, info.Size()-2))
+
+	paths, err := walFiles(dir)
+	assert.NoError(t, err)
+	entries, ended, err := readWALHeight(paths, 1)
+	assert.NoError(t, err)
+	assert.False(t, ended)
+	assert.Equal(t, int32(3), entries[len(entries)-1].timeoutInfo().Round)
+
+	// not repaired
+	info2, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, info.Size()-2, info2.Size())
+
+	// no WAL
+	paths, err = walFiles(t.TempDir())
+	assert.NoError(t, err)
+	entries, _, err = readWALHeight(paths, 1)
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
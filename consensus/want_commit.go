@@ -0,0 +1,41 @@
+package consensus
+
+import (
+	"errors"
+)
+
+// WantCommit asks the peers for the commit of a height. It is sent by a node
+// that has the block of its current height but not +2/3 precommits for it,
+// e.g., after a restart, when the precommits were gossiped while it was down:
+// a peer that already committed the height answers with the commit it saw
+// (see LoadCommit), whose precommits are added as votes, instead of waiting
+// for block sync.
+type WantCommit struct {
+	Height uint64
+}
+
+func (wc *WantCommit) ValidateBasic() error {
+	if wc.Height == 0 {
+		return errors.New("zero height")
+	}
+	return nil
+}
+
+// needCommit tells whether to ask the peers for the commit of the current
+// height: the proposal block is known but its precommits are not.
+func (cs *ConsensusState) needCommit() bool {
+	return cs.isProposalComplete() && !cs.Votes.Precommits(cs.Round).HasTwoThirdsMajority()
+}
+
+// CommitVotes returns the precommits of a commit received for a WantCommit,
+// to be added as VoteMessages, which verifies them.
+func CommitVotes(commit *Commit) []*Vote {
+	var votes []*Vote
+	for i, commitSig := range commit.Signatures {
+		if commitSig.Absent() {
+			continue
+		}
+		votes = append(votes, commit.GetVote(int32(i)))
+	}
+	return votes
+}
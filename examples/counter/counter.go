@@ -0,0 +1,105 @@
+// Package counter is the smallest application: it counts the blocks and
+// txs, and jails the validators that missed too many commits in a row until
+// they sign again.
+package counter
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+type App struct {
+	maxMissed int
+
+	mu     sync.Mutex
+	height uint64
+	blocks uint64
+	txs    uint64
+	missed map[common.Address]int
+	jailed map[common.Address]bool
+}
+
+var (
+	_ consensus.BlockFinalizer = (*App)(nil)
+	_ consensus.Querier        = (*App)(nil)
+)
+
+// New returns a counter jailing the validators that miss maxMissed commits
+// in a row, 0 to never jail them.
+func New(maxMissed int) *App {
+	return &App{
+		maxMissed: maxMissed,
+		missed:    make(map[common.Address]int),
+		jailed:    make(map[common.Address]bool),
+	}
+}
+
+func (app *App) FinalizeBlock(ctx context.Context, req consensus.FinalizeBlockRequest) (consensus.FinalizeBlockResponse, error) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+
+	app.height = req.Height
+	app.blocks++
+	app.txs += uint64(len(req.Txs))
+
+	var resp consensus.FinalizeBlockResponse
+	for _, vote := range req.LastCommitInfo.Votes {
+		addr := vote.Address
+		if vote.SignedLastBlock {
+			app.missed[addr] = 0
+			if app.jailed[addr] {
+				delete(app.jailed, addr)
+				resp.JailUpdates = append(resp.JailUpdates, consensus.JailUpdate{Address: addr, Jailed: false})
+			}
+			continue
+		}
+
+		app.missed[addr]++
+		// the engine refuses to jail every validator
+		if app.maxMissed > 0 && app.missed[addr] >= app.maxMissed && !app.jailed[addr] &&
+			len(app.jailed)+1 < len(req.LastCommitInfo.Votes) {
+			app.jailed[addr] = true
+			resp.JailUpdates = append(resp.JailUpdates, consensus.JailUpdate{Address: addr, Jailed: true})
+		}
+	}
+
+	resp.AppHash = app.hash()
+	return resp, nil
+}
+
+func (app *App) hash() []byte {
+	return append(uint64Bytes(app.blocks), uint64Bytes(app.txs)...)
+}
+
+func uint64Bytes(n uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+	return b
+}
+
+// Query serves "/blocks" and "/txs", as 8-byte big-endian integers at the
+// latest height. The counter keeps no history and cannot prove anything.
+func (app *App) Query(ctx context.Context, req consensus.QueryRequest) (consensus.QueryResponse, error) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+
+	resp := consensus.QueryResponse{Height: app.height}
+	switch {
+	case req.Height != 0 && req.Height != app.height:
+		resp.Code, resp.Log = 1, fmt.Sprintf("only the latest height %d can be queried", app.height)
+	case req.Prove:
+		resp.Code, resp.Log = 2, "proofs are not supported"
+	case req.Path == "/blocks":
+		resp.Value = uint64Bytes(app.blocks)
+	case req.Path == "/txs":
+		resp.Value = uint64Bytes(app.txs)
+	default:
+		resp.Code, resp.Log = 3, fmt.Sprintf("unknown path %q", req.Path)
+	}
+	return resp, nil
+}
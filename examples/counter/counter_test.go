@@ -0,0 +1,65 @@
+package counter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func commitInfo(signed ...bool) consensus.CommitInfo {
+	info := consensus.CommitInfo{}
+	for i, s := range signed {
+		info.Votes = append(info.Votes, consensus.VoteInfo{
+			Address:         common.BytesToAddress([]byte{byte(i + 1)}),
+			Power:           1,
+			SignedLastBlock: s,
+		})
+	}
+	return info
+}
+
+func TestJailMissingValidators(t *testing.T) {
+	app := New(2)
+	ctx := context.Background()
+	val1 := common.BytesToAddress([]byte{1})
+
+	resp, err := app.FinalizeBlock(ctx, consensus.FinalizeBlockRequest{Height: 1, LastCommitInfo: commitInfo(false, true, true)})
+	assert.NoError(t, err)
+	assert.Empty(t, resp.JailUpdates)
+
+	resp, err = app.FinalizeBlock(ctx, consensus.FinalizeBlockRequest{Height: 2, LastCommitInfo: commitInfo(false, true, true)})
+	assert.NoError(t, err)
+	assert.Equal(t, []consensus.JailUpdate{{Address: val1, Jailed: true}}, resp.JailUpdates)
+
+	// the last validators out of jail are never jailed
+	for h := uint64(3); h < 6; h++ {
+		resp, err = app.FinalizeBlock(ctx, consensus.FinalizeBlockRequest{Height: h, LastCommitInfo: commitInfo(false, false, false)})
+		assert.NoError(t, err)
+	}
+	assert.Len(t, app.jailed, 2)
+
+	resp, err = app.FinalizeBlock(ctx, consensus.FinalizeBlockRequest{Height: 6, LastCommitInfo: commitInfo(true, false, false)})
+	assert.NoError(t, err)
+	assert.Equal(t, []consensus.JailUpdate{{Address: val1, Jailed: false}}, resp.JailUpdates)
+}
+
+func TestCounterQuery(t *testing.T) {
+	app := New(0)
+	ctx := context.Background()
+
+	resp, err := app.FinalizeBlock(ctx, consensus.FinalizeBlockRequest{Height: 1})
+	assert.NoError(t, err)
+	assert.Equal(t, append(uint64Bytes(1), uint64Bytes(0)...), resp.AppHash)
+
+	q, err := app.Query(ctx, consensus.QueryRequest{Path: "/blocks"})
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(0), q.Code)
+	assert.Equal(t, uint64Bytes(1), q.Value)
+
+	q, err = app.Query(ctx, consensus.QueryRequest{Path: "/blocks", Height: 2})
+	assert.NoError(t, err)
+	assert.NotEqual(t, uint32(0), q.Code)
+}
@@ -0,0 +1,121 @@
+// Package kvstore is a key-value store application whose values are queried
+// with proofs against its app hash, the root of a statetree.
+//
+// A tx sets a key to a value with the data "key=value", or "key" for a value
+// equal to the key.
+package kvstore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/QuarkChain/go-minimal-pbft/statetree"
+)
+
+type App struct {
+	mu       sync.Mutex
+	tree     *statetree.Tree
+	height   uint64
+	versions map[uint64]int64 // tree version of each height
+}
+
+var (
+	_ consensus.BlockFinalizer = (*App)(nil)
+	_ consensus.Querier        = (*App)(nil)
+)
+
+func New() *App {
+	return &App{
+		tree:     statetree.New(),
+		versions: make(map[uint64]int64),
+	}
+}
+
+func parseTx(data []byte) (key, value []byte) {
+	if i := bytes.IndexByte(data, '='); i >= 0 {
+		return data[:i], data[i+1:]
+	}
+	return data, data
+}
+
+func (app *App) FinalizeBlock(ctx context.Context, req consensus.FinalizeBlockRequest) (consensus.FinalizeBlockResponse, error) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+
+	for _, tx := range req.Txs {
+		key, value := parseTx(tx.Data())
+		if len(key) == 0 {
+			continue
+		}
+		app.tree.Set(key, value)
+	}
+
+	hash, version := app.tree.SaveVersion()
+	app.height = req.Height
+	app.versions[req.Height] = version
+	return consensus.FinalizeBlockResponse{AppHash: hash}, nil
+}
+
+// Query serves "/key" with the key as data. The value is proven to be, or
+// not to be, in the state after the block at the response height: the state
+// whose root is the AppHash of that height.
+func (app *App) Query(ctx context.Context, req consensus.QueryRequest) (consensus.QueryResponse, error) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+
+	height := req.Height
+	if height == 0 {
+		height = app.height
+	}
+	resp := consensus.QueryResponse{Key: req.Data, Height: height}
+	if req.Path != "/key" {
+		resp.Code, resp.Log = 1, fmt.Sprintf("unknown path %q", req.Path)
+		return resp, nil
+	}
+
+	version, ok := app.versions[height]
+	if !ok {
+		resp.Code, resp.Log = 2, fmt.Sprintf("no state at height %d", height)
+		return resp, nil
+	}
+	it, err := app.tree.GetImmutable(version)
+	if err != nil {
+		return resp, err
+	}
+
+	value, proof := it.GetWithProof(req.Data)
+	resp.Value = value
+	if value != nil {
+		resp.Log = "exists"
+	} else {
+		resp.Log = "does not exist"
+	}
+	if req.Prove {
+		op, err := proof.ProofOp(req.Data)
+		if err != nil {
+			return resp, err
+		}
+		resp.ProofOps = []consensus.ProofOp{op}
+	}
+	return resp, nil
+}
+
+// VerifyQuery verifies the proof of a query response against the app hash
+// of its height, as a client of the store would.
+func VerifyQuery(appHash []byte, resp consensus.QueryResponse) error {
+	if len(resp.ProofOps) != 1 {
+		return errors.New("expected one proof op")
+	}
+	proof, err := statetree.ProofFromOp(resp.ProofOps[0])
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(resp.ProofOps[0].Key, resp.Key) {
+		return errors.New("proof of another key")
+	}
+	return proof.Verify(appHash, resp.Key, resp.Value)
+}
@@ -0,0 +1,62 @@
+package kvstore
+
+import (
+	"context"
+	"testing"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeBlock(state consensus.ChainState, data ...string) *consensus.FullBlock {
+	height := state.LastBlockHeight + 1
+	commit := consensus.NewCommit(state.LastBlockHeight, 0, state.LastBlockID, nil)
+	block := state.MakeBlock(height, commit, state.Validators.GetProposer().Address)
+
+	var txs []*types.Transaction
+	for _, d := range data {
+		txs = append(txs, types.NewTx(&types.LegacyTx{Data: []byte(d)}))
+	}
+	block.Block = block.Block.WithBody(txs, nil)
+	return block
+}
+
+// TestKVStoreThroughExecutor applies blocks as the consensus does, and
+// queries the store back through the executor, as the abci_query RPC does.
+func TestKVStoreThroughExecutor(t *testing.T) {
+	ctx := context.Background()
+	app := New()
+	exec := consensus.NewDefaultBlockExecutor(nil, consensus.WithFinalizer(app))
+	querier := exec.(consensus.Querier)
+
+	state := *consensus.MakeGenesisChainState("test", 1000, []common.Address{{1}}, []int64{1}, 100, 1)
+
+	state, err := exec.ApplyBlock(ctx, state, makeBlock(state, "a=1", "b"))
+	assert.NoError(t, err)
+	appHash1 := state.AppHash
+
+	state, err = exec.ApplyBlock(ctx, state, makeBlock(state, "a=2"))
+	assert.NoError(t, err)
+	assert.NotEqual(t, appHash1, state.AppHash)
+
+	resp, err := querier.Query(ctx, consensus.QueryRequest{Path: "/key", Data: []byte("a"), Prove: true})
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), resp.Height)
+	assert.Equal(t, []byte("2"), resp.Value)
+	assert.NoError(t, VerifyQuery(state.AppHash, resp))
+	assert.Error(t, VerifyQuery(appHash1, resp))
+
+	// the state of a past height
+	resp, err = querier.Query(ctx, consensus.QueryRequest{Path: "/key", Data: []byte("a"), Height: 1, Prove: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), resp.Value)
+	assert.NoError(t, VerifyQuery(appHash1, resp))
+
+	// and of an absent key
+	resp, err = querier.Query(ctx, consensus.QueryRequest{Path: "/key", Data: []byte("c"), Prove: true})
+	assert.NoError(t, err)
+	assert.Nil(t, resp.Value)
+	assert.NoError(t, VerifyQuery(state.AppHash, resp))
+}
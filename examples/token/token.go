@@ -0,0 +1,153 @@
+// Package token is a token ledger application: txs are transfers signed by
+// the sender, and balances are queried with proofs against the app hash.
+//
+// A transfer is an Ethereum transaction of Value tokens to To, with the
+// nonce of the sender account. Invalid transfers are skipped.
+package token
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/QuarkChain/go-minimal-pbft/statetree"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+type App struct {
+	signer types.Signer
+
+	mu       sync.Mutex
+	tree     *statetree.Tree
+	height   uint64
+	versions map[uint64]int64 // tree version of each height
+}
+
+var (
+	_ consensus.BlockFinalizer = (*App)(nil)
+	_ consensus.Querier        = (*App)(nil)
+	_ consensus.TxHasher       = (*App)(nil)
+)
+
+func balanceKey(addr common.Address) []byte {
+	return append([]byte("balance/"), addr.Bytes()...)
+}
+
+func nonceKey(addr common.Address) []byte {
+	return append([]byte("nonce/"), addr.Bytes()...)
+}
+
+// New returns the ledger of the chain (the chain ID of the transactions)
+// with the genesis balances.
+func New(chainID *big.Int, genesis map[common.Address]*big.Int) *App {
+	app := &App{
+		signer:   types.LatestSignerForChainID(chainID),
+		tree:     statetree.New(),
+		versions: make(map[uint64]int64),
+	}
+	for addr, balance := range genesis {
+		app.setBalance(addr, balance)
+	}
+	return app
+}
+
+func (app *App) balance(addr common.Address) *big.Int {
+	return new(big.Int).SetBytes(app.tree.Get(balanceKey(addr)))
+}
+
+func (app *App) setBalance(addr common.Address, balance *big.Int) {
+	app.tree.Set(balanceKey(addr), balance.Bytes())
+}
+
+func (app *App) nonce(addr common.Address) uint64 {
+	return new(big.Int).SetBytes(app.tree.Get(nonceKey(addr))).Uint64()
+}
+
+// TxHash is the signing hash of the transfer, which does not cover the
+// signature: the transfer is the same whatever the signature.
+func (app *App) TxHash(tx *types.Transaction) common.Hash {
+	return app.signer.Hash(tx)
+}
+
+func (app *App) transfer(tx *types.Transaction) error {
+	from, err := types.Sender(app.signer, tx)
+	if err != nil {
+		return err
+	}
+	if tx.To() == nil {
+		return fmt.Errorf("no recipient")
+	}
+	if nonce := app.nonce(from); tx.Nonce() != nonce {
+		return fmt.Errorf("nonce %d, expected %d", tx.Nonce(), nonce)
+	}
+	value := tx.Value()
+	balance := app.balance(from)
+	if value.Sign() < 0 || balance.Cmp(value) < 0 {
+		return fmt.Errorf("balance %v lower than %v", balance, value)
+	}
+
+	app.tree.Set(nonceKey(from), new(big.Int).SetUint64(tx.Nonce()+1).Bytes())
+	app.setBalance(from, balance.Sub(balance, value))
+	to := app.balance(*tx.To())
+	app.setBalance(*tx.To(), to.Add(to, value))
+	return nil
+}
+
+func (app *App) FinalizeBlock(ctx context.Context, req consensus.FinalizeBlockRequest) (consensus.FinalizeBlockResponse, error) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+
+	for _, tx := range req.Txs {
+		if err := app.transfer(tx); err != nil {
+			log.Debug("Skipping invalid transfer", "height", req.Height, "tx", app.TxHash(tx), "err", err)
+		}
+	}
+
+	hash, version := app.tree.SaveVersion()
+	app.height = req.Height
+	app.versions[req.Height] = version
+	return consensus.FinalizeBlockResponse{AppHash: hash}, nil
+}
+
+// Query serves "/balance" with the 20-byte address as data. The value is the
+// big-endian balance, and with proof the key is balanceKey(address).
+func (app *App) Query(ctx context.Context, req consensus.QueryRequest) (consensus.QueryResponse, error) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+
+	height := req.Height
+	if height == 0 {
+		height = app.height
+	}
+	resp := consensus.QueryResponse{Height: height}
+	if req.Path != "/balance" || len(req.Data) != common.AddressLength {
+		resp.Code, resp.Log = 1, fmt.Sprintf("unknown path %q or invalid address", req.Path)
+		return resp, nil
+	}
+
+	version, ok := app.versions[height]
+	if !ok {
+		resp.Code, resp.Log = 2, fmt.Sprintf("no state at height %d", height)
+		return resp, nil
+	}
+	it, err := app.tree.GetImmutable(version)
+	if err != nil {
+		return resp, err
+	}
+
+	resp.Key = balanceKey(common.BytesToAddress(req.Data))
+	value, proof := it.GetWithProof(resp.Key)
+	resp.Value = value
+	if req.Prove {
+		op, err := proof.ProofOp(resp.Key)
+		if err != nil {
+			return resp, err
+		}
+		resp.ProofOps = []consensus.ProofOp{op}
+	}
+	return resp, nil
+}
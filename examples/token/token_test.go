@@ -0,0 +1,58 @@
+package token
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/QuarkChain/go-minimal-pbft/statetree"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransfers(t *testing.T) {
+	ctx := context.Background()
+	chainID := big.NewInt(7)
+	signer := types.LatestSignerForChainID(chainID)
+
+	key, err := crypto.GenerateKey()
+	assert.NoError(t, err)
+	alice := crypto.PubkeyToAddress(key.PublicKey)
+	bob := common.Address{0xb}
+
+	app := New(chainID, map[common.Address]*big.Int{alice: big.NewInt(100)})
+
+	transfer := func(nonce uint64, value int64) *types.Transaction {
+		tx, err := types.SignTx(types.NewTx(&types.LegacyTx{
+			Nonce: nonce,
+			To:    &bob,
+			Value: big.NewInt(value),
+		}), signer, key)
+		assert.NoError(t, err)
+		return tx
+	}
+
+	txs := types.Transactions{
+		transfer(0, 30),
+		transfer(0, 30),  // replayed
+		transfer(1, 100), // more than the balance
+		transfer(1, 20),
+	}
+	resp, err := app.FinalizeBlock(ctx, consensus.FinalizeBlockRequest{Height: 1, Txs: txs})
+	assert.NoError(t, err)
+
+	assert.Equal(t, big.NewInt(50), app.balance(alice))
+	assert.Equal(t, big.NewInt(50), app.balance(bob))
+	assert.Equal(t, uint64(2), app.nonce(alice))
+
+	q, err := app.Query(ctx, consensus.QueryRequest{Path: "/balance", Data: bob.Bytes(), Prove: true})
+	assert.NoError(t, err)
+	assert.Equal(t, big.NewInt(50).Bytes(), q.Value)
+
+	proof, err := statetree.ProofFromOp(q.ProofOps[0])
+	assert.NoError(t, err)
+	assert.NoError(t, proof.Verify(resp.AppHash, q.Key, q.Value))
+}
@@ -0,0 +1,110 @@
+//go:build failpoints
+// +build failpoints
+
+// Package failpoint injects crashes at named points of the code, to test that
+// a node killed at the worst moment restarts without corrupted state or
+// double signs. It is only compiled in with the failpoints build tag; without
+// it Inject is a no-op.
+//
+// Failpoints are enabled with Enable, or for a whole process with the
+// MPBFT_FAILPOINTS environment variable, e.g.
+//
+//	MPBFT_FAILPOINTS="blockstore/mid-persist=exit,mempool/wal-fsync=skip"
+package failpoint
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+const Enabled = true
+
+// EnvVar holds the failpoints enabled at startup, as name=action pairs.
+const EnvVar = "MPBFT_FAILPOINTS"
+
+// ExitCode is the status of a process killed by an exit failpoint.
+const ExitCode = 86
+
+type Action string
+
+const (
+	// Panic panics at the failpoint.
+	Panic Action = "panic"
+	// Exit kills the process at the failpoint, without running deferred
+	// functions or flushing anything, as a crash would.
+	Exit Action = "exit"
+	// Skip makes Inject return true, so the code skips the step (e.g. an
+	// fsync) guarded by the failpoint.
+	Skip Action = "skip"
+)
+
+var (
+	mu     sync.RWMutex
+	points = make(map[string]Action)
+)
+
+func init() {
+	if err := parse(os.Getenv(EnvVar)); err != nil {
+		panic(err)
+	}
+}
+
+func parse(spec string) error {
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid failpoint %q, expected name=action", entry)
+		}
+		if err := Enable(kv[0], Action(kv[1])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Enable arms the failpoint name with the action.
+func Enable(name string, action Action) error {
+	switch action {
+	case Panic, Exit, Skip:
+	default:
+		return fmt.Errorf("unknown failpoint action %q", action)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	points[name] = action
+	return nil
+}
+
+// Disable disarms the failpoint name.
+func Disable(name string) {
+	mu.Lock()
+	defer mu.Unlock()
+	delete(points, name)
+}
+
+// Inject runs the action of the failpoint name if it is enabled. It returns
+// true if the guarded step must be skipped.
+func Inject(name string) bool {
+	mu.RLock()
+	action, ok := points[name]
+	mu.RUnlock()
+	if !ok {
+		return false
+	}
+
+	switch action {
+	case Panic:
+		panic(fmt.Sprintf("failpoint %s", name))
+	case Exit:
+		fmt.Fprintf(os.Stderr, "failpoint %s: exiting\n", name)
+		os.Exit(ExitCode)
+	}
+	return true
+}
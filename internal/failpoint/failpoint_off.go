@@ -0,0 +1,11 @@
+//go:build !failpoints
+// +build !failpoints
+
+package failpoint
+
+const Enabled = false
+
+// Inject is a no-op without the failpoints build tag.
+func Inject(name string) bool {
+	return false
+}
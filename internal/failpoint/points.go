@@ -0,0 +1,17 @@
+package failpoint
+
+// The failpoints of the node.
+const (
+	// after the tx is appended to the mempool WAL buffer
+	MempoolWALWrite = "mempool/wal-write"
+	// instead of the fsync of the mempool WAL
+	MempoolWALFsync = "mempool/wal-fsync"
+	// before a vote or proposal is signed
+	BeforeSign = "privval/before-sign"
+	// after the sign state file is written, before the message is signed
+	SignStateWrite = "privval/sign-state-write"
+	// after a vote or proposal is signed, before it is sent
+	AfterSign = "privval/after-sign"
+	// after the block is written but before its commit and the new height
+	BlockStoreMidPersist = "blockstore/mid-persist"
+)
@@ -0,0 +1,102 @@
+// Package testhook is the source of time and randomness of the consensus
+// and p2p code, so network-level tests can replace both: with a fake clock
+// and a seeded RNG, the peers picked for gossip and sync and the timestamps
+// of votes and proposals are the same on every run.
+//
+// Nodes never call the setters; tests do, before starting the components,
+// and restore the defaults with Reset once done.
+package testhook
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Clock tells the time.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+var (
+	mu    sync.Mutex
+	clock Clock = systemClock{}
+	rng         = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// SetClock makes Now return the time of c.
+func SetClock(c Clock) {
+	mu.Lock()
+	defer mu.Unlock()
+	clock = c
+}
+
+// SetSeed makes the random numbers the sequence of seed.
+func SetSeed(seed int64) {
+	mu.Lock()
+	defer mu.Unlock()
+	rng = rand.New(rand.NewSource(seed))
+}
+
+// Reset restores the system clock and an unpredictable seed.
+func Reset() {
+	SetClock(systemClock{})
+	SetSeed(time.Now().UnixNano())
+}
+
+func Now() time.Time {
+	mu.Lock()
+	c := clock
+	mu.Unlock()
+	return c.Now()
+}
+
+// Intn returns a random int in [0, n).
+func Intn(n int) int {
+	mu.Lock()
+	defer mu.Unlock()
+	return rng.Intn(n)
+}
+
+// Int63n returns a random int64 in [0, n).
+func Int63n(n int64) int64 {
+	mu.Lock()
+	defer mu.Unlock()
+	return rng.Int63n(n)
+}
+
+// Shuffle shuffles n elements with swap, see rand.Shuffle.
+func Shuffle(n int, swap func(i, j int)) {
+	mu.Lock()
+	defer mu.Unlock()
+	rng.Shuffle(n, swap)
+}
+
+// FakeClock is a Clock moving only when told to.
+type FakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
@@ -0,0 +1,34 @@
+package testhook
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeedIsReproducible(t *testing.T) {
+	defer Reset()
+
+	draw := func() []int {
+		SetSeed(42)
+		var ns []int
+		for i := 0; i < 8; i++ {
+			ns = append(ns, Intn(1000))
+		}
+		return ns
+	}
+	assert.Equal(t, draw(), draw())
+}
+
+func TestFakeClock(t *testing.T) {
+	defer Reset()
+
+	start := time.Unix(1000, 0)
+	c := NewFakeClock(start)
+	SetClock(c)
+	assert.Equal(t, start, Now())
+
+	c.Advance(time.Second)
+	assert.Equal(t, start.Add(time.Second), Now())
+}
@@ -0,0 +1,319 @@
+// Package invariants checks the stores of the nodes of a network against the
+// properties the protocol guarantees: no two commits for different blocks at
+// a height, the same app hashes and validator sets everywhere, commits
+// signed by the validators of their height and increasing block times.
+//
+// The checks read the stores only, so they run against the datadirs of
+// stopped nodes, e.g., at the end of an e2e test or after an incident (see
+// the audit command). A value the nodes disagree on is blamed on the nodes
+// outside the largest group agreeing, and the violations name their failure
+// domains, so that a fault confined to one region or provider stands out
+// from one spread over the network.
+package invariants
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Node is the stores of a node. AppHashes and Validators are nil if the node
+// does not record them, their checks are then skipped.
+type Node struct {
+	Name string
+	// Domain is the failure domain of the node, e.g., its region or
+	// provider.
+	Domain     string
+	Blocks     consensus.BlockStore
+	AppHashes  *consensus.AppHashStore
+	Validators *consensus.ValidatorStore
+}
+
+// Violation is an invariant broken at a height.
+type Violation struct {
+	Check  string `json:"check"`
+	Height uint64 `json:"height"`
+	// Nodes are the nodes at fault, Domains their failure domains.
+	Nodes   []string `json:"nodes"`
+	Domains []string `json:"domains,omitempty"`
+	Detail  string   `json:"detail"`
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%s at height %d by %v: %s", v.Check, v.Height, v.Nodes, v.Detail)
+}
+
+// Check is an invariant over the stores of the nodes.
+type Check struct {
+	Name string
+	Run  func(nodes []Node) []Violation
+}
+
+// Checks are all the invariants, run by Run.
+var Checks = []Check{
+	{"conflicting_commits", CheckCommits},
+	{"app_hash_chain", CheckAppHashes},
+	{"validator_set_linkage", CheckValidators},
+	{"monotonic_time", CheckTimes},
+}
+
+// Run runs the checks, all of them if none is given, and returns the
+// violations in check order, then height order.
+func Run(nodes []Node, checks ...Check) []Violation {
+	if len(checks) == 0 {
+		checks = Checks
+	}
+	var violations []Violation
+	for _, check := range checks {
+		found := check.Run(nodes)
+		sort.SliceStable(found, func(i, j int) bool { return found[i].Height < found[j].Height })
+		violations = append(violations, found...)
+	}
+	return violations
+}
+
+func newViolation(check string, height uint64, nodes []Node, format string, args ...interface{}) Violation {
+	v := Violation{Check: check, Height: height, Detail: fmt.Sprintf(format, args...)}
+	domains := make(map[string]bool)
+	for _, n := range nodes {
+		v.Nodes = append(v.Nodes, n.Name)
+		if n.Domain != "" && !domains[n.Domain] {
+			domains[n.Domain] = true
+			v.Domains = append(v.Domains, n.Domain)
+		}
+	}
+	sort.Strings(v.Domains)
+	return v
+}
+
+// heights returns the heights stored by any of the nodes.
+func heights(nodes []Node) (from, to uint64) {
+	for i, n := range nodes {
+		if base := n.Blocks.Base(); i == 0 || base < from {
+			from = base
+		}
+		if height := n.Blocks.Height(); height > to {
+			to = height
+		}
+	}
+	if from == 0 {
+		from = 1
+	}
+	return from, to
+}
+
+func hasBlock(n Node, height uint64) bool {
+	return n.Blocks.Base() <= height && height <= n.Blocks.Height()
+}
+
+// disagreement compares the values of the nodes at a height, and returns the
+// nodes outside the largest group agreeing on one, all of them on a tie, and
+// a description of the values. It returns no node when all agree.
+func disagreement(nodes []Node, values []string) ([]Node, string) {
+	groups := make(map[string][]Node)
+	var order []string
+	for i, v := range values {
+		if _, ok := groups[v]; !ok {
+			order = append(order, v)
+		}
+		groups[v] = append(groups[v], nodes[i])
+	}
+	if len(groups) <= 1 {
+		return nil, ""
+	}
+
+	largest, tie := order[0], false
+	for _, v := range order[1:] {
+		switch {
+		case len(groups[v]) > len(groups[largest]):
+			largest, tie = v, false
+		case len(groups[v]) == len(groups[largest]):
+			tie = true
+		}
+	}
+
+	var faulty []Node
+	var detail bytes.Buffer
+	for _, v := range order {
+		if tie || v != largest {
+			faulty = append(faulty, groups[v]...)
+		}
+		if detail.Len() > 0 {
+			detail.WriteString(", ")
+		}
+		names := make([]string, len(groups[v]))
+		for i, n := range groups[v] {
+			names[i] = n.Name
+		}
+		fmt.Fprintf(&detail, "%s by %v", v, names)
+	}
+	return faulty, detail.String()
+}
+
+// CheckCommits checks that the nodes committed the same block at every
+// height, and that the stored commit of every block is for it.
+func CheckCommits(nodes []Node) []Violation {
+	const check = "conflicting_commits"
+	var violations []Violation
+
+	from, to := heights(nodes)
+	for height := from; height <= to; height++ {
+		var (
+			have   []Node
+			values []string
+		)
+		for _, n := range nodes {
+			if !hasBlock(n, height) {
+				continue
+			}
+			block := n.Blocks.LoadBlock(height)
+			if block == nil {
+				violations = append(violations, newViolation(check, height, []Node{n}, "block missing from the store"))
+				continue
+			}
+			blockID := block.Hash()
+			if commit := n.Blocks.LoadBlockCommit(height); commit != nil {
+				if commit.BlockID != blockID {
+					violations = append(violations, newViolation(check, height, []Node{n}, "commit for %v, not the stored block %v", commit.BlockID, blockID))
+				}
+				blockID = commit.BlockID
+			}
+			have = append(have, n)
+			values = append(values, blockID.Hex())
+		}
+		if faulty, detail := disagreement(have, values); len(faulty) > 0 {
+			violations = append(violations, newViolation(check, height, faulty, "blocks committed: %s", detail))
+		}
+	}
+	return violations
+}
+
+// CheckAppHashes checks that the nodes recording app hashes have the same
+// at every height, and none missing after their first one.
+func CheckAppHashes(nodes []Node) []Violation {
+	const check = "app_hash_chain"
+	var violations []Violation
+
+	recording := make(map[string]bool)
+	from, to := heights(nodes)
+	for height := from; height <= to; height++ {
+		var (
+			have   []Node
+			values []string
+		)
+		for _, n := range nodes {
+			if n.AppHashes == nil || !hasBlock(n, height) {
+				continue
+			}
+			appHash, ok := n.AppHashes.Load(height)
+			if !ok {
+				if recording[n.Name] {
+					violations = append(violations, newViolation(check, height, []Node{n}, "app hash not recorded"))
+				}
+				continue
+			}
+			recording[n.Name] = true
+			have = append(have, n)
+			values = append(values, fmt.Sprintf("%x", appHash))
+		}
+		if faulty, detail := disagreement(have, values); len(faulty) > 0 {
+			violations = append(violations, newViolation(check, height, faulty, "app hashes: %s", detail))
+		}
+	}
+	return violations
+}
+
+// CheckValidators checks that the nodes recording validator sets have the
+// same at every height, and that the commit of every height is signed by
+// +2/3 of the voting power of the set of the height, and by its validators
+// only.
+func CheckValidators(nodes []Node) []Violation {
+	const check = "validator_set_linkage"
+	var violations []Violation
+
+	from, to := heights(nodes)
+	for height := from; height <= to; height++ {
+		var (
+			have   []Node
+			values []string
+		)
+		for _, n := range nodes {
+			if n.Validators == nil || !hasBlock(n, height) {
+				continue
+			}
+			vals, err := n.Validators.Load(height)
+			if err != nil {
+				continue
+			}
+			if commit := n.Blocks.LoadBlockCommit(height); commit != nil {
+				if err := commitSignedBy(commit, vals); err != nil {
+					violations = append(violations, newViolation(check, height, []Node{n}, "commit: %v", err))
+				}
+			}
+			data, err := json.Marshal(vals)
+			if err != nil {
+				continue
+			}
+			have = append(have, n)
+			values = append(values, fmt.Sprintf("%x", sha256.Sum256(data)))
+		}
+		if faulty, detail := disagreement(have, values); len(faulty) > 0 {
+			violations = append(violations, newViolation(check, height, faulty, "validator sets: %s", detail))
+		}
+	}
+	return violations
+}
+
+// commitSignedBy checks the signers of a commit by address: the signatures
+// themselves were verified when the commit was accepted.
+func commitSignedBy(commit *consensus.Commit, vals []consensus.ValidatorInfo) error {
+	power := make(map[common.Address]int64, len(vals))
+	var total, signed int64
+	for _, val := range vals {
+		power[val.Address] = val.Power
+		total += val.Power
+	}
+	for _, sig := range commit.Signatures {
+		if sig.Absent() {
+			continue
+		}
+		p, ok := power[sig.ValidatorAddress]
+		if !ok {
+			return fmt.Errorf("signed by %v, not a validator", sig.ValidatorAddress)
+		}
+		if sig.ForBlock() {
+			signed += p
+		}
+	}
+	if signed*3 <= total*2 {
+		return fmt.Errorf("signed by %d of %d voting power", signed, total)
+	}
+	return nil
+}
+
+// CheckTimes checks that the block times of every node increase.
+func CheckTimes(nodes []Node) []Violation {
+	const check = "monotonic_time"
+	var violations []Violation
+
+	for _, n := range nodes {
+		var last uint64
+		for height := n.Blocks.Base(); height > 0 && height <= n.Blocks.Height(); height++ {
+			block := n.Blocks.LoadBlock(height)
+			if block == nil {
+				last = 0
+				continue
+			}
+			if last != 0 && block.TimeMs() <= last {
+				violations = append(violations, newViolation(check, height, []Node{n}, "time %d ms not after %d ms", block.TimeMs(), last))
+			}
+			last = block.TimeMs()
+		}
+	}
+	return violations
+}
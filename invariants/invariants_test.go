@@ -0,0 +1,86 @@
+package invariants
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/stretchr/testify/assert"
+)
+
+type memBlockStore struct {
+	consensus.BlockStore
+	blocks  []*consensus.FullBlock
+	commits []*consensus.Commit
+}
+
+func (bs *memBlockStore) Base() uint64   { return 1 }
+func (bs *memBlockStore) Height() uint64 { return uint64(len(bs.blocks)) }
+
+func (bs *memBlockStore) LoadBlock(height uint64) *consensus.FullBlock {
+	return bs.blocks[height-1]
+}
+
+func (bs *memBlockStore) LoadBlockCommit(height uint64) *consensus.Commit {
+	return bs.commits[height-1]
+}
+
+// newNode is a node whose block of height h has time times[h-1].
+func newNode(name, domain string, times []uint64) Node {
+	bs := &memBlockStore{}
+	for i, t := range times {
+		header := &consensus.Header{Number: big.NewInt(int64(i + 1)), TimeMs: t, Difficulty: big.NewInt(1), BaseFee: big.NewInt(0)}
+		block := &consensus.FullBlock{Block: types.NewBlock(header, nil, nil, nil, trie.NewStackTrie(nil))}
+		bs.blocks = append(bs.blocks, block)
+		bs.commits = append(bs.commits, &consensus.Commit{Height: uint64(i + 1), BlockID: block.Hash()})
+	}
+	return Node{Name: name, Domain: domain, Blocks: bs}
+}
+
+func TestDisagreement(t *testing.T) {
+	nodes := []Node{{Name: "a"}, {Name: "b"}, {Name: "c"}}
+
+	faulty, _ := disagreement(nodes, []string{"x", "x", "x"})
+	assert.Empty(t, faulty)
+
+	faulty, detail := disagreement(nodes, []string{"x", "y", "x"})
+	assert.Equal(t, []Node{{Name: "b"}}, faulty)
+	assert.Equal(t, "x by [a c], y by [b]", detail)
+
+	// no majority to trust
+	faulty, _ = disagreement(nodes[:2], []string{"x", "y"})
+	assert.Len(t, faulty, 2)
+}
+
+func TestCheckTimes(t *testing.T) {
+	nodes := []Node{
+		newNode("a", "eu", []uint64{1000, 2000, 3000}),
+		newNode("b", "us", []uint64{1000, 2000, 2000}),
+	}
+	violations := CheckTimes(nodes)
+	assert.Len(t, violations, 1)
+	assert.Equal(t, uint64(3), violations[0].Height)
+	assert.Equal(t, []string{"b"}, violations[0].Nodes)
+	assert.Equal(t, []string{"us"}, violations[0].Domains)
+}
+
+func TestCheckCommits(t *testing.T) {
+	nodes := []Node{
+		newNode("a", "eu", []uint64{1000, 2000}),
+		newNode("b", "eu", []uint64{1000, 2000}),
+		newNode("c", "us", []uint64{1000, 2000}),
+	}
+	assert.Empty(t, CheckCommits(nodes))
+
+	nodes[2].Blocks.(*memBlockStore).commits[1].BlockID = common.Hash{1}
+	violations := CheckCommits(nodes)
+	// the commit of c is not for its block, nor for the block of the others
+	assert.Len(t, violations, 2)
+	for _, v := range violations {
+		assert.Equal(t, uint64(2), v.Height)
+		assert.Equal(t, []string{"c"}, v.Nodes)
+	}
+}
@@ -0,0 +1,411 @@
+// Package light verifies the headers of a chain from a trusted one, without
+// executing the blocks, and serves what it verified over a JSON-RPC proxy
+// (see Proxy), so that wallets query a full node they do not trust.
+//
+// A header is verified from a trusted one by skipping: more than the trust
+// level (1/3 by default) of the trusted validators signed its commit, and +2/3
+// of its own validators did, the ones its header commits to (see
+// consensus.HeaderExtra). When too many validators changed in between, a
+// header halfway is verified first. Headers below the trusted ones are
+// verified by hash from the one above. The headers, commits and validator
+// sets come from a primary node, and each verified header is compared with
+// the ones of the witnesses: a witness disagreeing is an attack on the light
+// client, or a fork of the chain, and the header is not trusted. Neither is
+// a header no witness confirms.
+//
+// A header commits to the app hash after the previous block (see
+// consensus.HeaderExtra): the query proofs are verified against the one of
+// the verified header of the next height. The app hash of a LightBlock, after
+// its own block, is only trusted when the primary and every witness reached
+// agree on it.
+package light
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/QuarkChain/go-minimal-pbft/rpc"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+var (
+	ErrTrustExpired         = errors.New("trusted header expired, the light client must be reset with new trust options")
+	ErrConflictingHeaders   = errors.New("witness has a conflicting header")
+	ErrNoWitness            = errors.New("no witness confirmed the header")
+	ErrInvalidLightBlock    = errors.New("invalid light block")
+	ErrHeaderFromFuture     = errors.New("header time is in the future")
+	ErrNonIncreasingHeaders = errors.New("header time not after the trusted one")
+)
+
+// Provider serves the chain to verify, it is implemented by client.Client.
+type Provider interface {
+	Status(ctx context.Context) (*rpc.ResultStatus, error)
+	Block(ctx context.Context, height uint64) (*consensus.FullBlock, error)
+	Commit(ctx context.Context, height uint64) (*rpc.ResultCommit, error)
+	Validators(ctx context.Context, height uint64) ([]consensus.ValidatorInfo, error)
+	ABCIQuery(ctx context.Context, path string, data []byte, height uint64, prove bool) (*rpc.ResultQuery, error)
+}
+
+// TrustOptions is the header the light client starts from, obtained out of
+// band, e.g., from a block explorer or a friend.
+type TrustOptions struct {
+	Height uint64
+	Hash   common.Hash
+	// Period is how long after its time a header is trusted to verify
+	// later ones. It must be shorter than the time a validator stays
+	// accountable for what it signed, so that validators who left cannot
+	// sign a fake chain unpunished.
+	Period time.Duration
+}
+
+// LightBlock is a verified header with its commit and validators. The ones
+// verified by hash have neither, and are not used to verify others.
+type LightBlock struct {
+	Header     *consensus.Header
+	Commit     *consensus.Commit
+	Validators *consensus.ValidatorSet
+	// AppHash is the app hash after the block, nil if not confirmed by the
+	// witnesses.
+	AppHash []byte
+}
+
+func (lb *LightBlock) Height() uint64 {
+	return lb.Header.Number.Uint64()
+}
+
+func (lb *LightBlock) Hash() common.Hash {
+	return lb.Header.Hash()
+}
+
+type Option func(*Client)
+
+// TrustLevel overrides consensus.DefaultTrustLevel.
+func TrustLevel(lvl consensus.Fraction) Option {
+	return func(c *Client) {
+		c.trustLevel = lvl
+	}
+}
+
+// MaxClockDrift is how far in the future of the local clock a header may
+// be, 10s by default.
+func MaxClockDrift(d time.Duration) Option {
+	return func(c *Client) {
+		c.maxClockDrift = d
+	}
+}
+
+// MaxLightBlocks is the number of verified headers kept, the highest ones,
+// 1000 by default.
+func MaxLightBlocks(n int) Option {
+	return func(c *Client) {
+		c.maxBlocks = n
+	}
+}
+
+// Client verifies the headers of a chain. Its methods are safe for
+// concurrent use; verifications run one at a time.
+type Client struct {
+	chainID       string
+	period        time.Duration
+	trustLevel    consensus.Fraction
+	maxClockDrift time.Duration
+	maxBlocks     int
+	now           func() time.Time
+
+	primary   Provider
+	witnesses []Provider
+
+	mtx     sync.Mutex
+	blocks  map[uint64]*LightBlock
+	heights []uint64 // of blocks, ascending
+}
+
+// NewClient verifies the header of the trust options against its commit,
+// and returns a client verifying later (and earlier) headers from it.
+func NewClient(ctx context.Context, chainID string, trust TrustOptions, primary Provider, witnesses []Provider, opts ...Option) (*Client, error) {
+	c := &Client{
+		chainID:       chainID,
+		period:        trust.Period,
+		trustLevel:    consensus.DefaultTrustLevel,
+		maxClockDrift: 10 * time.Second,
+		maxBlocks:     1000,
+		now:           time.Now,
+		primary:       primary,
+		witnesses:     witnesses,
+		blocks:        make(map[uint64]*LightBlock),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if err := consensus.ValidateTrustLevel(c.trustLevel); err != nil {
+		return nil, err
+	}
+	if trust.Period <= 0 {
+		return nil, errors.New("trusting period must be positive")
+	}
+
+	lb, err := c.fetch(ctx, c.primary, trust.Height)
+	if err != nil {
+		return nil, err
+	}
+	if lb.Hash() != trust.Hash {
+		return nil, fmt.Errorf("%w: header %d is %v, expected %v", ErrInvalidLightBlock, trust.Height, lb.Hash(), trust.Hash)
+	}
+	if c.expired(lb) {
+		return nil, fmt.Errorf("%w: header %d is older than the trusting period %v", ErrTrustExpired, trust.Height, trust.Period)
+	}
+	if err := c.compareWitnesses(ctx, lb); err != nil {
+		return nil, err
+	}
+	c.save(lb)
+
+	log.Info("light client initialized", "height", trust.Height, "hash", trust.Hash, "witnesses", len(witnesses))
+	return c, nil
+}
+
+// LastTrusted returns the highest verified header.
+func (c *Client) LastTrusted() *LightBlock {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.blocks[c.heights[len(c.heights)-1]]
+}
+
+// Update verifies the latest header of the primary.
+func (c *Client) Update(ctx context.Context) (*LightBlock, error) {
+	status, err := c.primary.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.VerifyHeight(ctx, status.LatestHeight)
+}
+
+// Sync verifies the latest header every interval, until the context is
+// canceled.
+func (c *Client) Sync(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if lb, err := c.Update(ctx); err != nil {
+			log.Warn("light client update failed", "err", err)
+		} else {
+			log.Debug("light client updated", "height", lb.Height(), "hash", lb.Hash())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// VerifyHeight returns the verified header of a height, verifying it if
+// needed.
+func (c *Client) VerifyHeight(ctx context.Context, height uint64) (*LightBlock, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if lb := c.blocks[height]; lb != nil {
+		return lb, nil
+	}
+
+	// from the highest block with validators below height, else from the
+	// lowest block above it
+	above := sort.Search(len(c.heights), func(i int) bool { return c.heights[i] > height })
+	for i := above - 1; i >= 0; i-- {
+		if lb := c.blocks[c.heights[i]]; lb.Validators != nil {
+			return c.verifySkipping(ctx, lb, height)
+		}
+	}
+	return c.verifyBackwards(ctx, c.blocks[c.heights[above]], height)
+}
+
+// verifySkipping verifies the header of height from trusted, below it, by
+// bisection if too many validators changed in between.
+func (c *Client) verifySkipping(ctx context.Context, trusted *LightBlock, height uint64) (*LightBlock, error) {
+	if c.expired(trusted) {
+		return nil, fmt.Errorf("%w: header %d", ErrTrustExpired, trusted.Height())
+	}
+
+	lb, err := c.fetch(ctx, c.primary, height)
+	if err != nil {
+		return nil, err
+	}
+	if lb.Header.TimeMs <= trusted.Header.TimeMs {
+		return nil, fmt.Errorf("%w: %d at height %d, %d at height %d", ErrNonIncreasingHeaders,
+			lb.Header.TimeMs, height, trusted.Header.TimeMs, trusted.Height())
+	}
+	if time.UnixMilli(int64(lb.Header.TimeMs)).After(c.now().Add(c.maxClockDrift)) {
+		return nil, fmt.Errorf("%w: %d at height %d", ErrHeaderFromFuture, lb.Header.TimeMs, height)
+	}
+
+	err = consensus.VerifyCommitLightTrusting(c.chainID, trusted.Validators, lb.Commit, c.trustLevel)
+	if errors.Is(err, consensus.ErrNotEnoughVotingPowerSigned) && height > trusted.Height()+1 {
+		pivot := trusted.Height() + (height-trusted.Height())/2
+		log.Debug("light client bisecting", "trusted", trusted.Height(), "pivot", pivot, "height", height)
+		mid, err := c.verifySkipping(ctx, trusted, pivot)
+		if err != nil {
+			return nil, err
+		}
+		return c.verifySkipping(ctx, mid, height)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: header %d from %d: %v", ErrInvalidLightBlock, height, trusted.Height(), err)
+	}
+
+	if err := c.compareWitnesses(ctx, lb); err != nil {
+		return nil, err
+	}
+	c.save(lb)
+	return lb, nil
+}
+
+// verifyBackwards verifies the header of height from trusted, above it, by
+// following the parent hashes.
+func (c *Client) verifyBackwards(ctx context.Context, trusted *LightBlock, height uint64) (*LightBlock, error) {
+	for trusted.Height() > height {
+		result, err := c.primary.Commit(ctx, trusted.Height()-1)
+		if err != nil {
+			return nil, err
+		}
+		if result.Header == nil || result.Header.Hash() != trusted.Header.ParentHash {
+			return nil, fmt.Errorf("%w: header %d is not the parent of header %d", ErrInvalidLightBlock,
+				trusted.Height()-1, trusted.Height())
+		}
+		lb := &LightBlock{Header: result.Header}
+		if err := c.compareWitnesses(ctx, lb); err != nil {
+			return nil, err
+		}
+		lb.AppHash = c.confirmAppHash(ctx, lb.Height(), result.AppHash)
+		c.save(lb)
+		trusted = lb
+	}
+	return trusted, nil
+}
+
+// fetch returns the header of height, with its commit and validators, from
+// p: +2/3 of the validators signed the header.
+func (c *Client) fetch(ctx context.Context, p Provider, height uint64) (*LightBlock, error) {
+	result, err := p.Commit(ctx, height)
+	if err != nil {
+		return nil, err
+	}
+	if err := consensus.ValidateHeaderBasic(result.Header); err != nil {
+		return nil, err
+	}
+	if result.Header.Number.Uint64() != height {
+		return nil, fmt.Errorf("%w: header of height %v, expected %d", ErrInvalidLightBlock, result.Header.Number, height)
+	}
+
+	infos, err := p.Validators(ctx, height)
+	if err != nil {
+		return nil, err
+	}
+	vals, err := consensus.NewValidatorSetFromInfos(infos, 1)
+	if err != nil {
+		return nil, fmt.Errorf("%w: validators of height %d: %v", ErrInvalidLightBlock, height, err)
+	}
+	extra, err := consensus.DecodeHeaderExtra(result.Header)
+	if err != nil {
+		return nil, err
+	}
+	if hash := consensus.ValidatorsHash(vals); hash != extra.ValidatorsHash {
+		return nil, fmt.Errorf("%w: validators of height %d hash to %v, header has %v", ErrInvalidLightBlock, height, hash, extra.ValidatorsHash)
+	}
+	lb := &LightBlock{Header: result.Header, Commit: result.Commit, Validators: vals}
+	if err := consensus.VerifyCommitLight(c.chainID, vals, lb.Hash(), height, lb.Commit); err != nil {
+		return nil, fmt.Errorf("%w: commit of height %d: %v", ErrInvalidLightBlock, height, err)
+	}
+	lb.AppHash = c.confirmAppHash(ctx, height, result.AppHash)
+	return lb, nil
+}
+
+// compareWitnesses checks that the witnesses have the same header, and
+// validators if lb has them. Witnesses not responding are skipped, but one
+// at least must confirm the header.
+func (c *Client) compareWitnesses(ctx context.Context, lb *LightBlock) error {
+	confirmed := false
+	for i, w := range c.witnesses {
+		result, err := w.Commit(ctx, lb.Height())
+		if err != nil {
+			log.Warn("light client witness unavailable", "witness", i, "height", lb.Height(), "err", err)
+			continue
+		}
+		if result.Header == nil || result.Header.Hash() != lb.Hash() {
+			log.Error("light client witness has a conflicting header", "witness", i, "height", lb.Height(), "hash", lb.Hash())
+			return fmt.Errorf("%w: witness %d at height %d", ErrConflictingHeaders, i, lb.Height())
+		}
+
+		if lb.Validators == nil {
+			confirmed = true
+			continue
+		}
+		infos, err := w.Validators(ctx, lb.Height())
+		if err != nil {
+			log.Warn("light client witness unavailable", "witness", i, "height", lb.Height(), "err", err)
+			continue
+		}
+		if !consensus.SameValidators(infos, consensus.ValidatorInfos(lb.Validators)) {
+			log.Error("light client witness has conflicting validators", "witness", i, "height", lb.Height())
+			return fmt.Errorf("%w: validators of witness %d at height %d", ErrConflictingHeaders, i, lb.Height())
+		}
+		confirmed = true
+	}
+	if !confirmed {
+		return fmt.Errorf("%w: height %d, %d witnesses", ErrNoWitness, lb.Height(), len(c.witnesses))
+	}
+	return nil
+}
+
+// confirmAppHash returns appHash if at least one witness, and every witness
+// reached, has it at height.
+func (c *Client) confirmAppHash(ctx context.Context, height uint64, appHash []byte) []byte {
+	if len(appHash) == 0 {
+		return nil
+	}
+	confirmed := false
+	for i, w := range c.witnesses {
+		result, err := w.Commit(ctx, height)
+		if err != nil {
+			continue
+		}
+		if !bytes.Equal(result.AppHash, appHash) {
+			log.Error("light client witness has a conflicting app hash", "witness", i, "height", height)
+			return nil
+		}
+		confirmed = true
+	}
+	if !confirmed {
+		return nil
+	}
+	return appHash
+}
+
+func (c *Client) expired(lb *LightBlock) bool {
+	return time.UnixMilli(int64(lb.Header.TimeMs)).Add(c.period).Before(c.now())
+}
+
+// save keeps lb, dropping the lowest blocks above MaxLightBlocks. The caller
+// must hold c.mtx, but on creation.
+func (c *Client) save(lb *LightBlock) {
+	height := lb.Height()
+	c.blocks[height] = lb
+	i := sort.Search(len(c.heights), func(i int) bool { return c.heights[i] >= height })
+	c.heights = append(c.heights, 0)
+	copy(c.heights[i+1:], c.heights[i:])
+	c.heights[i] = height
+
+	for len(c.heights) > c.maxBlocks {
+		delete(c.blocks, c.heights[0])
+		c.heights = c.heights[1:]
+	}
+}
@@ -0,0 +1,254 @@
+package light
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/QuarkChain/go-minimal-pbft/rpc"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testChainID = "light-test"
+
+// testChain is a Provider of a chain whose validators at each height are
+// given by name.
+type testChain struct {
+	commits    map[uint64]*rpc.ResultCommit
+	validators map[uint64][]consensus.ValidatorInfo
+	latest     uint64
+}
+
+func newTestChain(t *testing.T, startMs uint64, sets [][]string) *testChain {
+	pvs := make(map[string]consensus.PrivValidator)
+	c := &testChain{commits: make(map[uint64]*rpc.ResultCommit), validators: make(map[uint64][]consensus.ValidatorInfo)}
+
+	var parent common.Hash
+	for i, names := range sets {
+		height := uint64(i + 1)
+
+		addrs := make([]common.Address, len(names))
+		powers := make([]int64, len(names))
+		pubKeys := make([]consensus.PubKey, len(names))
+		byAddr := make(map[common.Address]consensus.PrivValidator)
+		for j, name := range names {
+			if pvs[name] == nil {
+				pvs[name] = consensus.GeneratePrivValidatorLocal()
+			}
+			pubKey, err := pvs[name].GetPubKey(context.Background())
+			require.NoError(t, err)
+			addrs[j], powers[j], pubKeys[j] = pubKey.Address(), 1, pubKey
+			byAddr[pubKey.Address()] = pvs[name]
+		}
+		vals := consensus.NewValidatorSet(addrs, powers, 1)
+		consensus.SetValidatorPubKeys(vals, pubKeys)
+
+		timeMs := startMs + uint64(i)*1000
+		// the app hash after height h is {h}
+		extra := &consensus.HeaderExtra{ValidatorsHash: consensus.ValidatorsHash(vals), LastAppHash: []byte{byte(height - 1)}}
+		header := &consensus.Header{
+			ParentHash: parent,
+			Number:     big.NewInt(int64(height)),
+			Time:       timeMs / 1000,
+			TimeMs:     timeMs,
+			Coinbase:   addrs[0],
+			Difficulty: big.NewInt(int64(height)),
+			Extra:      extra.Bytes(),
+			BaseFee:    big.NewInt(0),
+		}
+
+		vs := consensus.NewVoteSet(testChainID, height, 0, consensus.PrecommitType, vals)
+		for idx, val := range vals.Validators {
+			vote := &consensus.Vote{
+				ValidatorAddress: val.Address,
+				ValidatorIndex:   int32(idx),
+				Height:           height,
+				Type:             consensus.PrecommitType,
+				BlockID:          header.Hash(),
+			}
+			require.NoError(t, byAddr[val.Address].SignVote(context.Background(), testChainID, vote))
+			_, err := vs.AddVote(vote)
+			require.NoError(t, err)
+		}
+
+		c.commits[height] = &rpc.ResultCommit{Header: header, Commit: vs.MakeCommit(), AppHash: []byte{byte(height)}}
+		c.validators[height] = consensus.ValidatorInfos(vals)
+		c.latest = height
+		parent = header.Hash()
+	}
+	return c
+}
+
+func (c *testChain) Status(ctx context.Context) (*rpc.ResultStatus, error) {
+	return &rpc.ResultStatus{LatestHeight: c.latest}, nil
+}
+
+func (c *testChain) Block(ctx context.Context, height uint64) (*consensus.FullBlock, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (c *testChain) Commit(ctx context.Context, height uint64) (*rpc.ResultCommit, error) {
+	if result := c.commits[height]; result != nil {
+		return result, nil
+	}
+	return nil, fmt.Errorf("no commit at height %d", height)
+}
+
+func (c *testChain) Validators(ctx context.Context, height uint64) ([]consensus.ValidatorInfo, error) {
+	if vals := c.validators[height]; vals != nil {
+		return vals, nil
+	}
+	return nil, fmt.Errorf("no validators at height %d", height)
+}
+
+// ABCIQuery answers data at height, the latest one if 0.
+func (c *testChain) ABCIQuery(ctx context.Context, path string, data []byte, height uint64, prove bool) (*rpc.ResultQuery, error) {
+	if height == 0 {
+		height = c.latest
+	}
+	return &rpc.ResultQuery{Response: consensus.QueryResponse{Key: data, Value: data, Height: height}}, nil
+}
+
+func repeatSet(n int, names ...string) [][]string {
+	sets := make([][]string, n)
+	for i := range sets {
+		sets[i] = names
+	}
+	return sets
+}
+
+func trustAt(c *testChain, height uint64) TrustOptions {
+	return TrustOptions{Height: height, Hash: c.commits[height].Header.Hash(), Period: time.Hour}
+}
+
+func TestClientVerifyHeight(t *testing.T) {
+	ctx := context.Background()
+	chain := newTestChain(t, uint64(time.Now().Add(-time.Minute).UnixMilli()), repeatSet(10, "a", "b", "c", "d"))
+
+	lc, err := NewClient(ctx, testChainID, trustAt(chain, 5), chain, []Provider{chain})
+	require.NoError(t, err)
+
+	lb, err := lc.Update(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(10), lb.Height())
+	assert.Equal(t, chain.commits[10].Header.Hash(), lb.Hash())
+	assert.Equal(t, []byte{10}, lb.AppHash)
+	assert.Equal(t, lb, lc.LastTrusted())
+
+	// below the trusted header, by hash
+	lb, err = lc.VerifyHeight(ctx, 2)
+	require.NoError(t, err)
+	assert.Equal(t, chain.commits[2].Header.Hash(), lb.Hash())
+	assert.Nil(t, lb.Validators)
+	assert.Equal(t, []byte{2}, lb.AppHash)
+
+	// between verified headers
+	lb, err = lc.VerifyHeight(ctx, 7)
+	require.NoError(t, err)
+	assert.Equal(t, chain.commits[7].Header.Hash(), lb.Hash())
+	assert.NotNil(t, lb.Validators)
+
+	_, err = NewClient(ctx, testChainID, TrustOptions{Height: 5, Hash: common.Hash{1}, Period: time.Hour}, chain, []Provider{chain})
+	assert.True(t, errors.Is(err, ErrInvalidLightBlock))
+}
+
+func TestClientBisection(t *testing.T) {
+	ctx := context.Background()
+	sets := append(repeatSet(4, "a", "b", "c", "d"), repeatSet(4, "c", "d", "e", "f")...)
+	sets = append(sets, repeatSet(2, "e", "f", "g", "h")...)
+	chain := newTestChain(t, uint64(time.Now().Add(-time.Minute).UnixMilli()), sets)
+
+	lc, err := NewClient(ctx, testChainID, trustAt(chain, 1), chain, []Provider{chain})
+	require.NoError(t, err)
+
+	// none of the validators of height 1 signed height 10
+	lb, err := lc.VerifyHeight(ctx, 10)
+	require.NoError(t, err)
+	assert.Equal(t, chain.commits[10].Header.Hash(), lb.Hash())
+	assert.Equal(t, []byte{10}, lb.AppHash)
+	assert.Len(t, lc.heights, 3)
+}
+
+func TestClientRejects(t *testing.T) {
+	ctx := context.Background()
+	start := time.Now().Add(-time.Minute)
+	chain := newTestChain(t, uint64(start.UnixMilli()), repeatSet(5, "a", "b", "c", "d"))
+
+	// another chain with the same heights
+	fork := newTestChain(t, uint64(start.UnixMilli()), repeatSet(5, "a", "b", "c", "d"))
+	fork.commits[1], fork.validators[1] = chain.commits[1], chain.validators[1]
+	lc, err := NewClient(ctx, testChainID, trustAt(chain, 1), chain, []Provider{fork})
+	require.NoError(t, err)
+	_, err = lc.VerifyHeight(ctx, 3)
+	assert.True(t, errors.Is(err, ErrConflictingHeaders))
+
+	// validators unknown to the trusted ones
+	lc, err = NewClient(ctx, testChainID, trustAt(chain, 1), fork, []Provider{fork})
+	require.NoError(t, err)
+	_, err = lc.VerifyHeight(ctx, 2)
+	assert.True(t, errors.Is(err, ErrInvalidLightBlock))
+
+	// trusting period over
+	lc, err = NewClient(ctx, testChainID, trustAt(chain, 1), chain, []Provider{chain})
+	require.NoError(t, err)
+	lc.now = func() time.Time { return start.Add(2 * time.Hour) }
+	_, err = lc.VerifyHeight(ctx, 5)
+	assert.True(t, errors.Is(err, ErrTrustExpired))
+}
+
+func TestClientValidatorsCommitted(t *testing.T) {
+	ctx := context.Background()
+	chain := newTestChain(t, uint64(time.Now().Add(-time.Minute).UnixMilli()), repeatSet(5, "a", "b", "c", "d"))
+
+	// the primary, and a witness colluding, serve the real headers with the
+	// voting power of a validator they control inflated
+	liar := &testChain{commits: chain.commits, validators: make(map[uint64][]consensus.ValidatorInfo), latest: chain.latest}
+	for height, infos := range chain.validators {
+		lied := append([]consensus.ValidatorInfo{}, infos...)
+		if height > 1 {
+			lied[0].Power = 100
+		}
+		liar.validators[height] = lied
+	}
+	lc, err := NewClient(ctx, testChainID, trustAt(chain, 1), liar, []Provider{liar})
+	require.NoError(t, err)
+	_, err = lc.VerifyHeight(ctx, 3)
+	assert.True(t, errors.Is(err, ErrInvalidLightBlock))
+
+	// no witness reached
+	_, err = NewClient(ctx, testChainID, trustAt(chain, 1), chain, nil)
+	assert.True(t, errors.Is(err, ErrNoWitness))
+	down := &testChain{commits: map[uint64]*rpc.ResultCommit{}, validators: chain.validators}
+	_, err = NewClient(ctx, testChainID, trustAt(chain, 1), chain, []Provider{down})
+	assert.True(t, errors.Is(err, ErrNoWitness))
+}
+
+func TestProxyQuery(t *testing.T) {
+	ctx := context.Background()
+	chain := newTestChain(t, uint64(time.Now().Add(-time.Minute).UnixMilli()), repeatSet(5, "a", "b", "c", "d"))
+	lc, err := NewClient(ctx, testChainID, trustAt(chain, 1), chain, []Provider{chain})
+	require.NoError(t, err)
+
+	// the app hash after height h is {h}
+	api := &ProxyABCIAPI{client: lc, verify: func(appHash []byte, req consensus.QueryRequest, resp consensus.QueryResponse) error {
+		if !bytes.Equal(appHash, []byte{byte(resp.Height)}) {
+			return fmt.Errorf("proof of height %d against app hash %x", resp.Height, appHash)
+		}
+		return nil
+	}}
+	result, err := api.Query(ctx, "", []byte{1}, 3, true)
+	require.NoError(t, err)
+	assert.Equal(t, chain.commits[4].Header.Hash(), result.Header.Hash())
+	assert.NotNil(t, result.Commit)
+
+	// the next height is not committed yet
+	_, err = api.Query(ctx, "", []byte{1}, 0, true)
+	assert.Error(t, err)
+}
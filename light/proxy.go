@@ -0,0 +1,224 @@
+package light
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/QuarkChain/go-minimal-pbft/rpc"
+	"github.com/QuarkChain/go-minimal-pbft/statetree"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/log"
+	ethrpc "github.com/ethereum/go-ethereum/rpc"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// QueryVerifier verifies that a query response answers the request, and its
+// proof against the app hash of its height.
+type QueryVerifier func(appHash []byte, req consensus.QueryRequest, resp consensus.QueryResponse) error
+
+// VerifyStateTreeQuery verifies the statetree proof of a query, as served by
+// the applications keeping their state in a statetree.Tree keyed by the query
+// data, e.g., examples/kvstore.
+func VerifyStateTreeQuery(appHash []byte, req consensus.QueryRequest, resp consensus.QueryResponse) error {
+	if !bytes.Equal(resp.Key, req.Data) {
+		return fmt.Errorf("%w: response for another key", statetree.ErrInvalidProof)
+	}
+	if len(resp.ProofOps) != 1 {
+		return fmt.Errorf("%w: %d proof ops", statetree.ErrInvalidProof, len(resp.ProofOps))
+	}
+	proof, err := statetree.ProofFromOp(resp.ProofOps[0])
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(resp.ProofOps[0].Key, resp.Key) {
+		return fmt.Errorf("%w: proof of another key", statetree.ErrInvalidProof)
+	}
+	return proof.Verify(appHash, resp.Key, resp.Value)
+}
+
+// ProxyChainAPI serves the "chain" methods of a node checked against the
+// verified headers.
+type ProxyChainAPI struct {
+	client *Client
+}
+
+// resolve maps height 0 to the last verified header.
+func (api *ProxyChainAPI) resolve(ctx context.Context, height uint64) (*LightBlock, error) {
+	if height == 0 {
+		return api.client.LastTrusted(), nil
+	}
+	return api.client.VerifyHeight(ctx, height)
+}
+
+// Status is served as "chain_status", the last verified header.
+func (api *ProxyChainAPI) Status(ctx context.Context) (*rpc.ResultStatus, error) {
+	lb := api.client.LastTrusted()
+	return &rpc.ResultStatus{
+		LatestHeight:      lb.Height(),
+		LatestBlockHash:   lb.Hash(),
+		LatestBlockTimeMs: lb.Header.TimeMs,
+	}, nil
+}
+
+// Block is served as "chain_block". The txs of the block are checked against
+// its verified header; the tx hashes are the hashes of their encoding.
+func (api *ProxyChainAPI) Block(ctx context.Context, height uint64) (*rpc.ResultBlock, error) {
+	lb, err := api.resolve(ctx, height)
+	if err != nil {
+		return nil, err
+	}
+	block, err := api.client.primary.Block(ctx, lb.Height())
+	if err != nil {
+		return nil, err
+	}
+	if block.Hash() != lb.Hash() {
+		return nil, fmt.Errorf("%w: block %d is not the verified one", ErrInvalidLightBlock, lb.Height())
+	}
+	if types.DeriveSha(block.Transactions(), trie.NewStackTrie(nil)) != lb.Header.TxHash {
+		return nil, fmt.Errorf("%w: txs of block %d do not match its header", ErrInvalidLightBlock, lb.Height())
+	}
+
+	raw, err := block.EncodeToRLPBytes()
+	if err != nil {
+		return nil, err
+	}
+	return &rpc.ResultBlock{Hash: lb.Hash(), Header: lb.Header, Raw: raw, TxHashes: consensus.TxHashes(nil, block)}, nil
+}
+
+// Commit is served as "chain_commit". The commit is nil for the headers
+// verified by hash, as is the app hash when not confirmed by the witnesses.
+func (api *ProxyChainAPI) Commit(ctx context.Context, height uint64) (*rpc.ResultCommit, error) {
+	lb, err := api.resolve(ctx, height)
+	if err != nil {
+		return nil, err
+	}
+	return &rpc.ResultCommit{Header: lb.Header, Commit: lb.Commit, AppHash: lb.AppHash}, nil
+}
+
+// Validators is served as "chain_validators".
+func (api *ProxyChainAPI) Validators(ctx context.Context, height uint64) ([]consensus.ValidatorInfo, error) {
+	lb, err := api.resolve(ctx, height)
+	if err != nil {
+		return nil, err
+	}
+	if lb.Validators == nil {
+		return nil, fmt.Errorf("%w: header %d verified by hash", consensus.ErrValidatorsNotFound, lb.Height())
+	}
+	return consensus.ValidatorInfos(lb.Validators), nil
+}
+
+// ProxyABCIAPI serves the queries of a node, with their proofs verified.
+type ProxyABCIAPI struct {
+	client *Client
+	verify QueryVerifier
+}
+
+// Query is served as "abci_query". The proof is always requested from the
+// primary, and verified against the app hash of the response height, which
+// the verified header of the next height commits to. Failed queries have no
+// proof, they are passed through.
+func (api *ProxyABCIAPI) Query(ctx context.Context, path string, data hexutil.Bytes, height uint64, prove bool) (*rpc.ResultQuery, error) {
+	result, err := api.client.primary.ABCIQuery(ctx, path, data, height, true)
+	if err != nil {
+		return nil, err
+	}
+	resp := result.Response
+	if resp.Code != 0 {
+		return &rpc.ResultQuery{Response: resp}, nil
+	}
+	if height != 0 && resp.Height != height {
+		return nil, fmt.Errorf("%w: response of height %d, expected %d", ErrInvalidLightBlock, resp.Height, height)
+	}
+	lb, err := api.client.VerifyHeight(ctx, resp.Height+1)
+	if err != nil {
+		return nil, err
+	}
+	extra, err := consensus.DecodeHeaderExtra(lb.Header)
+	if err != nil {
+		return nil, err
+	}
+	req := consensus.QueryRequest{Path: path, Data: data, Height: height, Prove: true}
+	if err := api.verify(extra.LastAppHash, req, resp); err != nil {
+		return nil, err
+	}
+
+	verified := &rpc.ResultQuery{Response: resp, Header: lb.Header, Commit: lb.Commit}
+	if !prove {
+		verified.Response.ProofOps = nil
+	}
+	return verified, nil
+}
+
+// Proxy serves JSON-RPC over HTTP (on "/") and WebSocket (on "/websocket")
+// like a node, the results verified by a light client: chain_status,
+// chain_block, chain_commit, chain_validators and abci_query.
+type Proxy struct {
+	addr       string
+	rpcServer  *ethrpc.Server
+	httpServer *http.Server
+}
+
+func NewProxy(addr string, client *Client, verify QueryVerifier) (*Proxy, error) {
+	rpcServer := ethrpc.NewServer()
+	if err := rpcServer.RegisterName("chain", &ProxyChainAPI{client: client}); err != nil {
+		return nil, err
+	}
+	if err := rpcServer.RegisterName("abci", &ProxyABCIAPI{client: client, verify: verify}); err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", rpcServer)
+	mux.Handle("/websocket", rpcServer.WebsocketHandler([]string{"*"}))
+
+	return &Proxy{
+		addr:      addr,
+		rpcServer: rpcServer,
+		httpServer: &http.Server{
+			Addr:              addr,
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+	}, nil
+}
+
+// Start listens on the configured address and serves until the context is
+// canceled.
+func (p *Proxy) Start(ctx context.Context) error {
+	listener, err := net.Listen("tcp", p.addr)
+	if err != nil {
+		return err
+	}
+
+	log.Info("light client proxy started", "addr", listener.Addr())
+
+	go func() {
+		if err := p.httpServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("light client proxy stopped", "err", err)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		p.Stop()
+	}()
+
+	return nil
+}
+
+func (p *Proxy) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := p.httpServer.Shutdown(ctx); err != nil {
+		log.Error("failed to shutdown light client proxy", "err", err)
+	}
+	p.rpcServer.Stop()
+}
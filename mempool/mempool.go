@@ -0,0 +1,387 @@
+// Package mempool holds the txs submitted to the node until they are
+// committed.
+//
+// A tx is admitted once CheckTx of the application accepts it, journaled in
+// the WAL, and gossiped to the peers, which admit it the same way. Proposals
+// take the pending txs by priority, then in the order they arrived, up to the
+// size and gas of a block, and above the minimum priority the application
+// set with the last block. After every block, the committed txs are removed
+// and the others rechecked against the new app state.
+package mempool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+var (
+	ErrTxKnown     = errors.New("tx already in mempool or recently seen")
+	ErrMempoolFull = errors.New("mempool is full")
+	ErrTxTooLarge  = errors.New("tx too large")
+)
+
+// Config of a Mempool.
+type Config struct {
+	// Size is the number of pending txs above which txs are refused.
+	Size int
+	// MaxTxBytes bounds the encoding of a tx, 0 for no limit.
+	MaxTxBytes uint64
+	// CacheSize is the number of committed txs remembered, so that they are
+	// not admitted again, e.g., when gossiped by a late peer.
+	CacheSize int
+	// Recheck runs CheckTx again on the pending txs after every block.
+	Recheck bool
+}
+
+var DefaultConfig = Config{
+	Size:       5000,
+	MaxTxBytes: 1 << 20,
+	CacheSize:  10000,
+	Recheck:    true,
+}
+
+type mempoolTx struct {
+	tx       *types.Transaction
+	hash     common.Hash
+	size     uint64
+	priority int64
+	seq      uint64
+}
+
+// Mempool is a consensus.Mempool, admitting the txs with CheckTx of the
+// application, if it is a consensus.TxChecker.
+type Mempool struct {
+	config  Config
+	checker consensus.TxChecker
+	hasher  consensus.TxHasher
+
+	mtx    sync.Mutex
+	txs    map[common.Hash]*mempoolTx
+	seq    uint64
+	cache  *txCache
+	wal    *WAL
+	gossip func(tx *types.Transaction, from string)
+
+	// the priority below which txs are not reaped, from the last block
+	minPriority int64
+
+	available chan struct{}
+}
+
+var _ consensus.Mempool = (*Mempool)(nil)
+
+// New returns an empty mempool of the txs of app, which may be nil to admit
+// every tx.
+func New(config Config, app consensus.BlockFinalizer) *Mempool {
+	mp := &Mempool{
+		config:    config,
+		txs:       make(map[common.Hash]*mempoolTx),
+		cache:     newTxCache(config.CacheSize),
+		available: make(chan struct{}, 1),
+	}
+	mp.checker, _ = app.(consensus.TxChecker)
+	mp.hasher, _ = app.(consensus.TxHasher)
+	return mp
+}
+
+// SetWAL admits the txs journaled in wal again, and journals the admitted
+// txs in it from now on. It returns the number of txs admitted back.
+func (mp *Mempool) SetWAL(wal *WAL) (int, error) {
+	n, err := wal.Replay(func(data []byte) error {
+		tx := new(types.Transaction)
+		if err := tx.UnmarshalBinary(data); err != nil {
+			return err
+		}
+		return mp.CheckTx(context.Background(), tx, "")
+	})
+	if err != nil {
+		return n, err
+	}
+
+	mp.mtx.Lock()
+	defer mp.mtx.Unlock()
+	mp.wal = wal
+	// drop the duplicates and the txs rejected since
+	return n, mp.compactWAL()
+}
+
+// SetGossip sets the func sending the admitted txs to the peers, but the
+// peer from which it came, "" for the txs submitted to us.
+func (mp *Mempool) SetGossip(gossip func(tx *types.Transaction, from string)) {
+	mp.mtx.Lock()
+	defer mp.mtx.Unlock()
+	mp.gossip = gossip
+}
+
+func (mp *Mempool) hash(tx *types.Transaction) common.Hash {
+	if mp.hasher != nil {
+		return mp.hasher.TxHash(tx)
+	}
+	return tx.Hash()
+}
+
+// SubmitTx admits a tx submitted to the node, e.g., over RPC.
+func (mp *Mempool) SubmitTx(tx *types.Transaction) error {
+	return mp.CheckTx(context.Background(), tx, "")
+}
+
+// CheckTx admits tx, received from peer from if not "".
+func (mp *Mempool) CheckTx(ctx context.Context, tx *types.Transaction, from string) error {
+	size := uint64(tx.Size())
+	if mp.config.MaxTxBytes != 0 && size > mp.config.MaxTxBytes {
+		mempoolCheckedTxs.WithLabelValues("too_large").Inc()
+		return fmt.Errorf("%w: %d bytes, at most %d", ErrTxTooLarge, size, mp.config.MaxTxBytes)
+	}
+
+	hash := mp.hash(tx)
+	mp.mtx.Lock()
+	if _, ok := mp.txs[hash]; ok || mp.cache.has(hash) {
+		mp.mtx.Unlock()
+		mempoolCheckedTxs.WithLabelValues("known").Inc()
+		return ErrTxKnown
+	}
+	if len(mp.txs) >= mp.config.Size {
+		mp.mtx.Unlock()
+		mempoolCheckedTxs.WithLabelValues("full").Inc()
+		return ErrMempoolFull
+	}
+
+	// the app is called under the lock, so that no tx is checked against
+	// the state of a block, and admitted after its recheck
+	var resp consensus.CheckTxResponse
+	if mp.checker != nil {
+		var err error
+		if resp, err = mp.checker.CheckTx(ctx, tx); err != nil {
+			mp.mtx.Unlock()
+			mempoolCheckedTxs.WithLabelValues("rejected").Inc()
+			return fmt.Errorf("tx rejected by application: %w", err)
+		}
+	}
+
+	mp.seq++
+	mp.txs[hash] = &mempoolTx{tx: tx, hash: hash, size: size, priority: resp.Priority, seq: mp.seq}
+	if mp.wal != nil {
+		mp.journal(tx)
+	}
+	gossip := mp.gossip
+	mempoolTxs.Set(float64(len(mp.txs)))
+	mp.mtx.Unlock()
+
+	mempoolCheckedTxs.WithLabelValues("admitted").Inc()
+	mp.notify()
+	if gossip != nil {
+		gossip(tx, from)
+	}
+	return nil
+}
+
+// journal writes tx to the WAL. The tx stays pending if it cannot be
+// journaled, it is only lost if the node restarts.
+func (mp *Mempool) journal(tx *types.Transaction) {
+	data, err := tx.MarshalBinary()
+	if err == nil {
+		err = mp.wal.Write(data)
+	}
+	if err == nil {
+		err = mp.wal.Flush()
+	}
+	if err != nil {
+		log.Error("Failed to journal tx in mempool wal", "hash", tx.Hash(), "err", err)
+	}
+}
+
+func (mp *Mempool) notify() {
+	select {
+	case mp.available <- struct{}{}:
+	default:
+	}
+}
+
+// HasTxs tells whether txs are pending.
+func (mp *Mempool) HasTxs() bool {
+	mp.mtx.Lock()
+	defer mp.mtx.Unlock()
+	return len(mp.txs) > 0
+}
+
+// TxsAvailable receives after txs were admitted, or stayed pending after a
+// block.
+func (mp *Mempool) TxsAvailable() <-chan struct{} {
+	return mp.available
+}
+
+// Size returns the number of pending txs.
+func (mp *Mempool) Size() int {
+	mp.mtx.Lock()
+	defer mp.mtx.Unlock()
+	return len(mp.txs)
+}
+
+// sorted returns the pending txs in the order they are proposed. The caller
+// must hold mp.mtx.
+func (mp *Mempool) sorted() []*mempoolTx {
+	txs := make([]*mempoolTx, 0, len(mp.txs))
+	for _, mtx := range mp.txs {
+		txs = append(txs, mtx)
+	}
+	sort.Slice(txs, func(i, j int) bool {
+		if txs[i].priority != txs[j].priority {
+			return txs[i].priority > txs[j].priority
+		}
+		return txs[i].seq < txs[j].seq
+	})
+	return txs
+}
+
+// Reap returns the pending txs in order until one exceeds maxBytes or maxGas,
+// 0 for no limit, or is below the minimum priority. The txs below it stay
+// pending, as the priority the app requires may go down again.
+func (mp *Mempool) Reap(maxBytes, maxGas uint64) types.Transactions {
+	return mp.ReapExcluding(maxBytes, maxGas, nil)
+}
+
+// ReapExcluding is Reap leaving out the txs of exclude.
+func (mp *Mempool) ReapExcluding(maxBytes, maxGas uint64, exclude types.Transactions) types.Transactions {
+	mp.mtx.Lock()
+	defer mp.mtx.Unlock()
+
+	excluded := make(map[common.Hash]bool, len(exclude))
+	for _, tx := range exclude {
+		excluded[mp.hash(tx)] = true
+	}
+
+	var txs types.Transactions
+	bytes, gas := uint64(0), uint64(0)
+	sorted := mp.sorted()
+	for i, mtx := range sorted {
+		// sorted by priority, so are the next ones
+		if mtx.priority < mp.minPriority {
+			mempoolReapSkippedTxs.Add(float64(len(sorted) - i))
+			break
+		}
+		if excluded[mtx.hash] {
+			continue
+		}
+		if maxBytes != 0 && bytes+mtx.size > maxBytes {
+			break
+		}
+		if maxGas != 0 && gas+mtx.tx.Gas() > maxGas {
+			break
+		}
+		bytes += mtx.size
+		gas += mtx.tx.Gas()
+		txs = append(txs, mtx.tx)
+	}
+	return txs
+}
+
+// Pending tells whether the txs are all pending and not below the minimum
+// priority.
+func (mp *Mempool) Pending(txs types.Transactions) bool {
+	mp.mtx.Lock()
+	defer mp.mtx.Unlock()
+
+	for _, tx := range txs {
+		mtx, ok := mp.txs[mp.hash(tx)]
+		if !ok || mtx.priority < mp.minPriority {
+			return false
+		}
+	}
+	return true
+}
+
+// Update removes the txs committed at height, rechecks the others if
+// configured, and sets the minimum priority of the txs reaped.
+func (mp *Mempool) Update(ctx context.Context, height uint64, txs types.Transactions, minPriority int64) {
+	mp.mtx.Lock()
+	defer mp.mtx.Unlock()
+
+	if minPriority != mp.minPriority {
+		log.Debug("Updated minimum tx priority", "height", height, "priority", minPriority, "previous", mp.minPriority)
+		mp.minPriority = minPriority
+		mempoolMinTxPriority.Set(float64(minPriority))
+	}
+
+	for _, tx := range txs {
+		hash := mp.hash(tx)
+		delete(mp.txs, hash)
+		mp.cache.add(hash)
+	}
+
+	if mp.config.Recheck && mp.checker != nil {
+		for _, mtx := range mp.sorted() {
+			resp, err := mp.checker.CheckTx(ctx, mtx.tx)
+			if err != nil {
+				log.Debug("Dropping tx failing recheck", "hash", mtx.hash, "height", height, "err", err)
+				delete(mp.txs, mtx.hash)
+				mempoolCheckedTxs.WithLabelValues("recheck_rejected").Inc()
+				continue
+			}
+			mtx.priority = resp.Priority
+		}
+	}
+
+	if mp.wal != nil && len(txs) != 0 {
+		if err := mp.compactWAL(); err != nil {
+			log.Error("Failed to compact mempool wal", "height", height, "err", err)
+		}
+	}
+	mempoolTxs.Set(float64(len(mp.txs)))
+	if len(mp.txs) > 0 {
+		mp.notify()
+	}
+}
+
+// compactWAL rewrites the WAL with the pending txs. The caller must hold
+// mp.mtx.
+func (mp *Mempool) compactWAL() error {
+	pending := make([]*mempoolTx, 0, len(mp.txs))
+	for _, mtx := range mp.txs {
+		pending = append(pending, mtx)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].seq < pending[j].seq })
+
+	data := make([][]byte, 0, len(pending))
+	for _, mtx := range pending {
+		b, err := mtx.tx.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		data = append(data, b)
+	}
+	return mp.wal.Compact(data)
+}
+
+// txCache remembers the last size hashes added.
+type txCache struct {
+	hashes map[common.Hash]struct{}
+	ring   []common.Hash
+	next   int
+}
+
+func newTxCache(size int) *txCache {
+	return &txCache{hashes: make(map[common.Hash]struct{}, size), ring: make([]common.Hash, size)}
+}
+
+func (c *txCache) has(hash common.Hash) bool {
+	_, ok := c.hashes[hash]
+	return ok
+}
+
+func (c *txCache) add(hash common.Hash) {
+	if len(c.ring) == 0 || c.has(hash) {
+		return
+	}
+	delete(c.hashes, c.ring[c.next])
+	c.ring[c.next] = hash
+	c.hashes[hash] = struct{}{}
+	c.next = (c.next + 1) % len(c.ring)
+}
@@ -0,0 +1,131 @@
+package mempool
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+)
+
+var errBadTx = errors.New("bad tx")
+
+// checkerApp admits the txs whose first byte is not 0, the byte being their
+// priority.
+type checkerApp struct {
+	rejected map[string]bool
+}
+
+func (app *checkerApp) FinalizeBlock(ctx context.Context, req consensus.FinalizeBlockRequest) (consensus.FinalizeBlockResponse, error) {
+	return consensus.FinalizeBlockResponse{}, nil
+}
+
+func (app *checkerApp) CheckTx(ctx context.Context, tx *types.Transaction) (consensus.CheckTxResponse, error) {
+	if len(tx.Data()) == 0 || tx.Data()[0] == 0 || app.rejected[string(tx.Data())] {
+		return consensus.CheckTxResponse{}, errBadTx
+	}
+	return consensus.CheckTxResponse{Priority: int64(tx.Data()[0])}, nil
+}
+
+func newTx(data ...byte) *types.Transaction {
+	return types.NewTx(&types.LegacyTx{Data: data, Gas: 10})
+}
+
+func TestMempoolOrder(t *testing.T) {
+	ctx := context.Background()
+	mp := New(DefaultConfig, &checkerApp{})
+
+	low1, high, low2 := newTx(1, 1), newTx(2), newTx(1, 2)
+	for _, tx := range []*types.Transaction{low1, high, low2} {
+		assert.NoError(t, mp.CheckTx(ctx, tx, ""))
+	}
+	assert.ErrorIs(t, mp.CheckTx(ctx, low1, ""), ErrTxKnown)
+	assert.ErrorIs(t, mp.CheckTx(ctx, newTx(0), ""), errBadTx)
+	assert.True(t, mp.HasTxs())
+
+	assert.Equal(t, types.Transactions{high, low1, low2}, mp.Reap(0, 0))
+	assert.Equal(t, types.Transactions{high, low1}, mp.Reap(0, 25))
+}
+
+func TestMempoolUpdate(t *testing.T) {
+	ctx := context.Background()
+	app := &checkerApp{rejected: map[string]bool{}}
+	mp := New(DefaultConfig, app)
+
+	committed, failing, pending := newTx(1), newTx(2), newTx(3)
+	for _, tx := range []*types.Transaction{committed, failing, pending} {
+		assert.NoError(t, mp.CheckTx(ctx, tx, ""))
+	}
+
+	app.rejected[string(failing.Data())] = true
+	mp.Update(ctx, 1, types.Transactions{committed}, 0)
+	assert.Equal(t, types.Transactions{pending}, mp.Reap(0, 0))
+	// committed txs are not admitted again
+	assert.ErrorIs(t, mp.CheckTx(ctx, committed, ""), ErrTxKnown)
+}
+
+func TestMempoolMinPriority(t *testing.T) {
+	ctx := context.Background()
+	mp := New(DefaultConfig, &checkerApp{})
+
+	low, mid, high := newTx(1), newTx(2), newTx(3)
+	for _, tx := range []*types.Transaction{low, mid, high} {
+		assert.NoError(t, mp.CheckTx(ctx, tx, ""))
+	}
+
+	mp.Update(ctx, 1, nil, 2)
+	assert.Equal(t, types.Transactions{high, mid}, mp.Reap(0, 0))
+	mp.Update(ctx, 2, types.Transactions{high}, 4)
+	assert.Empty(t, mp.Reap(0, 0))
+	// still pending once the priority goes down
+	assert.Equal(t, 2, mp.Size())
+	mp.Update(ctx, 3, nil, 0)
+	assert.Equal(t, types.Transactions{mid, low}, mp.Reap(0, 0))
+}
+
+func TestMempoolReapExcluding(t *testing.T) {
+	ctx := context.Background()
+	mp := New(DefaultConfig, &checkerApp{})
+
+	low, mid, high := newTx(1), newTx(2), newTx(3)
+	for _, tx := range []*types.Transaction{low, mid, high} {
+		assert.NoError(t, mp.CheckTx(ctx, tx, ""))
+	}
+
+	// the committed txs leave room for the next ones
+	assert.Equal(t, types.Transactions{mid, low}, mp.ReapExcluding(0, 20, types.Transactions{high}))
+	assert.True(t, mp.Pending(types.Transactions{high, mid}))
+
+	mp.Update(ctx, 1, types.Transactions{high}, 2)
+	assert.True(t, mp.Pending(types.Transactions{mid}))
+	assert.False(t, mp.Pending(types.Transactions{mid, high}))
+	assert.False(t, mp.Pending(types.Transactions{mid, low}))
+}
+
+func TestMempoolWAL(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "mempool.wal")
+
+	wal, err := OpenWAL(path)
+	assert.NoError(t, err)
+	mp := New(DefaultConfig, nil)
+	_, err = mp.SetWAL(wal)
+	assert.NoError(t, err)
+	committed, pending := newTx(1), newTx(2)
+	assert.NoError(t, mp.CheckTx(ctx, committed, ""))
+	assert.NoError(t, mp.CheckTx(ctx, pending, ""))
+	mp.Update(ctx, 1, types.Transactions{committed}, 0)
+	assert.NoError(t, wal.Close())
+
+	wal, err = OpenWAL(path)
+	assert.NoError(t, err)
+	defer wal.Close()
+	mp = New(DefaultConfig, nil)
+	n, err := mp.SetWAL(wal)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, pending.Hash(), mp.Reap(0, 0)[0].Hash())
+}
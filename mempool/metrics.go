@@ -0,0 +1,39 @@
+package mempool
+
+import (
+	"github.com/QuarkChain/go-minimal-pbft/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	mempoolCheckedTxs = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "mempool_checked_txs_total",
+			Help: "Total number of txs checked for the mempool, by result: admitted, known, full, too_large, rejected, or recheck_rejected",
+		}, []string{"result"})
+	mempoolTxs = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "mempool_txs",
+			Help: "Number of txs pending in the mempool",
+		})
+	mempoolMinTxPriority = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "mempool_min_tx_priority",
+			Help: "Priority below which pending txs are not proposed, as set by the application with the last block",
+		})
+	mempoolReapSkippedTxs = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "mempool_reap_skipped_txs_total",
+			Help: "Total number of pending txs left out of proposals as below the minimum priority",
+		})
+)
+
+// RegisterMetrics registers the mempool metrics with reg, see metrics.Options.
+func RegisterMetrics(reg prometheus.Registerer) error {
+	return metrics.Register(reg,
+		mempoolCheckedTxs,
+		mempoolMinTxPriority,
+		mempoolReapSkippedTxs,
+		mempoolTxs,
+	)
+}
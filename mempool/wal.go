@@ -0,0 +1,196 @@
+package mempool
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/QuarkChain/go-minimal-pbft/internal/failpoint"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// Largest transaction accepted when replaying the WAL, anything bigger is
+// treated as corruption.
+var MaxWALTxSize = uint32(1 << 20)
+
+var ErrWALCorrupted = errors.New("mempool wal corrupted")
+
+// WAL journals the transactions accepted by the mempool, so that pending
+// transactions are not lost when the node restarts.
+//
+// Each entry is a 4-byte big-endian length, a 4-byte CRC32 (IEEE) of the tx,
+// and the tx itself. Entries are only appended; Compact rewrites the file with
+// the transactions still pending (e.g. after a block is committed).
+type WAL struct {
+	mtx  sync.Mutex
+	path string
+	file *os.File
+	w    *bufio.Writer
+}
+
+// OpenWAL opens (or creates) the WAL at path for appending.
+func OpenWAL(path string) (*WAL, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open mempool wal: %w", err)
+	}
+	return &WAL{path: path, file: file, w: bufio.NewWriter(file)}, nil
+}
+
+// Write appends a tx. It is buffered until Flush.
+func (wal *WAL) Write(tx []byte) error {
+	wal.mtx.Lock()
+	defer wal.mtx.Unlock()
+
+	if err := writeEntry(wal.w, tx); err != nil {
+		return err
+	}
+	failpoint.Inject(failpoint.MempoolWALWrite)
+	return nil
+}
+
+// Flush writes the buffered txs and fsyncs the file.
+func (wal *WAL) Flush() error {
+	wal.mtx.Lock()
+	defer wal.mtx.Unlock()
+
+	if err := wal.w.Flush(); err != nil {
+		return err
+	}
+	if failpoint.Inject(failpoint.MempoolWALFsync) {
+		return nil
+	}
+	return wal.file.Sync()
+}
+
+// Replay calls checkTx on every journaled tx in order, e.g., to re-run CheckTx
+// and add it back to the mempool at startup. Txs rejected by checkTx (such as
+// ones included in a block before the restart) are skipped. A truncated last
+// entry, as left by a crash in the middle of a write, is ignored.
+//
+// It returns the number of txs accepted by checkTx.
+func (wal *WAL) Replay(checkTx func(tx []byte) error) (int, error) {
+	wal.mtx.Lock()
+	defer wal.mtx.Unlock()
+
+	file, err := os.Open(wal.path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open mempool wal: %w", err)
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	accepted := 0
+	for {
+		tx, err := readEntry(r)
+		if err == io.EOF {
+			return accepted, nil
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			log.Warn("Ignoring truncated mempool wal entry", "path", wal.path, "accepted", accepted)
+			return accepted, nil
+		}
+		if err != nil {
+			return accepted, err
+		}
+
+		if err := checkTx(tx); err != nil {
+			log.Debug("Dropping tx from mempool wal", "err", err)
+			continue
+		}
+		accepted++
+	}
+}
+
+// Compact replaces the content of the WAL with the given txs.
+func (wal *WAL) Compact(txs [][]byte) error {
+	wal.mtx.Lock()
+	defer wal.mtx.Unlock()
+
+	tmpPath := wal.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(tmp)
+	for _, tx := range txs {
+		if err := writeEntry(w, tx); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	// drop anything buffered for the old file, the txs are in the new one
+	wal.file.Close()
+	renameErr := os.Rename(tmpPath, wal.path)
+
+	file, err := os.OpenFile(wal.path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to reopen mempool wal: %w", err)
+	}
+	wal.file = file
+	wal.w = bufio.NewWriter(file)
+	return renameErr
+}
+
+// Close flushes and closes the WAL.
+func (wal *WAL) Close() error {
+	if err := wal.Flush(); err != nil {
+		return err
+	}
+	return wal.file.Close()
+}
+
+func writeEntry(w io.Writer, tx []byte) error {
+	var hdr [8]byte
+	binary.BigEndian.PutUint32(hdr[:4], uint32(len(tx)))
+	binary.BigEndian.PutUint32(hdr[4:], crc32.ChecksumIEEE(tx))
+
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(tx)
+	return err
+}
+
+func readEntry(r io.Reader) ([]byte, error) {
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(hdr[:4])
+	if size > MaxWALTxSize {
+		return nil, fmt.Errorf("%w: tx size %d", ErrWALCorrupted, size)
+	}
+
+	tx := make([]byte, size)
+	if _, err := io.ReadFull(r, tx); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	if crc32.ChecksumIEEE(tx) != binary.BigEndian.Uint32(hdr[4:]) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrWALCorrupted)
+	}
+	return tx, nil
+}
@@ -0,0 +1,69 @@
+package mempool
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func replayAll(t *testing.T, wal *WAL) [][]byte {
+	var txs [][]byte
+	_, err := wal.Replay(func(tx []byte) error {
+		txs = append(txs, tx)
+		return nil
+	})
+	assert.NoError(t, err)
+	return txs
+}
+
+func TestWALReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mempool.wal")
+
+	wal, err := OpenWAL(path)
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Write([]byte("tx1")))
+	assert.NoError(t, wal.Write([]byte("tx2")))
+	assert.NoError(t, wal.Write([]byte("tx3")))
+	assert.NoError(t, wal.Close())
+
+	wal, err = OpenWAL(path)
+	assert.NoError(t, err)
+	defer wal.Close()
+
+	// rejected txs are skipped
+	n, err := wal.Replay(func(tx []byte) error {
+		if string(tx) == "tx2" {
+			return errors.New("already committed")
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	assert.NoError(t, wal.Compact([][]byte{[]byte("tx3")}))
+	assert.NoError(t, wal.Write([]byte("tx4")))
+	assert.NoError(t, wal.Flush())
+	assert.Equal(t, [][]byte{[]byte("tx3"), []byte("tx4")}, replayAll(t, wal))
+}
+
+func TestWALTruncatedTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mempool.wal")
+
+	wal, err := OpenWAL(path)
+	assert.NoError(t, err)
+	assert.NoError(t, wal.Write([]byte("tx1")))
+	assert.NoError(t, wal.Write([]byte("tx2")))
+	assert.NoError(t, wal.Close())
+
+	fi, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.NoError(t, os.Truncate(path, fi.Size()-1))
+
+	wal, err = OpenWAL(path)
+	assert.NoError(t, err)
+	defer wal.Close()
+	assert.Equal(t, [][]byte{[]byte("tx1")}, replayAll(t, wal))
+}
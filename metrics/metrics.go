@@ -0,0 +1,47 @@
+// Package metrics sets how the metrics of the node packages are exposed, so
+// an application embedding them can merge them with its own telemetry.
+//
+// The packages do not register their metrics by themselves; each has a
+// RegisterMetrics function to call with the registerer given by Options.Wrap.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Options of the metrics of the node packages.
+type Options struct {
+	// Namespace prefixes the metric names, e.g. "mpbft" gives
+	// mpbft_consensus_quorum_wait_seconds.
+	Namespace string
+	// ConstLabels are added to every metric, e.g. chain_id and moniker.
+	ConstLabels prometheus.Labels
+	// Registerer defaults to prometheus.DefaultRegisterer.
+	Registerer prometheus.Registerer
+}
+
+// Wrap returns the registerer adding the namespace and labels of the
+// options to the metrics registered with it.
+func (o Options) Wrap() prometheus.Registerer {
+	reg := o.Registerer
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+	if len(o.ConstLabels) != 0 {
+		reg = prometheus.WrapRegistererWith(o.ConstLabels, reg)
+	}
+	if o.Namespace != "" {
+		reg = prometheus.WrapRegistererWithPrefix(o.Namespace+"_", reg)
+	}
+	return reg
+}
+
+// Register registers all the collectors, stopping at the first error.
+func Register(reg prometheus.Registerer, collectors ...prometheus.Collector) error {
+	for _, c := range collectors {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
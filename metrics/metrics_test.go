@@ -0,0 +1,31 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOptionsWrap(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	opts := Options{
+		Namespace:   "mpbft",
+		ConstLabels: prometheus.Labels{"chain_id": "test"},
+		Registerer:  reg,
+	}
+
+	c := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_total", Help: "test"})
+	assert.NoError(t, Register(opts.Wrap(), c))
+	c.Inc()
+
+	mfs, err := reg.Gather()
+	assert.NoError(t, err)
+	assert.Len(t, mfs, 1)
+	assert.Equal(t, "mpbft_test_total", mfs[0].GetName())
+	assert.Equal(t, "chain_id", mfs[0].GetMetric()[0].GetLabel()[0].GetName())
+	assert.Equal(t, "test", mfs[0].GetMetric()[0].GetLabel()[0].GetValue())
+
+	// the same collector twice
+	assert.Error(t, Register(opts.Wrap(), c))
+}
@@ -1,14 +1,20 @@
-package main
+// Package node has the parts of a node an application embedding it
+// assembles next to the consensus state, outside of cmd/main: for now the
+// leveldb block store.
+package node
 
 import (
 	"encoding/binary"
 	"fmt"
 
 	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/QuarkChain/go-minimal-pbft/internal/failpoint"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
+// DefaultBlockStore stores the blocks and their commits in leveldb.
 type DefaultBlockStore struct {
 	db *leveldb.DB
 }
@@ -101,6 +107,15 @@ func (bs *DefaultBlockStore) SaveBlock(b *consensus.FullBlock, c *consensus.Comm
 		return
 	}
 
+	metaData, err := rlp.EncodeToBytes(consensus.NewBlockMeta(b, len(blockData)))
+	if err != nil {
+		return
+	}
+	if err := bs.db.Put(metaKey(b.NumberU64()), metaData, nil); err != nil {
+		return
+	}
+	failpoint.Inject(failpoint.BlockStoreMidPersist)
+
 	commitData, err := rlp.EncodeToBytes(c)
 	if err != nil {
 		return
@@ -135,3 +150,41 @@ func (bs *DefaultBlockStore) LoadSeenCommit() *consensus.Commit {
 	}
 	return c
 }
+
+func metaKey(height uint64) []byte {
+	key := make([]byte, 4+8)
+	copy(key, "meta")
+	binary.BigEndian.PutUint64(key[4:], height)
+	return key
+}
+
+func (bs *DefaultBlockStore) Iterate(from, to uint64, reverse bool, fn func(*consensus.BlockMeta) bool) error {
+	// a block is only stored once the height is, see SaveBlock
+	if height := bs.Height(); to > height {
+		to = height
+	}
+	if from < bs.Base() {
+		from = bs.Base()
+	}
+	if from > to {
+		return nil
+	}
+
+	it := bs.db.NewIterator(&util.Range{Start: metaKey(from), Limit: metaKey(to + 1)}, nil)
+	defer it.Release()
+
+	next, step := it.First, it.Next
+	if reverse {
+		next, step = it.Last, it.Prev
+	}
+	for ok := next(); ok; ok = step() {
+		meta := &consensus.BlockMeta{}
+		if err := rlp.DecodeBytes(it.Value(), meta); err != nil {
+			return fmt.Errorf("invalid block meta %x: %w", it.Key(), err)
+		}
+		if !fn(meta) {
+			break
+		}
+	}
+	return it.Error()
+}
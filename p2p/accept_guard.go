@@ -0,0 +1,229 @@
+package p2p
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// An inbound connection costs goroutines from its accept to the end of the
+// node info and cert handshakes, and every stream of a channel holds one of
+// its slots while a message is read. A slow-loris peer opening connections
+// and stalling them, or trickling the bytes of its messages, could exhaust
+// both. So the whole accept-to-ready of an inbound connection is bounded by
+// handshakeTimeout, an IP can have at most maxHandshakesPerIP connections in
+// handshake (more are refused at accept), and once its first byte arrived, a
+// message must be read at msgMinReadRate, else the connection is closed.
+
+var (
+	handshakeTimeout   = 20 * time.Second
+	maxHandshakesPerIP = 8
+	// time to read a message on top of its size at msgMinReadRate
+	msgReadGrace   = 5 * time.Second
+	msgMinReadRate = 64 * 1024 // bytes per second
+)
+
+var p2pHandshakesRefused = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "p2p_handshakes_refused_total",
+		Help: "Total number of inbound connections refused or closed before being ready, by reason",
+	}, []string{"reason"})
+
+type pendingHandshake struct {
+	deadline time.Time
+	peer     peer.ID // once the transport handshake is done
+}
+
+// handshakeGuard tracks the inbound connections from their accept until
+// they are ready, by IP and remote address.
+type handshakeGuard struct {
+	mu      sync.Mutex
+	pending map[string]map[string]*pendingHandshake
+	ready   func(peer.ID) bool
+}
+
+func newHandshakeGuard() *handshakeGuard {
+	return &handshakeGuard{pending: make(map[string]map[string]*pendingHandshake)}
+}
+
+// admit tells whether to accept a connection from addr, and tracks it until
+// it is ready or its deadline.
+func (hg *handshakeGuard) admit(addr multiaddr.Multiaddr, now time.Time) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		return true
+	}
+
+	hg.mu.Lock()
+	defer hg.mu.Unlock()
+
+	pending := hg.pending[ip.String()]
+	for a, ph := range pending {
+		if now.After(ph.deadline) || (ph.peer != "" && hg.ready != nil && hg.ready(ph.peer)) {
+			delete(pending, a)
+		}
+	}
+	if len(pending) >= maxHandshakesPerIP {
+		return false
+	}
+	if pending == nil {
+		pending = make(map[string]*pendingHandshake)
+		hg.pending[ip.String()] = pending
+	}
+	pending[addr.String()] = &pendingHandshake{deadline: now.Add(handshakeTimeout)}
+	return true
+}
+
+func (hg *handshakeGuard) lookup(addr multiaddr.Multiaddr) (*pendingHandshake, string) {
+	ip := addrIP(addr)
+	if ip == nil {
+		return nil, ""
+	}
+	return hg.pending[ip.String()][addr.String()], ip.String()
+}
+
+// done stops tracking a connection.
+func (hg *handshakeGuard) done(addr multiaddr.Multiaddr) {
+	hg.mu.Lock()
+	defer hg.mu.Unlock()
+
+	if ph, ip := hg.lookup(addr); ph != nil {
+		delete(hg.pending[ip], addr.String())
+		if len(hg.pending[ip]) == 0 {
+			delete(hg.pending, ip)
+		}
+	}
+}
+
+// attach closes the inbound connections not ready by their deadline. It
+// must be called before any connection is made.
+func (hg *handshakeGuard) attach(h host.Host, ready func(peer.ID) bool) {
+	hg.mu.Lock()
+	hg.ready = ready
+	hg.mu.Unlock()
+
+	h.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(n network.Network, conn network.Conn) {
+			if conn.Stat().Direction != network.DirInbound {
+				return
+			}
+			hg.mu.Lock()
+			ph, _ := hg.lookup(conn.RemoteMultiaddr())
+			deadline := time.Now().Add(handshakeTimeout)
+			if ph != nil {
+				ph.peer = conn.RemotePeer()
+				deadline = ph.deadline
+			}
+			hg.mu.Unlock()
+
+			time.AfterFunc(time.Until(deadline), func() {
+				hg.done(conn.RemoteMultiaddr())
+				if !hasConn(n, conn) || ready(conn.RemotePeer()) {
+					return
+				}
+				log.Debug("Closing inbound connection not ready in time", "peer", conn.RemotePeer(), "addr", conn.RemoteMultiaddr())
+				p2pHandshakesRefused.WithLabelValues("timeout").Inc()
+				recordDisconnect(string(conn.RemotePeer()), DisconnectTimeout, false)
+				conn.Close()
+			})
+		},
+		DisconnectedF: func(n network.Network, conn network.Conn) {
+			hg.done(conn.RemoteMultiaddr())
+		},
+	})
+}
+
+func hasConn(n network.Network, conn network.Conn) bool {
+	for _, c := range n.ConnsToPeer(conn.RemotePeer()) {
+		if c == conn {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptGater adds the per-IP handshake limit to the mode restrictions.
+type acceptGater struct {
+	modeGater
+	handshakes *handshakeGuard
+}
+
+func (g acceptGater) InterceptAccept(addrs network.ConnMultiaddrs) bool {
+	if !g.modeGater.InterceptAccept(addrs) {
+		return false
+	}
+	if !g.handshakes.admit(addrs.RemoteMultiaddr(), time.Now()) {
+		log.Debug("Refusing inbound connection, too many handshakes from its IP", "addr", addrs.RemoteMultiaddr())
+		p2pHandshakesRefused.WithLabelValues("ip_limit").Inc()
+		return false
+	}
+	return true
+}
+
+// msgReadLimit is the time to read a message of size bytes.
+func msgReadLimit(size int) time.Duration {
+	return msgReadGrace + time.Duration(size)*time.Second/time.Duration(msgMinReadRate)
+}
+
+// readWatchdog resets a stream whose message is not read in time, and
+// closes its connection.
+type readWatchdog struct {
+	timer *time.Timer
+	fired int32
+}
+
+func watchRead(stream network.Stream, limit time.Duration) *readWatchdog {
+	wd := &readWatchdog{}
+	wd.timer = time.AfterFunc(limit, func() {
+		atomic.StoreInt32(&wd.fired, 1)
+		stream.Reset()
+		if conn := stream.Conn(); conn != nil {
+			log.Debug("Closing connection trickling a message", "peer", conn.RemotePeer(), "protocol", stream.Protocol())
+			recordDisconnect(string(conn.RemotePeer()), DisconnectSlowPeer, false)
+			conn.Close()
+		}
+	})
+	return wd
+}
+
+// stop stops the watchdog, and returns ErrSlowPeer instead of err if it
+// fired.
+func (wd *readWatchdog) stop(err error) error {
+	if !wd.timer.Stop() && atomic.LoadInt32(&wd.fired) == 1 {
+		return ErrSlowPeer
+	}
+	return err
+}
+
+// readMessage reads a size-prefixed message from a channel stream. Waiting
+// for the first byte is not bounded (the stream may be idle until the next
+// message), the rest of the message is.
+func (cs *channelStream) readMessage() ([]byte, error) {
+	sizeBytes := make([]byte, 4)
+	if _, err := io.ReadFull(cs.Stream, sizeBytes[:1]); err != nil {
+		return nil, err
+	}
+
+	wd := watchRead(cs.Stream, msgReadLimit(len(sizeBytes)))
+	_, err := io.ReadFull(cs.Stream, sizeBytes[1:])
+	if err = wd.stop(err); err != nil {
+		return nil, err
+	}
+
+	size, err := checkMessageSize(cs, sizeBytes)
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, size)
+	wd = watchRead(cs.Stream, msgReadLimit(len(msg)))
+	_, err = io.ReadFull(cs.Stream, msg)
+	return msg, wd.stop(err)
+}
@@ -0,0 +1,75 @@
+package p2p
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandshakeGuardAdmit(t *testing.T) {
+	hg := newHandshakeGuard()
+	now := time.Now()
+	addr := func(s string) multiaddr.Multiaddr { return multiaddr.StringCast(s) }
+
+	for port := 0; port < maxHandshakesPerIP; port++ {
+		assert.True(t, hg.admit(addr(fmt.Sprintf("/ip4/1.2.3.4/udp/%d/quic", port)), now))
+	}
+	assert.False(t, hg.admit(addr("/ip4/1.2.3.4/udp/9/quic"), now))
+	// other IPs are not limited by it
+	assert.True(t, hg.admit(addr("/ip4/1.2.3.5/udp/9/quic"), now))
+
+	hg.done(addr("/ip4/1.2.3.4/udp/0/quic"))
+	assert.True(t, hg.admit(addr("/ip4/1.2.3.4/udp/9/quic"), now))
+	assert.False(t, hg.admit(addr("/ip4/1.2.3.4/udp/10/quic"), now))
+
+	// expired handshakes do not count
+	assert.True(t, hg.admit(addr("/ip4/1.2.3.4/udp/10/quic"), now.Add(handshakeTimeout+time.Second)))
+}
+
+// trickleStream returns a byte per read, waiting delay first.
+type trickleStream struct {
+	network.Stream
+	data  []byte
+	delay time.Duration
+	reset chan struct{}
+}
+
+func (s *trickleStream) Read(b []byte) (int, error) {
+	select {
+	case <-time.After(s.delay):
+	case <-s.reset:
+		return 0, io.ErrClosedPipe
+	}
+	if len(s.data) == 0 {
+		return 0, io.EOF
+	}
+	b[0], s.data = s.data[0], s.data[1:]
+	return 1, nil
+}
+
+func (s *trickleStream) Reset() error {
+	close(s.reset)
+	return nil
+}
+
+func (s *trickleStream) Conn() network.Conn { return nil }
+
+func TestReadMessageTrickle(t *testing.T) {
+	defer func(grace time.Duration) { msgReadGrace = grace }(msgReadGrace)
+	msgReadGrace = 50 * time.Millisecond
+
+	msg := []byte{0, 0, 0, 3, 'a', 'b', 'c'}
+	fast := &channelStream{Stream: &trickleStream{data: msg, reset: make(chan struct{})}, maxMessageSize: 16}
+	data, err := ReadMsgWithPrependedSize(fast)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("abc"), data)
+
+	slow := &channelStream{Stream: &trickleStream{data: msg, delay: 40 * time.Millisecond, reset: make(chan struct{})}, maxMessageSize: 16}
+	_, err = ReadMsgWithPrependedSize(slow)
+	assert.ErrorIs(t, err, ErrSlowPeer)
+}
@@ -0,0 +1,532 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MsgProposalParts announces a proposal by the header of the part set of its
+// block, instead of gossiping the proposal itself. The parts are then fetched
+// over TopicBlockParts, from the peer announcing it and any other peer
+// holding some of them, each part being checked against the root on its own.
+// The parts do not depend on the round, see blockPartsData: when a later
+// round proposes the block again, e.g., as the valid block, the parts
+// received in the earlier rounds are kept, and only the missing ones fetched. The header is signed by the proposer of the round, see
+// consensus.ProposalPartsSignBytes, and only the headers of the current
+// height and the next one signed by their proposer are tracked, so that no
+// peer can make us fetch junk, or fill the roots of a round before the
+// proposer.
+const MsgProposalParts = 0x09
+
+// TopicBlockParts serves the parts of the proposals we hold, or assemble.
+const TopicBlockParts = "/mpbft/dev/block_parts/1.0.0"
+
+const (
+	maxBlockPartsMsg = 4 * 1024 * 1024
+
+	partsFetchTimeout = 10 * time.Second
+	partsRetryWait    = 200 * time.Millisecond
+	// peers the missing parts are spread over, the announcers first
+	partsFetchPeers = 4
+	// roots kept per height and round, a bound on the roots a proposer signs
+	maxPartSetsPerRound = 4
+	// heights below the last announced one whose part sets are kept
+	partsKeepHeights = 1
+)
+
+var ErrInvalidBlockParts = errors.New("invalid block parts")
+
+// BlockParts enables announcing our proposals by their parts. Every node
+// fetches them, but older ones do not, so it is off by default.
+var BlockParts = false
+
+var (
+	p2pBlockParts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "p2p_block_parts_total",
+			Help: "Total number of proposal parts, by direction: sent, received, invalid, resumed from an earlier round, or wasted on a block never assembled",
+		}, []string{"direction"})
+	p2pBlockPartsFill = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "p2p_block_parts_fill_ratio",
+			Help:    "Fraction of the parts of a proposal held when its round ended before they were all received",
+			Buckets: prometheus.LinearBuckets(0.1, 0.1, 10),
+		})
+)
+
+func init() {
+	decoder[MsgProposalParts] = decodeProposalParts
+	if err := RegisterChannel(ChannelDescriptor{
+		ID:             TopicBlockParts,
+		Priority:       ChannelPriorityHigh,
+		QueueCapacity:  64,
+		MaxMessageSize: maxBlockPartsMsg,
+		Optional:       true,
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// ProposalParts is the announcement of a proposal of BlockID, its block split
+// into parts. It carries the fields of the proposal but the block, and the
+// signature of the parts by the proposer.
+type ProposalParts struct {
+	Height uint64
+	Round  uint32
+	// POLRound of the proposal plus one, 0 for none
+	POLRound          uint32
+	TimestampMs       uint64
+	ProposalSignature []byte
+	BlockID           common.Hash
+	Parts             consensus.PartSetHeader
+	Signature         []byte
+}
+
+func newProposalParts(p *consensus.Proposal, parts consensus.PartSetHeader) *ProposalParts {
+	return &ProposalParts{
+		Height:            p.Height,
+		Round:             uint32(p.Round),
+		POLRound:          uint32(p.POLRound + 1),
+		TimestampMs:       uint64(p.TimestampMs),
+		ProposalSignature: p.Signature,
+		BlockID:           p.Block.Hash(),
+		Parts:             parts,
+	}
+}
+
+func (pp *ProposalParts) ValidateBasic() error {
+	if len(pp.Signature) == 0 || len(pp.ProposalSignature) == 0 {
+		return fmt.Errorf("%w: unsigned", ErrInvalidBlockParts)
+	}
+	return pp.Parts.ValidateBasic()
+}
+
+// proposal returns the proposal announced, of block.
+func (pp *ProposalParts) proposal(block *consensus.FullBlock) *consensus.Proposal {
+	return &consensus.Proposal{
+		Height:      pp.Height,
+		Round:       int32(pp.Round),
+		POLRound:    int32(pp.POLRound) - 1,
+		TimestampMs: int64(pp.TimestampMs),
+		Signature:   pp.ProposalSignature,
+		Block:       block,
+	}
+}
+
+// blockPartsData returns the data split into the parts of block at height:
+// the encoding of an unsigned proposal of it with no round, which the
+// proposals of the block in every round share.
+func blockPartsData(height uint64, block *consensus.FullBlock) ([]byte, error) {
+	return encodeProposal(&consensus.Proposal{Height: height, POLRound: -1, Block: block})
+}
+
+// decodeBlockParts decodes the data of assembled parts, see blockPartsData.
+func decodeBlockParts(data []byte) (*consensus.Proposal, error) {
+	p := &consensus.Proposal{}
+	if err := p.DecodeRLP(rlp.NewStream(bytes.NewReader(data), 0)); err != nil {
+		return nil, err
+	}
+	if p.Block == nil {
+		return nil, errors.New("no block")
+	}
+	return p, nil
+}
+
+// partsConsensus is the consensus state signing and checking the
+// announcements.
+type partsConsensus interface {
+	HeightRound() (uint64, int32)
+	SignProposalParts(height uint64, round int32, blockID common.Hash, parts consensus.PartSetHeader) ([]byte, error)
+	VerifyProposalParts(height uint64, round int32, blockID common.Hash, parts consensus.PartSetHeader, sig []byte) error
+}
+
+// BlockPartsRequest asks for the parts at Indexes of a part set.
+type BlockPartsRequest struct {
+	Height  uint64
+	Round   uint32
+	Root    common.Hash
+	Indexes []uint32
+}
+
+// BlockPartsResponse carries the requested parts the peer holds.
+type BlockPartsResponse struct {
+	Parts []*consensus.Part
+}
+
+func decodeProposalParts(data []byte) (interface{}, error) {
+	pp := &ProposalParts{}
+	if err := rlp.DecodeBytes(data, pp); err != nil {
+		return nil, err
+	}
+	return pp, pp.ValidateBasic()
+}
+
+func encodeProposalParts(pp *ProposalParts) ([]byte, error) {
+	data, err := rlp.EncodeToBytes(pp)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{MsgProposalParts}, data...), nil
+}
+
+// partsPerRequest is the number of parts asked in a request, so that the
+// response fits the channel.
+func partsPerRequest() int {
+	if n := maxBlockPartsMsg / 2 / consensus.BlockPartSize; n > 1 {
+		return n
+	}
+	return 1
+}
+
+type partsKey struct {
+	height uint64
+	round  uint32
+	root   common.Hash
+}
+
+type partsEntry struct {
+	// shared with the entries of the other rounds proposing the block
+	set *consensus.PartSet
+	// peer that announced the root first, answerable for what it assembles to
+	origin peer.ID
+	// peers that announced or forwarded the root
+	sources map[peer.ID]bool
+}
+
+// partStore keeps the part sets of the last heights, complete or being
+// assembled.
+type partStore struct {
+	mtx  sync.Mutex
+	sets map[partsKey]*partsEntry
+}
+
+func newPartStore() *partStore {
+	return &partStore{sets: make(map[partsKey]*partsEntry)}
+}
+
+// add keeps a complete part set of ours.
+func (s *partStore) add(key partsKey, set *consensus.PartSet) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.prune(key.height)
+	if e, ok := s.sets[key]; ok {
+		e.set = set
+		return
+	}
+	s.sets[key] = &partsEntry{set: set, sources: make(map[peer.ID]bool)}
+}
+
+// track records the sources of an announced part set, and returns it if it
+// is new and must be fetched. The part set of the block proposed at the
+// height in an earlier round is resumed, along with its sources.
+func (s *partStore) track(key partsKey, h consensus.PartSetHeader, sources ...peer.ID) (*partsEntry, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if e, ok := s.sets[key]; ok {
+		for _, p := range sources {
+			e.sources[p] = true
+		}
+		return nil, nil
+	}
+
+	n := 0
+	for k := range s.sets {
+		if k.height == key.height && k.round == key.round {
+			n++
+		}
+	}
+	if n >= maxPartSetsPerRound {
+		return nil, fmt.Errorf("%w: more than %d roots at height %d round %d", ErrInvalidBlockParts, maxPartSetsPerRound, key.height, key.round)
+	}
+
+	set, err := consensus.NewPartSetFromHeader(h)
+	if err != nil {
+		return nil, err
+	}
+	s.prune(key.height)
+	e := &partsEntry{set: set, origin: sources[0], sources: make(map[peer.ID]bool)}
+	for k, prev := range s.sets {
+		if k.height == key.height && k.root == key.root && prev.set.Header() == h {
+			e.set = prev.set
+			for p := range prev.sources {
+				e.sources[p] = true
+			}
+			p2pBlockParts.WithLabelValues("resumed").Add(float64(consensus.CountBits(e.set.BitArray())))
+			break
+		}
+	}
+	for _, p := range sources {
+		e.sources[p] = true
+	}
+	s.sets[key] = e
+	return e, nil
+}
+
+func (s *partStore) get(key partsKey) *consensus.PartSet {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if e, ok := s.sets[key]; ok {
+		return e.set
+	}
+	return nil
+}
+
+func (s *partStore) sources(key partsKey) []peer.ID {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var ps []peer.ID
+	if e, ok := s.sets[key]; ok {
+		for p := range e.sources {
+			ps = append(ps, p)
+		}
+	}
+	return ps
+}
+
+// prune drops the part sets too far below height, counting the parts of the
+// ones never assembled as wasted. Called with mtx held.
+func (s *partStore) prune(height uint64) {
+	wasted := make(map[*consensus.PartSet]bool)
+	for k, e := range s.sets {
+		if k.height+partsKeepHeights < height {
+			if !e.set.IsComplete() {
+				wasted[e.set] = true
+			}
+			delete(s.sets, k)
+		}
+	}
+	for set := range wasted {
+		p2pBlockParts.WithLabelValues("wasted").Add(float64(consensus.CountBits(set.BitArray())))
+	}
+}
+
+// encodeProposalBroadcast encodes a proposal for broadcast: with BlockParts,
+// a proposal of ours larger than a part is announced by its parts, which we
+// keep to serve them. The proposals of others, or the ones we cannot sign the
+// parts of, are sent whole.
+func (server *Server) encodeProposalBroadcast(p *consensus.Proposal) ([]byte, error) {
+	if !BlockParts || server.partsConsensus == nil {
+		return encodeProposalMsg(p)
+	}
+
+	raw, err := blockPartsData(p.Height, p.Block)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) <= consensus.BlockPartSize {
+		return encodeProposalMsg(p)
+	}
+	set, err := consensus.NewPartSetFromData(raw, consensus.BlockPartSize)
+	if err != nil {
+		return nil, err
+	}
+
+	pp := newProposalParts(p, set.Header())
+	pp.Signature, err = server.partsConsensus.SignProposalParts(p.Height, p.Round, pp.BlockID, pp.Parts)
+	if err != nil {
+		log.Debug("Sending the proposal whole", "height", p.Height, "round", p.Round, "err", err)
+		return encodeProposalMsg(p)
+	}
+	server.parts.add(partsKey{height: pp.Height, round: pp.Round, root: pp.Parts.Root}, set)
+	return encodeProposalParts(pp)
+}
+
+// addProposalParts fetches the parts of an announced proposal, unless it is
+// already known or not valid, see acceptProposalParts.
+func (server *Server) addProposalParts(ctx context.Context, pp *ProposalParts, sources ...peer.ID) {
+	key := partsKey{height: pp.Height, round: pp.Round, root: pp.Parts.Root}
+	e, err := server.acceptProposalParts(key, pp, sources...)
+	if err != nil {
+		log.Debug("Ignoring proposal parts", "height", pp.Height, "round", pp.Round, "from", sources[0], "err", err)
+		return
+	}
+	if e != nil {
+		go server.fetchParts(ctx, key, e, pp)
+	}
+}
+
+// acceptProposalParts tracks the part set of an announcement of the current
+// height or the next one signed by the proposer of its round, and returns it
+// if it is new and must be fetched.
+func (server *Server) acceptProposalParts(key partsKey, pp *ProposalParts, sources ...peer.ID) (*partsEntry, error) {
+	if server.partsConsensus == nil {
+		return nil, fmt.Errorf("%w: no consensus state", ErrInvalidBlockParts)
+	}
+	height, _ := server.partsConsensus.HeightRound()
+	if pp.Height < height || pp.Height > height+1 {
+		return nil, fmt.Errorf("%w: height %d, at %d", ErrInvalidBlockParts, pp.Height, height)
+	}
+	if server.parts.get(key) != nil {
+		return server.parts.track(key, pp.Parts, sources...)
+	}
+	if err := server.partsConsensus.VerifyProposalParts(pp.Height, int32(pp.Round), pp.BlockID, pp.Parts, pp.Signature); err != nil {
+		return nil, err
+	}
+	return server.parts.track(key, pp.Parts, sources...)
+}
+
+// fetchParts assembles a part set, spreading the missing parts over the
+// sources and other peers, and takes the proposal to the consensus state.
+// When the round ends first, the parts are still fetched, for a later round
+// proposing the block again.
+func (server *Server) fetchParts(ctx context.Context, key partsKey, e *partsEntry, pp *ProposalParts) {
+	ctx, cancel := context.WithTimeout(ctx, partsFetchTimeout)
+	defer cancel()
+
+	set := e.set
+	late := false
+	for !set.IsComplete() {
+		peers := server.partsPeers(key)
+		missing := set.Missing()
+		if n := partsPerRequest() * len(peers); len(missing) > n {
+			missing = missing[:n]
+		}
+
+		var wg sync.WaitGroup
+		for i, p := range peers {
+			var want []uint32
+			for j := i; j < len(missing); j += len(peers) {
+				want = append(want, missing[j])
+			}
+			if len(want) == 0 {
+				break
+			}
+			wg.Add(1)
+			go func(p peer.ID) {
+				defer wg.Done()
+				server.requestParts(ctx, p, key, want, set)
+			}(p)
+		}
+		wg.Wait()
+
+		if set.IsComplete() {
+			break
+		}
+		if height, round := server.partsConsensus.HeightRound(); !late && (height > key.height || (height == key.height && round > int32(key.round))) {
+			late = true
+			p2pBlockPartsFill.Observe(float64(consensus.CountBits(set.BitArray())) / float64(set.Header().Total))
+		}
+		select {
+		case <-ctx.Done():
+			log.Debug("Failed fetching proposal parts", "height", key.height, "round", key.round,
+				"have", consensus.CountBits(set.BitArray()), "total", set.Header().Total)
+			return
+		case <-time.After(partsRetryWait):
+		}
+	}
+
+	data, err := decodeBlockParts(set.Data())
+	if err != nil {
+		server.penalize(server.ctx, e.origin, fmt.Errorf("%w: %v", ErrInvalidBlockParts, err))
+		return
+	}
+	if data.Height != key.height || data.Block.Hash() != pp.BlockID {
+		server.penalize(server.ctx, e.origin, fmt.Errorf("%w: block %v at height %d announced as block %v at height %d",
+			ErrInvalidBlockParts, data.Block.Hash(), data.Height, pp.BlockID, key.height))
+		return
+	}
+	proposal := pp.proposal(data.Block)
+	if err := proposal.ValidateBasic(); err != nil {
+		server.penalize(server.ctx, e.origin, fmt.Errorf("%w: %v", ErrInvalidBlockParts, err))
+		return
+	}
+	server.obsvC <- consensus.MsgInfo{Msg: &consensus.ProposalMessage{Proposal: proposal}, PeerID: string(e.origin)}
+	p2pMessagesReceived.WithLabelValues("observation").Inc()
+}
+
+// partsPeers returns the peers to fetch parts from: the sources of the part
+// set, then random peers that may hold some parts, as they assemble them too.
+func (server *Server) partsPeers(key partsKey) []peer.ID {
+	var peers []peer.ID
+	known := make(map[peer.ID]bool)
+	for _, p := range server.parts.sources(key) {
+		if server.isAuthorized(p) && PeerSupports(server.Host, p, TopicBlockParts) {
+			peers = append(peers, p)
+			known[p] = true
+		}
+	}
+	if len(peers) >= partsFetchPeers {
+		return peers
+	}
+
+	var others []peer.ID
+	for _, p := range PeersSupporting(server.Host, TopicBlockParts) {
+		if !known[p] && server.isAuthorized(p) {
+			others = append(others, p)
+		}
+	}
+	return append(peers, PickRandom(others, partsFetchPeers-len(peers))...)
+}
+
+// requestParts asks a peer for parts, and adds the ones it sends. A peer
+// sending an invalid part is penalized.
+func (server *Server) requestParts(ctx context.Context, p peer.ID, key partsKey, want []uint32, set *consensus.PartSet) {
+	req := &BlockPartsRequest{Height: key.height, Round: key.round, Root: key.root, Indexes: want}
+	resp := &BlockPartsResponse{}
+	if err := SendRPC(ctx, server.Host, p, TopicBlockParts, req, resp); err != nil {
+		log.Debug("Failed requesting proposal parts", "peer", p, "err", err)
+		return
+	}
+
+	for _, part := range resp.Parts {
+		if _, err := set.AddPart(part); err != nil {
+			p2pBlockParts.WithLabelValues("invalid").Inc()
+			server.penalize(ctx, p, err)
+			return
+		}
+		p2pBlockParts.WithLabelValues("received").Inc()
+	}
+}
+
+// handleBlockParts sends the requested parts we hold.
+func (server *Server) handleBlockParts(stream network.Stream) {
+	defer stream.Close()
+
+	if !server.isAuthorized(stream.Conn().RemotePeer()) {
+		return
+	}
+
+	data, err := ReadMsgWithPrependedSize(stream)
+	if err != nil {
+		return
+	}
+	var req BlockPartsRequest
+	if err := rlp.DecodeBytes(data, &req); err != nil {
+		return
+	}
+
+	resp := BlockPartsResponse{}
+	if set := server.parts.get(partsKey{height: req.Height, round: req.Round, root: req.Root}); set != nil {
+		for _, i := range req.Indexes {
+			if len(resp.Parts) == partsPerRequest() {
+				break
+			}
+			if part := set.GetPart(i); part != nil {
+				resp.Parts = append(resp.Parts, part)
+			}
+		}
+	}
+	respData, err := rlp.EncodeToBytes(&resp)
+	if err != nil {
+		return
+	}
+	if err := WriteMsgWithPrependedSize(stream, respData); err == nil {
+		p2pBlockParts.WithLabelValues("sent").Add(float64(len(resp.Parts)))
+	}
+}
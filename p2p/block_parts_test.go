@@ -0,0 +1,173 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var proposerSig = []byte("proposer")
+
+// testPartsConsensus is at height 10, the announcements signed with
+// proposerSig being the ones of the proposer.
+type testPartsConsensus struct{}
+
+func (testPartsConsensus) HeightRound() (uint64, int32) { return 10, 0 }
+
+func (testPartsConsensus) SignProposalParts(uint64, int32, common.Hash, consensus.PartSetHeader) ([]byte, error) {
+	return proposerSig, nil
+}
+
+func (testPartsConsensus) VerifyProposalParts(height uint64, round int32, blockID common.Hash, parts consensus.PartSetHeader, sig []byte) error {
+	if !bytes.Equal(sig, proposerSig) {
+		return consensus.ErrInvalidProposalParts
+	}
+	return nil
+}
+
+func testProposalParts(height uint64, root byte, sig []byte) (partsKey, *ProposalParts) {
+	pp := &ProposalParts{Height: height, Parts: consensus.PartSetHeader{Total: 2, Root: common.Hash{root}}, Signature: sig}
+	return partsKey{height: pp.Height, round: pp.Round, root: pp.Parts.Root}, pp
+}
+
+func TestProposalPartsJunkRoots(t *testing.T) {
+	server := &Server{parts: newPartStore(), partsConsensus: testPartsConsensus{}}
+	from := peer.ID("peer")
+
+	// more roots than a round keeps, not signed by the proposer
+	for i := 0; i < 2*maxPartSetsPerRound; i++ {
+		key, pp := testProposalParts(10, byte(i+1), []byte("junk"))
+		e, err := server.acceptProposalParts(key, pp, from)
+		assert.True(t, errors.Is(err, consensus.ErrInvalidProposalParts))
+		assert.Nil(t, e)
+	}
+
+	key, pp := testProposalParts(10, 0xff, proposerSig)
+	e, err := server.acceptProposalParts(key, pp, from)
+	require.NoError(t, err)
+	assert.NotNil(t, e)
+	// known, only the source is added
+	e, err = server.acceptProposalParts(key, pp, peer.ID("other"))
+	require.NoError(t, err)
+	assert.Nil(t, e)
+	assert.Len(t, server.parts.sources(key), 2)
+}
+
+func TestProposalPartsHeightBound(t *testing.T) {
+	server := &Server{parts: newPartStore(), partsConsensus: testPartsConsensus{}}
+	from := peer.ID("peer")
+
+	ours, err := consensus.NewPartSetFromData(make([]byte, 100), 64)
+	require.NoError(t, err)
+	oursKey := partsKey{height: 10, root: ours.Header().Root}
+	server.parts.add(oursKey, ours)
+
+	// would prune every part set we hold
+	for _, height := range []uint64{9, 12, 1 << 40} {
+		key, pp := testProposalParts(height, 1, proposerSig)
+		_, err := server.acceptProposalParts(key, pp, from)
+		assert.True(t, errors.Is(err, ErrInvalidBlockParts), "height %d", height)
+	}
+	assert.NotNil(t, server.parts.get(oursKey))
+
+	key, pp := testProposalParts(11, 1, proposerSig)
+	e, err := server.acceptProposalParts(key, pp, from)
+	require.NoError(t, err)
+	assert.NotNil(t, e)
+	assert.NotNil(t, server.parts.get(oursKey))
+}
+
+func TestProposalPartsResume(t *testing.T) {
+	server := &Server{parts: newPartStore(), partsConsensus: testPartsConsensus{}}
+	from := peer.ID("peer")
+
+	data := make([]byte, 300)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	full, err := consensus.NewPartSetFromData(data, 64)
+	require.NoError(t, err)
+
+	pp := &ProposalParts{Height: 10, Parts: full.Header(), Signature: proposerSig}
+	key := partsKey{height: pp.Height, round: pp.Round, root: pp.Parts.Root}
+	e, err := server.acceptProposalParts(key, pp, from)
+	require.NoError(t, err)
+	require.NotNil(t, e)
+	// the round ends with some of the parts
+	for _, i := range []uint32{0, 2, 3} {
+		_, err := e.set.AddPart(full.GetPart(i))
+		require.NoError(t, err)
+	}
+
+	// a later round proposes the block again
+	pp1 := &ProposalParts{Height: 10, Round: 1, Parts: full.Header(), Signature: proposerSig}
+	key1 := partsKey{height: pp1.Height, round: pp1.Round, root: pp1.Parts.Root}
+	e1, err := server.acceptProposalParts(key1, pp1, peer.ID("other"))
+	require.NoError(t, err)
+	require.NotNil(t, e1)
+	assert.Same(t, e.set, e1.set)
+	assert.Equal(t, []uint32{1, 4}, e1.set.Missing())
+	assert.Len(t, server.parts.sources(key1), 2)
+
+	// another block
+	other, err := consensus.NewPartSetFromData(data[1:], 64)
+	require.NoError(t, err)
+	pp2 := &ProposalParts{Height: 10, Round: 2, Parts: other.Header(), Signature: proposerSig}
+	e2, err := server.acceptProposalParts(partsKey{height: 10, round: 2, root: pp2.Parts.Root}, pp2, from)
+	require.NoError(t, err)
+	assert.Equal(t, 0, consensus.CountBits(e2.set.BitArray()))
+}
+
+func TestBlockPartsData(t *testing.T) {
+	cm := consensus.NewCommit(5, 6, common.Hash{}, []consensus.CommitSig{{
+		BlockIDFlag: consensus.BlockIDFlagCommit,
+		TimestampMs: 1133423,
+		Signature:   []byte{},
+	}})
+	block := &consensus.FullBlock{Block: types.NewBlock(
+		&consensus.Header{
+			Number:         big.NewInt(6),
+			TimeMs:         34534,
+			Difficulty:     big.NewInt(2),
+			Extra:          []byte{},
+			BaseFee:        big.NewInt(7),
+			NextValidators: []common.Address{},
+		},
+		[]*types.Transaction{},
+		[]*types.Header{},
+		[]*types.Receipt{},
+		trie.NewStackTrie(nil),
+	),
+		LastCommit: cm,
+	}
+
+	// the proposals of the block in every round share the parts
+	data, err := blockPartsData(6, block)
+	require.NoError(t, err)
+	p := &consensus.Proposal{Height: 6, Round: 3, POLRound: 1, TimestampMs: 34535, Signature: []byte{'1'}, Block: block}
+	pp := newProposalParts(p, consensus.PartSetHeader{Total: 1})
+	pp.Signature = proposerSig
+	require.NoError(t, pp.ValidateBasic())
+
+	decoded, err := decodeBlockParts(data)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(6), decoded.Height)
+	np := pp.proposal(decoded.Block)
+	assert.Equal(t, block.Hash(), np.Block.Hash())
+	assert.Equal(t, p.Round, np.Round)
+	assert.Equal(t, p.POLRound, np.POLRound)
+	assert.Equal(t, p.TimestampMs, np.TimestampMs)
+	assert.Equal(t, p.Signature, np.Signature)
+
+	p.POLRound = -1
+	assert.Equal(t, int32(-1), newProposalParts(p, pp.Parts).proposal(block).POLRound)
+}
@@ -2,6 +2,8 @@ package p2p
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"sync"
 
 	"github.com/QuarkChain/go-minimal-pbft/consensus"
@@ -10,6 +12,10 @@ import (
 	"github.com/libp2p/go-libp2p-core/peer"
 )
 
+// ErrBadBlock is returned when a peer serves a block that fails verification,
+// e.g., its hash is not committed by the LastCommit of the following block.
+var ErrBadBlock = errors.New("peer sent block failing verification")
+
 type BlockSync struct {
 	h          host.Host
 	wg         sync.WaitGroup
@@ -18,10 +24,36 @@ type BlockSync struct {
 	chainState consensus.ChainState
 	err        error
 	obsvC      chan consensus.MsgInfo
+	evpool     *consensus.EvidencePool
+	// last height synced, 0 for the latest
+	maxHeight uint64
+
+	// peers that served invalid blocks, never asked again during this sync
+	evicted map[peer.ID]error
 }
 
 func NewBlockSync(h host.Host, chainState consensus.ChainState, blockStore consensus.BlockStore, executor consensus.BlockExecutor, obsvC chan consensus.MsgInfo) *BlockSync {
-	return &BlockSync{h: h, executor: executor, blockStore: blockStore, chainState: chainState, obsvC: obsvC}
+	return &BlockSync{
+		h:          h,
+		executor:   executor,
+		blockStore: blockStore,
+		chainState: chainState,
+		obsvC:      obsvC,
+		evicted:    make(map[peer.ID]error),
+	}
+}
+
+// SetEvidencePool marks the evidence of the synced blocks as committed in
+// pool. It must be called before Start.
+func (bs *BlockSync) SetEvidencePool(pool *consensus.EvidencePool) {
+	bs.evpool = pool
+}
+
+// SetMaxHeight stops the sync at height, e.g., the halt height of an
+// upgrade, above which the peers may run a newer protocol. It must be called
+// before Start.
+func (bs *BlockSync) SetMaxHeight(height uint64) {
+	bs.maxHeight = height
 }
 
 func (bs *BlockSync) Start(ctx context.Context) {
@@ -35,32 +67,54 @@ func (bs *BlockSync) runRoutine(ctx context.Context) {
 	bs.wg.Done()
 }
 
-func (bs *BlockSync) sync(ctx context.Context) error {
-	ps := bs.h.Network().Peers()
-
+// findBestPeer asks all connected (and not evicted) peers for their last height
+// and returns the one with the highest. Peers that pruned the block at from
+// are skipped, the blocks are synced from there.
+func (bs *BlockSync) findBestPeer(ctx context.Context, from uint64) (peer.ID, uint64) {
 	var maxPeer peer.ID
 	var maxHeight uint64
+	pruned := 0
 
-	for {
-		for _, p := range ps {
-			req := &HelloRequest{}
-			resp := &HelloResponse{}
-			err := SendRPC(context.Background(), bs.h, p, TopicHello, req, resp)
-			if err != nil {
-				continue
-			}
+	for _, p := range PickRandom(bs.h.Network().Peers(), -1) {
+		if _, ok := bs.evicted[p]; ok {
+			continue
+		}
 
-			log.Info("Find peer", "peer", p, "last_height", resp.LastHeight)
-			if resp.LastHeight > maxHeight {
-				maxHeight = resp.LastHeight
-				maxPeer = p
-			} else if maxHeight == 0 {
-				// random pick up one to sync latest message
-				maxPeer = p
-			}
+		req := &HelloRequest{}
+		resp := &HelloResponse{}
+		err := SendRPC(ctx, bs.h, p, TopicHello, req, resp)
+		if err != nil {
+			continue
 		}
 
+		log.Info("Find peer", "peer", p, "last_height", resp.LastHeight, "base", resp.Base)
+		if resp.LastHeight >= from && !resp.retains(from) {
+			log.Debug("Skipping peer that pruned the blocks to sync", "peer", p, "from", from, "base", resp.Base)
+			pruned++
+			continue
+		}
+		if resp.LastHeight > maxHeight {
+			maxHeight = resp.LastHeight
+			maxPeer = p
+		} else if maxHeight == 0 {
+			// random pick up one to sync latest message
+			maxPeer = p
+		}
+	}
+	if maxHeight < from && pruned > 0 {
+		log.Warn("No peer retains the blocks to sync", "from", from, "pruned_peers", pruned)
+	}
+	return maxPeer, maxHeight
+}
+
+func (bs *BlockSync) sync(ctx context.Context) error {
+	for {
 		localLastHeight := bs.blockStore.Height()
+		maxPeer, maxHeight := bs.findBestPeer(ctx, localLastHeight+1)
+
+		if bs.maxHeight > 0 && maxHeight > bs.maxHeight {
+			maxHeight = bs.maxHeight
+		}
 
 		if maxHeight < localLastHeight {
 			// TODO: may return error
@@ -69,40 +123,103 @@ func (bs *BlockSync) sync(ctx context.Context) error {
 			break
 		}
 
-		log.Info("Sycning block", "from", localLastHeight, "to", maxHeight)
+		log.Info("Sycning block", "from", localLastHeight, "to", maxHeight, "peer", maxPeer)
 
-		for height := localLastHeight + 1; height <= maxHeight; height++ {
-			req := &GetFullBlockRequest{Height: height}
-			var vb consensus.FullBlock
-			if err := SendRPC(ctx, bs.h, maxPeer, TopicFullBlock, req, &vb); err != nil {
+		if err := bs.syncRange(ctx, maxPeer, localLastHeight+1, maxHeight); err != nil {
+			if !errors.Is(err, ErrBadBlock) {
 				return err
 			}
 
-			if err := bs.executor.ValidateBlock(bs.chainState, &vb); err != nil {
-				return err
-			}
+			// restart from the last persisted block with the remaining peers
+			bs.evictPeer(ctx, maxPeer, err)
+			continue
+		}
+		log.Info("Sycned block", "from", localLastHeight, "to", maxHeight)
 
-			if err := bs.chainState.Validators.VerifyCommit(
-				bs.chainState.ChainID, vb.Hash(), vb.NumberU64(), vb.Header().Commit); err != nil {
-				return err
-			}
+	}
+	log.Info("Finished syncing")
+
+	return nil
+}
+
+// syncRange downloads blocks [from, to] from the peer.
+//
+// Block N is only validated, applied, and persisted after block N+1 has
+// arrived and its LastCommit commits to the hash of N, so at most two blocks
+// are buffered at any time. The last block of the range has no successor yet
+// and is verified against the seen commit attached by the peer instead.
+func (bs *BlockSync) syncRange(ctx context.Context, p peer.ID, from, to uint64) error {
+	var pending *consensus.FullBlock
+
+	for height := from; height <= to; height++ {
+		next, err := bs.requestBlock(ctx, p, height)
+		if err != nil {
+			return err
+		}
 
-			newChainState, err := bs.executor.ApplyBlock(ctx, bs.chainState, &vb)
-			if err != nil {
+		if pending != nil {
+			if err := bs.verifyAndApply(ctx, pending, next.LastCommit); err != nil {
 				return err
 			}
-
-			bs.blockStore.SaveBlock(&vb, vb.Header().Commit)
-			bs.chainState = newChainState
 		}
-		log.Info("Sycned block", "from", localLastHeight, "to", maxHeight)
+		pending = next
+	}
 
+	return bs.verifyAndApply(ctx, pending, pending.Header().Commit)
+}
+
+func (bs *BlockSync) requestBlock(ctx context.Context, p peer.ID, height uint64) (*consensus.FullBlock, error) {
+	req := &GetFullBlockRequest{Height: height}
+	vb := &consensus.FullBlock{}
+	if err := SendRPC(ctx, bs.h, p, TopicFullBlock, req, vb); err != nil {
+		return nil, err
+	}
+
+	if vb.Block == nil || vb.NumberU64() != height {
+		return nil, fmt.Errorf("%w: requested height %d", ErrBadBlock, height)
+	}
+	return vb, nil
+}
+
+// verifyAndApply checks that the block is valid on top of the current chain
+// state and is committed by +2/3 of the current validators, then applies and
+// persists it with the commit as its canonical commit.
+func (bs *BlockSync) verifyAndApply(ctx context.Context, block *consensus.FullBlock, commit *consensus.Commit) error {
+	if err := bs.executor.ValidateBlock(bs.chainState, block); err != nil {
+		return fmt.Errorf("%w: height %d: %v", ErrBadBlock, block.NumberU64(), err)
+	}
+
+	if commit == nil {
+		return fmt.Errorf("%w: height %d: missing commit", ErrBadBlock, block.NumberU64())
+	}
+
+	if err := consensus.VerifyCommitByKeyType(
+		bs.chainState.ChainID, bs.chainState.Validators, block.Hash(), block.NumberU64(), commit); err != nil {
+		return fmt.Errorf("%w: height %d: %v", ErrBadBlock, block.NumberU64(), err)
+	}
+
+	newChainState, err := bs.executor.ApplyBlock(ctx, bs.chainState, block)
+	if err != nil {
+		return err
 	}
-	log.Info("Finished syncing")
 
+	bs.blockStore.SaveBlock(block, commit)
+	bs.chainState = newChainState
+	if bs.evpool != nil {
+		bs.evpool.MarkCommittedBlock(bs.executor, block)
+	}
 	return nil
 }
 
+// evictPeer disconnects a peer that served an invalid block and excludes it
+// from the rest of the sync.
+func (bs *BlockSync) evictPeer(ctx context.Context, p peer.ID, reason error) {
+	log.Warn("Evicting block sync peer", "peer", p, "reason", reason)
+
+	bs.evicted[p] = reason
+	Disconnect(ctx, bs.h, p, DisconnectBadMessage)
+}
+
 func (bs *BlockSync) LastChainState() consensus.ChainState {
 	return bs.chainState
 }
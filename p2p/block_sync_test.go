@@ -0,0 +1,276 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const syncTestChainID = "sync"
+
+// syncTestExecutor accepts the blocks extending the state without executing
+// them, the commits are what the sync verifies.
+type syncTestExecutor struct{}
+
+func (syncTestExecutor) ValidateBlock(state consensus.ChainState, block *consensus.FullBlock) error {
+	if block.NumberU64() != state.LastBlockHeight+1 || block.ParentHash() != state.LastBlockID {
+		return errors.New("block not extending the state")
+	}
+	return nil
+}
+
+func (syncTestExecutor) ApplyBlock(ctx context.Context, state consensus.ChainState, block *consensus.FullBlock) (consensus.ChainState, error) {
+	state.LastBlockHeight = block.NumberU64()
+	state.LastBlockID = block.Hash()
+	return state, nil
+}
+
+func (syncTestExecutor) MakeBlock(*consensus.ChainState, uint64, *consensus.Commit, common.Address) *consensus.FullBlock {
+	panic("not proposing")
+}
+
+// syncTestStore keeps the synced blocks in memory.
+type syncTestStore struct {
+	blocks  []*consensus.FullBlock
+	commits []*consensus.Commit
+}
+
+func (bs *syncTestStore) Base() uint64   { return 1 }
+func (bs *syncTestStore) Height() uint64 { return uint64(len(bs.blocks)) }
+func (bs *syncTestStore) Size() uint64   { return bs.Height() }
+
+func (bs *syncTestStore) LoadBlock(height uint64) *consensus.FullBlock {
+	if height == 0 || height > bs.Height() {
+		return nil
+	}
+	return bs.blocks[height-1]
+}
+
+func (bs *syncTestStore) LoadBlockCommit(height uint64) *consensus.Commit {
+	if height == 0 || height > bs.Height() {
+		return nil
+	}
+	return bs.commits[height-1]
+}
+
+func (bs *syncTestStore) LoadSeenCommit() *consensus.Commit { return nil }
+
+func (bs *syncTestStore) Iterate(from, to uint64, reverse bool, fn func(*consensus.BlockMeta) bool) error {
+	return nil
+}
+
+func (bs *syncTestStore) SaveBlock(block *consensus.FullBlock, commit *consensus.Commit) {
+	bs.blocks = append(bs.blocks, block)
+	bs.commits = append(bs.commits, commit)
+}
+
+// syncTestChain is a chain of a single validator.
+type syncTestChain struct {
+	genesis consensus.ChainState
+	pv      consensus.PrivValidator
+	addr    common.Address
+	blocks  []*consensus.FullBlock
+	// commits[i] commits blocks[i]
+	commits []*consensus.Commit
+}
+
+func makeSyncTestBlock(parent common.Hash, height uint64, lastCommit *consensus.Commit, timeMs uint64) *consensus.FullBlock {
+	return &consensus.FullBlock{
+		Block: types.NewBlock(
+			&consensus.Header{
+				ParentHash:     parent,
+				Number:         new(big.Int).SetUint64(height),
+				TimeMs:         timeMs,
+				LastCommitHash: lastCommit.Hash(),
+				Difficulty:     big.NewInt(1),
+				Extra:          []byte{},
+				BaseFee:        big.NewInt(0),
+				NextValidators: []common.Address{},
+			},
+			[]*types.Transaction{},
+			[]*types.Header{},
+			[]*types.Receipt{},
+			trie.NewStackTrie(nil),
+		),
+		LastCommit: lastCommit,
+	}
+}
+
+func newSyncTestChain(t *testing.T, n int) *syncTestChain {
+	pv := consensus.GeneratePrivValidatorLocal()
+	pubKey, err := pv.GetPubKey(context.Background())
+	require.NoError(t, err)
+	chain := &syncTestChain{
+		genesis: *consensus.MakeGenesisChainState(syncTestChainID, 1000, []common.Address{pubKey.Address()}, []int64{1}, 128, 1),
+		pv:      pv,
+		addr:    pubKey.Address(),
+	}
+
+	parent, lastCommit := common.Hash{}, consensus.NewCommit(0, 0, common.Hash{}, nil)
+	for height := uint64(1); height <= uint64(n); height++ {
+		block := makeSyncTestBlock(parent, height, lastCommit, 1000*height)
+		chain.blocks = append(chain.blocks, block)
+		chain.commits = append(chain.commits, chain.sign(t, block))
+		parent, lastCommit = block.Hash(), chain.commits[height-1]
+	}
+	return chain
+}
+
+// sign returns the commit of the validator for block.
+func (chain *syncTestChain) sign(t *testing.T, block *consensus.FullBlock) *consensus.Commit {
+	vs := consensus.NewVoteSet(syncTestChainID, block.NumberU64(), 0, consensus.PrecommitType, chain.genesis.Validators)
+	vote := &consensus.Vote{
+		ValidatorAddress: chain.addr,
+		ValidatorIndex:   0,
+		Height:           block.NumberU64(),
+		Round:            0,
+		TimestampMs:      block.Header().TimeMs + 1,
+		Type:             consensus.PrecommitType,
+		BlockID:          block.Hash(),
+	}
+	require.NoError(t, chain.pv.SignVote(context.Background(), syncTestChainID, vote))
+	_, err := vs.AddVote(vote)
+	require.NoError(t, err)
+	return vs.MakeCommit()
+}
+
+// syncTestPeer serves the blocks of a store as the server does, and records
+// the heights requested.
+type syncTestPeer struct {
+	store *syncTestStore
+
+	mtx       sync.Mutex
+	requested []uint64
+}
+
+// serveSyncTestPeer serves the first n blocks of chain on h, with the block at
+// forged, if any, replaced by a block of the same height that the validator
+// did not commit.
+func serveSyncTestPeer(h host.Host, chain *syncTestChain, n int, forged uint64) *syncTestPeer {
+	p := &syncTestPeer{store: &syncTestStore{}}
+	for i := 0; i < n; i++ {
+		block := chain.blocks[i]
+		if block.NumberU64() == forged {
+			block = makeSyncTestBlock(block.ParentHash(), forged, block.LastCommit, block.Header().TimeMs+1)
+		}
+		p.store.SaveBlock(block, chain.commits[i])
+	}
+
+	SetChannelHandler(h, TopicHello, func(stream network.Stream) {
+		defer stream.Close()
+		if _, err := ReadMsgWithPrependedSize(stream); err != nil {
+			return
+		}
+		resp, _ := rlp.EncodeToBytes(&HelloResponse{LastHeight: p.store.Height(), Base: p.store.Base()})
+		WriteMsgWithPrependedSize(stream, resp)
+	})
+	SetChannelHandler(h, TopicFullBlock, func(stream network.Stream) {
+		defer stream.Close()
+		data, err := ReadMsgWithPrependedSize(stream)
+		if err != nil {
+			return
+		}
+		var msg GetFullBlockRequest
+		if err := rlp.DecodeBytes(data, &msg); err != nil {
+			return
+		}
+		p.mtx.Lock()
+		p.requested = append(p.requested, msg.Height)
+		p.mtx.Unlock()
+
+		vb := p.store.LoadBlock(msg.Height)
+		if vb == nil {
+			return
+		}
+		resp, err := vb.WithCommit(p.store.LoadBlockCommit(msg.Height)).EncodeToRLPBytes()
+		if err != nil {
+			return
+		}
+		WriteMsgWithPrependedSize(stream, resp)
+	})
+	return p
+}
+
+func (p *syncTestPeer) requestedHeights() []uint64 {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return append([]uint64(nil), p.requested...)
+}
+
+// newSyncTestNet returns n connected hosts, the first one syncing.
+func newSyncTestNet(t *testing.T, n int) []host.Host {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	mn := mocknet.New(ctx)
+	for i := 0; i < n; i++ {
+		_, err := mn.GenPeer()
+		require.NoError(t, err)
+	}
+	require.NoError(t, mn.LinkAll())
+	require.NoError(t, mn.ConnectAllButSelf())
+	return mn.Hosts()
+}
+
+func runSyncTest(t *testing.T, h host.Host, chain *syncTestChain) (*BlockSync, *syncTestStore) {
+	store := &syncTestStore{}
+	bs := NewBlockSync(h, chain.genesis, store, syncTestExecutor{}, nil)
+	bs.Start(context.Background())
+	require.NoError(t, bs.WaitDone())
+	return bs, store
+}
+
+func TestBlockSyncEvictPeer(t *testing.T) {
+	chain := newSyncTestChain(t, 5)
+	hosts := newSyncTestNet(t, 2)
+	bad := hosts[1]
+	serveSyncTestPeer(bad, chain, 5, 3)
+
+	bs, store := runSyncTest(t, hosts[0], chain)
+
+	// the blocks before the forged one are kept
+	assert.Equal(t, uint64(2), store.Height())
+	assert.Equal(t, chain.blocks[1].Hash(), bs.LastChainState().LastBlockID)
+
+	require.Contains(t, bs.evicted, bad.ID())
+	assert.ErrorIs(t, bs.evicted[bad.ID()], ErrBadBlock)
+	assert.NotEqual(t, network.Connected, hosts[0].Network().Connectedness(bad.ID()))
+	record, ok := lastDisconnect(bad)
+	require.True(t, ok)
+	assert.Equal(t, DisconnectBadMessage, record.Reason)
+}
+
+func TestBlockSyncRestart(t *testing.T) {
+	chain := newSyncTestChain(t, 8)
+	hosts := newSyncTestNet(t, 3)
+	// the highest peer is synced from first
+	bad, good := hosts[1], hosts[2]
+	serveSyncTestPeer(bad, chain, 8, 3)
+	honest := serveSyncTestPeer(good, chain, 6, 0)
+
+	bs, store := runSyncTest(t, hosts[0], chain)
+
+	require.Equal(t, uint64(6), store.Height())
+	for i, block := range store.blocks {
+		assert.Equal(t, chain.blocks[i].Hash(), block.Hash())
+	}
+	assert.Equal(t, chain.commits[5].Hash(), store.commits[5].Hash())
+	assert.Equal(t, chain.blocks[5].Hash(), bs.LastChainState().LastBlockID)
+	assert.Contains(t, bs.evicted, bad.ID())
+
+	// restarted from the last persisted block, not from the first one
+	assert.Equal(t, []uint64{3, 4, 5, 6}, honest.requestedHeights())
+}
@@ -0,0 +1,185 @@
+package p2p
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// Peers report their height with every consensus sync request. A peer asking
+// for a height we already committed is lagging, e.g., it missed the
+// precommits of the height: instead of waiting for it to ask again, or for
+// block sync, it is pushed the stored block with the commit we saw for it,
+// which it commits right away (see consensus.ProcessCommittedBlock).
+
+// TopicCatchUp pushes committed blocks, with their commit, to lagging peers.
+const TopicCatchUp = "/mpbft/dev/catch_up/1.0.0"
+
+var (
+	catchUpInterval = time.Second
+	// a peer still reporting a height pushed to it is pushed it again after
+	catchUpResendInterval = 5 * time.Second
+)
+
+func init() {
+	if err := RegisterChannel(ChannelDescriptor{
+		ID:             TopicCatchUp,
+		Priority:       ChannelPriorityNormal,
+		QueueCapacity:  16,
+		MaxMessageSize: 32 * 1024 * 1024,
+		Optional:       true,
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// CatchUpMessage carries the RLP encoded full block, with its commit.
+type CatchUpMessage struct {
+	Block []byte
+}
+
+type catchUpPeer struct {
+	height uint64 // reported
+	pushed uint64
+	at     time.Time
+}
+
+// catchUpTracker keeps the heights reported by the peers.
+type catchUpTracker struct {
+	mu    sync.Mutex
+	peers map[peer.ID]*catchUpPeer
+}
+
+func newCatchUpTracker() *catchUpTracker {
+	return &catchUpTracker{peers: make(map[peer.ID]*catchUpPeer)}
+}
+
+func (t *catchUpTracker) reportHeight(p peer.ID, height uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cp, ok := t.peers[p]
+	if !ok {
+		cp = &catchUpPeer{}
+		t.peers[p] = cp
+	}
+	cp.height = height
+}
+
+// markPushed records that a peer was sent the block of height, e.g., in
+// answer to its consensus sync request.
+func (t *catchUpTracker) markPushed(p peer.ID, height uint64, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if cp, ok := t.peers[p]; ok {
+		cp.pushed, cp.at = height, now
+	}
+}
+
+// lagging returns the peers to push a block to, with its height: those at a
+// height up to latest, which were not pushed it recently. Disconnected peers
+// are forgotten.
+func (t *catchUpTracker) lagging(latest uint64, connected func(peer.ID) bool, now time.Time) map[peer.ID]uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	result := make(map[peer.ID]uint64)
+	for p, cp := range t.peers {
+		if !connected(p) {
+			delete(t.peers, p)
+			continue
+		}
+		if cp.height == 0 || cp.height > latest {
+			continue
+		}
+		if cp.pushed == cp.height && now.Sub(cp.at) < catchUpResendInterval {
+			continue
+		}
+		cp.pushed, cp.at = cp.height, now
+		result[p] = cp.height
+	}
+	return result
+}
+
+func (server *Server) catchUpRoutine(ctx context.Context) {
+	ticker := time.NewTicker(catchUpInterval)
+	defer ticker.Stop()
+
+	connected := func(p peer.ID) bool {
+		return server.Host.Network().Connectedness(p) == network.Connected
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for p, height := range server.catchUp.lagging(server.blockStore.Height(), connected, time.Now()) {
+			if PeerSupports(server.Host, p, TopicCatchUp) {
+				go server.pushBlock(ctx, p, height)
+			}
+		}
+	}
+}
+
+// pushBlock sends the block of a height and its commit to a peer.
+func (server *Server) pushBlock(ctx context.Context, p peer.ID, height uint64) {
+	if server.dropSuspended(MessageCatchUp, "sent") {
+		return
+	}
+
+	block := server.blockStore.LoadBlock(height)
+	commit := server.consensusState.LoadCommit(height)
+	if block == nil || commit == nil {
+		return
+	}
+	data, err := block.WithCommit(commit).EncodeToRLPBytes()
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, catchUpResendInterval)
+	defer cancel()
+	s, err := Send(ctx, server.Host, p, TopicCatchUp, &CatchUpMessage{Block: data})
+	if err != nil {
+		log.Debug("Failed to push block to lagging peer", "peer", p, "height", height, "err", err)
+		return
+	}
+	s.Close()
+	log.Debug("Pushed block to lagging peer", "peer", p, "height", height)
+	p2pMessagesSent.Inc()
+}
+
+func (server *Server) handleCatchUp(stream network.Stream) {
+	defer stream.Close()
+
+	p := stream.Conn().RemotePeer()
+	if !server.isAuthorized(p) || server.dropSuspended(MessageCatchUp, "received") {
+		return
+	}
+
+	data, err := ReadMsgWithPrependedSize(stream)
+	if err != nil {
+		return
+	}
+	var msg CatchUpMessage
+	if err := rlp.DecodeBytes(data, &msg); err != nil {
+		return
+	}
+	block := &consensus.FullBlock{}
+	if err := block.DecodeFromRLPBytes(msg.Block); err != nil {
+		p2pMessagesReceived.WithLabelValues("invalid").Inc()
+		log.Debug("received invalid catch-up block", "peer", p, "err", err)
+		return
+	}
+
+	// verified by the consensus state, ignored unless for its height
+	p2pMessagesReceived.WithLabelValues("catch_up").Inc()
+	server.consensusState.ProcessCommittedBlock(block)
+}
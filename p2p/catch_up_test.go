@@ -0,0 +1,35 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCatchUpTrackerLagging(t *testing.T) {
+	tracker := newCatchUpTracker()
+	connected := func(peer.ID) bool { return true }
+	now := time.Now()
+
+	tracker.reportHeight("a", 5)
+	tracker.reportHeight("b", 8)
+	tracker.reportHeight("c", 6)
+	tracker.markPushed("c", 6, now)
+
+	// b is not lagging, c was just pushed its block
+	assert.Equal(t, map[peer.ID]uint64{"a": 5}, tracker.lagging(7, connected, now))
+	// pushed once, until resent
+	assert.Empty(t, tracker.lagging(7, connected, now.Add(time.Second)))
+	assert.Equal(t, map[peer.ID]uint64{"a": 5, "c": 6},
+		tracker.lagging(7, connected, now.Add(catchUpResendInterval)))
+
+	// a moved on
+	tracker.reportHeight("a", 6)
+	assert.Equal(t, map[peer.ID]uint64{"a": 6}, tracker.lagging(7, connected, now.Add(catchUpResendInterval)))
+
+	// disconnected peers are forgotten
+	assert.Empty(t, tracker.lagging(7, func(peer.ID) bool { return false }, now.Add(time.Hour)))
+	assert.Empty(t, tracker.peers)
+}
@@ -0,0 +1,202 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/QuarkChain/go-minimal-pbft/internal/testhook"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+var (
+	ErrChannelRegistered   = errors.New("channel already registered")
+	ErrUnknownChannel      = errors.New("unknown channel")
+	ErrMessageTooLarge     = errors.New("message too large")
+	ErrChannelNotSupported = errors.New("channel not supported by peer")
+	ErrSlowPeer            = errors.New("message read too slowly")
+)
+
+const (
+	ChannelPriorityLow    = 0
+	ChannelPriorityNormal = 5
+	ChannelPriorityHigh   = 10
+)
+
+// how long a stream of a high priority channel waits for a free slot before
+// it is dropped, lower priority streams are dropped right away
+var channelQueueWait = 500 * time.Millisecond
+
+// ChannelDescriptor describes a stream protocol served by the node. Its ID is
+// the libp2p protocol ID, which the peers announce to each other in the
+// identify handshake, so the channels both sides support are known as soon as
+// a connection is up.
+type ChannelDescriptor struct {
+	ID             string
+	Priority       int
+	QueueCapacity  int // max number of streams served at the same time
+	MaxMessageSize int
+	// Optional channels are only used with peers that support them (e.g.
+	// evidence, statesync or app channels); a peer lacking a required one
+	// runs incompatible software.
+	Optional bool
+}
+
+type channel struct {
+	desc  ChannelDescriptor
+	slots chan struct{}
+}
+
+var (
+	channelsMu sync.RWMutex
+	channels   = make(map[string]*channel)
+)
+
+func init() {
+	for _, desc := range []ChannelDescriptor{
+		{ID: TopicHello, Priority: ChannelPriorityNormal, QueueCapacity: 32, MaxMessageSize: 1024},
+		{ID: TopicDisconnect, Priority: ChannelPriorityLow, QueueCapacity: 32, MaxMessageSize: 1024},
+		{ID: TopicFullBlock, Priority: ChannelPriorityNormal, QueueCapacity: 16, MaxMessageSize: 32 * 1024 * 1024},
+		{ID: TopicConsensusSync, Priority: ChannelPriorityHigh, QueueCapacity: 64, MaxMessageSize: 32 * 1024 * 1024},
+	} {
+		if err := RegisterChannel(desc); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// RegisterChannel adds a channel to the registry. Channels must be registered
+// before their handler is set, typically in init.
+func RegisterChannel(desc ChannelDescriptor) error {
+	if desc.ID == "" || desc.QueueCapacity <= 0 || desc.MaxMessageSize <= 0 {
+		return fmt.Errorf("invalid channel descriptor %+v", desc)
+	}
+
+	channelsMu.Lock()
+	defer channelsMu.Unlock()
+
+	if _, ok := channels[desc.ID]; ok {
+		return fmt.Errorf("%w: %s", ErrChannelRegistered, desc.ID)
+	}
+	channels[desc.ID] = &channel{desc: desc, slots: make(chan struct{}, desc.QueueCapacity)}
+	return nil
+}
+
+func lookupChannel(id string) (*channel, bool) {
+	channelsMu.RLock()
+	defer channelsMu.RUnlock()
+
+	ch, ok := channels[id]
+	return ch, ok
+}
+
+// Channels returns the registered channels, highest priority first.
+func Channels() []ChannelDescriptor {
+	channelsMu.RLock()
+	descs := make([]ChannelDescriptor, 0, len(channels))
+	for _, ch := range channels {
+		descs = append(descs, ch.desc)
+	}
+	channelsMu.RUnlock()
+
+	sort.Slice(descs, func(i, j int) bool {
+		if descs[i].Priority != descs[j].Priority {
+			return descs[i].Priority > descs[j].Priority
+		}
+		return descs[i].ID < descs[j].ID
+	})
+	return descs
+}
+
+// channelStream caps the size of the messages read from a stream at the max
+// message size of its channel.
+type channelStream struct {
+	network.Stream
+	maxMessageSize int
+}
+
+func (cs *channelStream) MaxMessageSize() int {
+	return cs.maxMessageSize
+}
+
+// SetChannelHandler serves a registered channel. Streams beyond the queue
+// capacity of the channel are reset.
+func SetChannelHandler(h host.Host, id string, handler network.StreamHandler) {
+	ch, ok := lookupChannel(id)
+	if !ok {
+		panic(fmt.Sprintf("%v: %s", ErrUnknownChannel, id))
+	}
+
+	h.SetStreamHandler(protocol.ID(id), func(stream network.Stream) {
+		if !ch.acquire() {
+			log.Debug("channel queue full, dropping stream", "channel", id, "peer", stream.Conn().RemotePeer())
+			stream.Reset()
+			return
+		}
+		defer ch.release()
+
+		handler(&channelStream{Stream: stream, maxMessageSize: ch.desc.MaxMessageSize})
+	})
+}
+
+func (ch *channel) acquire() bool {
+	select {
+	case ch.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if ch.desc.Priority < ChannelPriorityHigh {
+		return false
+	}
+
+	timer := time.NewTimer(channelQueueWait)
+	defer timer.Stop()
+	select {
+	case ch.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (ch *channel) release() {
+	<-ch.slots
+}
+
+// PeerSupports tells whether the peer announced the channel in its handshake.
+func PeerSupports(h host.Host, p peer.ID, id string) bool {
+	supported, err := h.Peerstore().SupportsProtocols(p, id)
+	return err == nil && len(supported) != 0
+}
+
+// PeersSupporting returns the connected peers that support the channel.
+func PeersSupporting(h host.Host, id string) []peer.ID {
+	var ps []peer.ID
+	for _, p := range h.Network().Peers() {
+		if PeerSupports(h, p, id) {
+			ps = append(ps, p)
+		}
+	}
+	return ps
+}
+
+// PickRandom returns n of the peers in random order, all of them if n is
+// negative or above their number. The order only depends on the seed of
+// testhook, not on the order of ps.
+func PickRandom(ps []peer.ID, n int) []peer.ID {
+	picked := append([]peer.ID{}, ps...)
+	sort.Slice(picked, func(i, j int) bool { return picked[i] < picked[j] })
+	testhook.Shuffle(len(picked), func(i, j int) { picked[i], picked[j] = picked[j], picked[i] })
+
+	if n >= 0 && n < len(picked) {
+		picked = picked[:n]
+	}
+	return picked
+}
@@ -0,0 +1,159 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// registerTestChannel registers desc for the duration of the test.
+func registerTestChannel(t *testing.T, desc ChannelDescriptor) {
+	require.NoError(t, RegisterChannel(desc))
+	t.Cleanup(func() {
+		channelsMu.Lock()
+		delete(channels, desc.ID)
+		channelsMu.Unlock()
+	})
+}
+
+// newChannelTestNet returns two connected hosts.
+func newChannelTestNet(t *testing.T) (host.Host, host.Host) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	mn, err := mocknet.FullMeshConnected(ctx, 2)
+	require.NoError(t, err)
+	hosts := mn.Hosts()
+	return hosts[0], hosts[1]
+}
+
+func TestRegisterChannel(t *testing.T) {
+	low := ChannelDescriptor{ID: "/mpbft/test/low/1.0.0", Priority: ChannelPriorityLow, QueueCapacity: 1, MaxMessageSize: 16}
+	high := ChannelDescriptor{ID: "/mpbft/test/high/1.0.0", Priority: ChannelPriorityHigh, QueueCapacity: 1, MaxMessageSize: 16}
+	registerTestChannel(t, low)
+	registerTestChannel(t, high)
+
+	assert.ErrorIs(t, RegisterChannel(low), ErrChannelRegistered)
+	assert.Error(t, RegisterChannel(ChannelDescriptor{ID: "/mpbft/test/empty/1.0.0", MaxMessageSize: 16}))
+	assert.Error(t, RegisterChannel(ChannelDescriptor{ID: "/mpbft/test/empty/1.0.0", QueueCapacity: 1}))
+	_, ok := lookupChannel("/mpbft/test/empty/1.0.0")
+	assert.False(t, ok)
+	assert.Panics(t, func() { SetChannelHandler(nil, "/mpbft/test/unknown/1.0.0", nil) })
+
+	descs := Channels()
+	assert.Contains(t, descs, low)
+	assert.Contains(t, descs, high)
+	for i := 1; i < len(descs); i++ {
+		assert.GreaterOrEqual(t, descs[i-1].Priority, descs[i].Priority)
+	}
+}
+
+func TestChannelAcquire(t *testing.T) {
+	defer func(wait time.Duration) { channelQueueWait = wait }(channelQueueWait)
+	channelQueueWait = 100 * time.Millisecond
+
+	low := &channel{desc: ChannelDescriptor{Priority: ChannelPriorityNormal}, slots: make(chan struct{}, 1)}
+	require.True(t, low.acquire())
+	// dropped right away
+	start := time.Now()
+	assert.False(t, low.acquire())
+	assert.Less(t, time.Since(start), channelQueueWait)
+
+	high := &channel{desc: ChannelDescriptor{Priority: ChannelPriorityHigh}, slots: make(chan struct{}, 1)}
+	require.True(t, high.acquire())
+	// dropped after waiting for a slot
+	start = time.Now()
+	assert.False(t, high.acquire())
+	assert.GreaterOrEqual(t, time.Since(start), channelQueueWait)
+
+	// served once a slot frees up in time
+	time.AfterFunc(channelQueueWait/4, high.release)
+	assert.True(t, high.acquire())
+}
+
+func TestChannelQueueCapacity(t *testing.T) {
+	desc := ChannelDescriptor{ID: "/mpbft/test/queue/1.0.0", Priority: ChannelPriorityNormal, QueueCapacity: 2, MaxMessageSize: 16}
+	registerTestChannel(t, desc)
+	a, b := newChannelTestNet(t)
+
+	started := make(chan struct{})
+	done := make(chan struct{})
+	SetChannelHandler(b, desc.ID, func(stream network.Stream) {
+		defer stream.Close()
+		if _, err := ReadMsgWithPrependedSize(stream); err != nil {
+			return
+		}
+		started <- struct{}{}
+		<-done
+		WriteMsgWithPrependedSize(stream, []byte("ok"))
+	})
+
+	send := func() (network.Stream, error) {
+		return Send(context.Background(), a, b.ID(), desc.ID, []byte("hi"))
+	}
+	var served []network.Stream
+	for i := 0; i < desc.QueueCapacity; i++ {
+		s, err := send()
+		require.NoError(t, err)
+		served = append(served, s)
+		<-started
+	}
+
+	// the queue is full, the stream is reset
+	s, err := send()
+	if err == nil {
+		_, err = ReadMsgWithPrependedSize(s)
+	}
+	assert.Error(t, err)
+
+	close(done)
+	for _, s := range served {
+		data, err := ReadMsgWithPrependedSize(s)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("ok"), data)
+	}
+
+	// the slots are free again
+	ch, _ := lookupChannel(desc.ID)
+	assert.Eventually(t, func() bool { return len(ch.slots) == 0 }, 5*time.Second, 10*time.Millisecond)
+	s, err = send()
+	require.NoError(t, err)
+	<-started
+	data, err := ReadMsgWithPrependedSize(s)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("ok"), data)
+}
+
+func TestChannelMaxMessageSize(t *testing.T) {
+	desc := ChannelDescriptor{ID: "/mpbft/test/size/1.0.0", Priority: ChannelPriorityNormal, QueueCapacity: 1, MaxMessageSize: 16}
+	registerTestChannel(t, desc)
+	a, b := newChannelTestNet(t)
+
+	errC := make(chan error, 1)
+	SetChannelHandler(b, desc.ID, func(stream network.Stream) {
+		defer stream.Close()
+		data, err := ReadMsgWithPrependedSize(stream)
+		errC <- err
+		if err == nil {
+			// echo twice, above the limit of the sender too
+			WriteMsgWithPrependedSize(stream, append(data, data...))
+		}
+	})
+
+	// the rlp encoding of 10 bytes takes 11
+	s, err := Send(context.Background(), a, b.ID(), desc.ID, make([]byte, 10))
+	require.NoError(t, err)
+	assert.NoError(t, <-errC)
+	_, err = ReadMsgWithPrependedSize(s)
+	assert.ErrorIs(t, err, ErrMessageTooLarge)
+
+	// the stream may be closed before the message is sent
+	Send(context.Background(), a, b.ID(), desc.ID, make([]byte, 16))
+	assert.ErrorIs(t, <-errC, ErrMessageTooLarge)
+}
@@ -0,0 +1,117 @@
+package p2p
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+)
+
+// MsgCompressedProposal is a proposal whose encoding (mostly the tx payloads
+// of its block) is compressed. After the type byte come the codec, the size
+// of the decoded proposal as a 4-byte big-endian integer, and the compressed
+// proposal.
+const MsgCompressedProposal = 0x07
+
+const (
+	proposalCodecNone  = 0x00
+	proposalCodecFlate = 0x01
+)
+
+var ErrInvalidCompressedProposal = errors.New("invalid compressed proposal")
+
+var (
+	// CompressProposals enables sending compressed proposals. Every node
+	// decodes them, but older ones do not, so it is off by default.
+	CompressProposals = false
+
+	// proposals smaller than this are not worth compressing
+	minCompressProposalSize = 4 * 1024
+
+	// compress only if it saves at least 1/compressProposalMinSaving of
+	// the size, otherwise the receivers pay for decompression for nothing
+	compressProposalMinSaving = 8
+
+	// MaxDecompressedProposalSize bounds the memory a peer can make us
+	// allocate with a small compressed proposal.
+	MaxDecompressedProposalSize = 32 * 1024 * 1024
+)
+
+func init() {
+	decoder[MsgCompressedProposal] = decodeCompressedProposal
+}
+
+// encodeProposalMsg encodes a proposal for broadcast, compressing it when
+// enabled and worth it for this block.
+func encodeProposalMsg(p *consensus.Proposal) ([]byte, error) {
+	if !CompressProposals || len(p.Block.Transactions()) == 0 {
+		return encode(p)
+	}
+
+	raw, err := encodeProposal(p)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < minCompressProposalSize || len(raw) > MaxDecompressedProposalSize {
+		return append([]byte{MsgProposal}, raw...), nil
+	}
+
+	var buf bytes.Buffer
+	buf.Write([]byte{MsgCompressedProposal, proposalCodecFlate, 0, 0, 0, 0})
+	binary.BigEndian.PutUint32(buf.Bytes()[2:6], uint32(len(raw)))
+
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(raw); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	if buf.Len() > len(raw)-len(raw)/compressProposalMinSaving {
+		return append([]byte{MsgProposal}, raw...), nil
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeCompressedProposal(data []byte) (interface{}, error) {
+	if len(data) < 5 {
+		return nil, fmt.Errorf("%w: too short", ErrInvalidCompressedProposal)
+	}
+	codec := data[0]
+	size := binary.BigEndian.Uint32(data[1:5])
+	if uint64(size) > uint64(MaxDecompressedProposalSize) {
+		return nil, fmt.Errorf("%w: decoded size %d exceeds %d", ErrInvalidCompressedProposal, size, MaxDecompressedProposalSize)
+	}
+
+	var raw []byte
+	switch codec {
+	case proposalCodecNone:
+		raw = data[5:]
+	case proposalCodecFlate:
+		r := flate.NewReader(bytes.NewReader(data[5:]))
+		defer r.Close()
+
+		// one more byte than announced to detect a lying size
+		raw = make([]byte, 0, size)
+		buf := bytes.NewBuffer(raw)
+		if _, err := io.Copy(buf, io.LimitReader(r, int64(size)+1)); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidCompressedProposal, err)
+		}
+		raw = buf.Bytes()
+	default:
+		return nil, fmt.Errorf("%w: unknown codec %d", ErrInvalidCompressedProposal, codec)
+	}
+
+	if len(raw) != int(size) {
+		return nil, fmt.Errorf("%w: decoded %d bytes, expected %d", ErrInvalidCompressedProposal, len(raw), size)
+	}
+	return decodeProposal(raw)
+}
@@ -0,0 +1,142 @@
+package p2p
+
+import (
+	"sync"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// connGuard closes connections to ourselves and duplicate connections to the
+// same peer (e.g. when both sides dial each other at the same time), which
+// otherwise show up as ghost peers in small meshes.
+//
+// Both sides must keep the same connection, so the winner is chosen by ID
+// ordering: the connection dialed by the peer with the smaller ID is kept,
+// see duplicateConns.
+//
+// It also closes the connections to the denied peers, see SetDeniedPeers,
+// and the inbound ones exceeding the eclipse policy.
+type connGuard struct {
+	h       host.Host
+	eclipse *eclipsePolicy
+
+	mu     sync.RWMutex
+	denied map[peer.ID]bool
+}
+
+var _ network.Notifiee = (*connGuard)(nil)
+
+func (cg *connGuard) Connected(n network.Network, conn network.Conn) {
+	remote := conn.RemotePeer()
+
+	if remote == cg.h.ID() {
+		log.Warn("Closing connection to self", "addr", conn.RemoteMultiaddr())
+		recordDisconnect(string(remote), DisconnectSelf, false)
+		go conn.Close()
+		return
+	}
+
+	if cg.isDenied(remote) {
+		log.Debug("Closing connection to denied peer", "peer", remote)
+		recordDisconnect(string(remote), DisconnectDenied, false)
+		go conn.Close()
+		return
+	}
+
+	conns := n.ConnsToPeer(remote)
+	if len(conns) <= 1 {
+		if conn.Stat().Direction == network.DirInbound && !cg.eclipse.isTrusted(remote) {
+			inbound, outbound := peerDirections(n)
+			if rejectInbound(len(inbound), len(outbound), cg.eclipse.config().MinOutboundRatio) {
+				log.Debug("Closing inbound connection, too few outbound peers", "peer", remote,
+					"inbound", len(inbound), "outbound", len(outbound))
+				recordDisconnect(string(remote), DisconnectInboundLimit, false)
+				go conn.Close()
+			}
+		}
+		return
+	}
+
+	// the direction of the connection to keep, as seen from us
+	keep := network.DirInbound
+	if cg.h.ID() < remote {
+		keep = network.DirOutbound
+	}
+
+	for _, c := range duplicateConns(conns, keep) {
+		log.Debug("Closing duplicate connection", "peer", remote, "direction", c.Stat().Direction)
+		recordDisconnect(string(remote), DisconnectDuplicate, false)
+		go c.Close()
+	}
+}
+
+// duplicateConns returns the connections of conns, all to the same peer, to
+// close. The connections in the keep direction are kept, or the ones in the
+// other direction if there are none: both sides agree on them. Of these, the
+// dialer alone keeps its oldest one and closes the others, since the sides
+// see different connection IDs and open times.
+func duplicateConns(conns []network.Conn, keep network.Direction) []network.Conn {
+	dir := network.DirUnknown
+	for _, c := range conns {
+		if c.Stat().Direction == keep {
+			dir = keep
+			break
+		}
+		dir = c.Stat().Direction
+	}
+
+	var oldest network.Conn
+	if dir == network.DirOutbound {
+		for _, c := range conns {
+			if c.Stat().Direction == dir && (oldest == nil || c.Stat().Opened.Before(oldest.Stat().Opened)) {
+				oldest = c
+			}
+		}
+	}
+
+	var dups []network.Conn
+	for _, c := range conns {
+		if c.Stat().Direction != dir || (oldest != nil && c != oldest) {
+			dups = append(dups, c)
+		}
+	}
+	return dups
+}
+
+func (cg *connGuard) isDenied(p peer.ID) bool {
+	cg.mu.RLock()
+	defer cg.mu.RUnlock()
+	return cg.denied[p]
+}
+
+func (cg *connGuard) Disconnected(network.Network, network.Conn)       {}
+func (cg *connGuard) Listen(network.Network, multiaddr.Multiaddr)      {}
+func (cg *connGuard) ListenClose(network.Network, multiaddr.Multiaddr) {}
+func (cg *connGuard) OpenedStream(network.Network, network.Stream)     {}
+func (cg *connGuard) ClosedStream(network.Network, network.Stream)     {}
+
+// SetDeniedPeers replaces the peers the node refuses to be connected to, and
+// closes the connections to them. It simulates network partitions, e.g., in
+// a localnet.
+func (server *Server) SetDeniedPeers(peers []peer.ID) {
+	denied := make(map[peer.ID]bool, len(peers))
+	for _, p := range peers {
+		denied[p] = true
+	}
+
+	server.guard.mu.Lock()
+	server.guard.denied = denied
+	server.guard.mu.Unlock()
+
+	for _, p := range peers {
+		if server.Host.Network().Connectedness(p) == network.Connected {
+			log.Info("Closing connection to denied peer", "peer", p)
+			recordDisconnect(string(p), DisconnectDenied, false)
+			server.Host.Network().ClosePeer(p)
+		}
+	}
+}
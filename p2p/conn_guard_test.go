@@ -0,0 +1,37 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/stretchr/testify/assert"
+)
+
+type guardTestConn struct {
+	network.Conn
+	stat network.Stat
+}
+
+func (c *guardTestConn) Stat() network.Stat { return c.stat }
+
+func TestDuplicateConns(t *testing.T) {
+	now := time.Now()
+	conn := func(dir network.Direction, age time.Duration) network.Conn {
+		return &guardTestConn{stat: network.Stat{Direction: dir, Opened: now.Add(-age)}}
+	}
+	in1, in2 := conn(network.DirInbound, time.Second), conn(network.DirInbound, 2*time.Second)
+	out1, out2 := conn(network.DirOutbound, time.Second), conn(network.DirOutbound, 2*time.Second)
+
+	// we dialed the connection to keep: our oldest one only
+	assert.ElementsMatch(t, []network.Conn{in1, out1}, duplicateConns([]network.Conn{in1, out1, out2}, network.DirOutbound))
+	assert.ElementsMatch(t, []network.Conn{out1}, duplicateConns([]network.Conn{out1, out2}, network.DirOutbound))
+
+	// the peer dialed it: it closes its other ones, we close ours
+	assert.ElementsMatch(t, []network.Conn{out1}, duplicateConns([]network.Conn{in1, out1, in2}, network.DirInbound))
+	assert.Empty(t, duplicateConns([]network.Conn{in1, in2}, network.DirInbound))
+
+	// none in the keep direction: the dialer keeps its oldest one
+	assert.ElementsMatch(t, []network.Conn{out1}, duplicateConns([]network.Conn{out1, out2}, network.DirInbound))
+	assert.Empty(t, duplicateConns([]network.Conn{in1, in2}, network.DirOutbound))
+}
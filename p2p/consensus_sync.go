@@ -1,10 +1,9 @@
 package p2p
 
 import (
-	"math/rand"
-
 	"github.com/QuarkChain/go-minimal-pbft/consensus"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/libp2p/go-libp2p-core/peer"
 )
 
 func (s *Server) consensSyncRoutine() {
@@ -15,20 +14,25 @@ func (s *Server) consensSyncRoutine() {
 		case localSyncReq := <-s.consensusSyncChan:
 			// randomly pick one peer to send
 			// TODO: may find the multiple peers with better information
-			ps := s.Host.Network().Peers()
+			var ps []peer.ID
+			for _, p := range PeersSupporting(s.Host, TopicConsensusSync) {
+				if s.isAuthorized(p) {
+					ps = append(ps, p)
+				}
+			}
 
 			if len(ps) == 0 {
 				continue
 			}
 
-			p := ps[rand.Intn(len(ps))]
+			p := PickRandom(ps, 1)[0]
 
 			resp := &consensus.ConsensusSyncResponse{}
 
 			// Do not block the goroutine
 			go func() {
 				log.Debug("sending consensus sync", "req", localSyncReq, "peer", p)
-				if err := SendRPC(s.ctx, s.Host, p, TopicConsensusSync, localSyncReq, resp); err != nil {
+				if err := s.sendConsensusSync(p, localSyncReq, resp); err != nil {
 					// Mark as bad peer and disconnect from peer?
 					return
 				}
@@ -57,6 +61,10 @@ func (s *Server) consensSyncRoutine() {
 						continue
 					}
 
+					if s.isDuplicate("sync", p, msg, msgData) {
+						continue
+					}
+
 					log.Debug("add consensus sync message", "msg", msg)
 
 					// TODO: add in goroutine if full
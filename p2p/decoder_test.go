@@ -8,6 +8,7 @@ import (
 	"github.com/QuarkChain/go-minimal-pbft/consensus"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/trie"
 	"github.com/stretchr/testify/assert"
 )
@@ -72,3 +73,69 @@ func TestSerdeVote(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, v, nv)
 }
+
+func TestDecodeSignatureSize(t *testing.T) {
+	v := &consensus.Vote{
+		Type:             consensus.PrevoteType,
+		Height:           4,
+		Round:            3,
+		BlockID:          common.BytesToHash([]byte{1, 2}),
+		ValidatorAddress: common.BigToAddress(big.NewInt(12345)),
+		Signature:        make([]byte, consensus.MaxSignatureSize+1),
+	}
+	data, err := encodeVote(v)
+	assert.NoError(t, err)
+	_, err = decodeVote(data)
+	assert.ErrorIs(t, err, consensus.ErrSignatureSize)
+
+	v.Signature = make([]byte, consensus.MaxSignatureSize)
+	data, err = encodeVote(v)
+	assert.NoError(t, err)
+	_, err = decodeVote(data)
+	assert.NoError(t, err)
+
+	commit := consensus.NewCommit(5, 0, common.Hash{}, []consensus.CommitSig{{
+		BlockIDFlag: consensus.BlockIDFlagCommit,
+		Signature:   make([]byte, consensus.MaxSignatureSize+1),
+	}})
+	assert.ErrorIs(t, consensus.ValidateCommitSignatureSizes(commit), consensus.ErrSignatureSize)
+	commit.Signatures[0].Signature = make([]byte, consensus.MaxSignatureSize)
+	assert.NoError(t, consensus.ValidateCommitSignatureSizes(commit))
+}
+
+func TestDecodeCompressedProposalBounds(t *testing.T) {
+	// claims a decoded size over the limit
+	data := []byte{MsgCompressedProposal, proposalCodecFlate, 0xff, 0xff, 0xff, 0xff}
+	_, err := decode(data)
+	assert.ErrorIs(t, err, ErrInvalidCompressedProposal)
+
+	// decodes to more bytes than claimed
+	data = []byte{MsgCompressedProposal, proposalCodecNone, 0, 0, 0, 1, 1, 2}
+	_, err = decode(data)
+	assert.ErrorIs(t, err, ErrInvalidCompressedProposal)
+
+	data = []byte{MsgCompressedProposal, 0x7f, 0, 0, 0, 1, 1}
+	_, err = decode(data)
+	assert.ErrorIs(t, err, ErrInvalidCompressedProposal)
+}
+
+func TestHelloResponseRetention(t *testing.T) {
+	// sent by nodes not announcing their base
+	data, err := rlp.EncodeToBytes(&struct{ LastHeight uint64 }{LastHeight: 10})
+	assert.NoError(t, err)
+	resp, err := decodeHelloResponse(data)
+	assert.NoError(t, err)
+	old := resp.(HelloResponse)
+	assert.True(t, old.retains(1))
+	assert.True(t, old.retains(10))
+	assert.False(t, old.retains(11))
+
+	pruned := HelloResponse{LastHeight: 10, Base: 5}
+	data, err = rlp.EncodeToBytes(&pruned)
+	assert.NoError(t, err)
+	resp, err = decodeHelloResponse(data)
+	assert.NoError(t, err)
+	assert.Equal(t, pruned, resp)
+	assert.False(t, pruned.retains(4))
+	assert.True(t, pruned.retains(5))
+}
@@ -0,0 +1,140 @@
+package p2p
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/QuarkChain/go-minimal-pbft/internal/testhook"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The same vote reaches us from many peers: through gossip, though gossipsub
+// drops the copies of a message it has seen, and through the consensus sync
+// responses of every peer we ask. Inbound proposals and votes are
+// deduplicated by the hash of their encoding before they are queued to the
+// consensus state, where they would be verified again.
+//
+// Only the messages of the current height are cached: consensus drops the
+// ones of future heights, which must not be dropped here when they come
+// again once we reach their height.
+
+var (
+	dedupTTL         = 2 * time.Minute
+	dedupMaxEntries  = 64 * 1024
+	dedupPeerEntries = 4 * 1024
+)
+
+var p2pInboundMessages = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "p2p_inbound_consensus_messages_total",
+		Help: "Total number of inbound proposals and votes by source and whether they were new, already received, or already received from the same peer",
+	}, []string{"source", "result"})
+
+type seenEntry struct {
+	key  [sha256.Size]byte
+	time time.Time
+}
+
+// seenCache is the set of the keys added in the last ttl, at most max of
+// them, evicted in insertion order.
+type seenCache struct {
+	ttl     time.Duration
+	max     int
+	entries map[[sha256.Size]byte]struct{}
+	order   []seenEntry
+}
+
+func newSeenCache(ttl time.Duration, max int) *seenCache {
+	return &seenCache{ttl: ttl, max: max, entries: make(map[[sha256.Size]byte]struct{})}
+}
+
+// add adds the key, and tells whether it was not in the cache.
+func (c *seenCache) add(key [sha256.Size]byte, now time.Time) bool {
+	for len(c.order) > 0 && (len(c.order) >= c.max || now.Sub(c.order[0].time) > c.ttl) {
+		delete(c.entries, c.order[0].key)
+		c.order = c.order[1:]
+	}
+
+	if _, ok := c.entries[key]; ok {
+		return false
+	}
+	c.entries[key] = struct{}{}
+	c.order = append(c.order, seenEntry{key: key, time: now})
+	return true
+}
+
+type inboundDedup struct {
+	mu     sync.Mutex
+	global *seenCache
+	peers  map[peer.ID]*seenCache
+}
+
+func newInboundDedup() *inboundDedup {
+	return &inboundDedup{
+		global: newSeenCache(dedupTTL, dedupMaxEntries),
+		peers:  make(map[peer.ID]*seenCache),
+	}
+}
+
+// seen records a message of the current height from a peer, and tells
+// whether it was already received.
+func (d *inboundDedup) seen(source string, from peer.ID, data []byte) bool {
+	key := sha256.Sum256(data)
+	now := testhook.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	pc, ok := d.peers[from]
+	if !ok {
+		pc = newSeenCache(dedupTTL, dedupPeerEntries)
+		d.peers[from] = pc
+	}
+	newFromPeer := pc.add(key, now)
+	isNew := d.global.add(key, now)
+
+	switch {
+	case !newFromPeer:
+		p2pInboundMessages.WithLabelValues(source, "peer_duplicate").Inc()
+	case !isNew:
+		p2pInboundMessages.WithLabelValues(source, "duplicate").Inc()
+	default:
+		p2pInboundMessages.WithLabelValues(source, "new").Inc()
+	}
+	return !isNew
+}
+
+// forget drops the cache of a disconnected peer.
+func (d *inboundDedup) forget(p peer.ID) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.peers, p)
+}
+
+// isDuplicate tells whether a decoded proposal or vote of the current height
+// was already received. Other messages are never duplicates.
+func (server *Server) isDuplicate(source string, from peer.ID, msg interface{}, data []byte) bool {
+	cs := server.consensusState
+	if cs == nil {
+		return false
+	}
+
+	var height uint64
+	switch m := msg.(type) {
+	case *consensus.Proposal:
+		height = m.Height
+	case *consensus.Vote:
+		height = m.Height
+	case *consensus.VoteExtension:
+		height = m.Height
+	default:
+		return false
+	}
+	if current, _ := cs.HeightRound(); height != current {
+		return false
+	}
+	return server.dedup.seen(source, from, data)
+}
@@ -0,0 +1,38 @@
+package p2p
+
+import (
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSeenCache(t *testing.T) {
+	c := newSeenCache(time.Minute, 2)
+	now := time.Now()
+	a, b, d := sha256.Sum256([]byte("a")), sha256.Sum256([]byte("b")), sha256.Sum256([]byte("d"))
+
+	assert.True(t, c.add(a, now))
+	assert.False(t, c.add(a, now))
+	assert.True(t, c.add(b, now))
+
+	// full: the oldest is evicted
+	assert.True(t, c.add(d, now))
+	assert.True(t, c.add(a, now))
+
+	// expired
+	assert.True(t, c.add(d, now.Add(2*time.Minute)))
+	assert.Len(t, c.entries, 1)
+}
+
+func TestInboundDedup(t *testing.T) {
+	d := newInboundDedup()
+
+	assert.False(t, d.seen("gossip", "peer1", []byte("vote")))
+	assert.True(t, d.seen("sync", "peer2", []byte("vote")))
+	assert.True(t, d.seen("sync", "peer1", []byte("vote")))
+
+	d.forget("peer1")
+	assert.Len(t, d.peers, 1)
+}
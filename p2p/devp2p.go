@@ -32,6 +32,14 @@ func broadcast(peers map[string]*PeerHandler, code uint64, data []byte) error {
 	return err1
 }
 
+// dialedBySmaller tells whether the connection to p was dialed by whichever
+// of us and p has the smaller node ID.
+func dialedBySmaller(self enode.ID, p *ethp2p.Peer) bool {
+	id := p.ID()
+	selfSmaller := bytes.Compare(self[:], id[:]) < 0
+	return selfSmaller != p.Inbound()
+}
+
 // SplitAndTrim splits input separated by a comma
 // and trims excessive white space from the substrings.
 func SplitAndTrim(input string) (ret []string) {
@@ -90,12 +98,27 @@ func RunDevp2p(
 			Length:  4,
 
 			Run: func(p *ethp2p.Peer, rw ethp2p.MsgReadWriter) error {
+				id := p.ID().String()
+				if p.ID() == server.Self().ID() {
+					recordDisconnect(id, DisconnectSelf, false)
+					return fmt.Errorf("connected to self")
+				}
+
+				self := &PeerHandler{p, rw}
 				pmu.Lock()
 				// TODO: Check max peers reached?
-				if _, ok := peers[p.ID().String()]; ok {
-					pmu.Unlock()
-					return fmt.Errorf("already connected")
+				if other, ok := peers[id]; ok {
+					// both sides must keep the same connection: the one
+					// dialed by the node with the smaller ID wins
+					if !dialedBySmaller(server.Self().ID(), p) || dialedBySmaller(server.Self().ID(), other.p) {
+						pmu.Unlock()
+						recordDisconnect(id, DisconnectDuplicate, false)
+						return fmt.Errorf("already connected")
+					}
+					recordDisconnect(id, DisconnectDuplicate, false)
+					other.p.Disconnect(ethp2p.DiscAlreadyConnected)
 				}
+				peers[id] = self
 				pmu.Unlock()
 
 				var exitErr error
@@ -143,7 +166,7 @@ func RunDevp2p(
 						obsvC <- consensus.MsgInfo{Msg: &consensus.VoteMessage{Vote: m}, PeerID: p.Fullname()}
 						p2pMessagesReceived.WithLabelValues("observation").Inc()
 					case *HelloRequest:
-						resp := &HelloResponse{state.GetLastHeight()}
+						resp := &HelloResponse{LastHeight: state.GetLastHeight()}
 						err := ethp2p.Send(rw, MsgHelloResponse, resp)
 
 						if err != nil {
@@ -161,7 +184,9 @@ func RunDevp2p(
 				}
 
 				pmu.Lock()
-				delete(peers, p.ID().String())
+				if peers[id] == self {
+					delete(peers, id)
+				}
 				pmu.Unlock()
 				return exitErr
 			},
@@ -0,0 +1,203 @@
+package p2p
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/QuarkChain/go-minimal-pbft/internal/testhook"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const TopicDisconnect = "/mpbft/dev/disconnect/1.0.0"
+
+// DisconnectReason tells the peer (and our own peer history) why a connection
+// is closed.
+type DisconnectReason uint8
+
+const (
+	DisconnectUnknown DisconnectReason = iota
+	DisconnectBadMessage
+	DisconnectTimeout
+	DisconnectBanned
+	DisconnectDuplicate
+	DisconnectSelf
+	DisconnectShutdown
+	DisconnectDenied
+	DisconnectUnauthorized
+	DisconnectGenesisMismatch
+	DisconnectInboundLimit
+	DisconnectRotated
+	DisconnectSlowPeer
+)
+
+func (r DisconnectReason) String() string {
+	switch r {
+	case DisconnectBadMessage:
+		return "bad_message"
+	case DisconnectTimeout:
+		return "timeout"
+	case DisconnectBanned:
+		return "banned"
+	case DisconnectDuplicate:
+		return "duplicate_connection"
+	case DisconnectSelf:
+		return "self_connection"
+	case DisconnectShutdown:
+		return "shutdown"
+	case DisconnectDenied:
+		return "denied"
+	case DisconnectUnauthorized:
+		return "unauthorized"
+	case DisconnectGenesisMismatch:
+		return "genesis_mismatch"
+	case DisconnectInboundLimit:
+		return "inbound_limit"
+	case DisconnectRotated:
+		return "rotated"
+	case DisconnectSlowPeer:
+		return "slow_peer"
+	default:
+		return "unknown"
+	}
+}
+
+// DisconnectMessage is the last message sent to a peer before closing the
+// connection.
+type DisconnectMessage struct {
+	Reason uint8
+}
+
+// time to deliver the disconnect message before closing anyway
+var disconnectMessageTimeout = time.Second
+
+var p2pPeerDisconnects = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "p2p_peer_disconnects_total",
+		Help: "Total number of peer disconnects by reason and side initiating it",
+	}, []string{"reason", "side"})
+
+// DisconnectRecord is an entry of the peer history.
+type DisconnectRecord struct {
+	Time   time.Time
+	Reason DisconnectReason
+	Remote bool // whether the peer disconnected us
+}
+
+const (
+	maxDisconnectRecordsPerPeer = 16
+	maxDisconnectHistoryPeers   = 1024
+)
+
+type disconnectHistory struct {
+	mu      sync.Mutex
+	records map[string][]DisconnectRecord
+}
+
+var peerHistory = &disconnectHistory{records: make(map[string][]DisconnectRecord)}
+
+func (dh *disconnectHistory) add(p string, record DisconnectRecord) {
+	dh.mu.Lock()
+	defer dh.mu.Unlock()
+
+	if _, ok := dh.records[p]; !ok && len(dh.records) >= maxDisconnectHistoryPeers {
+		// forget an arbitrary peer
+		for k := range dh.records {
+			delete(dh.records, k)
+			break
+		}
+	}
+
+	records := append(dh.records[p], record)
+	if len(records) > maxDisconnectRecordsPerPeer {
+		records = records[len(records)-maxDisconnectRecordsPerPeer:]
+	}
+	dh.records[p] = records
+}
+
+// PeerDisconnects returns the recent disconnects of a peer, oldest first.
+func PeerDisconnects(p peer.ID) []DisconnectRecord {
+	peerHistory.mu.Lock()
+	defer peerHistory.mu.Unlock()
+
+	return append([]DisconnectRecord{}, peerHistory.records[string(p)]...)
+}
+
+func recordDisconnect(p string, reason DisconnectReason, remote bool) {
+	side := "local"
+	if remote {
+		side = "remote"
+	}
+	p2pPeerDisconnects.WithLabelValues(reason.String(), side).Inc()
+	peerHistory.add(p, DisconnectRecord{Time: testhook.Now(), Reason: reason, Remote: remote})
+}
+
+// Disconnect tells the peer why it is disconnected, then closes all the
+// connections to it.
+func Disconnect(ctx context.Context, h host.Host, p peer.ID, reason DisconnectReason) {
+	log.Info("Disconnecting peer", "peer", p, "reason", reason)
+	recordDisconnect(string(p), reason, false)
+
+	ctx, cancel := context.WithTimeout(ctx, disconnectMessageTimeout)
+	defer cancel()
+
+	if s, err := Send(ctx, h, p, TopicDisconnect, &DisconnectMessage{Reason: uint8(reason)}); err != nil {
+		log.Debug("failed to send disconnect message", "peer", p, "err", err)
+	} else {
+		s.Close()
+	}
+
+	if err := h.Network().ClosePeer(p); err != nil {
+		log.Debug("failed to close peer", "peer", p, "err", err)
+	}
+}
+
+// DisconnectAll disconnects all the peers for reason, in parallel so that
+// it takes at most about disconnectMessageTimeout whatever the peers.
+func DisconnectAll(ctx context.Context, h host.Host, reason DisconnectReason) {
+	var wg sync.WaitGroup
+	for _, p := range h.Network().Peers() {
+		wg.Add(1)
+		go func(p peer.ID) {
+			defer wg.Done()
+			Disconnect(ctx, h, p, reason)
+		}(p)
+	}
+	wg.Wait()
+}
+
+func handleDisconnect(stream network.Stream) {
+	defer stream.Close()
+
+	p := stream.Conn().RemotePeer()
+
+	data, err := ReadMsgWithPrependedSize(stream)
+	if err != nil {
+		return
+	}
+
+	var msg DisconnectMessage
+	if err := rlp.DecodeBytes(data, &msg); err != nil {
+		return
+	}
+
+	reason := DisconnectReason(msg.Reason)
+	log.Info("Disconnected by peer", "peer", p, "reason", reason)
+	recordDisconnect(string(p), reason, true)
+}
+
+// penalize disconnects a peer that sent an invalid message, as reported by
+// consensus. Messages relayed by gossip are reported for the peer they come
+// from, which is only disconnected if it is connected to us.
+func (server *Server) penalize(ctx context.Context, p peer.ID, reason error) {
+	if p == server.Host.ID() || server.Host.Network().Connectedness(p) != network.Connected {
+		return
+	}
+	log.Warn("Peer sent an invalid message", "peer", p, "err", reason)
+	go Disconnect(ctx, server.Host, p, DisconnectBadMessage)
+}
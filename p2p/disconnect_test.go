@@ -0,0 +1,104 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newDisconnectTestNet returns n connected hosts handling disconnect
+// messages, their links having latency.
+func newDisconnectTestNet(t *testing.T, n int, latency time.Duration) []host.Host {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	mn := mocknet.New(ctx)
+	mn.SetLinkDefaults(mocknet.LinkOptions{Latency: latency})
+	for i := 0; i < n; i++ {
+		h, err := mn.GenPeer()
+		require.NoError(t, err)
+		SetChannelHandler(h, TopicDisconnect, handleDisconnect)
+	}
+	require.NoError(t, mn.LinkAll())
+	require.NoError(t, mn.ConnectAllButSelf())
+	return mn.Hosts()
+}
+
+func lastDisconnect(h host.Host) (DisconnectRecord, bool) {
+	records := PeerDisconnects(h.ID())
+	if len(records) == 0 {
+		return DisconnectRecord{}, false
+	}
+	return records[len(records)-1], true
+}
+
+func TestDisconnect(t *testing.T) {
+	hosts := newDisconnectTestNet(t, 2, 0)
+	a, b := hosts[0], hosts[1]
+
+	Disconnect(context.Background(), a, b.ID(), DisconnectBanned)
+	assert.NotEqual(t, network.Connected, a.Network().Connectedness(b.ID()))
+
+	record, ok := lastDisconnect(b)
+	require.True(t, ok)
+	assert.Equal(t, DisconnectBanned, record.Reason)
+	assert.False(t, record.Remote)
+
+	// the peer got the reason
+	assert.Eventually(t, func() bool {
+		record, ok := lastDisconnect(a)
+		return ok && record.Remote && record.Reason == DisconnectBanned
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestDisconnectUnreachable(t *testing.T) {
+	hosts := newDisconnectTestNet(t, 2, 0)
+	a, b := hosts[0], hosts[1]
+	b.RemoveStreamHandler(TopicDisconnect)
+
+	// the connection is closed all the same
+	Disconnect(context.Background(), a, b.ID(), DisconnectTimeout)
+	assert.NotEqual(t, network.Connected, a.Network().Connectedness(b.ID()))
+	record, ok := lastDisconnect(b)
+	require.True(t, ok)
+	assert.Equal(t, DisconnectTimeout, record.Reason)
+}
+
+func TestServerStop(t *testing.T) {
+	const latency = 400 * time.Millisecond
+	hosts := newDisconnectTestNet(t, 5, latency)
+	server := &Server{Host: hosts[0]}
+
+	start := time.Now()
+	server.Stop()
+	// in parallel, not one delivery after the other
+	assert.Less(t, time.Since(start), time.Duration(len(hosts)-1)*latency)
+
+	// every peer got the reason
+	assert.Eventually(t, func() bool {
+		received := 0
+		for _, record := range PeerDisconnects(hosts[0].ID()) {
+			if record.Remote && record.Reason == DisconnectShutdown {
+				received++
+			}
+		}
+		return received == len(hosts)-1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for _, h := range hosts[1:] {
+		assert.NotEqual(t, network.Connected, hosts[0].Network().Connectedness(h.ID()))
+		record, ok := lastDisconnect(h)
+		require.True(t, ok)
+		assert.Equal(t, DisconnectShutdown, record.Reason)
+		assert.False(t, record.Remote)
+	}
+
+	// stopping again is a no-op
+	server.Stop()
+}
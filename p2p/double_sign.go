@@ -0,0 +1,110 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/libp2p/go-libp2p-core/network"
+)
+
+// TopicSignedVotes serves the votes of a validator held by the node, for the
+// double-sign check of validators starting.
+const TopicSignedVotes = "/mpbft/dev/signed_votes/1.0.0"
+
+const (
+	maxSignedVotes      = 16
+	signedVotesQueryTTL = 5 * time.Second
+)
+
+func init() {
+	if err := RegisterChannel(ChannelDescriptor{
+		ID:             TopicSignedVotes,
+		Priority:       ChannelPriorityLow,
+		QueueCapacity:  8,
+		MaxMessageSize: 1024 * 1024,
+		Optional:       true,
+	}); err != nil {
+		panic(err)
+	}
+}
+
+type SignedVotesRequest struct {
+	Address    common.Address
+	FromHeight uint64
+}
+
+type SignedVotesResponse struct {
+	Votes [][]byte
+}
+
+func (server *Server) handleSignedVotes(stream network.Stream) {
+	defer stream.Close()
+
+	data, err := ReadMsgWithPrependedSize(stream)
+	if err != nil {
+		return
+	}
+
+	var req SignedVotesRequest
+	if err := rlp.DecodeBytes(data, &req); err != nil {
+		return
+	}
+
+	var resp SignedVotesResponse
+	for _, vote := range server.consensusState.SignedVotes(req.Address, req.FromHeight, maxSignedVotes) {
+		data, err := rlp.EncodeToBytes(vote)
+		if err != nil {
+			return
+		}
+		resp.Votes = append(resp.Votes, data)
+	}
+
+	respData, err := rlp.EncodeToBytes(&resp)
+	if err != nil {
+		return
+	}
+	WriteMsgWithPrependedSize(stream, respData)
+}
+
+// FindSignedVotes asks the connected peers for votes signed by the validator
+// key at heights from fromHeight on. Only votes with a valid signature are
+// returned, so a peer cannot prevent a validator from starting; peers that
+// fail to answer are skipped.
+func (server *Server) FindSignedVotes(ctx context.Context, chainID string, pubKey consensus.PubKey, fromHeight uint64) ([]*consensus.Vote, error) {
+	ctx, cancel := context.WithTimeout(ctx, signedVotesQueryTTL)
+	defer cancel()
+
+	peers := PeersSupporting(server.Host, TopicSignedVotes)
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("no peer to check signed votes with")
+	}
+
+	addr := pubKey.Address()
+	var found []*consensus.Vote
+	for _, p := range peers {
+		var resp SignedVotesResponse
+		err := SendRPC(ctx, server.Host, p, TopicSignedVotes, &SignedVotesRequest{Address: addr, FromHeight: fromHeight}, &resp)
+		if err != nil {
+			log.Debug("Failed to query signed votes", "peer", p, "err", err)
+			continue
+		}
+
+		for _, data := range resp.Votes {
+			var vote consensus.Vote
+			if err := rlp.DecodeBytes(data, &vote); err != nil || consensus.ValidateSignatureSize(vote.Signature) != nil {
+				break
+			}
+			if vote.ValidatorAddress != addr || vote.Height < fromHeight || !pubKey.VerifySignature(vote.VoteSignBytes(chainID), vote.Signature) {
+				log.Warn("Peer sent an invalid signed vote", "peer", p, "vote", &vote)
+				break
+			}
+			found = append(found, &vote)
+		}
+	}
+	return found, nil
+}
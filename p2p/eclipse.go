@@ -0,0 +1,195 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/peerstore"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// An attacker opening many connections to a node can end up holding all its
+// peers, and feed it only what it wants (an eclipse). Past dialTargetPeers,
+// the node keeps a minimum share of outbound connections, to peers it chose,
+// by refusing the inbound ones exceeding it; it regularly disconnects some
+// inbound peers, so that long-lived attacker connections do not keep the
+// slots forever; and it stays connected to its trusted peers, which are never
+// refused nor rotated.
+
+// EclipseConfig configures the protections against eclipse attacks, see
+// Server.SetEclipseConfig.
+type EclipseConfig struct {
+	// MinOutboundRatio is the minimum share of outbound peers, 0 to accept
+	// any inbound connection.
+	MinOutboundRatio float64
+	// Every InboundRotateInterval, InboundRotateFraction of the inbound
+	// peers is disconnected. A zero interval disables the rotation.
+	InboundRotateInterval time.Duration
+	InboundRotateFraction float64
+	// TrustedPeers are dialed again whenever disconnected.
+	TrustedPeers []peer.AddrInfo
+}
+
+var DefaultEclipseConfig = EclipseConfig{
+	MinOutboundRatio:      0.25,
+	InboundRotateInterval: 10 * time.Minute,
+	InboundRotateFraction: 0.1,
+}
+
+const trustedPeerTag = "trusted"
+
+type eclipsePolicy struct {
+	mu      sync.RWMutex
+	cfg     EclipseConfig
+	trusted map[peer.ID]bool
+}
+
+func newEclipsePolicy() *eclipsePolicy {
+	return &eclipsePolicy{cfg: DefaultEclipseConfig, trusted: make(map[peer.ID]bool)}
+}
+
+func (ep *eclipsePolicy) config() EclipseConfig {
+	ep.mu.RLock()
+	defer ep.mu.RUnlock()
+	return ep.cfg
+}
+
+func (ep *eclipsePolicy) isTrusted(p peer.ID) bool {
+	ep.mu.RLock()
+	defer ep.mu.RUnlock()
+	return ep.trusted[p]
+}
+
+// ParseTrustedPeers parses comma-separated multiaddrs with a peer ID.
+func ParseTrustedPeers(s string) ([]peer.AddrInfo, error) {
+	var peers []peer.AddrInfo
+	for _, addr := range strings.Split(s, ",") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+		ma, err := multiaddr.NewMultiaddr(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted peer %q: %w", addr, err)
+		}
+		pi, err := peer.AddrInfoFromP2pAddr(ma)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted peer %q: %w", addr, err)
+		}
+		peers = append(peers, *pi)
+	}
+	return peers, nil
+}
+
+// SetEclipseConfig replaces DefaultEclipseConfig. It must be called before
+// Run.
+func (server *Server) SetEclipseConfig(cfg EclipseConfig) {
+	trusted := make(map[peer.ID]bool, len(cfg.TrustedPeers))
+	for _, pi := range cfg.TrustedPeers {
+		trusted[pi.ID] = true
+		server.Host.Peerstore().AddAddrs(pi.ID, pi.Addrs, peerstore.PermanentAddrTTL)
+		server.Host.ConnManager().Protect(pi.ID, trustedPeerTag)
+	}
+
+	server.eclipse.mu.Lock()
+	defer server.eclipse.mu.Unlock()
+	server.eclipse.cfg = cfg
+	server.eclipse.trusted = trusted
+}
+
+// rejectInbound tells whether to refuse an inbound connection, given the
+// numbers of peers counting it.
+func rejectInbound(inbound, outbound int, minRatio float64) bool {
+	if minRatio <= 0 || inbound+outbound <= dialTargetPeers {
+		return false
+	}
+	return float64(outbound) < minRatio*float64(inbound+outbound)
+}
+
+// inboundToRotate picks the inbound peers to disconnect, none while the node
+// has few peers.
+func inboundToRotate(inbound []peer.ID, total int, fraction float64) []peer.ID {
+	if fraction <= 0 || total <= dialTargetPeers || len(inbound) == 0 {
+		return nil
+	}
+	return PickRandom(inbound, int(math.Ceil(fraction*float64(len(inbound)))))
+}
+
+// peerDirections splits the connected peers by the direction of their first
+// connection.
+func peerDirections(n network.Network) (inbound, outbound []peer.ID) {
+	for _, p := range n.Peers() {
+		conns := n.ConnsToPeer(p)
+		if len(conns) == 0 {
+			continue
+		}
+		if conns[0].Stat().Direction == network.DirOutbound {
+			outbound = append(outbound, p)
+		} else {
+			inbound = append(inbound, p)
+		}
+	}
+	return inbound, outbound
+}
+
+func (server *Server) eclipseRoutine(ctx context.Context) {
+	dial := time.NewTicker(dialInterval)
+	defer dial.Stop()
+
+	var rotate <-chan time.Time
+	if interval := server.eclipse.config().InboundRotateInterval; interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		rotate = ticker.C
+	}
+
+	server.connectTrusted(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-dial.C:
+			server.connectTrusted(ctx)
+		case <-rotate:
+			server.rotateInbound(ctx)
+		}
+	}
+}
+
+func (server *Server) connectTrusted(ctx context.Context) {
+	for _, pi := range server.eclipse.config().TrustedPeers {
+		if server.Host.Network().Connectedness(pi.ID) == network.Connected {
+			continue
+		}
+		go func(pi peer.AddrInfo) {
+			ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+			defer cancel()
+			if err := server.Host.Connect(ctx, pi); err != nil {
+				log.Debug("Failed to connect to trusted peer", "peer", pi.ID, "err", err)
+			}
+		}(pi)
+	}
+}
+
+// rotateInbound disconnects some of the untrusted inbound peers, whose
+// slots go to the peers we dial.
+func (server *Server) rotateInbound(ctx context.Context) {
+	inbound, outbound := peerDirections(server.Host.Network())
+	total := len(inbound) + len(outbound)
+
+	untrusted := inbound[:0]
+	for _, p := range inbound {
+		if !server.eclipse.isTrusted(p) {
+			untrusted = append(untrusted, p)
+		}
+	}
+	for _, p := range inboundToRotate(untrusted, total, server.eclipse.config().InboundRotateFraction) {
+		go Disconnect(ctx, server.Host, p, DisconnectRotated)
+	}
+}
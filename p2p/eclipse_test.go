@@ -0,0 +1,40 @@
+package p2p
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRejectInbound(t *testing.T) {
+	// small meshes accept any inbound connection
+	assert.False(t, rejectInbound(dialTargetPeers, 0, 0.25))
+
+	assert.True(t, rejectInbound(dialTargetPeers, 1, 0.25))
+	assert.False(t, rejectInbound(15, 5, 0.25))
+	assert.True(t, rejectInbound(16, 5, 0.25))
+	assert.False(t, rejectInbound(100, 0, 0))
+}
+
+func TestInboundToRotate(t *testing.T) {
+	var inbound []peer.ID
+	for i := 0; i < 15; i++ {
+		inbound = append(inbound, peer.ID(fmt.Sprintf("p%d", i)))
+	}
+
+	assert.Empty(t, inboundToRotate(inbound, dialTargetPeers, 0.1))
+	assert.Len(t, inboundToRotate(inbound, 20, 0.1), 2)
+	assert.Empty(t, inboundToRotate(inbound, 20, 0))
+	assert.Subset(t, inbound, inboundToRotate(inbound, 20, 0.5))
+}
+
+func TestParseTrustedPeers(t *testing.T) {
+	peers, err := ParseTrustedPeers("")
+	assert.NoError(t, err)
+	assert.Empty(t, peers)
+
+	_, err = ParseTrustedPeers("/ip4/1.2.3.4/udp/8999/quic")
+	assert.Error(t, err)
+}
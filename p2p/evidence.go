@@ -0,0 +1,75 @@
+package p2p
+
+import (
+	"context"
+	"time"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/libp2p/go-libp2p-core/network"
+)
+
+// TopicEvidence carries the consensus.DuplicateVoteEvidence found by the
+// nodes. It is not gossiped with the consensus messages, which are dropped
+// when stale: evidence stays relevant for many heights. Every node sends the
+// evidence it adds to its pool to its peers, so it floods the network once.
+const TopicEvidence = "/mpbft/dev/evidence/1.0.0"
+
+const evidenceSendTTL = 5 * time.Second
+
+func init() {
+	if err := RegisterChannel(ChannelDescriptor{
+		ID:             TopicEvidence,
+		Priority:       ChannelPriorityLow,
+		QueueCapacity:  16,
+		MaxMessageSize: 64 * 1024,
+		Optional:       true,
+	}); err != nil {
+		panic(err)
+	}
+}
+
+func (server *Server) handleEvidence(stream network.Stream) {
+	defer stream.Close()
+
+	p := stream.Conn().RemotePeer()
+	if !server.isAuthorized(p) || server.dropSuspended(MessageEvidence, "received") {
+		return
+	}
+
+	data, err := ReadMsgWithPrependedSize(stream)
+	if err != nil {
+		return
+	}
+	ev := &consensus.DuplicateVoteEvidence{}
+	if err := rlp.DecodeBytes(data, ev); err != nil || ev.ValidateBasic() != nil {
+		p2pMessagesReceived.WithLabelValues("invalid").Inc()
+		log.Debug("received invalid evidence", "peer", p, "err", err)
+		return
+	}
+
+	p2pMessagesReceived.WithLabelValues("evidence").Inc()
+	server.obsvC <- consensus.MsgInfo{Msg: ev, PeerID: string(p)}
+}
+
+// broadcastEvidence sends evidence to the peers supporting the evidence
+// channel.
+func (server *Server) broadcastEvidence(ctx context.Context, ev *consensus.DuplicateVoteEvidence) {
+	if server.dropSuspended(MessageEvidence, "sent") {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, evidenceSendTTL)
+	defer cancel()
+
+	for _, p := range PeersSupporting(server.Host, TopicEvidence) {
+		s, err := Send(ctx, server.Host, p, TopicEvidence, ev)
+		if err != nil {
+			log.Debug("Failed to send evidence", "peer", p, "err", err)
+			continue
+		}
+		s.Close()
+		p2pMessagesSent.Inc()
+	}
+}
@@ -0,0 +1,241 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+// Peers are grouped by the network of their address: their autonomous
+// system when an ASNProvider resolves it, else their /16 (/32 for IPv6).
+// When the node is short of peers, it dials the known ones of the groups it
+// has the fewest connections to first, so that its connections do not all
+// land in one provider, where an attacker owning it could eclipse the node.
+
+var (
+	dialInterval = 30 * time.Second
+	// dial while connected to fewer peers
+	dialTargetPeers = 16
+	// peers dialed per interval
+	dialBatch   = 4
+	dialTimeout = 10 * time.Second
+)
+
+const localGroup = "local"
+
+// ASNProvider resolves the autonomous system of an address, e.g., from a
+// GeoIP database. Without one, peers are grouped by network prefix only.
+type ASNProvider interface {
+	ASN(ip net.IP) (asn uint32, ok bool)
+}
+
+// NetInfo is the connectivity of the node, served as "net_info".
+type NetInfo struct {
+	PeerID   string `json:"peer_id"`
+	Peers    int    `json:"peers"`
+	Outbound int    `json:"outbound"`
+	// Groups is the number of distinct address groups of the peers, ASNs
+	// the number of distinct autonomous systems resolved
+	Groups            int    `json:"groups"`
+	ASNs              int    `json:"asns"`
+	LargestGroup      string `json:"largest_group"`
+	LargestGroupPeers int    `json:"largest_group_peers"`
+	// Diversity is the share of the peers outside of the largest group: 0
+	// when all are in the same one
+	Diversity float64 `json:"diversity"`
+}
+
+type locality struct {
+	mu  sync.RWMutex
+	asn ASNProvider
+}
+
+// SetASNProvider groups the peers by autonomous system.
+func (server *Server) SetASNProvider(p ASNProvider) {
+	server.locality.mu.Lock()
+	defer server.locality.mu.Unlock()
+	server.locality.asn = p
+}
+
+func addrIP(ma multiaddr.Multiaddr) net.IP {
+	if ma == nil {
+		return nil
+	}
+	for _, proto := range []int{multiaddr.P_IP4, multiaddr.P_IP6} {
+		if v, err := ma.ValueForProtocol(proto); err == nil {
+			return net.ParseIP(v)
+		}
+	}
+	return nil
+}
+
+// group returns the group of an address, and its ASN if resolved.
+func (l *locality) group(ma multiaddr.Multiaddr) (string, uint32, bool) {
+	ip := addrIP(ma)
+	if ip == nil {
+		return "", 0, false
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() {
+		return localGroup, 0, false
+	}
+
+	l.mu.RLock()
+	asn := l.asn
+	l.mu.RUnlock()
+	if asn != nil {
+		if n, ok := asn.ASN(ip); ok {
+			return fmt.Sprintf("as%d", n), n, true
+		}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(16, 32)).String() + "/16", 0, false
+	}
+	return ip.Mask(net.CIDRMask(32, 128)).String() + "/32", 0, false
+}
+
+// candidateGroup is the group of the first routable address of a peer.
+func (l *locality) candidateGroup(addrs []multiaddr.Multiaddr) string {
+	group := ""
+	for _, ma := range addrs {
+		g, _, _ := l.group(ma)
+		if g != "" && g != localGroup {
+			return g
+		}
+		if g != "" {
+			group = g
+		}
+	}
+	return group
+}
+
+type dialCandidate struct {
+	id    peer.ID
+	group string
+}
+
+// pickDiverse picks n candidates, each from the group with the fewest
+// connections so far (counting the ones picked before), ties broken in
+// candidate order.
+func pickDiverse(candidates []dialCandidate, connected map[string]int, n int) []peer.ID {
+	counts := make(map[string]int, len(connected))
+	for g, c := range connected {
+		counts[g] = c
+	}
+	picked := make([]peer.ID, 0, n)
+	used := make([]bool, len(candidates))
+	for len(picked) < n {
+		best := -1
+		for i, c := range candidates {
+			if !used[i] && (best == -1 || counts[c.group] < counts[candidates[best].group]) {
+				best = i
+			}
+		}
+		if best == -1 {
+			break
+		}
+		used[best] = true
+		counts[candidates[best].group]++
+		picked = append(picked, candidates[best].id)
+	}
+	return picked
+}
+
+// connectedGroups counts the connected peers per group.
+func (server *Server) connectedGroups() (map[string]int, map[uint32]bool) {
+	groups := make(map[string]int)
+	asns := make(map[uint32]bool)
+	for _, p := range server.Host.Network().Peers() {
+		conns := server.Host.Network().ConnsToPeer(p)
+		if len(conns) == 0 {
+			continue
+		}
+		g, asn, ok := server.locality.group(conns[0].RemoteMultiaddr())
+		groups[g]++
+		if ok {
+			asns[asn] = true
+		}
+	}
+	return groups, asns
+}
+
+// NetInfo reports the peers and how diverse their networks are.
+func (server *Server) NetInfo() NetInfo {
+	info := NetInfo{PeerID: server.Host.ID().String()}
+	for _, p := range server.Host.Network().Peers() {
+		info.Peers++
+		for _, c := range server.Host.Network().ConnsToPeer(p) {
+			if c.Stat().Direction == network.DirOutbound {
+				info.Outbound++
+				break
+			}
+		}
+	}
+
+	groups, asns := server.connectedGroups()
+	info.Groups, info.ASNs = len(groups), len(asns)
+	for g, n := range groups {
+		if n > info.LargestGroupPeers || (n == info.LargestGroupPeers && g < info.LargestGroup) {
+			info.LargestGroup, info.LargestGroupPeers = g, n
+		}
+	}
+	if info.Peers > 0 {
+		info.Diversity = 1 - float64(info.LargestGroupPeers)/float64(info.Peers)
+	}
+	return info
+}
+
+func (server *Server) dialRoutine(ctx context.Context) {
+	ticker := time.NewTicker(dialInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		server.dialDiverse(ctx)
+	}
+}
+
+// dialDiverse dials known peers, favoring the least represented groups,
+// while short of peers.
+func (server *Server) dialDiverse(ctx context.Context) {
+	h := server.Host
+	missing := dialTargetPeers - len(h.Network().Peers())
+	if missing <= 0 {
+		return
+	}
+
+	var candidates []dialCandidate
+	for _, p := range PickRandom(h.Peerstore().PeersWithAddrs(), -1) {
+		if p == h.ID() || h.Network().Connectedness(p) == network.Connected || server.guard.isDenied(p) {
+			continue
+		}
+		candidates = append(candidates, dialCandidate{id: p, group: server.locality.candidateGroup(h.Peerstore().Addrs(p))})
+	}
+	if len(candidates) == 0 {
+		return
+	}
+	if missing > dialBatch {
+		missing = dialBatch
+	}
+
+	groups, _ := server.connectedGroups()
+	for _, p := range pickDiverse(candidates, groups, missing) {
+		go func(p peer.ID) {
+			ctx, cancel := context.WithTimeout(ctx, dialTimeout)
+			defer cancel()
+			if err := h.Connect(ctx, peer.AddrInfo{ID: p}); err != nil {
+				log.Debug("Failed to dial peer", "peer", p, "err", err)
+			}
+		}(p)
+	}
+}
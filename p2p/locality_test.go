@@ -0,0 +1,56 @@
+package p2p
+
+import (
+	"net"
+	"testing"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeASN map[string]uint32
+
+func (f fakeASN) ASN(ip net.IP) (uint32, bool) {
+	asn, ok := f[ip.String()]
+	return asn, ok
+}
+
+func TestLocalityGroup(t *testing.T) {
+	l := &locality{}
+	group := func(addr string) string {
+		g, _, _ := l.group(multiaddr.StringCast(addr))
+		return g
+	}
+
+	assert.Equal(t, "34.12.0.0/16", group("/ip4/34.12.5.6/udp/8999/quic"))
+	assert.Equal(t, "34.12.0.0/16", group("/ip4/34.12.200.1/udp/8999/quic"))
+	assert.Equal(t, "2001:db8::/32", group("/ip6/2001:db8::1/udp/8999/quic"))
+	assert.Equal(t, localGroup, group("/ip4/127.0.0.1/udp/8999/quic"))
+	assert.Equal(t, localGroup, group("/ip4/10.0.0.1/udp/8999/quic"))
+
+	l.asn = fakeASN{"34.12.5.6": 15169}
+	assert.Equal(t, "as15169", group("/ip4/34.12.5.6/udp/8999/quic"))
+	// unresolved, by prefix
+	assert.Equal(t, "34.12.0.0/16", group("/ip4/34.12.200.1/udp/8999/quic"))
+
+	// the first routable address of a candidate
+	assert.Equal(t, "51.1.0.0/16", l.candidateGroup([]multiaddr.Multiaddr{
+		multiaddr.StringCast("/ip4/192.168.1.2/udp/8999/quic"),
+		multiaddr.StringCast("/ip4/51.1.2.3/udp/8999/quic"),
+	}))
+}
+
+func TestPickDiverse(t *testing.T) {
+	candidates := []dialCandidate{
+		{id: "a1", group: "a"}, {id: "a2", group: "a"}, {id: "a3", group: "a"},
+		{id: "b1", group: "b"}, {id: "b2", group: "b"},
+		{id: "c1", group: "c"},
+	}
+
+	// one per group first, the least connected ones before
+	connected := map[string]int{"a": 3, "b": 1}
+	assert.Equal(t, []peer.ID{"c1", "b1", "b2"}, pickDiverse(candidates, connected, 3))
+	assert.Equal(t, []peer.ID{"a1", "b1", "c1", "a2"}, pickDiverse(candidates, nil, 4))
+	assert.Len(t, pickDiverse(candidates, nil, 10), len(candidates))
+}
@@ -0,0 +1,25 @@
+package p2p
+
+import (
+	"github.com/QuarkChain/go-minimal-pbft/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RegisterMetrics registers the p2p metrics with reg, see metrics.Options.
+func RegisterMetrics(reg prometheus.Registerer) error {
+	return metrics.Register(reg,
+		p2pBlockParts,
+		p2pBlockPartsFill,
+		p2pGossipedTxs,
+		p2pHandshakesRefused,
+		p2pHeartbeatsSent,
+		p2pInboundMessages,
+		p2pMessagesSent,
+		p2pMessagesReceived,
+		p2pPeerDisconnects,
+		p2pRelayedVotes,
+		p2pSignedMessagesReceived,
+		p2pStaleMessagesDropped,
+		p2pSuspendedMessagesDropped,
+	)
+}
@@ -0,0 +1,90 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p-core/connmgr"
+	"github.com/libp2p/go-libp2p-core/control"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/multiformats/go-multiaddr"
+)
+
+var ErrUnknownMode = errors.New("unknown p2p mode")
+
+// Mode restricts the direction of the connections of a node.
+type Mode uint8
+
+const (
+	ModeFull Mode = iota
+	// ModeDialOnly nodes never accept connections, e.g., validators behind
+	// a firewall dropping inbound traffic: they do not listen, and stay DHT
+	// clients so their peers do not hand them out to others.
+	ModeDialOnly
+	// ModeListenOnly nodes never dial, e.g., sentries in a DMZ the validator
+	// connects to: they skip the bootstrap peers and only serve the
+	// connections made to them, DHT and gossip included.
+	ModeListenOnly
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModeFull:
+		return "full"
+	case ModeDialOnly:
+		return "dialOnly"
+	case ModeListenOnly:
+		return "listenOnly"
+	default:
+		return "unknown"
+	}
+}
+
+func ParseMode(s string) (Mode, error) {
+	for _, m := range []Mode{ModeFull, ModeDialOnly, ModeListenOnly} {
+		if s == m.String() {
+			return m, nil
+		}
+	}
+	return ModeFull, fmt.Errorf("%w: %q", ErrUnknownMode, s)
+}
+
+func (m Mode) dials() bool {
+	return m != ModeListenOnly
+}
+
+func (m Mode) listens() bool {
+	return m != ModeDialOnly
+}
+
+// modeGater refuses the connections in the direction the mode forbids, so
+// neither the DHT nor gossipsub peer exchange get around it.
+type modeGater struct {
+	mode Mode
+}
+
+var _ connmgr.ConnectionGater = modeGater{}
+
+func (g modeGater) InterceptPeerDial(peer.ID) bool {
+	return g.mode.dials()
+}
+
+func (g modeGater) InterceptAddrDial(peer.ID, multiaddr.Multiaddr) bool {
+	return g.mode.dials()
+}
+
+func (g modeGater) InterceptAccept(network.ConnMultiaddrs) bool {
+	return g.mode.listens()
+}
+
+func (g modeGater) InterceptSecured(dir network.Direction, _ peer.ID, _ network.ConnMultiaddrs) bool {
+	if dir == network.DirInbound {
+		return g.mode.listens()
+	}
+	return g.mode.dials()
+}
+
+func (g modeGater) InterceptUpgraded(network.Conn) (bool, control.DisconnectReason) {
+	return true, 0
+}
@@ -0,0 +1,51 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMode(t *testing.T) {
+	for _, m := range []Mode{ModeFull, ModeDialOnly, ModeListenOnly} {
+		parsed, err := ParseMode(m.String())
+		require.NoError(t, err)
+		assert.Equal(t, m, parsed)
+	}
+	_, err := ParseMode("validator")
+	assert.ErrorIs(t, err, ErrUnknownMode)
+}
+
+// newModeTestHost returns a host on loopback whose connections are gated by
+// mode.
+func newModeTestHost(t *testing.T, mode Mode) host.Host {
+	h, err := libp2p.New(context.Background(),
+		libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"),
+		libp2p.ConnectionGater(modeGater{mode}),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+func TestModeGater(t *testing.T) {
+	full := newModeTestHost(t, ModeFull)
+	dialOnly := newModeTestHost(t, ModeDialOnly)
+	listenOnly := newModeTestHost(t, ModeListenOnly)
+	connect := func(from, to host.Host) error {
+		return from.Connect(context.Background(), peer.AddrInfo{ID: to.ID(), Addrs: to.Addrs()})
+	}
+
+	assert.Error(t, connect(full, dialOnly))
+	assert.Error(t, connect(listenOnly, full))
+	assert.Error(t, connect(listenOnly, dialOnly))
+
+	assert.NoError(t, connect(dialOnly, full))
+	assert.NoError(t, connect(full, listenOnly))
+	assert.NoError(t, connect(dialOnly, listenOnly))
+}
@@ -0,0 +1,187 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// TopicNodeInfo exchanges the NodeInfo of both sides right after they
+// connect. Peers of another network, e.g., a forked testnet reusing the chain
+// ID, are disconnected, and their messages are ignored until the exchange is
+// done.
+const TopicNodeInfo = "/mpbft/dev/node_info/1.0.0"
+
+const nodeInfoTimeout = 10 * time.Second
+
+func init() {
+	if err := RegisterChannel(ChannelDescriptor{
+		ID:             TopicNodeInfo,
+		Priority:       ChannelPriorityHigh,
+		QueueCapacity:  32,
+		MaxMessageSize: 1024,
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// NodeInfo describes the network of a node.
+type NodeInfo struct {
+	ChainID     string
+	GenesisHash common.Hash // see consensus.GenesisHash
+	NodeName    string
+	// Relay announces that the node publishes the votes sent to it on
+	// TopicRelayVotes, see VoteRelays
+	Relay bool `rlp:"optional"`
+}
+
+// compatible tells why a peer is not of our network, nil if it is.
+func (ni *NodeInfo) compatible(other *NodeInfo) error {
+	if other.ChainID != ni.ChainID {
+		return fmt.Errorf("chain id %q, expected %q", other.ChainID, ni.ChainID)
+	}
+	if other.GenesisHash != ni.GenesisHash {
+		return fmt.Errorf("genesis %v, expected %v", other.GenesisHash, ni.GenesisHash)
+	}
+	return nil
+}
+
+type nodeInfoHandshake struct {
+	info NodeInfo
+	h    host.Host
+
+	mu    sync.Mutex
+	peers map[peer.ID]*NodeInfo
+}
+
+// attach serves our node info on the host and checks the one of every peer
+// connecting to it. It must be called before any connection is made.
+func (hs *nodeInfoHandshake) attach(h host.Host) {
+	hs.h = h
+	hs.peers = make(map[peer.ID]*NodeInfo)
+	SetChannelHandler(h, TopicNodeInfo, hs.handleNodeInfo)
+	h.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(n network.Network, conn network.Conn) {
+			go hs.handshake(conn.RemotePeer())
+		},
+		DisconnectedF: func(n network.Network, conn network.Conn) {
+			if n.Connectedness(conn.RemotePeer()) != network.Connected {
+				hs.mu.Lock()
+				delete(hs.peers, conn.RemotePeer())
+				hs.mu.Unlock()
+			}
+		},
+	})
+}
+
+// peerInfo returns the node info of a peer that passed the handshake.
+func (hs *nodeInfoHandshake) peerInfo(p peer.ID) *NodeInfo {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	return hs.peers[p]
+}
+
+func (hs *nodeInfoHandshake) accept(p peer.ID, info *NodeInfo) {
+	if err := hs.info.compatible(info); err != nil {
+		log.Warn("Closing connection to peer of another network", "peer", p, "name", info.NodeName, "err", err)
+		recordDisconnect(string(p), DisconnectGenesisMismatch, false)
+		hs.h.Network().ClosePeer(p)
+		return
+	}
+
+	hs.mu.Lock()
+	hs.peers[p] = info
+	hs.mu.Unlock()
+}
+
+func (hs *nodeInfoHandshake) handshake(p peer.ID) {
+	if hs.peerInfo(p) != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), nodeInfoTimeout)
+	defer cancel()
+
+	info, err := hs.exchange(ctx, p)
+	if err != nil {
+		if hs.h.Network().Connectedness(p) != network.Connected || hs.peerInfo(p) != nil {
+			return
+		}
+		log.Info("Closing connection to peer failing the node info handshake", "peer", p, "err", err)
+		recordDisconnect(string(p), DisconnectTimeout, false)
+		hs.h.Network().ClosePeer(p)
+		return
+	}
+	hs.accept(p, info)
+}
+
+func (hs *nodeInfoHandshake) exchange(ctx context.Context, p peer.ID) (*NodeInfo, error) {
+	data, err := rlp.EncodeToBytes(&hs.info)
+	if err != nil {
+		return nil, err
+	}
+
+	// not Send: the peer may not have announced its channels yet
+	stream, err := hs.h.NewStream(ctx, p, protocol.ID(TopicNodeInfo))
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+	if ch, ok := lookupChannel(TopicNodeInfo); ok {
+		stream = &channelStream{Stream: stream, maxMessageSize: ch.desc.MaxMessageSize}
+	}
+
+	if err := WriteMsgWithPrependedSize(stream, data); err != nil {
+		return nil, err
+	}
+	respData, err := ReadMsgWithPrependedSize(stream)
+	if err != nil {
+		return nil, err
+	}
+
+	var info NodeInfo
+	if err := rlp.DecodeBytes(respData, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+func (hs *nodeInfoHandshake) handleNodeInfo(stream network.Stream) {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(nodeInfoTimeout))
+
+	data, err := ReadMsgWithPrependedSize(stream)
+	if err != nil {
+		return
+	}
+	var info NodeInfo
+	if err := rlp.DecodeBytes(data, &info); err != nil {
+		return
+	}
+
+	// answer first, so the peer learns why it is disconnected
+	respData, err := rlp.EncodeToBytes(&hs.info)
+	if err != nil {
+		return
+	}
+	WriteMsgWithPrependedSize(stream, respData)
+	hs.accept(stream.Conn().RemotePeer(), &info)
+}
+
+// PeerNodeInfo returns the node info of a connected peer, nil until it passed
+// the handshake.
+func (server *Server) PeerNodeInfo(p peer.ID) *NodeInfo {
+	return server.nodeInfo.peerInfo(p)
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/QuarkChain/go-minimal-pbft/consensus"
@@ -63,9 +64,6 @@ const (
 )
 
 func init() {
-	prometheus.MustRegister(p2pHeartbeatsSent)
-	prometheus.MustRegister(p2pMessagesSent)
-	prometheus.MustRegister(p2pMessagesReceived)
 	decoder[1] = decodeProposal
 	decoder[2] = decodeVote
 	decoder[3] = decodeFullBlock
@@ -80,6 +78,14 @@ type HelloRequest struct {
 
 type HelloResponse struct {
 	LastHeight uint64
+	// Base is the first height the node retains blocks from, 0 if it
+	// retains all of them, as do the nodes not announcing it.
+	Base uint64 `rlp:"optional"`
+}
+
+// retains tells whether the node serves the block at height.
+func (resp *HelloResponse) retains(height uint64) bool {
+	return resp.Base <= height && height <= resp.LastHeight
 }
 
 type GetLatestMessagesRequest struct {
@@ -125,6 +131,9 @@ func decodeVote(data []byte) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := consensus.ValidateSignatureSize(v.Signature); err != nil {
+		return nil, err
+	}
 	return v, v.ValidateBasic()
 }
 
@@ -142,6 +151,14 @@ func decodeProposal(data []byte) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := consensus.ValidateSignatureSize(p.Signature); err != nil {
+		return nil, err
+	}
+	if p.Block != nil {
+		if err := consensus.ValidateCommitSignatureSizes(p.Block.LastCommit); err != nil {
+			return nil, err
+		}
+	}
 	return p, p.ValidateBasic()
 }
 
@@ -155,8 +172,13 @@ func encodeProposal(p *consensus.Proposal) ([]byte, error) {
 
 func decodeFullBlock(data []byte) (interface{}, error) {
 	var b consensus.FullBlock
-	err := b.DecodeFromRLPBytes(data)
-	return b, err
+	if err := b.DecodeFromRLPBytes(data); err != nil {
+		return b, err
+	}
+	if err := consensus.ValidateCommitSignatureSizes(b.LastCommit); err != nil {
+		return b, err
+	}
+	return b, consensus.ValidateCommitSignatureSizes(b.Commit())
 }
 
 func decode(data []byte) (interface{}, error) {
@@ -238,29 +260,52 @@ func WriteMsgWithPrependedSize(stream network.Stream, msg []byte) error {
 }
 
 func ReadMsgWithPrependedSize(stream stream.Stream) ([]byte, error) {
+	if cs, ok := stream.(*channelStream); ok {
+		return cs.readMessage()
+	}
+
 	sizeBytes := make([]byte, 4)
 	_, err := io.ReadFull(stream, sizeBytes)
 	if err != nil {
 		return nil, err
 	}
 
-	size := binary.BigEndian.Uint32(sizeBytes)
+	size, err := checkMessageSize(stream, sizeBytes)
+	if err != nil {
+		return nil, err
+	}
 
 	msg := make([]byte, size)
 	_, err = io.ReadFull(stream, msg)
 	return msg, err
 }
 
+func checkMessageSize(stream interface{}, sizeBytes []byte) (uint32, error) {
+	size := binary.BigEndian.Uint32(sizeBytes)
+	if ls, ok := stream.(interface{ MaxMessageSize() int }); ok && uint64(size) > uint64(ls.MaxMessageSize()) {
+		return 0, fmt.Errorf("%w: %d bytes", ErrMessageTooLarge, size)
+	}
+	return size, nil
+}
+
 func Send(ctx context.Context, h host.Host, peer peer.ID, topic string, msg interface{}) (stream.Stream, error) {
 	data, err := rlp.EncodeToBytes(msg)
 	if err != nil {
 		return nil, err
 	}
 
+	ch, registered := lookupChannel(topic)
+	if registered && ch.desc.Optional && !PeerSupports(h, peer, topic) {
+		return nil, fmt.Errorf("%w: %s", ErrChannelNotSupported, topic)
+	}
+
 	stream, err := h.NewStream(ctx, peer, protocol.ID(topic))
 	if err != nil {
 		return nil, err
 	}
+	if registered {
+		stream = &channelStream{Stream: stream, maxMessageSize: ch.desc.MaxMessageSize}
+	}
 
 	err = WriteMsgWithPrependedSize(stream, data)
 	if err != nil {
@@ -303,6 +348,20 @@ type Server struct {
 	networkID         string
 	nodeName          string
 	rootCtxCancel     context.CancelFunc
+	guard             *connGuard
+	dedup             *inboundDedup
+	certAuth          *CertAuth
+	nodeInfo          *nodeInfoHandshake
+	catchUp           *catchUpTracker
+	txPool            TxPool
+	txC               chan gossipTx
+	mode              Mode
+	locality          locality
+	eclipse           *eclipsePolicy
+	parts             *partStore
+	partsConsensus    partsConsensus
+	suspensions       *messageSuspensions
+	stopOnce          sync.Once
 }
 
 func NewP2PServer(
@@ -315,25 +374,38 @@ func NewP2PServer(
 	networkID string,
 	bootstrapPeers string,
 	nodeName string,
+	nodeInfo NodeInfo,
+	mode Mode,
+	certAuth *CertAuth,
 	rootCtxCancel context.CancelFunc,
 ) (*Server, error) {
+	// Multiple listen addresses
+	listen := libp2p.ListenAddrStrings(append([]string{
+		// Listen on QUIC, and websockets if enabled.
+		// https://github.com/libp2p/go-libp2p/issues/688
+		fmt.Sprintf("/ip4/0.0.0.0/udp/%d/quic", port),
+		fmt.Sprintf("/ip6/::/udp/%d/quic", port),
+	}, websocketListenAddrs()...)...)
+	dhtMode := dht.ModeServer
+	if !mode.listens() {
+		listen = libp2p.NoListenAddrs
+		dhtMode = dht.ModeClient
+	}
+
+	handshakes := newHandshakeGuard()
 	h, err := libp2p.New(ctx,
 		// Use the keypair we generated
 		libp2p.Identity(priv),
 
-		// Multiple listen addresses
-		libp2p.ListenAddrStrings(
-			// Listen on QUIC only.
-			// https://github.com/libp2p/go-libp2p/issues/688
-			fmt.Sprintf("/ip4/0.0.0.0/udp/%d/quic", port),
-			fmt.Sprintf("/ip6/::/udp/%d/quic", port),
-		),
+		listen,
+		libp2p.ConnectionGater(acceptGater{modeGater: modeGater{mode}, handshakes: handshakes}),
 
 		// Enable TLS security as the only security protocol.
 		libp2p.Security(libp2ptls.ID, libp2ptls.New),
 
-		// Enable QUIC transport as the only transport.
+		// Enable QUIC transport, and websockets for restrictive networks.
 		libp2p.Transport(libp2pquic.NewTransport),
+		websocketTransport(),
 
 		// Let's prevent our peer from having too many
 		// connections by attaching a connection manager.
@@ -346,7 +418,7 @@ func NewP2PServer(
 		// Let this host use the DHT to find other hosts
 		libp2p.Routing(func(h host.Host) (routing.PeerRouting, error) {
 			// TODO(leo): Persistent data store (i.e. address book)
-			idht, err := dht.New(ctx, h, dht.Mode(dht.ModeServer),
+			idht, err := dht.New(ctx, h, dht.Mode(dhtMode),
 				// TODO(leo): This intentionally makes us incompatible with the global IPFS DHT
 				dht.ProtocolPrefix(protocol.ID("/"+networkID)),
 			)
@@ -358,6 +430,23 @@ func NewP2PServer(
 		return nil, err
 	}
 
+	// before any connection is made, so no ghost peer slips through
+	guard := &connGuard{h: h, eclipse: newEclipsePolicy()}
+	h.Network().Notify(guard)
+	handshake := &nodeInfoHandshake{info: nodeInfo}
+	handshake.attach(h)
+	if certAuth != nil {
+		certAuth.attach(h)
+	}
+	handshakes.attach(h, func(p peer.ID) bool { return peerReady(handshake, certAuth, p) })
+
+	dedup := newInboundDedup()
+	h.Network().Notify(&network.NotifyBundle{DisconnectedF: func(n network.Network, conn network.Conn) {
+		if n.Connectedness(conn.RemotePeer()) != network.Connected {
+			dedup.forget(conn.RemotePeer())
+		}
+	}})
+
 	log.Info("Connecting to bootstrap peers", "bootstrap_peers", bootstrapPeers)
 
 	// Add our own bootstrap nodes
@@ -367,6 +456,11 @@ func NewP2PServer(
 	successes := 0
 	// Are we a bootstrap node? If so, it's okay to not have any peers.
 	bootstrapNode := false
+	if !mode.dials() {
+		log.Info("Listen-only node, not dialing bootstrap peers")
+		bootstrapPeers = ""
+		bootstrapNode = true
+	}
 
 	for _, addr := range strings.Split(bootstrapPeers, ",") {
 		if addr == "" {
@@ -396,8 +490,11 @@ func NewP2PServer(
 		}
 	}
 
-	h.SetStreamHandler(TopicHello, func(stream network.Stream) {
+	SetChannelHandler(h, TopicHello, func(stream network.Stream) {
 		defer stream.Close()
+		if !peerReady(handshake, certAuth, stream.Conn().RemotePeer()) {
+			return
+		}
 
 		data, err := ReadMsgWithPrependedSize(stream)
 		if err != nil {
@@ -415,7 +512,7 @@ func NewP2PServer(
 			"payload", data,
 			"raw", data)
 
-		resp, err := rlp.EncodeToBytes(&HelloResponse{blockStore.Height()})
+		resp, err := rlp.EncodeToBytes(&HelloResponse{LastHeight: blockStore.Height(), Base: blockStore.Base()})
 		if err != nil {
 			return
 		}
@@ -426,8 +523,13 @@ func NewP2PServer(
 		}
 	})
 
-	h.SetStreamHandler(TopicFullBlock, func(stream network.Stream) {
+	SetChannelHandler(h, TopicDisconnect, handleDisconnect)
+
+	SetChannelHandler(h, TopicFullBlock, func(stream network.Stream) {
 		defer stream.Close()
+		if !peerReady(handshake, certAuth, stream.Conn().RemotePeer()) {
+			return
+		}
 
 		data, err := ReadMsgWithPrependedSize(stream)
 		if err != nil {
@@ -447,6 +549,10 @@ func NewP2PServer(
 
 		// TODO: check height correctness
 		vb := blockStore.LoadBlock(msg.Height)
+		if vb == nil {
+			// pruned, or above our height
+			return
+		}
 		commit := blockStore.LoadBlockCommit(msg.Height)
 		vb = vb.WithCommit(commit)
 
@@ -469,7 +575,7 @@ func NewP2PServer(
 	}
 
 	log.Info("Node has been started", "peer_id", h.ID().String(),
-		"addrs", fmt.Sprintf("%v", h.Addrs()))
+		"addrs", fmt.Sprintf("%v", h.Addrs()), "mode", mode)
 
 	return &Server{
 		Host:              h,
@@ -483,6 +589,15 @@ func NewP2PServer(
 		networkID:         networkID,
 		nodeName:          nodeName,
 		rootCtxCancel:     rootCtxCancel,
+		guard:             guard,
+		dedup:             dedup,
+		certAuth:          certAuth,
+		nodeInfo:          handshake,
+		catchUp:           newCatchUpTracker(),
+		mode:              mode,
+		eclipse:           guard.eclipse,
+		parts:             newPartStore(),
+		suspensions:       newMessageSuspensions(),
 	}, nil
 }
 
@@ -499,11 +614,15 @@ func (server *Server) Run(ctx context.Context) error {
 	topic := fmt.Sprintf("%s/%s", server.networkID, "broadcast")
 
 	log.Info("Subscribing pubsub topic", "topic", topic)
-	ps, err := pubsub.NewGossipSub(ctx, server.Host)
+	ps, err := pubsub.NewGossipSub(ctx, server.Host, pubsub.WithMessageIdFn(broadcastMsgID))
 	if err != nil {
 		panic(err)
 	}
 
+	if err := ps.RegisterTopicValidator(topic, server.validateBroadcast); err != nil {
+		return fmt.Errorf("failed to register topic validator: %w", err)
+	}
+
 	th, err := ps.Join(topic)
 	if err != nil {
 		return fmt.Errorf("failed to join topic: %w", err)
@@ -516,6 +635,11 @@ func (server *Server) Run(ctx context.Context) error {
 
 	// TODO: create a thread to send heartbeat?
 
+	if server.mode.dials() {
+		go server.dialRoutine(ctx)
+		go server.eclipseRoutine(ctx)
+	}
+
 	// h.Network().Notify(&network.NotifyBundle{ConnectedF: func(net network.Network, conn network.Conn) {
 	// 	// Must be in goroutine to prevent blocking the callback
 	// 	go func() {
@@ -541,23 +665,45 @@ func (server *Server) Run(ctx context.Context) error {
 			case <-ctx.Done():
 				return
 			case msg := <-server.sendC:
+				if server.isStale(msg) {
+					continue
+				}
+
 				var err error
 				var data []byte
 				switch m := (msg).(type) {
 				case *consensus.ProposalMessage:
-					data, err = encode(m.Proposal)
+					data, err = server.encodeProposalBroadcast(m.Proposal)
 					if err == nil {
 						err = th.Publish(ctx, data)
 						p2pMessagesSent.Inc()
 					}
 				case *consensus.VoteMessage:
+					if VoteRelays > 0 && server.sendToRelays(ctx, m.Vote) {
+						continue
+					}
 					data, err = encode(m.Vote)
 					if err == nil {
 						err = th.Publish(ctx, data)
 						p2pMessagesSent.Inc()
 					}
+				case *consensus.VoteExtension:
+					if server.dropSuspended(MessageVoteExtension, "sent") {
+						continue
+					}
+					data, err = encodeVoteExtension(m)
+					if err == nil {
+						err = th.Publish(ctx, data)
+						p2pMessagesSent.Inc()
+					}
+				case *consensus.DuplicateVoteEvidence:
+					go server.broadcastEvidence(ctx, m)
+				case *consensus.PeerMisbehavior:
+					server.penalize(ctx, peer.ID(m.PeerID), m.Err)
 				case *consensus.ConsensusSyncRequest:
 					server.consensusSyncChan <- m
+				case *consensus.WantCommit:
+					go server.requestCommit(ctx, m)
 				default:
 					log.Error("unrecognized data to sent")
 				}
@@ -598,6 +744,11 @@ func (server *Server) Run(ctx context.Context) error {
 			"raw", envelope.Data,
 			"from", envelope.GetFrom().String())
 
+		if server.isDuplicate("gossip", envelope.ReceivedFrom, msg, envelope.Data) {
+			p2pMessagesReceived.WithLabelValues("duplicate").Inc()
+			continue
+		}
+
 		switch m := msg.(type) {
 		case *consensus.Proposal:
 			server.obsvC <- consensus.MsgInfo{Msg: &consensus.ProposalMessage{Proposal: m}, PeerID: string(envelope.GetFrom())}
@@ -605,6 +756,11 @@ func (server *Server) Run(ctx context.Context) error {
 		case *consensus.Vote:
 			server.obsvC <- consensus.MsgInfo{Msg: &consensus.VoteMessage{Vote: m}, PeerID: string(envelope.GetFrom())}
 			p2pMessagesReceived.WithLabelValues("observation").Inc()
+		case *consensus.VoteExtension:
+			server.obsvC <- consensus.MsgInfo{Msg: m, PeerID: string(envelope.GetFrom())}
+			p2pMessagesReceived.WithLabelValues("observation").Inc()
+		case *ProposalParts:
+			server.addProposalParts(ctx, m, envelope.GetFrom(), envelope.ReceivedFrom)
 		case *HelloRequest:
 		case *HelloResponse:
 		case *GetFullBlockRequest:
@@ -618,11 +774,27 @@ func (server *Server) Run(ctx context.Context) error {
 	}
 }
 
+// Stop tells all the peers that the node shuts down, then closes the host.
+// The node stops the server once the root context is canceled, whatever
+// the cause, including the end of Run.
+func (server *Server) Stop() {
+	server.stopOnce.Do(func() {
+		DisconnectAll(context.Background(), server.Host, DisconnectShutdown)
+		if err := server.Host.Close(); err != nil {
+			log.Debug("failed to close host", "err", err)
+		}
+	})
+}
+
 func (server *Server) SetConsensusState(cs *consensus.ConsensusState) {
 	server.consensusState = cs
+	server.partsConsensus = cs
 
-	server.Host.SetStreamHandler(TopicConsensusSync, func(stream network.Stream) {
+	SetChannelHandler(server.Host, TopicConsensusSync, func(stream network.Stream) {
 		defer stream.Close()
+		if !server.isAuthorized(stream.Conn().RemotePeer()) {
+			return
+		}
 
 		data, err := ReadMsgWithPrependedSize(stream)
 		if err != nil {
@@ -640,54 +812,72 @@ func (server *Server) SetConsensusState(cs *consensus.ConsensusState) {
 			"req", &req,
 			"payload", data)
 
-		msgs, err := cs.ProcessSyncRequest(&req)
+		server.respondConsensusSync(stream, &req)
+	})
+	SetChannelHandler(server.Host, TopicSignedConsensusSync, server.handleSignedConsensusSync)
+	SetChannelHandler(server.Host, TopicSignedVotes, server.handleSignedVotes)
+	SetChannelHandler(server.Host, TopicEvidence, server.handleEvidence)
+	SetChannelHandler(server.Host, TopicWantCommit, server.handleWantCommit)
+	SetChannelHandler(server.Host, TopicCatchUp, server.handleCatchUp)
+	SetChannelHandler(server.Host, TopicBlockParts, server.handleBlockParts)
+	if server.nodeInfo.info.Relay {
+		SetChannelHandler(server.Host, TopicRelayVotes, server.handleRelayVote)
+	}
 
-		if err != nil {
-			return
-		}
+	go server.consensSyncRoutine()
+	go server.catchUpRoutine(server.ctx)
+}
 
-		resp := consensus.ConsensusSyncResponse{}
+// respondConsensusSync sends the messages the requester lacks.
+func (server *Server) respondConsensusSync(stream network.Stream, req *consensus.ConsensusSyncRequest) {
+	server.catchUp.reportHeight(stream.Conn().RemotePeer(), req.Height)
 
-		if len(msgs) == 1 {
-			fb, ok0 := msgs[0].(*consensus.FullBlock)
-			if ok0 {
-				resp.IsCommited = 1
-				bs0, err := fb.EncodeToRLPBytes()
-				if err != nil {
-					return
-				}
-				resp.MessageData = append(resp.MessageData, bs0)
-			}
-		}
+	msgs, err := server.consensusState.ProcessSyncRequest(req, string(stream.Conn().RemotePeer()))
 
-		if resp.IsCommited == 0 {
-			for _, lmsg := range msgs {
-				var data []byte
-				var err error
+	if err != nil {
+		return
+	}
 
-				switch m := (lmsg).(type) {
-				case *consensus.ProposalMessage:
-					data, err = encode(m.Proposal)
-				case *consensus.VoteMessage:
-					data, err = encode(m.Vote)
-				}
-				if err != nil {
-					return
-				}
-				resp.MessageData = append(resp.MessageData, data)
+	resp := consensus.ConsensusSyncResponse{}
+
+	if len(msgs) == 1 {
+		fb, ok0 := msgs[0].(*consensus.FullBlock)
+		if ok0 {
+			resp.IsCommited = 1
+			bs0, err := fb.EncodeToRLPBytes()
+			if err != nil {
+				return
 			}
+			resp.MessageData = append(resp.MessageData, bs0)
+			server.catchUp.markPushed(stream.Conn().RemotePeer(), req.Height, time.Now())
 		}
+	}
 
-		respData, err := rlp.EncodeToBytes(&resp)
-		if err != nil {
-			return
-		}
+	if resp.IsCommited == 0 {
+		for _, lmsg := range msgs {
+			var data []byte
+			var err error
 
-		err = WriteMsgWithPrependedSize(stream, respData)
-		if err != nil {
-			return
+			switch m := (lmsg).(type) {
+			case *consensus.ProposalMessage:
+				data, err = encodeProposalMsg(m.Proposal)
+			case *consensus.VoteMessage:
+				data, err = encode(m.Vote)
+			}
+			if err != nil {
+				return
+			}
+			resp.MessageData = append(resp.MessageData, data)
 		}
-	})
+	}
 
-	go server.consensSyncRoutine()
+	respData, err := rlp.EncodeToBytes(&resp)
+	if err != nil {
+		return
+	}
+
+	err = WriteMsgWithPrependedSize(stream, respData)
+	if err != nil {
+		return
+	}
 }
@@ -0,0 +1,317 @@
+package p2p
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/protocol"
+)
+
+// The libp2p TLS handshake authenticates the peer ID of the remote side with
+// a self-signed certificate, which says nothing about who runs the peer.
+// Networks with a policy of CA-managed certificates (e.g. the links between a
+// validator and its sentries) also require every peer to prove, right after
+// connecting, that it holds a certificate issued by the operator CA for its
+// peer ID: the certificate names the peer ID in a "libp2p:<peer ID>" URI SAN,
+// and the peer signs both peer IDs of the connection with the certificate
+// key. Peers failing to do so within peerCertTimeout are disconnected, and
+// their messages are ignored until then.
+
+// TopicPeerCert exchanges the CA-issued certificates of both sides of a
+// connection, see CertAuth.
+const TopicPeerCert = "/mpbft/dev/peer_cert/1.0.0"
+
+const (
+	peerCertTimeout   = 10 * time.Second
+	peerCertURIPrefix = "libp2p:"
+)
+
+var ErrPeerCertInvalid = errors.New("invalid peer certificate")
+
+func init() {
+	if err := RegisterChannel(ChannelDescriptor{
+		ID:             TopicPeerCert,
+		Priority:       ChannelPriorityHigh,
+		QueueCapacity:  32,
+		MaxMessageSize: 64 * 1024,
+		// only served by the nodes with a CertAuth
+		Optional: true,
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// PeerCertMessage is the certificate chain of a peer, leaf first, and its
+// signature of the connection with the leaf key.
+type PeerCertMessage struct {
+	Chain     [][]byte
+	Signature []byte
+}
+
+// CertAuth authenticates the peers with certificates of an operator CA.
+type CertAuth struct {
+	cert  tls.Certificate
+	roots *x509.CertPool
+
+	h        host.Host
+	mu       sync.Mutex
+	verified map[peer.ID]bool
+}
+
+// LoadCertAuth loads the PEM certificate chain and key of the node, and the
+// PEM certificates of the CA its peers must have certificates of.
+func LoadCertAuth(certFile, keyFile, caFile string) (*CertAuth, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load peer certificate: %w", err)
+	}
+	if _, ok := cert.PrivateKey.(crypto.Signer); !ok {
+		return nil, fmt.Errorf("unsupported peer certificate key %T", cert.PrivateKey)
+	}
+
+	caPEM, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CA certificates: %w", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no CA certificate in %s", caFile)
+	}
+
+	return &CertAuth{cert: cert, roots: roots, verified: make(map[peer.ID]bool)}, nil
+}
+
+// attach serves our certificate on the host and authenticates every peer
+// connecting to it. It must be called before any connection is made.
+func (ca *CertAuth) attach(h host.Host) {
+	ca.h = h
+	SetChannelHandler(h, TopicPeerCert, ca.handlePeerCert)
+	h.Network().Notify(&network.NotifyBundle{
+		ConnectedF: func(n network.Network, conn network.Conn) {
+			go ca.authenticate(conn.RemotePeer())
+		},
+		DisconnectedF: func(n network.Network, conn network.Conn) {
+			if n.Connectedness(conn.RemotePeer()) != network.Connected {
+				ca.mu.Lock()
+				delete(ca.verified, conn.RemotePeer())
+				ca.mu.Unlock()
+			}
+		},
+	})
+}
+
+// isVerified tells whether the peer proved it holds a certificate of the CA.
+func (ca *CertAuth) isVerified(p peer.ID) bool {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	return ca.verified[p]
+}
+
+func (ca *CertAuth) setVerified(p peer.ID) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	ca.verified[p] = true
+}
+
+// authenticate sends our certificate to a peer, and verifies the one it
+// answers with.
+func (ca *CertAuth) authenticate(p peer.ID) {
+	if ca.isVerified(p) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), peerCertTimeout)
+	defer cancel()
+
+	err := ca.exchange(ctx, p)
+	if err != nil {
+		ca.reject(p, err)
+		return
+	}
+	ca.setVerified(p)
+	log.Debug("Peer certificate verified", "peer", p)
+}
+
+func (ca *CertAuth) exchange(ctx context.Context, p peer.ID) error {
+	msg, err := ca.message(p)
+	if err != nil {
+		return err
+	}
+	data, err := rlp.EncodeToBytes(msg)
+	if err != nil {
+		return err
+	}
+
+	// not Send: the peer may not have announced its channels yet
+	stream, err := ca.h.NewStream(ctx, p, protocol.ID(TopicPeerCert))
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+	if ch, ok := lookupChannel(TopicPeerCert); ok {
+		stream = &channelStream{Stream: stream, maxMessageSize: ch.desc.MaxMessageSize}
+	}
+
+	if err := WriteMsgWithPrependedSize(stream, data); err != nil {
+		return err
+	}
+	respData, err := ReadMsgWithPrependedSize(stream)
+	if err != nil {
+		return err
+	}
+
+	var resp PeerCertMessage
+	if err := rlp.DecodeBytes(respData, &resp); err != nil {
+		return fmt.Errorf("%w: %v", ErrPeerCertInvalid, err)
+	}
+	return ca.verify(p, &resp)
+}
+
+func (ca *CertAuth) handlePeerCert(stream network.Stream) {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(peerCertTimeout))
+	p := stream.Conn().RemotePeer()
+
+	data, err := ReadMsgWithPrependedSize(stream)
+	if err != nil {
+		return
+	}
+	var req PeerCertMessage
+	if err := rlp.DecodeBytes(data, &req); err != nil {
+		ca.reject(p, fmt.Errorf("%w: %v", ErrPeerCertInvalid, err))
+		return
+	}
+	if err := ca.verify(p, &req); err != nil {
+		ca.reject(p, err)
+		return
+	}
+	ca.setVerified(p)
+
+	msg, err := ca.message(p)
+	if err != nil {
+		return
+	}
+	respData, err := rlp.EncodeToBytes(msg)
+	if err != nil {
+		return
+	}
+	WriteMsgWithPrependedSize(stream, respData)
+}
+
+func (ca *CertAuth) reject(p peer.ID, err error) {
+	log.Warn("Closing connection to peer without a valid certificate", "peer", p, "err", err)
+	recordDisconnect(string(p), DisconnectUnauthorized, false)
+	ca.h.Network().ClosePeer(p)
+}
+
+// peerCertSignBytes is what the peer from signs for the peer to, so the
+// signature cannot be replayed on other connections.
+func peerCertSignBytes(from, to peer.ID) []byte {
+	return []byte("mpbft peer cert:" + string(from) + ":" + string(to))
+}
+
+// message returns our certificate and signature for the peer.
+func (ca *CertAuth) message(p peer.ID) (*PeerCertMessage, error) {
+	signer := ca.cert.PrivateKey.(crypto.Signer)
+	msg := peerCertSignBytes(ca.h.ID(), p)
+
+	var sig []byte
+	var err error
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		sig, err = signer.Sign(rand.Reader, msg, crypto.Hash(0))
+	} else {
+		digest := sha256.Sum256(msg)
+		sig, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &PeerCertMessage{Chain: ca.cert.Certificate, Signature: sig}, nil
+}
+
+// verify verifies that the certificate of a peer is issued by the CA for its
+// peer ID, and that the peer holds its key.
+func (ca *CertAuth) verify(p peer.ID, msg *PeerCertMessage) error {
+	if len(msg.Chain) == 0 {
+		return fmt.Errorf("%w: no certificate", ErrPeerCertInvalid)
+	}
+	leaf, err := x509.ParseCertificate(msg.Chain[0])
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrPeerCertInvalid, err)
+	}
+	intermediates := x509.NewCertPool()
+	for _, der := range msg.Chain[1:] {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrPeerCertInvalid, err)
+		}
+		intermediates.AddCert(cert)
+	}
+
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         ca.roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return fmt.Errorf("%w: %v", ErrPeerCertInvalid, err)
+	}
+
+	named := false
+	for _, uri := range leaf.URIs {
+		if uri.String() == peerCertURIPrefix+p.String() {
+			named = true
+			break
+		}
+	}
+	if !named {
+		return fmt.Errorf("%w: not issued for peer %s", ErrPeerCertInvalid, p)
+	}
+
+	var algo x509.SignatureAlgorithm
+	switch leaf.PublicKeyAlgorithm {
+	case x509.Ed25519:
+		algo = x509.PureEd25519
+	case x509.ECDSA:
+		algo = x509.ECDSAWithSHA256
+	case x509.RSA:
+		algo = x509.SHA256WithRSA
+	default:
+		return fmt.Errorf("%w: unsupported key %v", ErrPeerCertInvalid, leaf.PublicKeyAlgorithm)
+	}
+	if err := leaf.CheckSignature(algo, peerCertSignBytes(p, ca.h.ID()), msg.Signature); err != nil {
+		return fmt.Errorf("%w: %v", ErrPeerCertInvalid, err)
+	}
+	return nil
+}
+
+// isAuthorized tells whether the messages of a peer are accepted: once it
+// passed the node info handshake and, with a CertAuth, proved it holds a
+// certificate.
+func (server *Server) isAuthorized(p peer.ID) bool {
+	if p == server.Host.ID() {
+		return true
+	}
+	return peerReady(server.nodeInfo, server.certAuth, p)
+}
+
+func peerReady(hs *nodeInfoHandshake, ca *CertAuth, p peer.ID) bool {
+	return hs.peerInfo(p) != nil && (ca == nil || ca.isVerified(p))
+}
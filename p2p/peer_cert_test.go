@@ -0,0 +1,116 @@
+package p2p
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	p2pcrypto "github.com/libp2p/go-libp2p-core/crypto"
+)
+
+type certTestHost struct {
+	host.Host
+	id peer.ID
+}
+
+func (h *certTestHost) ID() peer.ID { return h.id }
+
+type certTestCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newCertTestCA(t *testing.T) *certTestCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "operator CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &certTestCA{cert: cert, key: key}
+}
+
+func newCertTestPeer(t *testing.T) peer.ID {
+	priv, _, err := p2pcrypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	id, err := peer.IDFromPrivateKey(priv)
+	require.NoError(t, err)
+	return id
+}
+
+// certAuth returns the CertAuth of the peer id with a certificate of the CA
+// issued for the peer named, trusting the CA roots.
+func (ca *certTestCA) certAuth(t *testing.T, id peer.ID, named peer.ID, roots *certTestCA) *CertAuth {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	uri, err := url.Parse(peerCertURIPrefix + named.String())
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		URIs:         []*url.URL{uri},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, key.Public(), ca.key)
+	require.NoError(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(roots.cert)
+	return &CertAuth{
+		cert:     tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+		roots:    pool,
+		h:        &certTestHost{id: id},
+		verified: make(map[peer.ID]bool),
+	}
+}
+
+func TestCertAuthVerify(t *testing.T) {
+	ca, other := newCertTestCA(t), newCertTestCA(t)
+	a, b, c := newCertTestPeer(t), newCertTestPeer(t), newCertTestPeer(t)
+	authA, authB, authC := ca.certAuth(t, a, a, ca), ca.certAuth(t, b, b, ca), ca.certAuth(t, c, c, ca)
+
+	msg, err := authA.message(b)
+	require.NoError(t, err)
+	assert.NoError(t, authB.verify(a, msg))
+
+	// the certificate of another peer
+	assert.ErrorIs(t, authB.verify(c, msg), ErrPeerCertInvalid)
+	// the signature is for the connection to b only
+	assert.ErrorIs(t, authC.verify(a, msg), ErrPeerCertInvalid)
+
+	tampered := &PeerCertMessage{Chain: msg.Chain, Signature: append([]byte(nil), msg.Signature...)}
+	tampered.Signature[0] ^= 1
+	assert.ErrorIs(t, authB.verify(a, tampered), ErrPeerCertInvalid)
+	assert.ErrorIs(t, authB.verify(a, &PeerCertMessage{Signature: msg.Signature}), ErrPeerCertInvalid)
+	assert.ErrorIs(t, authB.verify(a, &PeerCertMessage{Chain: [][]byte{{1, 2, 3}}, Signature: msg.Signature}), ErrPeerCertInvalid)
+
+	// issued by another CA, or by the CA for another peer
+	msg, err = other.certAuth(t, a, a, ca).message(b)
+	require.NoError(t, err)
+	assert.ErrorIs(t, authB.verify(a, msg), ErrPeerCertInvalid)
+	msg, err = ca.certAuth(t, a, c, ca).message(b)
+	require.NoError(t, err)
+	assert.ErrorIs(t, authB.verify(a, msg), ErrPeerCertInvalid)
+}
@@ -0,0 +1,99 @@
+package p2p
+
+import (
+	"context"
+	"crypto/sha256"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Full nodes relay the broadcast messages like validators do: gossipsub
+// forwards what passes validateBroadcast, and the consensus state publishes
+// again what it adds, e.g., when it got it from a consensus sync.
+//
+// Messages are identified by their content instead of sender and sequence
+// number, so the copies published by every relay are the same message for the
+// seen cache of gossipsub and are dropped instead of flooding the network
+// again. All the nodes of a network must agree on message IDs for IHAVE/IWANT
+// gossip to work.
+
+var p2pStaleMessagesDropped = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "p2p_stale_messages_dropped_total",
+		Help: "Total number of queued proposals and votes dropped as consensus moved past them",
+	}, []string{"type"})
+
+// isStale tells whether a queued message is too old to be sent, see
+// consensus.IsStaleMessage.
+func (server *Server) isStale(msg consensus.Message) bool {
+	cs := server.consensusState
+	if cs == nil {
+		return false
+	}
+	height, round := cs.HeightRound()
+	if !consensus.IsStaleMessage(msg, height, round) {
+		return false
+	}
+
+	switch msg.(type) {
+	case *consensus.ProposalMessage:
+		p2pStaleMessagesDropped.WithLabelValues("proposal").Inc()
+	case *consensus.VoteMessage:
+		p2pStaleMessagesDropped.WithLabelValues("vote").Inc()
+	case *consensus.VoteExtension:
+		p2pStaleMessagesDropped.WithLabelValues("vote_extension").Inc()
+	}
+	log.Debug("Dropping stale message", "msg", msg, "height", height, "round", round)
+	return true
+}
+
+// broadcastMsgID identifies a broadcast message by the hash of its data.
+func broadcastMsgID(m *pb.Message) string {
+	h := sha256.Sum256(m.Data)
+	return string(h[:])
+}
+
+// validateBroadcast keeps gossipsub from forwarding invalid messages,
+// proposals and votes we already hold, and suspended messages. Our own
+// messages are always accepted.
+func (server *Server) validateBroadcast(ctx context.Context, from peer.ID, m *pubsub.Message) pubsub.ValidationResult {
+	if from == server.Host.ID() {
+		return pubsub.ValidationAccept
+	}
+	if !server.isAuthorized(from) {
+		return pubsub.ValidationIgnore
+	}
+
+	msg, err := decode(m.Data)
+	if err != nil {
+		p2pMessagesReceived.WithLabelValues("invalid").Inc()
+		return pubsub.ValidationReject
+	}
+
+	if _, ok := msg.(*consensus.VoteExtension); ok && server.dropSuspended(MessageVoteExtension, "received") {
+		return pubsub.ValidationIgnore
+	}
+
+	cs := server.consensusState
+	if cs == nil {
+		return pubsub.ValidationAccept
+	}
+	switch msg := msg.(type) {
+	case *consensus.Proposal:
+		if cs.HasProposal(msg) {
+			p2pMessagesReceived.WithLabelValues("duplicate").Inc()
+			return pubsub.ValidationIgnore
+		}
+	case *consensus.Vote:
+		if cs.HasVote(msg) {
+			p2pMessagesReceived.WithLabelValues("duplicate").Inc()
+			return pubsub.ValidationIgnore
+		}
+	}
+	return pubsub.ValidationAccept
+}
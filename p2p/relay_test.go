@@ -0,0 +1,81 @@
+package p2p
+
+import (
+	"context"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func makeRelayTestVote() *consensus.Vote {
+	return &consensus.Vote{
+		Type:             consensus.PrevoteType,
+		Height:           4,
+		Round:            1,
+		TimestampMs:      1000,
+		BlockID:          common.BytesToHash([]byte{1, 2}),
+		ValidatorAddress: common.BigToAddress(big.NewInt(12345)),
+		ValidatorIndex:   5,
+		Signature:        []byte{'2'},
+	}
+}
+
+func TestBroadcastMsgID(t *testing.T) {
+	vote := makeRelayTestVote()
+	data, err := encode(vote)
+	require.NoError(t, err)
+
+	// the copies of every relay are the same message
+	a := &pb.Message{From: []byte("a"), Seqno: []byte{1}, Data: data}
+	b := &pb.Message{From: []byte("b"), Seqno: []byte{7}, Data: append([]byte{}, data...)}
+	assert.Equal(t, broadcastMsgID(a), broadcastMsgID(b))
+
+	vote.Round++
+	other, err := encode(vote)
+	require.NoError(t, err)
+	assert.NotEqual(t, broadcastMsgID(a), broadcastMsgID(&pb.Message{From: []byte("a"), Seqno: []byte{1}, Data: other}))
+}
+
+func TestValidateBroadcast(t *testing.T) {
+	h, err := mocknet.New(context.Background()).GenPeer()
+	require.NoError(t, err)
+	const ready, unknown = peer.ID("ready"), peer.ID("unknown")
+	server := &Server{
+		Host:        h,
+		nodeInfo:    &nodeInfoHandshake{peers: map[peer.ID]*NodeInfo{ready: {}}},
+		suspensions: newMessageSuspensions(),
+	}
+	validate := func(from peer.ID, data []byte) pubsub.ValidationResult {
+		return server.validateBroadcast(context.Background(), from, &pubsub.Message{Message: &pb.Message{Data: data}})
+	}
+
+	vote, err := encode(makeRelayTestVote())
+	require.NoError(t, err)
+	ext, err := encodeVoteExtension(&consensus.VoteExtension{Height: 4, BlockID: common.HexToHash("0x02"), Signature: []byte{1}})
+	require.NoError(t, err)
+
+	assert.Equal(t, pubsub.ValidationAccept, validate(ready, vote))
+	assert.Equal(t, pubsub.ValidationAccept, validate(ready, ext))
+	// before its handshake
+	assert.Equal(t, pubsub.ValidationIgnore, validate(unknown, vote))
+	// not forwarded, and the sender penalized
+	assert.Equal(t, pubsub.ValidationReject, validate(ready, []byte{0xff, 1, 2}))
+	assert.Equal(t, pubsub.ValidationReject, validate(ready, nil))
+	// ours, whatever it is
+	assert.Equal(t, pubsub.ValidationAccept, validate(h.ID(), nil))
+
+	_, err = server.SuspendMessages([]string{MessageVoteExtension}, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, pubsub.ValidationIgnore, validate(ready, ext))
+	assert.Equal(t, pubsub.ValidationAccept, validate(ready, vote))
+	assert.Equal(t, pubsub.ValidationAccept, validate(h.ID(), ext))
+}
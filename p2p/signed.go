@@ -0,0 +1,128 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TopicSignedConsensusSync carries the same requests as TopicConsensusSync,
+// signed by the node key of the sender. The request is the round step and
+// has-vote hints of the sender, so signing it makes a peer accountable for
+// the hints it gossips, beyond what the transport authenticates.
+const TopicSignedConsensusSync = "/mpbft/dev/consensus_sync_signed/1.0.0"
+
+var ErrInvalidMessageSignature = errors.New("invalid message signature")
+
+// SignControlMessages makes the node sign its consensus sync requests to the
+// peers supporting it.
+var SignControlMessages = false
+
+var p2pSignedMessagesReceived = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "p2p_signed_control_messages_received_total",
+		Help: "Total number of signed control messages received by signature validity",
+	}, []string{"result"})
+
+func init() {
+	if err := RegisterChannel(ChannelDescriptor{
+		ID:             TopicSignedConsensusSync,
+		Priority:       ChannelPriorityHigh,
+		QueueCapacity:  64,
+		MaxMessageSize: 32 * 1024 * 1024,
+		Optional:       true,
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// SignedMessage is a message signed with the node key of its sender. The
+// signature covers the topic, so it cannot be replayed on another one.
+type SignedMessage struct {
+	Payload   []byte
+	Signature []byte
+}
+
+func signBytes(topic string, payload []byte) []byte {
+	return append([]byte(topic+"\x00"), payload...)
+}
+
+func SignMessage(priv crypto.PrivKey, topic string, msg interface{}) (*SignedMessage, error) {
+	payload, err := rlp.EncodeToBytes(msg)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := priv.Sign(signBytes(topic, payload))
+	if err != nil {
+		return nil, err
+	}
+	return &SignedMessage{Payload: payload, Signature: sig}, nil
+}
+
+// Verify checks the message was signed by the node key of p.
+func (m *SignedMessage) Verify(p peer.ID, topic string) error {
+	pubKey, err := p.ExtractPublicKey()
+	if err != nil {
+		return fmt.Errorf("%w: no public key in peer id %v: %v", ErrInvalidMessageSignature, p, err)
+	}
+	ok, err := pubKey.Verify(signBytes(topic, m.Payload), m.Signature)
+	if err != nil || !ok {
+		return fmt.Errorf("%w: from %v", ErrInvalidMessageSignature, p)
+	}
+	return nil
+}
+
+func (server *Server) handleSignedConsensusSync(stream network.Stream) {
+	defer stream.Close()
+
+	p := stream.Conn().RemotePeer()
+	if !server.isAuthorized(p) {
+		return
+	}
+
+	data, err := ReadMsgWithPrependedSize(stream)
+	if err != nil {
+		return
+	}
+
+	var msg SignedMessage
+	if err := rlp.DecodeBytes(data, &msg); err != nil {
+		return
+	}
+	if err := msg.Verify(p, TopicSignedConsensusSync); err != nil {
+		p2pSignedMessagesReceived.WithLabelValues("invalid").Inc()
+		log.Debug("dropping signed consensus_sync_req", "peer", p, "err", err)
+		return
+	}
+	p2pSignedMessagesReceived.WithLabelValues("valid").Inc()
+
+	var req consensus.ConsensusSyncRequest
+	if err := rlp.DecodeBytes(msg.Payload, &req); err != nil {
+		return
+	}
+
+	log.Debug("received signed consensus_sync_req", "req", &req, "peer", p)
+
+	server.respondConsensusSync(stream, &req)
+}
+
+// sendConsensusSync sends a consensus sync request, signed if enabled and
+// supported by the peer.
+func (server *Server) sendConsensusSync(p peer.ID, req *consensus.ConsensusSyncRequest, resp *consensus.ConsensusSyncResponse) error {
+	if !SignControlMessages || !PeerSupports(server.Host, p, TopicSignedConsensusSync) {
+		return SendRPC(server.ctx, server.Host, p, TopicConsensusSync, req, resp)
+	}
+
+	msg, err := SignMessage(server.priv, TopicSignedConsensusSync, req)
+	if err != nil {
+		return err
+	}
+	return SendRPC(server.ctx, server.Host, p, TopicSignedConsensusSync, msg, resp)
+}
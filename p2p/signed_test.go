@@ -0,0 +1,125 @@
+package p2p
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/ethereum/go-ethereum/rlp"
+	p2pcrypto "github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// genSigningPeer adds a peer to mn whose id embeds its public key, as the
+// node keys do, unlike the keys of mocknet.GenPeer.
+func genSigningPeer(t *testing.T, mn mocknet.Mocknet) host.Host {
+	priv, _, err := p2pcrypto.GenerateEd25519Key(rand.Reader)
+	require.NoError(t, err)
+	h, err := mn.AddPeer(priv, multiaddr.StringCast(fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", 4000+len(mn.Peers()))))
+	require.NoError(t, err)
+	return h
+}
+
+func TestSignedMessageVerify(t *testing.T) {
+	mn := mocknet.New(context.Background())
+	a, b := genSigningPeer(t, mn), genSigningPeer(t, mn)
+	priv := a.Peerstore().PrivKey(a.ID())
+
+	req := &consensus.ConsensusSyncRequest{Height: 7, Round: 1}
+	msg, err := SignMessage(priv, TopicSignedConsensusSync, req)
+	require.NoError(t, err)
+	assert.NoError(t, msg.Verify(a.ID(), TopicSignedConsensusSync))
+
+	var decoded consensus.ConsensusSyncRequest
+	require.NoError(t, rlp.DecodeBytes(msg.Payload, &decoded))
+	assert.Equal(t, req.Height, decoded.Height)
+	assert.Equal(t, req.Round, decoded.Round)
+
+	// not replayable on another topic, nor as another peer
+	assert.ErrorIs(t, msg.Verify(a.ID(), TopicConsensusSync), ErrInvalidMessageSignature)
+	assert.ErrorIs(t, msg.Verify(b.ID(), TopicSignedConsensusSync), ErrInvalidMessageSignature)
+
+	tampered := &SignedMessage{Payload: append([]byte{}, msg.Payload...), Signature: msg.Signature}
+	tampered.Payload[len(tampered.Payload)-1]++
+	assert.ErrorIs(t, tampered.Verify(a.ID(), TopicSignedConsensusSync), ErrInvalidMessageSignature)
+}
+
+// serveConsensusSyncTopics answers the consensus sync requests on h, on the
+// signed topic too if signed, and reports the topic of each request with a
+// valid signature, if any.
+func serveConsensusSyncTopics(t *testing.T, h host.Host, signed bool, topicC chan<- string) {
+	respond := func(stream network.Stream) {
+		resp, err := rlp.EncodeToBytes(&consensus.ConsensusSyncResponse{})
+		require.NoError(t, err)
+		WriteMsgWithPrependedSize(stream, resp)
+	}
+
+	SetChannelHandler(h, TopicConsensusSync, func(stream network.Stream) {
+		defer stream.Close()
+		if _, err := ReadMsgWithPrependedSize(stream); err != nil {
+			return
+		}
+		topicC <- TopicConsensusSync
+		respond(stream)
+	})
+	if !signed {
+		return
+	}
+	SetChannelHandler(h, TopicSignedConsensusSync, func(stream network.Stream) {
+		defer stream.Close()
+		data, err := ReadMsgWithPrependedSize(stream)
+		if err != nil {
+			return
+		}
+		var msg SignedMessage
+		if err := rlp.DecodeBytes(data, &msg); err != nil {
+			return
+		}
+		if err := msg.Verify(stream.Conn().RemotePeer(), TopicSignedConsensusSync); err != nil {
+			return
+		}
+		topicC <- TopicSignedConsensusSync
+		respond(stream)
+	})
+}
+
+func TestSendConsensusSyncSigned(t *testing.T) {
+	defer func(sign bool) { SignControlMessages = sign }(SignControlMessages)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mn := mocknet.New(ctx)
+	a, signing, legacy := genSigningPeer(t, mn), genSigningPeer(t, mn), genSigningPeer(t, mn)
+	topicC := make(chan string, 1)
+	serveConsensusSyncTopics(t, signing, true, topicC)
+	serveConsensusSyncTopics(t, legacy, false, topicC)
+	require.NoError(t, mn.LinkAll())
+	require.NoError(t, mn.ConnectAllButSelf())
+	// the protocols are known after the identify handshake
+	require.Eventually(t, func() bool {
+		return PeerSupports(a, signing.ID(), TopicSignedConsensusSync) && PeerSupports(a, legacy.ID(), TopicConsensusSync)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	server := &Server{Host: a, ctx: ctx, priv: a.Peerstore().PrivKey(a.ID())}
+	send := func(h host.Host) string {
+		req := &consensus.ConsensusSyncRequest{Height: 3}
+		require.NoError(t, server.sendConsensusSync(h.ID(), req, &consensus.ConsensusSyncResponse{}))
+		return <-topicC
+	}
+
+	SignControlMessages = false
+	assert.Equal(t, TopicConsensusSync, send(signing))
+
+	SignControlMessages = true
+	assert.Equal(t, TopicSignedConsensusSync, send(signing))
+	// the peers not supporting it get the unsigned requests
+	assert.Equal(t, TopicConsensusSync, send(legacy))
+}
@@ -0,0 +1,145 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The kinds of messages an operator can suspend during an incident, e.g., to
+// contain a bug triggered by some evidence or tx. Proposals, votes, block
+// parts and consensus syncs cannot be suspended: consensus needs them to make
+// progress.
+const (
+	MessageEvidence      = "evidence"
+	MessageTxs           = "txs"
+	MessageVoteExtension = "vote_extension"
+	MessageCatchUp       = "catch_up"
+	MessageWantCommit    = "want_commit"
+)
+
+// MaxMessageSuspension caps how long messages are suspended at once, so that
+// a forgotten suspension does not outlive the incident for good.
+const MaxMessageSuspension = 24 * time.Hour
+
+var (
+	ErrUnknownMessageKind = errors.New("unknown or unsuspendable message kind")
+	ErrInvalidSuspension  = errors.New("invalid suspension duration")
+)
+
+var suspendableMessages = map[string]bool{
+	MessageEvidence:      true,
+	MessageTxs:           true,
+	MessageVoteExtension: true,
+	MessageCatchUp:       true,
+	MessageWantCommit:    true,
+}
+
+var p2pSuspendedMessagesDropped = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "p2p_suspended_messages_dropped_total",
+		Help: "Total number of messages neither processed nor sent while their kind is suspended, by kind and direction",
+	}, []string{"kind", "direction"})
+
+// MessageSuspension is a kind of messages suspended until a time.
+type MessageSuspension struct {
+	Kind    string `json:"kind"`
+	UntilMs uint64 `json:"until_ms"`
+}
+
+type messageSuspensions struct {
+	mu    sync.RWMutex
+	until map[string]time.Time
+}
+
+func newMessageSuspensions() *messageSuspensions {
+	return &messageSuspensions{until: make(map[string]time.Time)}
+}
+
+func (s *messageSuspensions) suspend(kinds []string, until time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, kind := range kinds {
+		s.until[kind] = until
+	}
+}
+
+func (s *messageSuspensions) resume(kinds []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, kind := range kinds {
+		delete(s.until, kind)
+	}
+}
+
+func (s *messageSuspensions) suspended(kind string, now time.Time) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	until, ok := s.until[kind]
+	return ok && now.Before(until)
+}
+
+// list returns the suspensions not over at now, by kind.
+func (s *messageSuspensions) list(now time.Time) []MessageSuspension {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]MessageSuspension, 0, len(s.until))
+	for kind, until := range s.until {
+		if now.Before(until) {
+			result = append(result, MessageSuspension{Kind: kind, UntilMs: uint64(until.UnixMilli())})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Kind < result[j].Kind })
+	return result
+}
+
+// SuspendMessages stops processing, relaying and sending the messages of the
+// given kinds for d, and returns the current suspensions. Suspending a kind
+// again replaces its suspension.
+func (server *Server) SuspendMessages(kinds []string, d time.Duration) ([]MessageSuspension, error) {
+	for _, kind := range kinds {
+		if !suspendableMessages[kind] {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownMessageKind, kind)
+		}
+	}
+	if d <= 0 || d > MaxMessageSuspension {
+		return nil, fmt.Errorf("%w: %v, must be positive and at most %v", ErrInvalidSuspension, d, MaxMessageSuspension)
+	}
+
+	now := time.Now()
+	server.suspensions.suspend(kinds, now.Add(d))
+	log.Warn("Suspended messages", "kinds", kinds, "for", d)
+	return server.suspensions.list(now), nil
+}
+
+// ResumeMessages cancels the suspensions of the given kinds, and returns the
+// remaining ones.
+func (server *Server) ResumeMessages(kinds []string) []MessageSuspension {
+	server.suspensions.resume(kinds)
+	log.Info("Resumed messages", "kinds", kinds)
+	return server.suspensions.list(time.Now())
+}
+
+// MessageSuspensions returns the current suspensions.
+func (server *Server) MessageSuspensions() []MessageSuspension {
+	return server.suspensions.list(time.Now())
+}
+
+// dropSuspended tells whether a message of kind is dropped as suspended,
+// direction being "received" or "sent".
+func (server *Server) dropSuspended(kind string, direction string) bool {
+	if !server.suspensions.suspended(kind, time.Now()) {
+		return false
+	}
+	p2pSuspendedMessagesDropped.WithLabelValues(kind, direction).Inc()
+	return true
+}
@@ -0,0 +1,39 @@
+package p2p
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSuspendMessages(t *testing.T) {
+	server := &Server{suspensions: newMessageSuspensions()}
+
+	_, err := server.SuspendMessages([]string{MessageTxs, "vote"}, time.Minute)
+	assert.True(t, errors.Is(err, ErrUnknownMessageKind))
+	_, err = server.SuspendMessages([]string{MessageTxs}, 0)
+	assert.True(t, errors.Is(err, ErrInvalidSuspension))
+	_, err = server.SuspendMessages([]string{MessageTxs}, 2*MaxMessageSuspension)
+	assert.True(t, errors.Is(err, ErrInvalidSuspension))
+	assert.Empty(t, server.MessageSuspensions())
+
+	suspensions, err := server.SuspendMessages([]string{MessageTxs, MessageEvidence}, time.Minute)
+	require.NoError(t, err)
+	require.Len(t, suspensions, 2)
+	assert.Equal(t, MessageEvidence, suspensions[0].Kind)
+	assert.True(t, server.dropSuspended(MessageTxs, "received"))
+	assert.False(t, server.dropSuspended(MessageCatchUp, "sent"))
+
+	suspensions = server.ResumeMessages([]string{MessageEvidence})
+	assert.Equal(t, []string{MessageTxs}, []string{suspensions[0].Kind})
+	assert.False(t, server.dropSuspended(MessageEvidence, "received"))
+
+	// over
+	now := time.Now()
+	server.suspensions.suspend([]string{MessageWantCommit}, now.Add(-time.Second))
+	assert.False(t, server.dropSuspended(MessageWantCommit, "sent"))
+	assert.Len(t, server.suspensions.list(now), 1)
+}
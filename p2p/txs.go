@@ -0,0 +1,134 @@
+package p2p
+
+import (
+	"context"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TopicTxs carries the txs admitted to the mempools. Like the evidence, they
+// are not gossiped with the consensus messages: every node sends the txs it
+// admits to its peers, but the one it got them from, and the peers already
+// holding them refuse them, so that a tx floods the network once.
+const TopicTxs = "/mpbft/dev/txs/1.0.0"
+
+const (
+	txSendTTL      = 5 * time.Second
+	txGossipQueue  = 1024
+	maxTxGossipMsg = 1024 * 1024
+)
+
+var p2pGossipedTxs = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "p2p_gossiped_txs_total",
+		Help: "Total number of txs gossiped, by direction: sent, received, or dropped when the queue is full",
+	}, []string{"direction"})
+
+func init() {
+	if err := RegisterChannel(ChannelDescriptor{
+		ID:             TopicTxs,
+		Priority:       ChannelPriorityLow,
+		QueueCapacity:  256,
+		MaxMessageSize: maxTxGossipMsg,
+		Optional:       true,
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// TxPool admits the txs received from the peers, see mempool.Mempool.
+type TxPool interface {
+	CheckTx(ctx context.Context, tx *types.Transaction, from string) error
+	SetGossip(gossip func(tx *types.Transaction, from string))
+}
+
+type gossipTx struct {
+	tx   *types.Transaction
+	from peer.ID
+}
+
+// SetMempool gossips the txs admitted to pool, and admits the txs of the
+// peers to it.
+func (server *Server) SetMempool(pool TxPool) {
+	server.txPool = pool
+	server.txC = make(chan gossipTx, txGossipQueue)
+	SetChannelHandler(server.Host, TopicTxs, server.handleTx)
+	pool.SetGossip(server.queueTx)
+	go server.txGossipRoutine(server.ctx)
+}
+
+func (server *Server) handleTx(stream network.Stream) {
+	defer stream.Close()
+
+	p := stream.Conn().RemotePeer()
+	if !server.isAuthorized(p) || server.dropSuspended(MessageTxs, "received") {
+		return
+	}
+
+	data, err := ReadMsgWithPrependedSize(stream)
+	if err != nil {
+		return
+	}
+	tx := new(types.Transaction)
+	if err := rlp.DecodeBytes(data, tx); err != nil {
+		p2pMessagesReceived.WithLabelValues("invalid").Inc()
+		log.Debug("received invalid tx", "peer", p, "err", err)
+		return
+	}
+
+	p2pGossipedTxs.WithLabelValues("received").Inc()
+	if err := server.txPool.CheckTx(server.ctx, tx, string(p)); err != nil {
+		log.Trace("tx of peer not admitted", "peer", p, "hash", tx.Hash(), "err", err)
+	}
+}
+
+// queueTx queues a tx admitted to the mempool for the gossip routine. It
+// never blocks the mempool: the tx is dropped when the queue is full.
+func (server *Server) queueTx(tx *types.Transaction, from string) {
+	if server.dropSuspended(MessageTxs, "sent") {
+		return
+	}
+
+	select {
+	case server.txC <- gossipTx{tx: tx, from: peer.ID(from)}:
+	default:
+		p2pGossipedTxs.WithLabelValues("dropped").Inc()
+	}
+}
+
+func (server *Server) txGossipRoutine(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case gtx := <-server.txC:
+			server.broadcastTx(ctx, gtx.tx, gtx.from)
+		}
+	}
+}
+
+// broadcastTx sends tx to the peers supporting the tx channel but from.
+func (server *Server) broadcastTx(ctx context.Context, tx *types.Transaction, from peer.ID) {
+	ctx, cancel := context.WithTimeout(ctx, txSendTTL)
+	defer cancel()
+
+	for _, p := range PeersSupporting(server.Host, TopicTxs) {
+		if p == from || !server.isAuthorized(p) {
+			continue
+		}
+		s, err := Send(ctx, server.Host, p, TopicTxs, tx)
+		if err != nil {
+			log.Debug("Failed to send tx", "peer", p, "err", err)
+			continue
+		}
+		s.Close()
+		p2pMessagesSent.Inc()
+		p2pGossipedTxs.WithLabelValues("sent").Inc()
+	}
+}
@@ -0,0 +1,31 @@
+package p2p
+
+import (
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// MsgVoteExtension is a consensus.VoteExtension, gossiped like the precommit
+// it extends. Older nodes do not decode it, which only loses them the
+// extensions.
+const MsgVoteExtension = 0x08
+
+func init() {
+	decoder[MsgVoteExtension] = decodeVoteExtension
+}
+
+func decodeVoteExtension(data []byte) (interface{}, error) {
+	ext := &consensus.VoteExtension{}
+	if err := rlp.DecodeBytes(data, ext); err != nil {
+		return nil, err
+	}
+	return ext, ext.ValidateBasic()
+}
+
+func encodeVoteExtension(ext *consensus.VoteExtension) ([]byte, error) {
+	data, err := rlp.EncodeToBytes(ext)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{MsgVoteExtension}, data...), nil
+}
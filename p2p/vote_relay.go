@@ -0,0 +1,116 @@
+package p2p
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TopicRelayVotes carries the votes of a validator on a constrained uplink to
+// its relays. Publishing a vote on the gossip topic sends it to every peer of
+// the mesh; with VoteRelays, the validator sends it once to a few peers
+// announcing NodeInfo.Relay instead, and they take it to the network: a
+// relay adds the vote to its consensus state, which publishes what it adds.
+// Without a relay connected, the votes are gossiped as usual.
+const TopicRelayVotes = "/mpbft/dev/relay_votes/1.0.0"
+
+const relaySendTTL = 2 * time.Second
+
+// VoteRelays is the number of relays to send our votes to, 0 to gossip them.
+var VoteRelays = 0
+
+var p2pRelayedVotes = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "p2p_relayed_votes_total",
+		Help: "Total number of votes sent to our relays, or relayed for peers, by direction",
+	}, []string{"direction"})
+
+func init() {
+	if err := RegisterChannel(ChannelDescriptor{
+		ID:             TopicRelayVotes,
+		Priority:       ChannelPriorityHigh,
+		QueueCapacity:  64,
+		MaxMessageSize: 16 * 1024,
+		Optional:       true,
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// handleRelayVote takes a vote of a peer to our consensus state, to be
+// published on its behalf. It is only served if we announce NodeInfo.Relay.
+func (server *Server) handleRelayVote(stream network.Stream) {
+	defer stream.Close()
+
+	p := stream.Conn().RemotePeer()
+	if !server.isAuthorized(p) {
+		return
+	}
+
+	data, err := ReadMsgWithPrependedSize(stream)
+	if err != nil {
+		return
+	}
+	vote := &consensus.Vote{}
+	err = rlp.DecodeBytes(data, vote)
+	if err == nil {
+		err = consensus.ValidateSignatureSize(vote.Signature)
+	}
+	if err != nil || vote.ValidateBasic() != nil {
+		p2pMessagesReceived.WithLabelValues("invalid").Inc()
+		log.Debug("received invalid vote to relay", "peer", p, "err", err)
+		return
+	}
+
+	p2pRelayedVotes.WithLabelValues("relayed").Inc()
+	server.obsvC <- consensus.MsgInfo{Msg: &consensus.VoteMessage{Vote: vote}, PeerID: string(p)}
+}
+
+// relayPeers returns up to VoteRelays ready peers relaying votes. They are
+// taken in the order of their IDs, so that the same relays are used as long
+// as they stay connected.
+func (server *Server) relayPeers() []peer.ID {
+	var relays []peer.ID
+	for _, p := range PeersSupporting(server.Host, TopicRelayVotes) {
+		if info := server.nodeInfo.peerInfo(p); info != nil && info.Relay && server.isAuthorized(p) {
+			relays = append(relays, p)
+		}
+	}
+	sort.Slice(relays, func(i, j int) bool { return relays[i] < relays[j] })
+	if len(relays) > VoteRelays {
+		relays = relays[:VoteRelays]
+	}
+	return relays
+}
+
+// sendToRelays sends a vote to our relays, and tells whether any took it.
+func (server *Server) sendToRelays(ctx context.Context, vote *consensus.Vote) bool {
+	relays := server.relayPeers()
+	if len(relays) == 0 {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, relaySendTTL)
+	defer cancel()
+
+	sent := false
+	for _, p := range relays {
+		s, err := Send(ctx, server.Host, p, TopicRelayVotes, vote)
+		if err != nil {
+			log.Debug("Failed to send vote to relay", "peer", p, "err", err)
+			continue
+		}
+		s.Close()
+		sent = true
+		p2pMessagesSent.Inc()
+		p2pRelayedVotes.WithLabelValues("sent").Inc()
+	}
+	return sent
+}
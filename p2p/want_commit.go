@@ -0,0 +1,118 @@
+package p2p
+
+import (
+	"context"
+	"time"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// TopicWantCommit serves the commits of the stored heights, see
+// consensus.WantCommit.
+const TopicWantCommit = "/mpbft/dev/want_commit/1.0.0"
+
+const wantCommitTimeout = 5 * time.Second
+
+func init() {
+	if err := RegisterChannel(ChannelDescriptor{
+		ID:             TopicWantCommit,
+		Priority:       ChannelPriorityHigh,
+		QueueCapacity:  32,
+		MaxMessageSize: 4 * 1024 * 1024,
+		Optional:       true,
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// WantCommitResponse carries the RLP encoded commit, empty if the peer does
+// not have it.
+type WantCommitResponse struct {
+	Commit []byte
+}
+
+func (server *Server) handleWantCommit(stream network.Stream) {
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(wantCommitTimeout))
+
+	if !server.isAuthorized(stream.Conn().RemotePeer()) || server.dropSuspended(MessageWantCommit, "received") {
+		return
+	}
+
+	data, err := ReadMsgWithPrependedSize(stream)
+	if err != nil {
+		return
+	}
+	var req consensus.WantCommit
+	if err := rlp.DecodeBytes(data, &req); err != nil || req.ValidateBasic() != nil {
+		return
+	}
+
+	resp := WantCommitResponse{}
+	if commit := server.consensusState.LoadCommit(req.Height); commit != nil {
+		if resp.Commit, err = rlp.EncodeToBytes(commit); err != nil {
+			return
+		}
+	}
+	respData, err := rlp.EncodeToBytes(&resp)
+	if err != nil {
+		return
+	}
+	WriteMsgWithPrependedSize(stream, respData)
+}
+
+// requestCommit asks a random peer for the commit of a height and adds its
+// precommits as votes.
+func (server *Server) requestCommit(ctx context.Context, req *consensus.WantCommit) {
+	if server.dropSuspended(MessageWantCommit, "sent") {
+		return
+	}
+
+	var ps []peer.ID
+	for _, p := range PeersSupporting(server.Host, TopicWantCommit) {
+		if server.isAuthorized(p) {
+			ps = append(ps, p)
+		}
+	}
+	if len(ps) == 0 {
+		return
+	}
+	p := PickRandom(ps, 1)[0]
+
+	ctx, cancel := context.WithTimeout(ctx, wantCommitTimeout)
+	defer cancel()
+
+	resp := &WantCommitResponse{}
+	if err := SendRPC(ctx, server.Host, p, TopicWantCommit, req, resp); err != nil {
+		log.Debug("Failed to request commit", "peer", p, "height", req.Height, "err", err)
+		return
+	}
+	if len(resp.Commit) == 0 {
+		return
+	}
+
+	commit := &consensus.Commit{}
+	err := rlp.DecodeBytes(resp.Commit, commit)
+	if err == nil {
+		err = consensus.ValidateCommitSignatureSizes(commit)
+	}
+	if err != nil || commit.Height != req.Height {
+		log.Debug("received invalid commit", "peer", p, "height", req.Height, "err", err)
+		p2pMessagesReceived.WithLabelValues("invalid").Inc()
+		return
+	}
+
+	log.Debug("received commit", "peer", p, "height", commit.Height, "round", commit.Round)
+	p2pMessagesReceived.WithLabelValues("commit").Inc()
+	for _, vote := range consensus.CommitVotes(commit) {
+		select {
+		case server.obsvC <- consensus.MsgInfo{Msg: &consensus.VoteMessage{Vote: vote}, PeerID: string(p)}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
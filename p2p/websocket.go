@@ -0,0 +1,38 @@
+package p2p
+
+import (
+	"fmt"
+
+	"github.com/libp2p/go-libp2p"
+	websocket "github.com/libp2p/go-ws-transport"
+)
+
+// WebsocketPort is the TCP port the node also listens on with websockets, 0
+// to only listen on QUIC. Nodes behind firewalls letting only web traffic
+// out reach the peers listening on 443 this way: the transport is picked by
+// the address format, /tcp/443/ws instead of /udp/8999/quic, so they simply
+// list such addresses in their bootstrap peers. Every node dials websocket
+// addresses, whatever its port.
+//
+// The connections are secured by the same TLS handshake as the QUIC ones,
+// inside the websocket. Firewalls inspecting the traffic for HTTPS want a
+// TLS-terminating proxy in front of the port, forwarding to it as plain ws.
+var WebsocketPort uint = 0
+
+// websocketListenAddrs returns the websocket addresses to listen on, none
+// if WebsocketPort is not set.
+func websocketListenAddrs() []string {
+	if WebsocketPort == 0 {
+		return nil
+	}
+	return []string{
+		fmt.Sprintf("/ip4/0.0.0.0/tcp/%d/ws", WebsocketPort),
+		fmt.Sprintf("/ip6/::/tcp/%d/ws", WebsocketPort),
+	}
+}
+
+// websocketTransport dials, and serves if listening, websocket addresses.
+// Unlike QUIC, they are multiplexed by yamux or mplex, the libp2p defaults.
+func websocketTransport() libp2p.Option {
+	return libp2p.Transport(websocket.New)
+}
@@ -0,0 +1,60 @@
+package p2p
+
+import (
+	"context"
+	"testing"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p-core/host"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	libp2pquic "github.com/libp2p/go-libp2p-quic-transport"
+	libp2ptls "github.com/libp2p/go-libp2p-tls"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebsocketListenAddrs(t *testing.T) {
+	defer func(port uint) { WebsocketPort = port }(WebsocketPort)
+
+	WebsocketPort = 0
+	assert.Empty(t, websocketListenAddrs())
+
+	WebsocketPort = 443
+	assert.Equal(t, []string{"/ip4/0.0.0.0/tcp/443/ws", "/ip6/::/tcp/443/ws"}, websocketListenAddrs())
+}
+
+// newWebsocketTestHost returns a host with the transports and security of
+// the node, listening on listen.
+func newWebsocketTestHost(t *testing.T, listen libp2p.Option) host.Host {
+	h, err := libp2p.New(context.Background(),
+		listen,
+		libp2p.Security(libp2ptls.ID, libp2ptls.New),
+		libp2p.Transport(libp2pquic.NewTransport),
+		websocketTransport(),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+func TestWebsocketConnect(t *testing.T) {
+	server := newWebsocketTestHost(t, libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0/ws"))
+	client := newWebsocketTestHost(t, libp2p.NoListenAddrs)
+
+	require.NotEmpty(t, server.Addrs())
+	for _, addr := range server.Addrs() {
+		_, err := addr.ValueForProtocol(multiaddr.P_WS)
+		require.NoError(t, err, "listening on %v", addr)
+	}
+
+	require.NoError(t, client.Connect(context.Background(), peer.AddrInfo{ID: server.ID(), Addrs: server.Addrs()}))
+	assert.Equal(t, network.Connected, client.Network().Connectedness(server.ID()))
+	conns := client.Network().ConnsToPeer(server.ID())
+	require.NotEmpty(t, conns)
+	_, err := conns[0].RemoteMultiaddr().ValueForProtocol(multiaddr.P_WS)
+	assert.NoError(t, err)
+	// secured by the TLS handshake, inside the websocket
+	assert.Equal(t, server.ID(), conns[0].RemotePeer())
+}
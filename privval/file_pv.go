@@ -0,0 +1,224 @@
+// Package privval protects validator keys from double signing across
+// restarts.
+//
+// The consensus WAL replays our own votes after a crash, but it may be lost,
+// rotated away or disabled, and a validator restarted from a stale copy of
+// its datadir would sign again at heights it already signed. FilePV records
+// the last height/round/step signed in a state file, written atomically
+// before every signature, and refuses to sign anything below it, or a
+// different message at it.
+package privval
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/QuarkChain/go-minimal-pbft/internal/failpoint"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// The steps of a round a validator signs in, in order.
+const (
+	StepPropose   int8 = 1
+	StepPrevote   int8 = 2
+	StepPrecommit int8 = 3
+)
+
+var (
+	ErrDoubleSign  = errors.New("refusing to double sign")
+	ErrUnknownMsg  = errors.New("unknown message type")
+	ErrNoSignBytes = errors.New("signer cannot sign arbitrary messages")
+)
+
+// LastSignState is the last message signed. SignBytesHash is the hash of its
+// sign bytes without the timestamp, so that the same vote can be signed again
+// after a restart, e.g., on WAL replay, while another one cannot.
+type LastSignState struct {
+	Height        uint64      `json:"height"`
+	Round         int32       `json:"round"`
+	Step          int8        `json:"step"`
+	SignBytesHash common.Hash `json:"sign_bytes_hash"`
+}
+
+// check tells whether a message at height/round/step with the given sign
+// bytes hash may be signed after the state.
+func (lss *LastSignState) check(height uint64, round int32, step int8, hash common.Hash) error {
+	switch {
+	case height < lss.Height:
+		return fmt.Errorf("%w: height %d below the last signed %d", ErrDoubleSign, height, lss.Height)
+	case height > lss.Height:
+		return nil
+	case round < lss.Round:
+		return fmt.Errorf("%w: round %d below the last signed %d at height %d", ErrDoubleSign, round, lss.Round, height)
+	case round > lss.Round:
+		return nil
+	case step < lss.Step:
+		return fmt.Errorf("%w: step %d below the last signed %d at height %d round %d", ErrDoubleSign, step, lss.Step, height, round)
+	case step > lss.Step:
+		return nil
+	case hash != lss.SignBytesHash:
+		return fmt.Errorf("%w: conflicting data at height %d round %d step %d", ErrDoubleSign, height, round, step)
+	}
+	return nil
+}
+
+// FilePV is a PrivValidator signing with another one, e.g., a local key,
+// only what does not regress its state file.
+type FilePV struct {
+	consensus.PrivValidator
+
+	mtx     sync.Mutex
+	path    string
+	state   LastSignState
+	alerter consensus.Alerter
+}
+
+// NewFilePV loads the state file at path, starting from an empty state if it
+// does not exist.
+func NewFilePV(signer consensus.PrivValidator, path string) (*FilePV, error) {
+	pv := &FilePV{PrivValidator: signer, path: path}
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return pv, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sign state: %w", err)
+	}
+	if err := json.Unmarshal(data, &pv.state); err != nil {
+		return nil, fmt.Errorf("invalid sign state %s: %w", path, err)
+	}
+	return pv, nil
+}
+
+// SetAlerter reports the signatures refused to alerter.
+func (pv *FilePV) SetAlerter(alerter consensus.Alerter) {
+	pv.mtx.Lock()
+	defer pv.mtx.Unlock()
+	pv.alerter = alerter
+}
+
+// LastSignState returns the last message signed.
+func (pv *FilePV) LastSignState() LastSignState {
+	pv.mtx.Lock()
+	defer pv.mtx.Unlock()
+	return pv.state
+}
+
+func voteStep(t consensus.SignedMsgType) (int8, error) {
+	switch t {
+	case consensus.PrevoteType:
+		return StepPrevote, nil
+	case consensus.PrecommitType:
+		return StepPrecommit, nil
+	}
+	return 0, fmt.Errorf("%w: vote type %d", ErrUnknownMsg, t)
+}
+
+func (pv *FilePV) SignVote(ctx context.Context, chainID string, vote *consensus.Vote) error {
+	step, err := voteStep(vote.Type)
+	if err != nil {
+		return err
+	}
+	v := *vote
+	v.TimestampMs, v.Signature = 0, nil
+	if err := pv.advance(vote.Height, vote.Round, step, v.VoteSignBytes(chainID)); err != nil {
+		return err
+	}
+	return pv.PrivValidator.SignVote(ctx, chainID, vote)
+}
+
+func (pv *FilePV) SignProposal(ctx context.Context, chainID string, proposal *consensus.Proposal) error {
+	p := *proposal
+	p.TimestampMs, p.Signature = 0, nil
+	if err := pv.advance(proposal.Height, proposal.Round, StepPropose, p.ProposalSignBytes(chainID)); err != nil {
+		return err
+	}
+	return pv.PrivValidator.SignProposal(ctx, chainID, proposal)
+}
+
+// SignBytes signs domain separated messages, e.g., vote extensions, which
+// cannot conflict with votes and proposals and are not tracked.
+func (pv *FilePV) SignBytes(msg []byte) ([]byte, error) {
+	signer, ok := pv.PrivValidator.(consensus.BytesSigner)
+	if !ok {
+		return nil, ErrNoSignBytes
+	}
+	return signer.SignBytes(msg)
+}
+
+// advance checks a message against the state and persists it as the last
+// signed before it is signed: a crash after the signature can then never
+// leave a message signed but not recorded.
+func (pv *FilePV) advance(height uint64, round int32, step int8, signBytes []byte) error {
+	pv.mtx.Lock()
+	defer pv.mtx.Unlock()
+
+	hash := common.Hash(sha256.Sum256(signBytes))
+	if err := pv.state.check(height, round, step, hash); err != nil {
+		if pv.alerter != nil {
+			pv.alerter.Alert(consensus.Alert{Kind: consensus.AlertDoubleSignPrevented, Height: height, Message: err.Error()})
+		}
+		return err
+	}
+	next := LastSignState{Height: height, Round: round, Step: step, SignBytesHash: hash}
+	if next == pv.state {
+		return nil
+	}
+	data, err := json.Marshal(next)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(pv.path, data, 0600); err != nil {
+		return fmt.Errorf("failed to persist sign state: %w", err)
+	}
+	pv.state = next
+
+	failpoint.Inject(failpoint.SignStateWrite)
+	return nil
+}
+
+// writeFileAtomic replaces the file at path with data, so that a crash leaves
+// either the old or the new content, both durable.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// make the rename itself durable
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,65 @@
+package privval
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+type countingSigner struct {
+	consensus.PrivValidator
+	signed int
+}
+
+func (s *countingSigner) SignVote(ctx context.Context, chainID string, vote *consensus.Vote) error {
+	s.signed++
+	vote.Signature = []byte{1}
+	return nil
+}
+
+func TestLastSignStateCheck(t *testing.T) {
+	a, b := common.Hash{1}, common.Hash{2}
+	lss := LastSignState{Height: 5, Round: 1, Step: StepPrevote, SignBytesHash: a}
+
+	assert.NoError(t, lss.check(6, 0, StepPropose, b))
+	assert.NoError(t, lss.check(5, 2, StepPropose, b))
+	assert.NoError(t, lss.check(5, 1, StepPrecommit, b))
+	// the same message again, e.g., on WAL replay
+	assert.NoError(t, lss.check(5, 1, StepPrevote, a))
+
+	for _, err := range []error{
+		lss.check(4, 3, StepPrecommit, a),
+		lss.check(5, 0, StepPrecommit, a),
+		lss.check(5, 1, StepPropose, a),
+		lss.check(5, 1, StepPrevote, b),
+	} {
+		assert.ErrorIs(t, err, ErrDoubleSign)
+	}
+}
+
+func TestFilePVPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	signer := &countingSigner{}
+	pv, err := NewFilePV(signer, path)
+	assert.NoError(t, err)
+
+	vote := &consensus.Vote{Type: consensus.PrecommitType, Height: 5, Round: 1}
+	assert.NoError(t, pv.SignVote(context.Background(), "test", vote))
+	assert.Equal(t, 1, signer.signed)
+
+	// as restarted
+	pv, err = NewFilePV(signer, path)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(5), pv.LastSignState().Height)
+	assert.Equal(t, StepPrecommit, pv.LastSignState().Step)
+
+	prevote := &consensus.Vote{Type: consensus.PrevoteType, Height: 5, Round: 1}
+	assert.ErrorIs(t, pv.SignVote(context.Background(), "test", prevote), ErrDoubleSign)
+	assert.Equal(t, 1, signer.signed)
+	assert.NoError(t, pv.SignVote(context.Background(), "test", &consensus.Vote{Type: consensus.PrevoteType, Height: 6}))
+	assert.Equal(t, 2, signer.signed)
+}
@@ -0,0 +1,389 @@
+package privval
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// VaultPV signs with a key of the transit secrets engine of HashiCorp Vault,
+// which keeps it: the node never sees the private key. Vault transit has no
+// secp256k1 keys, so the key must be an ed25519 one, signing the raw sign
+// bytes. Like a local key, it is meant to be wrapped by a FilePV, which keeps
+// the double signing protection on the node.
+//
+// The node authenticates with a token, or logs in with an AppRole and caches
+// the token it gets until shortly before it expires. Vault is probed in the
+// background, so that an unreachable or sealed Vault shows in the logs before
+// the node has to sign.
+
+var (
+	ErrVault            = errors.New("vault request failed")
+	ErrVaultKeyType     = errors.New("vault key is not an ed25519 key")
+	ErrVaultUnhealthy   = errors.New("vault is unhealthy")
+	ErrVaultNoAuth      = errors.New("no vault token nor approle")
+	ErrVaultBadResponse = errors.New("invalid vault response")
+)
+
+const (
+	defaultVaultMount        = "transit"
+	defaultVaultAppRoleMount = "approle"
+	defaultVaultTimeout      = 5 * time.Second
+
+	// a cached token is renewed by logging in again when less than this
+	// share of its lease is left
+	vaultTokenRenewShare = 0.1
+)
+
+// VaultConfig configures VaultPV. Either Token or RoleID and SecretID are
+// required.
+type VaultConfig struct {
+	Address string // e.g. https://vault.example:8200
+	Mount   string // path of the transit engine, "transit" if empty
+	Key     string
+	// KeyVersion is the version of the key to sign with, 0 for the latest
+	// when the node starts: a rotated key would change the validator.
+	KeyVersion int
+	// Namespace is the Vault Enterprise namespace, if any.
+	Namespace string
+
+	Token        string
+	RoleID       string
+	SecretID     string
+	AppRoleMount string // path of the AppRole auth method, "approle" if empty
+
+	Timeout    time.Duration // of each request, 5s if 0
+	HTTPClient *http.Client  // e.g. with the TLS config of Vault, http.DefaultClient if nil
+}
+
+// VaultPV is a PrivValidator signing with Vault transit, see NewVaultPV.
+type VaultPV struct {
+	cfg    VaultConfig
+	client *http.Client
+	pubKey consensus.PubKey
+
+	mtx         sync.Mutex
+	token       string
+	tokenExpiry time.Time // zero if it does not expire
+	health      error
+}
+
+// NewVaultPV authenticates with Vault and loads the public key of the
+// transit key.
+func NewVaultPV(ctx context.Context, cfg VaultConfig) (*VaultPV, error) {
+	if cfg.Mount == "" {
+		cfg.Mount = defaultVaultMount
+	}
+	if cfg.AppRoleMount == "" {
+		cfg.AppRoleMount = defaultVaultAppRoleMount
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultVaultTimeout
+	}
+	if cfg.Token == "" && (cfg.RoleID == "" || cfg.SecretID == "") {
+		return nil, ErrVaultNoAuth
+	}
+	cfg.Address = strings.TrimSuffix(cfg.Address, "/")
+
+	pv := &VaultPV{cfg: cfg, client: cfg.HTTPClient, token: cfg.Token}
+	if pv.client == nil {
+		pv.client = http.DefaultClient
+	}
+	if err := pv.Probe(ctx); err != nil {
+		return nil, err
+	}
+	if err := pv.loadPubKey(ctx); err != nil {
+		return nil, err
+	}
+	return pv, nil
+}
+
+type vaultKeyResponse struct {
+	Data struct {
+		Type          string `json:"type"`
+		LatestVersion int    `json:"latest_version"`
+		Keys          map[string]struct {
+			PublicKey string `json:"public_key"`
+		} `json:"keys"`
+	} `json:"data"`
+}
+
+func (pv *VaultPV) loadPubKey(ctx context.Context) error {
+	var resp vaultKeyResponse
+	if err := pv.do(ctx, http.MethodGet, "/v1/"+pv.cfg.Mount+"/keys/"+pv.cfg.Key, nil, &resp); err != nil {
+		return err
+	}
+	if resp.Data.Type != "ed25519" {
+		return fmt.Errorf("%w: %s is a %q key", ErrVaultKeyType, pv.cfg.Key, resp.Data.Type)
+	}
+	if pv.cfg.KeyVersion == 0 {
+		pv.cfg.KeyVersion = resp.Data.LatestVersion
+	}
+	key, ok := resp.Data.Keys[strconv.Itoa(pv.cfg.KeyVersion)]
+	if !ok {
+		return fmt.Errorf("%w: no version %d of key %s", ErrVaultBadResponse, pv.cfg.KeyVersion, pv.cfg.Key)
+	}
+	pub, err := base64.StdEncoding.DecodeString(key.PublicKey)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return fmt.Errorf("%w: public key of %s", ErrVaultBadResponse, pv.cfg.Key)
+	}
+	pv.pubKey = consensus.NewEd25519PubKey(pub)
+	log.Info("Loaded vault transit key", "key", pv.cfg.Key, "version", pv.cfg.KeyVersion, "addr", pv.pubKey.Address())
+	return nil
+}
+
+func (pv *VaultPV) GetPubKey(context.Context) (consensus.PubKey, error) {
+	return pv.pubKey, nil
+}
+
+func (pv *VaultPV) SignVote(ctx context.Context, chainID string, vote *consensus.Vote) error {
+	vote.TimestampMs = uint64(consensus.CanonicalNowMs())
+	sig, err := pv.sign(ctx, vote.VoteSignBytes(chainID))
+	if err != nil {
+		return err
+	}
+	vote.Signature = sig
+	return nil
+}
+
+func (pv *VaultPV) SignProposal(ctx context.Context, chainID string, proposal *consensus.Proposal) error {
+	sig, err := pv.sign(ctx, proposal.ProposalSignBytes(chainID))
+	if err != nil {
+		return err
+	}
+	proposal.Signature = sig
+	return nil
+}
+
+func (pv *VaultPV) SignBytes(msg []byte) ([]byte, error) {
+	return pv.sign(context.Background(), msg)
+}
+
+type vaultSignResponse struct {
+	Data struct {
+		Signature string `json:"signature"`
+	} `json:"data"`
+}
+
+// sign signs msg with the key, and checks the signature: a key rotated or
+// replaced in Vault must not make us send votes nobody accepts.
+func (pv *VaultPV) sign(ctx context.Context, msg []byte) ([]byte, error) {
+	req := map[string]interface{}{
+		"input":       base64.StdEncoding.EncodeToString(msg),
+		"key_version": pv.cfg.KeyVersion,
+	}
+	var resp vaultSignResponse
+	if err := pv.do(ctx, http.MethodPost, "/v1/"+pv.cfg.Mount+"/sign/"+pv.cfg.Key, req, &resp); err != nil {
+		return nil, err
+	}
+
+	// vault:v<version>:<base64 signature>
+	parts := strings.SplitN(resp.Data.Signature, ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" {
+		return nil, fmt.Errorf("%w: signature %q", ErrVaultBadResponse, resp.Data.Signature)
+	}
+	sig, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature %q", ErrVaultBadResponse, resp.Data.Signature)
+	}
+	if !pv.pubKey.VerifySignature(msg, sig) {
+		return nil, fmt.Errorf("%w: signature not of key %s version %d", ErrVaultBadResponse, pv.cfg.Key, pv.cfg.KeyVersion)
+	}
+	return sig, nil
+}
+
+// Probe checks that Vault is initialized, unsealed and active (or a standby
+// forwarding requests).
+func (pv *VaultPV) Probe(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, pv.cfg.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pv.cfg.Address+"/v1/sys/health?standbyok=true", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := pv.client.Do(req)
+	if err == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			// 429 standby, 472 DR secondary, 501 not initialized, 503 sealed
+			err = fmt.Errorf("%w: health status %d", ErrVaultUnhealthy, resp.StatusCode)
+		}
+	} else {
+		err = fmt.Errorf("%w: %v", ErrVaultUnhealthy, err)
+	}
+
+	pv.mtx.Lock()
+	changed := (err == nil) != (pv.health == nil)
+	pv.health = err
+	pv.mtx.Unlock()
+	if changed && err != nil {
+		log.Error("Vault is unhealthy", "addr", pv.cfg.Address, "err", err)
+	} else if changed {
+		log.Info("Vault is healthy again", "addr", pv.cfg.Address)
+	}
+	return err
+}
+
+// Health returns the error of the last probe, nil if Vault was healthy.
+func (pv *VaultPV) Health() error {
+	pv.mtx.Lock()
+	defer pv.mtx.Unlock()
+	return pv.health
+}
+
+// ProbeRoutine probes Vault every interval until ctx is done.
+func (pv *VaultPV) ProbeRoutine(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pv.Probe(ctx)
+		}
+	}
+}
+
+type vaultLoginResponse struct {
+	Auth struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int64  `json:"lease_duration"`
+	} `json:"auth"`
+}
+
+// authToken returns the cached token, logging in with the AppRole when
+// there is none or it is about to expire.
+func (pv *VaultPV) authToken(ctx context.Context) (string, error) {
+	pv.mtx.Lock()
+	defer pv.mtx.Unlock()
+
+	if pv.token != "" && (pv.tokenExpiry.IsZero() || time.Now().Before(pv.tokenExpiry)) {
+		return pv.token, nil
+	}
+	if pv.cfg.RoleID == "" {
+		return pv.token, nil
+	}
+
+	req := map[string]string{"role_id": pv.cfg.RoleID, "secret_id": pv.cfg.SecretID}
+	var resp vaultLoginResponse
+	if err := pv.request(ctx, http.MethodPost, "/v1/auth/"+pv.cfg.AppRoleMount+"/login", "", req, &resp); err != nil {
+		return "", fmt.Errorf("approle login: %w", err)
+	}
+	if resp.Auth.ClientToken == "" {
+		return "", fmt.Errorf("%w: no token from approle login", ErrVaultBadResponse)
+	}
+	pv.token, pv.tokenExpiry = resp.Auth.ClientToken, time.Time{}
+	if lease := time.Duration(resp.Auth.LeaseDuration) * time.Second; lease > 0 {
+		pv.tokenExpiry = time.Now().Add(lease - time.Duration(float64(lease)*vaultTokenRenewShare))
+	}
+	log.Debug("Logged in to vault", "addr", pv.cfg.Address, "lease", resp.Auth.LeaseDuration)
+	return pv.token, nil
+}
+
+// forgetToken drops a token Vault refused, e.g., revoked, so that the next
+// request logs in again.
+func (pv *VaultPV) forgetToken(token string) {
+	pv.mtx.Lock()
+	defer pv.mtx.Unlock()
+	if pv.cfg.RoleID != "" && pv.token == token {
+		pv.token = ""
+	}
+}
+
+// do sends an authenticated request, logging in again once if the token is
+// refused.
+func (pv *VaultPV) do(ctx context.Context, method, path string, body, result interface{}) error {
+	for attempt := 0; ; attempt++ {
+		token, err := pv.authToken(ctx)
+		if err != nil {
+			return err
+		}
+		err = pv.request(ctx, method, path, token, body, result)
+		var se *vaultStatusError
+		if attempt == 0 && pv.cfg.RoleID != "" && errors.As(err, &se) && se.status == http.StatusForbidden {
+			pv.forgetToken(token)
+			continue
+		}
+		return err
+	}
+}
+
+type vaultStatusError struct {
+	status int
+	errors []string
+}
+
+func (e *vaultStatusError) Error() string {
+	return fmt.Sprintf("%v: status %d: %s", ErrVault, e.status, strings.Join(e.errors, "; "))
+}
+
+func (e *vaultStatusError) Unwrap() error { return ErrVault }
+
+func (pv *VaultPV) request(ctx context.Context, method, path, token string, body, result interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, pv.cfg.Timeout)
+	defer cancel()
+
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, pv.cfg.Address+path, r)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if pv.cfg.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", pv.cfg.Namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := pv.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrVault, err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrVault, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		se := &vaultStatusError{status: resp.StatusCode}
+		var errResp struct {
+			Errors []string `json:"errors"`
+		}
+		if json.Unmarshal(data, &errResp) == nil {
+			se.errors = errResp.Errors
+		}
+		return se
+	}
+	if err := json.Unmarshal(data, result); err != nil {
+		return fmt.Errorf("%w: %v", ErrVaultBadResponse, err)
+	}
+	return nil
+}
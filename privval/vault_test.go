@@ -0,0 +1,130 @@
+package privval
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeVault serves the transit key "val" and an AppRole login.
+type fakeVault struct {
+	priv    ed25519.PrivateKey
+	logins  int32
+	token   atomic.Value
+	sealed  int32
+	keyType atomic.Value
+}
+
+func newFakeVault(t *testing.T) (*fakeVault, *httptest.Server) {
+	_, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	v := &fakeVault{priv: priv}
+	v.token.Store("")
+	v.keyType.Store("ed25519")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/sys/health", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&v.sealed) != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	mux.HandleFunc("/v1/auth/approle/login", func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&v.logins, 1)
+		token := "token" + string(rune('0'+n))
+		v.token.Store(token)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"auth": map[string]interface{}{"client_token": token, "lease_duration": 3600},
+		})
+	})
+	mux.HandleFunc("/v1/transit/keys/val", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != v.token.Load().(string) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{
+			"type":           v.keyType.Load(),
+			"latest_version": 1,
+			"keys": map[string]interface{}{
+				"1": map[string]string{"public_key": base64.StdEncoding.EncodeToString(v.priv.Public().(ed25519.PublicKey))},
+			},
+		}})
+	})
+	mux.HandleFunc("/v1/transit/sign/val", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != v.token.Load().(string) {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string][]string{"errors": {"permission denied"}})
+			return
+		}
+		var req struct {
+			Input string `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		msg, _ := base64.StdEncoding.DecodeString(req.Input)
+		sig := base64.StdEncoding.EncodeToString(ed25519.Sign(v.priv, msg))
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{"signature": "vault:v1:" + sig}})
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return v, server
+}
+
+func TestVaultPVSigns(t *testing.T) {
+	v, server := newFakeVault(t)
+	ctx := context.Background()
+
+	pv, err := NewVaultPV(ctx, VaultConfig{Address: server.URL, Key: "val", RoleID: "role", SecretID: "secret"})
+	require.NoError(t, err)
+	pubKey, _ := pv.GetPubKey(ctx)
+	assert.Equal(t, consensus.NewEd25519PubKey(v.priv.Public().(ed25519.PublicKey)).Address(), pubKey.Address())
+
+	vote := &consensus.Vote{Type: consensus.PrevoteType, Height: 5, Round: 1}
+	require.NoError(t, pv.SignVote(ctx, "test", vote))
+	assert.True(t, pubKey.VerifySignature(vote.VoteSignBytes("test"), vote.Signature))
+	sig, err := pv.SignBytes([]byte("msg"))
+	require.NoError(t, err)
+	assert.True(t, pubKey.VerifySignature([]byte("msg"), sig))
+	// the token is cached
+	assert.Equal(t, int32(1), atomic.LoadInt32(&v.logins))
+
+	// revoked
+	v.token.Store("other")
+	_, err = pv.SignBytes([]byte("msg"))
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&v.logins))
+}
+
+func TestVaultPVErrors(t *testing.T) {
+	v, server := newFakeVault(t)
+	ctx := context.Background()
+
+	_, err := NewVaultPV(ctx, VaultConfig{Address: server.URL, Key: "val"})
+	assert.ErrorIs(t, err, ErrVaultNoAuth)
+
+	// a static token is not renewed
+	_, err = NewVaultPV(ctx, VaultConfig{Address: server.URL, Key: "val", Token: "wrong"})
+	assert.ErrorIs(t, err, ErrVault)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&v.logins))
+
+	v.keyType.Store("ecdsa-p256")
+	_, err = NewVaultPV(ctx, VaultConfig{Address: server.URL, Key: "val", RoleID: "role", SecretID: "secret"})
+	assert.ErrorIs(t, err, ErrVaultKeyType)
+	v.keyType.Store("ed25519")
+
+	pv, err := NewVaultPV(ctx, VaultConfig{Address: server.URL, Key: "val", RoleID: "role", SecretID: "secret"})
+	require.NoError(t, err)
+	atomic.StoreInt32(&v.sealed, 1)
+	assert.ErrorIs(t, pv.Probe(ctx), ErrVaultUnhealthy)
+	assert.ErrorIs(t, pv.Health(), ErrVaultUnhealthy)
+	atomic.StoreInt32(&v.sealed, 0)
+	assert.NoError(t, pv.Probe(ctx))
+	assert.NoError(t, pv.Health())
+}
@@ -0,0 +1,90 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+var ErrNoTxs = errors.New("txs are not accepted")
+
+// TxSubmitter accepts txs for the next blocks.
+type TxSubmitter interface {
+	SubmitTx(tx *types.Transaction) error
+}
+
+// ResultQuery carries the application response together with the header
+// (and its commit) of the height after the response height: its extra data
+// commits to the app hash the proof is against, see consensus.HeaderExtra,
+// so that a light client holding a trusted validator set can verify the
+// header and then the proof against it. They are missing until the next
+// height is committed.
+type ResultQuery struct {
+	Response consensus.QueryResponse `json:"response"`
+	Header   *consensus.Header       `json:"header,omitempty"`
+	Commit   *consensus.Commit       `json:"commit,omitempty"`
+}
+
+// ABCIAPI passes queries through to the application.
+type ABCIAPI struct {
+	env *Environment
+}
+
+func NewABCIAPI(env *Environment) *ABCIAPI {
+	return &ABCIAPI{env: env}
+}
+
+// Query is served as "abci_query". Height 0 queries the latest height.
+func (api *ABCIAPI) Query(ctx context.Context, path string, data hexutil.Bytes, height uint64, prove bool) (*ResultQuery, error) {
+	querier, ok := api.env.Executor.(consensus.Querier)
+	if !ok {
+		return nil, consensus.ErrQueryNotSupported
+	}
+
+	height, err := ResolveHeight(api.env.BlockStore, height)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := querier.Query(ctx, consensus.QueryRequest{
+		Path:   path,
+		Data:   data,
+		Height: height,
+		Prove:  prove,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ResultQuery{Response: resp}
+	if !prove || resp.Code != 0 {
+		return result, nil
+	}
+
+	if block := api.env.BlockStore.LoadBlock(resp.Height + 1); block != nil {
+		result.Header = block.Header()
+		result.Commit = api.env.BlockStore.LoadBlockCommit(resp.Height + 1)
+	}
+	return result, nil
+}
+
+// BroadcastTx is served as "abci_broadcastTx": it submits a tx in its binary
+// encoding and returns its hash.
+func (api *ABCIAPI) BroadcastTx(ctx context.Context, data hexutil.Bytes) (common.Hash, error) {
+	if api.env.Txs == nil {
+		return common.Hash{}, ErrNoTxs
+	}
+	tx := new(types.Transaction)
+	if err := tx.UnmarshalBinary(data); err != nil {
+		return common.Hash{}, fmt.Errorf("invalid tx: %w", err)
+	}
+	if err := api.env.Txs.SubmitTx(tx); err != nil {
+		return common.Hash{}, err
+	}
+	return consensus.TxHash(api.env.Executor, tx), nil
+}
@@ -0,0 +1,76 @@
+package rpc
+
+import (
+	"context"
+	"time"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+)
+
+// ResultMessageSuspension is a kind of p2p messages suspended, see
+// p2p.MessageSuspension.
+type ResultMessageSuspension struct {
+	Kind    string `json:"kind"`
+	UntilMs uint64 `json:"until_ms"`
+}
+
+// MessageSuspender stops and restarts processing and gossiping kinds of p2p
+// messages, i.e., the p2p server.
+type MessageSuspender interface {
+	SuspendMessages(kinds []string, d time.Duration) ([]ResultMessageSuspension, error)
+	ResumeMessages(kinds []string) []ResultMessageSuspension
+}
+
+// AdminAPI changes the behavior of the node, and so is only served when
+// Environment.Admin is set, on an address only the operator can reach.
+type AdminAPI struct {
+	env *Environment
+}
+
+func NewAdminAPI(env *Environment) *AdminAPI {
+	return &AdminAPI{env: env}
+}
+
+// Halt is served as "admin_halt". The node stops proposing and precommits nil
+// from the next height on, which halts the chain once enough validators do.
+func (api *AdminAPI) Halt(ctx context.Context, reason string) (*consensus.HaltStatus, error) {
+	if api.env.ConsensusState == nil {
+		return nil, ErrNoConsensusState
+	}
+	api.env.ConsensusState.Halt(reason)
+	status := api.env.ConsensusState.HaltStatus()
+	return &status, nil
+}
+
+// Resume is served as "admin_resume", and cancels admin_halt. A halt of the
+// application is not resumed.
+func (api *AdminAPI) Resume(ctx context.Context) (*consensus.HaltStatus, error) {
+	if api.env.ConsensusState == nil {
+		return nil, ErrNoConsensusState
+	}
+	api.env.ConsensusState.Resume()
+	status := api.env.ConsensusState.HaltStatus()
+	return &status, nil
+}
+
+// SuspendMessages is served as "admin_suspendMessages". The node stops
+// processing, relaying and sending the p2p messages of the given kinds (e.g.,
+// "evidence" or "txs") for the given number of seconds, while consensus goes
+// on, to contain an incident triggered by such messages. It returns the
+// current suspensions.
+func (api *AdminAPI) SuspendMessages(ctx context.Context, kinds []string, seconds uint64) ([]ResultMessageSuspension, error) {
+	if api.env.Messages == nil {
+		return nil, ErrNoNet
+	}
+	return api.env.Messages.SuspendMessages(kinds, time.Duration(seconds)*time.Second)
+}
+
+// ResumeMessages is served as "admin_resumeMessages", and cancels the
+// suspensions of the given kinds before they are over. It returns the
+// remaining suspensions.
+func (api *AdminAPI) ResumeMessages(ctx context.Context, kinds []string) ([]ResultMessageSuspension, error) {
+	if api.env.Messages == nil {
+		return nil, ErrNoNet
+	}
+	return api.env.Messages.ResumeMessages(kinds), nil
+}
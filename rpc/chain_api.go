@@ -0,0 +1,271 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	ethrpc "github.com/ethereum/go-ethereum/rpc"
+)
+
+var (
+	ErrNoStores         = errors.New("store stats are not available")
+	ErrNoValidatorStore = errors.New("validator history is not recorded")
+	ErrNoParamsStore    = errors.New("consensus params history is not recorded")
+)
+
+// How often new block subscriptions check the block store for new blocks.
+var NewBlockPollInterval = 100 * time.Millisecond
+
+type ResultStatus struct {
+	EarliestHeight    uint64      `json:"earliest_height"`
+	LatestHeight      uint64      `json:"latest_height"`
+	LatestBlockHash   common.Hash `json:"latest_block_hash"`
+	LatestBlockTimeMs uint64      `json:"latest_block_time_ms"`
+	// nil while syncing
+	Halt *consensus.HaltStatus `json:"halt,omitempty"`
+}
+
+// ResultBlock carries the header for inspection and the RLP encoded full
+// block (including its LastCommit), which is what clients decode.
+type ResultBlock struct {
+	Hash   common.Hash       `json:"hash"`
+	Header *consensus.Header `json:"header"`
+	Raw    hexutil.Bytes     `json:"raw"`
+	// the hashes of the txs by the application, see consensus.TxHasher
+	TxHashes []common.Hash `json:"tx_hashes"`
+	// Error is set instead of the block by a newBlocks subscription failing
+	// to load the block of the next height, the last notification of the
+	// subscription.
+	Error string `json:"error,omitempty"`
+}
+
+type ResultCommit struct {
+	Header *consensus.Header `json:"header"`
+	Commit *consensus.Commit `json:"commit"`
+	// AppHash is the app hash after the block, if recorded. The header of
+	// the next height commits to it, not this one: clients cannot verify it
+	// against the commit.
+	AppHash hexutil.Bytes `json:"app_hash,omitempty"`
+}
+
+// ChainAPI serves the blocks and commits of the block store.
+type ChainAPI struct {
+	env *Environment
+}
+
+func NewChainAPI(env *Environment) *ChainAPI {
+	return &ChainAPI{env: env}
+}
+
+// ResolveHeight maps height 0 to the latest height and checks the height is
+// available in the store.
+func ResolveHeight(bs consensus.BlockStore, height uint64) (uint64, error) {
+	latest := bs.Height()
+	if height == 0 {
+		height = latest
+	}
+	if height > latest {
+		return 0, fmt.Errorf("height %d must be less than or equal to the current blockchain height %d", height, latest)
+	}
+	if base := bs.Base(); height < base {
+		return 0, fmt.Errorf("height %d is not available, lowest height is %d", height, base)
+	}
+	return height, nil
+}
+
+// Status is served as "chain_status".
+func (api *ChainAPI) Status(ctx context.Context) (*ResultStatus, error) {
+	bs := api.env.BlockStore
+
+	result := &ResultStatus{
+		EarliestHeight: bs.Base(),
+		LatestHeight:   bs.Height(),
+	}
+	if block := bs.LoadBlock(result.LatestHeight); block != nil {
+		result.LatestBlockHash = block.Hash()
+		result.LatestBlockTimeMs = block.TimeMs()
+	}
+	if api.env.ConsensusState != nil {
+		halt := api.env.ConsensusState.HaltStatus()
+		result.Halt = &halt
+	}
+	return result, nil
+}
+
+// Block is served as "chain_block". Height 0 returns the latest block.
+func (api *ChainAPI) Block(ctx context.Context, height uint64) (*ResultBlock, error) {
+	height, err := ResolveHeight(api.env.BlockStore, height)
+	if err != nil {
+		return nil, err
+	}
+	return api.resultBlock(height)
+}
+
+func (api *ChainAPI) resultBlock(height uint64) (*ResultBlock, error) {
+	block := api.env.BlockStore.LoadBlock(height)
+	if block == nil {
+		return nil, fmt.Errorf("block at height %d not found", height)
+	}
+
+	raw, err := block.EncodeToRLPBytes()
+	if err != nil {
+		return nil, err
+	}
+	return &ResultBlock{Hash: block.Hash(), Header: block.Header(), Raw: raw, TxHashes: consensus.TxHashes(api.env.Executor, block)}, nil
+}
+
+// Commit is served as "chain_commit". Height 0 returns the latest commit.
+func (api *ChainAPI) Commit(ctx context.Context, height uint64) (*ResultCommit, error) {
+	height, err := ResolveHeight(api.env.BlockStore, height)
+	if err != nil {
+		return nil, err
+	}
+
+	block := api.env.BlockStore.LoadBlock(height)
+	if block == nil {
+		return nil, fmt.Errorf("block at height %d not found", height)
+	}
+	result := &ResultCommit{Header: block.Header(), Commit: api.env.BlockStore.LoadBlockCommit(height)}
+	if api.env.AppHashes != nil {
+		result.AppHash, _ = api.env.AppHashes.Load(height)
+	}
+	return result, nil
+}
+
+// StoreStats is served as "chain_storeStats", the disk usage of the stores
+// of the node.
+func (api *ChainAPI) StoreStats(ctx context.Context) ([]consensus.StoreStats, error) {
+	if api.env.Stores == nil {
+		return nil, ErrNoStores
+	}
+	return api.env.Stores.Stats(), nil
+}
+
+// ValidatorSetDiff is served as "chain_validatorSetDiff", the validators
+// joining, leaving and changing voting power from the set of height from to
+// the one of height to.
+func (api *ChainAPI) ValidatorSetDiff(ctx context.Context, from, to uint64) (*consensus.ValidatorSetDiff, error) {
+	if api.env.Validators == nil {
+		return nil, ErrNoValidatorStore
+	}
+	return api.env.Validators.ValidatorSetDiff(from, to)
+}
+
+// Validators is served as "chain_validators", the validator set of a height
+// (0 for the latest block), in validator set order: the order of the
+// signatures of the commits of the height.
+func (api *ChainAPI) Validators(ctx context.Context, height uint64) ([]consensus.ValidatorInfo, error) {
+	if api.env.Validators == nil {
+		return nil, ErrNoValidatorStore
+	}
+	height, err := ResolveHeight(api.env.BlockStore, height)
+	if err != nil {
+		return nil, err
+	}
+	return api.env.Validators.Load(height)
+}
+
+// ConsensusParams is served as "chain_consensusParams", the consensus params
+// of a height (0 for the latest block).
+func (api *ChainAPI) ConsensusParams(ctx context.Context, height uint64) (*consensus.ConsensusParams, error) {
+	if api.env.ConsensusParams == nil {
+		return nil, ErrNoParamsStore
+	}
+	height, err := ResolveHeight(api.env.BlockStore, height)
+	if err != nil {
+		return nil, err
+	}
+	params, err := api.env.ConsensusParams.Load(height)
+	if err != nil {
+		return nil, err
+	}
+	return &params, nil
+}
+
+// MaxBlockMetas is the most block metas returned by one BlockMetas call.
+var MaxBlockMetas = 100
+
+// BlockMetas is served as "chain_blockMetas". It returns the metas of the
+// blocks in [from, to] (to 0 for the latest), from the highest if reverse, at
+// most MaxBlockMetas of them.
+func (api *ChainAPI) BlockMetas(ctx context.Context, from, to uint64, reverse bool) ([]*consensus.BlockMeta, error) {
+	to, err := ResolveHeight(api.env.BlockStore, to)
+	if err != nil {
+		return nil, err
+	}
+
+	metas := make([]*consensus.BlockMeta, 0)
+	err = api.env.BlockStore.Iterate(from, to, reverse, func(meta *consensus.BlockMeta) bool {
+		metas = append(metas, meta)
+		return len(metas) < MaxBlockMetas
+	})
+	return metas, err
+}
+
+// SubscriptionStart returns the first height of a new block subscription:
+// from if set, which must still be in the store, otherwise the next block.
+func SubscriptionStart(bs consensus.BlockStore, from *uint64) (uint64, error) {
+	if from == nil {
+		return bs.Height() + 1, nil
+	}
+	if base := bs.Base(); *from < base {
+		return 0, fmt.Errorf("height %d is not available, lowest height is %d", *from, base)
+	}
+	return *from, nil
+}
+
+// NewBlocks is served as the "newBlocks" subscription of "chain_subscribe"
+// (WebSocket only), notifying a ResultBlock for every newly stored block.
+//
+// Subscribers given a from height first get the stored blocks from it on,
+// then the new ones. The height of the last notified block is their cursor:
+// after a disconnect, subscribing again from the height after it resumes the
+// stream without gap nor duplicate. A block that cannot be loaded, e.g.
+// pruned meanwhile, is not skipped: the subscription ends with a
+// notification carrying the Error.
+func (api *ChainAPI) NewBlocks(ctx context.Context, from *uint64) (*ethrpc.Subscription, error) {
+	notifier, supported := ethrpc.NotifierFromContext(ctx)
+	if !supported {
+		return &ethrpc.Subscription{}, ethrpc.ErrNotificationsUnsupported
+	}
+
+	next, err := SubscriptionStart(api.env.BlockStore, from)
+	if err != nil {
+		return nil, err
+	}
+
+	rpcSub := notifier.CreateSubscription()
+
+	go func() {
+		ticker := time.NewTicker(NewBlockPollInterval)
+		defer ticker.Stop()
+
+		for {
+			for ; next <= api.env.BlockStore.Height(); next++ {
+				result, err := api.resultBlock(next)
+				if err != nil {
+					notifier.Notify(rpcSub.ID, &ResultBlock{Error: err.Error()})
+					return
+				}
+				if err := notifier.Notify(rpcSub.ID, result); err != nil {
+					return
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-rpcSub.Err():
+				return
+			case <-notifier.Closed():
+				return
+			}
+		}
+	}()
+
+	return rpcSub, nil
+}
@@ -0,0 +1,397 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/QuarkChain/go-minimal-pbft/rpc"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/log"
+	ethrpc "github.com/ethereum/go-ethereum/rpc"
+)
+
+// Client mirrors the node RPC endpoints. It is implemented by RemoteClient
+// (HTTP, WebSocket or IPC) and by the in-process client of rpc/client/local,
+// so code (and tests) can use either.
+type Client interface {
+	Status(ctx context.Context) (*rpc.ResultStatus, error)
+	Block(ctx context.Context, height uint64) (*consensus.FullBlock, error)
+	Commit(ctx context.Context, height uint64) (*rpc.ResultCommit, error)
+	BlockMetas(ctx context.Context, from, to uint64, reverse bool) ([]*consensus.BlockMeta, error)
+	StoreStats(ctx context.Context) ([]consensus.StoreStats, error)
+	ConsensusParams(ctx context.Context, height uint64) (*consensus.ConsensusParams, error)
+	ABCIQuery(ctx context.Context, path string, data []byte, height uint64, prove bool) (*rpc.ResultQuery, error)
+	// BroadcastTx submits tx and returns its hash by the application.
+	BroadcastTx(ctx context.Context, tx *types.Transaction) (common.Hash, error)
+	QuorumStatus(ctx context.Context) (*consensus.QuorumStatus, error)
+	RoundState(ctx context.Context) (*consensus.RoundStateSummary, error)
+	RoundStateSnapshot(ctx context.Context) (*consensus.RoundStateSnapshot, error)
+	LockState(ctx context.Context) (*consensus.LockState, error)
+	HeightTimings(ctx context.Context, from, to uint64) ([]*consensus.HeightTiming, error)
+	ValidatorSetDiff(ctx context.Context, from, to uint64) (*consensus.ValidatorSetDiff, error)
+	Validators(ctx context.Context, height uint64) ([]consensus.ValidatorInfo, error)
+	NetInfo(ctx context.Context) (*rpc.ResultNetInfo, error)
+
+	// The admin endpoints are only served with rpc.Environment.Admin set.
+	Halt(ctx context.Context, reason string) (*consensus.HaltStatus, error)
+	Resume(ctx context.Context) (*consensus.HaltStatus, error)
+	SuspendMessages(ctx context.Context, kinds []string, d time.Duration) ([]rpc.ResultMessageSuspension, error)
+	ResumeMessages(ctx context.Context, kinds []string) ([]rpc.ResultMessageSuspension, error)
+
+	// SubmitVotes is only served on the IPC socket, see rpc.VoteAPI.
+	SubmitVotes(ctx context.Context, votes []*consensus.Vote) ([]string, error)
+
+	// SubscribeNewBlocks sends every new block to ch until unsubscribed.
+	SubscribeNewBlocks(ctx context.Context, ch chan<- *consensus.FullBlock) (Subscription, error)
+	// SubscribeBlocksFrom sends the stored blocks from height from on, then
+	// every new block, to ch until unsubscribed. See also FollowBlocks. A
+	// block the node fails to load ends the subscription with an error.
+	SubscribeBlocksFrom(ctx context.Context, from uint64, ch chan<- *consensus.FullBlock) (Subscription, error)
+	// SubscribeRoundEvents sends the round events of the given types, all if
+	// none, to ch until unsubscribed.
+	SubscribeRoundEvents(ctx context.Context, ch chan<- consensus.RoundEvent, eventTypes ...consensus.RoundEventType) (Subscription, error)
+}
+
+// Subscription is an active subscription, see ethrpc.ClientSubscription.
+type Subscription interface {
+	Err() <-chan error
+	Unsubscribe()
+}
+
+// RetryConfig controls the retries of failed calls. Only transport errors are
+// retried; errors returned by the node (e.g. unknown height) are not.
+type RetryConfig struct {
+	MaxRetries     int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+var DefaultRetryConfig = RetryConfig{
+	MaxRetries:     3,
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     2 * time.Second,
+}
+
+type Option func(*RemoteClient)
+
+// WithRetry overrides DefaultRetryConfig, MaxRetries 0 disables retries.
+func WithRetry(cfg RetryConfig) Option {
+	return func(c *RemoteClient) {
+		c.retry = cfg
+	}
+}
+
+// RemoteClient talks to a node over HTTP ("http://host:port") or WebSocket
+// ("ws://host:port/websocket"). Subscriptions need a WebSocket connection.
+type RemoteClient struct {
+	c     *ethrpc.Client
+	retry RetryConfig
+}
+
+var _ Client = (*RemoteClient)(nil)
+
+func Dial(ctx context.Context, rawurl string, opts ...Option) (*RemoteClient, error) {
+	c, err := ethrpc.DialContext(ctx, rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &RemoteClient{c: c, retry: DefaultRetryConfig}
+	for _, opt := range opts {
+		opt(client)
+	}
+	return client, nil
+}
+
+func (c *RemoteClient) Close() {
+	c.c.Close()
+}
+
+func (c *RemoteClient) call(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	backoff := c.retry.InitialBackoff
+	for attempt := 0; ; attempt++ {
+		err := c.c.CallContext(ctx, result, method, args...)
+
+		var rpcErr ethrpc.Error
+		if err == nil || errors.As(err, &rpcErr) || ctx.Err() != nil || attempt >= c.retry.MaxRetries {
+			return err
+		}
+
+		log.Debug("rpc call failed, retrying", "method", method, "attempt", attempt+1, "backoff", backoff, "err", err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > c.retry.MaxBackoff {
+			backoff = c.retry.MaxBackoff
+		}
+	}
+}
+
+func (c *RemoteClient) Status(ctx context.Context) (*rpc.ResultStatus, error) {
+	result := &rpc.ResultStatus{}
+	if err := c.call(ctx, result, "chain_status"); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *RemoteClient) Block(ctx context.Context, height uint64) (*consensus.FullBlock, error) {
+	result := &rpc.ResultBlock{}
+	if err := c.call(ctx, result, "chain_block", height); err != nil {
+		return nil, err
+	}
+	return decodeBlock(result)
+}
+
+func (c *RemoteClient) Commit(ctx context.Context, height uint64) (*rpc.ResultCommit, error) {
+	result := &rpc.ResultCommit{}
+	if err := c.call(ctx, result, "chain_commit", height); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *RemoteClient) BlockMetas(ctx context.Context, from, to uint64, reverse bool) ([]*consensus.BlockMeta, error) {
+	var result []*consensus.BlockMeta
+	if err := c.call(ctx, &result, "chain_blockMetas", from, to, reverse); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *RemoteClient) StoreStats(ctx context.Context) ([]consensus.StoreStats, error) {
+	var result []consensus.StoreStats
+	if err := c.call(ctx, &result, "chain_storeStats"); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *RemoteClient) ConsensusParams(ctx context.Context, height uint64) (*consensus.ConsensusParams, error) {
+	result := &consensus.ConsensusParams{}
+	if err := c.call(ctx, result, "chain_consensusParams", height); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *RemoteClient) ABCIQuery(ctx context.Context, path string, data []byte, height uint64, prove bool) (*rpc.ResultQuery, error) {
+	result := &rpc.ResultQuery{}
+	if err := c.call(ctx, result, "abci_query", path, hexutil.Bytes(data), height, prove); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// BroadcastTx is not retried, a tx submitted twice may be rejected the
+// second time.
+func (c *RemoteClient) BroadcastTx(ctx context.Context, tx *types.Transaction) (common.Hash, error) {
+	data, err := tx.MarshalBinary()
+	if err != nil {
+		return common.Hash{}, err
+	}
+	var result common.Hash
+	if err := c.c.CallContext(ctx, &result, "abci_broadcastTx", hexutil.Bytes(data)); err != nil {
+		return common.Hash{}, err
+	}
+	return result, nil
+}
+
+func (c *RemoteClient) QuorumStatus(ctx context.Context) (*consensus.QuorumStatus, error) {
+	result := &consensus.QuorumStatus{}
+	if err := c.call(ctx, result, "consensus_quorum"); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *RemoteClient) RoundState(ctx context.Context) (*consensus.RoundStateSummary, error) {
+	result := &consensus.RoundStateSummary{}
+	if err := c.call(ctx, result, "consensus_roundState"); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *RemoteClient) RoundStateSnapshot(ctx context.Context) (*consensus.RoundStateSnapshot, error) {
+	result := &consensus.RoundStateSnapshot{}
+	if err := c.call(ctx, result, "consensus_roundStateSnapshot"); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *RemoteClient) LockState(ctx context.Context) (*consensus.LockState, error) {
+	result := &consensus.LockState{}
+	if err := c.call(ctx, result, "consensus_lockState"); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *RemoteClient) HeightTimings(ctx context.Context, from, to uint64) ([]*consensus.HeightTiming, error) {
+	var result []*consensus.HeightTiming
+	if err := c.call(ctx, &result, "consensus_heightTimings", from, to); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *RemoteClient) ValidatorSetDiff(ctx context.Context, from, to uint64) (*consensus.ValidatorSetDiff, error) {
+	result := &consensus.ValidatorSetDiff{}
+	if err := c.call(ctx, result, "chain_validatorSetDiff", from, to); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *RemoteClient) Validators(ctx context.Context, height uint64) ([]consensus.ValidatorInfo, error) {
+	var result []consensus.ValidatorInfo
+	if err := c.call(ctx, &result, "chain_validators", height); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *RemoteClient) NetInfo(ctx context.Context) (*rpc.ResultNetInfo, error) {
+	result := &rpc.ResultNetInfo{}
+	if err := c.call(ctx, result, "net_info"); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *RemoteClient) Halt(ctx context.Context, reason string) (*consensus.HaltStatus, error) {
+	result := &consensus.HaltStatus{}
+	if err := c.call(ctx, result, "admin_halt", reason); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *RemoteClient) Resume(ctx context.Context) (*consensus.HaltStatus, error) {
+	result := &consensus.HaltStatus{}
+	if err := c.call(ctx, result, "admin_resume"); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// SuspendMessages suspends the kinds for d, in whole seconds.
+func (c *RemoteClient) SuspendMessages(ctx context.Context, kinds []string, d time.Duration) ([]rpc.ResultMessageSuspension, error) {
+	var result []rpc.ResultMessageSuspension
+	if err := c.call(ctx, &result, "admin_suspendMessages", kinds, uint64(d/time.Second)); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *RemoteClient) ResumeMessages(ctx context.Context, kinds []string) ([]rpc.ResultMessageSuspension, error) {
+	var result []rpc.ResultMessageSuspension
+	if err := c.call(ctx, &result, "admin_resumeMessages", kinds); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// SubmitVotes is not retried either, see BroadcastTx.
+func (c *RemoteClient) SubmitVotes(ctx context.Context, votes []*consensus.Vote) ([]string, error) {
+	var result []string
+	if err := c.c.CallContext(ctx, &result, "votes_submit", votes); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *RemoteClient) SubscribeNewBlocks(ctx context.Context, ch chan<- *consensus.FullBlock) (Subscription, error) {
+	return c.subscribeBlocks(ctx, ch)
+}
+
+func (c *RemoteClient) SubscribeBlocksFrom(ctx context.Context, from uint64, ch chan<- *consensus.FullBlock) (Subscription, error) {
+	return c.subscribeBlocks(ctx, ch, from)
+}
+
+func (c *RemoteClient) subscribeBlocks(ctx context.Context, ch chan<- *consensus.FullBlock, args ...interface{}) (Subscription, error) {
+	resultC := make(chan *rpc.ResultBlock)
+	sub, err := c.c.Subscribe(ctx, "chain", resultC, append([]interface{}{"newBlocks"}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	bs := &blockSubscription{sub: sub, errC: make(chan error, 1), quit: make(chan struct{})}
+	go bs.forward(resultC, ch)
+	return bs, nil
+}
+
+func (c *RemoteClient) SubscribeRoundEvents(ctx context.Context, ch chan<- consensus.RoundEvent, eventTypes ...consensus.RoundEventType) (Subscription, error) {
+	return c.c.Subscribe(ctx, "consensus", ch, "roundEvents", eventTypes)
+}
+
+// blockSubscription decodes the notified blocks before handing them out.
+type blockSubscription struct {
+	sub      *ethrpc.ClientSubscription
+	errC     chan error
+	quit     chan struct{}
+	quitOnce sync.Once
+}
+
+func (bs *blockSubscription) forward(resultC <-chan *rpc.ResultBlock, ch chan<- *consensus.FullBlock) {
+	defer close(bs.errC)
+
+	for {
+		select {
+		case result := <-resultC:
+			block, err := decodeBlock(result)
+			if err != nil {
+				bs.sub.Unsubscribe()
+				bs.errC <- err
+				return
+			}
+			select {
+			case ch <- block:
+			case <-bs.quit:
+				return
+			}
+		case err := <-bs.sub.Err():
+			if err != nil {
+				bs.errC <- err
+			}
+			return
+		case <-bs.quit:
+			return
+		}
+	}
+}
+
+func (bs *blockSubscription) Err() <-chan error {
+	return bs.errC
+}
+
+func (bs *blockSubscription) Unsubscribe() {
+	bs.sub.Unsubscribe()
+	bs.quitOnce.Do(func() { close(bs.quit) })
+}
+
+func decodeBlock(result *rpc.ResultBlock) (*consensus.FullBlock, error) {
+	if result.Error != "" {
+		return nil, errors.New(result.Error)
+	}
+	block := &consensus.FullBlock{}
+	if err := block.DecodeFromRLPBytes(result.Raw); err != nil {
+		return nil, err
+	}
+	if block.Hash() != result.Hash {
+		return nil, errors.New("block hash mismatch")
+	}
+	return block, nil
+}
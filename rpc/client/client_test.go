@@ -0,0 +1,304 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/QuarkChain/go-minimal-pbft/rpc"
+	"github.com/QuarkChain/go-minimal-pbft/rpc/client"
+	"github.com/QuarkChain/go-minimal-pbft/rpc/client/local"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+// testBlockStore keeps the blocks in memory. Blocks in missing are not
+// found, as if pruned under a subscriber.
+type testBlockStore struct {
+	mtx     sync.Mutex
+	blocks  []*consensus.FullBlock
+	missing map[uint64]bool
+}
+
+func (bs *testBlockStore) Base() uint64 { return 1 }
+
+func (bs *testBlockStore) Height() uint64 {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+	return uint64(len(bs.blocks))
+}
+
+func (bs *testBlockStore) Size() uint64 { return bs.Height() }
+
+func (bs *testBlockStore) LoadBlock(height uint64) *consensus.FullBlock {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+	if height == 0 || height > uint64(len(bs.blocks)) || bs.missing[height] {
+		return nil
+	}
+	return bs.blocks[height-1]
+}
+
+func (bs *testBlockStore) LoadBlockCommit(height uint64) *consensus.Commit {
+	return consensus.NewCommit(height, 0, common.Hash{}, nil)
+}
+
+func (bs *testBlockStore) LoadSeenCommit() *consensus.Commit { return nil }
+
+func (bs *testBlockStore) Iterate(from, to uint64, reverse bool, fn func(*consensus.BlockMeta) bool) error {
+	for height := from; height <= to; height++ {
+		if block := bs.LoadBlock(height); block != nil && !fn(consensus.NewBlockMeta(block, int(block.Size()))) {
+			break
+		}
+	}
+	return nil
+}
+
+func (bs *testBlockStore) SaveBlock(block *consensus.FullBlock, commit *consensus.Commit) {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+	bs.blocks = append(bs.blocks, block)
+}
+
+func makeTestBlock(height uint64) *consensus.FullBlock {
+	return &consensus.FullBlock{
+		Block: types.NewBlock(
+			&consensus.Header{
+				Number:         new(big.Int).SetUint64(height),
+				TimeMs:         1000 * height,
+				Difficulty:     big.NewInt(1),
+				Extra:          []byte{},
+				BaseFee:        big.NewInt(7),
+				NextValidators: []common.Address{},
+			},
+			[]*types.Transaction{},
+			[]*types.Header{},
+			[]*types.Receipt{},
+			trie.NewStackTrie(nil),
+		),
+		LastCommit: consensus.NewCommit(height-1, 0, common.Hash{}, nil),
+	}
+}
+
+type testTxs struct {
+	txs []*types.Transaction
+}
+
+func (txs *testTxs) SubmitTx(tx *types.Transaction) error {
+	if tx.Nonce() == 0 {
+		return errors.New("nonce too low")
+	}
+	txs.txs = append(txs.txs, tx)
+	return nil
+}
+
+type testNet struct{}
+
+func (testNet) NetInfo() rpc.ResultNetInfo {
+	return rpc.ResultNetInfo{PeerID: "test", Peers: 3, Outbound: 1}
+}
+
+type testMessages struct{}
+
+func (testMessages) SuspendMessages(kinds []string, d time.Duration) ([]rpc.ResultMessageSuspension, error) {
+	suspensions := make([]rpc.ResultMessageSuspension, len(kinds))
+	for i, kind := range kinds {
+		suspensions[i] = rpc.ResultMessageSuspension{Kind: kind, UntilMs: uint64(d.Milliseconds())}
+	}
+	return suspensions, nil
+}
+
+func (testMessages) ResumeMessages(kinds []string) []rpc.ResultMessageSuspension {
+	return []rpc.ResultMessageSuspension{}
+}
+
+func assertErrorContains(t *testing.T, err error, contains string) {
+	t.Helper()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), contains)
+	}
+}
+
+// newTestClients serves env on an in-process RPC server, and returns a
+// WebSocket client of it along with the local client of env.
+func newTestClients(t *testing.T, env *rpc.Environment) map[string]client.Client {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	server, err := rpc.NewServer("127.0.0.1:0", env)
+	require.NoError(t, err)
+	require.NoError(t, server.Start(ctx))
+
+	remote, err := client.Dial(ctx, fmt.Sprintf("ws://%v/websocket", server.Addr()), client.WithRetry(client.RetryConfig{}))
+	require.NoError(t, err)
+	t.Cleanup(remote.Close)
+
+	return map[string]client.Client{"remote": remote, "local": local.New(env)}
+}
+
+func newTestEnv(t *testing.T, blocks uint64) (*rpc.Environment, *testTxs) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	bs := &testBlockStore{}
+	for height := uint64(1); height <= blocks; height++ {
+		bs.SaveBlock(makeTestBlock(height), nil)
+	}
+	txs := &testTxs{}
+	return &rpc.Environment{
+		BlockStore: bs,
+		Executor:   consensus.NewDefaultBlockExecutor(db),
+		Net:        testNet{},
+		Txs:        txs,
+		Messages:   testMessages{},
+		Admin:      true,
+	}, txs
+}
+
+func TestClientEndpoints(t *testing.T) {
+	env, txs := newTestEnv(t, 3)
+	for name, c := range newTestClients(t, env) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			status, err := c.Status(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, uint64(3), status.LatestHeight)
+			assert.Equal(t, env.BlockStore.LoadBlock(3).Hash(), status.LatestBlockHash)
+
+			block, err := c.Block(ctx, 2)
+			require.NoError(t, err)
+			assert.Equal(t, env.BlockStore.LoadBlock(2).Hash(), block.Hash())
+			_, err = c.Block(ctx, 4)
+			assert.Error(t, err)
+
+			commit, err := c.Commit(ctx, 0)
+			require.NoError(t, err)
+			assert.Equal(t, uint64(3), commit.Commit.Height)
+
+			metas, err := c.BlockMetas(ctx, 1, 0, false)
+			require.NoError(t, err)
+			assert.Len(t, metas, 3)
+
+			tx := types.NewTx(&types.LegacyTx{Nonce: 1, Gas: 21000, GasPrice: big.NewInt(1)})
+			hash, err := c.BroadcastTx(ctx, tx)
+			require.NoError(t, err)
+			assert.Equal(t, tx.Hash(), hash)
+			assert.Equal(t, tx.Hash(), txs.txs[len(txs.txs)-1].Hash())
+			_, err = c.BroadcastTx(ctx, types.NewTx(&types.LegacyTx{Gas: 21000, GasPrice: big.NewInt(1)}))
+			assertErrorContains(t, err, "nonce too low")
+
+			info, err := c.NetInfo(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, testNet{}.NetInfo(), *info)
+
+			suspensions, err := c.SuspendMessages(ctx, []string{"txs"}, 2*time.Second)
+			require.NoError(t, err)
+			assert.Equal(t, []rpc.ResultMessageSuspension{{Kind: "txs", UntilMs: 2000}}, suspensions)
+			suspensions, err = c.ResumeMessages(ctx, []string{"txs"})
+			require.NoError(t, err)
+			assert.Empty(t, suspensions)
+
+			// the components the node does not run are reported, not zero values
+			_, err = c.StoreStats(ctx)
+			assertErrorContains(t, err, rpc.ErrNoStores.Error())
+			_, err = c.ConsensusParams(ctx, 0)
+			assertErrorContains(t, err, rpc.ErrNoParamsStore.Error())
+			_, err = c.Validators(ctx, 0)
+			assertErrorContains(t, err, rpc.ErrNoValidatorStore.Error())
+			_, err = c.ValidatorSetDiff(ctx, 1, 2)
+			assertErrorContains(t, err, rpc.ErrNoValidatorStore.Error())
+			_, err = c.HeightTimings(ctx, 1, 0)
+			assertErrorContains(t, err, rpc.ErrNoHeightTimings.Error())
+			_, err = c.QuorumStatus(ctx)
+			assertErrorContains(t, err, rpc.ErrNoConsensusState.Error())
+			_, err = c.RoundState(ctx)
+			assertErrorContains(t, err, rpc.ErrNoConsensusState.Error())
+			_, err = c.RoundStateSnapshot(ctx)
+			assertErrorContains(t, err, rpc.ErrNoConsensusState.Error())
+			_, err = c.LockState(ctx)
+			assertErrorContains(t, err, rpc.ErrNoConsensusState.Error())
+			_, err = c.Halt(ctx, "test")
+			assertErrorContains(t, err, rpc.ErrNoConsensusState.Error())
+			_, err = c.Resume(ctx)
+			assertErrorContains(t, err, rpc.ErrNoConsensusState.Error())
+			_, err = c.ABCIQuery(ctx, "/", nil, 0, false)
+			assertErrorContains(t, err, consensus.ErrQueryNotSupported.Error())
+			_, err = c.SubscribeRoundEvents(ctx, make(chan consensus.RoundEvent))
+			assertErrorContains(t, err, rpc.ErrNoConsensusState.Error())
+		})
+	}
+}
+
+func TestClientSubmitVotesNotServed(t *testing.T) {
+	env, _ := newTestEnv(t, 1)
+	// served on the IPC socket only
+	_, err := newTestClients(t, env)["remote"].SubmitVotes(context.Background(), nil)
+	assert.Error(t, err)
+}
+
+func TestClientSubscribeBlocks(t *testing.T) {
+	defer func(d time.Duration) { rpc.NewBlockPollInterval = d }(rpc.NewBlockPollInterval)
+	rpc.NewBlockPollInterval = 10 * time.Millisecond
+
+	env, _ := newTestEnv(t, 2)
+	bs := env.BlockStore.(*testBlockStore)
+	for name, c := range newTestClients(t, env) {
+		t.Run(name, func(t *testing.T) {
+			blockC := make(chan *consensus.FullBlock)
+			sub, err := c.SubscribeBlocksFrom(context.Background(), 1, blockC)
+			require.NoError(t, err)
+			defer sub.Unsubscribe()
+
+			for height := uint64(1); height <= 2; height++ {
+				select {
+				case block := <-blockC:
+					assert.Equal(t, height, block.NumberU64())
+				case err := <-sub.Err():
+					t.Fatalf("subscription failed: %v", err)
+				case <-time.After(5 * time.Second):
+					t.Fatalf("no block %d", height)
+				}
+			}
+		})
+	}
+
+	// a block missing is not skipped, the subscriptions fail on it
+	bs.mtx.Lock()
+	bs.missing = map[uint64]bool{3: true}
+	bs.mtx.Unlock()
+	for name, c := range newTestClients(t, env) {
+		t.Run(name+" missing", func(t *testing.T) {
+			blockC := make(chan *consensus.FullBlock, 4)
+			sub, err := c.SubscribeBlocksFrom(context.Background(), 2, blockC)
+			require.NoError(t, err)
+			defer sub.Unsubscribe()
+
+			bs.SaveBlock(makeTestBlock(3), nil)
+			bs.SaveBlock(makeTestBlock(4), nil)
+
+			select {
+			case err := <-sub.Err():
+				assertErrorContains(t, err, "height 3 not found")
+			case <-time.After(5 * time.Second):
+				t.Fatal("subscription did not fail")
+			}
+			require.Len(t, blockC, 1)
+			assert.Equal(t, uint64(2), (<-blockC).NumberU64())
+		})
+		bs.mtx.Lock()
+		bs.blocks = bs.blocks[:2]
+		bs.mtx.Unlock()
+	}
+}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"context"
+	"time"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// FollowBlocks sends every block from height from on to ch until the context
+// is canceled, which it returns the error of. When the subscription fails,
+// e.g., as the connection to the node drops, it subscribes again from the
+// block after the last one sent, so ch gets every block once and in order.
+func FollowBlocks(ctx context.Context, c Client, from uint64, ch chan<- *consensus.FullBlock) error {
+	backoff := DefaultRetryConfig.InitialBackoff
+	next := from
+	for {
+		resumed, err := followBlocks(ctx, c, next, ch)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if resumed > next {
+			next = resumed
+			backoff = DefaultRetryConfig.InitialBackoff
+		}
+
+		log.Debug("block subscription ended, resubscribing", "from", next, "backoff", backoff, "err", err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > DefaultRetryConfig.MaxBackoff {
+			backoff = DefaultRetryConfig.MaxBackoff
+		}
+	}
+}
+
+// followBlocks runs one subscription from height next, and returns the height
+// to resume from when it ends.
+func followBlocks(ctx context.Context, c Client, next uint64, ch chan<- *consensus.FullBlock) (uint64, error) {
+	blockC := make(chan *consensus.FullBlock)
+	sub, err := c.SubscribeBlocksFrom(ctx, next, blockC)
+	if err != nil {
+		return next, err
+	}
+	defer sub.Unsubscribe()
+
+	for {
+		select {
+		case block := <-blockC:
+			if block.NumberU64() < next {
+				continue
+			}
+			select {
+			case ch <- block:
+				next = block.NumberU64() + 1
+			case <-ctx.Done():
+				return next, ctx.Err()
+			}
+		case err := <-sub.Err():
+			return next, err
+		case <-ctx.Done():
+			return next, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package local
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/QuarkChain/go-minimal-pbft/rpc"
+	"github.com/QuarkChain/go-minimal-pbft/rpc/client"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// Local is a client.Client calling the node components directly, without
+// encoding or a network round trip, for code embedding the node. Such code
+// runs the node, so the admin and vote endpoints are served whatever
+// rpc.Environment.Admin.
+type Local struct {
+	env  *rpc.Environment
+	abci *rpc.ABCIAPI
+}
+
+var _ client.Client = (*Local)(nil)
+
+func New(env *rpc.Environment) *Local {
+	return &Local{env: env, abci: rpc.NewABCIAPI(env)}
+}
+
+func (c *Local) Status(ctx context.Context) (*rpc.ResultStatus, error) {
+	return rpc.NewChainAPI(c.env).Status(ctx)
+}
+
+func (c *Local) Block(ctx context.Context, height uint64) (*consensus.FullBlock, error) {
+	height, err := rpc.ResolveHeight(c.env.BlockStore, height)
+	if err != nil {
+		return nil, err
+	}
+
+	block := c.env.BlockStore.LoadBlock(height)
+	if block == nil {
+		return nil, fmt.Errorf("block at height %d not found", height)
+	}
+	return block, nil
+}
+
+func (c *Local) Commit(ctx context.Context, height uint64) (*rpc.ResultCommit, error) {
+	return rpc.NewChainAPI(c.env).Commit(ctx, height)
+}
+
+func (c *Local) BlockMetas(ctx context.Context, from, to uint64, reverse bool) ([]*consensus.BlockMeta, error) {
+	return rpc.NewChainAPI(c.env).BlockMetas(ctx, from, to, reverse)
+}
+
+func (c *Local) StoreStats(ctx context.Context) ([]consensus.StoreStats, error) {
+	return rpc.NewChainAPI(c.env).StoreStats(ctx)
+}
+
+func (c *Local) ConsensusParams(ctx context.Context, height uint64) (*consensus.ConsensusParams, error) {
+	return rpc.NewChainAPI(c.env).ConsensusParams(ctx, height)
+}
+
+func (c *Local) ABCIQuery(ctx context.Context, path string, data []byte, height uint64, prove bool) (*rpc.ResultQuery, error) {
+	return c.abci.Query(ctx, path, data, height, prove)
+}
+
+func (c *Local) BroadcastTx(ctx context.Context, tx *types.Transaction) (common.Hash, error) {
+	if c.env.Txs == nil {
+		return common.Hash{}, rpc.ErrNoTxs
+	}
+	if err := c.env.Txs.SubmitTx(tx); err != nil {
+		return common.Hash{}, err
+	}
+	return consensus.TxHash(c.env.Executor, tx), nil
+}
+
+func (c *Local) QuorumStatus(ctx context.Context) (*consensus.QuorumStatus, error) {
+	return rpc.NewConsensusAPI(c.env).Quorum(ctx)
+}
+
+func (c *Local) RoundState(ctx context.Context) (*consensus.RoundStateSummary, error) {
+	return rpc.NewConsensusAPI(c.env).RoundState(ctx)
+}
+
+func (c *Local) RoundStateSnapshot(ctx context.Context) (*consensus.RoundStateSnapshot, error) {
+	return rpc.NewConsensusAPI(c.env).RoundStateSnapshot(ctx)
+}
+
+func (c *Local) LockState(ctx context.Context) (*consensus.LockState, error) {
+	return rpc.NewConsensusAPI(c.env).LockState(ctx)
+}
+
+func (c *Local) HeightTimings(ctx context.Context, from, to uint64) ([]*consensus.HeightTiming, error) {
+	return rpc.NewConsensusAPI(c.env).HeightTimings(ctx, from, to)
+}
+
+func (c *Local) ValidatorSetDiff(ctx context.Context, from, to uint64) (*consensus.ValidatorSetDiff, error) {
+	return rpc.NewChainAPI(c.env).ValidatorSetDiff(ctx, from, to)
+}
+
+func (c *Local) Validators(ctx context.Context, height uint64) ([]consensus.ValidatorInfo, error) {
+	return rpc.NewChainAPI(c.env).Validators(ctx, height)
+}
+
+func (c *Local) NetInfo(ctx context.Context) (*rpc.ResultNetInfo, error) {
+	return rpc.NewNetAPI(c.env).Info(ctx)
+}
+
+func (c *Local) Halt(ctx context.Context, reason string) (*consensus.HaltStatus, error) {
+	return rpc.NewAdminAPI(c.env).Halt(ctx, reason)
+}
+
+func (c *Local) Resume(ctx context.Context) (*consensus.HaltStatus, error) {
+	return rpc.NewAdminAPI(c.env).Resume(ctx)
+}
+
+func (c *Local) SuspendMessages(ctx context.Context, kinds []string, d time.Duration) ([]rpc.ResultMessageSuspension, error) {
+	if c.env.Messages == nil {
+		return nil, rpc.ErrNoNet
+	}
+	return c.env.Messages.SuspendMessages(kinds, d)
+}
+
+func (c *Local) ResumeMessages(ctx context.Context, kinds []string) ([]rpc.ResultMessageSuspension, error) {
+	return rpc.NewAdminAPI(c.env).ResumeMessages(ctx, kinds)
+}
+
+func (c *Local) SubmitVotes(ctx context.Context, votes []*consensus.Vote) ([]string, error) {
+	return rpc.NewVoteAPI(c.env).Submit(ctx, votes)
+}
+
+func (c *Local) SubscribeNewBlocks(ctx context.Context, ch chan<- *consensus.FullBlock) (client.Subscription, error) {
+	return c.subscribeBlocks(ctx, nil, ch)
+}
+
+func (c *Local) SubscribeBlocksFrom(ctx context.Context, from uint64, ch chan<- *consensus.FullBlock) (client.Subscription, error) {
+	return c.subscribeBlocks(ctx, &from, ch)
+}
+
+func (c *Local) SubscribeRoundEvents(ctx context.Context, ch chan<- consensus.RoundEvent, eventTypes ...consensus.RoundEventType) (client.Subscription, error) {
+	if c.env.ConsensusState == nil {
+		return nil, rpc.ErrNoConsensusState
+	}
+	return c.env.ConsensusState.SubscribeRoundEvents(ch, eventTypes...), nil
+}
+
+func (c *Local) subscribeBlocks(ctx context.Context, from *uint64, ch chan<- *consensus.FullBlock) (client.Subscription, error) {
+	next, err := rpc.SubscriptionStart(c.env.BlockStore, from)
+	if err != nil {
+		return nil, err
+	}
+
+	sub := &subscription{errC: make(chan error, 1), quit: make(chan struct{})}
+	go sub.run(ctx, c.env.BlockStore, next, ch)
+	return sub, nil
+}
+
+// subscription polls the block store like the RPC server does, so local and
+// remote subscribers see the same blocks, and end with an error on the same
+// missing block. Unlike a remote subscription, it also ends when the context
+// passed to SubscribeNewBlocks is canceled.
+type subscription struct {
+	errC     chan error
+	quit     chan struct{}
+	quitOnce sync.Once
+}
+
+func (sub *subscription) run(ctx context.Context, bs consensus.BlockStore, next uint64, ch chan<- *consensus.FullBlock) {
+	defer close(sub.errC)
+
+	ticker := time.NewTicker(rpc.NewBlockPollInterval)
+	defer ticker.Stop()
+
+	for {
+		for ; next <= bs.Height(); next++ {
+			block := bs.LoadBlock(next)
+			if block == nil {
+				sub.errC <- fmt.Errorf("block at height %d not found", next)
+				return
+			}
+			select {
+			case ch <- block:
+			case <-sub.quit:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-sub.quit:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (sub *subscription) Err() <-chan error {
+	return sub.errC
+}
+
+func (sub *subscription) Unsubscribe() {
+	sub.quitOnce.Do(func() { close(sub.quit) })
+}
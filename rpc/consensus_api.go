@@ -0,0 +1,133 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	ethrpc "github.com/ethereum/go-ethereum/rpc"
+)
+
+var (
+	ErrNoConsensusState = errors.New("consensus is not running")
+	ErrNoHeightTimings  = errors.New("height timings are not recorded")
+)
+
+// ConsensusAPI serves the live consensus state.
+type ConsensusAPI struct {
+	env *Environment
+}
+
+func NewConsensusAPI(env *Environment) *ConsensusAPI {
+	return &ConsensusAPI{env: env}
+}
+
+// Quorum is served as "consensus_quorum". While the network is halted it
+// reports since when, and which validators' votes are missing.
+func (api *ConsensusAPI) Quorum(ctx context.Context) (*consensus.QuorumStatus, error) {
+	if api.env.ConsensusState == nil {
+		return nil, ErrNoConsensusState
+	}
+	status := api.env.ConsensusState.QuorumStatus()
+	return &status, nil
+}
+
+// RoundState is served as "consensus_roundState", the summary of the
+// current round.
+func (api *ConsensusAPI) RoundState(ctx context.Context) (*consensus.RoundStateSummary, error) {
+	if api.env.ConsensusState == nil {
+		return nil, ErrNoConsensusState
+	}
+	summary := api.env.ConsensusState.GetRoundStateSummary()
+	return &summary, nil
+}
+
+// RoundStateSnapshot is served as "consensus_roundStateSnapshot", the round
+// state with the validator sets and the votes of every round.
+func (api *ConsensusAPI) RoundStateSnapshot(ctx context.Context) (*consensus.RoundStateSnapshot, error) {
+	if api.env.ConsensusState == nil {
+		return nil, ErrNoConsensusState
+	}
+	return api.env.ConsensusState.GetRoundStateSnapshot(), nil
+}
+
+// LockState is served as "consensus_lockState", the lock and the valid block
+// of the current height with the polkas and the transitions justifying them.
+func (api *ConsensusAPI) LockState(ctx context.Context) (*consensus.LockState, error) {
+	if api.env.ConsensusState == nil {
+		return nil, ErrNoConsensusState
+	}
+	ls := api.env.ConsensusState.GetLockState()
+	return &ls, nil
+}
+
+// MaxHeightTimings is the most height timings returned by one HeightTimings
+// call.
+var MaxHeightTimings = 100
+
+// HeightTimings is served as "consensus_heightTimings". It returns the
+// recorded timings of the heights in [from, to] (to 0 for the latest), at
+// most MaxHeightTimings of them from the highest; heights synced instead of
+// committed by consensus, or too old, have none.
+func (api *ConsensusAPI) HeightTimings(ctx context.Context, from, to uint64) ([]*consensus.HeightTiming, error) {
+	if api.env.HeightTimings == nil {
+		return nil, ErrNoHeightTimings
+	}
+	to, err := ResolveHeight(api.env.BlockStore, to)
+	if err != nil {
+		return nil, err
+	}
+
+	// older heights are overwritten
+	if size := api.env.HeightTimings.Size(); to >= size && from <= to-size {
+		from = to - size + 1
+	}
+
+	timings := make([]*consensus.HeightTiming, 0)
+	for height := to; height >= from && height > 0 && len(timings) < MaxHeightTimings; height-- {
+		if t := api.env.HeightTimings.Load(height); t != nil {
+			timings = append(timings, t)
+		}
+	}
+	return timings, nil
+}
+
+// roundEventsBuffer is the round events buffered for a subscriber, past which
+// it misses some.
+const roundEventsBuffer = 256
+
+// RoundEvents is served as the "roundEvents" subscription of
+// "consensus_subscribe" (WebSocket only), notifying the transitions of the
+// state machine, see consensus.RoundEvent. Given types, e.g. ["Commit"], only
+// those are notified.
+func (api *ConsensusAPI) RoundEvents(ctx context.Context, types []consensus.RoundEventType) (*ethrpc.Subscription, error) {
+	notifier, supported := ethrpc.NotifierFromContext(ctx)
+	if !supported {
+		return &ethrpc.Subscription{}, ethrpc.ErrNotificationsUnsupported
+	}
+	if api.env.ConsensusState == nil {
+		return nil, ErrNoConsensusState
+	}
+
+	rpcSub := notifier.CreateSubscription()
+	eventC := make(chan consensus.RoundEvent, roundEventsBuffer)
+	sub := api.env.ConsensusState.SubscribeRoundEvents(eventC, types...)
+
+	go func() {
+		defer sub.Unsubscribe()
+		for {
+			select {
+			case ev := <-eventC:
+				if err := notifier.Notify(rpcSub.ID, ev); err != nil {
+					return
+				}
+			case <-rpcSub.Err():
+				return
+			case <-notifier.Closed():
+				return
+			}
+		}
+	}()
+
+	return rpcSub, nil
+}
@@ -0,0 +1,48 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"google.golang.org/grpc"
+)
+
+// StreamBlocks calls StreamBlocks, passing every block received to fn with
+// its cursor, until the stream ends, fn fails or the context is canceled.
+// The stream of a following request only ends with an error: calling it again
+// with the last cursor resumes it.
+func StreamBlocks(ctx context.Context, cc *grpc.ClientConn, req *StreamBlocksRequest, fn func(block *consensus.FullBlock, cursor uint64) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := cc.NewStream(ctx, &grpc.StreamDesc{StreamName: "StreamBlocks", ServerStreams: true},
+		StreamBlocksMethod, grpc.CallContentSubtype(ContentSubtype))
+	if err != nil {
+		return err
+	}
+	if err := stream.SendMsg(req); err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+
+	for {
+		resp := &StreamBlocksResponse{}
+		if err := stream.RecvMsg(resp); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		block := &consensus.FullBlock{}
+		if err := block.DecodeFromRLPBytes(resp.Raw); err != nil {
+			return err
+		}
+		if err := fn(block, resp.Cursor); err != nil {
+			return err
+		}
+	}
+}
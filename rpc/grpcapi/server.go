@@ -0,0 +1,167 @@
+// Package grpcapi streams the blocks of a node over gRPC, for pipelines
+// exporting the chain.
+//
+// The messages are not protobuf but JSON, with the gRPC content subtype
+// "json" (content type application/grpc+json): any gRPC client sending with
+// this subtype, or the Go client of this package, calls the service
+// without generated code.
+package grpcapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/QuarkChain/go-minimal-pbft/rpc"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	ServiceName = "mpbft.BlockStream"
+	// StreamBlocksMethod is the full method name of StreamBlocks.
+	StreamBlocksMethod = "/" + ServiceName + "/StreamBlocks"
+	ContentSubtype     = "json"
+)
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (jsonCodec) Name() string                               { return ContentSubtype }
+
+type StreamBlocksRequest struct {
+	FromHeight uint64 `json:"from_height"`
+	// Follow keeps streaming the new blocks once the stored ones are sent.
+	Follow bool `json:"follow"`
+	// Cursor of the last block received, to resume a stream from the block
+	// after it; set, it replaces FromHeight.
+	Cursor uint64 `json:"cursor,omitempty"`
+}
+
+type StreamBlocksResponse struct {
+	Height uint64        `json:"height"`
+	Hash   common.Hash   `json:"hash"`
+	Raw    hexutil.Bytes `json:"raw"` // RLP encoded full block, see rpc.ResultBlock
+	// Cursor to resume the stream after this block.
+	Cursor uint64 `json:"cursor"`
+}
+
+// Server serves the BlockStream service.
+type Server struct {
+	addr       string
+	bs         consensus.BlockStore
+	grpcServer *grpc.Server
+}
+
+func NewServer(addr string, bs consensus.BlockStore) *Server {
+	s := &Server{addr: addr, bs: bs, grpcServer: grpc.NewServer()}
+	s.grpcServer.RegisterService(&grpc.ServiceDesc{
+		ServiceName: ServiceName,
+		HandlerType: (*interface{})(nil),
+		Streams: []grpc.StreamDesc{{
+			StreamName:    "StreamBlocks",
+			Handler:       streamBlocksHandler,
+			ServerStreams: true,
+		}},
+	}, s)
+	return s
+}
+
+func streamBlocksHandler(srv interface{}, stream grpc.ServerStream) error {
+	req := &StreamBlocksRequest{}
+	if err := stream.RecvMsg(req); err != nil {
+		return err
+	}
+	return srv.(*Server).StreamBlocks(req, stream)
+}
+
+// StreamBlocks sends the stored blocks from the requested height on and, if
+// following, the new ones as they are stored. Sending blocks while the client
+// does not read them, which is the flow control of gRPC: a slow client slows
+// down its stream instead of piling up blocks in the node.
+func (s *Server) StreamBlocks(req *StreamBlocksRequest, stream grpc.ServerStream) error {
+	from := req.FromHeight
+	if req.Cursor != 0 {
+		from = req.Cursor
+	}
+	next, err := rpc.SubscriptionStart(s.bs, &from)
+	if err != nil {
+		return status.Error(codes.OutOfRange, err.Error())
+	}
+
+	ctx := stream.Context()
+	ticker := time.NewTicker(rpc.NewBlockPollInterval)
+	defer ticker.Stop()
+
+	for {
+		for ; next <= s.bs.Height(); next++ {
+			block := s.bs.LoadBlock(next)
+			if block == nil {
+				continue
+			}
+			raw, err := block.EncodeToRLPBytes()
+			if err != nil {
+				return status.Error(codes.Internal, err.Error())
+			}
+			if err := stream.SendMsg(&StreamBlocksResponse{
+				Height: next,
+				Hash:   block.Hash(),
+				Raw:    raw,
+				Cursor: next + 1,
+			}); err != nil {
+				return err
+			}
+		}
+		if !req.Follow {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Start listens on the configured address and serves until the context is
+// canceled.
+func (s *Server) Start(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+
+	log.Info("gRPC server started", "addr", listener.Addr())
+
+	go func() {
+		if err := s.grpcServer.Serve(listener); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+			log.Error("gRPC server stopped", "err", err)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		s.Stop()
+	}()
+
+	return nil
+}
+
+// Stop ends the streams, which only end by themselves when not following.
+func (s *Server) Stop() {
+	s.grpcServer.Stop()
+}
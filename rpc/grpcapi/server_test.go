@@ -0,0 +1,182 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// testBlockStore keeps the blocks from base on in memory.
+type testBlockStore struct {
+	mtx    sync.Mutex
+	base   uint64
+	blocks []*consensus.FullBlock
+}
+
+func (bs *testBlockStore) Base() uint64 { return bs.base }
+
+func (bs *testBlockStore) Height() uint64 {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+	return uint64(len(bs.blocks))
+}
+
+func (bs *testBlockStore) Size() uint64 { return bs.Height() }
+
+func (bs *testBlockStore) LoadBlock(height uint64) *consensus.FullBlock {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+	if height < bs.base || height == 0 || height > uint64(len(bs.blocks)) {
+		return nil
+	}
+	return bs.blocks[height-1]
+}
+
+func (bs *testBlockStore) LoadBlockCommit(height uint64) *consensus.Commit { return nil }
+func (bs *testBlockStore) LoadSeenCommit() *consensus.Commit               { return nil }
+
+func (bs *testBlockStore) Iterate(from, to uint64, reverse bool, fn func(*consensus.BlockMeta) bool) error {
+	return nil
+}
+
+func (bs *testBlockStore) SaveBlock(block *consensus.FullBlock, commit *consensus.Commit) {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+	bs.blocks = append(bs.blocks, block)
+}
+
+func makeTestBlock(height uint64) *consensus.FullBlock {
+	return &consensus.FullBlock{
+		Block: types.NewBlock(
+			&consensus.Header{
+				Number:         new(big.Int).SetUint64(height),
+				TimeMs:         1000 * height,
+				Difficulty:     big.NewInt(1),
+				Extra:          []byte{},
+				BaseFee:        big.NewInt(7),
+				NextValidators: []common.Address{},
+			},
+			[]*types.Transaction{},
+			[]*types.Header{},
+			[]*types.Receipt{},
+			trie.NewStackTrie(nil),
+		),
+		LastCommit: consensus.NewCommit(height-1, 0, common.Hash{}, nil),
+	}
+}
+
+// newTestServer serves the blocks of a store of n blocks, pruned below base,
+// and returns a client connection to it.
+func newTestServer(t *testing.T, base, n uint64) (*testBlockStore, *grpc.ClientConn) {
+	bs := &testBlockStore{base: base}
+	for height := uint64(1); height <= n; height++ {
+		bs.SaveBlock(makeTestBlock(height), nil)
+	}
+
+	s := NewServer("127.0.0.1:0", bs)
+	listener, err := net.Listen("tcp", s.addr)
+	require.NoError(t, err)
+	go s.grpcServer.Serve(listener)
+	t.Cleanup(s.Stop)
+
+	cc, err := grpc.Dial(listener.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	t.Cleanup(func() { cc.Close() })
+	return bs, cc
+}
+
+type streamedBlock struct {
+	height uint64
+	hash   common.Hash
+	cursor uint64
+}
+
+func collectBlocks(blocks *[]streamedBlock) func(*consensus.FullBlock, uint64) error {
+	return func(block *consensus.FullBlock, cursor uint64) error {
+		*blocks = append(*blocks, streamedBlock{block.NumberU64(), block.Hash(), cursor})
+		return nil
+	}
+}
+
+func TestStreamBlocks(t *testing.T) {
+	bs, cc := newTestServer(t, 1, 4)
+
+	var blocks []streamedBlock
+	require.NoError(t, StreamBlocks(context.Background(), cc, &StreamBlocksRequest{FromHeight: 2}, collectBlocks(&blocks)))
+	require.Len(t, blocks, 3)
+	for i, block := range blocks {
+		height := uint64(i + 2)
+		assert.Equal(t, streamedBlock{height, bs.LoadBlock(height).Hash(), height + 1}, block)
+	}
+
+	// resumed after the block of the cursor, which replaces the height
+	req := &StreamBlocksRequest{FromHeight: 1, Cursor: blocks[1].cursor}
+	blocks = nil
+	require.NoError(t, StreamBlocks(context.Background(), cc, req, collectBlocks(&blocks)))
+	require.Len(t, blocks, 1)
+	assert.Equal(t, uint64(4), blocks[0].height)
+
+	// fn failing ends the stream
+	errStop := errors.New("stop")
+	calls := 0
+	err := StreamBlocks(context.Background(), cc, &StreamBlocksRequest{FromHeight: 1}, func(*consensus.FullBlock, uint64) error {
+		calls++
+		return errStop
+	})
+	assert.ErrorIs(t, err, errStop)
+	assert.Equal(t, 1, calls)
+}
+
+func TestStreamBlocksFollow(t *testing.T) {
+	bs, cc := newTestServer(t, 1, 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	heights := make(chan uint64)
+	errC := make(chan error, 1)
+	go func() {
+		errC <- StreamBlocks(ctx, cc, &StreamBlocksRequest{FromHeight: 1, Follow: true}, func(block *consensus.FullBlock, cursor uint64) error {
+			heights <- block.NumberU64()
+			return nil
+		})
+	}()
+
+	assert.Equal(t, uint64(1), <-heights)
+	assert.Equal(t, uint64(2), <-heights)
+	// the new blocks follow
+	bs.SaveBlock(makeTestBlock(3), nil)
+	select {
+	case height := <-heights:
+		assert.Equal(t, uint64(3), height)
+	case <-time.After(5 * time.Second):
+		t.Fatal("new block not streamed")
+	}
+
+	// a following stream only ends with an error
+	cancel()
+	assert.Equal(t, codes.Canceled, status.Code(<-errC))
+}
+
+func TestStreamBlocksPruned(t *testing.T) {
+	_, cc := newTestServer(t, 3, 4)
+
+	err := StreamBlocks(context.Background(), cc, &StreamBlocksRequest{FromHeight: 2}, collectBlocks(new([]streamedBlock)))
+	assert.Equal(t, codes.OutOfRange, status.Code(err))
+
+	var blocks []streamedBlock
+	require.NoError(t, StreamBlocks(context.Background(), cc, &StreamBlocksRequest{FromHeight: 3}, collectBlocks(&blocks)))
+	assert.Len(t, blocks, 2)
+}
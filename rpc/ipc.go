@@ -0,0 +1,78 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+
+	"github.com/ethereum/go-ethereum/log"
+	ethrpc "github.com/ethereum/go-ethereum/rpc"
+)
+
+// IPCServer serves JSON-RPC on a unix socket, to the processes of the host
+// allowed to open it. On top of the APIs of Server, it serves VoteAPI.
+type IPCServer struct {
+	path      string
+	rpcServer *ethrpc.Server
+	listener  net.Listener
+}
+
+func NewIPCServer(path string, env *Environment) (*IPCServer, error) {
+	rpcServer := ethrpc.NewServer()
+	apis := map[string]interface{}{
+		"abci":      NewABCIAPI(env),
+		"chain":     NewChainAPI(env),
+		"consensus": NewConsensusAPI(env),
+		"votes":     NewVoteAPI(env),
+	}
+	if env.Admin {
+		apis["admin"] = NewAdminAPI(env)
+	}
+	for name, api := range apis {
+		if err := rpcServer.RegisterName(name, api); err != nil {
+			return nil, err
+		}
+	}
+	return &IPCServer{path: path, rpcServer: rpcServer}, nil
+}
+
+// Start listens on the socket, only accessible to the user of the node, and
+// serves until the context is canceled.
+func (s *IPCServer) Start(ctx context.Context) error {
+	// a socket left by a node that did not shut down cleanly
+	if err := os.Remove(s.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	listener, err := net.Listen("unix", s.path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(s.path, 0600); err != nil {
+		listener.Close()
+		return err
+	}
+	s.listener = listener
+
+	log.Info("IPC server started", "path", s.path)
+
+	go func() {
+		if err := s.rpcServer.ServeListener(listener); err != nil && !errors.Is(err, net.ErrClosed) {
+			log.Error("IPC server stopped", "err", err)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		s.Stop()
+	}()
+
+	return nil
+}
+
+func (s *IPCServer) Stop() {
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.rpcServer.Stop()
+}
@@ -0,0 +1,44 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+)
+
+var ErrNoNet = errors.New("p2p is not running")
+
+// ResultNetInfo is the connectivity of the node, see p2p.NetInfo.
+type ResultNetInfo struct {
+	PeerID            string  `json:"peer_id"`
+	Peers             int     `json:"peers"`
+	Outbound          int     `json:"outbound"`
+	Groups            int     `json:"groups"`
+	ASNs              int     `json:"asns"`
+	LargestGroup      string  `json:"largest_group"`
+	LargestGroupPeers int     `json:"largest_group_peers"`
+	Diversity         float64 `json:"diversity"`
+}
+
+// NetInfoSource reports the connectivity of the node, i.e., the p2p server.
+type NetInfoSource interface {
+	NetInfo() ResultNetInfo
+}
+
+// NetAPI serves the p2p connectivity.
+type NetAPI struct {
+	env *Environment
+}
+
+func NewNetAPI(env *Environment) *NetAPI {
+	return &NetAPI{env: env}
+}
+
+// Info is served as "net_info": the peers, and how many distinct networks
+// (/16 or autonomous systems) they are in.
+func (api *NetAPI) Info(ctx context.Context) (*ResultNetInfo, error) {
+	if api.env.Net == nil {
+		return nil, ErrNoNet
+	}
+	info := api.env.Net.NetInfo()
+	return &info, nil
+}
@@ -0,0 +1,117 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/ethereum/go-ethereum/log"
+	ethrpc "github.com/ethereum/go-ethereum/rpc"
+)
+
+// Environment contains the node components served over RPC.
+type Environment struct {
+	BlockStore      consensus.BlockStore
+	Executor        consensus.BlockExecutor
+	ConsensusState  *consensus.ConsensusState    // nil while syncing
+	HeightTimings   *consensus.HeightTimingStore // nil if not recorded
+	Stores          *consensus.Stores
+	Validators      *consensus.ValidatorStore       // nil if not recorded
+	ConsensusParams *consensus.ConsensusParamsStore // nil if not recorded
+	AppHashes       *consensus.AppHashStore         // nil if not recorded
+	Net             NetInfoSource                   // nil if not networked
+	Txs             TxSubmitter                     // nil if txs are not accepted
+	Messages        MessageSuspender                // nil if not networked
+	Admin           bool                            // serve AdminAPI
+}
+
+// Server serves JSON-RPC over HTTP (on "/") and WebSocket (on "/websocket").
+type Server struct {
+	addr       string
+	rpcServer  *ethrpc.Server
+	httpServer *http.Server
+	listener   net.Listener
+}
+
+func NewServer(addr string, env *Environment) (*Server, error) {
+	rpcServer := ethrpc.NewServer()
+	if err := rpcServer.RegisterName("abci", NewABCIAPI(env)); err != nil {
+		return nil, err
+	}
+	if err := rpcServer.RegisterName("chain", NewChainAPI(env)); err != nil {
+		return nil, err
+	}
+	if err := rpcServer.RegisterName("consensus", NewConsensusAPI(env)); err != nil {
+		return nil, err
+	}
+	if err := rpcServer.RegisterName("net", NewNetAPI(env)); err != nil {
+		return nil, err
+	}
+	if env.Admin {
+		if err := rpcServer.RegisterName("admin", NewAdminAPI(env)); err != nil {
+			return nil, err
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", rpcServer)
+	mux.Handle("/websocket", rpcServer.WebsocketHandler([]string{"*"}))
+
+	return &Server{
+		addr:      addr,
+		rpcServer: rpcServer,
+		httpServer: &http.Server{
+			Addr:              addr,
+			Handler:           mux,
+			ReadHeaderTimeout: 10 * time.Second,
+		},
+	}, nil
+}
+
+// Start listens on the configured address and serves until the context is
+// canceled.
+func (s *Server) Start(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+
+	s.listener = listener
+
+	log.Info("RPC server started", "addr", listener.Addr())
+
+	go func() {
+		if err := s.httpServer.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("RPC server stopped", "err", err)
+		}
+	}()
+
+	go func() {
+		<-ctx.Done()
+		s.Stop()
+	}()
+
+	return nil
+}
+
+// Addr returns the address the server listens on once started, e.g. the port
+// picked for ":0".
+func (s *Server) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+func (s *Server) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		log.Error("failed to shutdown RPC server", "err", err)
+	}
+	s.rpcServer.Stop()
+}
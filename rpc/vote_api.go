@@ -0,0 +1,41 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+)
+
+// MaxSubmittedVotes is the most votes of one votes_submit call.
+var MaxSubmittedVotes = 1000
+
+// VoteAPI takes the votes of co-located signers, and so is only served on the
+// IPC socket.
+type VoteAPI struct {
+	env *Environment
+}
+
+func NewVoteAPI(env *Environment) *VoteAPI {
+	return &VoteAPI{env: env}
+}
+
+// Submit is served as "votes_submit". It returns, for each vote, why it was
+// rejected, "" if it was queued, see ConsensusState.SubmitVotes.
+func (api *VoteAPI) Submit(ctx context.Context, votes []*consensus.Vote) ([]string, error) {
+	if api.env.ConsensusState == nil {
+		return nil, ErrNoConsensusState
+	}
+	if len(votes) > MaxSubmittedVotes {
+		return nil, fmt.Errorf("%d votes, at most %d per call", len(votes), MaxSubmittedVotes)
+	}
+
+	errs := api.env.ConsensusState.SubmitVotes(ctx, votes)
+	results := make([]string, len(errs))
+	for i, err := range errs {
+		if err != nil {
+			results[i] = err.Error()
+		}
+	}
+	return results, nil
+}
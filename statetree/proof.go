@@ -0,0 +1,164 @@
+package statetree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// ProofOpType is the type of the consensus.ProofOp of a statetree proof.
+const ProofOpType = "statetree"
+
+var ErrInvalidProof = errors.New("invalid proof")
+
+// LeafProof proves that a key-value pair is the leaf at Index of a tree of
+// Total leaves.
+type LeafProof struct {
+	Key       []byte
+	ValueHash []byte
+	Index     uint64
+	Total     uint64
+	Aunts     [][]byte
+}
+
+// Proof proves that a key has a value (Leaf), or has none: then Left and
+// Right are the adjacent leaves around the key, one of them being nil at the
+// edges and both in an empty tree of Total 0.
+type Proof struct {
+	Leaf  *LeafProof `rlp:"nil"`
+	Left  *LeafProof `rlp:"nil"`
+	Right *LeafProof `rlp:"nil"`
+	Total uint64
+}
+
+// computeRoot returns the root hash of the tree the leaf proof is for.
+func (p *LeafProof) computeRoot() ([]byte, error) {
+	if p.Index >= p.Total {
+		return nil, fmt.Errorf("%w: leaf %d of %d", ErrInvalidProof, p.Index, p.Total)
+	}
+	root, rest := computeRoot(leafHash(p.Key, p.ValueHash), int(p.Index), int(p.Total), p.Aunts)
+	if root == nil || len(rest) != 0 {
+		return nil, fmt.Errorf("%w: %d aunts for leaf %d of %d", ErrInvalidProof, len(p.Aunts), p.Index, p.Total)
+	}
+	return root, nil
+}
+
+// computeRoot hashes the leaf up to the root of a subtree of total leaves. It
+// consumes the aunts from the top, and returns nil if there are too few.
+func computeRoot(leaf []byte, index, total int, aunts [][]byte) ([]byte, [][]byte) {
+	if total == 1 {
+		return leaf, aunts
+	}
+	if len(aunts) == 0 {
+		return nil, nil
+	}
+
+	k := split(total)
+	top, rest := aunts[len(aunts)-1], aunts[:len(aunts)-1]
+	if index < k {
+		left, rest := computeRoot(leaf, index, k, rest)
+		if left == nil {
+			return nil, nil
+		}
+		return innerHash(left, top), rest
+	}
+	right, rest := computeRoot(leaf, index-k, total-k, rest)
+	if right == nil {
+		return nil, nil
+	}
+	return innerHash(top, right), rest
+}
+
+// Verify verifies that key has value in the tree of the root hash, or if
+// value is nil, that key is absent from it.
+func (p *Proof) Verify(root []byte, key []byte, value []byte) error {
+	if value != nil {
+		return p.verifyExistence(root, key, value)
+	}
+	return p.verifyAbsence(root, key)
+}
+
+func (p *Proof) verifyExistence(root []byte, key []byte, value []byte) error {
+	if p.Leaf == nil {
+		return fmt.Errorf("%w: not an existence proof", ErrInvalidProof)
+	}
+	if !bytes.Equal(p.Leaf.Key, key) || !bytes.Equal(p.Leaf.ValueHash, hash(value)) {
+		return fmt.Errorf("%w: proof of another key-value pair", ErrInvalidProof)
+	}
+	return verifyLeaf(root, p.Leaf)
+}
+
+func (p *Proof) verifyAbsence(root []byte, key []byte) error {
+	if p.Leaf != nil {
+		return fmt.Errorf("%w: the key exists", ErrInvalidProof)
+	}
+
+	if p.Left == nil && p.Right == nil {
+		if p.Total != 0 || !bytes.Equal(root, EmptyHash) {
+			return fmt.Errorf("%w: no neighbor in a non-empty tree", ErrInvalidProof)
+		}
+		return nil
+	}
+
+	if p.Left != nil {
+		if err := verifyLeaf(root, p.Left); err != nil {
+			return err
+		}
+		if p.Left.Total != p.Total || bytes.Compare(p.Left.Key, key) >= 0 {
+			return fmt.Errorf("%w: left neighbor not before the key", ErrInvalidProof)
+		}
+		if p.Right == nil && p.Left.Index != p.Total-1 {
+			return fmt.Errorf("%w: left neighbor not the last leaf", ErrInvalidProof)
+		}
+	}
+	if p.Right != nil {
+		if err := verifyLeaf(root, p.Right); err != nil {
+			return err
+		}
+		if p.Right.Total != p.Total || bytes.Compare(p.Right.Key, key) <= 0 {
+			return fmt.Errorf("%w: right neighbor not after the key", ErrInvalidProof)
+		}
+		if p.Left == nil && p.Right.Index != 0 {
+			return fmt.Errorf("%w: right neighbor not the first leaf", ErrInvalidProof)
+		}
+	}
+	if p.Left != nil && p.Right != nil && p.Left.Index+1 != p.Right.Index {
+		return fmt.Errorf("%w: neighbors not adjacent", ErrInvalidProof)
+	}
+	return nil
+}
+
+func verifyLeaf(root []byte, p *LeafProof) error {
+	computed, err := p.computeRoot()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(computed, root) {
+		return fmt.Errorf("%w: root mismatch", ErrInvalidProof)
+	}
+	return nil
+}
+
+// ProofOp encodes the proof of key for a consensus.QueryResponse.
+func (p *Proof) ProofOp(key []byte) (consensus.ProofOp, error) {
+	data, err := rlp.EncodeToBytes(p)
+	if err != nil {
+		return consensus.ProofOp{}, err
+	}
+	return consensus.ProofOp{Type: ProofOpType, Key: key, Data: data}, nil
+}
+
+// ProofFromOp decodes a proof encoded by ProofOp.
+func ProofFromOp(op consensus.ProofOp) (*Proof, error) {
+	if op.Type != ProofOpType {
+		return nil, fmt.Errorf("%w: proof op type %q", ErrInvalidProof, op.Type)
+	}
+	var p Proof
+	if err := rlp.DecodeBytes(op.Data, &p); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidProof, err)
+	}
+	return &p, nil
+}
@@ -0,0 +1,241 @@
+// Package statetree is a Merkle-ized key-value store for applications built
+// on the engine: its root hash is a deterministic app hash, and it proves
+// the presence or absence of keys to the clients of the app.
+//
+// The tree is the RFC 6962 Merkle tree of the key-value pairs in key order.
+// Every saved version is kept in memory until deleted, so it suits examples
+// and small states, not large ones.
+package statetree
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var ErrVersionNotFound = errors.New("version not found")
+
+var (
+	leafPrefix  = []byte{0}
+	innerPrefix = []byte{1}
+)
+
+// EmptyHash is the root hash of the empty tree.
+var EmptyHash = hash()
+
+func hash(data ...[]byte) []byte {
+	h := sha256.New()
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// leafHash commits to the key and the value; the key length keeps the
+// boundary between them unambiguous.
+func leafHash(key []byte, valueHash []byte) []byte {
+	var size [8]byte
+	for i, n := 0, uint64(len(key)); i < 8; i, n = i+1, n>>8 {
+		size[7-i] = byte(n)
+	}
+	return hash(leafPrefix, size[:], key, valueHash)
+}
+
+func innerHash(left, right []byte) []byte {
+	return hash(innerPrefix, left, right)
+}
+
+// split returns the largest power of 2 smaller than n, the size of the left
+// subtree of n leaves.
+func split(n int) int {
+	k := 1
+	for k*2 < n {
+		k *= 2
+	}
+	return k
+}
+
+func rootOf(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		return EmptyHash
+	case 1:
+		return leaves[0]
+	}
+	k := split(len(leaves))
+	return innerHash(rootOf(leaves[:k]), rootOf(leaves[k:]))
+}
+
+// aunts returns the hashes of the siblings on the path from the leaf at index
+// to the root, from the bottom.
+func aunts(leaves [][]byte, index int) [][]byte {
+	if len(leaves) <= 1 {
+		return nil
+	}
+	k := split(len(leaves))
+	if index < k {
+		return append(aunts(leaves[:k], index), rootOf(leaves[k:]))
+	}
+	return append(aunts(leaves[k:], index-k), rootOf(leaves[:k]))
+}
+
+// Tree is the working state of the app, of which versions are saved once per
+// block.
+type Tree struct {
+	working  map[string][]byte
+	versions map[int64]*ImmutableTree
+	version  int64
+}
+
+func New() *Tree {
+	return &Tree{
+		working:  make(map[string][]byte),
+		versions: make(map[int64]*ImmutableTree),
+	}
+}
+
+// Set sets the value of a key. Nil values are stored as empty ones.
+func (t *Tree) Set(key, value []byte) {
+	if value == nil {
+		value = []byte{}
+	}
+	t.working[string(key)] = append([]byte{}, value...)
+}
+
+// Get returns the working value of a key, nil if there is none.
+func (t *Tree) Get(key []byte) []byte {
+	return t.working[string(key)]
+}
+
+func (t *Tree) Has(key []byte) bool {
+	_, ok := t.working[string(key)]
+	return ok
+}
+
+func (t *Tree) Delete(key []byte) {
+	delete(t.working, string(key))
+}
+
+// Version is the last saved version, 0 if none.
+func (t *Tree) Version() int64 {
+	return t.version
+}
+
+// WorkingHash is the root hash the working state would be saved with.
+func (t *Tree) WorkingHash() []byte {
+	return t.snapshot(t.version + 1).Hash()
+}
+
+// SaveVersion saves the working state as the next version, and returns its
+// root hash.
+func (t *Tree) SaveVersion() ([]byte, int64) {
+	it := t.snapshot(t.version + 1)
+	t.version++
+	t.versions[t.version] = it
+	return it.Hash(), t.version
+}
+
+// GetImmutable returns a saved version.
+func (t *Tree) GetImmutable(version int64) (*ImmutableTree, error) {
+	it, ok := t.versions[version]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrVersionNotFound, version)
+	}
+	return it, nil
+}
+
+// DeleteVersionsBefore drops the saved versions before version, e.g., the
+// ones no longer queried.
+func (t *Tree) DeleteVersionsBefore(version int64) {
+	for v := range t.versions {
+		if v < version {
+			delete(t.versions, v)
+		}
+	}
+}
+
+func (t *Tree) snapshot(version int64) *ImmutableTree {
+	it := &ImmutableTree{version: version}
+	for k := range t.working {
+		it.keys = append(it.keys, []byte(k))
+	}
+	sort.Slice(it.keys, func(i, j int) bool {
+		return bytes.Compare(it.keys[i], it.keys[j]) < 0
+	})
+
+	it.values = make([][]byte, len(it.keys))
+	it.leaves = make([][]byte, len(it.keys))
+	for i, k := range it.keys {
+		it.values[i] = t.working[string(k)]
+		it.leaves[i] = leafHash(k, hash(it.values[i]))
+	}
+	it.root = rootOf(it.leaves)
+	return it
+}
+
+// ImmutableTree is a saved version of a Tree.
+type ImmutableTree struct {
+	version int64
+	keys    [][]byte // sorted
+	values  [][]byte
+	leaves  [][]byte
+	root    []byte
+}
+
+func (it *ImmutableTree) Version() int64 {
+	return it.version
+}
+
+func (it *ImmutableTree) Hash() []byte {
+	return it.root
+}
+
+func (it *ImmutableTree) Size() int {
+	return len(it.keys)
+}
+
+func (it *ImmutableTree) search(key []byte) (int, bool) {
+	i := sort.Search(len(it.keys), func(i int) bool {
+		return bytes.Compare(it.keys[i], key) >= 0
+	})
+	return i, i < len(it.keys) && bytes.Equal(it.keys[i], key)
+}
+
+// Get returns the value of a key, nil if there is none.
+func (it *ImmutableTree) Get(key []byte) []byte {
+	if i, ok := it.search(key); ok {
+		return it.values[i]
+	}
+	return nil
+}
+
+// GetWithProof returns the value of a key with the proof of it, or if there
+// is none, a nil value with the proof of its absence.
+func (it *ImmutableTree) GetWithProof(key []byte) ([]byte, *Proof) {
+	i, ok := it.search(key)
+	if ok {
+		return it.values[i], &Proof{Leaf: it.leafProof(i)}
+	}
+
+	// the neighbors of the key, adjacent in the tree
+	proof := &Proof{Total: uint64(len(it.keys))}
+	if i > 0 {
+		proof.Left = it.leafProof(i - 1)
+	}
+	if i < len(it.keys) {
+		proof.Right = it.leafProof(i)
+	}
+	return nil, proof
+}
+
+func (it *ImmutableTree) leafProof(i int) *LeafProof {
+	return &LeafProof{
+		Key:       it.keys[i],
+		ValueHash: hash(it.values[i]),
+		Index:     uint64(i),
+		Total:     uint64(len(it.keys)),
+		Aunts:     aunts(it.leaves, i),
+	}
+}
@@ -0,0 +1,79 @@
+package statetree
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProofs(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 3, 5, 8, 13} {
+		tree := New()
+		for i := 0; i < n; i++ {
+			tree.Set([]byte(fmt.Sprintf("key%02d", 2*i)), []byte(fmt.Sprintf("value%d", i)))
+		}
+		root, version := tree.SaveVersion()
+		it, err := tree.GetImmutable(version)
+		assert.NoError(t, err)
+
+		for i := 0; i < n; i++ {
+			key := []byte(fmt.Sprintf("key%02d", 2*i))
+			value, proof := it.GetWithProof(key)
+			assert.Equal(t, []byte(fmt.Sprintf("value%d", i)), value)
+			assert.NoError(t, proof.Verify(root, key, value), "n=%d i=%d", n, i)
+			assert.Error(t, proof.Verify(root, key, []byte("other")))
+			assert.Error(t, proof.Verify(root, key, nil))
+		}
+
+		// before, between and after the keys
+		for i := -1; i < n; i++ {
+			key := []byte(fmt.Sprintf("key%02d", 2*i+1))
+			value, proof := it.GetWithProof(key)
+			assert.Nil(t, value)
+			assert.NoError(t, proof.Verify(root, key, nil), "n=%d i=%d", n, i)
+			assert.Error(t, proof.Verify(EmptyHash[:len(EmptyHash)-1], key, nil))
+		}
+	}
+}
+
+func TestAbsenceProofOfPresentKey(t *testing.T) {
+	tree := New()
+	tree.Set([]byte("a"), []byte("1"))
+	tree.Set([]byte("c"), []byte("3"))
+	root, _ := tree.SaveVersion()
+	it, _ := tree.GetImmutable(1)
+
+	// the neighbors of b do not prove a is absent
+	_, proof := it.GetWithProof([]byte("b"))
+	assert.NoError(t, proof.Verify(root, []byte("b"), nil))
+	assert.Error(t, proof.Verify(root, []byte("a"), nil))
+	assert.Error(t, proof.Verify(root, []byte("c"), nil))
+}
+
+func TestVersions(t *testing.T) {
+	tree := New()
+	assert.Equal(t, EmptyHash, tree.WorkingHash())
+
+	tree.Set([]byte("a"), []byte("1"))
+	working := tree.WorkingHash()
+	h1, v1 := tree.SaveVersion()
+	assert.Equal(t, working, h1)
+	assert.Equal(t, int64(1), v1)
+
+	tree.Set([]byte("a"), []byte("2"))
+	tree.Delete([]byte("a"))
+	h2, v2 := tree.SaveVersion()
+	assert.Equal(t, EmptyHash, h2)
+
+	it1, err := tree.GetImmutable(v1)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), it1.Get([]byte("a")))
+	it2, err := tree.GetImmutable(v2)
+	assert.NoError(t, err)
+	assert.Nil(t, it2.Get([]byte("a")))
+
+	tree.DeleteVersionsBefore(v2)
+	_, err = tree.GetImmutable(v1)
+	assert.ErrorIs(t, err, ErrVersionNotFound)
+}
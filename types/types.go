@@ -0,0 +1,61 @@
+// Package types is the stable API of the data an application embedding the
+// node exchanges with it: blocks, commits, votes, validator sets, the chain
+// state and the messages of the application interface.
+//
+// The types are aliases of the consensus ones, so values move freely between
+// the two packages. Applications should import them from here: the consensus
+// package may move its implementation around, types only changes with a new
+// major version of the module.
+package types
+
+import (
+	"github.com/QuarkChain/go-minimal-pbft/consensus"
+)
+
+// Chain data.
+type (
+	Header    = consensus.Header
+	FullBlock = consensus.FullBlock
+	Commit    = consensus.Commit
+	CommitSig = consensus.CommitSig
+	Vote      = consensus.Vote
+	Proposal  = consensus.Proposal
+
+	Validator    = consensus.Validator
+	ValidatorSet = consensus.ValidatorSet
+	PubKey       = consensus.PubKey
+
+	ChainState = consensus.ChainState
+	Genesis    = consensus.Genesis
+)
+
+// Application interface.
+type (
+	BlockFinalizer        = consensus.BlockFinalizer
+	FinalizeBlockRequest  = consensus.FinalizeBlockRequest
+	FinalizeBlockResponse = consensus.FinalizeBlockResponse
+	CommitInfo            = consensus.CommitInfo
+	VoteInfo              = consensus.VoteInfo
+	ValidatorUpdate       = consensus.ValidatorUpdate
+	JailUpdate            = consensus.JailUpdate
+
+	Application       = consensus.Application
+	BeginBlockRequest = consensus.BeginBlockRequest
+	ProposalValidator = consensus.ProposalValidator
+	TxChecker         = consensus.TxChecker
+	CheckTxResponse   = consensus.CheckTxResponse
+
+	Querier       = consensus.Querier
+	TxHasher      = consensus.TxHasher
+	QueryRequest  = consensus.QueryRequest
+	QueryResponse = consensus.QueryResponse
+)
+
+// Node components an application may replace.
+type (
+	BlockStore       = consensus.BlockStore
+	BlockExecutor    = consensus.BlockExecutor
+	Mempool          = consensus.Mempool
+	PrivValidator    = consensus.PrivValidator
+	ProposerSelector = consensus.ProposerSelector
+)